@@ -12,7 +12,7 @@ func main() {
 
 	err := cli.RootCommand.Execute()
 	if err != nil {
-		cli.SetError(err, 1)
+		cli.SetError(err)
 	}
 
 	cli.HandleErrors()
@@ -6,12 +6,15 @@ package cli
  */
 
 import (
+	"encoding/json"
 	"fmt"
+	"runtime"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vdisk"
 )
 
 var log elog.View
@@ -23,9 +26,11 @@ var (
 	flagDefault          bool
 	flagCompressionLevel uint
 	flagForce            bool
+	flagYes              bool
 	flagExcludeDefault   bool
-	flagFormat           string
+	flagFormats          []string
 	flagOutput           string
+	flagOutputs          []string
 	flagPlatform         string
 	flagName             string
 	flagKey              string
@@ -33,7 +38,25 @@ var (
 	flagOS               bool
 	flagRecord           string
 	flagShell            bool
+	flagShellSet         bool
 	flagTouched          bool
+	flagHardlinks        bool
+	flagAccessedSince    string
+	flagStrip            bool
+	flagTmpDir           string
+	flagTableFormat      string
+	flagSparse           bool
+	flagPolicy           string
+	flagBootloader       string
+	flagPreserveOwner    bool
+	flagResume           bool
+	flagAllowNoPrograms  bool
+	flagReservedBlocks   int
+	flagEncrypt          string
+	flagNoFollow         bool
+	flagVerifyModes      bool
+
+	flagEncryptionPassphraseFile string
 
 	pushOrganisation string
 	pushBucket       string
@@ -56,10 +79,16 @@ func InitializeCommands() {
 	addModifyFlags(provisionCmd.Flags())
 	addModifyFlags(unpackCmd.Flags())
 	addModifyFlags(packCmd.Flags())
+	addModifyFlags(packagesKernelCmd.Flags())
+	addModifyFlags(packagesFromRegistryCmd.Flags())
+	addModifyFlags(minimizeCmd.Flags())
+	addModifyFlags(sizesCmd.Flags())
 	// setup logging across all commands
 	RootCommand.PersistentFlags().BoolVarP(&flagVerbose, "verbose", "v", false, "enable verbose output")
 	RootCommand.PersistentFlags().BoolVarP(&flagDebug, "debug", "d", false, "enable debug output")
 	RootCommand.PersistentFlags().BoolVarP(&flagJSON, "json", "j", false, "enable json output")
+	RootCommand.PersistentFlags().BoolVar(&flagYes, "yes", false, "overwrite existing outputs without asking")
+	RootCommand.PersistentFlags().StringVar(&flagTableFormat, "table-format", "plain", "format of tables printed by listing commands (plain, csv, tsv)")
 
 	RootCommand.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
 
@@ -83,9 +112,17 @@ func InitializeCommands() {
 
 		log = logger
 
-		return nil
+		if f := cmd.Flags().Lookup("shell"); f != nil {
+			flagShellSet = f.Changed
+		}
+
+		return SetTableMode(flagTableFormat)
 	}
 
+	provisionCmd.AddCommand(provisionConsoleCmd)
+	provisionCmd.AddCommand(provisionExportCmd)
+	provisionCmd.AddCommand(provisionBatchCmd)
+
 	// Here we define some hidden top-level shortcuts.
 	RootCommand.AddCommand(commandShortcut(versionCmd))
 	RootCommand.AddCommand(commandShortcut(buildCmd))
@@ -98,6 +135,7 @@ func InitializeCommands() {
 
 	// Here is the visible command structure definition.
 	RootCommand.AddCommand(imagesCmd)
+	RootCommand.AddCommand(kernelsCmd)
 	RootCommand.AddCommand(packagesCmd)
 	RootCommand.AddCommand(projectsCmd)
 	RootCommand.AddCommand(provisionersCmd)
@@ -116,20 +154,40 @@ func InitializeCommands() {
 
 	addImagesCmd()
 
+	kernelsCmd.AddCommand(kernelsOptionsCmd)
+
 	packagesCmd.AddCommand(packCmd)
 	packagesCmd.AddCommand(unpackCmd)
+	packagesCmd.AddCommand(packagesKernelCmd)
+	packagesCmd.AddCommand(packagesSignalsCmd)
+	packagesCmd.AddCommand(packagesFromRegistryCmd)
+	packagesCmd.AddCommand(packagesAddCmd)
+	packagesCmd.AddCommand(packagesExtractVCFGCmd)
+	packagesCmd.AddCommand(packagesIconCmd)
+	packagesCmd.AddCommand(packagesCopyCmd)
+	packagesCmd.AddCommand(packagesProvenanceCmd)
+	packagesCmd.AddCommand(packagesPushCmd)
+	packagesCmd.AddCommand(packagesPullCmd)
+	packagesCmd.AddCommand(packagesRebaseCmd)
 
 	projectsCmd.AddCommand(newProjectCmd)
 	addModifyFlags(newProjectCmd.Flags())
 
 	projectsCmd.AddCommand(convertContainerCmd)
 	projectsCmd.AddCommand(importSharedObjectsCmd)
+	projectsCmd.AddCommand(buildAllCmd)
+	projectsCmd.AddCommand(projectsTargetsCmd)
 
 	provisionersCmd.AddCommand(provisionersNewCmd)
+	provisionersCmd.AddCommand(provisionersRekeyCmd)
+	provisionersCmd.AddCommand(provisionersDiffCmd)
+	provisionersCmd.AddCommand(provisionersTestCmd)
 
 	provisionersNewCmd.AddCommand(provisionersNewAmazonEC2Cmd)
 	provisionersNewCmd.AddCommand(provisionersNewAzureCmd)
 	provisionersNewCmd.AddCommand(provisionersNewGoogleCmd)
+	provisionersNewCmd.AddCommand(provisionersNewVSphereCmd)
+	provisionersNewCmd.AddCommand(provisionersNewLibvirtCmd)
 }
 
 // AddNewProvisionerCmd - Append a command to the `vorteil provisioners new` command
@@ -141,6 +199,7 @@ func addImagesCmd() {
 	imagesCmd.AddCommand(buildCmd)
 	imagesCmd.AddCommand(decompileCmd)
 	imagesCmd.AddCommand(provisionCmd)
+	imagesCmd.AddCommand(auditCmd)
 	imagesCmd.AddCommand(catCmd)
 	imagesCmd.AddCommand(cpCmd)
 	imagesCmd.AddCommand(duCmd)
@@ -150,8 +209,18 @@ func addImagesCmd() {
 	imagesCmd.AddCommand(gptCmd)
 	imagesCmd.AddCommand(lsCmd)
 	imagesCmd.AddCommand(md5Cmd)
+	imagesCmd.AddCommand(mkfsCmd)
+	imagesCmd.AddCommand(minimizeCmd)
+	imagesCmd.AddCommand(partitionsCmd)
+	imagesCmd.AddCommand(readblocksCmd)
+	imagesCmd.AddCommand(superblockCmd)
+	imagesCmd.AddCommand(patchCmd)
+	imagesCmd.AddCommand(resizeCmd)
+	imagesCmd.AddCommand(sizesCmd)
 	imagesCmd.AddCommand(statCmd)
 	imagesCmd.AddCommand(treeCmd)
+	imagesCmd.AddCommand(usageCmd)
+	imagesCmd.AddCommand(verifyCmd)
 }
 
 func commandShortcut(cmd *cobra.Command) *cobra.Command {
@@ -194,10 +263,18 @@ var versionCmd = &cobra.Command{
 			panic(err)
 		}
 
+		if flagJSON {
+			format = "json"
+		}
+
 		switch format {
 		case "json":
-			fmt.Printf("{\n\t\"version\": \"%s\",\n\t\"ref\": \"%s\",\n\t\"released\": \"%s\"\n}\n",
-				release, commit, date)
+			data, err := json.MarshalIndent(getVersionInfo(), "", "\t")
+			if err != nil {
+				SetError(err)
+				return
+			}
+			fmt.Println(string(data))
 		default:
 			fmt.Printf("Version: %s\nRef: %s\nReleased: %s\n", release, commit, date)
 		}
@@ -205,7 +282,27 @@ var versionCmd = &cobra.Command{
 	},
 }
 
+// versionInfo is what the version command prints as json, for tools that
+// wrap the CLI to check what it supports.
+type versionInfo struct {
+	Version   string   `json:"version"`
+	Ref       string   `json:"ref"`
+	Released  string   `json:"released"`
+	GoVersion string   `json:"go"`
+	Formats   []string `json:"formats"`
+}
+
+func getVersionInfo() *versionInfo {
+	return &versionInfo{
+		Version:   release,
+		Ref:       commit,
+		Released:  date,
+		GoVersion: runtime.Version(),
+		Formats:   vdisk.AllFormatStrings(),
+	}
+}
+
 func init() {
 	f := versionCmd.Flags()
-	f.String("format", "", "specify output format (json, plain)")
+	f.String("format", "", "specify output format (json, plain), or use --json")
 }
@@ -1,12 +1,27 @@
 package cli
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/vorteil/vorteil/pkg/provisioners"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vio"
 	"github.com/vorteil/vorteil/pkg/vpkg"
+	"github.com/vorteil/vorteil/pkg/vproj"
 )
 
 func TestHandleFileInjections(t *testing.T) {
@@ -51,3 +66,984 @@ func TestHandleFileInjections(t *testing.T) {
 	}
 
 }
+
+func TestCleanInjectionPath(t *testing.T) {
+
+	good := map[string]string{
+		"/":           "/",
+		"/etc":        "/etc",
+		"/etc/":       "/etc",
+		"//etc//app/": "/etc/app",
+		"/etc/./app":  "/etc/app",
+		"/./":         "/",
+		"/etc/..app":  "/etc/..app",
+	}
+	for dst, expect := range good {
+		clean, err := cleanInjectionPath(dst)
+		if err != nil {
+			t.Fatalf("expected '%s' to be accepted: %v", dst, err)
+		}
+		if clean != expect {
+			t.Fatalf("expected '%s' to be normalized to '%s', got '%s'", dst, expect, clean)
+		}
+	}
+
+	for _, dst := range []string{"", "etc", "./etc", "etc/app", "/..", "/etc/../app", "/etc/..", "../etc", "\\etc"} {
+		_, err := cleanInjectionPath(dst)
+		if err == nil {
+			t.Fatalf("expected '%s' to be rejected", dst)
+		}
+	}
+
+	f, err := ioutil.TempFile(os.TempDir(), "vorteil-test-")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	// every bad destination is reported
+	filesMap[f.Name()] = []string{"/ok", "relative", "/a/../b"}
+	defer delete(filesMap, f.Name())
+
+	err = handleFileInjections(vpkg.NewBuilder())
+	if err == nil || !strings.Contains(err.Error(), "relative") || !strings.Contains(err.Error(), "/a/../b") {
+		t.Fatalf("expected both bad destinations to be reported, got %v", err)
+	}
+}
+
+func TestKernelOptionsTable(t *testing.T) {
+
+	table := kernelOptionsTable([]string{"logs", "shell", "wasm"})
+
+	rows := make(map[string][]string)
+	for _, row := range table[1:] {
+		rows[row[0]] = row
+	}
+
+	for tag, expect := range map[string]string{
+		"shell":       "yes",
+		"logs":        "yes",
+		"ntp":         "no",
+		"kernel-args": "yes",
+		"wasm":        "yes",
+	} {
+		row, ok := rows[tag]
+		if !ok {
+			t.Fatalf("expected a row for '%s', got %v", tag, table)
+		}
+		if row[1] != expect {
+			t.Fatalf("expected '%s' support to be '%s', got '%s'", tag, expect, row[1])
+		}
+	}
+
+	// features the compiler can't ask for come last
+	if last := table[len(table)-1]; last[0] != "wasm" {
+		t.Fatalf("expected unknown features last, got %v", last)
+	}
+}
+
+func TestConfirmOverwrite(t *testing.T) {
+
+	for input, expect := range map[string]bool{
+		"y\n":     true,
+		" YES \n": true,
+		"y":       true,
+		"\n":      false,
+		"n\n":     false,
+		"":        false,
+		"sure\n":  false,
+	} {
+		out := new(bytes.Buffer)
+		if promptOverwrite("output", "disk.raw", strings.NewReader(input), out) != expect {
+			t.Fatalf("expected answer %q to give %v", input, expect)
+		}
+		if !strings.Contains(out.String(), "[y/N]") {
+			t.Fatalf("expected a [y/N] prompt, got %q", out.String())
+		}
+	}
+
+	f, err := ioutil.TempFile(os.TempDir(), "vorteil-test-")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	// tests don't run in a terminal, so there's nobody to ask
+	err = checkValidNewFileOutput(f.Name(), false, "output", "-f")
+	if err == nil {
+		t.Fatal("expected an existing output to be refused without a terminal")
+	}
+
+	flagYes = true
+	defer func() { flagYes = false }()
+
+	err = checkValidNewFileOutput(f.Name(), false, "output", "-f")
+	if err != nil {
+		t.Fatalf("expected --yes to allow an overwrite: %v", err)
+	}
+}
+
+func TestCommandErrorClasses(t *testing.T) {
+
+	base := errors.New("no such file")
+	err := fmt.Errorf("loading: %w", ErrSourceResolve.Wrap(base))
+
+	if !errors.Is(err, ErrSourceResolve) {
+		t.Fatal("expected error to be of class ErrSourceResolve")
+	}
+
+	if errors.Is(err, ErrDiskBuild) {
+		t.Fatal("expected error not to be of class ErrDiskBuild")
+	}
+
+	if !errors.Is(err, base) {
+		t.Fatal("expected error to unwrap to the original error")
+	}
+
+	if code := exitCode(err); code != ErrSourceResolve.ExitCode() {
+		t.Fatalf("expected exit code %d, got %d", ErrSourceResolve.ExitCode(), code)
+	}
+
+	if code := exitCode(base); code != errorExitCode {
+		t.Fatalf("expected exit code %d for an unclassified error, got %d", errorExitCode, code)
+	}
+
+	if code := exitCode(nil); code != 0 {
+		t.Fatalf("expected exit code 0 without an error, got %d", code)
+	}
+
+	// scripts rely on these to tell a failed build from a failed upload
+	for e, code := range map[*CommandError]int{ErrSourceResolve: 9, ErrDiskBuild: 15, ErrProvision: 19} {
+		if e.ExitCode() != code {
+			t.Fatalf("expected class '%s' to exit with %d, got %d", e.Class(), code, e.ExitCode())
+		}
+	}
+
+	if ErrProvision.Wrap(nil) != nil {
+		t.Fatal("expected wrapping nil to return nil")
+	}
+
+	classes := make(map[string]bool)
+	codes := make(map[int]bool)
+	for _, e := range []*CommandError{ErrSourceResolve, ErrInvalidConfig, ErrDiskBuild, ErrProvision, ErrRun} {
+		if classes[e.Class()] {
+			t.Fatalf("duplicate class '%s'", e.Class())
+		}
+		classes[e.Class()] = true
+		if codes[e.ExitCode()] || e.ExitCode() == errorExitCode {
+			t.Fatalf("class '%s' doesn't have its own exit code", e.Class())
+		}
+		codes[e.ExitCode()] = true
+	}
+}
+
+func TestParseAccessedSince(t *testing.T) {
+
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	since, err := parseAccessedSince("90m", now)
+	if err != nil || !since.Equal(now.Add(-90*time.Minute)) {
+		t.Fatalf("unexpected result for duration: %v, %v", since, err)
+	}
+
+	since, err = parseAccessedSince("2020-05-01T10:00:00Z", now)
+	if err != nil || !since.Equal(time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected result for timestamp: %v, %v", since, err)
+	}
+
+	since, err = parseAccessedSince("1590000000", now)
+	if err != nil || since.Unix() != 1590000000 {
+		t.Fatalf("unexpected result for unix time: %v, %v", since, err)
+	}
+
+	for _, s := range []string{"-1h", "yesterday"} {
+		_, err = parseAccessedSince(s, now)
+		if err == nil {
+			t.Fatalf("expected failure for '%s'", s)
+		}
+	}
+
+}
+
+func TestParseDataDisks(t *testing.T) {
+
+	disks, err := parseDataDisks([]string{"10 GiB", "512 MiB"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(disks) != 2 || disks[0] != int64(10*vcfg.GiB) || disks[1] != int64(512*vcfg.MiB) {
+		t.Fatalf("unexpected data disks: %v", disks)
+	}
+
+	for _, s := range []string{"0", "lots"} {
+		_, err = parseDataDisks([]string{s})
+		if err == nil {
+			t.Fatalf("expected failure for '%s'", s)
+		}
+	}
+
+}
+
+func TestParseTags(t *testing.T) {
+
+	tags, err := parseTags([]string{"team=core", "cost-centre=", "expr=a=b"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tags) != 3 || tags["team"] != "core" || tags["cost-centre"] != "" || tags["expr"] != "a=b" {
+		t.Fatalf("unexpected tags: %v", tags)
+	}
+
+	for _, pairs := range [][]string{{"team"}, {"=core"}, {"team=a", "team=b"}} {
+		_, err = parseTags(pairs)
+		if err == nil {
+			t.Fatalf("expected failure for %v", pairs)
+		}
+	}
+
+}
+
+func TestBatchPackages(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vorteil-batch")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = batchPackages(dir)
+	if err == nil {
+		t.Fatalf("expected failure for a directory without packages")
+	}
+
+	for _, name := range []string{"b.vorteil", "a.vorteil", "notes.txt"} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	err = os.Mkdir(filepath.Join(dir, "c.vorteil"), 0755)
+	if err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+
+	paths, err := batchPackages(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(paths) != 2 || paths[0] != filepath.Join(dir, "a.vorteil") || paths[1] != filepath.Join(dir, "b.vorteil") {
+		t.Fatalf("unexpected packages: %v", paths)
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+
+	header, err := parseHeaders([]string{"Authorization: Bearer abc", "x-mirror:eu", "X-Mirror: us"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if header.Get("Authorization") != "Bearer abc" || len(header["X-Mirror"]) != 2 {
+		t.Fatalf("unexpected headers: %v", header)
+	}
+
+	for _, v := range []string{"Authorization", ": value", "Bad Name: value"} {
+		_, err = parseHeaders([]string{v})
+		if err == nil {
+			t.Fatalf("expected failure for '%s'", v)
+		}
+	}
+
+}
+
+func TestUploadCopy(t *testing.T) {
+
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.Header.Get("X-Token") != "abc" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var err error
+		body, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	header := http.Header{"X-Token": []string{"abc"}}
+
+	_, err := uploadCopy(server.URL, header, func(w io.Writer) (*vpkg.PackageInfo, error) {
+		_, err := w.Write([]byte("package"))
+		return &vpkg.PackageInfo{}, err
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(body) != "package" {
+		t.Fatalf("server received '%s'", body)
+	}
+
+	// a failed copy fails the upload
+	body = nil
+	_, err = uploadCopy(server.URL, header, func(w io.Writer) (*vpkg.PackageInfo, error) {
+		w.Write([]byte("pack"))
+		return nil, vpkg.ErrChecksumMismatch
+	})
+	if !errors.Is(err, vpkg.ErrChecksumMismatch) {
+		t.Fatalf("expected a checksum error, got %v", err)
+	}
+	if body != nil {
+		t.Fatalf("server received a body from a failed upload: '%s'", body)
+	}
+
+}
+
+func TestPackageAdditions(t *testing.T) {
+
+	additions, err := parsePackageAdditions([]string{"etc/app.conf=./app.conf", "/data/=dir=x"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if additions[0] != (packageAddition{path: "/etc/app.conf", src: "./app.conf"}) ||
+		additions[1] != (packageAddition{path: "/data", src: "dir=x"}) {
+		t.Fatalf("unexpected additions: %+v", additions)
+	}
+
+	for _, arg := range []string{"app.conf", "=app.conf", "/etc/app.conf=", "/=dir"} {
+		_, err = parsePackageAdditions([]string{arg})
+		if err == nil {
+			t.Fatalf("expected failure for '%s'", arg)
+		}
+	}
+
+	dir, err := ioutil.TempDir(os.TempDir(), "vorteil-test-")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	err = os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "sub", "file"), []byte("data"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	existing := map[string]bool{
+		"/":          true,
+		"/etc":       true,
+		"/etc/sub":   true,
+		"/etc/other": false,
+	}
+
+	// directories merge with existing directories
+	conflict, err := packageAddConflict(existing, dir, "/etc")
+	if err != nil || conflict != "" {
+		t.Fatalf("unexpected conflict: '%s', %v", conflict, err)
+	}
+
+	existing["/etc/sub/file"] = false
+
+	conflict, err = packageAddConflict(existing, dir, "/etc")
+	if err != nil || conflict != "/etc/sub/file" {
+		t.Fatalf("expected conflict not found: '%s', %v", conflict, err)
+	}
+
+	conflict, err = packageAddConflict(existing, filepath.Join(dir, "sub", "file"), "/etc/other")
+	if err != nil || conflict != "/etc/other" {
+		t.Fatalf("expected conflict not found: '%s', %v", conflict, err)
+	}
+
+}
+
+func TestTempDir(t *testing.T) {
+
+	defer os.Setenv("VORTEIL_TMPDIR", os.Getenv("VORTEIL_TMPDIR"))
+
+	os.Setenv("VORTEIL_TMPDIR", "")
+	if tempDir() != os.TempDir() {
+		t.Fatalf("expected system temp dir, got %s", tempDir())
+	}
+
+	os.Setenv("VORTEIL_TMPDIR", "/env")
+	if tempDir() != "/env" {
+		t.Fatalf("expected VORTEIL_TMPDIR, got %s", tempDir())
+	}
+
+	flagTmpDir = "/flag"
+	defer func() { flagTmpDir = "" }()
+	if tempDir() != "/flag" {
+		t.Fatalf("expected --tmpdir, got %s", tempDir())
+	}
+
+	avail, err := vio.FreeSpace(os.TempDir())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if avail >= 0 {
+		err = checkFreeSpace(os.TempDir(), avail+1<<40)
+		if err == nil {
+			t.Fatal("expected failure; not enough free space")
+		}
+	}
+
+	err = checkFreeSpace(os.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+}
+
+func TestGetEncryption(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vorteil-cli")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "passphrase")
+	err = ioutil.WriteFile(path, []byte("secret\r\n"), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	defer func() { flagEncryptionPassphraseFile = "" }()
+
+	_, err = getEncryption("metadata")
+	if err == nil {
+		t.Fatal("expected failure; no passphrase file")
+	}
+
+	flagEncryptionPassphraseFile = path
+
+	encryption, err := getEncryption("metadata")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if string(encryption.Passphrase) != "secret" {
+		t.Fatalf("expected trailing newline to be trimmed from passphrase, got %q", encryption.Passphrase)
+	}
+
+	_, err = getEncryption("keyring")
+	if err == nil {
+		t.Fatal("expected failure; unsupported key source")
+	}
+
+	err = ioutil.WriteFile(path, []byte("\n"), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err = getEncryption("metadata")
+	if err == nil {
+		t.Fatal("expected failure; empty passphrase")
+	}
+
+}
+
+func TestOpenVCFGFromURL(t *testing.T) {
+
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/base.vcfg" {
+			http.NotFound(w, r)
+			return
+		}
+		requests++
+		fmt.Fprint(w, "[system]\n  hostname = \"remote\"\n")
+	}))
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		f, err := openVCFG(srv.URL + "/base.vcfg")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		cfg, err := vcfg.LoadFile(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		if cfg.System.Hostname != "remote" {
+			t.Fatalf("unexpected hostname: %s", cfg.System.Hostname)
+		}
+	}
+
+	if requests != 1 {
+		t.Fatalf("expected the vcfg to be downloaded once, got %d requests", requests)
+	}
+
+	_, err := openVCFG(srv.URL + "/missing.vcfg")
+	if err == nil {
+		t.Fatal("expected failure; vcfg does not exist")
+	}
+
+}
+
+func TestDelimitedTables(t *testing.T) {
+
+	vals := [][]string{
+		{"NAME", "DETAIL"},
+		{"a", "plain"},
+		{"b,c", "say \"hi\""},
+		{"d\te", "two\nlines"},
+	}
+
+	buf := new(bytes.Buffer)
+	err := csvTable(buf, vals)
+	if err != nil {
+		t.Fatalf("failed to write csv: %v", err)
+	}
+
+	expect := "NAME,DETAIL\na,plain\n\"b,c\",\"say \"\"hi\"\"\"\nd\te,\"two\nlines\"\n"
+	if buf.String() != expect {
+		t.Fatalf("csv table is wrong: %q", buf.String())
+	}
+
+	buf.Reset()
+	err = tsvTable(buf, vals)
+	if err != nil {
+		t.Fatalf("failed to write tsv: %v", err)
+	}
+
+	expect = "NAME\tDETAIL\na\tplain\nb,c\tsay \"hi\"\nd e\ttwo lines\n"
+	if buf.String() != expect {
+		t.Fatalf("tsv table is wrong: %q", buf.String())
+	}
+
+	err = SetTableMode("xml")
+	if err == nil {
+		t.Fatalf("unsupported table format accepted")
+	}
+
+}
+
+func TestPromptProjectTarget(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vorteil-targets")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, ".vorteilproject"), []byte(`
+[[target]]
+	name = "debug"
+[[target]]
+[[target]]
+	name = "prod"
+`), 0644)
+	if err != nil {
+		t.Fatalf("failed to write project file: %v", err)
+	}
+
+	for _, tc := range []struct {
+		src, input, expect string
+	}{
+		{dir, "\n", dir},
+		{dir, "2\n", dir + ":prod"},
+		{dir, "5\nx\n2\n", dir + ":prod"},
+		{dir + ":debug", "", dir + ":debug"},
+	} {
+		out := new(bytes.Buffer)
+		src, err := promptProjectTarget(tc.src, strings.NewReader(tc.input), out)
+		if err != nil {
+			t.Fatalf("unexpected error for input %q: %v", tc.input, err)
+		}
+		if src != tc.expect {
+			t.Fatalf("input %q selected '%s', expected '%s'", tc.input, src, tc.expect)
+		}
+	}
+
+	_, err = promptProjectTarget(dir, strings.NewReader(""), ioutil.Discard)
+	if err == nil {
+		t.Fatalf("expected an error when nothing is selected")
+	}
+
+	src, err := promptProjectTarget(filepath.Join(dir, "missing"), strings.NewReader(""), ioutil.Discard)
+	if err != nil || src != filepath.Join(dir, "missing") {
+		t.Fatalf("expected a source that isn't a project to be left alone, got '%s' (%v)", src, err)
+	}
+}
+
+type streamTestProvisioner struct {
+	provisioners.Provisioner
+}
+
+func (p *streamTestProvisioner) DiskFormat() vdisk.Format {
+	return vdisk.GCPFArchiveFormat
+}
+
+func (p *streamTestProvisioner) SizeAlign() vcfg.Bytes {
+	return 0
+}
+
+func (p *streamTestProvisioner) WantsCompressed() bool {
+	return true
+}
+
+func (p *streamTestProvisioner) Provision(args *provisioners.ProvisionArgs) error {
+	_, err := ioutil.ReadAll(args.Image)
+	return err
+}
+
+// closeCountingReader counts how many times the package reader is closed.
+type closeCountingReader struct {
+	vpkg.Reader
+	closed int
+}
+
+func (r *closeCountingReader) Close() error {
+	r.closed++
+	if r.closed > 1 {
+		return nil
+	}
+	return r.Reader.Close()
+}
+
+func TestProvisionPackageCloses(t *testing.T) {
+
+	for _, data := range []string{"not a vcfg", ""} {
+
+		b := vpkg.NewBuilder()
+		err := b.SetVCFG(vio.CustomFile(vio.CustomFileArgs{
+			Name:       "default.vcfg",
+			Size:       len(data),
+			ReadCloser: ioutil.NopCloser(strings.NewReader(data)),
+		}))
+		if err != nil {
+			t.Fatalf("failed to set vcfg: %v", err)
+		}
+
+		pkgReader, err := vpkg.ReaderFromBuilder(b)
+		if err != nil {
+			t.Fatalf("failed to create package reader: %v", err)
+		}
+
+		// an invalid vcfg fails before anything is built, and a valid one
+		// fails while the disk is streamed into the upload
+		r := &closeCountingReader{Reader: pkgReader}
+		err = provisionPackage(new(streamTestProvisioner), r, new(provisioners.ProvisionArgs), "")
+		if err == nil {
+			t.Fatalf("expected provisioning %q to fail", data)
+		}
+		if r.closed != 1 {
+			t.Fatalf("package reader for %q closed %d times, expected once", data, r.closed)
+		}
+	}
+}
+
+func TestStreamProvision(t *testing.T) {
+
+	b := vpkg.NewBuilder()
+	vcfgData := []byte("not a vcfg")
+	err := b.SetVCFG(vio.CustomFile(vio.CustomFileArgs{
+		Name:       "default.vcfg",
+		Size:       len(vcfgData),
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(vcfgData)),
+	}))
+	if err != nil {
+		t.Fatalf("failed to set vcfg: %v", err)
+	}
+
+	pkgReader, err := vpkg.ReaderFromBuilder(b)
+	if err != nil {
+		t.Fatalf("failed to create package reader: %v", err)
+	}
+	defer pkgReader.Close()
+
+	prov := new(streamTestProvisioner)
+	args := new(provisioners.ProvisionArgs)
+
+	// the build fails straight away because the vcfg is invalid, which the
+	// provisioner sees as a read error
+	buildErr, err := streamProvision(prov, &vdisk.BuildArgs{
+		PackageReader: pkgReader,
+		Format:        prov.DiskFormat(),
+	}, args)
+	if buildErr == nil {
+		t.Fatalf("expected a build error")
+	}
+	if err == nil || err.Error() != buildErr.Error() {
+		t.Fatalf("expected the provisioner to fail reading with the build error, got %v", err)
+	}
+	if args.Image == nil || args.Image.Size() != 0 {
+		t.Fatalf("expected the provisioner to be given a stream")
+	}
+}
+
+func TestVersionInfo(t *testing.T) {
+
+	data, err := json.Marshal(getVersionInfo())
+	if err != nil {
+		t.Fatalf("failed to marshal version info: %v", err)
+	}
+
+	info := make(map[string]interface{})
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		t.Fatalf("failed to unmarshal version info: %v", err)
+	}
+
+	for _, key := range []string{"version", "ref", "released", "go", "formats"} {
+		if _, ok := info[key]; !ok {
+			t.Fatalf("version info is missing '%s': %s", key, data)
+		}
+	}
+
+	formats, _ := info["formats"].([]interface{})
+	if len(formats) != len(vdisk.AllFormatStrings()) {
+		t.Fatalf("expected %d formats, got %v", len(vdisk.AllFormatStrings()), info["formats"])
+	}
+}
+
+func TestProvisionersTestSubcommand(t *testing.T) {
+
+	cmd := provisionersTestSubcommand(provisionersNewAmazonEC2Cmd, "AWS", newAmazonEC2Provisioner)
+	if cmd.Use != "amazon-ec2" {
+		t.Fatalf("expected the subcommand to be named after the new command, got '%s'", cmd.Use)
+	}
+
+	for _, name := range []string{"key", "secret", "region", "bucket"} {
+		if cmd.Flags().Lookup(name) != provisionersNewAmazonEC2Cmd.Flags().Lookup(name) {
+			t.Fatalf("expected flag '%s' to be shared with the new command", name)
+		}
+	}
+
+	if cmd.Flags().Lookup("passphrase") != nil {
+		t.Fatalf("expected no passphrase flag, because nothing is encrypted")
+	}
+}
+
+func TestParseBuildOutputs(t *testing.T) {
+
+	formats, outputs, err := parseBuildOutputs("app.vorteil", []string{"raw", "vmdk"}, nil)
+	if err != nil {
+		t.Fatalf("failed to parse outputs: %v", err)
+	}
+	if len(formats) != 2 || formats[0] != vdisk.RAWFormat || formats[1] != vdisk.VMDKFormat {
+		t.Fatalf("unexpected formats: %v", formats)
+	}
+	if len(outputs) != 2 || outputs[0] != "app.raw" || outputs[1] != "app.vmdk" {
+		t.Fatalf("expected outputs named after the package, got %v", outputs)
+	}
+
+	_, outputs, err = parseBuildOutputs(".", []string{"raw", "xva"}, []string{"out/a.raw", "out/a.xva"})
+	if err != nil {
+		t.Fatalf("failed to parse outputs: %v", err)
+	}
+	if outputs[0] != "out/a.raw" || outputs[1] != "out/a.xva" {
+		t.Fatalf("expected the given outputs, got %v", outputs)
+	}
+
+	formats, outputs, err = parseBuildOutputs("app", nil, nil)
+	if err != nil {
+		t.Fatalf("failed to parse outputs: %v", err)
+	}
+	if len(formats) != 1 || formats[0] != vdisk.VMDKFormat || outputs[0] != "app.vmdk" {
+		t.Fatalf("expected the default format, got %v for %v", formats, outputs)
+	}
+
+	formats, _, err = parseBuildOutputs("app", nil, []string{"app.vmdk", "app.vhd"})
+	if err != nil {
+		t.Fatalf("failed to parse outputs: %v", err)
+	}
+	if len(formats) != 2 || formats[0] != vdisk.VMDKFormat || formats[1] != vdisk.VHDFormat {
+		t.Fatalf("expected formats inferred from the outputs, got %v", formats)
+	}
+
+	for _, c := range []struct {
+		formats, outputs []string
+	}{
+		{[]string{"raw", "vmdk"}, []string{"app.raw"}},
+		{[]string{"raw", "qcow2"}, nil},
+		{[]string{"raw", "gcp"}, nil},
+		{[]string{"vmdk", "stream-optimized-vmdk"}, nil},
+		{[]string{"raw", "raw"}, []string{"app.raw", "./app.raw"}},
+		{nil, []string{"app.img"}},
+		{nil, []string{"app.raw", "app.tar.gz"}},
+	} {
+		_, _, err = parseBuildOutputs("app", c.formats, c.outputs)
+		if err == nil {
+			t.Fatalf("expected an error for formats %v and outputs %v", c.formats, c.outputs)
+		}
+	}
+}
+
+func TestBuildAllResults(t *testing.T) {
+
+	format := vdisk.RAWFormat
+	targets := []*vproj.Target{{Name: "debug"}, {}}
+	results, err := buildAllResults(targets, "out", format)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, expect := range []string{"debug", "default"} {
+		if results[i].target != expect {
+			t.Fatalf("target %d is called '%s', expected '%s'", i, results[i].target, expect)
+		}
+		output := filepath.Join("out", expect+format.Suffix())
+		if results[i].output != output {
+			t.Fatalf("target %d is written to '%s', expected '%s'", i, results[i].output, output)
+		}
+	}
+
+	for _, names := range [][]string{
+		{"../x"},
+		{"a/b"},
+		{`a\b`},
+		{".."},
+		{"x", "x"},
+		{"default", ""},
+	} {
+		var targets []*vproj.Target
+		for _, name := range names {
+			targets = append(targets, &vproj.Target{Name: name})
+		}
+		_, err = buildAllResults(targets, "out", format)
+		if err == nil {
+			t.Fatalf("expected an error for targets %q", names)
+		}
+	}
+}
+
+type exportTestProvisioner struct {
+	provisioners.Provisioner
+	err error
+}
+
+func (p *exportTestProvisioner) Export(ctx context.Context, name string, w io.Writer) error {
+	_, err := io.WriteString(w, "exported "+name)
+	if err != nil {
+		return err
+	}
+	return p.err
+}
+
+func TestExportImage(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vorteil-export")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.raw")
+	err = ioutil.WriteFile(path, []byte("original"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	prov := &exportTestProvisioner{err: errors.New("export failed")}
+	err = exportImage(context.Background(), prov, "app", path)
+	if err == nil {
+		t.Fatalf("expected the export error to be returned")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if string(data) != "original" {
+		t.Fatalf("failed export replaced the output with %q", data)
+	}
+
+	prov.err = nil
+	err = exportImage(context.Background(), prov, "app", path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if string(data) != "exported app" {
+		t.Fatalf("output contains %q, expected %q", data, "exported app")
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %v", err)
+	}
+	if len(fis) != 1 {
+		t.Fatalf("expected only the output in %s, found %d files", dir, len(fis))
+	}
+}
+
+func TestRekeySecret(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vorteil-key")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "provisioner.key")
+	err = ioutil.WriteFile(keyFile, []byte("secret key\n"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+
+	secret, err := rekeySecret("pass", "")
+	if err != nil || secret != "pass" {
+		t.Fatalf("expected the passphrase, got %q, %v", secret, err)
+	}
+
+	expect, err := provisioners.ReadKeyFile(keyFile)
+	if err != nil {
+		t.Fatalf("failed to read key file: %v", err)
+	}
+
+	secret, err = rekeySecret("", keyFile)
+	if err != nil || secret != expect {
+		t.Fatalf("expected the key file's contents, got %q, %v", secret, err)
+	}
+
+	_, err = rekeySecret("pass", keyFile)
+	if err == nil {
+		t.Fatalf("expected an error for both a passphrase and a key file")
+	}
+}
+
+func TestRescueShell(t *testing.T) {
+
+	defer func() {
+		flagShell = false
+		flagShellSet = false
+	}()
+
+	cfg := new(vcfg.VCFG)
+	cfg.System.RescueShell = true
+
+	if !rescueShell(cfg) {
+		t.Fatalf("expected the VCFG's rescue-shell without --shell")
+	}
+
+	flagShellSet = true
+	if rescueShell(cfg) {
+		t.Fatalf("expected --shell=false to override the VCFG's rescue-shell")
+	}
+
+	cfg.System.RescueShell = false
+	flagShell = true
+	if !rescueShell(cfg) {
+		t.Fatalf("expected --shell to override the VCFG's rescue-shell")
+	}
+}
@@ -100,6 +100,7 @@ func initKernels() error {
 	vkern.Global = ksrc
 	vimg.GetKernel = ksrc.Get
 	vimg.GetLatestKernel = vkern.ConstructGetLastestKernelsFunc(&ksrc)
+	vimg.ListKernels = ksrc.List
 
 	return nil
 
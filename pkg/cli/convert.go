@@ -50,13 +50,13 @@ repositories:
 
 		cc, err := vconvert.NewContainerConverter(args[0], config, log)
 		if err != nil {
-			SetError(err, 1)
+			SetError(err)
 			return
 		}
 
 		err = cc.ConvertToProject(args[1], user, pwd)
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
 	},
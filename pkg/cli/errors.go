@@ -0,0 +1,97 @@
+package cli
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ExitCoder is implemented by errors that know which exit code the process
+// should terminate with.
+type ExitCoder interface {
+	ExitCode() int
+}
+
+// CommandError classifies the failure of a command. The exported Err*
+// values are the classes; use Wrap to attach an underlying error to one. The
+// result can be matched with errors.Is against its class, and unwrapped to
+// reach the original error. The process exits with the code of the class.
+type CommandError struct {
+	class string
+	code  int
+	err   error
+}
+
+// errorExitCode is the exit code for errors that haven't been classified.
+const errorExitCode = 1
+
+// Error classes and their exit codes. Source, build, and provision errors
+// keep the codes 'provision' has always exited with for them, which scripts
+// use to tell a bad package from a failed build or a failed upload.
+var (
+	// ErrSourceResolve : a buildable, package, or other input couldn't be found or loaded
+	ErrSourceResolve = &CommandError{class: "source", code: 9}
+	// ErrInvalidConfig : the VCFG or command line configuration is invalid
+	ErrInvalidConfig = &CommandError{class: "config", code: 10}
+	// ErrDiskBuild : building a disk image failed
+	ErrDiskBuild = &CommandError{class: "build", code: 15}
+	// ErrProvision : provisioning to a remote platform failed
+	ErrProvision = &CommandError{class: "provision", code: 19}
+	// ErrRun : running a virtual machine failed
+	ErrRun = &CommandError{class: "run", code: 20}
+)
+
+// Wrap returns a new error of the same class as e, wrapping err.
+func (e *CommandError) Wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &CommandError{class: e.class, code: e.code, err: err}
+}
+
+// Error implements the error interface.
+func (e *CommandError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("%s error", e.class)
+	}
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *CommandError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether target is of the same class as e.
+func (e *CommandError) Is(target error) bool {
+	t, ok := target.(*CommandError)
+	return ok && t.class == e.class
+}
+
+// Class returns the name of the class of e, like 'build'.
+func (e *CommandError) Class() string {
+	return e.class
+}
+
+// ExitCode returns the exit code for the class of e.
+func (e *CommandError) ExitCode() int {
+	return e.code
+}
+
+// exitCode returns the exit code the process should terminate with after err:
+// zero if there was no error, the code of the first ExitCoder it wraps, or
+// errorExitCode.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var ec ExitCoder
+	if errors.As(err, &ec) {
+		return ec.ExitCode()
+	}
+	return errorExitCode
+}
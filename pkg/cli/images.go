@@ -7,18 +7,25 @@ package cli
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/vorteil/vorteil/pkg/ext"
 	"github.com/vorteil/vorteil/pkg/imagetools"
+	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vdecompiler"
 	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/vio"
 	"github.com/vorteil/vorteil/pkg/vpkg"
 )
 
@@ -28,10 +35,25 @@ var imagesCmd = &cobra.Command{
 	Long: `The ultimate purpose of any Vorteil app is to become a virtual machine. These
 commands are responsible for creating the virtual disk images that are an
 important step along the way. These commands also include helper and utility
-functions that operate on existing Vorteil virtual disk images.`,
+functions that operate on existing Vorteil virtual disk images.
+
+On Linux, commands that read an existing disk image also accept a block device
+such as /dev/sdb in place of an image file.
+
+Images with an encrypted root partition can be read once they are unlocked by
+giving their passphrase with --encryption-passphrase-file.
+
+Paths within an image's file-system follow symlinks in their directories, like
+on a real file-system, unless --no-follow is set.`,
 	Aliases: []string{"disks"},
 }
 
+func init() {
+	f := imagesCmd.PersistentFlags()
+	f.StringVar(&flagEncryptionPassphraseFile, "encryption-passphrase-file", "", "file holding the passphrase of the image's encrypted root partition")
+	f.BoolVar(&flagNoFollow, "no-follow", false, "don't follow symlinks in paths within the image's file-system")
+}
+
 var buildCmd = &cobra.Command{
 	Use:   "build [BUILDABLE]",
 	Short: "Create a virtual disk image",
@@ -51,6 +73,18 @@ must be a valid Vorteil project.
 Supported disk formats include:
 
 	xva, raw, vmdk, stream-optimized-vmdk, vhd, vhd-dynamic
+
+Several images can be written from a single build of the file-system by giving
+more than one format, e.g. '--format raw,vmdk'. Each --output is paired with
+the format in the same position, so '--format raw,vmdk -o app.raw -o app.vmdk'
+writes both images, and if no --output is given each image is named after
+BUILDABLE with the format's file extension. Images written together share a
+disk size, aligned to suit all of their formats.
+
+If --format isn't given, the format of each --output is inferred from its file
+extension, so '-o app.vmdk' writes a VMDK. Extensions shared by several
+formats choose the format named after them, like vmdk for '.vmdk' and vhd for
+'.vhd'. Without either, a vmdk is written.
 `,
 	Aliases: []string{"new", "create", "make"},
 	Args:    cobra.MaximumNArgs(1),
@@ -61,100 +95,243 @@ Supported disk formats include:
 			buildablePath = args[0]
 		}
 
-		format, err := parseImageFormat(flagFormat)
+		// the format is only inferred from the outputs if it isn't given
+		formatArgs := flagFormats
+		if !cmd.Flags().Changed("format") {
+			formatArgs = nil
+		}
+
+		formats, outputPaths, err := parseBuildOutputs(buildablePath, formatArgs, flagOutputs)
 		if err != nil {
-			SetError(err, 1)
+			SetError(err)
 			return
 		}
-		suffix := format.Suffix()
 
-		_, base := filepath.Split(strings.TrimSuffix(filepath.ToSlash(buildablePath), "/"))
-		outputPath := filepath.Join(".", strings.TrimSuffix(base, vpkg.Suffix)+suffix)
-		if flagOutput != "" {
-			outputPath = flagOutput
-			if !strings.HasSuffix(outputPath, suffix) {
-				log.Warnf("file name does not end with '%s' file extension", suffix)
+		for _, outputPath := range outputPaths {
+			err = checkValidNewFileOutput(outputPath, flagForce, "output", "-f")
+			if err != nil {
+				SetError(err)
+				return
 			}
 		}
 
-		err = checkValidNewFileOutput(outputPath, flagForce, "output", "-f")
-		if err != nil {
-			SetError(err, 2)
-			return
-		}
-
-		pkgBuilder, err := getPackageBuilder("BUILDABLE", buildablePath)
+		pkgBuilder, err := getTargetPackageBuilder("BUILDABLE", buildablePath)
 		if err != nil {
-			SetError(err, 3)
+			SetError(err)
 			return
 		}
 		defer pkgBuilder.Close()
 
 		err = modifyPackageBuilder(pkgBuilder)
 		if err != nil {
-			SetError(err, 4)
+			SetError(err)
 			return
 		}
 
 		pkgReader, err := vpkg.ReaderFromBuilder(pkgBuilder)
 		if err != nil {
-			SetError(err, 5)
+			SetError(err)
 			return
 		}
 		defer pkgReader.Close()
 
-		err = initKernels()
+		pkgReader, err = checkPrograms(pkgReader)
 		if err != nil {
-			SetError(err, 6)
+			SetError(err)
 			return
 		}
 
-		f, err := os.Create(outputPath)
+		err = initKernels()
 		if err != nil {
-			SetError(err, 7)
+			SetError(err)
 			return
 		}
-		defer f.Close()
 
-		err = vdisk.Build(context.Background(), f, &vdisk.BuildArgs{
+		var bootloader vio.File
+		if flagBootloader != "" {
+			bootloader, err = vio.Open(flagBootloader)
+			if err != nil {
+				SetError(err)
+				return
+			}
+		}
+
+		var encryption *vimg.Encryption
+		if flagEncrypt != "" {
+			encryption, err = getEncryption(flagEncrypt)
+			if err != nil {
+				SetError(err)
+				return
+			}
+		}
+
+		files := make([]*vio.AtomicFile, len(outputPaths))
+		for i, outputPath := range outputPaths {
+			files[i], err = vio.AtomicCreate(outputPath, 0666)
+			if err != nil {
+				SetError(err)
+				return
+			}
+			defer files[i].Close()
+		}
+
+		buildArgs := &vdisk.BuildArgs{
 			WithVCFGDefaults: true,
 			PackageReader:    pkgReader,
-			Format:           format,
+			Format:           formats[0],
 			KernelOptions: vdisk.KernelOptions{
 				Shell: flagShell,
 			},
-			Logger: log,
-		})
-		if err != nil {
-			SetError(err, 8)
-			return
+			Logger:                log,
+			Strip:                 flagStrip,
+			Sparse:                flagSparse,
+			Bootloader:            bootloader,
+			Encryption:            encryption,
+			AllowNoPrograms:       flagAllowNoPrograms,
+			ReservedBlocksPercent: flagReservedBlocks,
+			TempDir:               tempDir(),
 		}
 
-		err = f.Close()
+		if len(files) == 1 {
+			err = vdisk.Build(context.Background(), files[0].File, buildArgs)
+		} else {
+			err = buildOutputs(buildArgs, formats, files)
+		}
 		if err != nil {
-			SetError(err, 9)
+			SetError(ErrDiskBuild.Wrap(err))
 			return
 		}
 
+		for _, f := range files {
+			err = f.Commit()
+			if err != nil {
+				SetError(err)
+				return
+			}
+		}
+
 		err = pkgReader.Close()
 		if err != nil {
-			SetError(err, 10)
+			SetError(err)
 			return
 		}
 
 		// TODO: progress tracking
-		log.Printf("created image: %s", outputPath)
+		for _, outputPath := range outputPaths {
+			log.Printf("created image: %s", outputPath)
+		}
 
 	},
 }
 
+// defaultBuildFormat is the format the build command writes if it's given
+// neither a --format nor an --output to infer one from.
+const defaultBuildFormat = "vmdk"
+
+// parseBuildOutputs pairs each of the formats given to the build command with
+// the output at the same position, naming the outputs after buildablePath if
+// there are none, and checks that they can all be written by one build. If
+// no formats are given they're inferred from the outputs' file extensions.
+func parseBuildOutputs(buildablePath string, formatArgs, outputArgs []string) ([]vdisk.Format, []string, error) {
+
+	if len(formatArgs) == 0 && len(outputArgs) == 0 {
+		formatArgs = []string{defaultBuildFormat}
+	}
+
+	var formats []vdisk.Format
+	if len(formatArgs) == 0 {
+		formats = make([]vdisk.Format, len(outputArgs))
+		for i, output := range outputArgs {
+			format, err := vdisk.FormatFromExtension(output)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%w -- use --format to choose one", err)
+			}
+			formats[i] = format
+		}
+	} else {
+		formats = make([]vdisk.Format, len(formatArgs))
+		for i, s := range formatArgs {
+			format, err := parseImageFormat(s)
+			if err != nil {
+				return nil, nil, err
+			}
+			formats[i] = format
+		}
+	}
+
+	err := vdisk.CheckOutputFormats(formats)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	outputs := make([]string, len(formats))
+	if len(outputArgs) == 0 {
+		_, base := filepath.Split(strings.TrimSuffix(filepath.ToSlash(buildablePath), "/"))
+		for i, format := range formats {
+			outputs[i] = filepath.Join(".", strings.TrimSuffix(base, vpkg.Suffix)+format.Suffix())
+		}
+	} else if len(outputArgs) != len(formats) {
+		return nil, nil, fmt.Errorf("got %d outputs for %d formats: give a --format for each --output", len(outputArgs), len(formats))
+	} else {
+		for i, output := range outputArgs {
+			if suffix := formats[i].Suffix(); !strings.HasSuffix(output, suffix) {
+				log.Warnf("file name '%s' does not end with '%s' file extension", output, suffix)
+			}
+			outputs[i] = output
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, output := range outputs {
+		path, err := filepath.Abs(output)
+		if err != nil {
+			return nil, nil, err
+		}
+		if seen[path] {
+			return nil, nil, fmt.Errorf("more than one image would be written to '%s'", output)
+		}
+		seen[path] = true
+	}
+
+	return formats, outputs, nil
+}
+
+// buildOutputs builds an image in each of formats, writing them to files,
+// from a single build of the file-system.
+func buildOutputs(args *vdisk.BuildArgs, formats []vdisk.Format, files []*vio.AtomicFile) error {
+
+	scratch, err := ioutil.TempFile(tempDir(), "vorteil-build-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(scratch.Name())
+	defer scratch.Close()
+
+	outputs := make([]vdisk.Output, len(files))
+	for i, f := range files {
+		outputs[i] = vdisk.Output{
+			Format: formats[i],
+			W:      f.File,
+		}
+	}
+
+	return vdisk.BuildOutputs(context.Background(), scratch, args, outputs)
+}
+
 func init() {
 	f := buildCmd.Flags()
 	f.BoolVarP(&flagForce, "force", "f", false, "force overwrite of existing files")
-	f.StringVarP(&flagOutput, "output", "o", "", "path to put image file")
+	f.StringArrayVarP(&flagOutputs, "output", "o", nil, "path to put image file (repeatable, one for each format)")
 	f.StringVarP(&flagKey, "key", "k", "", "vrepo authentication key")
-	f.StringVar(&flagFormat, "format", "vmdk", "disk image format")
-	f.BoolVar(&flagShell, "shell", false, "add a busybox shell environment to the image")
+	f.StringSliceVar(&flagFormats, "format", []string{defaultBuildFormat}, "disk image format, or a comma-separated list of formats to write together (inferred from the --output file extensions if not given)")
+	f.BoolVar(&flagShell, "shell", false, "add a busybox shell environment to the image (overrides system.rescue-shell)")
+	f.BoolVar(&flagStrip, "strip", false, "remove debugging information and symbol tables from ELF binaries")
+	f.BoolVar(&flagSparse, "sparse", false, "skip writing empty regions, leaving holes in the output file (faster for large images)")
+	f.StringVar(&flagBootloader, "bootloader", "", "write this boot code to the MBR instead of the built-in bootloader (at most 446 bytes, or a 512 byte MBR)")
+	f.StringVar(&flagEncrypt, "encrypt", "", "encrypt the root partition with LUKS, unlocked at boot with a passphrase from SOURCE (metadata, console)")
+	f.StringVar(&flagEncryptionPassphraseFile, "encryption-passphrase-file", "", "file holding the passphrase of the image's encrypted root partition")
+	f.BoolVar(&flagAllowNoPrograms, "allow-no-programs", false, "build the package even if it defines no programs, e.g. for a data-only disk")
+	f.IntVar(&flagReservedBlocks, "reserved-blocks-percent", 0, "percentage of the ext file-system's blocks to reserve for the superuser (0 to 50)")
 }
 
 var decompileCmd = &cobra.Command{
@@ -165,10 +342,21 @@ var decompileCmd = &cobra.Command{
 
 		srcPath := args[0]
 		outPath := args[1]
+
+		var since time.Time
+		if flagAccessedSince != "" {
+			var err error
+			since, err = parseAccessedSince(flagAccessedSince, time.Now())
+			if err != nil {
+				SetError(err)
+				return
+			}
+		}
+
 		decompileSpinner := log.NewProgress("Decompiling Disk", "", 0)
 		defer decompileSpinner.Finish(true)
-		if err := runDecompile(srcPath, outPath, flagTouched); err != nil {
-			SetError(err, 1)
+		if err := runDecompile(srcPath, outPath, flagTouched, flagHardlinks, flagPreserveOwner, flagResume, since); err != nil {
+			SetError(err)
 		}
 		decompileSpinner.Finish(true)
 		log.Printf("Decompile Completed")
@@ -178,6 +366,36 @@ var decompileCmd = &cobra.Command{
 func init() {
 	f := decompileCmd.Flags()
 	f.BoolVarP(&flagTouched, "touched", "t", false, "Only extract files that have been 'touched'.")
+	f.BoolVar(&flagPreserveOwner, "preserve-owner", false, "Give extracted files the owner and group they have on the image (needs root).")
+	f.StringVar(&flagEncryptionPassphraseFile, "encryption-passphrase-file", "", "File holding the passphrase of the image's encrypted root partition.")
+	f.BoolVar(&flagNoFollow, "no-follow", false, "Don't follow symlinks in paths within the image's file-system.")
+	f.BoolVar(&flagHardlinks, "hardlinks", false, "Recreate hardlinked files as hardlinks instead of copies.")
+	f.BoolVar(&flagResume, "resume", false, "Resume an interrupted decompile, keeping files already extracted if their size and digest match the image.")
+	f.StringVar(&flagAccessedSince, "accessed-since", "", "Only extract files accessed since a duration ago (e.g. 1h) or a timestamp.")
+}
+
+// parseAccessedSince resolves the value of --accessed-since, which is either a
+// duration before now, a timestamp, or a number of seconds since the epoch.
+func parseAccessedSince(s string, now time.Time) (time.Time, error) {
+
+	if d, err := time.ParseDuration(s); err == nil {
+		if d < 0 {
+			return time.Time{}, fmt.Errorf("--accessed-since duration cannot be negative: %s", s)
+		}
+		return now.Add(-d), nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+
+	return time.Time{}, fmt.Errorf("--accessed-since must be a duration or a timestamp: %s", s)
 }
 
 var catCmd = &cobra.Command{
@@ -188,9 +406,9 @@ var catCmd = &cobra.Command{
 		img := args[0]
 
 		// Create Vorteil Image Object From Image
-		vImageIO, err := vdecompiler.Open(img)
+		vImageIO, err := openImage(img)
 		if err != nil {
-			SetError(err, 1)
+			SetError(err)
 			return
 		}
 		defer vImageIO.Close()
@@ -201,14 +419,14 @@ var catCmd = &cobra.Command{
 			// Get Reader
 			rdr, err := imagetools.CatImageFile(vImageIO, fpath, flagOS)
 			if err != nil {
-				SetError(err, 2)
+				SetError(err)
 				return
 			}
 
 			// Copy Contents
 			_, err = io.Copy(os.Stdout, rdr)
 			if err != nil {
-				SetError(err, 3)
+				SetError(err)
 				return
 			}
 
@@ -229,9 +447,9 @@ var cpCmd = &cobra.Command{
 
 		img := args[0]
 
-		iio, err := vdecompiler.Open(img)
+		iio, err := openImage(img)
 		if err != nil {
-			SetError(err, 1)
+			SetError(err)
 			return
 		}
 		defer iio.Close()
@@ -254,53 +472,79 @@ func init() {
 var duCmd = &cobra.Command{
 	Use:   "du IMAGE [FILEPATH]",
 	Short: "Calculate file space usage.",
-	Args:  cobra.RangeArgs(1, 2),
+	Long: `Calculate the space used by each directory in an image's file-system, sorted
+with the largest first. FILEPATH defaults to "/". Sizes count the blocks each
+file occupies unless --apparent is set.`,
+	Args: cobra.RangeArgs(1, 2),
 	Run: func(cmd *cobra.Command, args []string) {
 		err := SetNumberModeFlagCMD(cmd)
 		if err != nil {
-			SetError(err, 1)
+			SetError(err)
 			return
 		}
 		img := args[0]
 
-		iio, err := vdecompiler.Open(img)
+		iio, err := openImage(img)
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
 		defer iio.Close()
 
 		all, err := cmd.Flags().GetBool("all")
 		if err != nil {
-			SetError(err, 3)
+			SetError(err)
 			return
 		}
 
 		free, err := cmd.Flags().GetBool("free")
 		if err != nil {
-			SetError(err, 4)
+			SetError(err)
 			return
 		}
 
 		maxDepth, err := cmd.Flags().GetInt("max-depth")
 		if err != nil {
-			SetError(err, 5)
+			SetError(err)
+			return
+		}
+
+		if cmd.Flags().Changed("depth") {
+			maxDepth, err = cmd.Flags().GetInt("depth")
+			if err != nil {
+				SetError(err)
+				return
+			}
+		}
+
+		apparent, err := cmd.Flags().GetBool("apparent")
+		if err != nil {
+			SetError(err)
 			return
 		}
 
-		table := [][]string{{"", ""}}
+		table := [][]string{{"PATH", "SIZE"}}
 
 		var fpath string = "/"
 		if len(args) > 1 {
 			fpath = args[1]
 		}
 
-		duOut, err := imagetools.DUImageFile(iio, fpath, free, maxDepth, all)
+		duOut, err := imagetools.DUImage(iio, fpath, imagetools.DUOptions{
+			CalcFreeSpace: free,
+			MaxDepth:      maxDepth,
+			All:           all,
+			Apparent:      apparent,
+		})
 		if err != nil {
-			SetError(err, 6)
+			SetError(err)
 			return
 		}
 
+		sort.SliceStable(duOut.ImageFiles, func(i, j int) bool {
+			return duOut.ImageFiles[i].FileSize > duOut.ImageFiles[j].FileSize
+		})
+
 		for i := range duOut.ImageFiles {
 			table = append(table, []string{duOut.ImageFiles[i].FilePath, fmt.Sprintf("%s", PrintableSize(duOut.ImageFiles[i].FileSize))})
 		}
@@ -317,6 +561,8 @@ func init() {
 	f.BoolP("all", "a", false, "Write counts for all files, not just directories.")
 	f.BoolP("free", "f", false, "Add a free-space estimation at the end.")
 	f.IntP("max-depth", "l", -1, "Print the total only if the file is within a certain depth.")
+	f.Int("depth", -1, "Limit the breakdown to this many levels below FILEPATH (same as --max-depth).")
+	f.Bool("apparent", false, "Print apparent sizes rather than disk usage.")
 	f.StringP("numbers", "n", "short", "Number printing format")
 }
 
@@ -327,16 +573,16 @@ var formatCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		img := args[0]
 
-		iio, err := vdecompiler.Open(img)
+		iio, err := openImage(img)
 		if err != nil {
-			SetError(err, 1)
+			SetError(err)
 			return
 		}
 		defer iio.Close()
 
 		format, err := iio.ImageFormat()
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
 
@@ -351,19 +597,19 @@ var fsCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		err := SetNumberModeFlagCMD(cmd)
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
-		iio, err := vdecompiler.Open(args[0])
+		iio, err := openImage(args[0])
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
 		defer iio.Close()
 
 		fsReport, err := imagetools.FSImageFile(iio)
 		if err != nil {
-			SetError(err, 3)
+			SetError(err)
 			return
 		}
 
@@ -372,6 +618,7 @@ var fsCmd = &cobra.Command{
 		log.Printf("Type:             \t%s", fsReport.Type)
 		log.Printf("Block size:       \t%s", PrintableSize(fsReport.BlockSize))
 		log.Printf("Blocks allocated: \t%s / %s", PrintableSize(fsReport.BlocksAllocated), PrintableSize(fsReport.BlocksAvaliable))
+		log.Printf("Blocks reserved:  \t%s", PrintableSize(fsReport.ReservedBlocks))
 		log.Printf("Inodes allocated: \t%s / %s", PrintableSize(fsReport.InodesAllocated), PrintableSize(fsReport.InodesAvaliable))
 
 		log.Printf("Block groups:     \t%s", PrintableSize(fsReport.BlockGroups))
@@ -401,15 +648,15 @@ var fsimgCmd = &cobra.Command{
 		img := args[0]
 		dst := args[1]
 
-		iio, err := vdecompiler.Open(img)
+		iio, err := openImage(img)
 		if err != nil {
-			SetError(err, 1)
+			SetError(err)
 			return
 		}
 		defer iio.Close()
 
 		if err := imagetools.FSIMGImage(iio, dst); err != nil {
-			SetError(err, 2)
+			SetError(err)
 
 		}
 	},
@@ -422,21 +669,21 @@ var gptCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		err := SetNumberModeFlagCMD(cmd)
 		if err != nil {
-			SetError(err, 1)
+			SetError(err)
 			return
 		}
 		img := args[0]
 
-		iio, err := vdecompiler.Open(img)
+		iio, err := openImage(img)
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
 		defer iio.Close()
 
 		gptOut, err := imagetools.ImageGPT(iio)
 		if err != nil {
-			SetError(err, 3)
+			SetError(err)
 			return
 		}
 
@@ -466,7 +713,7 @@ var lsCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		err := SetNumberModeFlagCMD(cmd)
 		if err != nil {
-			SetError(err, 1)
+			SetError(err)
 			return
 		}
 		var reiterating bool
@@ -493,9 +740,9 @@ var lsCmd = &cobra.Command{
 
 		img := args[0]
 
-		iio, err := vdecompiler.Open(img)
+		iio, err := openImage(img)
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
 		defer iio.Close()
@@ -513,19 +760,19 @@ var lsCmd = &cobra.Command{
 
 		if flagOS {
 			if fpath != "/" && fpath != "" && fpath != "." {
-				SetError(fmt.Errorf("bad FILE_PATH for vorteil partition: %s", fpath), 3)
+				SetError(fmt.Errorf("bad FILE_PATH for vorteil partition: %s", fpath))
 				return
 			}
 
 			kfiles, err := iio.KernelFiles()
 			if err != nil {
-				SetError(err, 4)
+				SetError(err)
 				return
 			}
 
 			if long {
 				var table [][]string
-				table = [][]string{{"", "", "", "", "", "", ""}}
+				table = [][]string{{"PERMISSIONS", "LINKS", "UID", "GID", "MODIFIED", "SIZE", "NAME"}}
 				for _, kf := range kfiles {
 					table = append(table, []string{"----------", "?", "-", "-", "-", fmt.Sprintf("%s", PrintableSize(kf.Size)), kf.Name})
 				}
@@ -540,14 +787,14 @@ var lsCmd = &cobra.Command{
 
 		ino, err := iio.ResolvePathToInodeNo(fpath)
 		if err != nil {
-			SetError(err, 5)
+			SetError(err)
 			return
 		}
 
 	inoEntry:
 		inode, err := iio.ResolveInode(ino)
 		if err != nil {
-			SetError(err, 6)
+			SetError(err)
 			return
 		}
 
@@ -567,7 +814,7 @@ var lsCmd = &cobra.Command{
 
 		entries, err = iio.Readdir(inode)
 		if err != nil {
-			SetError(err, 7)
+			SetError(err)
 			return
 		}
 
@@ -576,7 +823,7 @@ var lsCmd = &cobra.Command{
 		}
 
 		if long {
-			table = [][]string{{"", "", "", "", "", "", ""}}
+			table = [][]string{{"PERMISSIONS", "LINKS", "UID", "GID", "MODIFIED", "SIZE", "NAME"}}
 		}
 
 		for _, entry := range entries {
@@ -594,7 +841,7 @@ var lsCmd = &cobra.Command{
 			if long {
 				child, err := iio.ResolveInode(entry.Inode)
 				if err != nil {
-					SetError(err, 8)
+					SetError(err)
 					return
 				}
 				links := "?"
@@ -670,7 +917,7 @@ var md5Cmd = &cobra.Command{
 		fpath := args[1]
 		imageFileMD5, err := imagetools.MDSumImageFile(img, fpath, flagOS)
 		if err != nil {
-			SetError(err, 1)
+			SetError(err)
 			return
 		}
 
@@ -691,7 +938,7 @@ var statCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		err := SetNumberModeFlagCMD(cmd)
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
 		img := args[0]
@@ -703,19 +950,31 @@ var statCmd = &cobra.Command{
 
 		fileStat, err := imagetools.StatImageFile(img, fpath, flagOS)
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
+			return
+		}
+
+		fields := [][]string{
+			{"File", fileStat.FileName},
+			{"Size", fmt.Sprintf("%s", PrintableSize(fileStat.Size))},
+			{"Inode", fmt.Sprintf("%d", fileStat.Inode)},
+			{"Permissions", fileStat.Permissions},
+			{"Uid", fmt.Sprintf("%d (%s)", fileStat.UID, fileStat.User)},
+			{"Gid", fmt.Sprintf("%d (%s)", fileStat.GID, fileStat.Group)},
+			{"Access", fmt.Sprintf("%s", fileStat.Access)},
+			{"Modify", fmt.Sprintf("%s", fileStat.Modify)},
+			{"Create", fmt.Sprintf("%s", fileStat.Create)},
+		}
+
+		// delimited output gets one row per field, so that it can be parsed
+		if TableMode != 0 {
+			PlainTable(append([][]string{{"FIELD", "VALUE"}}, fields...))
 			return
 		}
 
-		log.Printf("File: %s", fileStat.FileName)
-		log.Printf("Size: %s", PrintableSize(fileStat.Size))
-		log.Printf("Inode: %d", fileStat.Inode)
-		log.Printf("Permissions: %s", fileStat.Permissions)
-		log.Printf("Uid: %d (%s)", fileStat.UID, fileStat.User)
-		log.Printf("Gid: %d (%s)", fileStat.GID, fileStat.Group)
-		log.Printf("Access: %s", fileStat.Access)
-		log.Printf("Modify: %s", fileStat.Modify)
-		log.Printf("Create: %s", fileStat.Create)
+		for _, f := range fields {
+			log.Printf("%s: %s", f[0], f[1])
+		}
 	},
 }
 
@@ -739,7 +998,7 @@ var treeCmd = &cobra.Command{
 
 		treeResults, err := imagetools.TreeImageFile(img, fpath, flagOS)
 		if err != nil {
-			SetError(err, 1)
+			SetError(err)
 			return
 		}
 
@@ -752,3 +1011,884 @@ func init() {
 	f := treeCmd.Flags()
 	f.BoolVarP(&flagOS, "vpartition", "p", false, "Read files from the Vorteil OS partition instead of the file-system partition.")
 }
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify IMAGE PACKAGE",
+	Short: "Compare the files on a disk image against a package.",
+	Long: `Compare the file-system on IMAGE against the file tree of PACKAGE, reporting
+files that were added, removed, or changed. Files are compared by type, size,
+and content digest, and by permission bits with --modes. Exits with a non-zero
+status if any differences are found.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		iio, err := openImage(args[0])
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer iio.Close()
+
+		pkgr, err := vpkg.Open(args[1])
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer pkgr.Close()
+
+		report, err := imagetools.VerifyImage(iio, pkgr.FS(), imagetools.VerifyOptions{
+			Modes: flagVerifyModes,
+		})
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		if !report.Mismatch() {
+			log.Printf("Disk matches package.")
+			return
+		}
+
+		table := [][]string{{"RESULT", "PATH", "DETAIL"}}
+		for _, f := range report.Files {
+			table = append(table, []string{f.Result.String(), f.Path, f.Detail})
+		}
+		PlainTable(table)
+
+		SetError(fmt.Errorf("disk does not match package: %d difference(s)", len(report.Files)))
+	},
+}
+
+func init() {
+	f := verifyCmd.Flags()
+	f.BoolVar(&flagVerifyModes, "modes", false, "Also compare permission bits, for disks built with file modes preserved.")
+}
+
+var auditCmd = &cobra.Command{
+	Use:   "audit IMAGE",
+	Short: "Check a disk image against a policy.",
+	Long: `Check IMAGE against the rules in a policy file, reporting whether each rule
+passed. Rules about programs and settings are checked against the VCFG stored
+on the disk, and rules about files against its file-system. Exits with a
+non-zero status if any rule fails.
+
+The policy is a YAML or JSON file supporting these rules:
+
+  no-root-programs: true    # no program may run with root privilege
+  required-files:           # paths that must exist on the file-system
+    - /app
+  forbidden-files:          # paths that must not exist on the file-system
+    - /bin/sh
+  read-only-root: true      # the root file-system must be mounted read-only
+  no-debug: true            # no program may use strace, and no network tcpdump`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		data, err := ioutil.ReadFile(flagPolicy)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		policy, err := imagetools.LoadAuditPolicy(data)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		iio, err := openImage(args[0])
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer iio.Close()
+
+		report, err := imagetools.AuditImage(iio, policy)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		if len(report.Results) == 0 {
+			log.Printf("Policy has no rules to check.")
+			return
+		}
+
+		table := [][]string{{"RULE", "RESULT", "DETAIL"}}
+		for _, res := range report.Results {
+			result := "pass"
+			if !res.Passed {
+				result = "fail"
+			}
+			table = append(table, []string{res.Rule, result, res.Detail})
+		}
+		PlainTable(table)
+
+		if n := report.Failed(); n > 0 {
+			SetError(fmt.Errorf("disk does not satisfy policy: %d rule(s) failed", n))
+		}
+	},
+}
+
+func init() {
+	f := auditCmd.Flags()
+	f.StringVar(&flagPolicy, "policy", "", "Path to the policy file to check against.")
+	auditCmd.MarkFlagRequired("policy")
+}
+
+var partitionsCmd = &cobra.Command{
+	Use:   "partitions IMAGE",
+	Short: "Show the partition layout of a disk image.",
+	Long: `List the partitions in the MBR of IMAGE, followed by those in its GUID
+Partition Table if it has one. The file-system in each partition is shown where
+it can be detected.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := SetNumberModeFlagCMD(cmd)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		iio, err := openImage(args[0])
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer iio.Close()
+
+		partitions, err := iio.Partitions()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		table := [][]string{{"TABLE", "#", "NAME", "START", "SIZE", "TYPE", "BOOTABLE", "FILESYSTEM"}}
+		for _, p := range partitions {
+			bootable := "no"
+			if p.Bootable {
+				bootable = "yes"
+			}
+			fs := p.Filesystem
+			if fs == "" {
+				fs = "-"
+			}
+			name := p.Name
+			if name == "" {
+				name = "-"
+			}
+			table = append(table, []string{
+				p.Table,
+				fmt.Sprintf("%d", p.Index),
+				name,
+				PrintableSize(int(p.Start())).String(),
+				PrintableSize(int(p.Size())).String(),
+				p.Type,
+				bootable,
+				fs,
+			})
+		}
+		PlainTable(table)
+	},
+}
+
+func init() {
+	f := partitionsCmd.Flags()
+	f.StringP("numbers", "n", "short", "Number printing format")
+}
+
+var (
+	superblockGroup int
+	superblockRaw   bool
+)
+
+var superblockCmd = &cobra.Command{
+	Use:   "superblock IMAGE",
+	Short: "Show every field of the file-system's superblock.",
+	Long: `Show every field of the ext superblock of IMAGE's file-system, annotated with
+what it means where that isn't obvious, followed by a summary of the block group
+descriptor table. This is a low-level debugging tool: use 'fs' for a summary.
+
+Backup superblocks can be shown with --group, and --raw adds a hexdump of the
+bytes reserved for the superblock.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := SetNumberModeFlagCMD(cmd)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		iio, err := openImage(args[0])
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer iio.Close()
+
+		report, err := imagetools.ImageSuperblock(iio, superblockGroup)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		log.Printf("Block group:\t%d", report.Group)
+		log.Printf("Offset:     \t%s", PrintableSize(int(report.Offset)))
+
+		table := [][]string{{"OFFSET", "FIELD", "VALUE", "DETAIL"}}
+		for _, field := range report.Fields {
+			value := field.Text
+			if field.IsNumber {
+				value = PrintableSize(int(field.Number)).String()
+			}
+			table = append(table, []string{
+				fmt.Sprintf("0x%03X", field.Offset),
+				field.Name,
+				value,
+				field.Detail,
+			})
+		}
+		PlainTable(table)
+
+		if report.BGDT == nil {
+			log.Warnf("Superblock signature is invalid, so the block group descriptor table wasn't read.")
+		} else {
+			table = [][]string{{"GROUP", "BLOCK BITMAP", "INODE BITMAP", "INODE TABLE", "FREE BLOCKS", "FREE INODES", "DIRECTORIES"}}
+			for i, bg := range report.BGDT {
+				table = append(table, []string{
+					fmt.Sprintf("%d", i),
+					PrintableSize(int(bg.BlockBitmapBlockAddr)).String(),
+					PrintableSize(int(bg.InodeBitmapBlockAddr)).String(),
+					PrintableSize(int(bg.InodeTableBlockAddr)).String(),
+					PrintableSize(int(bg.UnallocatedBlocks)).String(),
+					PrintableSize(int(bg.UnallocatedInodes)).String(),
+					PrintableSize(int(bg.Directories)).String(),
+				})
+			}
+			PlainTable(table)
+		}
+
+		if superblockRaw {
+			log.Printf("%s", strings.TrimSuffix(hex.Dump(report.Raw), "\n"))
+		}
+	},
+}
+
+func init() {
+	f := superblockCmd.Flags()
+	f.StringP("numbers", "n", "short", "Number printing format")
+	f.IntVarP(&superblockGroup, "group", "g", 0, "Block group to read a backup superblock from.")
+	f.BoolVar(&superblockRaw, "raw", false, "Also print a hexdump of the superblock.")
+}
+
+var (
+	readblocksStart int64
+	readblocksCount int64
+)
+
+var readblocksCmd = &cobra.Command{
+	Use:   "readblocks IMAGE",
+	Short: "Copy a range of file-system blocks out of an image.",
+	Long: `Copy --count blocks of IMAGE's file-system, starting at block --start, to a
+file. Blocks are numbered from the start of the file-system partition and are
+the size given by its superblock, so block numbers from 'superblock' and
+'stat' can be used as they are. This is a low-level debugging tool for
+inspecting metadata regions: use 'cp' to extract files.`,
+	Example: `  $ vorteil images readblocks disk.raw --start 1 --count 1 -o bgdt.bin`,
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := SetNumberModeFlagCMD(cmd)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		err = checkValidNewFileOutput(flagOutput, flagForce, "output", "-f")
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		iio, err := openImage(args[0])
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer iio.Close()
+
+		report, err := imagetools.ReadBlocks(iio, readblocksStart, readblocksCount, flagOutput)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		log.Printf("Block size:\t%s", PrintableSize(int(report.BlockSize)))
+		log.Printf("Blocks:    \t%d to %d", report.Start, report.Start+report.Count-1)
+		log.Printf("Copied %s to %s", PrintableSize(int(report.Size)), flagOutput)
+	},
+}
+
+func init() {
+	f := readblocksCmd.Flags()
+	f.StringP("numbers", "n", "short", "Number printing format")
+	f.Int64Var(&readblocksStart, "start", 0, "First file-system block to copy.")
+	f.Int64Var(&readblocksCount, "count", 1, "Number of blocks to copy.")
+	f.StringVarP(&flagOutput, "output", "o", "", "Path to write the blocks to.")
+	f.BoolVarP(&flagForce, "force", "f", false, "force overwrite of existing files")
+	readblocksCmd.MarkFlagRequired("output")
+}
+
+var usageCmd = &cobra.Command{
+	Use:   "usage IMAGE",
+	Short: "Show free space and fragmentation of the file-system.",
+	Long: `Scan the block bitmaps of IMAGE's file-system to count its used and free blocks,
+and find the largest run of contiguous free blocks. Fragmentation is the share
+of free blocks outside that run: 0% means all free space is in one piece.
+
+This shows whether there's room to grow files without rebuilding the image,
+like with 'patch'.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := SetNumberModeFlagCMD(cmd)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		iio, err := openImage(args[0])
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer iio.Close()
+
+		u, err := iio.BlockUsage()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		table := [][]string{
+			{"", "BLOCKS", "SIZE"},
+			{"Total", PrintableSize(int(u.Blocks)).String(), PrintableSize(int(u.Blocks * u.BlockSize)).String()},
+			{"Used", PrintableSize(int(u.UsedBlocks)).String(), PrintableSize(int(u.UsedBlocks * u.BlockSize)).String()},
+			{"Free", PrintableSize(int(u.FreeBlocks)).String(), PrintableSize(int(u.FreeBlocks * u.BlockSize)).String()},
+			{"Largest free extent", PrintableSize(int(u.LargestFreeExtent)).String(), PrintableSize(int(u.LargestFreeExtent * u.BlockSize)).String()},
+		}
+		PlainTable(table)
+
+		log.Printf("Block size:   \t%s", PrintableSize(int(u.BlockSize)))
+		log.Printf("Free extents: \t%d", u.FreeExtents)
+		log.Printf("Fragmentation:\t%.1f%%", u.Fragmentation()*100)
+	},
+}
+
+func init() {
+	f := usageCmd.Flags()
+	f.StringP("numbers", "n", "short", "Number printing format")
+}
+
+var patchCmd = &cobra.Command{
+	Use:   "patch IMAGE FILEPATH NEWFILE",
+	Short: "Replace the contents of a file on a disk image in-place.",
+	Long: `Replace the contents of the regular file at FILEPATH on IMAGE with the contents
+of NEWFILE, without rebuilding the image.
+
+The file is overwritten in-place, so NEWFILE must fit within the blocks
+already allocated to FILEPATH: it must be the same size or smaller than the
+original file, rounded up to the file-system block size. Only raw images can
+be patched.`,
+	Args: cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		f, err := os.Open(args[2])
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		if !fi.Mode().IsRegular() {
+			SetError(fmt.Errorf("NEWFILE must be a regular file: %s", args[2]))
+			return
+		}
+
+		err = imagetools.PatchImageFile(args[0], args[1], f, fi.Size())
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		log.Printf("Patched %s", args[1])
+	},
+}
+
+var resizeCmd = &cobra.Command{
+	Use:   "resize IMAGE SIZE",
+	Short: "Grow a disk image and its file-system.",
+	Long: `Grow IMAGE to SIZE (e.g. 2GiB), without rebuilding it.
+
+The root partition is extended to fill the new space and the ext file-system
+on it is grown to match, so everything added fills the file-system's free
+space. SIZE must be larger than the image and a multiple of the file-system
+block size (4 KiB). Shrinking an image is not supported. Only raw images can
+be resized.
+
+The image is resized in-place unless an output path is given, in which case
+IMAGE is copied there first and left unchanged.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		size, err := vcfg.ParseBytes(args[1])
+		if err != nil {
+			SetError(fmt.Errorf("invalid size: %w", err))
+			return
+		}
+
+		path := args[0]
+		if flagOutput != "" {
+			err = checkValidNewFileOutput(flagOutput, flagForce, "output", "-f")
+			if err != nil {
+				SetError(err)
+				return
+			}
+
+			err = copyImageFile(path, flagOutput)
+			if err != nil {
+				SetError(err)
+				return
+			}
+			path = flagOutput
+		}
+
+		err = imagetools.ResizeImage(path, int64(size))
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		log.Printf("Resized %s to %s", path, size)
+	},
+}
+
+func init() {
+	f := resizeCmd.Flags()
+	f.StringVarP(&flagOutput, "output", "o", "", "path to write the resized image to instead of resizing IMAGE in-place")
+	f.BoolVarP(&flagForce, "force", "f", false, "force overwrite of existing files")
+}
+
+// copyImageFile copies the image at src to a new file at dst.
+func copyImageFile(src, dst string) error {
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := vio.AtomicCreate(dst, 0666)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+
+	return out.Commit()
+}
+
+var mkfsSize string
+
+var mkfsCmd = &cobra.Command{
+	Use:   "mkfs DIR OUTPUT",
+	Short: "Create a file-system image from a directory.",
+	Long: `Create a bare ext file-system image at OUTPUT containing the contents of DIR.
+
+Unlike the build command, no VCFG, kernel, bootloader, or partition table is
+involved: the output is only a file-system, which makes it useful as a data
+disk to attach to a VM alongside its boot disk. File permissions and symlinks
+are preserved.
+
+If no size is given the image is made as small as possible while still
+containing everything in DIR.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		dir := args[0]
+		outputPath := args[1]
+
+		size, err := vcfg.ParseBytes(mkfsSize)
+		if err != nil {
+			SetError(fmt.Errorf("invalid size: %w", err))
+			return
+		}
+
+		fi, err := os.Stat(dir)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		if !fi.IsDir() {
+			SetError(fmt.Errorf("DIR must be a directory: %s", dir))
+			return
+		}
+
+		err = checkValidNewFileOutput(outputPath, flagForce, "output", "-f")
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		tree, err := vio.FileTreeFromDirectory(dir)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer tree.Close()
+
+		f, err := vio.AtomicCreate(outputPath, 0666)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer f.Close()
+
+		n, err := vdisk.BuildFilesystem(context.Background(), f, &vdisk.FilesystemArgs{
+			FileTree: tree,
+			Logger:   log,
+			Size:     size,
+		})
+		if err != nil {
+			SetError(ErrDiskBuild.Wrap(err))
+			return
+		}
+
+		err = f.Truncate(n)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		err = f.Commit()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		log.Printf("created file-system image: %s (%s)", outputPath, vcfg.Bytes(n))
+	},
+}
+
+func init() {
+	f := mkfsCmd.Flags()
+	f.StringVar(&mkfsSize, "size", "", "size of the file-system image, e.g. 256MiB")
+	f.BoolVarP(&flagForce, "force", "f", false, "force overwrite of existing files")
+}
+
+var (
+	minimizeDryRun bool
+	minimizeFormat string
+	minimizeKeep   []string
+)
+
+var minimizeCmd = &cobra.Command{
+	Use:   "minimize IMAGE OUTPUT",
+	Short: "Rebuild an image with only the files it uses.",
+	Long: `Rebuild IMAGE at OUTPUT, keeping only the files that were touched while IMAGE
+was running, the binaries of its programs, and anything given with --keep.
+Everything else is removed. This is an aggressive size optimization for
+appliances that never need anything they didn't touch: run the image through
+everything it's expected to do before minimizing it.
+
+The new image is built with the VCFG stored in IMAGE, in the same format unless
+--format is given. An image with an absolute disk size is rebuilt as small as
+possible: use --vm.disk-size to leave room for the programs to write to. Use
+--dry-run to list the files that would be removed, and how much space they
+take, without building anything.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		err := SetNumberModeFlagCMD(cmd)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		img := args[0]
+		outputPath := args[1]
+
+		iio, err := openImage(img)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer iio.Close()
+
+		cfg, err := iio.VCFG()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		plan, err := imagetools.PlanMinimize(iio, cfg, minimizeKeep)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		if plan.Touched == 0 {
+			SetError(fmt.Errorf("no files in '%s' have been touched: run it before minimizing it", img))
+			return
+		}
+
+		if minimizeDryRun {
+			table := [][]string{{"PATH", "SIZE"}}
+			for _, file := range plan.Removed {
+				table = append(table, []string{file.Path, PrintableSize(file.Size).String()})
+			}
+			PlainTable(table)
+			log.Printf("Would remove %d of %d files, saving %s", len(plan.Removed), len(plan.Removed)+len(plan.Kept), PrintableSize(plan.RemovedSize))
+			return
+		}
+
+		format, err := iio.ImageFormat()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		if minimizeFormat != "" {
+			format, err = parseImageFormat(minimizeFormat)
+			if err != nil {
+				SetError(err)
+				return
+			}
+		}
+
+		err = checkValidNewFileOutput(outputPath, flagForce, "output", "-f")
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		dir, err := ioutil.TempDir(tempDir(), "vorteil-minimize-")
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		root := filepath.Join(dir, "fs")
+		_, err = imagetools.ExtractMinimized(iio, plan, root)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		if !cfg.VM.DiskSize.IsDelta() {
+			cfg.VM.DiskSize = 0
+		}
+
+		pkgBuilder := vpkg.NewBuilder()
+		defer pkgBuilder.Close()
+
+		err = handleDirectory(root, ".", pkgBuilder)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		f, err := cfg.File()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		err = pkgBuilder.SetVCFG(f)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		err = modifyPackageBuilder(pkgBuilder)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		pkgReader, err := vpkg.ReaderFromBuilder(pkgBuilder)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer pkgReader.Close()
+
+		err = initKernels()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		out, err := vio.AtomicCreate(outputPath, 0666)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer out.Close()
+
+		err = vdisk.Build(context.Background(), out.File, &vdisk.BuildArgs{
+			WithVCFGDefaults: true,
+			PackageReader:    pkgReader,
+			Format:           format,
+			Logger:           log,
+		})
+		if err != nil {
+			SetError(ErrDiskBuild.Wrap(err))
+			return
+		}
+
+		err = out.Commit()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		log.Printf("created image: %s (removed %d files, %s)", outputPath, len(plan.Removed), PrintableSize(plan.RemovedSize))
+	},
+}
+
+func init() {
+	f := minimizeCmd.Flags()
+	f.BoolVar(&minimizeDryRun, "dry-run", false, "list the files that would be removed without building anything")
+	f.StringVar(&minimizeFormat, "format", "", "disk image format (default: the format of IMAGE)")
+	f.StringSliceVar(&minimizeKeep, "keep", nil, "keep this file, or everything in this directory, even if it wasn't touched")
+	f.BoolVarP(&flagForce, "force", "f", false, "force overwrite of existing files")
+	f.StringP("numbers", "n", "short", "Number printing format")
+}
+
+var sizesFormats []string
+
+var sizesCmd = &cobra.Command{
+	Use:   "sizes [BUILDABLE]",
+	Short: "Compare the size of an image in different disk formats.",
+	Long: `Build BUILDABLE once and report how big the image would be in each disk
+format given with --formats, without writing any of them out. The file-system
+is built a single time, as a raw image in a scratch file in the temporary
+directory (see --tmpdir), and converted to each format in turn.
+
+Every format is measured at the same disk size, aligned to suit all of them.
+The gcp format needs 1 GiB alignment, so including it can make the other
+formats bigger than they would be if built on their own.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		err := SetNumberModeFlagCMD(cmd)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		buildablePath := "."
+		if len(args) >= 1 {
+			buildablePath = args[0]
+		}
+
+		var formats []vdisk.Format
+		for _, s := range sizesFormats {
+			format, err := parseImageFormat(s)
+			if err != nil {
+				SetError(err)
+				return
+			}
+			formats = append(formats, format)
+		}
+
+		pkgBuilder, err := getTargetPackageBuilder("BUILDABLE", buildablePath)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer pkgBuilder.Close()
+
+		err = modifyPackageBuilder(pkgBuilder)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		pkgReader, err := vpkg.ReaderFromBuilder(pkgBuilder)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer pkgReader.Close()
+
+		pkgReader, err = checkPrograms(pkgReader)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		err = initKernels()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		scratch, err := ioutil.TempFile(tempDir(), "vorteil-sizes-")
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer os.Remove(scratch.Name())
+		defer scratch.Close()
+
+		sizes, err := vdisk.MeasureFormats(context.Background(), scratch, &vdisk.BuildArgs{
+			WithVCFGDefaults: true,
+			PackageReader:    pkgReader,
+			KernelOptions: vdisk.KernelOptions{
+				Shell: flagShell,
+			},
+			Logger:          log,
+			Strip:           flagStrip,
+			AllowNoPrograms: flagAllowNoPrograms,
+			TempDir:         tempDir(),
+		}, formats)
+		if err != nil {
+			SetError(ErrDiskBuild.Wrap(err))
+			return
+		}
+
+		table := [][]string{{"FORMAT", "SIZE"}}
+		for _, size := range sizes {
+			table = append(table, []string{size.Format.String(), PrintableSize(size.Size).String()})
+		}
+		PlainTable(table)
+	},
+}
+
+func init() {
+	f := sizesCmd.Flags()
+	f.StringSliceVar(&sizesFormats, "formats", []string{
+		vdisk.RAWFormat.String(),
+		vdisk.VMDKSparseFormat.String(),
+		vdisk.VMDKStreamOptimizedFormat.String(),
+		vdisk.VHDFixedFormat.String(),
+		vdisk.VHDDynamicFormat.String(),
+		vdisk.XVAFormat.String(),
+	}, "disk image formats to measure")
+	f.StringVarP(&flagKey, "key", "k", "", "vrepo authentication key")
+	f.BoolVar(&flagShell, "shell", false, "add a busybox shell environment to the image (overrides system.rescue-shell)")
+	f.BoolVar(&flagStrip, "strip", false, "remove debugging information and symbol tables from ELF binaries")
+	f.BoolVar(&flagAllowNoPrograms, "allow-no-programs", false, "build the package even if it defines no programs, e.g. for a data-only disk")
+	f.StringP("numbers", "n", "short", "Number printing format")
+}
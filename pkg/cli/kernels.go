@@ -0,0 +1,104 @@
+package cli
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vimg"
+)
+
+var kernelsCmd = &cobra.Command{
+	Use:   "kernels",
+	Short: "Inspect the kernels available to build with",
+}
+
+var kernelsOptionsCmd = &cobra.Command{
+	Use:   "options [VERSION]",
+	Short: "List the kernel options a kernel supports",
+	Long: `List the optional kernel features that the kernel VERSION supports, and the
+settings that add them to a disk, so that it's clear what can be used before
+building. Kernel arguments from system.kernel-args are passed to every kernel.
+
+VERSION is resolved like the vm.kernel field of a VCFG, and defaults to
+"latest".`,
+	Example: "  $ vorteil kernels options 20.9.1",
+	Args:    cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		version := "latest"
+		if len(args) > 0 {
+			version = args[0]
+		}
+
+		err := initKernels()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		ctx := context.Background()
+
+		kernel, err := vimg.ResolveKernel(ctx, &vcfg.VCFG{
+			VM: vcfg.VMSettings{Kernel: version},
+		}, log)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		bundle, err := ksrc.Get(ctx, kernel)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer bundle.Close()
+
+		log.Printf("Kernel:      \t%s", kernel)
+		log.Printf("Compiler:    \t%s or later", bundle.Bundle().EarliestCompatibleCompiler())
+
+		PlainTable(kernelOptionsTable(bundle.Bundle().Tags()))
+	},
+}
+
+// kernelOptionsTable returns a table of every kernel option, and whether a
+// kernel bundle with tags supports it. Features the bundle has that this
+// compiler doesn't know how to ask for are listed last.
+func kernelOptionsTable(tags []string) [][]string {
+
+	supported := make(map[string]bool)
+	for _, tag := range tags {
+		supported[tag] = true
+	}
+
+	yes := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+
+	table := [][]string{{"OPTION", "SUPPORTED", "SET BY"}}
+
+	known := make(map[string]bool)
+	for _, feature := range vimg.KernelFeatures {
+		known[feature.Tag] = true
+		table = append(table, []string{feature.Tag, yes(supported[feature.Tag]), feature.Setting})
+	}
+
+	table = append(table, []string{"kernel-args", yes(true), "system.kernel-args"})
+
+	for _, tag := range tags {
+		if !known[tag] {
+			table = append(table, []string{tag, yes(true), "not supported by this compiler"})
+		}
+	}
+
+	return table
+}
@@ -6,25 +6,28 @@ package cli
  */
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strings"
+	"time"
 
+	isatty "github.com/mattn/go-isatty"
 	"github.com/sisatech/tablewriter"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
-	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vdisk"
 	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/vorteil"
 	"github.com/vorteil/vorteil/pkg/vpkg"
-	"github.com/vorteil/vorteil/pkg/vproj"
 )
 
 var (
@@ -33,13 +36,12 @@ var (
 	date    = "Thu, 01 Jan 1970 00:00:00 +0000"
 )
 
-// Each command executed may have a error message and status code
-var errorStatusCode int
+// Each command executed may have a error message
 var errorStatusMessage error
 
-// SetError sets the global variables for when the process exits to display accordingly
-func SetError(err error, code int) {
-	errorStatusCode = code
+// SetError sets the error the process reports when it exits. The exit code
+// comes from the error's class (see CommandError).
+func SetError(err error) {
 	errorStatusMessage = err
 }
 
@@ -64,15 +66,27 @@ func isNotExist(path string) bool {
 
 func checkValidNewDirOutput(path string, force bool, dest, flag string) error {
 	if !isEmptyDir(path) {
-		return checkValidNewFileOutput(path, force, dest, flag)
+		return checkValidNewOutput(path, force, dest, flag, false)
 	}
 
 	return nil
 }
 
+// checkValidNewFileOutput returns an error if something already exists at
+// path, unless force is set. An existing regular file is left for the new
+// file to replace when it's committed with vio.AtomicCreate, so that it
+// survives a failed write, but anything else is removed.
 func checkValidNewFileOutput(path string, force bool, dest, flag string) error {
+	return checkValidNewOutput(path, force, dest, flag, true)
+}
+
+func checkValidNewOutput(path string, force bool, dest, flag string, replaceFiles bool) error {
 	if !isNotExist(path) {
 		if force {
+			if fi, err := os.Lstat(path); replaceFiles && err == nil && fi.Mode().IsRegular() {
+				return nil
+			}
+
 			err := os.RemoveAll(path)
 			if err != nil {
 				return fmt.Errorf("failed to delete existing %s '%s': %w", dest, path, err)
@@ -83,6 +97,8 @@ func checkValidNewFileOutput(path string, force bool, dest, flag string) error {
 			if err != nil {
 				return fmt.Errorf("failed to create parent directory for %s '%s': %w", dest, path, err)
 			}
+		} else if confirmOverwrite(dest, path) {
+			return checkValidNewOutput(path, true, dest, flag, replaceFiles)
 		} else {
 			return fmt.Errorf("%s '%s' already exists (you can use '%s' to force an overwrite)", dest, path, flag)
 		}
@@ -91,6 +107,33 @@ func checkValidNewFileOutput(path string, force bool, dest, flag string) error {
 	return nil
 }
 
+// confirmOverwrite returns true if the existing dest at path may be
+// overwritten without --force: either --yes was set, or the user agreed when
+// asked. It doesn't ask unless stdin and stdout are both terminals, so
+// scripts still fail safe.
+func confirmOverwrite(dest, path string) bool {
+	if flagYes {
+		return true
+	}
+	if !isatty.IsTerminal(os.Stdin.Fd()) || !isatty.IsTerminal(os.Stdout.Fd()) {
+		return false
+	}
+	return promptOverwrite(dest, path, os.Stdin, os.Stdout)
+}
+
+func promptOverwrite(dest, path string, in io.Reader, out io.Writer) bool {
+
+	fmt.Fprintf(out, "%s '%s' already exists. Overwrite it? [y/N]: ", dest, path)
+
+	line, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
 func parseImageFormat(s string) (vdisk.Format, error) {
 	format, err := vdisk.ParseFormat(s)
 	if err != nil {
@@ -99,312 +142,250 @@ func parseImageFormat(s string) (vdisk.Format, error) {
 	return format, nil
 }
 
-type sourceType string
+// sourceOptions returns the options the CLI resolves sources with: progress
+// goes to the CLI's logger, and downloads from a Vorteil repository carry the
+// key chosen with --key.
+func sourceOptions() *vorteil.SourceOptions {
+	return &vorteil.SourceOptions{
+		Logger:       log,
+		Authenticate: checkAuthentication,
+		TempDir:      tempDir(),
+	}
+}
 
-const (
-	sourceURL     sourceType = "URL"
-	sourceFile               = "File"
-	sourceDir                = "Dir"
-	sourceINVALID            = "INVALID"
-)
+// sourceError rewords an unresolved source error to name the argument it was
+// given as.
+func sourceError(argName, src string, err error) error {
+	if errors.Is(err, vorteil.ErrUnresolvedSource) {
+		return fmt.Errorf("failed to resolve %s '%s'", argName, src)
+	}
+	return err
+}
 
-// readSourcePath fetches src, target or returns an error
-func readSourcePath(src string) (string, string, error) {
+func getPackageReader(argName, src string) (vpkg.Reader, error) {
+	pkgR, err := vorteil.NewPackageReader(src, sourceOptions())
+	return pkgR, ErrSourceResolve.Wrap(sourceError(argName, src, err))
+}
 
-	// Get absolute path to help with splitting
-	src, err := filepath.Abs(src)
-	if err != nil {
-		return "", "", err
-	}
+func getPackageBuilder(argName, src string) (vpkg.Builder, error) {
+	pkgB, err := vorteil.NewPackageBuilder(src, sourceOptions())
+	return pkgB, ErrSourceResolve.Wrap(sourceError(argName, src, err))
+
+	// TODO: check for vrepo strings
 
-	// Check if source contains a target
-	colonSplit := strings.Split(src, ":")
-	colonLength := len(colonSplit)
+}
 
-	// Most of the time target should be here
-	target := colonSplit[len(colonSplit)-1]
+var (
+	flagIcon             string
+	flagVCFG             []string
+	flagInfoDate         string
+	flagInfoURL          string
+	flagSystemFilesystem string
+	flagSystemOutputMode string
+	flagSysctl           []string
+	flagVMDiskSize       string
+	flagVMInodes         string
+	flagVMRAM            string
+	overrideVCFG         vcfg.VCFG
+	envFileEnv           []string
+)
 
-	// If target is src no target was provided
-	if target == src {
-		target = ""
-	}
-	if target != "" {
-		src = colonSplit[0]
-		if runtime.GOOS == "windows" {
-			src = fmt.Sprintf("%s:%s", colonSplit[0], colonSplit[1])
-			// Catches edge case when window users provide no targets because of directory
-			if colonLength == 2 {
-				target = ""
-			}
-		}
-	}
+func addModifyFlags(f *pflag.FlagSet) {
+	vcfgFlags.AddTo(f)
+}
 
-	return src, target, err
+type remoteVCFG struct {
+	data    []byte
+	modTime time.Time
 }
 
-func getSourceType(src string) (sourceType, error) {
-	var err error
-	var fi os.FileInfo
+// remoteVCFGs caches VCFGs downloaded by openVCFG, so each is only fetched
+// once no matter how many times the flags are merged.
+var remoteVCFGs = make(map[string]*remoteVCFG)
 
-	// Check if Source is a URL
-	if _, err := url.ParseRequestURI(src); err == nil {
-		if u, uErr := url.Parse(src); uErr == nil && u.Scheme != "" && u.Host != "" && u.Path != "" {
-			return sourceURL, nil
-		}
-	}
+// isURL returns true if path is an http or https URL.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
 
-	src, target, err := readSourcePath(src)
-	if err != nil {
-		return sourceINVALID, err
+// repositoryAuthentication returns checkAuthentication if the server at src
+// is a Vorteil repository, so that the vrepo key is only ever sent to one.
+func repositoryAuthentication(src string) func() (string, error) {
+	if newVrepo, err := vorteil.CheckRepository(src); err == nil && newVrepo == "True" {
+		return checkAuthentication
 	}
+	return nil
+}
+
+// parseHeaders parses the 'Name: Value' headers given to --header.
+func parseHeaders(values []string) (http.Header, error) {
 
-	// Check if Source is a file or dir
-	fi, err = os.Stat(src)
-	if !os.IsNotExist(err) && (fi != nil && !fi.IsDir()) {
-		if target != "" {
-			return sourceINVALID, errors.New("Targetable runs are unable to be used on packages")
+	header := make(http.Header)
+	for _, v := range values {
+		kv := strings.SplitN(v, ":", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header '%s': should be 'Name: Value'", v)
 		}
-		return sourceFile, nil
-	} else if !os.IsNotExist(err) && (fi != nil && fi.IsDir()) {
-		return sourceDir, nil
+		header.Add(name, strings.TrimSpace(kv[1]))
 	}
 
-	// Source is unknown and thus is invalid
-	return sourceINVALID, err
+	return header, nil
 }
 
-func checkIfNewVRepo(src string) (string, error) {
-	urlo, err := url.Parse(src)
-	if err != nil {
-		return "", err
-	}
-	client := &http.Client{}
+func downloadVCFG(src string) (*remoteVCFG, error) {
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s/info", urlo.Scheme, urlo.Host), nil)
+	resp, err := vorteil.Fetch(src, repositoryAuthentication(src))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	req.Header.Set("Info-Request", "True")
+	defer resp.Body.Close()
 
-	resp, err := client.Do(req)
+	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return "", errors.New("not a new vorteil repository")
+
+	modTime := time.Now()
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		modTime = t
 	}
-	return resp.Header.Get("Vorteil-Repository"), nil
+
+	return &remoteVCFG{
+		data:    data,
+		modTime: modTime,
+	}, nil
 }
 
-func getReaderURL(src string) (vpkg.Reader, error) {
+// openVCFG opens the VCFG at path, which may be a local file or an http or
+// https URL. Downloads carry the vrepo key if the server is a Vorteil
+// repository.
+func openVCFG(path string) (vio.File, error) {
 
-	newVrepo, err := checkIfNewVRepo(src)
-	if err != nil {
-		return nil, err
+	if !isURL(path) {
+		return vio.Open(path)
 	}
-	client := &http.Client{}
 
-	req, err := http.NewRequest("GET", src, nil)
-	if err != nil {
-		return nil, err
-	}
-	if newVrepo == "True" {
-		token, err := checkAuthentication()
+	r, ok := remoteVCFGs[path]
+	if !ok {
+		var err error
+		r, err = downloadVCFG(path)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("failed to download vcfg '%s': %v", path, err)
 		}
+		remoteVCFGs[path] = r
+	}
+
+	return vio.CustomFile(vio.CustomFileArgs{
+		Name:       path,
+		Size:       len(r.data),
+		ModTime:    r.modTime,
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(r.data)),
+	}), nil
+}
+
+// mergeFlagVCFGFiles : Merge values from from VCFG files stored in 'flagVCFG', and then merge vcfg flag values with overrideVCFG
+func mergeVCFGFlagValues(b *vpkg.Builder) error {
+	var err error
+	var f vio.File
+	var cfg *vcfg.VCFG
 
-		if token != "" {
-			req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+	// Iterate over vcfg paths stored in flagVCFG, read vcfg files and merge into b
+	for _, path := range flagVCFG {
+		f, err = openVCFG(path)
+		if err != nil {
+			return err
 		}
-	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		if resp != nil {
-			resp.Body.Close()
+		cfg, err = vcfg.LoadFile(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
 		}
-		return nil, err
-	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New(resp.Status)
-	}
 
-	var p elog.Progress
-	if resp.ContentLength == -1 {
-		p = log.NewProgress("Downloading package", "", 0)
-		defer p.Finish(true)
-	} else {
-		p = log.NewProgress("Downloading package", "KiB", resp.ContentLength)
+		err = (*b).MergeVCFG(cfg)
+		if err != nil {
+			return err
+		}
 	}
 
-	pkgr, err := vpkg.Load(p.ProxyReader(resp.Body))
+	// Environment variables from env files override those from VCFG files
+	err = mergeEnvFileValues(*b)
 	if err != nil {
-		resp.Body.Close()
-		p.Finish(false)
-		return nil, err
+		return err
 	}
 
-	return pkgr, nil
-}
-
-func getBuilderURL(argName, src string) (vpkg.Builder, error) {
-	pkgr, err := getReaderURL(src)
+	// Merge overrideVCFG object containing flag values into b
+	err = (*b).MergeVCFG(&overrideVCFG)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	pkgb, err := vpkg.NewBuilderFromReader(pkgr)
-	if err != nil {
-		pkgr.Close()
-		return nil, err
+
+	// Explicit --program[N].env flags override everything else
+	if len(envFileEnv) > 0 {
+		return modifyPrograms(*b, func(p *vcfg.Program) {
+			p.Env = vcfg.MergeEnv(p.Env)
+		})
 	}
-	return pkgb, nil
+
+	return nil
 }
 
-func getReaderFile(src string) (vpkg.Reader, error) {
-	f, err := os.Open(src)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return nil, err
-		}
-		return nil, fmt.Errorf("failed to resolve %s ", src)
+// mergeEnvFileValues adds the variables from every --env-file to the
+// environment of every program in b, replacing any existing values.
+func mergeEnvFileValues(b vpkg.Builder) error {
+	if len(envFileEnv) == 0 {
+		return nil
 	}
 
-	pkgr, err := vpkg.Load(f)
-	if err != nil {
-		f.Close()
-		return nil, err
-	}
-	return pkgr, nil
+	return modifyPrograms(b, func(p *vcfg.Program) {
+		p.Env = vcfg.MergeEnv(p.Env, envFileEnv)
+	})
 }
-func getBuilderFile(argName, src string) (vpkg.Builder, error) {
 
-	pkgr, err := getReaderFile(src)
+// modifyPrograms calls fn on every program in b's VCFG.
+func modifyPrograms(b vpkg.Builder, fn func(p *vcfg.Program)) error {
+	cfg, err := b.VCFG()
 	if err != nil {
-		return nil, err
-	}
-	pkgb, err := vpkg.NewBuilderFromReader(pkgr)
-	if err != nil {
-		pkgr.Close()
-		return nil, err
+		return err
 	}
-	return pkgb, err
-}
 
-func getBuilderDir(argName, src string) (vpkg.Builder, error) {
-	var ptgt *vproj.Target
-	path, target := vproj.Split(src)
-	proj, err := vproj.LoadProject(path)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			return nil, err
-		}
-		return nil, fmt.Errorf("failed to resolve %s '%s'", argName, src)
+	for i := range cfg.Programs {
+		fn(&cfg.Programs[i])
 	}
 
-	ptgt, err = proj.Target(target)
+	f, err := cfg.File()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	pkgb, err := ptgt.NewBuilder()
-	return pkgb, err
+	return b.SetVCFG(f)
 }
 
-func getPackageReader(argName, src string) (vpkg.Reader, error) {
-	var err error
-	var pkgR vpkg.Reader
-	sType, err := getSourceType(src)
+func setRescueShell(b vpkg.Builder, shell bool) error {
+	cfg, err := b.VCFG()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	switch sType {
-	case sourceURL:
-		pkgR, err = getReaderURL(src)
-	case sourceFile:
-		pkgR, err = getReaderFile(src)
-	case sourceINVALID:
-		fallthrough
-	default:
-		err = fmt.Errorf("failed to resolve %s '%s'", argName, src)
-	}
+	cfg.System.RescueShell = shell
 
-	return pkgR, err
-}
-func getPackageBuilder(argName, src string) (vpkg.Builder, error) {
-	var err error
-	var pkgB vpkg.Builder
-	sType, err := getSourceType(src)
+	f, err := cfg.File()
 	if err != nil {
-		return nil, err
-	}
-
-	switch sType {
-	case sourceURL:
-		pkgB, err = getBuilderURL(argName, src)
-	case sourceFile:
-		pkgB, err = getBuilderFile(argName, src)
-	case sourceDir:
-		pkgB, err = getBuilderDir(argName, src)
-	case sourceINVALID:
-		fallthrough
-	default:
-		err = fmt.Errorf("failed to resolve %s '%s'", argName, src)
+		return err
 	}
 
-	return pkgB, err
-
-	// TODO: check for vrepo strings
-
-}
-
-var (
-	flagIcon             string
-	flagVCFG             []string
-	flagInfoDate         string
-	flagInfoURL          string
-	flagSystemFilesystem string
-	flagSystemOutputMode string
-	flagSysctl           []string
-	flagVMDiskSize       string
-	flagVMInodes         string
-	flagVMRAM            string
-	overrideVCFG         vcfg.VCFG
-)
-
-func addModifyFlags(f *pflag.FlagSet) {
-	vcfgFlags.AddTo(f)
+	return b.SetVCFG(f)
 }
 
-// mergeFlagVCFGFiles : Merge values from from VCFG files stored in 'flagVCFG', and then merge vcfg flag values with overrideVCFG
-func mergeVCFGFlagValues(b *vpkg.Builder) error {
-	var err error
-	var f vio.File
-	var cfg *vcfg.VCFG
-
-	// Iterate over vcfg paths stored in flagVCFG, read vcfg files and merge into b
-	for _, path := range flagVCFG {
-		f, err = vio.Open(path)
-		if err != nil {
-			return err
-		}
-
-		cfg, err = vcfg.LoadFile(f)
-		if err != nil {
-			return err
-		}
-
-		err = (*b).MergeVCFG(cfg)
-		if err != nil {
-			return err
-		}
+// rescueShell returns true if the kernel for cfg should include the rescue
+// shell: an explicit --shell, true or false, overrides the VCFG's
+// rescue-shell.
+func rescueShell(cfg *vcfg.VCFG) bool {
+	if flagShellSet {
+		return flagShell
 	}
-
-	// Merge overrideVCFG object containing flag values into b
-	err = (*b).MergeVCFG(&overrideVCFG)
-	return err
+	return cfg.System.RescueShell
 }
 
 func modifyPackageBuilder(b vpkg.Builder) error {
@@ -413,7 +394,7 @@ func modifyPackageBuilder(b vpkg.Builder) error {
 
 	err = vcfgFlags.Validate()
 	if err != nil {
-		return err
+		return ErrInvalidConfig.Wrap(err)
 	}
 
 	if flagIcon != "" {
@@ -426,7 +407,15 @@ func modifyPackageBuilder(b vpkg.Builder) error {
 
 	err = mergeVCFGFlagValues(&b)
 	if err != nil {
-		return err
+		return ErrInvalidConfig.Wrap(err)
+	}
+
+	// an explicit --shell, true or false, overrides the VCFG's rescue-shell
+	if flagShellSet {
+		err = setRescueShell(b, flagShell)
+		if err != nil {
+			return err
+		}
 	}
 
 	err = handleFileInjections(b)
@@ -501,13 +490,54 @@ func (c PrintableSize) String() string {
 	}
 }
 
-// PlainTable prints data in a grid, handling alignment automatically.
+// TableMode determines how PlainTable renders tables: 0 is an aligned grid, 1
+// is CSV, and 2 is TSV.
+var TableMode int
+
+// SetTableMode parses s and sets TableMode accordingly.
+func SetTableMode(s string) error {
+	s = strings.ToLower(s)
+	s = strings.TrimSpace(s)
+	switch s {
+	case "", "plain":
+		TableMode = 0
+	case "csv":
+		TableMode = 1
+	case "tsv":
+		TableMode = 2
+	default:
+		return fmt.Errorf("table format must be one of 'plain', 'csv', or 'tsv'")
+	}
+	return nil
+}
+
+// PlainTable prints data in the format selected by TableMode. The first row
+// holds column headings, which are left out of the grid but kept in delimited
+// output.
 func PlainTable(vals [][]string) {
 	if len(vals) == 0 {
 		panic(errors.New("no rows provided"))
 	}
 
-	table := tablewriter.NewWriter(os.Stdout)
+	var err error
+	switch TableMode {
+	case 0:
+		gridTable(os.Stdout, vals)
+	case 1:
+		err = csvTable(os.Stdout, vals)
+	case 2:
+		err = tsvTable(os.Stdout, vals)
+	default:
+		panic("invalid TableMode")
+	}
+	if err != nil {
+		log.Errorf("failed to write table: %v", err)
+	}
+}
+
+// gridTable writes vals to w in a grid, handling alignment automatically.
+func gridTable(w io.Writer, vals [][]string) {
+	table := tablewriter.NewWriter(w)
 	table.SetAlignment(tablewriter.ALIGN_LEFT)
 	table.SetBorder(false)
 	table.SetColumnSeparator("")
@@ -517,3 +547,31 @@ func PlainTable(vals [][]string) {
 
 	table.Render()
 }
+
+// csvTable writes vals to w as comma-separated values, quoted as described by
+// RFC 4180.
+func csvTable(w io.Writer, vals [][]string) error {
+	cw := csv.NewWriter(w)
+	err := cw.WriteAll(vals)
+	if err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// tsvTable writes vals to w as tab-separated values. TSV has no quoting, so
+// tabs and line breaks within values are replaced with spaces.
+func tsvTable(w io.Writer, vals [][]string) error {
+	r := strings.NewReplacer("\t", " ", "\r\n", " ", "\n", " ", "\r", " ")
+	for _, row := range vals {
+		cells := make([]string, len(row))
+		for i := range row {
+			cells[i] = r.Replace(row[i])
+		}
+		_, err := fmt.Fprintln(w, strings.Join(cells, "\t"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -6,13 +6,31 @@ package cli
  */
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	unixpath "path"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vconvert"
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/vorteil"
 	"github.com/vorteil/vorteil/pkg/vpkg"
 	"github.com/vorteil/vorteil/pkg/vproj"
+	"gopkg.in/yaml.v2"
 )
 
 var packagesCmd = &cobra.Command{
@@ -45,7 +63,7 @@ identify it and explain its purpose and its use.`,
 
 		wd, err := os.Getwd()
 		if err != nil {
-			SetError(err, 8)
+			SetError(err)
 			return
 		}
 
@@ -70,40 +88,40 @@ identify it and explain its purpose and its use.`,
 
 		err = checkValidNewFileOutput(outputPath, flagForce, "output", "-f")
 		if err != nil {
-			SetError(err, 1)
+			SetError(err)
 			return
 		}
 
 		builder, err := getPackageBuilder("PACKABLE", packablePath)
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
 
 		err = modifyPackageBuilder(builder)
 		if err != nil {
-			SetError(err, 3)
+			SetError(err)
 			return
 		}
 
 		builder.SetCompressionLevel(int(flagCompressionLevel))
 
-		f, err := os.Create(outputPath)
+		f, err := vio.AtomicCreate(outputPath, 0666)
 		if err != nil {
-			SetError(err, 5)
+			SetError(err)
 			return
 		}
 		defer f.Close()
 
 		err = builder.Pack(f)
 		if err != nil {
-			SetError(err, 6)
+			SetError(err)
 			return
 		}
 
-		err = f.Close()
+		err = f.Commit()
 		if err != nil {
-			SetError(err, 7)
+			SetError(err)
 			return
 		}
 
@@ -148,30 +166,30 @@ other files. If the DEST argument is omitted it will default to ".".`,
 
 		err := checkValidNewDirOutput(prjPath, flagForce, "DEST", "-f")
 		if err != nil {
-			SetError(err, 1)
+			SetError(err)
 
 			return
 		}
 		pkg, err := getPackageBuilder("PACKABLE", pkgPath)
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
 		defer pkg.Close()
 		err = modifyPackageBuilder(pkg)
 		if err != nil {
-			SetError(err, 3)
+			SetError(err)
 			return
 		}
 		pkgr, err := vpkg.ReaderFromBuilder(pkg)
 		if err != nil {
-			SetError(err, 4)
+			SetError(err)
 			return
 		}
 		defer pkgr.Close()
 		err = vproj.CreateFromPackage(prjPath, pkgr)
 		if err != nil {
-			SetError(err, 5)
+			SetError(err)
 			return
 		}
 
@@ -185,3 +203,1121 @@ func init() {
 
 	f.BoolVarP(&flagForce, "force", "f", false, "force overwrite of existing files")
 }
+
+var packagesKernelCmd = &cobra.Command{
+	Use:   "kernel [BUILDABLE]",
+	Short: "Show the kernel a package would build with",
+	Long: `Resolve the kernel version, kernel features, and kernel arguments that
+building BUILDABLE would use, without building anything. If BUILDABLE is
+omitted it will default to ".".
+
+The kernel features depend on the VCFG, and on the --shell flag, which should
+match the flag intended for the build.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		buildablePath := "."
+		if len(args) >= 1 {
+			buildablePath = args[0]
+		}
+
+		pkgBuilder, err := getPackageBuilder("BUILDABLE", buildablePath)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer pkgBuilder.Close()
+
+		err = modifyPackageBuilder(pkgBuilder)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		pkgReader, err := vpkg.ReaderFromBuilder(pkgBuilder)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer pkgReader.Close()
+
+		pkgReader, err = vpkg.PeekVCFG(pkgReader)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		cfg, err := vcfg.LoadFile(pkgReader.VCFG())
+		if err != nil {
+			SetError(ErrInvalidConfig.Wrap(err))
+			return
+		}
+
+		err = initKernels()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		kernel, err := vimg.ResolveKernel(context.Background(), cfg, log)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		requested := cfg.VM.Kernel
+		if requested == "" {
+			requested = "latest"
+		}
+
+		tags := vimg.KernelTags(cfg, vimg.KernelOptions{
+			Shell: rescueShell(cfg),
+		})
+		features := strings.Join(tags, ", ")
+		if features == "" {
+			features = "none"
+		}
+
+		kargs := cfg.System.KernelArgs
+		if kargs == "" {
+			kargs = "none"
+		}
+
+		log.Printf("Requested kernel:\t%s", requested)
+		log.Printf("Resolved kernel: \t%s", kernel)
+		log.Printf("Features:        \t%s", features)
+		log.Printf("Kernel arguments:\t%s", kargs)
+	},
+}
+
+func init() {
+	f := packagesKernelCmd.Flags()
+	f.StringVarP(&flagKey, "key", "k", "", "vrepo authentication key")
+	f.BoolVar(&flagShell, "shell", false, "include the busybox shell kernel feature (overrides system.rescue-shell)")
+}
+
+var packagesSignalsCmd = &cobra.Command{
+	Use:   "signals",
+	Short: "List the signals a program can be terminated with",
+	Long: `List the signals supported by the program terminate setting in the VCFG,
+along with their numbers.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		err := SetNumberModeFlagCMD(cmd)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		var names []string
+		for sig := range vcfg.TerminateSignals {
+			names = append(names, string(sig))
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return vcfg.TerminateSignals[vcfg.TerminateSignal(names[i])] < vcfg.TerminateSignals[vcfg.TerminateSignal(names[j])]
+		})
+
+		table := [][]string{{"SIGNAL", "NUMBER"}}
+		for _, name := range names {
+			n := int(vcfg.TerminateSignals[vcfg.TerminateSignal(name)])
+			number := fmt.Sprintf("%d", n)
+			if NumbersMode == 2 {
+				number = fmt.Sprintf("%#x", n)
+			}
+			table = append(table, []string{name, number})
+		}
+
+		PlainTable(table)
+	},
+}
+
+func init() {
+	f := packagesSignalsCmd.Flags()
+	f.StringP("numbers", "n", "short", "Number printing format")
+}
+
+var packagesFromRegistryCmd = &cobra.Command{
+	Use:   "from-registry IMAGE",
+	Short: "Create a Vorteil package from a container registry image",
+	Long: `Pull a container image directly from a registry, flatten its layers, and
+create a Vorteil package from it with a VCFG generated from the image
+configuration.
+
+IMAGE is a container image reference such as docker.io/library/nginx:latest.
+Registries are mapped to URLs the same way as for 'projects convert-container'.
+If no --username and --password are provided, credentials saved by 'docker
+login' are used where available. Downloaded layers are cached in
+~/.vorteil/layers and reused by later pulls unless --no-cache is set.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		image := args[0]
+
+		suffix := ".vorteil"
+		name := filepath.Base(strings.SplitN(image, "@", 2)[0])
+		name = strings.SplitN(name, ":", 2)[0]
+
+		outputPath := filepath.Join(".", name+suffix)
+		if flagOutput != "" {
+			outputPath = flagOutput
+			if !strings.HasSuffix(outputPath, suffix) {
+				log.Warnf("file name does not end with '%s' file extension", suffix)
+			}
+		}
+
+		err := checkValidNewFileOutput(outputPath, flagForce, "output", "-f")
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		user, _ := cmd.Flags().GetString("username")
+		pwd, _ := cmd.Flags().GetString("password")
+		config, _ := cmd.Flags().GetString("config")
+		noCache, _ := cmd.Flags().GetBool("no-cache")
+
+		cc, err := vconvert.NewContainerConverter(image, config, log)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		if !noCache {
+			home, err := homedir.Dir()
+			if err != nil {
+				SetError(err)
+				return
+			}
+			cc.SetCacheDir(filepath.Join(home, ".vorteil", "layers"))
+		}
+
+		dir, err := ioutil.TempDir(tempDir(), "vorteil-registry-")
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		err = cc.ConvertToProject(dir, user, pwd)
+		if err != nil {
+			SetError(ErrSourceResolve.Wrap(err))
+			return
+		}
+
+		builder, err := getPackageBuilder("IMAGE", dir)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer builder.Close()
+
+		err = modifyPackageBuilder(builder)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		builder.SetCompressionLevel(int(flagCompressionLevel))
+
+		f, err := vio.AtomicCreate(outputPath, 0666)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer f.Close()
+
+		err = builder.Pack(f)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		err = f.Commit()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		log.Printf("created package: %s", outputPath)
+	},
+}
+
+func init() {
+	f := packagesFromRegistryCmd.Flags()
+	f.BoolVarP(&flagForce, "force", "f", false, "force overwrite of existing files")
+	f.StringVarP(&flagOutput, "output", "o", "", "path to put package file")
+	f.UintVar(&flagCompressionLevel, "compression-level", 1, "compression level (0-9)")
+	f.String("username", "", "container registry user")
+	f.String("password", "", "container registry password")
+	f.StringP("config", "c", "", "container registry configuration list")
+	f.Bool("no-cache", false, "download every layer instead of using cached layers")
+	f.StringVar(&flagTmpDir, "tmpdir", "", "directory to create temporary files in (default $VORTEIL_TMPDIR or the system default)")
+}
+
+// packageAddition is a file or directory on the host to be added to a
+// package filesystem.
+type packageAddition struct {
+	path string
+	src  string
+}
+
+// parsePackageAdditions parses arguments of the form PATH=SRC, where PATH is
+// the destination within the package filesystem.
+func parsePackageAdditions(args []string) ([]packageAddition, error) {
+
+	var additions []packageAddition
+
+	for _, arg := range args {
+		x := strings.SplitN(arg, "=", 2)
+		if len(x) != 2 || x[0] == "" || x[1] == "" {
+			return nil, fmt.Errorf("bad argument '%s': expected PATH=SRC", arg)
+		}
+
+		path := unixpath.Clean("/" + filepath.ToSlash(x[0]))
+		if path == "/" {
+			return nil, fmt.Errorf("bad argument '%s': cannot replace the filesystem root", arg)
+		}
+
+		additions = append(additions, packageAddition{
+			path: path,
+			src:  x[1],
+		})
+	}
+
+	return additions, nil
+}
+
+// packageAddConflict returns a path that would be overwritten by adding src
+// at path to a package filesystem, or an empty string if there is none.
+// Existing maps each path in the package filesystem to whether or not it is a
+// directory. Directories merge with directories without conflict.
+func packageAddConflict(existing map[string]bool, src, path string) (string, error) {
+
+	var conflict string
+
+	err := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+
+		target := unixpath.Join(path, filepath.ToSlash(rel))
+		isDir, ok := existing[target]
+		if ok && !(isDir && fi.IsDir()) {
+			conflict = target
+			return io.EOF
+		}
+
+		return nil
+	})
+	if err == io.EOF {
+		err = nil
+	}
+
+	return conflict, err
+}
+
+var packagesAddCmd = &cobra.Command{
+	Use:   "add PACKAGE PATH=SRC...",
+	Short: "Add files to an existing Vorteil package",
+	Long: `Add files or directories from the host to the filesystem of an existing
+Vorteil package, without rebuilding it from its project. Each PATH=SRC argument
+maps the file or directory at SRC on the host to PATH within the package
+filesystem. Missing parent directories are created, and directories are merged
+with any that already exist.
+
+The package's VCFG is left unchanged. The updated package replaces PACKAGE
+unless --output is set. Paths that already exist in the package are only
+overwritten if --force is set.`,
+	Example: `  $ vorteil packages add app.vorteil /etc/app.conf=./app.conf`,
+	Args:    cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		pkgPath := args[0]
+
+		additions, err := parsePackageAdditions(args[1:])
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		outputPath := pkgPath
+		if flagOutput != "" {
+			outputPath = flagOutput
+			err = checkValidNewFileOutput(outputPath, flagForce, "output", "-f")
+			if err != nil {
+				SetError(err)
+				return
+			}
+		}
+
+		pkgr, err := vorteil.OpenPackage(pkgPath)
+		if err != nil {
+			SetError(ErrSourceResolve.Wrap(err))
+			return
+		}
+
+		existing := make(map[string]bool)
+		err = pkgr.FS().Walk(func(path string, f vio.File) error {
+			existing[unixpath.Clean("/"+path)] = f.IsDir()
+			return nil
+		})
+		if err != nil {
+			pkgr.Close()
+			SetError(err)
+			return
+		}
+
+		if !flagForce {
+			for _, a := range additions {
+				conflict, err := packageAddConflict(existing, a.src, a.path)
+				if err != nil {
+					pkgr.Close()
+					SetError(err)
+					return
+				}
+				if conflict != "" {
+					pkgr.Close()
+					SetError(fmt.Errorf("'%s' already exists in package, use --force to overwrite it", conflict))
+					return
+				}
+			}
+		}
+
+		builder, err := vpkg.NewBuilderFromReader(pkgr)
+		if err != nil {
+			pkgr.Close()
+			SetError(err)
+			return
+		}
+		defer builder.Close()
+
+		for _, a := range additions {
+			err = injectPath(a.src, a.path, builder)
+			if err != nil {
+				SetError(err)
+				return
+			}
+		}
+
+		builder.SetCompressionLevel(int(flagCompressionLevel))
+
+		// the package is only committed over the output afterwards, because
+		// it is still being read from PACKAGE
+		f, err := vio.AtomicCreate(outputPath, 0644)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer f.Close()
+
+		err = builder.Pack(f)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		err = f.Commit()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		log.Printf("updated package: %s", outputPath)
+	},
+}
+
+func init() {
+	f := packagesAddCmd.Flags()
+	f.BoolVarP(&flagForce, "force", "f", false, "overwrite existing paths in the package, and existing output files")
+	f.StringVarP(&flagOutput, "output", "o", "", "path to put the updated package file")
+	f.UintVar(&flagCompressionLevel, "compression-level", 1, "compression level (0-9)")
+}
+
+// marshalVCFG encodes cfg as toml, json or yaml.
+func marshalVCFG(cfg *vcfg.VCFG, format string) ([]byte, error) {
+
+	switch strings.ToLower(format) {
+	case "", "toml":
+		return cfg.Marshal()
+	case "json":
+		data, err := json.MarshalIndent(cfg, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	case "yaml", "yml":
+		// going through json keeps the field names and order used elsewhere
+		data, err := json.Marshal(cfg)
+		if err != nil {
+			return nil, err
+		}
+		var x yaml.MapSlice
+		err = yaml.Unmarshal(data, &x)
+		if err != nil {
+			return nil, err
+		}
+		return yaml.Marshal(x)
+	default:
+		return nil, fmt.Errorf("unsupported vcfg format '%s': expected toml, json or yaml", format)
+	}
+}
+
+// extractVCFG returns the VCFG of a disk image, or of anything a package can
+// be built from.
+func extractVCFG(src string) (*vcfg.VCFG, error) {
+
+	if fi, err := os.Stat(src); err == nil && !fi.IsDir() {
+		iio, err := vdecompiler.Open(src)
+		if err == nil {
+			defer iio.Close()
+			if _, err = iio.GPTHeader(); err == nil {
+				return iio.VCFG()
+			}
+		}
+	}
+
+	builder, err := getPackageBuilder("SOURCE", src)
+	if err != nil {
+		return nil, err
+	}
+	defer builder.Close()
+
+	pkgReader, err := vpkg.ReaderFromBuilder(builder)
+	if err != nil {
+		return nil, err
+	}
+	defer pkgReader.Close()
+
+	pkgReader, err = vpkg.PeekVCFG(pkgReader)
+	if err != nil {
+		return nil, err
+	}
+
+	return vcfg.LoadFile(pkgReader.VCFG())
+}
+
+var packagesExtractVCFGCmd = &cobra.Command{
+	Use:   "extract-vcfg SOURCE",
+	Short: "Export the VCFG of a package or disk image",
+	Long: `Export the VCFG of a package, project or disk image as a standalone file,
+which can be edited and merged back into a build with --vcfg. The VCFG of a
+disk image includes any defaults that were applied when it was built.
+
+The VCFG is written to stdout unless --output is set. Supported formats are
+toml, json and yaml, and any of them can be passed back to --vcfg.`,
+	Example: `  $ vorteil packages extract-vcfg app.vorteil -o app.vcfg
+  $ vorteil build --vcfg app.vcfg app.vorteil`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		format, _ := cmd.Flags().GetString("format")
+
+		if flagOutput != "" {
+			err := checkValidNewFileOutput(flagOutput, flagForce, "output", "-f")
+			if err != nil {
+				SetError(err)
+				return
+			}
+		}
+
+		cfg, err := extractVCFG(args[0])
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		data, err := marshalVCFG(cfg, format)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		if flagOutput == "" {
+			_, err = os.Stdout.Write(data)
+			if err != nil {
+				SetError(err)
+			}
+			return
+		}
+
+		err = vio.AtomicWriteFile(flagOutput, data, 0644)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		log.Printf("extracted vcfg: %s", flagOutput)
+	},
+}
+
+func init() {
+	f := packagesExtractVCFGCmd.Flags()
+	f.BoolVarP(&flagForce, "force", "f", false, "force overwrite of existing files")
+	f.StringVarP(&flagOutput, "output", "o", "", "path to write the vcfg to")
+	f.StringVarP(&flagKey, "key", "k", "", "vrepo authentication key")
+	f.String("format", "toml", "vcfg format (toml, json or yaml)")
+}
+
+var packagesIconCmd = &cobra.Command{
+	Use:   "icon SOURCE",
+	Short: "Extract the icon of a package",
+	Long: `Extract the icon of a package or project and write it to a file. The format
+of the icon is detected from its contents and reported once it's written.`,
+	Example: `  $ vorteil packages icon app.vorteil -o icon.png`,
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		err := checkValidNewFileOutput(flagOutput, flagForce, "output", "-f")
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		builder, err := getPackageBuilder("SOURCE", args[0])
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer builder.Close()
+
+		pkgReader, err := vpkg.ReaderFromBuilder(builder)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer pkgReader.Close()
+
+		icon := pkgReader.Icon()
+		defer icon.Close()
+
+		data, err := ioutil.ReadAll(icon)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		if len(data) == 0 {
+			SetError(fmt.Errorf("package '%s' has no icon", args[0]))
+			return
+		}
+
+		err = vio.AtomicWriteFile(flagOutput, data, 0644)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		format := vpkg.IconFormat(data)
+		if format == "" {
+			log.Warnf("icon is not in a recognised image format")
+			format = "unknown"
+		}
+
+		log.Printf("extracted icon (%s): %s", format, flagOutput)
+	},
+}
+
+func init() {
+	f := packagesIconCmd.Flags()
+	f.BoolVarP(&flagForce, "force", "f", false, "force overwrite of existing files")
+	f.StringVarP(&flagOutput, "output", "o", "", "path to write the icon to")
+	f.StringVarP(&flagKey, "key", "k", "", "vrepo authentication key")
+	packagesIconCmd.MarkFlagRequired("output")
+}
+
+var packagesCopyCmd = &cobra.Command{
+	Use:   "copy SOURCE DEST",
+	Short: "Copy a package, verifying its checksum",
+	Long: `Copy a package from SOURCE to DEST, streaming it rather than loading it into
+memory, and verifying its contents against the checksum in its header as it
+goes. Either argument may be a path to a package file or an http or https URL,
+so the command can download, upload, or copy packages between files.
+
+Downloads send a GET request and uploads a PUT request, with any headers set
+with --header. The vrepo key is sent as well if the server is a Vorteil
+repository. A local DEST is only written once the copy has been verified, and a
+failed upload is aborted before the request is finished.
+
+Packages packed without a checksum are copied with a warning, because their
+contents can't be verified, unless --require-checksum is set.`,
+	Example: `  $ vorteil packages copy https://example.com/apps/app.vorteil app.vorteil
+  $ vorteil packages copy app.vorteil https://mirror.example.com/app.vorteil -H "Authorization: Bearer $TOKEN"`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		src, dst := args[0], args[1]
+
+		values, _ := cmd.Flags().GetStringArray("header")
+		header, err := parseHeaders(values)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		if !isURL(dst) {
+			err = checkValidNewFileOutput(dst, flagForce, "DEST", "-f")
+			if err != nil {
+				SetError(err)
+				return
+			}
+		}
+
+		r, size, err := openCopySource(src, header)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer r.Close()
+
+		var p elog.Progress
+		if size < 0 {
+			p = log.NewProgress("Copying package", "", 0)
+		} else {
+			p = log.NewProgress("Copying package", "KiB", size)
+		}
+		defer p.Finish(false)
+
+		requireChecksum, _ := cmd.Flags().GetBool("require-checksum")
+		copyPackage := func(w io.Writer) (*vpkg.PackageInfo, error) {
+			info, err := vpkg.Copy(w, p.ProxyReader(r))
+			if err != nil {
+				return nil, err
+			}
+			if info.Checksum == "" && requireChecksum {
+				return nil, fmt.Errorf("package '%s' has no checksum to verify", src)
+			}
+			return info, nil
+		}
+
+		var info *vpkg.PackageInfo
+		if isURL(dst) {
+			info, err = uploadCopy(dst, header, copyPackage)
+		} else {
+			info, err = writeCopy(dst, copyPackage)
+		}
+		if err != nil {
+			SetError(err)
+			return
+		}
+		p.Finish(true)
+
+		if info.Checksum == "" {
+			log.Warnf("package has no checksum, so its contents weren't verified")
+			log.Printf("copied package: %s", dst)
+			return
+		}
+
+		log.Printf("copied package (sha256 %s): %s", info.Checksum, dst)
+	},
+}
+
+func init() {
+	f := packagesCopyCmd.Flags()
+	f.BoolVarP(&flagForce, "force", "f", false, "force overwrite of existing files")
+	f.StringVarP(&flagKey, "key", "k", "", "vrepo authentication key")
+	f.StringArrayP("header", "H", nil, "extra 'Name: Value' header to send with requests (repeatable)")
+	f.Bool("require-checksum", false, "fail if the package has no checksum to verify")
+}
+
+var packagesPushCmd = &cobra.Command{
+	Use:   "push PACKAGE REFERENCE",
+	Short: "Push a package to an OCI registry",
+	Long: `Push a package file to an OCI registry as an artifact, so that existing
+container registries can be used to distribute packages. The package is
+stored unchanged as the artifact's only blob, with the media type
+` + string(vorteil.PackageMediaType) + `, and its config describes the package
+using the info and programs from its VCFG.
+
+Credentials for the registry are read from the Docker config file, so log in
+with 'docker login' first. The pushed package can be used anywhere a package
+is expected by prefixing the reference with ` + vorteil.OCIPrefix + `.`,
+	Example: `  $ vorteil packages push app.vorteil registry.example.com/apps/app:1.0
+  $ vorteil images build oci://registry.example.com/apps/app:1.0`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		fi, err := os.Stat(args[0])
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		if !fi.Mode().IsRegular() {
+			SetError(fmt.Errorf("PACKAGE '%s' is not a package file (you can use 'vorteil packages pack' to make one)", args[0]))
+			return
+		}
+
+		digest, err := vorteil.PushPackage(args[0], args[1], sourceOptions())
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		log.Printf("pushed package (%s): %s", digest, args[1])
+	},
+}
+
+var packagesPullCmd = &cobra.Command{
+	Use:   "pull REFERENCE OUTPUT",
+	Short: "Pull a package from an OCI registry",
+	Long: `Pull a package pushed to an OCI registry with 'vorteil packages push', and
+write it to a file. Its digest is verified as it's downloaded, and OUTPUT is
+only written once it has been.`,
+	Example: `  $ vorteil packages pull registry.example.com/apps/app:1.0 app.vorteil`,
+	Args:    cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		err := checkValidNewFileOutput(args[1], flagForce, "OUTPUT", "-f")
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		f, err := vio.AtomicCreate(args[1], 0644)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer f.Close()
+
+		err = vorteil.PullPackage(args[0], f, sourceOptions())
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		err = f.Commit()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		log.Printf("pulled package: %s", args[1])
+	},
+}
+
+func init() {
+	f := packagesPullCmd.Flags()
+	f.BoolVarP(&flagForce, "force", "f", false, "force overwrite of existing files")
+}
+
+// openCopySource opens src for packages copy, returning its size, or -1 if
+// the server doesn't say.
+func openCopySource(src string, header http.Header) (io.ReadCloser, int64, error) {
+
+	if !isURL(src) {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, 0, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return f, fi.Size(), nil
+	}
+
+	resp, err := vorteil.Send(http.MethodGet, src, nil, header, repositoryAuthentication(src))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to download '%s': %w", src, err)
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// writeCopy writes a package to the file at dst with fn, which is only put in
+// place if fn succeeds.
+func writeCopy(dst string, fn func(w io.Writer) (*vpkg.PackageInfo, error)) (*vpkg.PackageInfo, error) {
+
+	f, err := vio.AtomicCreate(dst, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := fn(f)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// uploadCopy streams a package written with fn to dst in a PUT request. If
+// fn fails the request body is cut short, so the server never receives a
+// complete package.
+func uploadCopy(dst string, header http.Header, fn func(w io.Writer) (*vpkg.PackageInfo, error)) (*vpkg.PackageInfo, error) {
+
+	pr, pw := io.Pipe()
+
+	type result struct {
+		info *vpkg.PackageInfo
+		err  error
+	}
+	ch := make(chan result, 1)
+
+	go func() {
+		info, err := fn(pw)
+		pw.CloseWithError(err)
+		ch <- result{info, err}
+	}()
+
+	resp, err := vorteil.Send(http.MethodPut, dst, pr, header, repositoryAuthentication(dst))
+	pr.CloseWithError(io.ErrClosedPipe)
+	res := <-ch
+	if res.err != nil {
+		return nil, res.err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload to '%s': %w", dst, err)
+	}
+	resp.Body.Close()
+
+	return res.info, nil
+}
+
+var packagesProvenanceCmd = &cobra.Command{
+	Use:   "provenance PACKAGE",
+	Short: "List where each file in a package came from",
+	Long: `List every file in PACKAGE with its origin: 'original' if it came from the
+project the package was built from, 'injected' if it was added on top with
+--files or 'packages add', and 'merged' if it was added on top over a file or
+directory that was already there.
+
+Packages only keep this information if they were written to a file, so a
+package that was streamed (for example to stdout) lists everything as
+original.`,
+	Example: `  $ vorteil packages provenance app.vorteil`,
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		builder, err := getPackageBuilder("PACKAGE", args[0])
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer builder.Close()
+
+		pkgReader, err := vpkg.ReaderFromBuilder(builder)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer pkgReader.Close()
+
+		provenance := vpkg.Provenance(pkgReader)
+
+		table := [][]string{{"PATH", "ORIGIN"}}
+		err = pkgReader.FS().Walk(func(path string, f vio.File) error {
+			if path == "." {
+				return nil
+			}
+			path = strings.TrimPrefix(path, "./")
+			origin, ok := provenance[path]
+			if !ok {
+				origin = vpkg.OriginOriginal
+			}
+			table = append(table, []string{"/" + path, string(origin)})
+			return nil
+		})
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		PlainTable(table)
+	},
+}
+
+func init() {
+	f := packagesProvenanceCmd.Flags()
+	f.StringVarP(&flagKey, "key", "k", "", "vrepo authentication key")
+}
+
+// rebaseDigests returns the VCFG of the package at path, and the digests of
+// its filesystem.
+func rebaseDigests(path string) (*vcfg.VCFG, map[string]string, error) {
+
+	pkgr, err := vorteil.OpenPackage(path)
+	if err != nil {
+		return nil, nil, ErrSourceResolve.Wrap(err)
+	}
+	defer pkgr.Close()
+
+	cfg, err := vcfg.LoadFile(pkgr.VCFG())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	digests, err := vpkg.FSDigests(pkgr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cfg, digests, nil
+}
+
+var packagesRebaseCmd = &cobra.Command{
+	Use:   "rebase APP --base NEWBASE --old-base OLDBASE",
+	Short: "Move a package onto a new base package",
+	Long: `Rebase the package APP, which was built on top of the package OLDBASE, onto the
+package NEWBASE, without rebuilding it from its project. This is useful for
+rolling updates to a shared base out to every package built on it.
+
+Everything APP added, modified, or removed compared to OLDBASE is reapplied
+over NEWBASE, and everything else is taken from NEWBASE. The VCFG of APP is
+merged over that of NEWBASE, except for the kernel, which is only taken from
+APP if it differs from the kernel of OLDBASE.
+
+Files that NEWBASE changed as well, in a different way to APP, are reported as
+conflicts, and get APP's version. The rebased package replaces APP unless
+--output is set.`,
+	Example: `  $ vorteil packages rebase app.vorteil --old-base base-1.0.vorteil --base base-1.1.vorteil`,
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		appPath := args[0]
+		basePath, _ := cmd.Flags().GetString("base")
+		oldBasePath, _ := cmd.Flags().GetString("old-base")
+
+		outputPath := appPath
+		if flagOutput != "" {
+			outputPath = flagOutput
+			err := checkValidNewFileOutput(outputPath, flagForce, "output", "-f")
+			if err != nil {
+				SetError(err)
+				return
+			}
+		}
+
+		oldCfg, oldDigests, err := rebaseDigests(oldBasePath)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		_, newDigests, err := rebaseDigests(basePath)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		baseReader, err := vorteil.OpenPackage(basePath)
+		if err != nil {
+			SetError(ErrSourceResolve.Wrap(err))
+			return
+		}
+
+		builder, err := vpkg.NewBuilderFromReader(baseReader)
+		if err != nil {
+			baseReader.Close()
+			SetError(err)
+			return
+		}
+		defer builder.Close()
+
+		appReader, err := vorteil.OpenPackage(appPath)
+		if err != nil {
+			SetError(ErrSourceResolve.Wrap(err))
+			return
+		}
+		defer appReader.Close()
+
+		appCfg, err := vcfg.LoadFile(appReader.VCFG())
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		// an unchanged kernel is the base's, so the new base's is kept
+		if appCfg.VM.Kernel == oldCfg.VM.Kernel {
+			appCfg.VM.Kernel = ""
+		}
+
+		err = builder.MergeVCFG(appCfg)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		icon, err := ioutil.ReadAll(appReader.Icon())
+		if err != nil {
+			SetError(err)
+			return
+		}
+		if len(icon) > 0 {
+			err = builder.SetIcon(vio.CustomFile(vio.CustomFileArgs{
+				Name:       "icon",
+				Size:       len(icon),
+				ReadCloser: ioutil.NopCloser(bytes.NewReader(icon)),
+			}))
+			if err != nil {
+				SetError(err)
+				return
+			}
+		}
+
+		report, err := vpkg.Rebase(builder, appReader, oldDigests, newDigests, tempDir())
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		builder.SetCompressionLevel(int(flagCompressionLevel))
+
+		// the package is only committed over the output afterwards, because
+		// APP is still being read
+		f, err := vio.AtomicCreate(outputPath, 0644)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer f.Close()
+
+		err = builder.Pack(f)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		err = f.Commit()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		if len(report.Conflicts) > 0 {
+			table := [][]string{{"PATH", "APP", "NEW BASE"}}
+			for _, c := range report.Conflicts {
+				table = append(table, []string{c.Path, c.App, c.Base})
+			}
+			PlainTable(table)
+			log.Warnf("%d files changed by both the app and the new base were given the app's version", len(report.Conflicts))
+		}
+
+		log.Printf("rebased package (%d changes reapplied): %s", len(report.Changes), outputPath)
+	},
+}
+
+func init() {
+	f := packagesRebaseCmd.Flags()
+	f.String("base", "", "path to the new base package")
+	f.String("old-base", "", "path to the base package APP was built on")
+	f.BoolVarP(&flagForce, "force", "f", false, "force overwrite of existing files")
+	f.StringVarP(&flagOutput, "output", "o", "", "path to put the rebased package file")
+	f.UintVar(&flagCompressionLevel, "compression-level", 1, "compression level (0-9)")
+	packagesRebaseCmd.MarkFlagRequired("base")
+	packagesRebaseCmd.MarkFlagRequired("old-base")
+}
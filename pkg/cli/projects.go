@@ -6,10 +6,21 @@ package cli
  */
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 
+	isatty "github.com/mattn/go-isatty"
 	"github.com/spf13/cobra"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/vpkg"
 	"github.com/vorteil/vorteil/pkg/vproj"
 )
 
@@ -73,14 +84,20 @@ ignore = [".vorteilproject", "*.vcfg", "debug"]
 
 Projects are valid sources for all VCLI commands that build Vorteil images or
 create Vorteil packages. For such commands, the source is assumed to be a
-project if it is a path to a directory containing a '.vorteilproject' file.
+project if it is a path to a directory containing a '.vorteilproject' file,
+or to a .zip or .tar.gz archive of one, which is extracted temporarily.
 Without any further information, the first target within the project file will
 be used, but alternate targets can be used by appending '::<target>' to the
-path.`,
+path. Commands that build or provision a project run in a terminal ask which
+target to use instead, if there's more than one and none was named.`,
 	Example: `  Turn an existing directory into a project, based on binary 'helloworld':
 
 	$ %s new helloworld
 
+List the targets in the project:
+
+	$ %s targets
+
 Check the validity of the project (useful if you've made changes):
 
 	$ %s lint
@@ -102,24 +119,24 @@ var newProjectCmd = &cobra.Command{
 		if len(args) != 0 {
 			err = vcfgFlags.Validate()
 			if err != nil {
-				SetError(err, 1)
+				SetError(err)
 				return
 			}
 			projectPath, err = filepath.Abs(args[0])
 			if err != nil {
-				SetError(err, 2)
+				SetError(err)
 				return
 			}
 			// make sure directory is created
 			err = os.MkdirAll(projectPath, os.ModePerm)
 			if err != nil {
-				SetError(err, 3)
+				SetError(err)
 				return
 			}
 
 			err = vproj.NewProject(projectPath, &overrideVCFG, log)
 			if err != nil {
-				SetError(err, 4)
+				SetError(err)
 				return
 			}
 		}
@@ -138,7 +155,7 @@ var importSharedObjectsCmd = &cobra.Command{
 		if len(args) != 0 {
 			projectPath, err = filepath.Abs(args[0])
 			if err != nil {
-				SetError(err, 1)
+				SetError(err)
 				return
 			}
 		}
@@ -147,13 +164,13 @@ var importSharedObjectsCmd = &cobra.Command{
 		importOperation, err := vproj.NewImportSharedObject(projectPath, flagExcludeDefault, log)
 
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
 
 		// Start Import Operation
 		if err = importOperation.Start(); err != nil {
-			SetError(err, 3)
+			SetError(err)
 			return
 		}
 	},
@@ -163,3 +180,324 @@ func init() {
 	f := importSharedObjectsCmd.Flags()
 	f.BoolVarP(&flagExcludeDefault, "no-defaults", "e", false, "exclude default shared objects")
 }
+
+var (
+	buildAllOutput string
+	buildAllFormat string
+	buildAllJobs   int
+	buildAllForce  bool
+)
+
+type buildAllResult struct {
+	target string
+	output string
+	err    error
+}
+
+// buildTarget builds a single project target into a disk image at outputPath.
+func buildTarget(t *vproj.Target, format vdisk.Format, outputPath string) error {
+
+	pkgBuilder, err := t.NewBuilder()
+	if err != nil {
+		return ErrSourceResolve.Wrap(err)
+	}
+	defer pkgBuilder.Close()
+
+	pkgReader, err := vpkg.ReaderFromBuilder(pkgBuilder)
+	if err != nil {
+		return err
+	}
+	defer pkgReader.Close()
+
+	f, err := vio.AtomicCreate(outputPath, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = vdisk.Build(context.Background(), f, &vdisk.BuildArgs{
+		WithVCFGDefaults: true,
+		PackageReader:    pkgReader,
+		Format:           format,
+		KernelOptions: vdisk.KernelOptions{
+			Shell: flagShell,
+		},
+		Logger: log,
+	})
+	if err != nil {
+		return ErrDiskBuild.Wrap(err)
+	}
+
+	return f.Commit()
+}
+
+// buildAllResults names the output of each target in dir, rejecting names
+// that are repeated or that would put the output anywhere else.
+func buildAllResults(targets []*vproj.Target, dir string, format vdisk.Format) ([]buildAllResult, error) {
+
+	results := make([]buildAllResult, len(targets))
+	for i, t := range targets {
+		name := t.Name
+		if name == "" {
+			name = "default"
+		}
+		if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return nil, fmt.Errorf("target name '%s' can't be used as a file name", name)
+		}
+		for j := 0; j < i; j++ {
+			if results[j].target == name {
+				return nil, fmt.Errorf("project has more than one target called '%s'", name)
+			}
+		}
+		results[i].target = name
+		results[i].output = filepath.Join(dir, name+format.Suffix())
+	}
+
+	return results, nil
+}
+
+var buildAllCmd = &cobra.Command{
+	Use:   "build-all [PROJECT]",
+	Short: "Build a disk image for every target in a project.",
+	Long: `Build a disk image for every target in a project.
+
+Each target is written to OUTPUT/<target><suffix>, where the suffix depends on
+the disk format. Unnamed targets are called 'default'. A summary of which
+targets succeeded and failed is printed once every build has finished.`,
+	Example: "  $ vorteil projects build-all . -o images/ --format raw --jobs 4",
+	Args:    cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		projectPath := "."
+		if len(args) != 0 {
+			projectPath = args[0]
+		}
+
+		format, err := parseImageFormat(buildAllFormat)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		if buildAllJobs < 1 {
+			SetError(fmt.Errorf("--jobs must be at least 1"))
+			return
+		}
+
+		proj, err := vproj.LoadProject(projectPath)
+		if err != nil {
+			SetError(ErrSourceResolve.Wrap(err))
+			return
+		}
+
+		targets := proj.Targets()
+		if len(targets) == 0 {
+			SetError(fmt.Errorf("project '%s' has no targets", projectPath))
+			return
+		}
+
+		results, err := buildAllResults(targets, buildAllOutput, format)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		for _, r := range results {
+			err = checkValidNewFileOutput(r.output, buildAllForce, "output", "-f")
+			if err != nil {
+				SetError(err)
+				return
+			}
+		}
+
+		err = os.MkdirAll(buildAllOutput, 0777)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		err = initKernels()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, buildAllJobs)
+		for i := range targets {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				results[i].err = buildTarget(targets[i], format, results[i].output)
+			}(i)
+		}
+		wg.Wait()
+
+		var failed int
+		table := [][]string{{"TARGET", "STATUS", "DETAIL"}}
+		for _, r := range results {
+			if r.err != nil {
+				failed++
+				table = append(table, []string{r.target, "failed", r.err.Error()})
+				continue
+			}
+			table = append(table, []string{r.target, "ok", r.output})
+		}
+
+		PlainTable(table)
+
+		if failed > 0 {
+			SetError(ErrDiskBuild.Wrap(fmt.Errorf("%d of %d targets failed to build", failed, len(results))))
+			return
+		}
+	},
+}
+
+func init() {
+	f := buildAllCmd.Flags()
+	f.StringVarP(&buildAllOutput, "output", "o", ".", "directory to write the disk images to")
+	f.StringVar(&buildAllFormat, "format", "vmdk", "disk image format")
+	f.IntVar(&buildAllJobs, "jobs", 1, "number of targets to build in parallel")
+	f.BoolVarP(&buildAllForce, "force", "f", false, "overwrite existing disk images")
+	f.BoolVar(&flagShell, "shell", false, "add a busybox shell environment to the images (overrides system.rescue-shell)")
+}
+
+// targetName returns the name a target is shown as, marking the default.
+func targetName(t *vproj.Target, i int) string {
+	name := t.Name
+	if name == "" {
+		name = "default"
+	}
+	if i == 0 {
+		name += " (default)"
+	}
+	return name
+}
+
+var projectsTargetsCmd = &cobra.Command{
+	Use:   "targets [PROJECT]",
+	Short: "List the targets in a project.",
+	Long: `List the targets in a project, with a summary of the configuration each one
+produces after its vcfgs are merged. The first target is the default, used
+when a source doesn't name one.`,
+	Example: "  $ vorteil projects targets .",
+	Args:    cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		projectPath := "."
+		if len(args) != 0 {
+			projectPath = args[0]
+		}
+
+		proj, err := vproj.LoadProject(projectPath)
+		if err != nil {
+			SetError(ErrSourceResolve.Wrap(err))
+			return
+		}
+
+		targets := proj.Targets()
+		if len(targets) == 0 {
+			SetError(fmt.Errorf("project '%s' has no targets", projectPath))
+			return
+		}
+
+		table := [][]string{{"TARGET", "VCFGS", "BINARY", "PROGRAMS", "RAM", "DISK SIZE"}}
+		for i, t := range targets {
+			row := []string{targetName(t, i), strings.Join(t.VCFGs, ", "), "", "", "", ""}
+			cfg, err := t.VCFG()
+			if err != nil {
+				row[2] = fmt.Sprintf("error: %v", err)
+			} else {
+				if len(cfg.Programs) > 0 {
+					row[2] = cfg.Programs[0].Binary
+				}
+				row[3] = strconv.Itoa(len(cfg.Programs))
+				row[4] = cfg.VM.RAM.String()
+				row[5] = cfg.VM.DiskSize.String()
+			}
+			table = append(table, row)
+		}
+
+		PlainTable(table)
+	},
+}
+
+// selectProjectTarget asks which target to use when src is a project with
+// more than one target and doesn't name one, returning src with the chosen
+// target appended. It returns src unchanged if there's nothing to choose, or
+// if stdin or stdout isn't a terminal to ask on.
+func selectProjectTarget(src string) (string, error) {
+	if !isatty.IsTerminal(os.Stdin.Fd()) || !isatty.IsTerminal(os.Stdout.Fd()) {
+		return src, nil
+	}
+	return promptProjectTarget(src, os.Stdin, os.Stdout)
+}
+
+func promptProjectTarget(src string, in io.Reader, out io.Writer) (string, error) {
+
+	if isURL(src) {
+		return src, nil
+	}
+
+	path, target := vproj.Split(src)
+	if target != "" {
+		return src, nil
+	}
+
+	proj, err := vproj.LoadProject(path)
+	if err != nil {
+		return src, nil
+	}
+
+	// unnamed targets other than the default can't be chosen by name
+	var choices []*vproj.Target
+	for i, t := range proj.Targets() {
+		if i == 0 || t.Name != "" {
+			choices = append(choices, t)
+		}
+	}
+	if len(choices) < 2 {
+		return src, nil
+	}
+
+	fmt.Fprintf(out, "Project '%s' has %d targets:\n", path, len(choices))
+	for i, t := range choices {
+		fmt.Fprintf(out, "  %d) %s\n", i+1, targetName(t, i))
+	}
+
+	r := bufio.NewReader(in)
+	for {
+		fmt.Fprintf(out, "Select a target [1]: ")
+		line, err := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" && err != nil {
+			return "", fmt.Errorf("no target selected: %w", err)
+		}
+
+		n := 1
+		if line != "" {
+			n, err = strconv.Atoi(line)
+			if err != nil || n < 1 || n > len(choices) {
+				fmt.Fprintf(out, "Enter a number from 1 to %d.\n", len(choices))
+				continue
+			}
+		}
+
+		if n == 1 {
+			return src, nil
+		}
+		return src + ":" + choices[n-1].Name, nil
+	}
+}
+
+// getTargetPackageBuilder is getPackageBuilder, except that it asks which
+// target to build if src is a project with more than one.
+func getTargetPackageBuilder(argName, src string) (vpkg.Builder, error) {
+	src, err := selectProjectTarget(src)
+	if err != nil {
+		return nil, err
+	}
+	return getPackageBuilder(argName, src)
+}
@@ -9,20 +9,28 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/google/uuid"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/provisioners"
 	"github.com/vorteil/vorteil/pkg/provisioners/amazon"
 	"github.com/vorteil/vorteil/pkg/provisioners/azure"
 	"github.com/vorteil/vorteil/pkg/provisioners/google"
+	"github.com/vorteil/vorteil/pkg/provisioners/libvirt"
 	"github.com/vorteil/vorteil/pkg/provisioners/registry"
+	"github.com/vorteil/vorteil/pkg/provisioners/vsphere"
+	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vdisk"
 	"github.com/vorteil/vorteil/pkg/vio"
 	"github.com/vorteil/vorteil/pkg/vpkg"
@@ -47,111 +55,81 @@ If your PROVISIONER was created with a passphrase you can input this passphrase
 		var provisionFile string
 		provisionFile = args[1]
 
+		if provisionLogFile != "" {
+			lf, err := os.OpenFile(provisionLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				SetError(fmt.Errorf("Could not open log file '%s', error: %v", provisionLogFile, err))
+				return
+			}
+			defer lf.Close()
+
+			// everything below, including the disk build and the
+			// provisioner, logs through the tee
+			log = elog.NewTee(log, lf, flagDebug)
+		}
+
 		// Load the provided provisioner file
 		if _, err := os.Stat(provisionFile); err != nil {
-			SetError(fmt.Errorf("Could not read PROVISIONER '%s' , error: %v", provisionFile, err), 1)
+			SetError(fmt.Errorf("Could not read PROVISIONER '%s' , error: %v", provisionFile, err))
 			return
 		}
 
 		b, err := ioutil.ReadFile(provisionFile)
 		if err != nil {
-			SetError(fmt.Errorf("Could not read PROVISIONER '%s' , error: %v", provisionFile, err), 2)
+			SetError(fmt.Errorf("Could not read PROVISIONER '%s' , error: %v", provisionFile, err))
 			return
 		}
 
-		data, err := provisioners.Decrypt(b, provisionPassPhrase)
+		passphrase, err := rekeySecret(provisionPassPhrase, provisionPassPhraseFile)
 		if err != nil {
-			SetError(err, 3)
+			SetError(err)
 			return
 		}
 
-		ptype, err := provisioners.ProvisionerType(data)
+		data, err := provisioners.Decrypt(b, passphrase)
 		if err != nil {
-			SetError(err, 4)
+			SetError(err)
 			return
 		}
 
-		prov, err := registry.NewProvisioner(ptype, log, data)
+		ptype, err := provisioners.ProvisionerType(data)
 		if err != nil {
-			SetError(err, 5)
+			SetError(err)
 			return
 		}
 
-		buildablePath := "."
-		if len(args) >= 1 {
-			buildablePath = args[0]
-		}
-
-		pkgBuilder, err := getPackageBuilder("BUILDABLE", buildablePath)
+		prov, err := registry.NewProvisioner(ptype, log, data)
 		if err != nil {
-			SetError(err, 9)
-
+			SetError(err)
 			return
 		}
 
-		err = modifyPackageBuilder(pkgBuilder)
+		dataDisks, err := parseDataDisks(provisionDataDisks)
 		if err != nil {
-			SetError(err, 10)
+			SetError(err)
 			return
 		}
 
-		pkgReader, err := vpkg.ReaderFromBuilder(pkgBuilder)
+		tags, err := parseTags(provisionTags)
 		if err != nil {
-			SetError(err, 11)
+			SetError(err)
 			return
 		}
-		defer pkgReader.Close()
 
-		pkgReader, err = vpkg.PeekVCFG(pkgReader)
-		if err != nil {
-			SetError(err, 12)
-			return
+		buildablePath := "."
+		if len(args) >= 1 {
+			buildablePath = args[0]
 		}
 
 		err = initKernels()
 		if err != nil {
-			SetError(err, 13)
-			return
-		}
-
-		f, err := ioutil.TempFile(os.TempDir(), "vorteil.disk")
-		if err != nil {
-			SetError(err, 14)
-			return
-		}
-		defer os.Remove(f.Name())
-		defer f.Close()
-
-		err = vdisk.Build(context.Background(), f, &vdisk.BuildArgs{
-			WithVCFGDefaults: true,
-			PackageReader:    pkgReader,
-			Format:           prov.DiskFormat(),
-			SizeAlign:        int64(prov.SizeAlign()),
-			KernelOptions: vdisk.KernelOptions{
-				Shell: flagShell,
-			},
-			Logger: log,
-		})
-		if err != nil {
-			SetError(err, 15)
+			SetError(err)
 			return
 		}
 
-		err = f.Close()
+		pkgReader, err := loadProvisionPackage(buildablePath)
 		if err != nil {
-			SetError(err, 16)
-			return
-		}
-
-		err = pkgReader.Close()
-		if err != nil {
-			SetError(err, 17)
-			return
-		}
-
-		image, err := vio.LazyOpen(f.Name())
-		if err != nil {
-			SetError(err, 18)
+			SetError(err)
 			return
 		}
 
@@ -160,17 +138,21 @@ If your PROVISIONER was created with a passphrase you can input this passphrase
 			log.Infof("--name flag what not set using generated uuid '%s'", provisionName)
 		}
 
-		ctx := context.TODO()
-		err = prov.Provision(&provisioners.ProvisionArgs{
-			Context:         ctx,
-			Image:           image,
+		provisionArgs := &provisioners.ProvisionArgs{
+			Context:         context.TODO(),
 			Name:            provisionName,
 			Description:     provisionDescription,
 			Force:           provisionForce,
 			ReadyWhenUsable: provisionReadyWhenUsable,
-		})
+			KeepOnFailure:   provisionKeepOnFailure,
+			Strict:          provisionStrict,
+			DataDisks:       dataDisks,
+			Tags:            tags,
+		}
+
+		err = provisionPackage(prov, pkgReader, provisionArgs, provisionKeepDisk)
 		if err != nil {
-			SetError(err, 19)
+			SetError(err)
 			return
 		}
 
@@ -178,6 +160,248 @@ If your PROVISIONER was created with a passphrase you can input this passphrase
 	},
 }
 
+// loadProvisionPackage loads the buildable at path, with the package
+// overrides from the command line applied, and returns a reader for it.
+func loadProvisionPackage(path string) (vpkg.Reader, error) {
+
+	pkgBuilder, err := getTargetPackageBuilder("BUILDABLE", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = modifyPackageBuilder(pkgBuilder)
+	if err != nil {
+		pkgBuilder.Close()
+		return nil, err
+	}
+
+	pkgReader, err := vpkg.ReaderFromBuilder(pkgBuilder)
+	if err != nil {
+		pkgBuilder.Close()
+		return nil, ErrSourceResolve.Wrap(err)
+	}
+
+	pkgReader, err = checkPrograms(pkgReader)
+	if err != nil {
+		pkgReader.Close()
+		return nil, ErrSourceResolve.Wrap(err)
+	}
+
+	return pkgReader, nil
+}
+
+// provisionPackage builds a disk from pkgReader in prov's format, and
+// provisions it with args, adding the image and the VM settings from the
+// package's VCFG. The disk is kept at keepDisk if it isn't empty. The reader
+// is always closed, as soon as the disk is built if it gets that far. Kernels
+// must already be set up.
+func provisionPackage(prov provisioners.Provisioner, pkgReader vpkg.Reader, args *provisioners.ProvisionArgs, keepDisk string) error {
+
+	defer func() {
+		if pkgReader != nil {
+			pkgReader.Close()
+		}
+	}()
+
+	cfg, err := vcfg.LoadFile(pkgReader.VCFG())
+	if err != nil {
+		return ErrSourceResolve.Wrap(err)
+	}
+
+	args.CPUs = cfg.VM.CPUs
+	args.RAM = cfg.VM.RAM
+	args.TempDir = tempDir()
+
+	buildArgs := &vdisk.BuildArgs{
+		WithVCFGDefaults: true,
+		PackageReader:    pkgReader,
+		Format:           prov.DiskFormat(),
+		SizeAlign:        int64(prov.SizeAlign()),
+		KernelOptions: vdisk.KernelOptions{
+			Shell: flagShell,
+		},
+		Logger:          log,
+		Strip:           flagStrip,
+		AllowNoPrograms: flagAllowNoPrograms,
+		TempDir:         tempDir(),
+	}
+
+	// the disk can only be streamed straight into the upload if it
+	// doesn't need to be kept afterwards
+	if prov.WantsCompressed() && keepDisk == "" {
+		buildErr, err := streamProvision(prov, buildArgs, args)
+		if buildErr != nil {
+			return ErrDiskBuild.Wrap(buildErr)
+		}
+		return ErrProvision.Wrap(err)
+	}
+
+	size, err := vdisk.EstimateSize(pkgReader, cfg)
+	if err != nil {
+		return ErrDiskBuild.Wrap(err)
+	}
+
+	err = checkFreeSpace(tempDir(), size)
+	if err != nil {
+		return ErrDiskBuild.Wrap(err)
+	}
+
+	f, err := ioutil.TempFile(tempDir(), "vorteil.disk")
+	if err != nil {
+		return ErrDiskBuild.Wrap(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = vdisk.Build(context.Background(), f, buildArgs)
+	if err != nil {
+		return ErrDiskBuild.Wrap(err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		return ErrDiskBuild.Wrap(err)
+	}
+
+	if keepDisk != "" {
+		// registered after the os.Remove above so that it runs first,
+		// and keeps the disk even if provisioning fails
+		defer func() {
+			err := keepProvisionDisk(f.Name(), keepDisk)
+			if err != nil {
+				log.Errorf("Failed to keep built disk: %v", err)
+				return
+			}
+			log.Printf("Kept built disk at %s", keepDisk)
+		}()
+	}
+
+	err = pkgReader.Close()
+	pkgReader = nil
+	if err != nil {
+		return ErrProvision.Wrap(err)
+	}
+
+	args.Image, err = vio.LazyOpen(f.Name())
+	if err != nil {
+		return ErrProvision.Wrap(err)
+	}
+
+	return ErrProvision.Wrap(prov.Provision(args))
+}
+
+// errUploadStopped is what a disk being streamed into an upload fails with if
+// the provisioner stops reading it before it's finished.
+var errUploadStopped = errors.New("upload stopped before the disk was built")
+
+// streamProvision builds a disk in the provisioner's format straight into
+// its upload, without a temporary file, for provisioners whose formats are
+// compressed as they're written. It returns the error building the disk
+// separately from the error provisioning it, and ignores build errors that
+// are only caused by the upload stopping early.
+func streamProvision(prov provisioners.Provisioner, buildArgs *vdisk.BuildArgs, args *provisioners.ProvisionArgs) (buildErr error, err error) {
+
+	pr, pw := io.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		w, err := vio.WriteSeeker(pw)
+		if err == nil {
+			err = vdisk.Build(context.Background(), w, buildArgs)
+		}
+		// the result is ready before the upload sees the end of the
+		// stream, so a failed build is never mistaken for a failed upload
+		done <- err
+		pw.CloseWithError(err)
+	}()
+
+	format := prov.DiskFormat()
+	args.Image = vio.CustomFile(vio.CustomFileArgs{
+		Name:       "disk" + format.Suffix(),
+		ReadCloser: pr,
+	})
+
+	err = prov.Provision(args)
+
+	select {
+	case buildErr = <-done:
+	default:
+		pr.CloseWithError(errUploadStopped)
+		<-done
+	}
+
+	return buildErr, err
+}
+
+// parseDataDisks parses the sizes given to --data-disk.
+func parseDataDisks(sizes []string) ([]int64, error) {
+
+	var disks []int64
+	for _, s := range sizes {
+		size, err := vcfg.ParseBytes(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data disk size '%s': %v", s, err)
+		}
+		if size <= 0 {
+			return nil, fmt.Errorf("invalid data disk size '%s': must be larger than zero", s)
+		}
+		disks = append(disks, int64(size))
+	}
+
+	return disks, nil
+}
+
+// parseTags parses the 'key=value' pairs given to --tag.
+func parseTags(pairs []string) (map[string]string, error) {
+
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	tags := make(map[string]string)
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid tag '%s': should be key=value", pair)
+		}
+		if _, ok := tags[kv[0]]; ok {
+			return nil, fmt.Errorf("tag '%s' is set more than once", kv[0])
+		}
+		tags[kv[0]] = kv[1]
+	}
+
+	return tags, nil
+}
+
+// keepProvisionDisk moves the built disk at src to dst, falling back to a copy
+// if the two are on different file-systems.
+func keepProvisionDisk(src, dst string) error {
+
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := vio.AtomicCreate(dst, 0666)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+
+	return out.Commit()
+}
+
 func generateProvisionUUID() string {
 	pName := strings.ReplaceAll(uuid.New().String(), "-", "")
 
@@ -195,6 +419,13 @@ var (
 	provisionForce           bool
 	provisionReadyWhenUsable bool
 	provisionPassPhrase      string
+	provisionPassPhraseFile  string
+	provisionKeepDisk        string
+	provisionKeepOnFailure   bool
+	provisionStrict          bool
+	provisionDataDisks       []string
+	provisionTags            []string
+	provisionLogFile         string
 )
 
 func init() {
@@ -206,6 +437,16 @@ func init() {
 	f.BoolVarP(&provisionForce, "force", "f", false, "Force an overwrite if an existing image conflicts with the new.")
 	f.BoolVarP(&provisionReadyWhenUsable, "ready-when-usable", "r", false, "Return successfully as soon as the operation is complete, regardless of whether or not the platform is still processing the image.")
 	f.StringVarP(&provisionPassPhrase, "passphrase", "s", "", "Passphrase used to decrypt encrypted provisioner data.")
+	f.StringVar(&provisionPassPhraseFile, "key-file", "", "Path of a key file used to decrypt encrypted provisioner data, instead of a passphrase.")
+	f.StringVar(&provisionKeepDisk, "keep-disk", "", "Keep the built disk image at this path instead of deleting it after provisioning.")
+	f.BoolVar(&provisionKeepOnFailure, "keep-on-failure", false, "Keep any resources created on the remote platform if provisioning fails, instead of removing them.")
+	f.BoolVar(&provisionStrict, "strict", false, "Fail instead of warning about provisioner configuration problems, like a bucket in a different location to the image.")
+	f.StringArrayVar(&provisionDataDisks, "data-disk", nil, "Size of an empty data disk to attach alongside the boot disk, e.g. '10 GiB', if supported by the platform (repeatable).")
+	f.StringArrayVar(&provisionTags, "tag", nil, "Tag to apply to the resulting image as key=value, e.g. 'team=core', if supported by the platform (repeatable).")
+	f.BoolVar(&flagStrip, "strip", false, "remove debugging information and symbol tables from ELF binaries")
+	f.BoolVar(&flagAllowNoPrograms, "allow-no-programs", false, "build the package even if it defines no programs, e.g. for a data-only disk")
+	f.StringVar(&flagTmpDir, "tmpdir", "", "directory to create the temporary disk and other temporary files in (default $VORTEIL_TMPDIR or the system default)")
+	f.StringVar(&provisionLogFile, "log-file", "", "Also append all log messages to this file, while still showing progress on the terminal.")
 }
 
 var provisionersCmd = &cobra.Command{
@@ -215,6 +456,494 @@ var provisionersCmd = &cobra.Command{
 	Example: ``,
 }
 
+var (
+	provisionersRekeyOldPassphrase string
+	provisionersRekeyNewPassphrase string
+	provisionersRekeyOldKeyFile    string
+	provisionersRekeyNewKeyFile    string
+)
+
+// rekeySecret returns the key file's contents if a key file was given,
+// otherwise the passphrase. Giving both is an error, so that no command
+// silently picks one of them.
+func rekeySecret(passphrase, keyFile string) (string, error) {
+	if keyFile == "" {
+		return passphrase, nil
+	}
+	if passphrase != "" {
+		return "", fmt.Errorf("a passphrase and a key file cannot both be provided")
+	}
+	return provisioners.ReadKeyFile(keyFile)
+}
+
+var provisionersRekeyCmd = &cobra.Command{
+	Use:   "rekey PROVISIONER",
+	Short: "Re-encrypt a provisioner file with a new passphrase or key file.",
+	Long: `Re-encrypt a provisioner file with a new passphrase or key file.
+
+The PROVISIONER is decrypted with the old passphrase (or key file) and, only if
+that succeeds, re-encrypted with the new one. The file is replaced atomically,
+so an interrupted rekey leaves the original untouched.`,
+	Example: "  $ vorteil provisioners rekey ./awsProvisioner --old-passphrase old --new-key-file ./provisioner.key",
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		oldSecret, err := rekeySecret(provisionersRekeyOldPassphrase, provisionersRekeyOldKeyFile)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		newSecret, err := rekeySecret(provisionersRekeyNewPassphrase, provisionersRekeyNewKeyFile)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		b, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		out, err := provisioners.Rekey(b, oldSecret, newSecret)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		err = vio.AtomicWriteFile(args[0], out, 0644)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		log.Printf("Rekeyed provisioner '%s'", args[0])
+	},
+}
+
+func init() {
+	f := provisionersRekeyCmd.Flags()
+	f.StringVar(&provisionersRekeyOldPassphrase, "old-passphrase", "", "Passphrase the provisioner is currently encrypted with.")
+	f.StringVar(&provisionersRekeyNewPassphrase, "new-passphrase", "", "Passphrase to re-encrypt the provisioner with.")
+	f.StringVar(&provisionersRekeyOldKeyFile, "old-key-file", "", "Key file the provisioner is currently encrypted with.")
+	f.StringVar(&provisionersRekeyNewKeyFile, "new-key-file", "", "Key file to re-encrypt the provisioner with.")
+}
+
+var (
+	provisionersDiffPassphrase string
+	provisionersDiffKeyFile    string
+)
+
+// readProvisioner reads and decrypts the provisioner file at path.
+func readProvisioner(path, secret string) ([]byte, error) {
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := provisioners.Decrypt(b, secret)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt provisioner '%s': %w", path, err)
+	}
+
+	return data, nil
+}
+
+var provisionersDiffCmd = &cobra.Command{
+	Use:   "diff PROVISIONER PROVISIONER",
+	Short: "Compare two provisioner files.",
+	Long: `Compare two provisioner files.
+
+Both provisioners are decrypted with the same passphrase (or key file), and
+every setting that differs between them is listed. The values of secrets,
+such as access keys, are masked. Provisioners of different types cannot be
+compared.`,
+	Example: "  $ vorteil provisioners diff ./awsProvisioner ./awsProvisioner.old --passphrase secret",
+	Args:    cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		secret, err := rekeySecret(provisionersDiffPassphrase, provisionersDiffKeyFile)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		a, err := readProvisioner(args[0], secret)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		b, err := readProvisioner(args[1], secret)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		diffs, err := provisioners.Diff(a, b)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		if len(diffs) == 0 {
+			log.Printf("Provisioners are identical")
+			return
+		}
+
+		table := [][]string{{"KEY", args[0], args[1]}}
+		for _, d := range diffs {
+			va, vb := d.A, d.B
+			if va == "" {
+				va = "-"
+			}
+			if vb == "" {
+				vb = "-"
+			}
+			table = append(table, []string{d.Key, va, vb})
+		}
+
+		PlainTable(table)
+	},
+}
+
+func init() {
+	f := provisionersDiffCmd.Flags()
+	f.StringVarP(&provisionersDiffPassphrase, "passphrase", "s", "", "Passphrase used to decrypt both provisioners.")
+	f.StringVar(&provisionersDiffKeyFile, "key-file", "", "Key file used to decrypt both provisioners, instead of a passphrase.")
+}
+
+var (
+	provisionConsoleProvisioner string
+	provisionConsoleName        string
+	provisionConsolePassphrase  string
+	provisionConsoleKeyFile     string
+)
+
+var provisionConsoleCmd = &cobra.Command{
+	Use:   "console",
+	Short: "Print the serial console output of an instance.",
+	Long: `Print the serial console output of an instance running on the platform a
+provisioner targets, which can help work out why a freshly provisioned image
+isn't coming up.
+
+Instances aren't created by 'vorteil provision', so --name is the name of an
+instance launched from a provisioned image. Supported platforms are Amazon
+EC2 (an instance ID or Name tag), Google Compute Engine, and Azure (a VM in
+the provisioner's resource group with boot diagnostics enabled).`,
+	Example: "  $ vorteil provision console --provisioner ./awsProvisioner --name my-app",
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		secret, err := rekeySecret(provisionConsolePassphrase, provisionConsoleKeyFile)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		data, err := readProvisioner(provisionConsoleProvisioner, secret)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		ptype, err := provisioners.ProvisionerType(data)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		prov, err := registry.NewProvisioner(ptype, log, data)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		err = prov.Console(context.Background(), provisionConsoleName, os.Stdout)
+		if err != nil {
+			SetError(err)
+			return
+		}
+	},
+}
+
+func init() {
+	f := provisionConsoleCmd.Flags()
+	f.StringVarP(&provisionConsoleProvisioner, "provisioner", "p", "", "Provisioner file for the platform the instance is running on.")
+	f.StringVarP(&provisionConsoleName, "name", "n", "", "Name of the instance.")
+	f.StringVarP(&provisionConsolePassphrase, "passphrase", "s", "", "Passphrase used to decrypt encrypted provisioner data.")
+	f.StringVar(&provisionConsoleKeyFile, "key-file", "", "Path of a key file used to decrypt encrypted provisioner data, instead of a passphrase.")
+	provisionConsoleCmd.MarkFlagRequired("provisioner")
+	provisionConsoleCmd.MarkFlagRequired("name")
+}
+
+var (
+	provisionBatchProvisioner   string
+	provisionBatchPassphrase    string
+	provisionBatchKeyFile       string
+	provisionBatchJobs          int
+	provisionBatchForce         bool
+	provisionBatchKeepOnFailure bool
+	provisionBatchStrict        bool
+	provisionBatchTags          []string
+)
+
+type provisionBatchResult struct {
+	name string
+	path string
+	err  error
+}
+
+var provisionBatchCmd = &cobra.Command{
+	Use:   "batch DIRECTORY",
+	Short: "Provision every package in a directory.",
+	Long: `Build and provision every package (a file ending in .vorteil) in DIRECTORY to
+the platform a provisioner targets, with up to --jobs of them at a time. Each
+image is named after its package file, without the suffix.
+
+A package failing doesn't stop the others. A summary of which packages
+succeeded and failed is printed once every one has finished.`,
+	Example: "  $ vorteil provision batch --provisioner ./awsProvisioner ./packages --jobs 4",
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		if provisionBatchJobs < 1 {
+			SetError(fmt.Errorf("--jobs must be at least 1"))
+			return
+		}
+
+		secret, err := rekeySecret(provisionBatchPassphrase, provisionBatchKeyFile)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		data, err := readProvisioner(provisionBatchProvisioner, secret)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		ptype, err := provisioners.ProvisionerType(data)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		tags, err := parseTags(provisionBatchTags)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		paths, err := batchPackages(args[0])
+		if err != nil {
+			SetError(ErrSourceResolve.Wrap(err))
+			return
+		}
+
+		err = initKernels()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		results := make([]provisionBatchResult, len(paths))
+		for i, path := range paths {
+			results[i].path = path
+			results[i].name = strings.TrimSuffix(filepath.Base(path), vpkg.Suffix)
+		}
+
+		// each package is only opened once a job is free to provision it,
+		// and provisionPackage closes it
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, provisionBatchJobs)
+		for i := range results {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				// provisioners keep state while they provision, so every
+				// package gets its own
+				prov, err := registry.NewProvisioner(ptype, log, data)
+				if err != nil {
+					results[i].err = err
+					return
+				}
+
+				pkgReader, err := loadProvisionPackage(results[i].path)
+				if err != nil {
+					results[i].err = err
+					return
+				}
+
+				results[i].err = provisionPackage(prov, pkgReader, &provisioners.ProvisionArgs{
+					Context:       context.TODO(),
+					Name:          results[i].name,
+					Force:         provisionBatchForce,
+					KeepOnFailure: provisionBatchKeepOnFailure,
+					Strict:        provisionBatchStrict,
+					Tags:          tags,
+				}, "")
+			}(i)
+		}
+		wg.Wait()
+
+		var failed int
+		table := [][]string{{"PACKAGE", "IMAGE", "STATUS", "DETAIL"}}
+		for _, r := range results {
+			if r.err != nil {
+				failed++
+				table = append(table, []string{filepath.Base(r.path), r.name, "failed", r.err.Error()})
+				continue
+			}
+			table = append(table, []string{filepath.Base(r.path), r.name, "ok", ""})
+		}
+
+		PlainTable(table)
+
+		if failed > 0 {
+			SetError(ErrProvision.Wrap(fmt.Errorf("%d of %d packages failed to provision", failed, len(results))))
+			return
+		}
+	},
+}
+
+func init() {
+	f := provisionBatchCmd.Flags()
+	f.StringVarP(&provisionBatchProvisioner, "provisioner", "p", "", "Provisioner file for the platform to provision the packages to.")
+	f.StringVarP(&provisionBatchPassphrase, "passphrase", "s", "", "Passphrase used to decrypt encrypted provisioner data.")
+	f.StringVar(&provisionBatchKeyFile, "key-file", "", "Path of a key file used to decrypt encrypted provisioner data, instead of a passphrase.")
+	f.IntVar(&provisionBatchJobs, "jobs", 1, "number of packages to build and provision in parallel")
+	f.BoolVarP(&provisionBatchForce, "force", "f", false, "Force an overwrite if existing images conflict with the new.")
+	f.BoolVar(&provisionBatchKeepOnFailure, "keep-on-failure", false, "Keep any resources created on the remote platform for a package that fails to provision, instead of removing them.")
+	f.BoolVar(&provisionBatchStrict, "strict", false, "Fail instead of warning about provisioner configuration problems, like a bucket in a different location to the images.")
+	f.StringArrayVar(&provisionBatchTags, "tag", nil, "Tag to apply to every resulting image as key=value, e.g. 'team=core', if supported by the platform (repeatable).")
+	f.BoolVar(&flagStrip, "strip", false, "remove debugging information and symbol tables from ELF binaries")
+	f.StringVar(&flagTmpDir, "tmpdir", "", "directory to create the temporary disks and other temporary files in (default $VORTEIL_TMPDIR or the system default)")
+	provisionBatchCmd.MarkFlagRequired("provisioner")
+}
+
+// batchPackages returns the paths of the package files in dir.
+func batchPackages(dir string) ([]string, error) {
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, fi := range fis {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), vpkg.Suffix) {
+			paths = append(paths, filepath.Join(dir, fi.Name()))
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no packages found in '%s'", dir)
+	}
+
+	return paths, nil
+}
+
+var (
+	provisionExportProvisioner string
+	provisionExportName        string
+	provisionExportPassphrase  string
+	provisionExportKeyFile     string
+)
+
+var provisionExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Download a provisioned image to a local file.",
+	Long: `Download the image called --name from the platform a provisioner targets, and
+write its disk to --output as a raw disk image. This can back up images, or
+move them between platforms by provisioning the exported disk elsewhere.
+
+Supported platforms are Amazon EC2, which exports the AMI to the
+provisioner's bucket first and needs the 'vmimport' service role, Google
+Compute Engine, which runs a Cloud Build in the provisioner's project to
+export the image to its bucket, and libvirt, which downloads the domain's boot
+volume. Exports from the clouds can take a long time.`,
+	Example: "  $ vorteil provision export --provisioner ./awsProvisioner --name my-app -o my-app.raw",
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+
+		err := checkValidNewFileOutput(flagOutput, flagForce, "output", "-f")
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		secret, err := rekeySecret(provisionExportPassphrase, provisionExportKeyFile)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		data, err := readProvisioner(provisionExportProvisioner, secret)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		ptype, err := provisioners.ProvisionerType(data)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		prov, err := registry.NewProvisioner(ptype, log, data)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		err = exportImage(context.Background(), prov, provisionExportName, flagOutput)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		log.Printf("Exported %s to %s", provisionExportName, flagOutput)
+	},
+}
+
+// exportImage exports the image called name with prov to outputPath, which
+// is only replaced if the export succeeds.
+func exportImage(ctx context.Context, prov provisioners.Provisioner, name, outputPath string) error {
+
+	f, err := vio.AtomicCreate(outputPath, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = prov.Export(ctx, name, f)
+	if err != nil {
+		return err
+	}
+
+	return f.Commit()
+}
+
+func init() {
+	f := provisionExportCmd.Flags()
+	f.StringVarP(&provisionExportProvisioner, "provisioner", "p", "", "Provisioner file for the platform the image is on.")
+	f.StringVarP(&provisionExportName, "name", "n", "", "Name of the image.")
+	f.StringVarP(&provisionExportPassphrase, "passphrase", "s", "", "Passphrase used to decrypt encrypted provisioner data.")
+	f.StringVar(&provisionExportKeyFile, "key-file", "", "Path of a key file used to decrypt encrypted provisioner data, instead of a passphrase.")
+	f.StringVarP(&flagOutput, "output", "o", "", "Path to write the raw disk image to.")
+	f.BoolVarP(&flagForce, "force", "f", false, "force overwrite of existing files")
+	provisionExportCmd.MarkFlagRequired("provisioner")
+	provisionExportCmd.MarkFlagRequired("name")
+	provisionExportCmd.MarkFlagRequired("output")
+}
+
 var provisionersNewCmd = &cobra.Command{
 	Use:   "new",
 	Short: "Add a new provisioner.",
@@ -222,10 +951,12 @@ var provisionersNewCmd = &cobra.Command{
 
 var (
 	provisionersNewPassphrase string
+	provisionersNewForce      bool
 
 	// Google Cloud Platform
-	provisionersNewGoogleBucket  string
-	provisionersNewGoogleKeyFile string
+	provisionersNewGoogleBucket   string
+	provisionersNewGoogleKeyFile  string
+	provisionersNewGoogleLocation string
 
 	// Amazon Web Services
 	provisionersNewAmazonKey    string
@@ -240,6 +971,22 @@ var (
 	provisionersNewAzureResourceGroup      string
 	provisionersNewAzureStorageAccountKey  string
 	provisionersNewAzureStorageAccountName string
+
+	// VMware vSphere
+	provisionersNewVSphereURL          string
+	provisionersNewVSphereUsername     string
+	provisionersNewVSpherePassword     string
+	provisionersNewVSphereInsecure     bool
+	provisionersNewVSphereDatacenter   string
+	provisionersNewVSphereDatastore    string
+	provisionersNewVSphereResourcePool string
+	provisionersNewVSphereNetwork      string
+
+	// libvirt
+	provisionersNewLibvirtURI     string
+	provisionersNewLibvirtPool    string
+	provisionersNewLibvirtNetwork string
+	provisionersNewLibvirtStart   bool
 )
 
 var provisionersNewAmazonEC2Cmd = &cobra.Command{
@@ -248,34 +995,41 @@ var provisionersNewAmazonEC2Cmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 
-		f, err := os.OpenFile(args[0], os.O_RDWR|os.O_CREATE, 0644)
+		err := checkValidNewFileOutput(args[0], provisionersNewForce, "OUTPUT_FILE", "--force")
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		f, err := vio.AtomicCreate(args[0], 0644)
 		if err != nil {
-			SetError(err, 1)
+			SetError(err)
 			return
 		}
 		defer f.Close()
 
-		p, err := amazon.NewProvisioner(log, &amazon.Config{
-			Key:    provisionersNewAmazonKey,
-			Secret: provisionersNewAmazonSecret,
-			Region: provisionersNewAmazonRegion,
-			Bucket: provisionersNewAmazonBucket,
-		})
+		p, err := newAmazonEC2Provisioner()
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
 
 		data, err := p.Marshal()
 		if err != nil {
-			SetError(err, 3)
+			SetError(err)
 			return
 		}
 
 		out := provisioners.Encrypt(data, provisionersNewPassphrase)
 		_, err = io.Copy(f, bytes.NewReader(out))
 		if err != nil {
-			SetError(err, 4)
+			SetError(err)
+			return
+		}
+
+		err = f.Commit()
+		if err != nil {
+			SetError(err)
 			return
 		}
 
@@ -292,6 +1046,7 @@ func init() {
 	f.StringVarP(&provisionersNewAmazonBucket, "bucket", "b", "", "AWS bucket")
 	provisionersNewAmazonEC2Cmd.MarkFlagRequired("bucket")
 	f.StringVarP(&provisionersNewPassphrase, "passphrase", "p", "", "Passphrase for encrypting exported provisioner data.")
+	f.BoolVar(&provisionersNewForce, "force", false, "force overwrite of existing files")
 }
 
 var provisionersNewAzureCmd = &cobra.Command{
@@ -300,49 +1055,41 @@ var provisionersNewAzureCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 
-		f, err := os.OpenFile(args[0], os.O_RDWR|os.O_CREATE, 0644)
+		err := checkValidNewFileOutput(args[0], provisionersNewForce, "OUTPUT_FILE", "--force")
 		if err != nil {
-			SetError(err, 1)
+			SetError(err)
 			return
 		}
-		defer f.Close()
 
-		path := provisionersNewAzureKeyFile
-		_, err = os.Stat(path)
+		f, err := vio.AtomicCreate(args[0], 0644)
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
+		defer f.Close()
 
-		b, err := ioutil.ReadFile(path)
+		p, err := newAzureProvisioner()
 		if err != nil {
-			SetError(err, 3)
+			SetError(err)
 			return
 		}
 
-		p, err := azure.NewProvisioner(log, &azure.Config{
-			Key:                base64.StdEncoding.EncodeToString(b),
-			Container:          provisionersNewAzureContainer,
-			Location:           provisionersNewAzureLocation,
-			ResourceGroup:      provisionersNewAzureResourceGroup,
-			StorageAccountKey:  provisionersNewAzureStorageAccountKey,
-			StorageAccountName: provisionersNewAzureStorageAccountName,
-		})
+		data, err := p.Marshal()
 		if err != nil {
-			SetError(err, 4)
+			SetError(err)
 			return
 		}
 
-		data, err := p.Marshal()
+		out := provisioners.Encrypt(data, provisionersNewPassphrase)
+		_, err = io.Copy(f, bytes.NewReader(out))
 		if err != nil {
-			SetError(err, 5)
+			SetError(err)
 			return
 		}
 
-		out := provisioners.Encrypt(data, provisionersNewPassphrase)
-		_, err = io.Copy(f, bytes.NewReader(out))
+		err = f.Commit()
 		if err != nil {
-			SetError(err, 6)
+			SetError(err)
 			return
 		}
 
@@ -364,6 +1111,7 @@ func init() {
 	f.StringVarP(&provisionersNewAzureStorageAccountName, "storage-account-name", "n", "", "Azure storage account name")
 	provisionersNewAzureCmd.MarkFlagRequired("storage-account-name")
 	f.StringVarP(&provisionersNewPassphrase, "passphrase", "p", "", "Passphrase for encrypting exported provisioner data.")
+	f.BoolVar(&provisionersNewForce, "force", false, "force overwrite of existing files")
 
 }
 
@@ -373,55 +1121,311 @@ var provisionersNewGoogleCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1), // Single arg, points to output file
 	Run: func(cmd *cobra.Command, args []string) {
 
-		f, err := os.OpenFile(args[0], os.O_RDWR|os.O_CREATE, 0644)
+		err := checkValidNewFileOutput(args[0], provisionersNewForce, "OUTPUT_FILE", "--force")
 		if err != nil {
-			SetError(err, 1)
+			SetError(err)
 			return
 		}
-		defer f.Close()
 
-		path := provisionersNewGoogleKeyFile
-		_, err = os.Stat(path)
+		f, err := vio.AtomicCreate(args[0], 0644)
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
+		defer f.Close()
 
-		b, err := ioutil.ReadFile(path)
+		p, err := newGoogleProvisioner()
 		if err != nil {
-			SetError(err, 3)
+			SetError(err)
 			return
 		}
 
-		p, err := google.NewProvisioner(log, &google.Config{
-			Bucket: provisionersNewGoogleBucket,
-			Key:    base64.StdEncoding.EncodeToString(b),
-		})
+		data, err := p.Marshal()
 		if err != nil {
-			SetError(err, 4)
+			SetError(err)
 			return
 		}
 
-		data, err := p.Marshal()
+		out := provisioners.Encrypt(data, provisionersNewPassphrase)
+		_, err = io.Copy(f, bytes.NewReader(out))
 		if err != nil {
-			SetError(err, 5)
+			SetError(err)
 			return
 		}
 
-		out := provisioners.Encrypt(data, provisionersNewPassphrase)
-		_, err = io.Copy(f, bytes.NewReader(out))
+		err = f.Commit()
 		if err != nil {
-			SetError(err, 6)
+			SetError(err)
 			return
 		}
+
 	},
 }
 
 func init() {
 	f := provisionersNewGoogleCmd.Flags()
 	f.StringVarP(&provisionersNewPassphrase, "passphrase", "p", "", "Passphrase for encrypting exported provisioner data.")
+	f.BoolVar(&provisionersNewForce, "force", false, "force overwrite of existing files")
 	f.StringVarP(&provisionersNewGoogleBucket, "bucket", "b", "", "Name of an existing Google Cloud Storage bucket, for which the provided service account credentials have adequate permissions for object creation/deletion.")
 	provisionersNewGoogleCmd.MarkFlagRequired("bucket")
 	f.StringVarP(&provisionersNewGoogleKeyFile, "credentials", "f", "", "Path of an existing JSON-formatted Google Cloud Platform service account credentials file.")
 	provisionersNewGoogleCmd.MarkFlagRequired("credentials")
+	f.StringVar(&provisionersNewGoogleLocation, "location", "", "Region or multi-region to store images in, e.g. 'us-central1' or 'us' (default chosen by Google). Provisioning warns if the bucket is somewhere else.")
+}
+
+var provisionersNewVSphereCmd = &cobra.Command{
+	Use:   "vsphere <OUTPUT_FILE>",
+	Short: "Add a new VMware vSphere (vCenter) Provisioner.",
+	Long: `Add a new VMware vSphere (vCenter) Provisioner.
+
+Provisioning uploads the disk image to the datastore and registers a new,
+powered off VM with it in the datacenter's VM folder.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		err := checkValidNewFileOutput(args[0], provisionersNewForce, "OUTPUT_FILE", "--force")
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		f, err := vio.AtomicCreate(args[0], 0644)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer f.Close()
+
+		p, err := newVSphereProvisioner()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		data, err := p.Marshal()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		out := provisioners.Encrypt(data, provisionersNewPassphrase)
+		_, err = io.Copy(f, bytes.NewReader(out))
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		err = f.Commit()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+	},
+}
+
+func init() {
+	f := provisionersNewVSphereCmd.Flags()
+	f.StringVar(&provisionersNewVSphereURL, "url", "", "vCenter URL")
+	provisionersNewVSphereCmd.MarkFlagRequired("url")
+	f.StringVar(&provisionersNewVSphereUsername, "username", "", "vCenter user name")
+	provisionersNewVSphereCmd.MarkFlagRequired("username")
+	f.StringVar(&provisionersNewVSpherePassword, "password", "", "vCenter password")
+	f.BoolVar(&provisionersNewVSphereInsecure, "insecure", false, "Skip verification of the vCenter TLS certificate")
+	f.StringVar(&provisionersNewVSphereDatacenter, "datacenter", "", "Datacenter to create VMs in")
+	provisionersNewVSphereCmd.MarkFlagRequired("datacenter")
+	f.StringVar(&provisionersNewVSphereDatastore, "datastore", "", "Datastore to store VM disks on")
+	provisionersNewVSphereCmd.MarkFlagRequired("datastore")
+	f.StringVar(&provisionersNewVSphereResourcePool, "resource-pool", "", "Resource pool for VMs (default: the datacenter's default pool)")
+	f.StringVar(&provisionersNewVSphereNetwork, "network", vsphere.DefaultNetwork, "Network to connect VMs to")
+	f.StringVarP(&provisionersNewPassphrase, "passphrase", "p", "", "Passphrase for encrypting exported provisioner data.")
+	f.BoolVar(&provisionersNewForce, "force", false, "force overwrite of existing files")
+}
+
+var provisionersNewLibvirtCmd = &cobra.Command{
+	Use:   "libvirt <OUTPUT_FILE>",
+	Short: "Add a new libvirt (KVM) Provisioner.",
+	Long: `Add a new libvirt (KVM) Provisioner.
+
+Provisioning uploads the disk image to a new volume in the storage pool, and
+defines a domain that boots from it, with the CPUs and RAM of the app's VCFG.
+The domain is left shut off unless --start is set.
+
+The libvirt host is managed through virsh, which has to be installed on this
+machine. Remote hosts can be reached with a connection URI like
+'qemu+ssh://user@host/system'.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+
+		err := checkValidNewFileOutput(args[0], provisionersNewForce, "OUTPUT_FILE", "--force")
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		f, err := vio.AtomicCreate(args[0], 0644)
+		if err != nil {
+			SetError(err)
+			return
+		}
+		defer f.Close()
+
+		p, err := newLibvirtProvisioner()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		data, err := p.Marshal()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		out := provisioners.Encrypt(data, provisionersNewPassphrase)
+		_, err = io.Copy(f, bytes.NewReader(out))
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		err = f.Commit()
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+	},
+}
+
+func init() {
+	f := provisionersNewLibvirtCmd.Flags()
+	f.StringVar(&provisionersNewLibvirtURI, "uri", libvirt.DefaultURI, "libvirt connection URI")
+	f.StringVar(&provisionersNewLibvirtPool, "pool", libvirt.DefaultPool, "Storage pool to upload disks to")
+	f.StringVar(&provisionersNewLibvirtNetwork, "network", libvirt.DefaultNetwork, "Network to connect domains to")
+	f.BoolVar(&provisionersNewLibvirtStart, "start", false, "Start domains once they're defined")
+	f.StringVarP(&provisionersNewPassphrase, "passphrase", "p", "", "Passphrase for encrypting exported provisioner data.")
+	f.BoolVar(&provisionersNewForce, "force", false, "force overwrite of existing files")
+}
+
+// The provisioners new commands and the provisioners test commands share
+// their flags, and build their provisioners with these.
+
+func newAmazonEC2Provisioner() (provisioners.Provisioner, error) {
+	return amazon.NewProvisioner(log, &amazon.Config{
+		Key:    provisionersNewAmazonKey,
+		Secret: provisionersNewAmazonSecret,
+		Region: provisionersNewAmazonRegion,
+		Bucket: provisionersNewAmazonBucket,
+	})
+}
+
+func newAzureProvisioner() (provisioners.Provisioner, error) {
+
+	b, err := ioutil.ReadFile(provisionersNewAzureKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return azure.NewProvisioner(log, &azure.Config{
+		Key:                base64.StdEncoding.EncodeToString(b),
+		Container:          provisionersNewAzureContainer,
+		Location:           provisionersNewAzureLocation,
+		ResourceGroup:      provisionersNewAzureResourceGroup,
+		StorageAccountKey:  provisionersNewAzureStorageAccountKey,
+		StorageAccountName: provisionersNewAzureStorageAccountName,
+	})
+}
+
+func newGoogleProvisioner() (provisioners.Provisioner, error) {
+
+	b, err := ioutil.ReadFile(provisionersNewGoogleKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return google.NewProvisioner(log, &google.Config{
+		Bucket:   provisionersNewGoogleBucket,
+		Key:      base64.StdEncoding.EncodeToString(b),
+		Location: provisionersNewGoogleLocation,
+	})
+}
+
+func newVSphereProvisioner() (provisioners.Provisioner, error) {
+	return vsphere.NewProvisioner(log, &vsphere.Config{
+		URL:          provisionersNewVSphereURL,
+		Username:     provisionersNewVSphereUsername,
+		Password:     provisionersNewVSpherePassword,
+		Insecure:     provisionersNewVSphereInsecure,
+		Datacenter:   provisionersNewVSphereDatacenter,
+		Datastore:    provisionersNewVSphereDatastore,
+		ResourcePool: provisionersNewVSphereResourcePool,
+		Network:      provisionersNewVSphereNetwork,
+	})
+}
+
+func newLibvirtProvisioner() (provisioners.Provisioner, error) {
+	return libvirt.NewProvisioner(log, &libvirt.Config{
+		URI:     provisionersNewLibvirtURI,
+		Pool:    provisionersNewLibvirtPool,
+		Network: provisionersNewLibvirtNetwork,
+		Start:   provisionersNewLibvirtStart,
+	})
+}
+
+var provisionersTestCmd = &cobra.Command{
+	Use:   "test",
+	Short: "Check provisioner credentials without saving a provisioner.",
+	Long: `Check that the credentials for a provisioner work, by making a cheap
+authenticated call to each platform API that provisioning uses. Nothing is
+created on the platform, and no provisioner file is written, so typos can be
+caught before they're encrypted away.
+
+Each subcommand takes the same flags as the matching 'vorteil provisioners new'
+subcommand, apart from --passphrase.`,
+	Example: "  $ vorteil provisioners test amazon-ec2 --key $KEY --secret $SECRET --bucket my-bucket",
+}
+
+// provisionersTestSubcommand returns a provisioners test subcommand sharing
+// the flags of newCmd, which checks the credentials of the provisioner
+// returned by fn.
+func provisionersTestSubcommand(newCmd *cobra.Command, platform string, fn func() (provisioners.Provisioner, error)) *cobra.Command {
+
+	cmd := &cobra.Command{
+		Use:   strings.Fields(newCmd.Use)[0],
+		Short: fmt.Sprintf("Check the credentials for a new %s provisioner.", platform),
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+
+			p, err := fn()
+			if err != nil {
+				SetError(err)
+				return
+			}
+
+			err = p.CheckCredentials(context.Background())
+			if err != nil {
+				SetError(fmt.Errorf("%s credentials check failed: %w", p.Type(), err))
+				return
+			}
+
+			log.Printf("Credentials for the %s provisioner are valid", p.Type())
+		},
+	}
+
+	newCmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if flag.Name != "passphrase" && flag.Name != "force" {
+			cmd.Flags().AddFlag(flag)
+		}
+	})
+
+	return cmd
+}
+
+func init() {
+	provisionersTestCmd.AddCommand(provisionersTestSubcommand(provisionersNewAmazonEC2Cmd, "AWS (Amazon Web Services)", newAmazonEC2Provisioner))
+	provisionersTestCmd.AddCommand(provisionersTestSubcommand(provisionersNewAzureCmd, "Microsoft Azure", newAzureProvisioner))
+	provisionersTestCmd.AddCommand(provisionersTestSubcommand(provisionersNewGoogleCmd, "Google Cloud (Compute Engine)", newGoogleProvisioner))
+	provisionersTestCmd.AddCommand(provisionersTestSubcommand(provisionersNewVSphereCmd, "VMware vSphere (vCenter)", newVSphereProvisioner))
+	provisionersTestCmd.AddCommand(provisionersTestSubcommand(provisionersNewLibvirtCmd, "libvirt (KVM)", newLibvirtProvisioner))
 }
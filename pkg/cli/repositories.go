@@ -17,6 +17,7 @@ import (
 	"strings"
 
 	"github.com/spf13/cobra"
+	"github.com/vorteil/vorteil/pkg/vorteil"
 	"github.com/vorteil/vorteil/pkg/vpkg"
 )
 
@@ -64,7 +65,7 @@ var defaultKeyCmd = &cobra.Command{
 
 		pathCheck, err := checkKeysFolder()
 		if err != nil {
-			SetError(err, 1)
+			SetError(err)
 			return
 		}
 
@@ -73,26 +74,26 @@ var defaultKeyCmd = &cobra.Command{
 			key := args[0]
 			f, err := os.Open(filepath.Join(pathCheck, key))
 			if err != nil {
-				SetError(fmt.Errorf("%s does not exist as a key stored", key), 3)
+				SetError(fmt.Errorf("%s does not exist as a key stored", key))
 				return
 			}
 			defer f.Close()
 			data, err := ioutil.ReadAll(f)
 			if err != nil {
-				SetError(fmt.Errorf("unable to read from key file"), 4)
+				SetError(fmt.Errorf("unable to read from key file"))
 				return
 			}
 
 			defaultF, err := os.OpenFile(filepath.Join(pathCheck, "default"), os.O_RDWR|os.O_CREATE, 0644)
 			if err != nil {
-				SetError(fmt.Errorf("unable to open default key: %s", err.Error()), 5)
+				SetError(fmt.Errorf("unable to open default key: %s", err.Error()))
 				return
 			}
 
 			defer defaultF.Close()
 			err = ioutil.WriteFile(filepath.Join(pathCheck, "default"), data, os.ModePerm)
 			if err != nil {
-				SetError(err, 6)
+				SetError(err)
 				return
 			}
 
@@ -103,20 +104,20 @@ var defaultKeyCmd = &cobra.Command{
 		// Open default
 		f, err := os.Open(filepath.Join(pathCheck, "default"))
 		if err != nil {
-			SetError(errors.New("default key has not been set"), 6)
+			SetError(errors.New("default key has not been set"))
 			return
 		}
 		defer f.Close()
 
 		h := md5.New()
 		if _, err := io.Copy(h, f); err != nil {
-			SetError(err, 7)
+			SetError(err)
 			return
 		}
 
 		fis, err := ioutil.ReadDir(pathCheck)
 		if err != nil {
-			SetError(err, 8)
+			SetError(err)
 			return
 		}
 
@@ -125,12 +126,12 @@ var defaultKeyCmd = &cobra.Command{
 			if fi.Name() != "default" {
 				f2, err := os.Open(filepath.Join(pathCheck, fi.Name()))
 				if err != nil {
-					SetError(err, 9)
+					SetError(err)
 					return
 				}
 				h2 := md5.New()
 				if _, err := io.Copy(h2, f2); err != nil {
-					SetError(err, 6)
+					SetError(err)
 					return
 				}
 				if bytes.Equal(h.Sum(nil), h2.Sum(nil)) {
@@ -168,14 +169,14 @@ var createKeyCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		name := args[0]
 		if name == "default" {
-			SetError(errors.New("default is a reserved word and can't be a name"), 1)
+			SetError(errors.New("default is a reserved word and can't be a name"))
 			return
 		}
 		key := args[1]
 
 		pathCheck, err := checkKeysFolder()
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
 
@@ -183,7 +184,7 @@ var createKeyCmd = &cobra.Command{
 		// if stat returns no error return error saying you need to provide the force flag
 		fi, err := os.Stat(filepath.Join(pathCheck, name))
 		if err == nil && !flagForce {
-			SetError(errors.New("key file already exists provide --force to overwrite"), 2)
+			SetError(errors.New("key file already exists provide --force to overwrite"))
 			return
 		}
 
@@ -192,14 +193,14 @@ var createKeyCmd = &cobra.Command{
 			// open old file
 			f2, err := os.Open(filepath.Join(pathCheck, name))
 			if err != nil {
-				SetError(err, 4)
+				SetError(err)
 				return
 			}
 			defer f2.Close()
 
 			odata, err := ioutil.ReadAll(f2)
 			if err != nil {
-				SetError(err, 5)
+				SetError(err)
 				return
 			}
 
@@ -209,14 +210,14 @@ var createKeyCmd = &cobra.Command{
 				defer f.Close()
 				data, err := ioutil.ReadAll(f)
 				if err != nil {
-					SetError(err, 6)
+					SetError(err)
 					return
 				}
 				if string(data) == string(odata) {
 					// Write default to be the same
 					err = ioutil.WriteFile(filepath.Join(pathCheck, "default"), []byte(key), os.ModePerm)
 					if err != nil {
-						SetError(err, 7)
+						SetError(err)
 						return
 					}
 				}
@@ -226,7 +227,7 @@ var createKeyCmd = &cobra.Command{
 		// Write key to a file under that keys directory
 		err = ioutil.WriteFile(filepath.Join(pathCheck, name), []byte(key), os.ModePerm)
 		if err != nil {
-			SetError(err, 8)
+			SetError(err)
 			return
 		}
 
@@ -234,7 +235,7 @@ var createKeyCmd = &cobra.Command{
 		if flagDefault {
 			err = ioutil.WriteFile(filepath.Join(pathCheck, "default"), []byte(key), os.ModePerm)
 			if err != nil {
-				SetError(err, 9)
+				SetError(err)
 				return
 			}
 		}
@@ -269,13 +270,13 @@ var listKeysCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		pathCheck, err := checkKeysFolder()
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
 
 		fis, err := ioutil.ReadDir(pathCheck)
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
 
@@ -287,7 +288,7 @@ var listKeysCmd = &cobra.Command{
 			defer defaultKey.Close()
 			data, err = ioutil.ReadAll(defaultKey)
 			if err != nil {
-				SetError(err, 3)
+				SetError(err)
 				return
 			}
 		}
@@ -297,13 +298,13 @@ var listKeysCmd = &cobra.Command{
 				if len(data) > 0 {
 					f, err := os.Open(filepath.Join(pathCheck, fi.Name()))
 					if err != nil {
-						SetError(err, 4)
+						SetError(err)
 						return
 					}
 					defer f.Close()
 					keyD, err := ioutil.ReadAll(f)
 					if err != nil {
-						SetError(err, 5)
+						SetError(err)
 						return
 					}
 					if string(data) == string(keyD) {
@@ -342,12 +343,12 @@ var deleteKeyCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		name := args[0]
 		if name == "default" {
-			SetError(errors.New("default is a reserved word and can't be used to delete a key"), 1)
+			SetError(errors.New("default is a reserved word and can't be used to delete a key"))
 			return
 		}
 		pathCheck, err := checkKeysFolder()
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
 		path := filepath.Join(pathCheck, name)
@@ -356,14 +357,14 @@ var deleteKeyCmd = &cobra.Command{
 		// before removing we should check if default is the same and delete that
 		f1, err := ioutil.ReadFile(path)
 		if err != nil {
-			SetError(fmt.Errorf("%s keyfile does not exist", name), 2)
+			SetError(fmt.Errorf("%s keyfile does not exist", name))
 			return
 		}
 
 		f2, err := ioutil.ReadFile(dpath)
 		if err != nil {
 			if !errors.Is(err, os.ErrNotExist) {
-				SetError(err, 3)
+				SetError(err)
 				return
 			}
 		}
@@ -372,7 +373,7 @@ var deleteKeyCmd = &cobra.Command{
 		if bytes.Equal(f1, f2) {
 			err = os.Remove(dpath)
 			if err != nil {
-				SetError(err, 4)
+				SetError(err)
 				return
 			}
 		}
@@ -380,7 +381,7 @@ var deleteKeyCmd = &cobra.Command{
 		// Else just remove the keyfile
 		err = os.Remove(filepath.Join(pathCheck, name))
 		if err != nil {
-			SetError(err, 5)
+			SetError(err)
 			return
 		}
 
@@ -410,20 +411,20 @@ var pushCmd = &cobra.Command{
 
 		pkgBuilder, err := getPackageBuilder("BUILDABLE", buildablePath)
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
 		defer pkgBuilder.Close()
 
 		err = modifyPackageBuilder(pkgBuilder)
 		if err != nil {
-			SetError(err, 3)
+			SetError(err)
 			return
 		}
 
 		err = pushPackage(pkgBuilder, urlPath, repoPath)
 		if err != nil {
-			SetError(err, 5)
+			SetError(err)
 			return
 		}
 
@@ -495,7 +496,7 @@ func checkAuthFile(path string) (string, error) {
 func preparePackage(builder vpkg.Builder) (*os.File, error) {
 	spinner := log.NewProgress("Preparing Package", "", 0)
 	defer spinner.Finish(true)
-	file, err := ioutil.TempFile(os.TempDir(), "vpkg-")
+	file, err := ioutil.TempFile(tempDir(), "vpkg-")
 	if err != nil {
 		return nil, err
 	}
@@ -577,7 +578,7 @@ func pushPackage(builder vpkg.Builder, url string, repo []string) error {
 		return err
 	}
 
-	if isVrepo, _ := checkIfNewVRepo(url); isVrepo == "" {
+	if isVrepo, _ := vorteil.CheckRepository(url); isVrepo == "" {
 		return fmt.Errorf("target repo '%s' is not a Vorteil Repository", url)
 	}
 
@@ -23,9 +23,10 @@ import (
 	"github.com/thanhpk/randstr"
 	"github.com/vorteil/vorteil/pkg/imagetools"
 	"github.com/vorteil/vorteil/pkg/vcfg"
-	"github.com/vorteil/vorteil/pkg/vdecompiler"
+	"github.com/vorteil/vorteil/pkg/vdisk"
 	"github.com/vorteil/vorteil/pkg/virtualizers"
 	"github.com/vorteil/vorteil/pkg/virtualizers/util"
+	"github.com/vorteil/vorteil/pkg/vorteil"
 	"github.com/vorteil/vorteil/pkg/vpkg"
 )
 
@@ -47,45 +48,45 @@ and cleaning up the instance when it's done.`,
 
 		pkgBuilder, err := getPackageBuilder("BUILDABLE", buildablePath)
 		if err != nil {
-			SetError(err, 2)
+			SetError(err)
 			return
 		}
 		defer pkgBuilder.Close()
 
 		err = modifyPackageBuilder(pkgBuilder)
 		if err != nil {
-			SetError(err, 3)
+			SetError(err)
 			return
 		}
 
 		pkgReader, err := vpkg.ReaderFromBuilder(pkgBuilder)
 		if err != nil {
-			SetError(err, 4)
+			SetError(err)
 			return
 		}
 		defer pkgReader.Close()
 
 		pkgReader, err = vpkg.PeekVCFG(pkgReader)
 		if err != nil {
-			SetError(err, 5)
+			SetError(err)
 			return
 		}
 
 		cfgf := pkgReader.VCFG()
 		cfg, err := vcfg.LoadFile(cfgf)
 		if err != nil {
-			SetError(err, 6)
+			SetError(err)
 			return
 		}
 		err = initKernels()
 		if err != nil {
-			SetError(err, 7)
+			SetError(err)
 			return
 		}
 
-		src, _, err := readSourcePath(buildablePath)
+		src, _, err := vorteil.SplitSource(buildablePath)
 		if err != nil {
-			SetError(err, 20)
+			SetError(err)
 			return
 		}
 
@@ -105,49 +106,61 @@ and cleaning up the instance when it's done.`,
 					name = "vorteil-vm"
 				}
 			} else {
-				SetError(err, 1)
+				SetError(err)
 				return
 			}
 		} else {
 			name = strings.ReplaceAll(filepath.Base(buildablePath), ".vorteil", "")
 		}
 
+		size, err := vdisk.EstimateSize(pkgReader, cfg)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
+		err = checkFreeSpace(tempDir(), size)
+		if err != nil {
+			SetError(err)
+			return
+		}
+
 		switch flagPlatform {
 		case platformQEMU:
 			err = runQEMU(pkgReader, cfg, name)
 			if err != nil {
-				SetError(err, 8)
+				SetError(err)
 				return
 			}
 		case platformVMware:
 			err = runVMware(pkgReader, cfg, name)
 			if err != nil {
-				SetError(err, 13)
+				SetError(err)
 				return
 			}
 		case platformVirtualBox:
 			err = runVirtualBox(pkgReader, cfg, name)
 			if err != nil {
-				SetError(err, 9)
+				SetError(err)
 				return
 			}
 		case platformHyperV:
 			err = runHyperV(pkgReader, cfg, name)
 			if err != nil {
-				SetError(err, 10)
+				SetError(err)
 				return
 			}
 		case platformFirecracker:
 			err = runFirecracker(pkgReader, cfg, name)
 			if err != nil {
-				SetError(err, 11)
+				SetError(err)
 				return
 			}
 		default:
 			if flagPlatform == "not installed" {
-				SetError((fmt.Errorf("no virtualizers are currently installed")), 12)
+				SetError((fmt.Errorf("no virtualizers are currently installed")))
 			} else {
-				SetError((fmt.Errorf("platform '%s' not supported", flagPlatform)), 12)
+				SetError((fmt.Errorf("platform '%s' not supported", flagPlatform)))
 			}
 		}
 
@@ -159,8 +172,9 @@ func init() {
 	f.StringVar(&flagPlatform, "platform", defaultVirtualizer(), "run a virtual machine with appropriate hypervisor (qemu, firecracker, virtualbox, hyper-v)")
 	f.StringVarP(&flagKey, "key", "k", "", "vrepo authentication key")
 	f.BoolVar(&flagGUI, "gui", false, "when running virtual machine show gui of hypervisor")
-	f.BoolVar(&flagShell, "shell", false, "add a busybox shell environment to the image")
+	f.BoolVar(&flagShell, "shell", false, "add a busybox shell environment to the image (overrides system.rescue-shell)")
 	f.StringVar(&flagRecord, "record", "", "extract touched files to this path after running")
+	f.StringVar(&flagTmpDir, "tmpdir", "", "directory to create the temporary disk and other temporary files in (default $VORTEIL_TMPDIR or the system default)")
 }
 
 func defaultVirtualizer() string {
@@ -184,15 +198,32 @@ func defaultVirtualizer() string {
 	return defaultP
 }
 
-func runDecompile(diskpath string, outpath string, skipUnTouched bool) error {
-	iio, err := vdecompiler.Open(diskpath)
+func runDecompile(diskpath string, outpath string, skipUnTouched, hardlinks, preserveOwner, resume bool, accessedSince time.Time) error {
+	iio, err := openImage(diskpath)
 	if err != nil {
 		return err
 	}
 
 	defer iio.Close()
 
-	report, err := imagetools.DecompileImage(iio, outpath, skipUnTouched)
+	// only root can give files away to other users
+	if preserveOwner && os.Geteuid() != 0 {
+		log.Warnf("Not running as root: extracted files will be owned by the current user instead of their owners on the image")
+		preserveOwner = false
+	}
+
+	opts := imagetools.DecompileOptions{
+		Hardlinks:     hardlinks,
+		PreserveOwner: preserveOwner,
+		Resume:        resume,
+	}
+	if accessedSince.IsZero() {
+		opts.SkipNotTouched = skipUnTouched
+	} else {
+		opts.AccessedSince = accessedSince
+	}
+
+	report, err := imagetools.DecompileImageWithOptions(iio, outpath, opts)
 	if err != nil {
 		return err
 	}
@@ -205,10 +236,16 @@ func runDecompile(diskpath string, outpath string, skipUnTouched bool) error {
 			log.Debugf("Copied File  > %s", dFile.Path)
 		case imagetools.CopiedSymlink:
 			log.Debugf("Created Symlink > %s", dFile.Path)
+		case imagetools.CopiedHardlink:
+			log.Debugf("Created Hardlink > %s", dFile.Path)
 		case imagetools.SkippedAbnormalFile:
 			log.Debugf("Skipped Abnormal > %s", dFile.Path)
 		case imagetools.SkippedNotTouched:
 			log.Debugf("Skipped Untouched File > %s", dFile.Path)
+		case imagetools.SkippedNotKept:
+			log.Debugf("Skipped Unkept File > %s", dFile.Path)
+		case imagetools.SkippedExisting:
+			log.Debugf("Skipped Existing File > %s", dFile.Path)
 		}
 	}
 
@@ -249,8 +286,8 @@ func run(virt virtualizers.Virtualizer, diskpath string, cfg *vcfg.VCFG, name st
 		if flagRecord != "" {
 			decompileSpinner := log.NewProgress("Decompiling Disk", "", 0)
 			defer decompileSpinner.Finish(true)
-			if err := runDecompile(diskpath, flagRecord, true); err != nil {
-				SetError(err, 1)
+			if err := runDecompile(diskpath, flagRecord, true, false, false, false, time.Time{}); err != nil {
+				SetError(err)
 				return
 			}
 			decompileSpinner.Finish(true)
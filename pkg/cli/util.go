@@ -6,10 +6,20 @@ package cli
  */
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vimg"
 	"github.com/vorteil/vorteil/pkg/vio"
 	"github.com/vorteil/vorteil/pkg/vpkg"
 )
@@ -22,62 +32,250 @@ func HandleErrors() {
 			log.Errorf(errorStatusMessage.Error())
 		}
 	}
-	if errorStatusCode != 0 {
-		os.Exit(errorStatusCode)
+	if code := exitCode(errorStatusMessage); code != 0 {
+		os.Exit(code)
 	}
 	return
 }
 
-func handleDirectory(src string, dst string, builder vpkg.Builder) error {
+func handleDirectory(src string, path string, builder vpkg.Builder) error {
 	// create subtree
 	tree, err := vio.FileTreeFromDirectory(src)
 	if err != nil {
 		return err
 	}
 
-	x := strings.Split(strings.TrimSuffix(filepath.ToSlash(src), "/"), "/")
-	err = builder.AddSubTreeToFS(filepath.Join(dst, x[len(x)-1]), tree)
+	err = builder.AddSubTreeToFS(path, tree)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func handleFile(src string, dst string, builder vpkg.Builder) error {
+func handleFile(src string, path string, builder vpkg.Builder) error {
 	// create file object
 	f, err := vio.LazyOpen(src)
 	if err != nil {
 		return err
 	}
 
-	err = builder.AddToFS(filepath.Join(dst, filepath.Base(f.Name())), f)
+	err = builder.AddToFS(path, f)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// injectPath maps the file or directory at src on the host to path within the
+// package filesystem, recording it as injected on top of the package.
+func injectPath(src string, path string, builder vpkg.Builder) error {
+	stat, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	builder.SetOrigin(vpkg.OriginInjected)
+	defer builder.SetOrigin(vpkg.OriginOriginal)
+
+	if stat.IsDir() {
+		return handleDirectory(src, path, builder)
+	}
+
+	return handleFile(src, path, builder)
+}
+
+// cleanInjectionPath returns the normalized form of dst, a directory within
+// the package filesystem that --files injects into. It must be absolute, and
+// can't contain '..', so that it's clear where injected files end up.
+func cleanInjectionPath(dst string) (string, error) {
+
+	if dst == "" {
+		return "", errors.New("destination is empty")
+	}
+
+	if !strings.HasPrefix(dst, "/") {
+		return "", errors.New("destination must be an absolute path, like '/etc'")
+	}
+
+	for _, elem := range strings.Split(dst, "/") {
+		if elem == ".." {
+			return "", errors.New("destination can't contain '..'")
+		}
+	}
+
+	return path.Clean(dst), nil
+}
+
 func handleFileInjections(builder vpkg.Builder) error {
-	for src, v := range filesMap {
-		for _, dst := range v {
-			stat, err := os.Stat(src)
+
+	srcs := make([]string, 0, len(filesMap))
+	for src := range filesMap {
+		srcs = append(srcs, src)
+	}
+	sort.Strings(srcs)
+
+	// every destination is checked before anything is injected, so that all
+	// of the bad ones are reported together
+	dsts := make(map[string][]string)
+	var problems []string
+	for _, src := range srcs {
+		for _, dst := range filesMap[src] {
+			clean, err := cleanInjectionPath(dst)
 			if err != nil {
-				return err
+				problems = append(problems, fmt.Sprintf("--files %s@%s: %v", src, dst, err))
+				continue
 			}
+			dsts[src] = append(dsts[src], clean)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid file injections:\n  %s", strings.Join(problems, "\n  "))
+	}
 
-			if stat.IsDir() {
-				err = handleDirectory(src, dst, builder)
-				if err != nil {
-					return err
-				}
-			} else {
-				err = handleFile(src, dst, builder)
-				if err != nil {
-					return err
-				}
+	for _, src := range srcs {
+		for _, dst := range dsts[src] {
+			x := strings.Split(strings.TrimSuffix(filepath.ToSlash(src), "/"), "/")
+			err := injectPath(src, path.Join(dst, x[len(x)-1]), builder)
+			if err != nil {
+				return err
 			}
 		}
 	}
 
 	return nil
 }
+
+// tempDir returns the directory temporary files and disks are created in,
+// which is set by --tmpdir or the VORTEIL_TMPDIR environment variable, and
+// otherwise the system default.
+func tempDir() string {
+
+	if flagTmpDir != "" {
+		return flagTmpDir
+	}
+
+	if dir := os.Getenv("VORTEIL_TMPDIR"); dir != "" {
+		return dir
+	}
+
+	return os.TempDir()
+}
+
+// checkFreeSpace returns an error if dir is known to have less than need bytes
+// of free space.
+func checkFreeSpace(dir string, need int64) error {
+
+	avail, err := vio.FreeSpace(dir)
+	if err != nil {
+		return err
+	}
+
+	if avail >= 0 && avail < need {
+		return fmt.Errorf("not enough free space in %s for the disk: need %s, have %s (use --tmpdir to choose another directory)", dir, vcfg.Bytes(need), vcfg.Bytes(avail))
+	}
+
+	return nil
+}
+
+// checkPrograms returns an error if the package in r defines no programs to
+// run, unless --allow-no-programs is set, so that it's caught before anything
+// is built. The returned reader must be used in place of r.
+func checkPrograms(r vpkg.Reader) (vpkg.Reader, error) {
+
+	r, err := vpkg.PeekVCFG(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if flagAllowNoPrograms {
+		return r, nil
+	}
+
+	cfg, err := vcfg.LoadFile(r.VCFG())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.Programs) == 0 {
+		return nil, fmt.Errorf("%w (use --allow-no-programs to build a data-only disk)", vdisk.ErrNoPrograms)
+	}
+
+	return r, nil
+}
+
+// readPassphraseFile returns the passphrase in the file at path. A single
+// trailing newline is not part of the passphrase, so files written by echo
+// work as expected.
+func readPassphraseFile(path string) ([]byte, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	data = bytes.TrimSuffix(data, []byte("\r"))
+	if len(data) == 0 {
+		return nil, fmt.Errorf("passphrase file is empty: %s", path)
+	}
+
+	return data, nil
+}
+
+// getEncryption returns the settings to encrypt an image's root partition
+// with, reading its passphrase from --encryption-passphrase-file.
+func getEncryption(keySource string) (*vimg.Encryption, error) {
+
+	if flagEncryptionPassphraseFile == "" {
+		return nil, errors.New("--encrypt needs a passphrase: use --encryption-passphrase-file")
+	}
+
+	passphrase, err := readPassphraseFile(flagEncryptionPassphraseFile)
+	if err != nil {
+		return nil, err
+	}
+
+	encryption := &vimg.Encryption{
+		KeySource:  keySource,
+		Passphrase: passphrase,
+	}
+
+	err = encryption.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return encryption, nil
+}
+
+// openImage opens the disk image at path, unlocking its encrypted root
+// partition with the passphrase in --encryption-passphrase-file, if it's set.
+// Symlinks in paths are followed unless --no-follow is set.
+func openImage(path string) (*vdecompiler.IO, error) {
+
+	iio, err := vdecompiler.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	iio.SetFollowSymlinks(!flagNoFollow)
+
+	if flagEncryptionPassphraseFile == "" {
+		return iio, nil
+	}
+
+	passphrase, err := readPassphraseFile(flagEncryptionPassphraseFile)
+	if err != nil {
+		iio.Close()
+		return nil, err
+	}
+
+	err = iio.Unlock(passphrase)
+	if err != nil {
+		iio.Close()
+		return nil, err
+	}
+
+	return iio, nil
+}
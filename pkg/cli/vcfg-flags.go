@@ -79,12 +79,15 @@ func tallyRepeatableFlag(v *int, s string) {
 }
 
 // --sysctl
-var sysctlFlag = flag.NewStringSliceFlag("sysctl", "add a sysctl key/value tuple", hideFlags, sysctlFlagValidator)
+var sysctlFlag = flag.NewStringSliceFlag("sysctl", "add a sysctl key/value tuple, e.g. 'net.core.somaxconn=1024'", hideFlags, sysctlFlagValidator)
 var sysctlFlagValidator = func(f flag.StringSliceFlag) error {
 	for _, s := range f.Value {
-		x := strings.Split(s, "=")
+		x := strings.SplitN(s, "=", 2)
 		if len(x) < 2 {
-			log.Warnf("invalid sysctl tuple '%s'", s)
+			return fmt.Errorf("invalid sysctl tuple '%s' (should be key=value)", s)
+		}
+		if err := vcfg.ValidateSysctl(x[0], x[1]); err != nil {
+			return err
 		}
 		if overrideVCFG.Sysctl == nil {
 			overrideVCFG.Sysctl = make(map[string]string)
@@ -303,6 +306,18 @@ var networkMaskFlagValidator = func(f flag.NStringFlag) error {
 	return initRequiredNetworksFromString(f, func(nic *vcfg.NetworkInterface, s string) { nic.Mask = s })
 }
 
+// --network.mode
+var networkModeFlag = flag.NewNStringFlag("network[<<N>>].mode", "configure how app's network gets its address (dhcp, static, slaac, ipv6-static)", &maxNetworkFlags, hideFlags, networkModeFlagValidator)
+var networkModeFlagValidator = func(f flag.NStringFlag) error {
+	return initRequiredNetworksFromString(f, func(nic *vcfg.NetworkInterface, s string) {
+		nic.Mode = vcfg.NetworkMode(s)
+		// networks added by flags default to dhcp, which only suits that mode
+		if nic.IP == string(vcfg.DHCPNetworkMode) && nic.Mode != vcfg.DHCPNetworkMode {
+			nic.IP = ""
+		}
+	})
+}
+
 // --network.tcp
 var networkTCPFlag = flag.NewNStringSliceFlag("network[<<N>>].tcp", "expose tcp port", &maxNetworkFlags, hideFlags, networkTCPFlagValidator)
 var networkTCPFlagValidator = func(f flag.NStringSliceFlag) error {
@@ -329,6 +344,30 @@ var systemDNSFlagValidator = func(f flag.StringSliceFlag) error {
 	return nil
 }
 
+// --system.kernel-modules
+var systemKernelModulesFlag = flag.NewStringSliceFlag("system.kernel-modules", "set the kernel modules to load at boot", hideFlags, systemKernelModulesFlagValidator)
+var systemKernelModulesFlagValidator = func(f flag.StringSliceFlag) error {
+	for _, name := range f.Value {
+		if err := vcfg.ValidateKernelModule(name); err != nil {
+			return err
+		}
+	}
+	overrideVCFG.System.KernelModules = f.Value
+	return nil
+}
+
+// --system.disable-services
+var systemDisableServicesFlag = flag.NewStringSliceFlag("system.disable-services", "set the built-in services to leave disabled (dhcp, logs, ntp, strace, tcpdump)", hideFlags, systemDisableServicesFlagValidator)
+var systemDisableServicesFlagValidator = func(f flag.StringSliceFlag) error {
+	for _, name := range f.Value {
+		if err := vcfg.ValidateService(name); err != nil {
+			return err
+		}
+	}
+	overrideVCFG.System.DisableServices = f.Value
+	return nil
+}
+
 // --system.hostname
 var systemHostnameFlag = flag.NewStringFlag("system.hostname", "set the hostname for the system", hideFlags, systemHostnameFlagValidator)
 var systemHostnameFlagValidator = func(f flag.StringFlag) error {
@@ -336,8 +375,20 @@ var systemHostnameFlagValidator = func(f flag.StringFlag) error {
 	return nil
 }
 
+// --system.timezone
+var systemTimezoneFlag = flag.NewStringFlag("system.timezone", "set the timezone for the system (tz database name)", hideFlags, systemTimezoneFlagValidator)
+var systemTimezoneFlagValidator = func(f flag.StringFlag) error {
+	if f.Value != "" {
+		if err := vcfg.ValidateTimezone(f.Value); err != nil {
+			return err
+		}
+	}
+	overrideVCFG.System.Timezone = f.Value
+	return nil
+}
+
 // --system.filesystem
-var systemFilesystemFlag = flag.NewStringFlag("system.filesystem", "set the filesystem format", hideFlags, systemFilesystemFlagValidator)
+var systemFilesystemFlag = flag.NewStringFlag("system.filesystem", "set the filesystem format (ext2 forces the older format without extents)", hideFlags, systemFilesystemFlagValidator)
 var systemFilesystemFlagValidator = func(f flag.StringFlag) error {
 	overrideVCFG.System.Filesystem = vcfg.Filesystem(f.Value)
 	return nil
@@ -350,6 +401,20 @@ var systemMaxFDsFlagValidator = func(f flag.UintFlag) error {
 	return nil
 }
 
+// --system.boot-timeout
+var systemBootTimeoutFlag = flag.NewUintFlag("system.boot-timeout", "seconds the bootloader waits before starting the default entry", hideFlags, systemBootTimeoutFlagValidator)
+var systemBootTimeoutFlagValidator = func(f flag.UintFlag) error {
+	overrideVCFG.System.BootTimeout = int(f.Value)
+	return nil
+}
+
+// --system.default-boot-entry
+var systemDefaultBootEntryFlag = flag.NewStringFlag("system.default-boot-entry", "bootloader entry to start by default (vorteil, or rescue if the image has a shell)", hideFlags, systemDefaultBootEntryFlagValidator)
+var systemDefaultBootEntryFlagValidator = func(f flag.StringFlag) error {
+	overrideVCFG.System.DefaultBootEntry = f.Value
+	return nil
+}
+
 // --system.output-mode
 var systemOutputModeFlag = flag.NewStringFlag("system.output-mode", "specify vm output behaviour mode", hideFlags, systemOutputModeFlagValidator)
 var systemOutputModeFlagValidator = func(f flag.StringFlag) error {
@@ -432,6 +497,9 @@ var vmKernelFlagValidator = func(f flag.StringFlag) error {
 	return nil
 }
 
+// --kernel
+var kernelFlag = flag.NewStringFlag("kernel", "kernel version to build app on, or 'latest' (shorthand for --vm.kernel)", hideFlags, vmKernelFlagValidator)
+
 // --vm.ram
 var vmRAMFlag = flag.NewStringFlag("vm.ram", "memory to allocate to app", hideFlags, vmRAMFlagValidator)
 var vmRAMFlagValidator = func(f flag.StringFlag) error {
@@ -500,6 +568,27 @@ var programEnvFlagValidator = func(f flag.NStringSliceFlag) error {
 	return initRequiredProgramsFromStringSlice(f, func(prog *vcfg.Program, s []string) { prog.Env = s })
 }
 
+// --vcfg
+var vcfgFileFlag = flag.NewStringSliceFlag("vcfg", "merge a VCFG file or http(s) URL into the configuration", hideFlags, vcfgFileFlagValidator)
+var vcfgFileFlagValidator = func(f flag.StringSliceFlag) error {
+	flagVCFG = f.Value
+	return nil
+}
+
+// --env-file
+var envFileFlag = flag.NewStringSliceFlag("env-file", "add environment variables from a dotenv file to every program", hideFlags, envFileFlagValidator)
+var envFileFlagValidator = func(f flag.StringSliceFlag) error {
+	envFileEnv = nil
+	for _, path := range f.Value {
+		env, err := vcfg.LoadEnvFile(path)
+		if err != nil {
+			return err
+		}
+		envFileEnv = vcfg.MergeEnv(envFileEnv, env)
+	}
+	return nil
+}
+
 // --program.cwd
 var programCWDFlag = flag.NewNStringFlag("program[<<N>>].cwd", "configure the working directory of a program", &maxProgramFlags, hideFlags, programCWDFlagValidator)
 var programCWDFlagValidator = func(f flag.NStringFlag) error {
@@ -536,6 +625,24 @@ var programStderrFlagValidator = func(f flag.NStringFlag) error {
 	return initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Stderr = s })
 }
 
+// --program.stdin
+var programStdinFlag = flag.NewNStringFlag("program[<<N>>].stdin", "configure where programs stdin is read from (file:PATH, literal:TEXT)", &maxProgramFlags, hideFlags, programStdinFlagValidator)
+var programStdinFlagValidator = func(f flag.NStringFlag) error {
+	return initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Stdin = s })
+}
+
+// --program.logging.destination
+var programLoggingDestinationFlag = flag.NewNStringFlag("program[<<N>>].logging.destination", "configure where program output is sent (console, file:PATH, syslog, serial:DEVICE)", &maxProgramFlags, hideFlags, programLoggingDestinationFlagValidator)
+var programLoggingDestinationFlagValidator = func(f flag.NStringFlag) error {
+	return initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Logging.Destination = s })
+}
+
+// --program.logging.format
+var programLoggingFormatFlag = flag.NewNStringFlag("program[<<N>>].logging.format", "configure how program output is written (text, json)", &maxProgramFlags, hideFlags, programLoggingFormatFlagValidator)
+var programLoggingFormatFlagValidator = func(f flag.NStringFlag) error {
+	return initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Logging.Format = vcfg.LogFormat(s) })
+}
+
 // --program.strace
 var programStraceFlag = flag.NewNBoolFlag("program[<<N>>].strace", "configure the program to run with strace", &maxProgramFlags, hideFlags, programStraceFlagValidator)
 var programStraceFlagValidator = func(f flag.NBoolFlag) error {
@@ -548,18 +655,34 @@ var programArgsFlagValidator = func(f flag.NStringFlag) error {
 	return initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Args = s })
 }
 
+// --program.type
+var programTypeFlag = flag.NewNStringFlag("program[<<N>>].type", "configure how the program is supervised (service, oneshot)", &maxProgramFlags, hideFlags, programTypeFlagValidator)
+var programTypeFlagValidator = func(f flag.NStringFlag) error {
+	return initRequiredProgramsFromString(f, func(prog *vcfg.Program, s string) { prog.Type = vcfg.ProgramType(s) })
+}
+
+// --program.fail-boot
+var programFailBootFlag = flag.NewNBoolFlag("program[<<N>>].fail-boot", "fail the boot if a oneshot program exits non-zero", &maxProgramFlags, hideFlags, programFailBootFlagValidator)
+var programFailBootFlagValidator = func(f flag.NBoolFlag) error {
+	return initRequiredProgramsFromBool(f, func(prog *vcfg.Program, s bool) { prog.FailBoot = s })
+}
+
 var vcfgFlags = flag.FlagsList{
-	&vmCPUsFlag, &vmDiskSizeFlag, &vmInodesFlag, &vmKernelFlag, &vmRAMFlag,
+	&vmCPUsFlag, &vmDiskSizeFlag, &vmInodesFlag, &vmKernelFlag, &kernelFlag, &vmRAMFlag,
 	&filesFlag, &infoAuthorFlag, &infoDateFlag, &infoDescriptionFlag,
 	&infoNameFlag, &infoSummaryFlag, &infoURLFlag, &infoVersionFlag,
 	&networkIPFlag, &networkMaskFlag, &networkGatewayFlag, &networkUDPFlag,
 	&networkTCPFlag, &networkHTTPFlag, &networkHTTPSFlag, &networkMTUFlag,
-	&networkTCPDumpFlag, &loggingConfigFlag, &loggingTypeFlag, &nfsMountFlag,
+	&networkTCPDumpFlag, &networkModeFlag, &loggingConfigFlag, &loggingTypeFlag, &nfsMountFlag,
 	&nfsServerFlag, &nfsOptionsFlag, &systemKernelArgsFlag, &systemDNSFlag,
 	&systemHostnameFlag, &systemFilesystemFlag, &systemMaxFDsFlag,
 	&systemOutputModeFlag, &systemUserFlag, &programBinaryFlag,
 	&programPrivilegesFlag, &programArgsFlag, &programStdoutFlag,
 	&programStderrFlag, &programLogFilesFlag, &programBootstrapFlag,
 	&programEnvFlag, &programCWDFlag, &programStraceFlag, &sysctlFlag,
-	&programTerminateFlag, &systemTerminateWaitFlag,
+	&programTerminateFlag, &systemTerminateWaitFlag, &programTypeFlag,
+	&programFailBootFlag, &systemTimezoneFlag, &envFileFlag,
+	&systemKernelModulesFlag, &vcfgFileFlag, &programLoggingDestinationFlag,
+	&programLoggingFormatFlag, &systemDisableServicesFlag,
+	&systemBootTimeoutFlag, &systemDefaultBootEntryFlag, &programStdinFlag,
 }
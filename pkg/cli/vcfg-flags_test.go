@@ -88,6 +88,14 @@ func TestVMKernelFlag(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, f.Value, overrideVCFG.VM.Kernel)
 
+	// set --kernel="latest"
+	k := kernelFlag
+	k.Value = "latest"
+
+	err = k.Validate(k)
+	assert.NoError(t, err)
+	assert.Equal(t, "latest", overrideVCFG.VM.Kernel)
+
 }
 
 func TestVMRAMFlag(t *testing.T) {
@@ -242,6 +250,25 @@ func TestNetworksIPFlag(t *testing.T) {
 
 }
 
+func TestNetworkModeFlag(t *testing.T) {
+
+	testResetOverrideVCFG()
+
+	// set --networks[2].mode="slaac"
+	f := networkModeFlag
+	nNICs := 2
+	f.Total = &nNICs
+	f.Value = []string{"", "slaac"}
+
+	err := networkModeFlagValidator(f)
+	assert.NoError(t, err)
+	assert.Equal(t, nNICs, len(overrideVCFG.Networks))
+	assert.Equal(t, vcfg.SLAACNetworkMode, overrideVCFG.Networks[1].Mode)
+	assert.Equal(t, "", overrideVCFG.Networks[1].IP)
+	assert.Equal(t, "dhcp", overrideVCFG.Networks[0].IP)
+
+}
+
 func TestNetworkMaskFlag(t *testing.T) {
 
 	testResetOverrideVCFG()
@@ -557,6 +584,27 @@ func TestSystemMaxFDsFlag(t *testing.T) {
 
 }
 
+func TestSystemBootFlags(t *testing.T) {
+
+	testResetOverrideVCFG()
+
+	// set --system.boot-timeout=5 --system.default-boot-entry=rescue
+	timeout := systemBootTimeoutFlag
+	timeout.Value = 5
+
+	err := systemBootTimeoutFlagValidator(timeout)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, overrideVCFG.System.BootTimeout)
+
+	entry := systemDefaultBootEntryFlag
+	entry.Value = "rescue"
+
+	err = systemDefaultBootEntryFlagValidator(entry)
+	assert.NoError(t, err)
+	assert.Equal(t, "rescue", overrideVCFG.System.DefaultBootEntry)
+
+}
+
 func TestSystemTerminateWaitFlag(t *testing.T) {
 
 	testResetOverrideVCFG()
@@ -701,6 +749,23 @@ func TestProgramStdoutFlag(t *testing.T) {
 
 }
 
+func TestProgramStdinFlag(t *testing.T) {
+
+	testResetOverrideVCFG()
+
+	// set --program[2].stdin="literal:yes"
+	f := programStdinFlag
+	f.Value = []string{"", "literal:yes"}
+	nProgs := 2
+	f.Total = &nProgs
+
+	err := programStdinFlagValidator(f)
+	assert.NoError(t, err)
+	assert.Equal(t, nProgs, len(overrideVCFG.Programs))
+	assert.Equal(t, f.Value[1], overrideVCFG.Programs[1].Stdin)
+
+}
+
 func TestProgramStderrFlag(t *testing.T) {
 
 	testResetOverrideVCFG()
@@ -807,12 +872,18 @@ func TestSysctlFlag(t *testing.T) {
 
 	testResetOverrideVCFG()
 
-	// set --sysctl A=B
+	// set --sysctl net.core.somaxconn=1024
 	f := sysctlFlag
-	f.Value = []string{"A=B"}
+	f.Value = []string{"net.core.somaxconn=1024", "net.ipv4.tcp_rmem=4096 87380 6291456"}
 
 	err := sysctlFlagValidator(f)
 	assert.NoError(t, err)
-	assert.Equal(t, "B", overrideVCFG.Sysctl["A"])
+	assert.Equal(t, "1024", overrideVCFG.Sysctl["net.core.somaxconn"])
+	assert.Equal(t, "4096 87380 6291456", overrideVCFG.Sysctl["net.ipv4.tcp_rmem"])
+
+	for _, v := range []string{"A=B", "net.core.somaxconn", "net.core.somaxconn="} {
+		f.Value = []string{v}
+		assert.Error(t, sysctlFlagValidator(f), v)
+	}
 
 }
@@ -54,7 +54,7 @@ func buildFirecracker(ctx context.Context, w io.WriteSeeker, cfg *vcfg.VCFG, arg
 	}
 	vimgBuilder, err := vdisk.CreateBuilder(ctx, &vimg.BuilderArgs{
 		Kernel: vimg.KernelOptions{
-			Shell: args.KernelOptions.Shell,
+			Shell: args.KernelOptions.Shell || cfg.System.RescueShell,
 		},
 		FSCompiler: ext.NewCompiler(&ext.CompilerArgs{
 			FileTree: args.PackageReader.FS(),
@@ -89,7 +89,7 @@ func runVMware(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 	var err error
 	// Create base folder to store vmware vms so the socket can be grouped
 	parent := fmt.Sprintf("%s-%s", vmware.VirtualizerID, randstr.Hex(5))
-	parent = filepath.Join(os.TempDir(), parent)
+	parent = filepath.Join(tempDir(), parent)
 
 	// Create parent directory as it doesn't exist
 	err = os.MkdirAll(parent, os.ModePerm)
@@ -119,7 +119,7 @@ func runVMware(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 		Logger: log,
 	})
 	if err != nil {
-		return err
+		return ErrDiskBuild.Wrap(err)
 	}
 
 	err = f.Close()
@@ -150,7 +150,7 @@ func runVMware(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 		return err
 	}
 
-	return run(virt, f.Name(), cfg, name)
+	return ErrRun.Wrap(run(virt, f.Name(), cfg, name))
 }
 
 // runFirecracker needs a longer build process so we can pull the calver of the kernel used to build the disk
@@ -174,7 +174,7 @@ func runFirecracker(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 
 	// Create base folder to store firecracker vms so the socket can be grouped
 	parent := fmt.Sprintf("%s-%s", firecracker.VirtualizerID, randstr.Hex(5))
-	parent = filepath.Join(os.TempDir(), parent)
+	parent = filepath.Join(tempDir(), parent)
 	defer os.RemoveAll(parent)
 
 	// Create parent directory as it doesn't exist
@@ -208,7 +208,7 @@ func runFirecracker(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 		Logger: log,
 	})
 	if err != nil {
-		return err
+		return ErrDiskBuild.Wrap(err)
 	}
 
 	// assign kernel version that was built with vcfg
@@ -238,7 +238,7 @@ func runFirecracker(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 		return err
 	}
 
-	return run(virt, f.Name(), cfg, name)
+	return ErrRun.Wrap(run(virt, f.Name(), cfg, name))
 }
 
 func runHyperV(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
@@ -250,7 +250,7 @@ func runHyperV(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 	}
 	// Create base folder to store hyper-v vms so the socket can be grouped
 	parent := fmt.Sprintf("%s-%s", hyperv.VirtualizerID, randstr.Hex(5))
-	parent = filepath.Join(os.TempDir(), parent)
+	parent = filepath.Join(tempDir(), parent)
 
 	// Create parent directory as it doesn't exist
 	err := os.MkdirAll(parent, os.ModePerm)
@@ -280,7 +280,7 @@ func runHyperV(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 		Logger: log,
 	})
 	if err != nil {
-		return err
+		return ErrDiskBuild.Wrap(err)
 	}
 
 	err = f.Close()
@@ -311,7 +311,7 @@ func runHyperV(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 		return err
 	}
 
-	return run(virt, f.Name(), cfg, name)
+	return ErrRun.Wrap(run(virt, f.Name(), cfg, name))
 }
 
 func runVirtualBox(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
@@ -320,7 +320,7 @@ func runVirtualBox(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 	}
 	// Create base folder to store virtualbox vms so the socket can be grouped
 	parent := fmt.Sprintf("%s-%s", virtualbox.VirtualizerID, randstr.Hex(5))
-	parent = filepath.Join(os.TempDir(), parent)
+	parent = filepath.Join(tempDir(), parent)
 	defer os.RemoveAll(parent)
 
 	// Create parent directory as it doesn't exist
@@ -349,7 +349,7 @@ func runVirtualBox(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 		Logger: log,
 	})
 	if err != nil {
-		return err
+		return ErrDiskBuild.Wrap(err)
 	}
 
 	err = f.Close()
@@ -380,7 +380,7 @@ func runVirtualBox(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 		return err
 	}
 
-	return run(virt, f.Name(), cfg, name)
+	return ErrRun.Wrap(run(virt, f.Name(), cfg, name))
 }
 
 func runQEMU(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
@@ -390,7 +390,7 @@ func runQEMU(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 	}
 	// Create base folder to store qemu vms so the socket can be grouped
 	parent := fmt.Sprintf("%s-%s", qemu.VirtualizerID, randstr.Hex(5))
-	parent = filepath.Join(os.TempDir(), parent)
+	parent = filepath.Join(tempDir(), parent)
 	defer os.RemoveAll(parent)
 	// Create parent directory as it doesn't exist
 	err := os.MkdirAll(parent, os.ModePerm)
@@ -416,7 +416,7 @@ func runQEMU(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 		Logger: log,
 	})
 	if err != nil {
-		return err
+		return ErrDiskBuild.Wrap(err)
 	}
 
 	err = f.Close()
@@ -446,5 +446,5 @@ func runQEMU(pkgReader vpkg.Reader, cfg *vcfg.VCFG, name string) error {
 		return err
 	}
 
-	return run(virt, f.Name(), cfg, name)
+	return ErrRun.Wrap(run(virt, f.Name(), cfg, name))
 }
@@ -0,0 +1,321 @@
+package elfstrip
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// ErrNotELF is returned by Strip if the data isn't an ELF file.
+var ErrNotELF = errors.New("not an ELF file")
+
+// IsELF returns true if data begins with the ELF magic number. Only the first
+// four bytes are needed.
+func IsELF(data []byte) bool {
+	return len(data) >= 4 && bytes.Equal(data[:4], []byte(elf.ELFMAG))
+}
+
+type section struct {
+	name      string
+	nameOff   uint32
+	typ       uint32
+	flags     uint64
+	addr      uint64
+	off       uint64
+	size      uint64
+	link      uint32
+	info      uint32
+	addralign uint64
+	entsize   uint64
+}
+
+func (s *section) alloc() bool {
+	return s.flags&uint64(elf.SHF_ALLOC) != 0
+}
+
+func (s *section) infoIsSection() bool {
+	t := elf.SectionType(s.typ)
+	return t == elf.SHT_REL || t == elf.SHT_RELA || s.flags&uint64(elf.SHF_INFO_LINK) != 0
+}
+
+func (s *section) removable() bool {
+	if s.alloc() {
+		return false
+	}
+	return strings.HasPrefix(s.name, ".debug_") || strings.HasPrefix(s.name, ".zdebug_") ||
+		s.name == ".symtab" || s.name == ".strtab"
+}
+
+type header struct {
+	class     elf.Class
+	order     binary.ByteOrder
+	shoff     uint64
+	shentsize uint16
+	shnum     uint16
+	shstrndx  uint16
+}
+
+func readHeader(data []byte, f *elf.File) (*header, error) {
+
+	hdr := &header{
+		class: f.Class,
+		order: f.ByteOrder,
+	}
+
+	switch f.Class {
+	case elf.ELFCLASS64:
+		h := new(elf.Header64)
+		err := binary.Read(bytes.NewReader(data), f.ByteOrder, h)
+		if err != nil {
+			return nil, err
+		}
+		hdr.shoff, hdr.shentsize, hdr.shnum, hdr.shstrndx = h.Shoff, h.Shentsize, h.Shnum, h.Shstrndx
+	case elf.ELFCLASS32:
+		h := new(elf.Header32)
+		err := binary.Read(bytes.NewReader(data), f.ByteOrder, h)
+		if err != nil {
+			return nil, err
+		}
+		hdr.shoff, hdr.shentsize, hdr.shnum, hdr.shstrndx = uint64(h.Shoff), h.Shentsize, h.Shnum, h.Shstrndx
+	default:
+		return nil, errors.New("unsupported ELF class")
+	}
+
+	return hdr, nil
+}
+
+func (hdr *header) readSections(data []byte, f *elf.File) ([]*section, error) {
+
+	sections := make([]*section, hdr.shnum)
+
+	for i := range sections {
+		off := hdr.shoff + uint64(i)*uint64(hdr.shentsize)
+		if off+uint64(hdr.shentsize) > uint64(len(data)) {
+			return nil, errors.New("section header table out of bounds")
+		}
+		r := bytes.NewReader(data[off:])
+
+		s := new(section)
+		if hdr.class == elf.ELFCLASS64 {
+			sh := new(elf.Section64)
+			err := binary.Read(r, hdr.order, sh)
+			if err != nil {
+				return nil, err
+			}
+			*s = section{"", sh.Name, sh.Type, sh.Flags, sh.Addr, sh.Off, sh.Size, sh.Link, sh.Info, sh.Addralign, sh.Entsize}
+		} else {
+			sh := new(elf.Section32)
+			err := binary.Read(r, hdr.order, sh)
+			if err != nil {
+				return nil, err
+			}
+			*s = section{"", sh.Name, sh.Type, uint64(sh.Flags), uint64(sh.Addr), uint64(sh.Off), uint64(sh.Size), sh.Link, sh.Info, uint64(sh.Addralign), uint64(sh.Entsize)}
+		}
+		s.name = f.Sections[i].Name
+		sections[i] = s
+	}
+
+	return sections, nil
+}
+
+func (hdr *header) writeSection(w *bytes.Buffer, s *section) {
+	if hdr.class == elf.ELFCLASS64 {
+		_ = binary.Write(w, hdr.order, &elf.Section64{
+			Name: s.nameOff, Type: s.typ, Flags: s.flags, Addr: s.addr, Off: s.off, Size: s.size,
+			Link: s.link, Info: s.info, Addralign: s.addralign, Entsize: s.entsize,
+		})
+	} else {
+		_ = binary.Write(w, hdr.order, &elf.Section32{
+			Name: s.nameOff, Type: s.typ, Flags: uint32(s.flags), Addr: uint32(s.addr), Off: uint32(s.off), Size: uint32(s.size),
+			Link: s.link, Info: s.info, Addralign: uint32(s.addralign), Entsize: uint32(s.entsize),
+		})
+	}
+}
+
+// chooseRemovals decides which sections to remove. Sections that refer to a
+// removed section are removed as well if nothing at runtime needs them,
+// otherwise the section they refer to is kept.
+func chooseRemovals(sections []*section, shstrndx int) []bool {
+
+	removed := make([]bool, len(sections))
+	for i, s := range sections {
+		removed[i] = i != 0 && i != shstrndx && s.removable()
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for i, s := range sections {
+			if removed[i] {
+				continue
+			}
+			refs := []uint32{s.link}
+			if s.infoIsSection() {
+				refs = append(refs, s.info)
+			}
+			for _, ref := range refs {
+				if ref == 0 || int(ref) >= len(sections) || !removed[ref] {
+					continue
+				}
+				if s.alloc() || i == shstrndx {
+					removed[ref] = false
+				} else {
+					removed[i] = true
+				}
+				changed = true
+				break
+			}
+		}
+	}
+
+	return removed
+}
+
+func align(x, a uint64) uint64 {
+	if a <= 1 {
+		return x
+	}
+	return (x + a - 1) / a * a
+}
+
+// Strip returns a copy of an ELF executable or shared object without its
+// debugging information and symbol tables. Everything loaded at runtime is
+// left byte-for-byte identical, so the program behaves exactly as before.
+// Other kinds of ELF file, such as relocatable objects, are returned
+// unchanged, as are files with nothing to strip.
+func Strip(data []byte) ([]byte, error) {
+
+	if !IsELF(data) {
+		return nil, ErrNotELF
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return data, nil
+	}
+
+	hdr, err := readHeader(data, f)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.shnum == 0 || int(hdr.shnum) != len(f.Sections) || hdr.shstrndx >= hdr.shnum {
+		return data, nil
+	}
+
+	sections, err := hdr.readSections(data, f)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := chooseRemovals(sections, int(hdr.shstrndx))
+
+	var any bool
+	for _, r := range removed {
+		any = any || r
+	}
+	if !any {
+		return data, nil
+	}
+
+	// everything up to the end of the last segment is kept as it is
+	var keep uint64
+	for _, p := range f.Progs {
+		if end := p.Off + p.Filesz; end > keep {
+			keep = end
+		}
+	}
+	if hdr.class == elf.ELFCLASS64 {
+		keep = maxUint64(keep, 64)
+	} else {
+		keep = maxUint64(keep, 52)
+	}
+	for i, s := range sections {
+		if s.alloc() && elf.SectionType(s.typ) != elf.SHT_NOBITS && s.off+s.size > keep {
+			// shouldn't happen, but nothing loaded at runtime may move
+			if removed[i] {
+				return data, nil
+			}
+			keep = s.off + s.size
+		}
+	}
+	if keep > uint64(len(data)) {
+		return nil, errors.New("segment extends past the end of the file")
+	}
+
+	out := new(bytes.Buffer)
+	out.Write(data[:keep])
+
+	index := make([]uint32, len(sections))
+	var kept []*section
+	for i, s := range sections {
+		if removed[i] {
+			continue
+		}
+		index[i] = uint32(len(kept))
+
+		ns := *s
+		if elf.SectionType(s.typ) != elf.SHT_NOBITS && s.off >= keep && s.size > 0 {
+			if s.off+s.size > uint64(len(data)) {
+				return nil, errors.New("section extends past the end of the file")
+			}
+			pad := align(uint64(out.Len()), s.addralign) - uint64(out.Len())
+			out.Write(make([]byte, pad))
+			ns.off = uint64(out.Len())
+			out.Write(data[s.off : s.off+s.size])
+		}
+		kept = append(kept, &ns)
+	}
+
+	for _, s := range kept {
+		if int(s.link) < len(index) {
+			s.link = index[s.link]
+		}
+		if s.infoIsSection() && int(s.info) < len(index) {
+			s.info = index[s.info]
+		}
+	}
+
+	entAlign := uint64(4)
+	if hdr.class == elf.ELFCLASS64 {
+		entAlign = 8
+	}
+	pad := align(uint64(out.Len()), entAlign) - uint64(out.Len())
+	out.Write(make([]byte, pad))
+	shoff := uint64(out.Len())
+
+	for _, s := range kept {
+		hdr.writeSection(out, s)
+	}
+
+	b := out.Bytes()
+	if hdr.class == elf.ELFCLASS64 {
+		hdr.order.PutUint64(b[0x28:], shoff)
+		hdr.order.PutUint16(b[0x3C:], uint16(len(kept)))
+		hdr.order.PutUint16(b[0x3E:], uint16(index[hdr.shstrndx]))
+	} else {
+		hdr.order.PutUint32(b[0x20:], uint32(shoff))
+		hdr.order.PutUint16(b[0x30:], uint16(len(kept)))
+		hdr.order.PutUint16(b[0x32:], uint16(index[hdr.shstrndx]))
+	}
+
+	return b, nil
+}
+
+func maxUint64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,111 @@
+package elfstrip
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"debug/elf"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripNotELF(t *testing.T) {
+	assert.False(t, IsELF([]byte("#!/bin/sh\n")))
+	_, err := Strip([]byte("#!/bin/sh\n"))
+	assert.Equal(t, ErrNotELF, err)
+}
+
+// buildTestBinary compiles a small Go program, which includes DWARF debugging
+// information and a symbol table unless told otherwise.
+func buildTestBinary(t *testing.T, dir string) string {
+
+	gobin := filepath.Join(runtime.GOROOT(), "bin", "go")
+	if _, err := os.Stat(gobin); err != nil {
+		t.Skip("go toolchain not available")
+	}
+
+	src := filepath.Join(dir, "main.go")
+	err := ioutil.WriteFile(src, []byte("package main\n\nimport \"fmt\"\n\nfunc main() { fmt.Println(\"hello\") }\n"), 0644)
+	assert.NoError(t, err)
+
+	exe := filepath.Join(dir, "hello")
+	cmd := exec.Command(gobin, "build", "-o", exe, src)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO111MODULE=off", "CGO_ENABLED=0")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Skipf("failed to build test binary: %v: %s", err, out)
+	}
+
+	return exe
+}
+
+func TestStripExecutable(t *testing.T) {
+
+	if runtime.GOOS != "linux" {
+		t.Skip("native binaries are not ELF files")
+	}
+
+	dir, err := ioutil.TempDir("", "elfstrip")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	exe := buildTestBinary(t, dir)
+
+	data, err := ioutil.ReadFile(exe)
+	assert.NoError(t, err)
+	assert.True(t, IsELF(data))
+
+	orig, err := elf.NewFile(bytes.NewReader(data))
+	assert.NoError(t, err)
+	if orig.Section(".symtab") == nil {
+		t.Skip("test binary is already stripped")
+	}
+
+	out, err := Strip(data)
+	assert.NoError(t, err)
+	assert.Less(t, len(out), len(data))
+
+	stripped, err := elf.NewFile(bytes.NewReader(out))
+	assert.NoError(t, err)
+
+	for _, s := range stripped.Sections {
+		assert.False(t, strings.HasPrefix(s.Name, ".debug_"), s.Name)
+		assert.NotEqual(t, ".symtab", s.Name)
+	}
+
+	// loaded sections are untouched
+	for _, s := range orig.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 || s.Type == elf.SHT_NOBITS {
+			continue
+		}
+		ns := stripped.Section(s.Name)
+		if assert.NotNil(t, ns, s.Name) {
+			a, _ := s.Data()
+			b, _ := ns.Data()
+			assert.Equal(t, a, b, s.Name)
+		}
+	}
+
+	// stripping twice changes nothing
+	again, err := Strip(out)
+	assert.NoError(t, err)
+	assert.Equal(t, out, again)
+
+	// and the stripped binary still runs
+	path := filepath.Join(dir, "hello-stripped")
+	assert.NoError(t, ioutil.WriteFile(path, out, 0755))
+	output, err := exec.Command(path).Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", string(output))
+}
@@ -0,0 +1,80 @@
+package elog
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tee is a View that passes everything through to another View, and also
+// writes every log message to W as a timestamped line, so a persistent log
+// can be kept without changing what's shown on the terminal. Progress bars
+// are only shown by the wrapped View. Info messages are always written to W,
+// whether or not the wrapped View shows them, but debug messages are only
+// written if Debug is set.
+type Tee struct {
+	View
+	W     io.Writer
+	Debug bool
+	lock  sync.Mutex
+}
+
+// NewTee returns a Tee writing the log messages of v to w.
+func NewTee(v View, w io.Writer, debug bool) *Tee {
+	return &Tee{
+		View:  v,
+		W:     w,
+		Debug: debug,
+	}
+}
+
+func (t *Tee) write(level, format string, x ...interface{}) {
+
+	msg := strings.TrimRight(fmt.Sprintf(format, x...), "\n")
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// a failing log file mustn't interrupt whatever is being logged
+	_, _ = fmt.Fprintf(t.W, "%s %-5s %s\n", time.Now().UTC().Format(time.RFC3339), level, msg)
+
+}
+
+// Debugf logs to the wrapped View, and to W if Debug is set.
+func (t *Tee) Debugf(format string, x ...interface{}) {
+	t.View.Debugf(format, x...)
+	if t.Debug {
+		t.write("DEBUG", format, x...)
+	}
+}
+
+// Errorf logs to the wrapped View and to W.
+func (t *Tee) Errorf(format string, x ...interface{}) {
+	t.View.Errorf(format, x...)
+	t.write("ERROR", format, x...)
+}
+
+// Infof logs to the wrapped View and to W.
+func (t *Tee) Infof(format string, x ...interface{}) {
+	t.View.Infof(format, x...)
+	t.write("INFO", format, x...)
+}
+
+// Printf logs to the wrapped View and to W.
+func (t *Tee) Printf(format string, x ...interface{}) {
+	t.View.Printf(format, x...)
+	t.write("INFO", format, x...)
+}
+
+// Warnf logs to the wrapped View and to W.
+func (t *Tee) Warnf(format string, x ...interface{}) {
+	t.View.Warnf(format, x...)
+	t.write("WARN", format, x...)
+}
@@ -0,0 +1,44 @@
+package elog
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTee(t *testing.T) {
+
+	buf := new(bytes.Buffer)
+	tee := NewTee(&CLI{DisableTTY: true}, buf, false)
+
+	tee.Printf("hello %s", "world")
+	tee.Infof("verbose\n")
+	tee.Warnf("careful")
+	tee.Errorf("broken")
+	tee.Debugf("hidden")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	expect := []string{"INFO  hello world", "INFO  verbose", "WARN  careful", "ERROR broken"}
+	if len(lines) != len(expect) {
+		t.Fatalf("expected %d lines, got %d: %q", len(expect), len(lines), lines)
+	}
+
+	for i := range expect {
+		if !strings.HasSuffix(lines[i], expect[i]) {
+			t.Fatalf("line %d: expected suffix %q, got %q", i, expect[i], lines[i])
+		}
+	}
+
+	buf.Reset()
+	tee.Debug = true
+	tee.Debugf("shown")
+	if !strings.HasSuffix(buf.String(), "DEBUG shown\n") {
+		t.Fatalf("expected debug message to be written, got %q", buf.String())
+	}
+
+}
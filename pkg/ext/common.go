@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"path"
 
@@ -24,6 +25,7 @@ const (
 	InodeSize                = 128
 	InodesPerBlock           = BlockSize / InodeSize
 	BlockGroupDescriptorSize = 32
+	FirstInode               = 11
 	blocksPerSuperblock      = 1
 	blocksPerBlockBitmap     = 1
 	blocksPerInodeBitmap     = 1
@@ -48,9 +50,79 @@ const (
 	inodeRegularFilePermissions = InodeTypeRegularFile | DefaultInodePermissions
 	inodeSymlinkPermissions     = InodeTypeSymlink | DefaultInodePermissions
 
-	IncompatFiletype = 0x2
+	IncompatFiletype  = 0x2
+	IncompatExtents   = 0x40
+	Incompat64Bit     = 0x80
+	ROCompatLargeFile = 0x2
+
+	// BlockGroupDescriptorSize64 is the size of a block group descriptor on
+	// file-systems with the 64bit feature.
+	BlockGroupDescriptorSize64 = 64
+
+	InodeFlagExtents = 0x80000
+	ExtentMagic      = 0xF30A
+)
+
+// Names of the feature flags in a Superblock's OptionalFeatures,
+// RequiredFeatures, and ReadOnlyFeatures, as e2fsprogs calls them.
+var (
+	CompatFeatureNames = map[uint32]string{
+		0x1:   "dir_prealloc",
+		0x2:   "imagic_inodes",
+		0x4:   "has_journal",
+		0x8:   "ext_attr",
+		0x10:  "resize_inode",
+		0x20:  "dir_index",
+		0x200: "sparse_super2",
+	}
+	IncompatFeatureNames = map[uint32]string{
+		0x1:     "compression",
+		0x2:     "filetype",
+		0x4:     "needs_recovery",
+		0x8:     "journal_dev",
+		0x10:    "meta_bg",
+		0x40:    "extent",
+		0x80:    "64bit",
+		0x100:   "mmp",
+		0x200:   "flex_bg",
+		0x400:   "ea_inode",
+		0x1000:  "dirdata",
+		0x2000:  "metadata_csum_seed",
+		0x4000:  "large_dir",
+		0x8000:  "inline_data",
+		0x10000: "encrypt",
+	}
+	ROCompatFeatureNames = map[uint32]string{
+		0x1:   "sparse_super",
+		0x2:   "large_file",
+		0x4:   "btree_dir",
+		0x8:   "huge_file",
+		0x10:  "uninit_bg",
+		0x20:  "dir_nlink",
+		0x40:  "extra_isize",
+		0x100: "quota",
+		0x200: "bigalloc",
+		0x400: "metadata_csum",
+	}
 )
 
+// FeatureNames returns the names of the features set in flags, lowest bit
+// first. Bits that aren't in names are shown in hex.
+func FeatureNames(flags uint32, names map[uint32]string) []string {
+	var list []string
+	for bit := uint32(1); bit != 0; bit <<= 1 {
+		if flags&bit == 0 {
+			continue
+		}
+		name, ok := names[bit]
+		if !ok {
+			name = fmt.Sprintf("0x%X", bit)
+		}
+		list = append(list, name)
+	}
+	return list
+}
+
 // Superblock is the structure of a superblock as written to the disk.
 type Superblock struct {
 	TotalInodes         uint32
@@ -78,11 +150,69 @@ type Superblock struct {
 	VersionMajor        uint32
 	SuperUser           uint16
 	SuperGroup          uint16
-	_                   uint32
-	_                   uint16
+	FirstInode          uint32
+	InodeSize           uint16
 	_                   uint16
-	_                   uint32
+	OptionalFeatures    uint32
 	RequiredFeatures    uint32
+	ReadOnlyFeatures    uint32
+	UUID                [16]byte
+	VolumeName          [16]byte
+	LastMountPath       [64]byte
+	_                   uint32
+	_                   [4]byte
+	JournalUUID         [16]byte
+	_                   [3]uint32
+	_                   [4]uint32
+	_                   uint8
+	_                   uint8
+	DescriptorSize      uint16
+	_                   [3]uint32
+	_                   [17]uint32
+	TotalBlocksHi       uint32
+	ReservedBlocksHi    uint32
+	UnallocatedBlocksHi uint32
+}
+
+// Blocks returns the total number of blocks in the file-system, including
+// the upper bits stored by file-systems with the 64bit feature.
+func (sb *Superblock) Blocks() int64 {
+	n := int64(sb.TotalBlocks)
+	if sb.RequiredFeatures&Incompat64Bit != 0 {
+		n |= int64(sb.TotalBlocksHi) << 32
+	}
+	return n
+}
+
+// UnallocatedBlocksCount returns the number of free blocks in the
+// file-system, including the upper bits stored by file-systems with the 64bit
+// feature.
+func (sb *Superblock) UnallocatedBlocksCount() int64 {
+	n := int64(sb.UnallocatedBlocks)
+	if sb.RequiredFeatures&Incompat64Bit != 0 {
+		n |= int64(sb.UnallocatedBlocksHi) << 32
+	}
+	return n
+}
+
+// ReservedBlocksCount returns the number of blocks reserved for the
+// superuser, including the upper bits stored by file-systems with the 64bit
+// feature.
+func (sb *Superblock) ReservedBlocksCount() int64 {
+	n := int64(sb.ReservedBlocks)
+	if sb.RequiredFeatures&Incompat64Bit != 0 {
+		n |= int64(sb.ReservedBlocksHi) << 32
+	}
+	return n
+}
+
+// GroupDescriptorSize returns the size of each entry in the block group
+// descriptor table.
+func (sb *Superblock) GroupDescriptorSize() int {
+	if sb.RequiredFeatures&Incompat64Bit != 0 && sb.DescriptorSize > BlockGroupDescriptorSize {
+		return int(sb.DescriptorSize)
+	}
+	return BlockGroupDescriptorSize
 }
 
 // BlockGroupDescriptorTableEntry is the structure of an ext block group
@@ -97,6 +227,19 @@ type BlockGroupDescriptorTableEntry struct {
 	_                    [14]byte
 }
 
+// BlockGroupDescriptorTableEntryHi is the second half of a block group
+// descriptor on file-systems with the 64bit feature. It holds the upper bits
+// of the fields in the BlockGroupDescriptorTableEntry before it.
+type BlockGroupDescriptorTableEntryHi struct {
+	BlockBitmapBlockAddrHi uint32
+	InodeBitmapBlockAddrHi uint32
+	InodeTableBlockAddrHi  uint32
+	UnallocatedBlocksHi    uint16
+	UnallocatedInodesHi    uint16
+	DirectoriesHi          uint16
+	_                      [14]byte
+}
+
 // Inode is the structure of an inode as written to the disk.
 type Inode struct {
 	Permissions      uint16
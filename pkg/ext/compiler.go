@@ -20,13 +20,26 @@ type compiler struct {
 	nodeTracker
 	blockUsage
 
-	tree vio.FileTree
-	size int64
+	tree          vio.FileTree
+	size          int64
+	preserveModes bool
+	format        Format
+	ext4Threshold int64
+	ext4          bool
+
+	reservedBlocksPercent int64
 
 	superblock Superblock
 	bgdt       []byte
 }
 
+func (c *compiler) descriptorSize() int64 {
+	if c.ext4 {
+		return BlockGroupDescriptorSize64
+	}
+	return BlockGroupDescriptorSize
+}
+
 func (c *compiler) calculateMinimumSize(ctx context.Context, minDataBlocks, minInodes, minInodesPer64 int64) (int64, error) {
 
 	var err error
@@ -50,7 +63,7 @@ func (c *compiler) calculateMinimumSize(ctx context.Context, minDataBlocks, minI
 		}
 
 		inodesPerGroup = align(inodesPerGroup, InodesPerBlock)
-		blocksPerBGDT = divide(groups*BlockGroupDescriptorSize, BlockSize)
+		blocksPerBGDT = divide(groups*c.descriptorSize(), BlockSize)
 		blocksPerInodeTable = inodesPerGroup / InodesPerBlock
 		overheadBlocksPerGroup = blocksPerSuperblock + blocksPerBGDT + blocksPerBlockBitmap + blocksPerInodeBitmap + blocksPerInodeTable
 		dataBlocksPerGroup = blocksPerGroup - overheadBlocksPerGroup
@@ -92,7 +105,7 @@ retry:
 		return errors.New("minimum inodes required exceeds maximum number of inodes possible at this disk size")
 	}
 
-	c.blocksPerBGDT = divide(c.groups*BlockGroupDescriptorSize, BlockSize)
+	c.blocksPerBGDT = divide(c.groups*c.descriptorSize(), BlockSize)
 	c.blocksPerInodeTable = c.inodesPerGroup / InodesPerBlock
 	c.overheadBlocksPerGroup = blocksPerSuperblock + c.blocksPerBGDT + blocksPerBlockBitmap + blocksPerInodeBitmap + c.blocksPerInodeTable
 
@@ -104,6 +117,10 @@ retry:
 	}
 
 	c.dataBlocksPerGroup = c.blocksPerGroup - c.overheadBlocksPerGroup
+	if c.ext4 && c.dataBlocksPerGroup < minExtentRun {
+		return errors.New("file-system too large to build with extents")
+	}
+
 	c.unallocatedBlocks = c.blocks - c.filledDataBlocks - c.groups*c.overheadBlocksPerGroup
 	c.unallocatedInodes = c.groups*c.inodesPerGroup - int64(len(c.inodeBlocks)-1)
 
@@ -137,7 +154,21 @@ func (c *compiler) initSuperblock() {
 	c.superblock.FragmentsPerGroup = uint32(c.blocksPerGroup)
 	c.superblock.UnallocatedBlocks = uint32(c.unallocatedBlocks)
 	c.superblock.UnallocatedInodes = uint32(c.unallocatedInodes)
+	reserved := c.blocks * c.reservedBlocksPercent / 100
+	c.superblock.ReservedBlocks = uint32(reserved)
 	c.superblock.RequiredFeatures = IncompatFiletype
+
+	if c.ext4 {
+		c.superblock.VersionMajor = 1
+		c.superblock.FirstInode = FirstInode
+		c.superblock.InodeSize = InodeSize
+		c.superblock.RequiredFeatures |= IncompatExtents | Incompat64Bit
+		c.superblock.ReadOnlyFeatures = ROCompatLargeFile
+		c.superblock.DescriptorSize = BlockGroupDescriptorSize64
+		c.superblock.TotalBlocksHi = uint32(c.blocks >> 32)
+		c.superblock.UnallocatedBlocksHi = uint32(c.unallocatedBlocks >> 32)
+		c.superblock.ReservedBlocksHi = uint32(reserved >> 32)
+	}
 }
 
 func (c *compiler) generateBGDT() error {
@@ -169,16 +200,28 @@ func (c *compiler) generateBGDT() error {
 			inodes = ipb - claimedInodes%ipb
 		}
 
+		blockBitmap := i*c.blocksPerGroup + blocksPerSuperblock + c.blocksPerBGDT
+		inodeBitmap := blockBitmap + blocksPerBlockBitmap
+		inodeTable := inodeBitmap + blocksPerInodeBitmap
+
 		bgdte := &BlockGroupDescriptorTableEntry{
-			BlockBitmapBlockAddr: uint32(i*c.blocksPerGroup + blocksPerSuperblock + c.blocksPerBGDT),
-			InodeBitmapBlockAddr: uint32(i*c.blocksPerGroup + blocksPerSuperblock + c.blocksPerBGDT + blocksPerBlockBitmap),
-			InodeTableBlockAddr:  uint32(i*c.blocksPerGroup + blocksPerSuperblock + c.blocksPerBGDT + blocksPerBlockBitmap + blocksPerInodeBitmap),
+			BlockBitmapBlockAddr: uint32(blockBitmap),
+			InodeBitmapBlockAddr: uint32(inodeBitmap),
+			InodeTableBlockAddr:  uint32(inodeTable),
 			UnallocatedBlocks:    uint16(blocks),
 			UnallocatedInodes:    uint16(inodes),
 			Directories:          uint16(c.dirsInGroup[i]),
 		}
 
 		_ = binary.Write(buf, binary.LittleEndian, bgdte)
+
+		if c.ext4 {
+			_ = binary.Write(buf, binary.LittleEndian, &BlockGroupDescriptorTableEntryHi{
+				BlockBitmapBlockAddrHi: uint32(blockBitmap >> 32),
+				InodeBitmapBlockAddrHi: uint32(inodeBitmap >> 32),
+				InodeTableBlockAddrHi:  uint32(inodeTable >> 32),
+			})
+		}
 	}
 
 	c.bgdt = buf.Bytes()
@@ -348,6 +391,12 @@ func (c *compiler) writeInode(ino int64, w io.Writer) error {
 		inode.Permissions = inodeRegularFilePermissions
 	}
 
+	if c.preserveModes {
+		if mode, ok := vio.FileMode(node.node.File); ok {
+			inode.Permissions = inode.Permissions&InodeTypeMask | uint16(mode&InodePermissionsMask)
+		}
+	}
+
 	inode.Links = 1
 	if node.node.File.IsDir() {
 		inode.Links++
@@ -361,7 +410,15 @@ func (c *compiler) writeInode(ino int64, w io.Writer) error {
 	inode.UID = SuperUID
 	inode.GID = SuperGID
 	inode.Sectors = node.fs * (BlockSize / SectorSize)
-	c.setInodePointers(ino, inode)
+
+	if c.ext4 {
+		if !node.node.File.IsDir() {
+			inode.SizeUpper = uint32(int64(node.node.File.Size()) >> 32)
+		}
+		c.setInodeExtents(ino, inode)
+	} else {
+		c.setInodePointers(ino, inode)
+	}
 
 	err := binary.Write(w, binary.LittleEndian, inode)
 	if err != nil {
@@ -14,12 +14,55 @@ import (
 	"github.com/vorteil/vorteil/pkg/vio"
 )
 
+// Format selects the on-disk layout written by a Compiler.
+type Format int
+
+const (
+	// FormatAuto uses FormatExt4 if the file-system needs at least the
+	// Ext4Threshold number of bytes to hold its contents, and FormatExt2
+	// otherwise.
+	FormatAuto Format = iota
+
+	// FormatExt2 maps file data using indirect block pointers. It can be
+	// mounted by every ext driver.
+	FormatExt2
+
+	// FormatExt4 maps file data using extents and enables the 64bit feature,
+	// avoiding the overhead of indirect blocks for large files. It must be
+	// mounted by an ext4 driver.
+	FormatExt4
+)
+
+// DefaultExt4Threshold is the Ext4Threshold used when none is provided.
+const DefaultExt4Threshold = 0x40000000
+
+// MaxReservedBlocksPercent is the largest ReservedBlocksPercent that makes
+// sense: any more and most of the file-system is only usable by the superuser.
+const MaxReservedBlocksPercent = 50
+
 // CompilerArgs organizes all inputs necessary to create a new Compiler. Because
 // the compiler is designed to be configured in stages by the caller very little
 // goes here.
 type CompilerArgs struct {
 	FileTree vio.FileTree
 	Logger   elog.Logger
+
+	// PreserveModes gives each inode the permission bits of its file, where
+	// they are known (see vio.FileMode), instead of DefaultInodePermissions.
+	PreserveModes bool
+
+	// Format selects the on-disk layout. The zero value is FormatAuto.
+	Format Format
+
+	// Ext4Threshold is the minimum file-system size, in bytes, at which
+	// FormatAuto switches to FormatExt4. If it is zero DefaultExt4Threshold
+	// is used.
+	Ext4Threshold int64
+
+	// ReservedBlocksPercent is the percentage of the file-system's blocks
+	// reserved for the superuser, from 0 to MaxReservedBlocksPercent. The
+	// zero value reserves nothing, leaving every block usable.
+	ReservedBlocksPercent int
 }
 
 // Compiler keeps all variables and settings for a single file-system compile
@@ -38,6 +81,7 @@ type Compiler struct {
 	minDataBlocks  int64
 	minSize        int64
 	inodes         int64
+	transforms     []vio.Transform
 
 	compiler
 }
@@ -50,6 +94,13 @@ func NewCompiler(args *CompilerArgs) *Compiler {
 	c := new(Compiler)
 	c.tree = args.FileTree
 	c.log = args.Logger
+	c.preserveModes = args.PreserveModes
+	c.format = args.Format
+	c.ext4Threshold = args.Ext4Threshold
+	c.reservedBlocksPercent = int64(args.ReservedBlocksPercent)
+	if c.ext4Threshold == 0 {
+		c.ext4Threshold = DefaultExt4Threshold
+	}
 	return c
 }
 
@@ -89,6 +140,19 @@ func (c *Compiler) AddFile(path string, r io.ReadCloser, size int64, force bool)
 	return nil
 }
 
+// AddTransform allows the caller to change the contents of every file whose
+// path 'matcher' returns true for, by replacing them with whatever 'transform'
+// reads from them as the file-system is committed. Transforms run in the order
+// they were added, each one reading the output of the last, and an error from
+// any of them fails Commit, naming the file. This function must be called
+// before calling Commit, otherwise the behaviour is undefined.
+func (c *Compiler) AddTransform(matcher func(path string) bool, transform func(io.Reader) (io.Reader, error)) {
+	c.transforms = append(c.transforms, vio.Transform{
+		Match: matcher,
+		Apply: transform,
+	})
+}
+
 // IncreaseMinimumInodes allows the caller to force in some extra empty inodes
 // on top of whatever would have otherwise been there. This function can only be
 // called before calling Commit, otherwise the behaviour is undefined.
@@ -124,6 +188,7 @@ type nodeBlocks struct {
 	start   int64
 	content uint32
 	fs      uint32
+	leaves  uint32
 }
 
 // Commit is the second of the four steps necessary to compile a file-system
@@ -133,7 +198,10 @@ type nodeBlocks struct {
 // capacity of the file-system must be done before this function is called.
 func (c *Compiler) Commit(ctx context.Context) error {
 
-	var err error
+	err := vio.ApplyTransforms(c.tree, c.transforms)
+	if err != nil {
+		return err
+	}
 
 	c.filledDataBlocks, err = c.scanInodes(ctx, c.tree)
 	if err != nil {
@@ -155,10 +223,48 @@ func (c *Compiler) Commit(ctx context.Context) error {
 		return err
 	}
 
+	if c.format == FormatExt4 || (c.format == FormatAuto && c.minSize >= c.ext4Threshold) {
+		err = c.useExtents(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 
 }
 
+func (c *Compiler) useExtents(ctx context.Context) error {
+
+	var err error
+
+	c.ext4 = true
+	c.filledDataBlocks, err = c.layoutExtents()
+	if err != nil {
+		return err
+	}
+
+	c.minDataBlocks = c.filledDataBlocks + divide(c.minFreeSpace, BlockSize)
+
+	c.minSize, err = c.calculateMinimumSize(ctx, c.minDataBlocks, c.minInodes, c.minInodesPer64)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// FilesystemType returns the name of the kernel driver needed to mount the
+// file-system, which is either "ext2" or "ext4". The answer is only final once
+// Commit has been called.
+func (c *Compiler) FilesystemType() string {
+	if c.ext4 || c.format == FormatExt4 {
+		return "ext4"
+	}
+	return "ext2"
+}
+
 // MinimumSize returns the minimum number of bytes needed to contain the
 // file-system image. It can be called after a successful call to Commit, and is
 // intended to provide useful information to the caller that can help it
@@ -183,6 +289,10 @@ func (c *Compiler) Precompile(ctx context.Context, size int64) error {
 
 	c.fillBlockUsageBitmap()
 
+	if c.ext4 {
+		c.leafBlocks = c.extentLeafBlocks
+	}
+
 	c.initSuperblock()
 
 	err = c.generateBGDT()
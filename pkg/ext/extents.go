@@ -0,0 +1,244 @@
+package ext
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	extentHeaderSize = 12
+	extentEntrySize  = 12
+	extentsPerInode  = 4
+	extentsPerBlock  = (BlockSize - extentHeaderSize) / extentEntrySize
+	maxExtentLength  = 32768
+
+	// minExtentRun is the fewest data blocks a block group may hold on a
+	// file-system built with extents. Each extent ends at a block group
+	// boundary, so this bounds the number of extents a file needs before the
+	// final size of the file-system is known.
+	minExtentRun = BlockSize*8 - 2048
+
+	inodeBlockPointersSize = 60
+)
+
+type extentHeader struct {
+	Magic      uint16
+	Entries    uint16
+	Max        uint16
+	Depth      uint16
+	Generation uint32
+}
+
+type extentIndex struct {
+	Block  uint32
+	LeafLo uint32
+	LeafHi uint16
+	_      uint16
+}
+
+type extent struct {
+	Block   uint32
+	Len     uint16
+	StartHi uint16
+	StartLo uint32
+}
+
+type extentRun struct {
+	logical  int64
+	physical int64
+	length   int64
+}
+
+// calculateExtentLeaves returns the number of leaf blocks the extent tree of
+// an inode with content data blocks needs. If the worst case number of
+// extents fits in the inode there are none, otherwise the inode holds an
+// index of up to four leaves.
+func calculateExtentLeaves(content int64) (int64, error) {
+
+	if content == 0 {
+		return 0, nil
+	}
+
+	extents := divide(content, minExtentRun) + 1
+	if extents <= extentsPerInode {
+		return 0, nil
+	}
+
+	leaves := divide(extents, extentsPerBlock)
+	if leaves > extentsPerInode {
+		return 0, fmt.Errorf("file too large for ext4 extents")
+	}
+
+	return leaves, nil
+
+}
+
+// layoutExtents recalculates the blocks needed by every inode for a
+// file-system that maps its data with extents. Leaf blocks are placed before
+// each inode's data.
+func (c *nodeTracker) layoutExtents() (int64, error) {
+
+	var filledDataBlocks int64
+
+	for i := range c.inodeBlocks {
+
+		nb := &c.inodeBlocks[i]
+		if nb.node == nil {
+			continue
+		}
+
+		leaves, err := calculateExtentLeaves(int64(nb.content))
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", nb.node.Path(), err)
+		}
+
+		nb.start = filledDataBlocks
+		nb.leaves = uint32(leaves)
+		nb.fs = nb.content + nb.leaves
+		filledDataBlocks += int64(nb.fs)
+
+	}
+
+	return filledDataBlocks, nil
+
+}
+
+// extentRuns maps count data blocks, starting at data block first, to runs of
+// contiguous block addresses. Runs are broken at block group boundaries.
+func (c *blockUsage) extentRuns(first, count int64) []extentRun {
+
+	var runs []extentRun
+	var logical int64
+
+	for count > 0 {
+		n := c.dataBlocksPerGroup - first%c.dataBlocksPerGroup
+		if n > count {
+			n = count
+		}
+		if n > maxExtentLength {
+			n = maxExtentLength
+		}
+		runs = append(runs, extentRun{
+			logical:  logical,
+			physical: c.mapDBtoBlockAddr(first),
+			length:   n,
+		})
+		first += n
+		logical += n
+		count -= n
+	}
+
+	return runs
+
+}
+
+// splitExtentRuns splits the longest runs in half until there are at least n
+// of them, so that no leaf of an extent tree is left empty.
+func splitExtentRuns(runs []extentRun, n int64) []extentRun {
+
+	for int64(len(runs)) < n {
+		longest := 0
+		for i := range runs {
+			if runs[i].length > runs[longest].length {
+				longest = i
+			}
+		}
+
+		r := runs[longest]
+		half := r.length / 2
+		a := extentRun{logical: r.logical, physical: r.physical, length: half}
+		b := extentRun{logical: r.logical + half, physical: r.physical + half, length: r.length - half}
+
+		runs = append(runs[:longest], append([]extentRun{a, b}, runs[longest+1:]...)...)
+	}
+
+	return runs
+
+}
+
+func writeExtentHeader(buf *bytes.Buffer, entries, max, depth int64) {
+	_ = binary.Write(buf, binary.LittleEndian, &extentHeader{
+		Magic:   ExtentMagic,
+		Entries: uint16(entries),
+		Max:     uint16(max),
+		Depth:   uint16(depth),
+	})
+}
+
+func writeExtents(buf *bytes.Buffer, runs []extentRun) {
+	for _, r := range runs {
+		_ = binary.Write(buf, binary.LittleEndian, &extent{
+			Block:   uint32(r.logical),
+			Len:     uint16(r.length),
+			StartHi: uint16(r.physical >> 32),
+			StartLo: uint32(r.physical),
+		})
+	}
+}
+
+// extentTree returns the extent tree of an inode: the contents of the inode's
+// block pointer fields, and the contents of each of its leaf blocks.
+func (c *compiler) extentTree(nb *nodeBlocks) ([]byte, [][]byte) {
+
+	leaves := int64(nb.leaves)
+	runs := c.extentRuns(nb.start+leaves, int64(nb.content))
+
+	root := new(bytes.Buffer)
+
+	if leaves == 0 {
+		writeExtentHeader(root, int64(len(runs)), extentsPerInode, 0)
+		writeExtents(root, runs)
+		return root.Bytes(), nil
+	}
+
+	runs = splitExtentRuns(runs, leaves)
+	n := int64(len(runs))
+
+	writeExtentHeader(root, leaves, extentsPerInode, 1)
+
+	blocks := make([][]byte, leaves)
+	for i := int64(0); i < leaves; i++ {
+		part := runs[i*n/leaves : (i+1)*n/leaves]
+
+		addr := c.mapDBtoBlockAddr(nb.start + i)
+		_ = binary.Write(root, binary.LittleEndian, &extentIndex{
+			Block:  uint32(part[0].logical),
+			LeafLo: uint32(addr),
+			LeafHi: uint16(addr >> 32),
+		})
+
+		leaf := new(bytes.Buffer)
+		writeExtentHeader(leaf, int64(len(part)), extentsPerBlock, 0)
+		writeExtents(leaf, part)
+		blocks[i] = leaf.Bytes()
+	}
+
+	return root.Bytes(), blocks
+
+}
+
+func (c *compiler) extentLeafBlocks(nb *nodeBlocks) [][]byte {
+	_, leaves := c.extentTree(nb)
+	return leaves
+}
+
+func (c *compiler) setInodeExtents(ino int64, inode *Inode) {
+
+	root, _ := c.extentTree(&c.inodeBlocks[ino])
+	root = append(root, make([]byte, inodeBlockPointersSize-len(root))...)
+
+	r := bytes.NewReader(root)
+	_ = binary.Read(r, binary.LittleEndian, &inode.DirectPointer)
+	_ = binary.Read(r, binary.LittleEndian, &inode.SinglyIndirect)
+	_ = binary.Read(r, binary.LittleEndian, &inode.DoublyIndirect)
+	_ = binary.Read(r, binary.LittleEndian, &inode.TriplyIndirect)
+
+	inode.Flags |= InodeFlagExtents
+
+}
@@ -0,0 +1,74 @@
+package ext
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"testing"
+)
+
+func TestExtentLeavesCalculation(t *testing.T) {
+
+	// Files that can't need more than four extents are mapped from the inode.
+	for _, n := range []int64{0, 1, minExtentRun * 3} {
+		leaves, err := calculateExtentLeaves(n)
+		if err != nil || leaves != 0 {
+			t.Fatalf("calculateExtentLeaves calculates %d blocks incorrectly", n)
+		}
+	}
+
+	leaves, err := calculateExtentLeaves(minExtentRun * 4)
+	if err != nil || leaves != 1 {
+		t.Fatalf("calculateExtentLeaves calculates %d blocks incorrectly", minExtentRun*4)
+	}
+
+	_, err = calculateExtentLeaves(minExtentRun * extentsPerBlock * 5)
+	if err == nil {
+		t.Fatalf("calculateExtentLeaves accepted a file too large for four leaves")
+	}
+
+}
+
+func TestExtentRuns(t *testing.T) {
+
+	c := &blockUsage{
+		blocksPerGroup:         BlockSize * 8,
+		overheadBlocksPerGroup: 100,
+		dataBlocksPerGroup:     BlockSize*8 - 100,
+	}
+
+	// A run is broken at the end of each block group.
+	runs := c.extentRuns(c.dataBlocksPerGroup-10, 20)
+	if len(runs) != 2 {
+		t.Fatalf("extentRuns returned %d runs, expected 2", len(runs))
+	}
+
+	if runs[0] != (extentRun{logical: 0, physical: c.blocksPerGroup - 10, length: 10}) {
+		t.Fatalf("extentRuns calculates the first run incorrectly: %+v", runs[0])
+	}
+
+	if runs[1] != (extentRun{logical: 10, physical: c.blocksPerGroup + 100, length: 10}) {
+		t.Fatalf("extentRuns calculates the second run incorrectly: %+v", runs[1])
+	}
+
+	// Splitting runs keeps them contiguous.
+	runs = splitExtentRuns(runs, 5)
+	if len(runs) != 5 {
+		t.Fatalf("splitExtentRuns returned %d runs, expected 5", len(runs))
+	}
+
+	var logical int64
+	for _, r := range runs {
+		if r.logical != logical || r.length == 0 {
+			t.Fatalf("splitExtentRuns produced a bad run: %+v", r)
+		}
+		logical += r.length
+	}
+
+	if logical != 20 {
+		t.Fatalf("splitExtentRuns lost blocks: %d", logical)
+	}
+
+}
@@ -21,6 +21,11 @@ type nodeTracker struct {
 	activeNodeBlock  int64
 	activeNodeBlocks int64
 	activeNodeStart  int64
+	activeNodeLeaves [][]byte
+
+	// leafBlocks returns the extent tree leaf blocks for a node. It is only
+	// set for file-systems that map their data with extents.
+	leafBlocks func(node *nodeBlocks) [][]byte
 }
 
 func (c *nodeTracker) scanInodes(ctx context.Context, tree vio.FileTree) (int64, error) {
@@ -107,6 +112,10 @@ func (c *nodeTracker) prepNextDataBlock() error {
 		c.activeNodeBlock = 0
 		c.activeNodeBlocks = int64(node.fs)
 		c.activeNodeStart = int64(node.start)
+		c.activeNodeLeaves = nil
+		if c.leafBlocks != nil && node.leaves > 0 {
+			c.activeNodeLeaves = c.leafBlocks(node)
+		}
 
 		// generate dir data into args.objData
 		if node.node.File.IsDir() {
@@ -151,9 +160,18 @@ func (c *nodeTracker) writeBlock(w io.Writer, mapDBtoBlockAddr func(int64) int64
 	btype := blockType(c.activeNodeBlock)
 	refsPerBlock := int64(BlockSize / pointerSize)
 
+	if c.leafBlocks != nil {
+		btype = 0
+		if c.activeNodeBlock < int64(len(c.activeNodeLeaves)) {
+			btype = -1
+		}
+	}
+
 	var j int64
 
 	switch btype {
+	case -1: // it is an extent tree leaf block
+		_, _ = buffer.Write(c.activeNodeLeaves[c.activeNodeBlock])
 	case 0: // it is a data block
 		_, err := io.CopyN(buffer, c.activeNodeReader, BlockSize)
 		if err != nil && err != io.EOF {
@@ -0,0 +1,238 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+	"gopkg.in/yaml.v2"
+)
+
+// Rules an AuditPolicy can enforce, as they are named in a policy file.
+const (
+	AuditNoRootPrograms = "no-root-programs"
+	AuditRequiredFiles  = "required-files"
+	AuditForbiddenFiles = "forbidden-files"
+	AuditReadOnlyRoot   = "read-only-root"
+	AuditNoDebug        = "no-debug"
+	AuditEncryptedRoot  = "encrypted-root"
+)
+
+// AuditPolicy describes the rules a disk image must satisfy. Rules that are
+// left unset aren't checked.
+type AuditPolicy struct {
+	NoRootPrograms bool     `yaml:"no-root-programs" json:"no-root-programs"` // no program may run with root privilege
+	RequiredFiles  []string `yaml:"required-files" json:"required-files"`     // paths that must exist on the file-system
+	ForbiddenFiles []string `yaml:"forbidden-files" json:"forbidden-files"`   // paths that must not exist on the file-system
+	ReadOnlyRoot   bool     `yaml:"read-only-root" json:"read-only-root"`     // the root file-system must be mounted read-only
+	NoDebug        bool     `yaml:"no-debug" json:"no-debug"`                 // no program may use strace, and no network tcpdump
+	EncryptedRoot  bool     `yaml:"encrypted-root" json:"encrypted-root"`     // the root partition must be encrypted with LUKS
+}
+
+// LoadAuditPolicy parses a policy from YAML, or JSON. Unknown rules are
+// rejected rather than ignored, so a typo can't make a policy pass.
+func LoadAuditPolicy(data []byte) (*AuditPolicy, error) {
+
+	policy := new(AuditPolicy)
+	err := yaml.UnmarshalStrict(data, policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse policy: %w", err)
+	}
+
+	return policy, nil
+}
+
+// AuditReport holds the result of every rule checked against a disk.
+type AuditReport struct {
+	Results []AuditResult
+}
+
+// AuditResult holds whether a single rule passed, with a detail explaining
+// why it failed, or what was checked if it passed.
+type AuditResult struct {
+	Rule   string
+	Passed bool
+	Detail string
+}
+
+// Failed returns the number of rules that failed.
+func (r *AuditReport) Failed() int {
+	var n int
+	for _, res := range r.Results {
+		if !res.Passed {
+			n++
+		}
+	}
+	return n
+}
+
+func (p *AuditPolicy) needsConfig() bool {
+	return p.NoRootPrograms || p.ReadOnlyRoot || p.NoDebug
+}
+
+func auditConfig(cfg *vcfg.VCFG, policy *AuditPolicy) []AuditResult {
+
+	var results []AuditResult
+
+	programName := func(i int) string {
+		p := cfg.Programs[i]
+		bin := p.Binary
+		if bin == "" {
+			if fields := strings.Fields(p.Args); len(fields) > 0 {
+				bin = fields[0]
+			}
+		}
+		if bin == "" {
+			return fmt.Sprintf("program %d", i)
+		}
+		return fmt.Sprintf("program %d (%s)", i, bin)
+	}
+
+	if policy.NoRootPrograms {
+		var offenders []string
+		for i, p := range cfg.Programs {
+			// programs without a privilege run as root by default
+			if p.Privilege == "" || p.Privilege == vcfg.RootPrivilege {
+				offenders = append(offenders, programName(i))
+			}
+		}
+		res := AuditResult{Rule: AuditNoRootPrograms, Passed: len(offenders) == 0}
+		if res.Passed {
+			res.Detail = fmt.Sprintf("%d program(s) checked", len(cfg.Programs))
+		} else {
+			res.Detail = "runs as root: " + strings.Join(offenders, ", ")
+		}
+		results = append(results, res)
+	}
+
+	if policy.ReadOnlyRoot {
+		// squashfs is always mounted read-only, and ext only if the
+		// kernel args ask for it
+		fs := cfg.System.Filesystem
+		if fs == "" {
+			fs = "ext"
+		}
+		ro := fs == vcfg.SquashFS
+		for _, arg := range strings.Fields(cfg.System.KernelArgs) {
+			if arg == "ro" {
+				ro = true
+			}
+		}
+		mode := "rw"
+		if ro {
+			mode = "ro"
+		}
+		results = append(results, AuditResult{
+			Rule:   AuditReadOnlyRoot,
+			Passed: ro,
+			Detail: fmt.Sprintf("%s root mounted %s", fs, mode),
+		})
+	}
+
+	if policy.NoDebug {
+		var offenders []string
+		for i, p := range cfg.Programs {
+			if p.Strace {
+				offenders = append(offenders, programName(i)+" uses strace")
+			}
+		}
+		for i, nic := range cfg.Networks {
+			if nic.TCPDUMP {
+				offenders = append(offenders, fmt.Sprintf("network %d uses tcpdump", i))
+			}
+		}
+		res := AuditResult{Rule: AuditNoDebug, Passed: len(offenders) == 0}
+		if !res.Passed {
+			res.Detail = strings.Join(offenders, ", ")
+		}
+		results = append(results, res)
+	}
+
+	return results
+}
+
+func auditFiles(iio *vdecompiler.IO, policy *AuditPolicy) ([]AuditResult, error) {
+
+	var results []AuditResult
+
+	exists := func(fpath string) (bool, error) {
+		_, err := iio.ResolvePathToInodeNo(fpath)
+		if errors.Is(err, vdecompiler.ErrFileNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("resolving %s: %w", fpath, err)
+		}
+		return true, nil
+	}
+
+	for _, fpath := range policy.RequiredFiles {
+		ok, err := exists(fpath)
+		if err != nil {
+			return nil, err
+		}
+		res := AuditResult{Rule: AuditRequiredFiles, Passed: ok, Detail: fpath + " is present"}
+		if !ok {
+			res.Detail = fpath + " is missing"
+		}
+		results = append(results, res)
+	}
+
+	for _, fpath := range policy.ForbiddenFiles {
+		ok, err := exists(fpath)
+		if err != nil {
+			return nil, err
+		}
+		res := AuditResult{Rule: AuditForbiddenFiles, Passed: !ok, Detail: fpath + " is absent"}
+		if ok {
+			res.Detail = fpath + " is present"
+		}
+		results = append(results, res)
+	}
+
+	return results, nil
+}
+
+// AuditImage checks vorteilImage against every rule set in policy. Rules
+// about programs and settings are checked against the VCFG stored on the
+// disk, and rules about files against its file-system. A rule failing isn't
+// an error: check the report's Failed count.
+func AuditImage(vorteilImage *vdecompiler.IO, policy *AuditPolicy) (AuditReport, error) {
+
+	var report AuditReport
+
+	if policy.needsConfig() {
+		cfg, err := vorteilImage.VCFG()
+		if err != nil {
+			return report, err
+		}
+		report.Results = append(report.Results, auditConfig(cfg, policy)...)
+	}
+
+	if policy.EncryptedRoot {
+		encrypted, err := vorteilImage.Encrypted()
+		if err != nil {
+			return report, err
+		}
+		res := AuditResult{Rule: AuditEncryptedRoot, Passed: encrypted, Detail: "root partition is encrypted"}
+		if !encrypted {
+			res.Detail = "root partition is not encrypted"
+		}
+		report.Results = append(report.Results, res)
+	}
+
+	results, err := auditFiles(vorteilImage, policy)
+	if err != nil {
+		return report, err
+	}
+	report.Results = append(report.Results, results...)
+
+	return report, nil
+}
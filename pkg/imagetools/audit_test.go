@@ -0,0 +1,127 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+)
+
+func TestLoadAuditPolicy(t *testing.T) {
+
+	policy, err := LoadAuditPolicy([]byte(`
+no-root-programs: true
+required-files:
+  - /app
+forbidden-files: [/bin/sh]
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !policy.NoRootPrograms || len(policy.RequiredFiles) != 1 || len(policy.ForbiddenFiles) != 1 {
+		t.Fatalf("policy loaded incorrectly: %+v", policy)
+	}
+
+	_, err = LoadAuditPolicy([]byte(`{"no-debug": true}`))
+	if err != nil {
+		t.Fatalf("unexpected error loading json: %v", err)
+	}
+
+	_, err = LoadAuditPolicy([]byte("no-root-program: true\n"))
+	if err == nil {
+		t.Fatalf("expected an error for an unknown rule")
+	}
+}
+
+func TestAuditConfig(t *testing.T) {
+
+	cfg := &vcfg.VCFG{
+		Programs: []vcfg.Program{
+			{Binary: "/app", Privilege: vcfg.UserPrivilege},
+			{Args: "/helper --flag", Strace: true},
+		},
+		Networks: []vcfg.NetworkInterface{{TCPDUMP: true}},
+	}
+
+	results := auditConfig(cfg, &AuditPolicy{
+		NoRootPrograms: true,
+		ReadOnlyRoot:   true,
+		NoDebug:        true,
+	})
+
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+
+	for _, res := range results {
+		if res.Passed {
+			t.Fatalf("expected rule '%s' to fail", res.Rule)
+		}
+	}
+
+	if results[0].Detail != "runs as root: program 1 (/helper)" {
+		t.Fatalf("unexpected detail: %s", results[0].Detail)
+	}
+
+	cfg.Programs = cfg.Programs[:1]
+	cfg.Networks = nil
+	cfg.System.KernelArgs = "ro"
+
+	for _, res := range auditConfig(cfg, &AuditPolicy{
+		NoRootPrograms: true,
+		ReadOnlyRoot:   true,
+		NoDebug:        true,
+	}) {
+		if !res.Passed {
+			t.Fatalf("expected rule '%s' to pass: %s", res.Rule, res.Detail)
+		}
+	}
+}
+
+func TestAuditImageFiles(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "imagetools")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	iio, err := vdecompiler.Open(buildResizeTestImage(t, dir, ext.FormatExt2))
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	defer iio.Close()
+
+	report, err := AuditImage(iio, &AuditPolicy{
+		RequiredFiles:  []string{"/data", "/missing"},
+		ForbiddenFiles: []string{"/data", "/missing/child"},
+		EncryptedRoot:  true,
+	})
+	if err != nil {
+		t.Fatalf("failed to audit image: %v", err)
+	}
+
+	expect := []bool{false, true, false, false, true}
+	if len(report.Results) != len(expect) {
+		t.Fatalf("expected %d results, got %d", len(expect), len(report.Results))
+	}
+
+	for i, res := range report.Results {
+		if res.Passed != expect[i] {
+			t.Fatalf("rule '%s' (%s): passed = %v, expected %v", res.Rule, res.Detail, res.Passed, expect[i])
+		}
+	}
+
+	if report.Failed() != 3 {
+		t.Fatalf("expected 3 failures, got %d", report.Failed())
+	}
+}
@@ -24,7 +24,7 @@ func CatImageFile(vorteilImage *vdecompiler.IO, imageFilePath string, os bool) (
 		imageFilePath = strings.TrimPrefix(imageFilePath, "/")
 		rdr, err = vorteilImage.KernelFile(imageFilePath)
 	} else {
-		ino, err := vorteilImage.ResolvePathToInodeNo(imageFilePath)
+		ino, err := vorteilImage.ResolveTargetInodeNo(imageFilePath)
 		if err != nil {
 			return nil, err
 		}
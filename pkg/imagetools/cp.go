@@ -13,6 +13,7 @@ import (
 	"strings"
 
 	"github.com/vorteil/vorteil/pkg/vdecompiler"
+	"github.com/vorteil/vorteil/pkg/vio"
 )
 
 // CopyImageFile copies a the file at imageFilePath from inside the vorteilImage to destFilePath in the system
@@ -40,22 +41,68 @@ func CopyImageFile(vorteilImage *vdecompiler.IO, imageFilePath string, destFileP
 		return err
 	}
 
+	inode, err := vorteilImage.ResolveInode(ino)
+	if err != nil {
+		return err
+	}
+
+	// a single file is replaced atomically, but the files of a directory
+	// are written in place
+	if vdecompiler.InodeIsRegularFile(inode) {
+		rdr, err := vorteilImage.InodeReader(inode)
+		if err != nil {
+			return err
+		}
+		return copyToFile(destFilePath, io.LimitReader(rdr, int64(vdecompiler.InodeSize(inode))))
+	}
+
 	return copyImageFileRecursive(vorteilImage, ino, filepath.Base(imageFilePath), destFilePath)
 }
 
+// copyToFile copies everything from r into a new file at dst, which only
+// appears once it's complete.
+func copyToFile(dst string, r io.Reader) error {
+
+	f, err := vio.AtomicCreate(dst, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+
+	return f.Commit()
+}
+
+// writeToFile copies everything from r into a new file at dst, in place.
+func writeToFile(dst string, r io.Reader) error {
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
 func copyImageFileFromVPartition(vorteilImage *vdecompiler.IO, imageFilePath string, destFilePath string) error {
 	var err error
 	var r io.Reader
-	var f *os.File
 	if imageFilePath != "" && imageFilePath != "/" && imageFilePath != "." {
 		// single file
 		imageFilePath = strings.TrimPrefix(imageFilePath, "/")
-		r, err := vorteilImage.KernelFile(imageFilePath)
+		r, err = vorteilImage.KernelFile(imageFilePath)
 		if err == nil {
-			if f, err := os.Create(destFilePath); err == nil {
-				defer f.Close()
-				_, err = io.Copy(f, r)
-			}
+			err = copyToFile(destFilePath, r)
 		}
 	} else {
 		// entire folder
@@ -75,18 +122,7 @@ func copyImageFileFromVPartition(vorteilImage *vdecompiler.IO, imageFilePath str
 				break
 			}
 
-			f, err = os.Create(filepath.Join(destFilePath, kf.Name))
-			if err != nil {
-				break
-			}
-			defer f.Close()
-
-			_, err = io.Copy(f, r)
-			if err != nil {
-				break
-			}
-
-			err = f.Close()
+			err = writeToFile(filepath.Join(destFilePath, kf.Name), r)
 			if err != nil {
 				break
 			}
@@ -96,7 +132,6 @@ func copyImageFileFromVPartition(vorteilImage *vdecompiler.IO, imageFilePath str
 }
 
 func copyImageFileRecursive(vorteilImage *vdecompiler.IO, ino int, rpath string, destFilePath string) error {
-	var f *os.File
 	var rdr io.Reader
 	var err error
 	var entries []*vdecompiler.DirectoryEntry
@@ -106,11 +141,8 @@ func copyImageFileRecursive(vorteilImage *vdecompiler.IO, ino int, rpath string,
 	}
 
 	if vdecompiler.InodeIsRegularFile(inode) {
-		if f, err = os.Create(destFilePath); err == nil {
-			defer f.Close()
-			if rdr, err = vorteilImage.InodeReader(inode); err == nil {
-				_, err = io.CopyN(f, rdr, int64(vdecompiler.InodeSize(inode)))
-			}
+		if rdr, err = vorteilImage.InodeReader(inode); err == nil {
+			err = writeToFile(destFilePath, io.LimitReader(rdr, int64(vdecompiler.InodeSize(inode))))
 		}
 		goto DONE
 	}
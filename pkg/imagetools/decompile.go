@@ -6,20 +6,37 @@ package imagetools
  */
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/vorteil/vorteil/pkg/ext"
 	"github.com/vorteil/vorteil/pkg/vdecompiler"
 )
 
+// DecompileOptions control which files a decompile copies, and how.
+type DecompileOptions struct {
+	SkipNotTouched bool      // only copy files that were accessed while the image ran
+	AccessedSince  time.Time // if set, only copy files last accessed at or after this time
+	Hardlinks      bool      // recreate files sharing an inode as hardlinks instead of copies
+	PreserveOwner  bool      // give files the owner and group they have on the image, which needs root
+	Resume         bool      // keep what an interrupted decompile already extracted, instead of failing on it
+}
+
 // DecompileReport : Info on the results of a Decompile Operation
 type DecompileReport struct {
 	SkipNotTouched bool
 	ImageFiles     []DecompiledFile
+
+	opts       DecompileOptions
+	hardlinked map[int]bool
+	linked     map[int]string
+	only       map[string]bool // if set, the only files that are copied
 }
 
 // DecompiledFile holds the path of the decompiled file, and its results
@@ -32,7 +49,7 @@ type DecompiledFile struct {
 type CopyResult int
 
 const (
-	// SkippedNotTouched : File was skipped because it was not touched during runtime
+	// SkippedNotTouched : File was skipped because it was not touched during runtime, or not since AccessedSince
 	SkippedNotTouched CopyResult = 0
 	// SkippedAbnormalFile : File was skipped because it was not a dir, file or symlink
 	SkippedAbnormalFile = 1
@@ -42,9 +59,15 @@ const (
 	CopiedSymlink = 3
 	// CopiedMkDir : File was a dir, and was reconstructed during decompile
 	CopiedMkDir = 4
+	// CopiedHardlink : File was a hardlink to an already copied file, and was linked to it during decompile
+	CopiedHardlink = 5
+	// SkippedNotKept : File was skipped because it isn't one of the files being kept by a minimize
+	SkippedNotKept = 6
+	// SkippedExisting : File already existed with the same size and digest, and was kept by a resumed decompile
+	SkippedExisting = 7
 )
 
-func createSymlinkCallback(vorteilImage *vdecompiler.IO, inode *ext.Inode, dpath string) func() error {
+func createSymlinkCallback(vorteilImage *vdecompiler.IO, inode *ext.Inode, dpath string, preserveOwner, resume bool) func() error {
 	return func() error {
 		rdr, err := vorteilImage.InodeReader(inode)
 		if err != nil {
@@ -55,24 +78,50 @@ func createSymlinkCallback(vorteilImage *vdecompiler.IO, inode *ext.Inode, dpath
 			return err
 		}
 
+		if resume {
+			if target, err := os.Readlink(dpath); err == nil && target == string(data) {
+				return nil
+			}
+			err = os.Remove(dpath)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
 		err = os.Symlink(string(string(data)), dpath)
 		if err != nil {
 			return err
 		}
+		if preserveOwner {
+			return os.Lchown(dpath, vdecompiler.InodeUID(inode), vdecompiler.InodeGID(inode))
+		}
 		return nil
 	}
 }
 
-func copyInodeToRegularFile(vorteilImage *vdecompiler.IO, inode *ext.Inode, dpath string) error {
+// chownInode gives the file at dpath the owner and group of inode, if the
+// report preserves ownership.
+func (report *DecompileReport) chownInode(inode *ext.Inode, dpath string) error {
+	if !report.opts.PreserveOwner {
+		return nil
+	}
+	return os.Chown(dpath, vdecompiler.InodeUID(inode), vdecompiler.InodeGID(inode))
+}
+
+func copyInodeToRegularFile(vorteilImage *vdecompiler.IO, inode *ext.Inode, dpath string, overwrite bool) error {
 	var err error
 	var f *os.File
 	var rdr io.Reader
 
-	err = utilFileNotExists(dpath)
-	if err != nil {
-		return err
+	if !overwrite {
+		err = utilFileNotExists(dpath)
+		if err != nil {
+			return err
+		}
 	}
 
+	// entries of the decompiled tree are written in place: a resumed
+	// decompile replaces any that were left incomplete
 	f, err = os.Create(dpath)
 	if err != nil {
 		return err
@@ -85,7 +134,90 @@ func copyInodeToRegularFile(vorteilImage *vdecompiler.IO, inode *ext.Inode, dpat
 	}
 
 	_, err = io.CopyN(f, rdr, int64(vdecompiler.InodeSize(inode)))
-	return err
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func fileDigest(r io.Reader) ([]byte, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// existingFileMatches returns true if there's already a regular file at dpath
+// with the same size and digest as the contents of inode.
+func existingFileMatches(vorteilImage *vdecompiler.IO, inode *ext.Inode, dpath string) (bool, error) {
+
+	fi, err := os.Lstat(dpath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if !fi.Mode().IsRegular() || fi.Size() != int64(vdecompiler.InodeSize(inode)) {
+		return false, nil
+	}
+
+	f, err := os.Open(dpath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	existing, err := fileDigest(f)
+	if err != nil {
+		return false, err
+	}
+
+	rdr, err := vorteilImage.InodeReader(inode)
+	if err != nil {
+		return false, err
+	}
+
+	digest, err := fileDigest(io.LimitReader(rdr, fi.Size()))
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(existing, digest), nil
+}
+
+// existingHardlinkMatches returns true if dpath is already a hardlink to
+// first. Anything else at dpath is removed, so that the link can be made.
+func existingHardlinkMatches(first, dpath string) (bool, error) {
+
+	fi, err := os.Lstat(dpath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if ffi, err := os.Lstat(first); err == nil && os.SameFile(fi, ffi) {
+		return true, nil
+	}
+
+	return false, os.Remove(dpath)
+}
+
+// dirNotExists returns an error if something already exists at dpath, unless
+// the decompile is resuming and it's a directory.
+func (report *DecompileReport) dirNotExists(dpath string) error {
+	if report.opts.Resume {
+		if fi, err := os.Stat(dpath); err == nil && fi.IsDir() {
+			return nil
+		}
+	}
+	return utilFileNotExists(dpath)
 }
 
 func utilFileNotExists(fpath string) error {
@@ -99,6 +231,18 @@ func utilFileNotExists(fpath string) error {
 	return nil
 }
 
+// skipInode returns true if the inode was not accessed recently enough to be
+// copied.
+func (report *DecompileReport) skipInode(inode *ext.Inode) bool {
+	if report.opts.SkipNotTouched && inode.LastAccessTime == 0 {
+		return true
+	}
+	if !report.opts.AccessedSince.IsZero() && time.Unix(int64(inode.LastAccessTime), 0).Before(report.opts.AccessedSince) {
+		return true
+	}
+	return false
+}
+
 // decompileImageRecursive : Recursively loop through all image nodes and decompile them to the correct files
 func decompileImageRecursive(vorteilImage *vdecompiler.IO, report DecompileReport, symlinkCallbacks []func() error, ino int, rpath string, dpath string) (DecompileReport, []func() error, error) {
 	var entries []*vdecompiler.DirectoryEntry
@@ -108,7 +252,7 @@ func decompileImageRecursive(vorteilImage *vdecompiler.IO, report DecompileRepor
 		return report, nil, err
 	}
 
-	if report.SkipNotTouched && inode.LastAccessTime == 0 && !vdecompiler.InodeIsDirectory(inode) && rpath != "/" {
+	if report.skipInode(inode) && !vdecompiler.InodeIsDirectory(inode) && rpath != "/" {
 		report.ImageFiles = append(report.ImageFiles, DecompiledFile{
 			Path:   rpath,
 			Result: SkippedNotTouched,
@@ -116,8 +260,16 @@ func decompileImageRecursive(vorteilImage *vdecompiler.IO, report DecompileRepor
 		goto DONE
 	}
 
+	if report.only != nil && !report.only[rpath] && !vdecompiler.InodeIsDirectory(inode) {
+		report.ImageFiles = append(report.ImageFiles, DecompiledFile{
+			Path:   rpath,
+			Result: SkippedNotKept,
+		})
+		goto DONE
+	}
+
 	if vdecompiler.InodeIsSymlink(inode) {
-		symlinkCallbacks = append(symlinkCallbacks, createSymlinkCallback(vorteilImage, inode, dpath))
+		symlinkCallbacks = append(symlinkCallbacks, createSymlinkCallback(vorteilImage, inode, dpath, report.opts.PreserveOwner, report.opts.Resume))
 		report.ImageFiles = append(report.ImageFiles, DecompiledFile{
 			Path:   rpath,
 			Result: CopiedSymlink,
@@ -125,8 +277,55 @@ func decompileImageRecursive(vorteilImage *vdecompiler.IO, report DecompileRepor
 		goto DONE
 	}
 
+	if vdecompiler.InodeIsRegularFile(inode) && report.hardlinked[ino] {
+		if first, ok := report.linked[ino]; ok {
+			if report.opts.Resume {
+				var same bool
+				same, err = existingHardlinkMatches(first, dpath)
+				if err == nil && same {
+					report.ImageFiles = append(report.ImageFiles, DecompiledFile{
+						Path:   rpath,
+						Result: SkippedExisting,
+					})
+				}
+				if err != nil || same {
+					goto DONE
+				}
+			}
+			err = os.Link(first, dpath)
+			if err == nil {
+				report.ImageFiles = append(report.ImageFiles, DecompiledFile{
+					Path:   rpath,
+					Result: CopiedHardlink,
+				})
+			}
+			goto DONE
+		}
+		report.linked[ino] = dpath
+	}
+
 	if vdecompiler.InodeIsRegularFile(inode) {
-		err = copyInodeToRegularFile(vorteilImage, inode, dpath)
+		if report.opts.Resume {
+			var same bool
+			same, err = existingFileMatches(vorteilImage, inode, dpath)
+			if err == nil && same {
+				err = report.chownInode(inode, dpath)
+				if err == nil {
+					report.ImageFiles = append(report.ImageFiles, DecompiledFile{
+						Path:   rpath,
+						Result: SkippedExisting,
+					})
+				}
+				goto DONE
+			}
+			if err != nil {
+				goto DONE
+			}
+		}
+		err = copyInodeToRegularFile(vorteilImage, inode, dpath, report.opts.Resume)
+		if err == nil {
+			err = report.chownInode(inode, dpath)
+		}
 		if err == nil {
 			report.ImageFiles = append(report.ImageFiles, DecompiledFile{
 				Path:   rpath,
@@ -145,9 +344,12 @@ func decompileImageRecursive(vorteilImage *vdecompiler.IO, report DecompileRepor
 	}
 
 	// INODE IS DIR
-	err = utilFileNotExists(dpath)
+	err = report.dirNotExists(dpath)
 	if err == nil {
 		err = os.MkdirAll(dpath, 0777)
+		if err == nil {
+			err = report.chownInode(inode, dpath)
+		}
 		if err == nil {
 			report.ImageFiles = append(report.ImageFiles, DecompiledFile{
 				Path:   rpath,
@@ -177,11 +379,46 @@ DONE:
 
 // DecompileImage will copy the contents inside vorteilImage to the outputPath on the local filesystem.
 //	If skipNotTouched is set to true, only files that have been touched during runtime will be copied.
+//	If hardlinks is set to true, files sharing an inode are recreated as hardlinks instead of copies.
 //	Returns a DecompileReport Object that provides information of the result of each file.
-func DecompileImage(vorteilImage *vdecompiler.IO, outputPath string, skipNotTouched bool) (DecompileReport, error) {
+func DecompileImage(vorteilImage *vdecompiler.IO, outputPath string, skipNotTouched, hardlinks bool) (DecompileReport, error) {
+	return DecompileImageWithOptions(vorteilImage, outputPath, DecompileOptions{
+		SkipNotTouched: skipNotTouched,
+		Hardlinks:      hardlinks,
+	})
+}
+
+// DecompileImageWithOptions works like DecompileImage, but takes its options
+// from opts. Files accessed before opts.AccessedSince are skipped, according
+// to the clock of the VM that accessed them; directories are always
+// recreated. A resumed decompile keeps the files and directories that are
+// already at outputPath, so long as they match the image, and replaces those
+// that don't. Files are matched by size and SHA-256 digest.
+func DecompileImageWithOptions(vorteilImage *vdecompiler.IO, outputPath string, opts DecompileOptions) (DecompileReport, error) {
+	return decompileImage(vorteilImage, outputPath, opts, nil)
+}
+
+// decompileImage copies the files chosen by opts to outputPath, or only the
+// files in only if it isn't nil.
+func decompileImage(vorteilImage *vdecompiler.IO, outputPath string, opts DecompileOptions, only map[string]bool) (DecompileReport, error) {
+
 	report := DecompileReport{
+		SkipNotTouched: opts.SkipNotTouched,
 		ImageFiles:     make([]DecompiledFile, 0),
-		SkipNotTouched: skipNotTouched,
+		opts:           opts,
+		hardlinked:     make(map[int]bool),
+		linked:         make(map[int]string),
+		only:           only,
+	}
+
+	if report.opts.Hardlinks {
+		links, err := vorteilImage.Hardlinks()
+		if err != nil {
+			return report, err
+		}
+		for ino := range links {
+			report.hardlinked[ino] = true
+		}
 	}
 
 	fi, err := os.Stat(outputPath)
@@ -0,0 +1,104 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+)
+
+func TestDecompileResume(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "imagetools")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	iio, err := vdecompiler.Open(buildResizeTestImage(t, dir, ext.FormatExt4))
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	defer iio.Close()
+
+	out := filepath.Join(dir, "out")
+	data := filepath.Join(out, "data")
+
+	result := func(report DecompileReport, fpath string) CopyResult {
+		for _, f := range report.ImageFiles {
+			if f.Path == fpath {
+				return f.Result
+			}
+		}
+		t.Fatalf("%s is missing from the report", fpath)
+		return 0
+	}
+
+	_, err = DecompileImageWithOptions(iio, out, DecompileOptions{})
+	if err != nil {
+		t.Fatalf("failed to decompile: %v", err)
+	}
+
+	_, err = DecompileImageWithOptions(iio, out, DecompileOptions{})
+	if err == nil {
+		t.Fatalf("expected decompiling over existing files to fail without resuming")
+	}
+
+	// an interrupted copy leaves a partial file, which must be replaced
+	err = ioutil.WriteFile(data, testFileContents()[:100], 0644)
+	if err != nil {
+		t.Fatalf("failed to truncate file: %v", err)
+	}
+
+	report, err := DecompileImageWithOptions(iio, out, DecompileOptions{Resume: true})
+	if err != nil {
+		t.Fatalf("failed to resume decompile: %v", err)
+	}
+
+	if r := result(report, "/data"); r != CopiedRegularFile {
+		t.Fatalf("expected partial file to be copied again, got result %d", r)
+	}
+
+	got, err := ioutil.ReadFile(data)
+	if err != nil {
+		t.Fatalf("failed to read extracted file: %v", err)
+	}
+	if !bytes.Equal(got, testFileContents()) {
+		t.Fatalf("resumed file doesn't match the image")
+	}
+
+	report, err = DecompileImageWithOptions(iio, out, DecompileOptions{Resume: true})
+	if err != nil {
+		t.Fatalf("failed to resume decompile: %v", err)
+	}
+
+	if r := result(report, "/data"); r != SkippedExisting {
+		t.Fatalf("expected complete file to be skipped, got result %d", r)
+	}
+
+	// a file of the same size but different contents doesn't match
+	corrupt := append([]byte{}, testFileContents()...)
+	corrupt[0]++
+	err = ioutil.WriteFile(data, corrupt, 0644)
+	if err != nil {
+		t.Fatalf("failed to corrupt file: %v", err)
+	}
+
+	report, err = DecompileImageWithOptions(iio, out, DecompileOptions{Resume: true})
+	if err != nil {
+		t.Fatalf("failed to resume decompile: %v", err)
+	}
+
+	if r := result(report, "/data"); r != CopiedRegularFile {
+		t.Fatalf("expected file with a different digest to be copied again, got result %d", r)
+	}
+}
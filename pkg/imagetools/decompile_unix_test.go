@@ -0,0 +1,92 @@
+// +build linux darwin freebsd
+
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+)
+
+func TestDecompilePreserveOwner(t *testing.T) {
+
+	if os.Geteuid() != 0 {
+		t.Skip("preserving ownership needs root")
+	}
+
+	dir, err := ioutil.TempDir("", "imagetools")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := buildResizeTestImage(t, dir, ext.FormatExt4)
+
+	// give the file an owner with a uid too large for the lower 16 bits
+	iio, err := vdecompiler.OpenRW(path)
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	ino, err := iio.ResolvePathToInodeNo("/data")
+	if err != nil {
+		t.Fatalf("failed to resolve file: %v", err)
+	}
+	inode, err := iio.ResolveInode(ino)
+	if err != nil {
+		t.Fatalf("failed to resolve inode: %v", err)
+	}
+	inode.UID = 1000
+	inode.GID = 2000
+	binary.LittleEndian.PutUint16(inode.OSStuff[4:6], 1)
+	err = iio.WriteInode(ino, inode)
+	iio.Close()
+	if err != nil {
+		t.Fatalf("failed to write inode: %v", err)
+	}
+
+	iio, err = vdecompiler.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	defer iio.Close()
+
+	owner := func(fpath string) (uint32, uint32) {
+		fi, err := os.Lstat(fpath)
+		if err != nil {
+			t.Fatalf("failed to stat extracted file: %v", err)
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		return st.Uid, st.Gid
+	}
+
+	_, err = DecompileImageWithOptions(iio, filepath.Join(dir, "owned"), DecompileOptions{PreserveOwner: true})
+	if err != nil {
+		t.Fatalf("failed to decompile: %v", err)
+	}
+
+	uid, gid := owner(filepath.Join(dir, "owned", "data"))
+	if uid != 1<<16+1000 || gid != 2000 {
+		t.Fatalf("extracted file is owned by %d:%d, expected %d:%d", uid, gid, 1<<16+1000, 2000)
+	}
+
+	_, err = DecompileImageWithOptions(iio, filepath.Join(dir, "unowned"), DecompileOptions{})
+	if err != nil {
+		t.Fatalf("failed to decompile: %v", err)
+	}
+
+	uid, gid = owner(filepath.Join(dir, "unowned", "data"))
+	if int(uid) != os.Geteuid() || int(gid) != os.Getegid() {
+		t.Fatalf("expected extracted file to be owned by the current user without PreserveOwner, got %d:%d", uid, gid)
+	}
+}
@@ -23,11 +23,34 @@ type duImageInfo struct {
 	FileSize int
 }
 
+// DUOptions : Options for DUImage
+type DUOptions struct {
+	// CalcFreeSpace adds the free space of the file-system to the report.
+	CalcFreeSpace bool
+	// MaxDepth limits the report to entries this many levels below the path. Negative values mean no limit.
+	MaxDepth int
+	// All reports files as well as directories.
+	All bool
+	// Apparent measures files by their size instead of the blocks they occupy.
+	Apparent bool
+}
+
 // DUImageFile returns the disk usage calculations of a path (imageFilePath) in a vorteilImage.
 //	Disk usuage is recursive will be calculated at a depth set to maxDepth.
 func DUImageFile(vorteilImage *vdecompiler.IO, imageFilePath string, calcFreeSpace bool, maxDepth int, all bool) (DUImageReport, error) {
+	return DUImage(vorteilImage, imageFilePath, DUOptions{
+		CalcFreeSpace: calcFreeSpace,
+		MaxDepth:      maxDepth,
+		All:           all,
+	})
+}
+
+// DUImage returns the disk usage calculations of a path (imageFilePath) in a vorteilImage, with the
+// cumulative size of every directory below it.
+func DUImage(vorteilImage *vdecompiler.IO, imageFilePath string, opts DUOptions) (DUImageReport, error) {
 	var duOut DUImageReport
 	var depth = 0
+	var maxDepth = opts.MaxDepth
 
 	var recurse func(*ext.Inode, string) (int, error)
 	recurse = func(inode *ext.Inode, name string) (int, error) {
@@ -39,6 +62,9 @@ func DUImageFile(vorteilImage *vdecompiler.IO, imageFilePath string, calcFreeSpa
 
 		var size int
 		size = int(inode.Sectors) * ext.SectorSize
+		if opts.Apparent {
+			size = int(vdecompiler.InodeSize(inode))
+		}
 
 		if !vdecompiler.InodeIsDirectory(inode) {
 			return size, nil
@@ -63,7 +89,7 @@ func DUImageFile(vorteilImage *vdecompiler.IO, imageFilePath string, calcFreeSpa
 			if err != nil {
 				return 0, err
 			}
-			if all || vdecompiler.InodeIsDirectory(inode) {
+			if opts.All || vdecompiler.InodeIsDirectory(cinode) {
 				if (maxDepth >= 0 && depth <= maxDepth) || maxDepth < 0 {
 					duOut.ImageFiles = append(duOut.ImageFiles, duImageInfo{
 						FilePath: child,
@@ -97,10 +123,10 @@ func DUImageFile(vorteilImage *vdecompiler.IO, imageFilePath string, calcFreeSpa
 		FileSize: size,
 	})
 
-	if calcFreeSpace {
+	if opts.CalcFreeSpace {
 		sb, err := vorteilImage.Superblock(0)
 		if err == nil {
-			duOut.FreeSpace = int(sb.UnallocatedBlocks) * int(1024<<sb.BlockSize)
+			duOut.FreeSpace = int(sb.UnallocatedBlocksCount()) * int(1024<<sb.BlockSize)
 		}
 	}
 
@@ -8,6 +8,7 @@ package imagetools
 import (
 	"time"
 
+	"github.com/vorteil/vorteil/pkg/ext"
 	"github.com/vorteil/vorteil/pkg/vdecompiler"
 	"github.com/vorteil/vorteil/pkg/vimg"
 )
@@ -22,6 +23,7 @@ type FSFileReport struct {
 	BlocksAvaliable int
 	BlockGroups     int
 	MaxBlock        int
+	ReservedBlocks  int
 	InodesAllocated int
 	InodesAvaliable int
 	MaxInodes       int
@@ -46,11 +48,15 @@ func FSImageFile(vorteilImage *vdecompiler.IO) (FSFileReport, error) {
 	fsOut.FirstLBA = int(entry.FirstLBA)
 	fsOut.LastLBA = int(entry.LastLBA)
 	fsOut.Type = "ext2"
+	if sb.RequiredFeatures&ext.IncompatExtents != 0 {
+		fsOut.Type = "ext4"
+	}
 	fsOut.BlockSize = 1024 << int(sb.BlockSize)
-	fsOut.BlocksAllocated = int(sb.TotalBlocks - sb.UnallocatedBlocks)
-	fsOut.BlocksAvaliable = int(sb.TotalBlocks)
-	fsOut.BlockGroups = int((sb.TotalBlocks + sb.BlocksPerGroup - 1) / sb.BlocksPerGroup)
+	fsOut.BlocksAllocated = int(sb.Blocks() - sb.UnallocatedBlocksCount())
+	fsOut.BlocksAvaliable = int(sb.Blocks())
+	fsOut.BlockGroups = int((sb.Blocks() + int64(sb.BlocksPerGroup) - 1) / int64(sb.BlocksPerGroup))
 	fsOut.MaxBlock = int(sb.BlocksPerGroup)
+	fsOut.ReservedBlocks = int(sb.ReservedBlocksCount())
 	fsOut.InodesAllocated = int(sb.TotalInodes - sb.UnallocatedInodes)
 	fsOut.InodesAvaliable = int(sb.TotalInodes)
 	fsOut.MaxInodes = int(sb.InodesPerGroup)
@@ -32,7 +32,7 @@ func MDSumImageFile(vorteilImagePath string, imageFilePath string, seekOS bool)
 		imageFilePath = strings.TrimPrefix(imageFilePath, "/")
 		rdr, err = vorteilImage.KernelFile(imageFilePath)
 	} else {
-		ino, err := vorteilImage.ResolvePathToInodeNo(imageFilePath)
+		ino, err := vorteilImage.ResolveTargetInodeNo(imageFilePath)
 		if err != nil {
 			return md5sumOut, err
 		}
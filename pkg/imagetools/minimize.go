@@ -0,0 +1,163 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+)
+
+// Reasons a MinimizedFile is kept.
+const (
+	KeptTouched   = "touched"
+	KeptProgram   = "program"
+	KeptRequested = "requested"
+	KeptSymlink   = "symlink"
+)
+
+// MinimizedFile is a file in the file-system of an image being minimized.
+type MinimizedFile struct {
+	Path   string
+	Size   int64  // space the file takes on the file-system
+	Reason string // why the file is kept, empty if it's removed
+}
+
+// MinimizePlan lists the files a minimized copy of an image keeps and the
+// files it removes. Directories are always kept, so they aren't listed.
+type MinimizePlan struct {
+	Kept        []MinimizedFile
+	Removed     []MinimizedFile
+	Touched     int // number of files kept because they were touched
+	KeptSize    int64
+	RemovedSize int64
+
+	keep map[string]bool
+}
+
+// minimizeKeeps returns the paths of the files declared by cfg that must be
+// kept whether they were touched or not: the binary of every program.
+func minimizeKeeps(cfg *vcfg.VCFG) map[string]bool {
+
+	keeps := make(map[string]bool)
+	if cfg == nil {
+		return keeps
+	}
+
+	for _, p := range cfg.Programs {
+		if p.Binary == "" {
+			continue
+		}
+		bin := p.Binary
+		if !path.IsAbs(bin) {
+			bin = path.Join("/", p.Cwd, bin)
+		}
+		keeps[path.Clean(bin)] = true
+	}
+
+	return keeps
+}
+
+// requested returns true if fpath is one of paths, or inside one of them.
+func requested(fpath string, paths []string) bool {
+	for _, p := range paths {
+		p = path.Clean("/" + filepath.ToSlash(p))
+		if fpath == p || p == "/" || strings.HasPrefix(fpath, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (plan *MinimizePlan) walk(vorteilImage *vdecompiler.IO, ino int, rpath string, keeps map[string]bool, paths []string) error {
+
+	inode, err := vorteilImage.ResolveInode(ino)
+	if err != nil {
+		return err
+	}
+
+	if vdecompiler.InodeIsDirectory(inode) {
+		entries, err := vorteilImage.Readdir(inode)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.Name == "." || entry.Name == ".." {
+				continue
+			}
+			err = plan.walk(vorteilImage, entry.Inode, path.Join(rpath, entry.Name), keeps, paths)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	file := MinimizedFile{
+		Path: rpath,
+		Size: int64(inode.Sectors) * ext.SectorSize,
+	}
+
+	switch {
+	case vdecompiler.InodeIsSymlink(inode):
+		file.Reason = KeptSymlink
+	case inode.LastAccessTime != 0:
+		file.Reason = KeptTouched
+		plan.Touched++
+	case keeps[rpath]:
+		file.Reason = KeptProgram
+	case requested(rpath, paths):
+		file.Reason = KeptRequested
+	}
+
+	if file.Reason == "" {
+		plan.Removed = append(plan.Removed, file)
+		plan.RemovedSize += file.Size
+		return nil
+	}
+
+	plan.keep[rpath] = true
+	plan.Kept = append(plan.Kept, file)
+	plan.KeptSize += file.Size
+
+	return nil
+}
+
+// PlanMinimize decides which files of the image's file-system a minimized
+// copy of the image needs: every file touched while the image was running,
+// the binaries of the programs in cfg, and everything at or below the paths
+// in keep. Symlinks and directories are always kept. All other files are
+// removed.
+func PlanMinimize(vorteilImage *vdecompiler.IO, cfg *vcfg.VCFG, keep []string) (*MinimizePlan, error) {
+
+	plan := &MinimizePlan{
+		keep: make(map[string]bool),
+	}
+
+	ino, err := vorteilImage.ResolvePathToInodeNo("/")
+	if err != nil {
+		return nil, err
+	}
+
+	err = plan.walk(vorteilImage, ino, "/", minimizeKeeps(cfg), keep)
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// ExtractMinimized copies the directories of the image's file-system, and
+// the files plan keeps, to outputPath on the local file-system.
+func ExtractMinimized(vorteilImage *vdecompiler.IO, plan *MinimizePlan, outputPath string) (DecompileReport, error) {
+	return decompileImage(vorteilImage, outputPath, DecompileOptions{}, plan.keep)
+}
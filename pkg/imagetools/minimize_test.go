@@ -0,0 +1,126 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+)
+
+func TestMinimize(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "imagetools")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := buildResizeTestImage(t, dir, ext.FormatExt4)
+
+	plan := func(cfg *vcfg.VCFG, keep []string) *MinimizePlan {
+		iio, err := vdecompiler.Open(path)
+		if err != nil {
+			t.Fatalf("failed to open image: %v", err)
+		}
+		defer iio.Close()
+
+		plan, err := PlanMinimize(iio, cfg, keep)
+		if err != nil {
+			t.Fatalf("failed to plan minimize: %v", err)
+		}
+		return plan
+	}
+
+	reason := func(plan *MinimizePlan, fpath string) string {
+		for _, file := range plan.Kept {
+			if file.Path == fpath {
+				return file.Reason
+			}
+		}
+		return ""
+	}
+
+	p := plan(nil, nil)
+	if p.Touched != 0 || len(p.Kept) != 0 || len(p.Removed) != 1 || p.Removed[0].Path != "/data" {
+		t.Fatalf("expected only /data to be removed from an untouched image, got %+v", p)
+	}
+	if p.RemovedSize < int64(len(testFileContents())) {
+		t.Fatalf("removed size %d is smaller than the removed file", p.RemovedSize)
+	}
+
+	if r := reason(plan(nil, []string{"/"}), "/data"); r != KeptRequested {
+		t.Fatalf("expected /data to be kept because it was requested, got '%s'", r)
+	}
+
+	cfg := &vcfg.VCFG{Programs: []vcfg.Program{{Binary: "data", Cwd: "/"}}}
+	if r := reason(plan(cfg, nil), "/data"); r != KeptProgram {
+		t.Fatalf("expected /data to be kept as a program binary, got '%s'", r)
+	}
+
+	// untouched files aren't extracted
+	iio, err := vdecompiler.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	_, err = ExtractMinimized(iio, p, filepath.Join(dir, "untouched"))
+	iio.Close()
+	if err != nil {
+		t.Fatalf("failed to extract: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "untouched", "data")); !os.IsNotExist(err) {
+		t.Fatalf("expected untouched file not to be extracted: %v", err)
+	}
+
+	// touch the file
+	iio, err = vdecompiler.OpenRW(path)
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	ino, err := iio.ResolvePathToInodeNo("/data")
+	if err != nil {
+		t.Fatalf("failed to resolve file: %v", err)
+	}
+	inode, err := iio.ResolveInode(ino)
+	if err != nil {
+		t.Fatalf("failed to resolve inode: %v", err)
+	}
+	inode.LastAccessTime = 1600000000
+	err = iio.WriteInode(ino, inode)
+	iio.Close()
+	if err != nil {
+		t.Fatalf("failed to write inode: %v", err)
+	}
+
+	p = plan(nil, nil)
+	if p.Touched != 1 || len(p.Removed) != 0 || reason(p, "/data") != KeptTouched {
+		t.Fatalf("expected /data to be kept because it was touched, got %+v", p)
+	}
+
+	iio, err = vdecompiler.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	defer iio.Close()
+
+	_, err = ExtractMinimized(iio, p, filepath.Join(dir, "touched"))
+	if err != nil {
+		t.Fatalf("failed to extract: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "touched", "data"))
+	if err != nil {
+		t.Fatalf("failed to read extracted file: %v", err)
+	}
+	if len(data) != len(testFileContents()) {
+		t.Fatalf("extracted file has %d bytes, expected %d", len(data), len(testFileContents()))
+	}
+}
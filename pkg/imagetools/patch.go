@@ -0,0 +1,100 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+)
+
+// PatchImageFile overwrites the contents of the regular file at imageFilePath
+//	inside the raw image at vorteilImagePath with size bytes read from r.
+//	The file is patched in-place, so the new contents must fit within the blocks
+//	already allocated to it: the new file must be the same size or smaller than
+//	the old file, rounded up to the file-system block size. Anything requiring
+//	blocks to be allocated, or r ending early, returns an error without
+//	modifying the image.
+func PatchImageFile(vorteilImagePath string, imageFilePath string, r io.Reader, size int64) error {
+
+	vorteilImage, err := vdecompiler.OpenRW(vorteilImagePath)
+	if err != nil {
+		return err
+	}
+	defer vorteilImage.Close()
+
+	format, err := vorteilImage.ImageFormat()
+	if err != nil {
+		return err
+	}
+	if format != vdisk.RAWFormat {
+		return fmt.Errorf("patching is only supported for '%s' images, not '%s'", vdisk.RAWFormat, format)
+	}
+
+	ino, err := vorteilImage.ResolvePathToInodeNo(imageFilePath)
+	if err != nil {
+		return err
+	}
+
+	inode, err := vorteilImage.ResolveInode(ino)
+	if err != nil {
+		return err
+	}
+
+	if !vdecompiler.InodeIsRegularFile(inode) || vdecompiler.InodeIsSymlink(inode) {
+		return fmt.Errorf("\"%s\" is not a regular file", imageFilePath)
+	}
+
+	sb, err := vorteilImage.Superblock(0)
+	if err != nil {
+		return err
+	}
+	blockSize := int64(1024 << sb.BlockSize)
+
+	blocks, err := vorteilImage.InodeBlocks(inode)
+	if err != nil {
+		return err
+	}
+
+	needed := (size + blockSize - 1) / blockSize
+	if needed > int64(len(blocks)) {
+		return fmt.Errorf("new contents of \"%s\" need %d blocks but only %d are allocated: the file must be the same size or smaller (%d bytes at most)", imageFilePath, needed, len(blocks), int64(len(blocks))*blockSize)
+	}
+
+	for i := int64(0); i < needed; i++ {
+		if blocks[i] == 0 {
+			return fmt.Errorf("\"%s\" is sparse and patching it would require allocating blocks", imageFilePath)
+		}
+	}
+
+	// read everything before the first write, so that a short read can't
+	// leave the file half patched
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return fmt.Errorf("failed to read new contents of \"%s\": %w", imageFilePath, err)
+	}
+
+	for i := int64(0); i < needed; i++ {
+		end := (i + 1) * blockSize
+		if end > size {
+			end = size
+		}
+		err = vorteilImage.WriteBlock(blocks[i], data[i*blockSize:end])
+		if err != nil {
+			return err
+		}
+	}
+
+	inode.SizeLower = uint32(size)
+	inode.SizeUpper = uint32(size >> 32)
+	inode.ModificationTime = uint32(time.Now().Unix())
+
+	return vorteilImage.WriteInode(ino, inode)
+}
@@ -0,0 +1,107 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+)
+
+// readImageFile returns the contents of the file at path inside the image at
+// imagePath.
+func readImageFile(t *testing.T, imagePath, path string) []byte {
+
+	iio, err := vdecompiler.Open(imagePath)
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	defer iio.Close()
+
+	ino, err := iio.ResolvePathToInodeNo(path)
+	if err != nil {
+		t.Fatalf("failed to resolve '%s': %v", path, err)
+	}
+
+	inode, err := iio.ResolveInode(ino)
+	if err != nil {
+		t.Fatalf("failed to resolve inode: %v", err)
+	}
+
+	r, err := iio.InodeReader(inode)
+	if err != nil {
+		t.Fatalf("failed to read inode: %v", err)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read inode: %v", err)
+	}
+
+	return data
+}
+
+func TestPatchImageFile(t *testing.T) {
+
+	for _, format := range []ext.Format{ext.FormatExt2, ext.FormatExt4} {
+
+		dir, err := ioutil.TempDir("", "imagetools")
+		if err != nil {
+			t.Fatalf("failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		path := buildResizeTestImage(t, dir, format)
+
+		original, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read image: %v", err)
+		}
+
+		// new contents that need more blocks than the file has
+		big := make([]byte, len(testFileContents())+8192)
+		err = PatchImageFile(path, "/data", bytes.NewReader(big), int64(len(big)))
+		if err == nil {
+			t.Fatalf("expected an error patching a file with larger contents")
+		}
+
+		// a reader that ends early
+		short := io.LimitReader(bytes.NewReader(big), 5000)
+		err = PatchImageFile(path, "/data", short, 10000)
+		if err == nil {
+			t.Fatalf("expected an error patching a file from a short reader")
+		}
+
+		after, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read image: %v", err)
+		}
+		if !bytes.Equal(original, after) {
+			t.Fatalf("image was modified by failed patches")
+		}
+
+		contents := []byte("patched contents")
+		err = PatchImageFile(path, "/data", bytes.NewReader(contents), int64(len(contents)))
+		if err != nil {
+			t.Fatalf("failed to patch file: %v", err)
+		}
+
+		data := readImageFile(t, path, "/data")
+		if !bytes.Equal(data, contents) {
+			t.Fatalf("patched file contains %q, expected %q", data, contents)
+		}
+
+		err = PatchImageFile(path, "/", bytes.NewReader(contents), int64(len(contents)))
+		if err == nil {
+			t.Fatalf("expected an error patching a directory")
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+)
+
+// ReadBlocksReport describes the blocks copied by ReadBlocks.
+type ReadBlocksReport struct {
+	BlockSize int64
+	Start     int64
+	Count     int64
+	Size      int64
+}
+
+// ReadBlocks copies count file-system blocks of a vorteil image, starting at
+// block start, to destPath.
+func ReadBlocks(vorteilImage *vdecompiler.IO, start, count int64, destPath string) (*ReadBlocksReport, error) {
+
+	rdr, blockSize, err := vorteilImage.BlockRangeReader(start, count)
+	if err != nil {
+		return nil, err
+	}
+
+	err = copyToFile(destPath, rdr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReadBlocksReport{
+		BlockSize: blockSize,
+		Start:     start,
+		Count:     count,
+		Size:      rdr.Size(),
+	}, nil
+}
@@ -0,0 +1,478 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vimg"
+)
+
+// resizer holds everything needed to grow an image once it has been read and
+// checked, so that the image file can be extended before anything is written.
+type resizer struct {
+	f    *os.File
+	size int64
+
+	mbr     *vimg.ProtectiveMBR
+	hdr     vimg.GPTHeader
+	entries []*vimg.GPTEntry
+	root    *vimg.GPTEntry
+
+	sb             ext.Superblock
+	bgdt           []*ext.BlockGroupDescriptorTableEntry
+	partOffset     int64
+	blocksPerBGDT  int64
+	overhead       int64
+	oldBlocks      int64
+	oldGroups      int64
+	newBlocks      int64
+	newGroups      int64
+	oldBackupLBA   int64
+	newBackupLBA   int64
+	newEntriesLBA  int64
+	newLastUsable  int64
+	entriesSectors int64
+}
+
+// ResizeImage grows the raw image at path to size bytes in-place. The root
+// partition is extended to fill the new space, the secondary GPT is moved to
+// the new end of the disk, and the ext file-system on the root partition gets
+// the extra blocks, adding block groups as needed. Shrinking is not supported:
+// size must be larger than the image and a multiple of the file-system block
+// size.
+func ResizeImage(path string, size int64) error {
+
+	r, err := loadResizer(path, size)
+	if err != nil {
+		return err
+	}
+
+	r.f, err = os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer r.f.Close()
+
+	err = r.f.Truncate(size)
+	if err != nil {
+		return err
+	}
+
+	err = r.growFilesystem()
+	if err != nil {
+		return err
+	}
+
+	err = r.writePartitionTable()
+	if err != nil {
+		return err
+	}
+
+	return r.f.Close()
+}
+
+func loadResizer(path string, size int64) (*resizer, error) {
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("\"%s\" is not a regular file", path)
+	}
+
+	if size%ext.BlockSize != 0 {
+		return nil, fmt.Errorf("new size must be a multiple of the file-system block size (%d bytes)", ext.BlockSize)
+	}
+
+	if size <= fi.Size() {
+		return nil, fmt.Errorf("new size must be larger than the image's current size (%d bytes): shrinking is not supported", fi.Size())
+	}
+
+	iio, err := vdecompiler.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer iio.Close()
+
+	format, err := iio.ImageFormat()
+	if err != nil {
+		return nil, err
+	}
+	if format != vdisk.RAWFormat {
+		return nil, fmt.Errorf("resizing is only supported for '%s' images, not '%s'", vdisk.RAWFormat, format)
+	}
+
+	encrypted, err := iio.Encrypted()
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		return nil, errors.New("resizing is not supported for images with an encrypted root partition")
+	}
+
+	r := &resizer{size: size}
+
+	err = r.loadPartitionTable(iio)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.loadFilesystem(iio)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *resizer) loadPartitionTable(iio *vdecompiler.IO) error {
+
+	buf := make([]byte, vimg.SectorSize)
+	_, err := iio.ReadAt(buf, 0)
+	if err != nil {
+		return err
+	}
+
+	r.mbr = new(vimg.ProtectiveMBR)
+	err = binary.Read(bytes.NewReader(buf), binary.LittleEndian, r.mbr)
+	if err != nil {
+		return err
+	}
+
+	hdr, err := iio.GPTHeader()
+	if err != nil {
+		return err
+	}
+	r.hdr = *hdr
+
+	if r.hdr.HeaderSize < vimg.GPTHeaderSize || r.hdr.HeaderSize > vimg.SectorSize {
+		return fmt.Errorf("GPT header has an invalid size: %d", r.hdr.HeaderSize)
+	}
+
+	r.entries, err = iio.GPTEntries()
+	if err != nil {
+		return err
+	}
+
+	r.root, err = iio.GPTEntry(vdecompiler.UTF16toString(vimg.RootPartitionName))
+	if err != nil {
+		return err
+	}
+
+	for _, e := range r.entries {
+		if e.FirstLBA > r.root.FirstLBA {
+			return fmt.Errorf("root partition is not the last partition on the disk: '%s' follows it", vdecompiler.GPTEntryName(e))
+		}
+	}
+
+	r.entriesSectors = (int64(r.hdr.NoOfParts)*int64(r.hdr.SizePartEntry) + vimg.SectorSize - 1) / vimg.SectorSize
+	r.oldBackupLBA = int64(r.hdr.BackupLBA)
+	r.newBackupLBA = r.size/vimg.SectorSize - 1
+	r.newEntriesLBA = r.newBackupLBA - r.entriesSectors
+	r.newLastUsable = r.newEntriesLBA - 1
+	r.partOffset = int64(r.root.FirstLBA) * vimg.SectorSize
+
+	return nil
+}
+
+func (r *resizer) loadFilesystem(iio *vdecompiler.IO) error {
+
+	sb, err := iio.Superblock(0)
+	if err != nil {
+		return fmt.Errorf("root partition does not hold an ext file-system: %w", err)
+	}
+	r.sb = *sb
+
+	if 1024<<sb.BlockSize != ext.BlockSize {
+		return fmt.Errorf("resizing is only supported for file-systems with %d byte blocks, not %d", ext.BlockSize, 1024<<sb.BlockSize)
+	}
+
+	bpg := int64(sb.BlocksPerGroup)
+	if bpg != ext.BlockSize*8 {
+		return fmt.Errorf("resizing is only supported for file-systems with %d blocks per group, not %d", ext.BlockSize*8, bpg)
+	}
+
+	r.bgdt, err = iio.BGDT(0)
+	if err != nil {
+		return err
+	}
+
+	inodeSize := int64(ext.InodeSize)
+	if sb.VersionMajor >= 1 && sb.InodeSize != 0 {
+		inodeSize = int64(sb.InodeSize)
+	}
+	inodeTableBlocks := (int64(sb.InodesPerGroup)*inodeSize + ext.BlockSize - 1) / ext.BlockSize
+
+	// the superblock is block zero, followed by the BGDT, then the bitmaps
+	r.blocksPerBGDT = int64(r.bgdt[0].BlockBitmapBlockAddr) - 1
+	r.overhead = int64(r.bgdt[0].InodeTableBlockAddr) + inodeTableBlocks
+
+	r.oldBlocks = sb.Blocks()
+	r.oldGroups = (r.oldBlocks + bpg - 1) / bpg
+
+	r.newBlocks = (r.newLastUsable - int64(r.root.FirstLBA) + 1) * vimg.SectorSize / ext.BlockSize
+	r.newGroups = (r.newBlocks + bpg - 1) / bpg
+
+	// a final block group too small to contain its own metadata is left off
+	if x := r.newBlocks % bpg; x > 0 && x < r.overhead {
+		r.newGroups--
+		r.newBlocks = r.newGroups * bpg
+	}
+
+	if r.newBlocks <= r.oldBlocks {
+		return fmt.Errorf("new size is too small to add any blocks to the file-system")
+	}
+
+	maxGroups := r.blocksPerBGDT * ext.BlockSize / int64(sb.GroupDescriptorSize())
+	if r.newGroups > maxGroups {
+		return fmt.Errorf("file-system cannot grow beyond %d block groups (%d bytes)", maxGroups, maxGroups*bpg*ext.BlockSize)
+	}
+
+	return nil
+}
+
+func (r *resizer) blockOffset(block int64) int64 {
+	return r.partOffset + block*ext.BlockSize
+}
+
+func (r *resizer) growFilesystem() error {
+
+	bpg := int64(r.sb.BlocksPerGroup)
+	ipg := int64(r.sb.InodesPerGroup)
+
+	// the old secondary GPT header is now inside the root partition
+	if r.oldBackupLBA > int64(r.hdr.CurrentLBA) {
+		_, err := r.f.WriteAt(make([]byte, vimg.SectorSize), r.oldBackupLBA*vimg.SectorSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	table := make([]byte, r.blocksPerBGDT*ext.BlockSize)
+	_, err := r.f.ReadAt(table, r.blockOffset(1))
+	if err != nil {
+		return err
+	}
+
+	var addedBlocks, addedInodes int64
+
+	// free up the blocks the last old group gains, if it was a partial group
+	last := r.oldGroups - 1
+	end := r.newBlocks
+	if end > (last+1)*bpg {
+		end = (last + 1) * bpg
+	}
+	if end > r.oldBlocks {
+		bitmap := make([]byte, ext.BlockSize)
+		off := r.blockOffset(int64(r.bgdt[last].BlockBitmapBlockAddr))
+		_, err = r.f.ReadAt(bitmap, off)
+		if err != nil {
+			return err
+		}
+
+		for b := r.oldBlocks - last*bpg; b < end-last*bpg; b++ {
+			bitmap[b/8] &^= 1 << (b % 8)
+		}
+
+		_, err = r.f.WriteAt(bitmap, off)
+		if err != nil {
+			return err
+		}
+
+		bgdte := *r.bgdt[last]
+		bgdte.UnallocatedBlocks += uint16(end - r.oldBlocks)
+		r.putDescriptor(table, last, &bgdte)
+		addedBlocks += end - r.oldBlocks
+	}
+
+	for g := r.oldGroups; g < r.newGroups; g++ {
+		free, err := r.writeGroup(g)
+		if err != nil {
+			return err
+		}
+
+		base := g * bpg
+		r.putDescriptor(table, g, &ext.BlockGroupDescriptorTableEntry{
+			BlockBitmapBlockAddr: uint32(base + int64(r.bgdt[0].BlockBitmapBlockAddr)),
+			InodeBitmapBlockAddr: uint32(base + int64(r.bgdt[0].InodeBitmapBlockAddr)),
+			InodeTableBlockAddr:  uint32(base + int64(r.bgdt[0].InodeTableBlockAddr)),
+			UnallocatedBlocks:    uint16(free),
+			UnallocatedInodes:    uint16(ipg),
+		})
+		addedBlocks += free
+		addedInodes += ipg
+	}
+
+	sb := r.sb
+	sb.TotalBlocks = uint32(r.newBlocks)
+	sb.TotalInodes += uint32(addedInodes)
+	sb.UnallocatedInodes += uint32(addedInodes)
+	unallocated := r.sb.UnallocatedBlocksCount() + addedBlocks
+	sb.UnallocatedBlocks = uint32(unallocated)
+	if sb.RequiredFeatures&ext.Incompat64Bit != 0 {
+		sb.TotalBlocksHi = uint32(r.newBlocks >> 32)
+		sb.UnallocatedBlocksHi = uint32(unallocated >> 32)
+	}
+
+	for g := int64(0); g < r.newGroups; g++ {
+		off := r.blockOffset(g * bpg)
+		if g == 0 {
+			off += ext.SuperblockOffset
+		}
+
+		sb.SuperblockNumber = uint32(g * bpg)
+		buf := new(bytes.Buffer)
+		_ = binary.Write(buf, binary.LittleEndian, &sb)
+		_, err = r.f.WriteAt(buf.Bytes(), off)
+		if err != nil {
+			return err
+		}
+
+		_, err = r.f.WriteAt(table, r.blockOffset(g*bpg+1))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *resizer) putDescriptor(table []byte, g int64, bgdte *ext.BlockGroupDescriptorTableEntry) {
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, bgdte)
+	copy(table[g*int64(r.sb.GroupDescriptorSize()):], buf.Bytes())
+}
+
+// writeGroup writes the bitmaps and an empty inode table for a new block
+// group g, and returns the number of free blocks in it. Its superblock and
+// BGDT are written along with those of every other group.
+func (r *resizer) writeGroup(g int64) (int64, error) {
+
+	bpg := int64(r.sb.BlocksPerGroup)
+	ipg := int64(r.sb.InodesPerGroup)
+	base := g * bpg
+
+	blocks := r.newBlocks - base
+	if blocks > bpg {
+		blocks = bpg
+	}
+
+	bitmap := make([]byte, ext.BlockSize)
+	for b := int64(0); b < ext.BlockSize*8; b++ {
+		if b < r.overhead || b >= blocks {
+			bitmap[b/8] |= 1 << (b % 8)
+		}
+	}
+
+	_, err := r.f.WriteAt(bitmap, r.blockOffset(base+int64(r.bgdt[0].BlockBitmapBlockAddr)))
+	if err != nil {
+		return 0, err
+	}
+
+	bitmap = bytes.Repeat([]byte{0xFF}, ext.BlockSize)
+	for i := int64(0); i < ipg; i++ {
+		bitmap[i/8] &^= 1 << (i % 8)
+	}
+
+	_, err = r.f.WriteAt(bitmap, r.blockOffset(base+int64(r.bgdt[0].InodeBitmapBlockAddr)))
+	if err != nil {
+		return 0, err
+	}
+
+	zeroes := make([]byte, ext.BlockSize)
+	for b := base + int64(r.bgdt[0].InodeTableBlockAddr); b < base+r.overhead; b++ {
+		_, err = r.f.WriteAt(zeroes, r.blockOffset(b))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return blocks - r.overhead, nil
+}
+
+func (r *resizer) writePartitionTable() error {
+
+	r.root.LastLBA = uint64(r.newLastUsable)
+
+	buf := new(bytes.Buffer)
+	for _, e := range r.entries {
+		_ = binary.Write(buf, binary.LittleEndian, e)
+	}
+	entries := make([]byte, r.entriesSectors*vimg.SectorSize)
+	copy(entries, buf.Bytes())
+	crcParts := crc32.ChecksumIEEE(buf.Bytes())
+
+	_, err := r.f.WriteAt(entries, r.newEntriesLBA*vimg.SectorSize)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.f.WriteAt(entries, int64(r.hdr.StartLBAParts)*vimg.SectorSize)
+	if err != nil {
+		return err
+	}
+
+	secondary := r.hdr
+	secondary.CurrentLBA = uint64(r.newBackupLBA)
+	secondary.BackupLBA = r.hdr.CurrentLBA
+	secondary.LastUsableLBA = uint64(r.newLastUsable)
+	secondary.StartLBAParts = uint64(r.newEntriesLBA)
+	secondary.CRCParts = crcParts
+
+	err = r.writeGPTHeader(&secondary)
+	if err != nil {
+		return err
+	}
+
+	primary := r.hdr
+	primary.BackupLBA = uint64(r.newBackupLBA)
+	primary.LastUsableLBA = uint64(r.newLastUsable)
+	primary.CRCParts = crcParts
+
+	err = r.writeGPTHeader(&primary)
+	if err != nil {
+		return err
+	}
+
+	if r.mbr.PartitionType != 0xEE {
+		return nil
+	}
+
+	sectors := r.size/vimg.SectorSize - 1
+	if sectors > 0xFFFFFFFF {
+		sectors = 0xFFFFFFFF
+	}
+	r.mbr.TotalSectors = uint32(sectors)
+
+	buf = new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, r.mbr)
+	_, err = r.f.WriteAt(buf.Bytes(), 0)
+	return err
+}
+
+func (r *resizer) writeGPTHeader(hdr *vimg.GPTHeader) error {
+
+	hdr.CRC = 0
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, hdr)
+	hdr.CRC = crc32.ChecksumIEEE(buf.Bytes()[:hdr.HeaderSize])
+
+	buf.Reset()
+	_ = binary.Write(buf, binary.LittleEndian, hdr)
+	_, err := r.f.WriteAt(buf.Bytes(), int64(hdr.CurrentLBA)*vimg.SectorSize)
+	return err
+}
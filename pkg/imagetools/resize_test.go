@@ -0,0 +1,360 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+const (
+	testRootFirstLBA = 2048
+	testRootSize     = 8 << 20
+)
+
+func testFileContents() []byte {
+	data := make([]byte, 300000)
+	for i := range data {
+		data[i] = byte(i*7 + i>>12)
+	}
+	return data
+}
+
+func testGPTHeaderBytes(hdr *vimg.GPTHeader) []byte {
+	hdr.CRC = 0
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, hdr)
+	hdr.CRC = crc32.ChecksumIEEE(buf.Bytes()[:vimg.GPTHeaderSize])
+	buf.Reset()
+	_ = binary.Write(buf, binary.LittleEndian, hdr)
+	return buf.Bytes()
+}
+
+// buildResizeTestImage writes a GPT disk with a single root partition holding
+// an ext file-system in the given format, laid out the way vimg lays out
+// Vorteil disks.
+func buildResizeTestImage(t *testing.T, dir string, format ext.Format) string {
+
+	src := filepath.Join(dir, "src")
+	err := os.MkdirAll(src, 0755)
+	if err != nil {
+		t.Fatalf("failed to create source dir: %v", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(src, "data"), testFileContents(), 0644)
+	if err != nil {
+		t.Fatalf("failed to write source file: %v", err)
+	}
+
+	tree, err := vio.FileTreeFromDirectory(src)
+	if err != nil {
+		t.Fatalf("failed to load file tree: %v", err)
+	}
+	defer tree.Close()
+
+	fs := ext.NewCompiler(&ext.CompilerArgs{
+		FileTree: tree,
+		Logger:   &elog.CLI{},
+		Format:   format,
+	})
+
+	ctx := context.Background()
+	err = fs.Commit(ctx)
+	if err != nil {
+		t.Fatalf("failed to commit file-system: %v", err)
+	}
+
+	err = fs.Precompile(ctx, testRootSize)
+	if err != nil {
+		t.Fatalf("failed to precompile file-system: %v", err)
+	}
+
+	fsPath := filepath.Join(dir, "fs.img")
+	f, err := os.Create(fsPath)
+	if err != nil {
+		t.Fatalf("failed to create file-system image: %v", err)
+	}
+
+	err = fs.Compile(ctx, f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("failed to compile file-system: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(fsPath)
+	if err != nil {
+		t.Fatalf("failed to read file-system image: %v", err)
+	}
+
+	lastUsable := int64(testRootFirstLBA + testRootSize/vimg.SectorSize - 1)
+	entriesLBA := lastUsable + 1
+	backupLBA := entriesLBA + vimg.GPTEntriesSectors
+	size := (backupLBA + 1) * vimg.SectorSize
+
+	entry := &vimg.GPTEntry{
+		FirstLBA: testRootFirstLBA,
+		LastLBA:  uint64(lastUsable),
+	}
+	copy(entry.Name[:], vimg.RootPartitionName)
+
+	entries := make([]byte, vimg.GPTEntriesSectors*vimg.SectorSize)
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, entry)
+	copy(entries, buf.Bytes())
+
+	primary := &vimg.GPTHeader{
+		Signature:      vimg.GPTSignature,
+		HeaderSize:     vimg.GPTHeaderSize,
+		CurrentLBA:     vimg.PrimaryGPTHeaderLBA,
+		BackupLBA:      uint64(backupLBA),
+		FirstUsableLBA: vimg.P0FirstLBA,
+		LastUsableLBA:  uint64(lastUsable),
+		StartLBAParts:  vimg.PrimaryGPTEntriesLBA,
+		NoOfParts:      vimg.MaximumGPTEntries,
+		SizePartEntry:  vimg.GPTEntrySize,
+		CRCParts:       crc32.ChecksumIEEE(entries),
+	}
+	secondary := *primary
+	secondary.CurrentLBA = uint64(backupLBA)
+	secondary.BackupLBA = vimg.PrimaryGPTHeaderLBA
+	secondary.StartLBAParts = uint64(entriesLBA)
+
+	disk := make([]byte, size)
+	copy(disk[vimg.PrimaryGPTHeaderOffset:], testGPTHeaderBytes(primary))
+	copy(disk[vimg.PrimaryGPTEntriesOffset:], entries)
+	copy(disk[testRootFirstLBA*vimg.SectorSize:], data)
+	copy(disk[entriesLBA*vimg.SectorSize:], entries)
+	copy(disk[backupLBA*vimg.SectorSize:], testGPTHeaderBytes(&secondary))
+
+	path := filepath.Join(dir, "disk.raw")
+	err = ioutil.WriteFile(path, disk, 0644)
+	if err != nil {
+		t.Fatalf("failed to write image: %v", err)
+	}
+
+	return path
+}
+
+func checkResizedGPT(t *testing.T, iio *vdecompiler.IO, size int64) {
+
+	hdr, err := iio.GPTHeader()
+	if err != nil {
+		t.Fatalf("failed to read GPT header: %v", err)
+	}
+
+	if hdr.BackupLBA != uint64(size/vimg.SectorSize-1) {
+		t.Fatalf("secondary GPT header at LBA %d, expected %d", hdr.BackupLBA, size/vimg.SectorSize-1)
+	}
+
+	buf := make([]byte, vimg.SectorSize)
+	_, err = iio.ReadAt(buf, int64(hdr.BackupLBA)*vimg.SectorSize)
+	if err != nil {
+		t.Fatalf("failed to read secondary GPT header: %v", err)
+	}
+
+	secondary := new(vimg.GPTHeader)
+	_ = binary.Read(bytes.NewReader(buf), binary.LittleEndian, secondary)
+
+	for _, h := range []*vimg.GPTHeader{hdr, secondary} {
+		x := *h
+		crc := x.CRC
+		if testGPTHeaderBytes(&x); x.CRC != crc {
+			t.Fatalf("GPT header at LBA %d has a bad CRC", h.CurrentLBA)
+		}
+		if h.LastUsableLBA != secondary.StartLBAParts-1 {
+			t.Fatalf("GPT header at LBA %d has last usable LBA %d, expected %d", h.CurrentLBA, h.LastUsableLBA, secondary.StartLBAParts-1)
+		}
+	}
+
+	entries := make([]byte, vimg.GPTEntriesSectors*vimg.SectorSize)
+	_, err = iio.ReadAt(entries, int64(secondary.StartLBAParts)*vimg.SectorSize)
+	if err != nil {
+		t.Fatalf("failed to read secondary GPT entries: %v", err)
+	}
+
+	if crc32.ChecksumIEEE(entries) != hdr.CRCParts {
+		t.Fatalf("secondary GPT entries don't match the header's CRC")
+	}
+
+	root, err := iio.GPTEntry(vdecompiler.UTF16toString(vimg.RootPartitionName))
+	if err != nil {
+		t.Fatalf("failed to read root partition entry: %v", err)
+	}
+
+	if root.LastLBA != hdr.LastUsableLBA {
+		t.Fatalf("root partition ends at LBA %d, expected %d", root.LastLBA, hdr.LastUsableLBA)
+	}
+}
+
+// checkResizedFilesystem checks that the free blocks and inodes counted in
+// each group's bitmaps agree with its descriptor and with the superblock.
+func checkResizedFilesystem(t *testing.T, iio *vdecompiler.IO, oldBlocks int64) {
+
+	sb, err := iio.Superblock(0)
+	if err != nil {
+		t.Fatalf("failed to read superblock: %v", err)
+	}
+
+	if sb.Blocks() <= oldBlocks {
+		t.Fatalf("file-system has %d blocks, expected more than %d", sb.Blocks(), oldBlocks)
+	}
+
+	bgdt, err := iio.BGDT(0)
+	if err != nil {
+		t.Fatalf("failed to read BGDT: %v", err)
+	}
+
+	groups := (sb.Blocks() + int64(sb.BlocksPerGroup) - 1) / int64(sb.BlocksPerGroup)
+	if int64(len(bgdt)) != groups || groups < 2 {
+		t.Fatalf("file-system has %d block groups, expected %d (at least 2)", len(bgdt), groups)
+	}
+
+	if sb.TotalInodes != uint32(groups)*sb.InodesPerGroup {
+		t.Fatalf("file-system has %d inodes, expected %d", sb.TotalInodes, uint32(groups)*sb.InodesPerGroup)
+	}
+
+	var freeBlocks, freeInodes int64
+	for g, bgdte := range bgdt {
+
+		count := func(block uint32, n int) int64 {
+			bitmap := make([]byte, ext.BlockSize)
+			_, err := iio.ReadAt(bitmap, int64(testRootFirstLBA*vimg.SectorSize)+int64(block)*ext.BlockSize)
+			if err != nil {
+				t.Fatalf("failed to read bitmap: %v", err)
+			}
+			var used int
+			for _, b := range bitmap[:n/8] {
+				used += bits.OnesCount8(b)
+			}
+			return int64(n - used)
+		}
+
+		blocks := count(bgdte.BlockBitmapBlockAddr, ext.BlockSize*8)
+		if blocks != int64(bgdte.UnallocatedBlocks) {
+			t.Fatalf("group %d has %d free blocks in its bitmap, but its descriptor says %d", g, blocks, bgdte.UnallocatedBlocks)
+		}
+
+		inodes := count(bgdte.InodeBitmapBlockAddr, int(sb.InodesPerGroup))
+		if inodes != int64(bgdte.UnallocatedInodes) {
+			t.Fatalf("group %d has %d free inodes in its bitmap, but its descriptor says %d", g, inodes, bgdte.UnallocatedInodes)
+		}
+
+		freeBlocks += blocks
+		freeInodes += inodes
+
+		// backup superblocks start at the first block of their group
+		if g > 0 {
+			buf := make([]byte, binary.Size(ext.Superblock{}))
+			_, err := iio.ReadAt(buf, int64(testRootFirstLBA*vimg.SectorSize)+int64(g)*int64(sb.BlocksPerGroup)*ext.BlockSize)
+			if err != nil {
+				t.Fatalf("failed to read superblock of group %d: %v", g, err)
+			}
+			sbg := new(ext.Superblock)
+			_ = binary.Read(bytes.NewReader(buf), binary.LittleEndian, sbg)
+			if sbg.Signature != ext.Signature || sbg.Blocks() != sb.Blocks() {
+				t.Fatalf("superblock of group %d has %d blocks, expected %d", g, sbg.Blocks(), sb.Blocks())
+			}
+		}
+	}
+
+	if freeBlocks != sb.UnallocatedBlocksCount() {
+		t.Fatalf("bitmaps have %d free blocks, but the superblock says %d", freeBlocks, sb.UnallocatedBlocksCount())
+	}
+
+	if freeInodes != int64(sb.UnallocatedInodes) {
+		t.Fatalf("bitmaps have %d free inodes, but the superblock says %d", freeInodes, sb.UnallocatedInodes)
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+
+	for _, format := range []ext.Format{ext.FormatExt2, ext.FormatExt4} {
+
+		dir, err := ioutil.TempDir("", "imagetools")
+		if err != nil {
+			t.Fatalf("failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		path := buildResizeTestImage(t, dir, format)
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("failed to stat image: %v", err)
+		}
+
+		err = ResizeImage(path, fi.Size()/ext.BlockSize*ext.BlockSize)
+		if err == nil {
+			t.Fatalf("expected an error shrinking the image")
+		}
+
+		err = ResizeImage(path, 300<<20+vimg.SectorSize)
+		if err == nil {
+			t.Fatalf("expected an error for a size that isn't block-aligned")
+		}
+
+		const size = 300 << 20
+		err = ResizeImage(path, size)
+		if err != nil {
+			t.Fatalf("failed to resize image: %v", err)
+		}
+
+		fi, err = os.Stat(path)
+		if err != nil {
+			t.Fatalf("failed to stat image: %v", err)
+		}
+
+		if fi.Size() != size {
+			t.Fatalf("resized image is %d bytes, expected %d", fi.Size(), size)
+		}
+
+		iio, err := vdecompiler.Open(path)
+		if err != nil {
+			t.Fatalf("failed to open resized image: %v", err)
+		}
+		defer iio.Close()
+
+		checkResizedGPT(t, iio, size)
+		checkResizedFilesystem(t, iio, testRootSize/ext.BlockSize)
+
+		ino, err := iio.ResolvePathToInodeNo("/data")
+		if err != nil {
+			t.Fatalf("failed to find file on resized image: %v", err)
+		}
+
+		inode, err := iio.ResolveInode(ino)
+		if err != nil {
+			t.Fatalf("failed to read inode: %v", err)
+		}
+
+		r, err := iio.InodeReader(inode)
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+
+		if !bytes.Equal(data, testFileContents()) {
+			t.Fatalf("file contents changed by resize")
+		}
+	}
+}
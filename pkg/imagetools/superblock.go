@@ -0,0 +1,173 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+)
+
+// SuperblockField is one field of an ext superblock, as it's stored on disk.
+type SuperblockField struct {
+	Offset   int    // offset of the field within the superblock
+	Name     string // name of the field in ext.Superblock
+	IsNumber bool
+	Number   int64  // value of the field, if IsNumber
+	Text     string // value of the field, if it isn't a number
+	Detail   string // what the value means, if it isn't obvious
+}
+
+// SuperblockReport contains every field of an ext superblock, along with
+// the block group descriptor table that follows it.
+type SuperblockReport struct {
+	Group  int   // block group the superblock was read from
+	Offset int64 // offset of the superblock within the image
+	Fields []SuperblockField
+	BGDT   []*ext.BlockGroupDescriptorTableEntry
+	Raw    []byte // all of the bytes reserved for the superblock
+}
+
+var superblockStates = map[int64]string{
+	1: "clean",
+	2: "has errors",
+}
+
+var superblockOSes = map[int64]string{
+	0: "Linux",
+	1: "Hurd",
+	2: "Masix",
+	3: "FreeBSD",
+	4: "Lites",
+}
+
+// superblockDetail explains the value of the superblock field name, if it
+// needs explaining.
+func superblockDetail(name string, v int64) string {
+
+	switch name {
+	case "BlockSize", "FragmentSize":
+		return fmt.Sprintf("%d bytes", 1024<<uint(v))
+	case "Signature":
+		if v == ext.Signature {
+			return "valid"
+		}
+		return "invalid"
+	case "State":
+		return superblockStates[v]
+	case "OS":
+		return superblockOSes[v]
+	case "LastMountTime", "LastWrittenTime", "TimeLastCheck":
+		if v == 0 {
+			return "never"
+		}
+		return time.Unix(v, 0).UTC().Format(time.RFC3339)
+	case "OptionalFeatures":
+		return strings.Join(ext.FeatureNames(uint32(v), ext.CompatFeatureNames), " ")
+	case "RequiredFeatures":
+		return strings.Join(ext.FeatureNames(uint32(v), ext.IncompatFeatureNames), " ")
+	case "ReadOnlyFeatures":
+		return strings.Join(ext.FeatureNames(uint32(v), ext.ROCompatFeatureNames), " ")
+	}
+
+	return ""
+}
+
+// superblockFields lists the named fields of sb in the order they're stored.
+func superblockFields(sb *ext.Superblock) []SuperblockField {
+
+	var fields []SuperblockField
+
+	val := reflect.ValueOf(sb).Elem()
+	typ := val.Type()
+	off := 0
+
+	for i := 0; i < typ.NumField(); i++ {
+
+		sf := typ.Field(i)
+		fv := val.Field(i)
+		size := int(sf.Type.Size())
+
+		if sf.Name != "_" {
+			field := SuperblockField{
+				Offset: off,
+				Name:   sf.Name,
+			}
+
+			switch fv.Kind() {
+			case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				field.IsNumber = true
+				field.Number = int64(fv.Uint())
+				field.Detail = superblockDetail(sf.Name, field.Number)
+			case reflect.Array:
+				data := make([]byte, fv.Len())
+				reflect.Copy(reflect.ValueOf(data), fv)
+				if strings.HasSuffix(sf.Name, "UUID") {
+					field.Text = fmt.Sprintf("%x-%x-%x-%x-%x", data[0:4], data[4:6], data[6:8], data[8:10], data[10:16])
+				} else {
+					field.Text = string(bytes.TrimRight(data, "\x00"))
+				}
+			}
+
+			fields = append(fields, field)
+		}
+
+		off += size
+	}
+
+	return fields
+}
+
+// ImageSuperblock returns every field of the ext superblock in block group
+// 'group' of the image's file-system, and the block group descriptor table
+// stored after it. Backup superblocks only exist in some block groups.
+func ImageSuperblock(vorteilImage *vdecompiler.IO, group int) (*SuperblockReport, error) {
+
+	if group < 0 {
+		return nil, errors.New("block group can't be negative")
+	}
+
+	off, err := vorteilImage.SuperblockOffset(group)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := vorteilImage.RawSuperblock(group)
+	if err != nil {
+		return nil, err
+	}
+
+	sb := new(ext.Superblock)
+	err = binary.Read(bytes.NewReader(raw), binary.LittleEndian, sb)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &SuperblockReport{
+		Group:  group,
+		Offset: off,
+		Fields: superblockFields(sb),
+		Raw:    raw,
+	}
+
+	if sb.Signature != ext.Signature {
+		return report, nil
+	}
+
+	report.BGDT, err = vorteilImage.BGDT(group)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
@@ -0,0 +1,76 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+)
+
+func TestImageSuperblock(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "imagetools")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	iio, err := vdecompiler.Open(buildResizeTestImage(t, dir, ext.FormatExt4))
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	defer iio.Close()
+
+	report, err := ImageSuperblock(iio, 0)
+	if err != nil {
+		t.Fatalf("failed to read superblock: %v", err)
+	}
+
+	if len(report.Raw) != 1024 {
+		t.Fatalf("expected 1024 raw bytes, got %d", len(report.Raw))
+	}
+
+	if len(report.BGDT) == 0 {
+		t.Fatalf("expected block group descriptors")
+	}
+
+	fields := make(map[string]SuperblockField)
+	for _, field := range report.Fields {
+		fields[field.Name] = field
+	}
+
+	for name, expect := range map[string]SuperblockField{
+		"TotalInodes":      {Offset: 0x0, IsNumber: true},
+		"Signature":        {Offset: 0x38, IsNumber: true, Number: ext.Signature, Detail: "valid"},
+		"RequiredFeatures": {Offset: 0x60, IsNumber: true},
+		"UUID":             {Offset: 0x68},
+		"DescriptorSize":   {Offset: 0xFE, IsNumber: true},
+	} {
+		field, ok := fields[name]
+		if !ok {
+			t.Fatalf("field '%s' is missing", name)
+		}
+		if field.Offset != expect.Offset || field.IsNumber != expect.IsNumber {
+			t.Fatalf("field '%s' at offset 0x%X (number: %v), expected 0x%X (number: %v)", name, field.Offset, field.IsNumber, expect.Offset, expect.IsNumber)
+		}
+		if expect.Number != 0 && (field.Number != expect.Number || field.Detail != expect.Detail) {
+			t.Fatalf("field '%s' is %d (%s), expected %d (%s)", name, field.Number, field.Detail, expect.Number, expect.Detail)
+		}
+	}
+
+	if detail := fields["RequiredFeatures"].Detail; detail != "filetype extent 64bit" {
+		t.Fatalf("unexpected required features: %s", detail)
+	}
+
+	_, err = ImageSuperblock(iio, -1)
+	if err == nil {
+		t.Fatalf("expected an error for a negative block group")
+	}
+}
@@ -0,0 +1,300 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// VerifyResult : Enum const for the result of comparing a single file
+type VerifyResult int
+
+const (
+	// VerifyAdded : File exists on the disk but not in the package
+	VerifyAdded VerifyResult = 0
+	// VerifyRemoved : File exists in the package but not on the disk
+	VerifyRemoved = 1
+	// VerifyChanged : File exists in both but its type, size, contents or mode differ
+	VerifyChanged = 2
+)
+
+func (r VerifyResult) String() string {
+	switch r {
+	case VerifyAdded:
+		return "added"
+	case VerifyRemoved:
+		return "removed"
+	case VerifyChanged:
+		return "changed"
+	default:
+		return "unknown"
+	}
+}
+
+// VerifyReport holds every difference found between a disk and a package.
+// An empty report means the disk matches the package.
+type VerifyReport struct {
+	Files []VerifiedFile
+}
+
+// VerifiedFile holds the path of a file that differs, and how.
+type VerifiedFile struct {
+	Path   string
+	Result VerifyResult
+	Detail string
+}
+
+// Mismatch returns true if any differences were found.
+func (r *VerifyReport) Mismatch() bool {
+	return len(r.Files) > 0
+}
+
+// VerifyOptions : Options for VerifyImage
+type VerifyOptions struct {
+	// Modes also compares permission bits. Only disks built with modes
+	// preserved (see ext.CompilerArgs.PreserveModes) keep those of the
+	// package; others give every inode ext.DefaultInodePermissions.
+	Modes bool
+
+	// VCFG is the VCFG the image was built with, which decides what the
+	// image builder added to the package (see vimg.InjectedPaths). If nil,
+	// it is read from the image.
+	VCFG *vcfg.VCFG
+}
+
+type verifyEntry struct {
+	kind   string
+	size   int64
+	digest string
+	mode   os.FileMode
+}
+
+func (e *verifyEntry) diff(o *verifyEntry, modes bool) string {
+	if e.kind != o.kind {
+		return fmt.Sprintf("type %s -> %s", e.kind, o.kind)
+	}
+	if e.size != o.size {
+		return fmt.Sprintf("size %d -> %d", e.size, o.size)
+	}
+	if e.digest != o.digest {
+		return fmt.Sprintf("digest %.12s -> %.12s", e.digest, o.digest)
+	}
+	if modes && e.mode != o.mode {
+		return fmt.Sprintf("mode %#o -> %#o", e.mode, o.mode)
+	}
+	return ""
+}
+
+func verifyDigest(r io.Reader) (string, int64, error) {
+	hasher := sha256.New()
+	n, err := io.Copy(hasher, r)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), n, nil
+}
+
+func verifyPackageEntries(tree vio.FileTree) (map[string]*verifyEntry, error) {
+
+	entries := make(map[string]*verifyEntry)
+
+	err := tree.Walk(func(fpath string, f vio.File) error {
+
+		fpath = path.Join("/", strings.TrimPrefix(fpath, "."))
+		entry := new(verifyEntry)
+		entry.mode = ext.DefaultInodePermissions
+		if mode, ok := vio.FileMode(f); ok {
+			entry.mode = mode & ext.InodePermissionsMask
+		}
+
+		switch {
+		case f.IsDir():
+			entry.kind = "dir"
+		case f.IsSymlink():
+			entry.kind = "symlink"
+			target := f.Symlink()
+			if !f.SymlinkIsCached() {
+				data, err := ioutil.ReadAll(f)
+				if err != nil {
+					return err
+				}
+				target = string(data)
+			}
+			entry.size = int64(len(target))
+			entry.digest, _, _ = verifyDigest(strings.NewReader(target))
+		default:
+			var err error
+			entry.kind = "file"
+			entry.digest, entry.size, err = verifyDigest(f)
+			if err != nil {
+				return fmt.Errorf("reading package file %s: %w", fpath, err)
+			}
+		}
+
+		entries[fpath] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func verifyDiskEntries(vorteilImage *vdecompiler.IO) (map[string]*verifyEntry, error) {
+
+	entries := make(map[string]*verifyEntry)
+
+	var recurse func(ino int, fpath string) error
+	recurse = func(ino int, fpath string) error {
+
+		inode, err := vorteilImage.ResolveInode(ino)
+		if err != nil {
+			return err
+		}
+
+		entry := new(verifyEntry)
+		entry.mode = os.FileMode(inode.Permissions & ext.InodePermissionsMask)
+		entries[fpath] = entry
+
+		switch {
+		case vdecompiler.InodeIsDirectory(inode):
+			entry.kind = "dir"
+		case vdecompiler.InodeIsSymlink(inode):
+			entry.kind = "symlink"
+		case vdecompiler.InodeIsRegularFile(inode):
+			entry.kind = "file"
+		default:
+			entry.kind = "abnormal"
+			return nil
+		}
+
+		if entry.kind != "dir" {
+			rdr, err := vorteilImage.InodeReader(inode)
+			if err != nil {
+				return err
+			}
+			entry.digest, entry.size, err = verifyDigest(io.LimitReader(rdr, vdecompiler.InodeSize(inode)))
+			if err != nil {
+				return fmt.Errorf("reading disk file %s: %w", fpath, err)
+			}
+			return nil
+		}
+
+		children, err := vorteilImage.Readdir(inode)
+		if err != nil {
+			return err
+		}
+
+		for _, child := range children {
+			if child.Name == "." || child.Name == ".." {
+				continue
+			}
+			err = recurse(child.Inode, path.Join(fpath, child.Name))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	err := recurse(ext.RootDirInode, "/")
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// VerifyImage compares the file-system on vorteilImage against the file tree
+// of a package, reporting files that were added, removed, or changed. Files
+// are compared by type, size, and SHA-256 digest of their contents, and by
+// permission bits if opts.Modes is set. Paths the image builder adds to
+// every disk built with the image's VCFG aren't compared. The package tree is
+// read in full, so it must not have been consumed already.
+func VerifyImage(vorteilImage *vdecompiler.IO, tree vio.FileTree, opts VerifyOptions) (VerifyReport, error) {
+
+	var report VerifyReport
+
+	cfg := opts.VCFG
+	if cfg == nil {
+		var err error
+		cfg, err = vorteilImage.VCFG()
+		if err != nil {
+			return report, err
+		}
+	}
+
+	injected := make(map[string]bool)
+	for _, p := range vimg.InjectedPaths(cfg) {
+		injected["/"+p] = true
+	}
+
+	pkgEntries, err := verifyPackageEntries(tree)
+	if err != nil {
+		return report, err
+	}
+
+	diskEntries, err := verifyDiskEntries(vorteilImage)
+	if err != nil {
+		return report, err
+	}
+
+	for fpath, pe := range pkgEntries {
+		if injected[fpath] {
+			continue
+		}
+		de, ok := diskEntries[fpath]
+		if !ok {
+			report.Files = append(report.Files, VerifiedFile{
+				Path:   fpath,
+				Result: VerifyRemoved,
+			})
+			continue
+		}
+		if detail := pe.diff(de, opts.Modes); detail != "" {
+			report.Files = append(report.Files, VerifiedFile{
+				Path:   fpath,
+				Result: VerifyChanged,
+				Detail: detail,
+			})
+		}
+	}
+
+	for fpath := range diskEntries {
+		if _, ok := pkgEntries[fpath]; ok {
+			continue
+		}
+		if injected[fpath] {
+			continue
+		}
+		report.Files = append(report.Files, VerifiedFile{
+			Path:   fpath,
+			Result: VerifyAdded,
+		})
+	}
+
+	sort.Slice(report.Files, func(i, j int) bool {
+		return report.Files[i].Path < report.Files[j].Path
+	})
+
+	return report, nil
+}
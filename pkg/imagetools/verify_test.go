@@ -0,0 +1,171 @@
+package imagetools
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdecompiler"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// verifyTestImage compares the image at imagePath against the directory src.
+// Test images have no OS partition to read a VCFG from, so an empty one is
+// used unless opts has one.
+func verifyTestImage(t *testing.T, imagePath, src string, opts VerifyOptions) VerifyReport {
+
+	if opts.VCFG == nil {
+		opts.VCFG = new(vcfg.VCFG)
+	}
+
+	iio, err := vdecompiler.Open(imagePath)
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	defer iio.Close()
+
+	tree, err := vio.FileTreeFromDirectory(src)
+	if err != nil {
+		t.Fatalf("failed to load file tree: %v", err)
+	}
+	defer tree.Close()
+
+	report, err := VerifyImage(iio, tree, opts)
+	if err != nil {
+		t.Fatalf("failed to verify image: %v", err)
+	}
+
+	return report
+}
+
+// verifyTestChange returns the detail of the change reported for fpath, or
+// fails the test if there isn't exactly one difference, a change to fpath.
+func verifyTestChange(t *testing.T, report VerifyReport, fpath string) string {
+
+	if len(report.Files) != 1 {
+		t.Fatalf("expected one difference, got %v", report.Files)
+	}
+
+	f := report.Files[0]
+	if f.Path != fpath || f.Result != VerifyChanged {
+		t.Fatalf("expected %s to be changed, got %s %s", fpath, f.Path, f.Result)
+	}
+
+	return f.Detail
+}
+
+func TestVerifyImage(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "imagetools")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := buildResizeTestImage(t, dir, ext.FormatExt2)
+
+	// the image was built without preserving modes, so every inode has
+	// ext.DefaultInodePermissions
+	src := filepath.Join(dir, "src")
+	for _, fpath := range []string{src, filepath.Join(src, "data")} {
+		err = os.Chmod(fpath, ext.DefaultInodePermissions)
+		if err != nil {
+			t.Fatalf("failed to chmod source: %v", err)
+		}
+	}
+
+	report := verifyTestImage(t, path, src, VerifyOptions{Modes: true})
+	if report.Mismatch() {
+		t.Fatalf("expected the image to match, got %v", report.Files)
+	}
+
+	err = os.Chmod(filepath.Join(src, "data"), 0644)
+	if err != nil {
+		t.Fatalf("failed to chmod source file: %v", err)
+	}
+
+	report = verifyTestImage(t, path, src, VerifyOptions{})
+	if report.Mismatch() {
+		t.Fatalf("expected modes to be ignored, got %v", report.Files)
+	}
+
+	report = verifyTestImage(t, path, src, VerifyOptions{Modes: true})
+	detail := verifyTestChange(t, report, "/data")
+	if detail != "mode 0644 -> 0700" {
+		t.Fatalf("unexpected detail for a mismatched mode: %s", detail)
+	}
+
+	// same size, different contents
+	data := testFileContents()
+	data[0]++
+	err = os.Chmod(filepath.Join(src, "data"), ext.DefaultInodePermissions)
+	if err != nil {
+		t.Fatalf("failed to chmod source file: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(src, "data"), data, 0)
+	if err != nil {
+		t.Fatalf("failed to write source file: %v", err)
+	}
+
+	report = verifyTestImage(t, path, src, VerifyOptions{Modes: true})
+	detail = verifyTestChange(t, report, "/data")
+	if !strings.HasPrefix(detail, "digest ") {
+		t.Fatalf("unexpected detail for a mismatched digest: %s", detail)
+	}
+}
+
+func TestVerifyImageInjected(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "imagetools")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// build the image with what the image builder would add for a
+	// timezone, then take it out of the package
+	src := filepath.Join(dir, "src")
+	err = os.MkdirAll(filepath.Join(src, "etc"), 0755)
+	if err != nil {
+		t.Fatalf("failed to create source dir: %v", err)
+	}
+	for _, name := range []string{"localtime", "timezone"} {
+		err = ioutil.WriteFile(filepath.Join(src, "etc", name), []byte("UTC\n"), 0644)
+		if err != nil {
+			t.Fatalf("failed to write source file: %v", err)
+		}
+	}
+
+	path := buildResizeTestImage(t, dir, ext.FormatExt2)
+
+	err = os.RemoveAll(filepath.Join(src, "etc"))
+	if err != nil {
+		t.Fatalf("failed to remove source dir: %v", err)
+	}
+
+	report := verifyTestImage(t, path, src, VerifyOptions{})
+	if len(report.Files) != 3 {
+		t.Fatalf("expected /etc and its files to be added without a timezone, got %v", report.Files)
+	}
+	for _, f := range report.Files {
+		if f.Result != VerifyAdded || !strings.HasPrefix(f.Path, "/etc") {
+			t.Fatalf("expected /etc and its files to be added, got %s %s", f.Path, f.Result)
+		}
+	}
+
+	cfg := new(vcfg.VCFG)
+	cfg.System.Timezone = "UTC"
+	report = verifyTestImage(t, path, src, VerifyOptions{VCFG: cfg})
+	if report.Mismatch() {
+		t.Fatalf("expected the timezone files to be ignored, got %v", report.Files)
+	}
+}
@@ -0,0 +1,78 @@
+package luks
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// The anti-forensic splitter spreads the master key across many stripes of
+// key material, so that destroying any part of a key slot destroys the key.
+
+// diffuse hashes each digest-sized chunk of d in place, prefixed with its
+// index.
+func diffuse(d []byte) {
+
+	var index [4]byte
+	for i := 0; i*sha256.Size < len(d); i++ {
+		chunk := d[i*sha256.Size:]
+		if len(chunk) > sha256.Size {
+			chunk = chunk[:sha256.Size]
+		}
+
+		binary.BigEndian.PutUint32(index[:], uint32(i))
+		h := sha256.New()
+		h.Write(index[:])
+		h.Write(chunk)
+		copy(chunk, h.Sum(nil))
+	}
+}
+
+func xor(dst, a, b []byte) {
+	for i := range dst {
+		dst[i] = a[i] ^ b[i]
+	}
+}
+
+// afSplit splits key into stripes blocks of random-looking data.
+func afSplit(key []byte, stripes int) ([]byte, error) {
+
+	n := len(key)
+	out := make([]byte, n*stripes)
+	d := make([]byte, n)
+
+	_, err := io.ReadFull(rand.Reader, out[:n*(stripes-1)])
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < stripes-1; i++ {
+		xor(d, d, out[i*n:(i+1)*n])
+		diffuse(d)
+	}
+
+	xor(out[(stripes-1)*n:], d, key)
+
+	return out, nil
+}
+
+// afMerge recovers a key of n bytes from material split by afSplit.
+func afMerge(material []byte, n, stripes int) []byte {
+
+	d := make([]byte, n)
+	for i := 0; i < stripes-1; i++ {
+		xor(d, d, material[i*n:(i+1)*n])
+		diffuse(d)
+	}
+
+	key := make([]byte, n)
+	xor(key, d, material[(stripes-1)*n:])
+
+	return key
+}
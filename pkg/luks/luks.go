@@ -0,0 +1,415 @@
+package luks
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+// Constants of the LUKS1 on-disk format.
+const (
+	SectorSize     = 512
+	KeySlots       = 8
+	Stripes        = 4000
+	Version        = 1
+	HeaderSize     = 592
+	keySlotActive  = 0x00AC71F3
+	keySlotDead    = 0x0000DEAD
+	digestSize     = 20
+	saltSize       = 32
+	slotAlignment  = 4096 / SectorSize // key material is aligned to 4 KiB
+	payloadAlign   = 1 << 20 / SectorSize
+	hashSpec       = "sha256"
+	cipherName     = "aes"
+	cipherMode     = "xts-plain64"
+	minIterations  = 1000
+	mkDigestRounds = 8 // the master key digest gets an eighth of the keyslot iterations
+)
+
+// Ciphers that can be used to encrypt a volume.
+const (
+	CipherAESXTSPlain64 = cipherName + "-" + cipherMode
+	DefaultCipher       = CipherAESXTSPlain64
+)
+
+// Defaults for the fields of Options that are left empty.
+const (
+	DefaultKeyBytes   = 64 // AES-256 in XTS mode
+	DefaultIterations = 100000
+)
+
+// Magic is the signature at the start of every LUKS header.
+var Magic = [6]byte{'L', 'U', 'K', 'S', 0xBA, 0xBE}
+
+// ErrNotLUKS is returned when a volume doesn't start with a LUKS header.
+var ErrNotLUKS = errors.New("not a LUKS volume")
+
+// ErrWrongPassphrase is returned when a passphrase doesn't unlock any of a
+// volume's key slots.
+var ErrWrongPassphrase = errors.New("passphrase doesn't match any key slot")
+
+// KeySlot is the structure of a LUKS1 key slot as it appears on disk.
+type KeySlot struct {
+	Active            uint32
+	Iterations        uint32
+	Salt              [saltSize]byte
+	KeyMaterialOffset uint32 // in sectors
+	Stripes           uint32
+}
+
+// Header is the structure of a LUKS1 header as it appears on disk. Every
+// field is big-endian.
+type Header struct {
+	Magic         [6]byte
+	Version       uint16
+	CipherName    [32]byte
+	CipherMode    [32]byte
+	HashSpec      [32]byte
+	PayloadOffset uint32 // in sectors
+	KeyBytes      uint32
+	MKDigest      [digestSize]byte
+	MKDigestSalt  [saltSize]byte
+	MKDigestIter  uint32
+	UUID          [40]byte
+	KeySlots      [KeySlots]KeySlot
+}
+
+func cstring(b []byte) string {
+	return string(bytes.TrimRight(b, "\x00"))
+}
+
+// Cipher returns the cipher and mode of the volume, e.g. "aes-xts-plain64".
+func (h *Header) Cipher() string {
+	return cstring(h.CipherName[:]) + "-" + cstring(h.CipherMode[:])
+}
+
+// Options configures a new volume.
+type Options struct {
+	Cipher     string // only CipherAESXTSPlain64 is supported
+	KeyBytes   int    // size of the master key: 32 for AES-128, or 64 for AES-256
+	Iterations int    // PBKDF2 iterations used to derive the key slot key from the passphrase
+}
+
+// Validate checks that the options are supported, after defaults are
+// applied to anything left empty.
+func (o *Options) Validate() error {
+
+	opts := o.withDefaults()
+
+	if opts.Cipher != CipherAESXTSPlain64 {
+		return fmt.Errorf("cipher '%s' is not supported (should be '%s')", opts.Cipher, CipherAESXTSPlain64)
+	}
+
+	if opts.KeyBytes != 32 && opts.KeyBytes != 64 {
+		return fmt.Errorf("key size of %d bytes is not supported (should be 32 or 64)", opts.KeyBytes)
+	}
+
+	if opts.Iterations < minIterations {
+		return fmt.Errorf("%d iterations is too few (should be at least %d)", opts.Iterations, minIterations)
+	}
+
+	return nil
+}
+
+func (o *Options) withDefaults() Options {
+
+	var opts Options
+	if o != nil {
+		opts = *o
+	}
+
+	if opts.Cipher == "" {
+		opts.Cipher = DefaultCipher
+	}
+
+	if opts.KeyBytes == 0 {
+		opts.KeyBytes = DefaultKeyBytes
+	}
+
+	if opts.Iterations == 0 {
+		opts.Iterations = DefaultIterations
+	}
+
+	return opts
+}
+
+// Volume is an unlocked LUKS volume, which can encrypt and decrypt the
+// sectors of its payload.
+type Volume struct {
+	Header *Header
+	cipher *xts.Cipher
+}
+
+func newVolume(hdr *Header, masterKey []byte) (*Volume, error) {
+
+	c, err := xts.NewCipher(aes.NewCipher, masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Volume{
+		Header: hdr,
+		cipher: c,
+	}, nil
+}
+
+// PayloadOffset returns the offset of the encrypted payload from the start of
+// the volume, in bytes. Everything before it is the header and key material.
+func (v *Volume) PayloadOffset() int64 {
+	return int64(v.Header.PayloadOffset) * SectorSize
+}
+
+// EncryptSectors encrypts whole sectors of src into dst, which may overlap
+// exactly. The first sector is payload sector number 'sector'.
+func (v *Volume) EncryptSectors(dst, src []byte, sector uint64) {
+	cryptSectors(v.cipher.Encrypt, dst, src, sector)
+}
+
+// DecryptSectors decrypts whole sectors of src into dst, which may overlap
+// exactly. The first sector is payload sector number 'sector'.
+func (v *Volume) DecryptSectors(dst, src []byte, sector uint64) {
+	cryptSectors(v.cipher.Decrypt, dst, src, sector)
+}
+
+func cryptSectors(fn func(dst, src []byte, sector uint64), dst, src []byte, sector uint64) {
+	if len(src)%SectorSize != 0 {
+		panic(errors.New("data must be a whole number of sectors"))
+	}
+	for i := 0; i < len(src); i += SectorSize {
+		fn(dst[i:i+SectorSize], src[i:i+SectorSize], sector)
+		sector++
+	}
+}
+
+// slotSectors returns the number of sectors taken by the key material of
+// each key slot.
+func slotSectors(keyBytes int) int {
+	sectors := (keyBytes*Stripes + SectorSize - 1) / SectorSize
+	return (sectors + slotAlignment - 1) / slotAlignment * slotAlignment
+}
+
+func randomUUID() ([40]byte, error) {
+
+	var uuid [40]byte
+
+	b := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return uuid, err
+	}
+
+	b[6] = b[6]&0x0F | 0x40
+	b[8] = b[8]&0x3F | 0x80
+	copy(uuid[:], fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]))
+
+	return uuid, nil
+}
+
+// Format creates a new volume with a random master key, protected by the
+// passphrase in the first key slot. It returns the unlocked volume, and
+// everything that must be written before the volume's payload: the header,
+// and the key material of every key slot.
+func Format(passphrase []byte, opts *Options) (*Volume, []byte, error) {
+
+	err := opts.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	o := opts.withDefaults()
+
+	if len(passphrase) == 0 {
+		return nil, nil, errors.New("passphrase is empty")
+	}
+
+	masterKey := make([]byte, o.KeyBytes)
+	_, err = io.ReadFull(rand.Reader, masterKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hdr := &Header{
+		Magic:        Magic,
+		Version:      Version,
+		KeyBytes:     uint32(o.KeyBytes),
+		MKDigestIter: uint32(o.Iterations / mkDigestRounds),
+	}
+
+	if hdr.MKDigestIter < minIterations {
+		hdr.MKDigestIter = minIterations
+	}
+
+	copy(hdr.CipherName[:], cipherName)
+	copy(hdr.CipherMode[:], cipherMode)
+	copy(hdr.HashSpec[:], hashSpec)
+
+	hdr.UUID, err = randomUUID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = io.ReadFull(rand.Reader, hdr.MKDigestSalt[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	copy(hdr.MKDigest[:], pbkdf2.Key(masterKey, hdr.MKDigestSalt[:], int(hdr.MKDigestIter), digestSize, sha256.New))
+
+	slotSize := slotSectors(o.KeyBytes)
+	offset := slotAlignment
+	for i := range hdr.KeySlots {
+		hdr.KeySlots[i] = KeySlot{
+			Active:            keySlotDead,
+			KeyMaterialOffset: uint32(offset),
+			Stripes:           Stripes,
+		}
+		offset += slotSize
+	}
+
+	hdr.PayloadOffset = uint32((offset + payloadAlign - 1) / payloadAlign * payloadAlign)
+
+	data := make([]byte, int(hdr.PayloadOffset)*SectorSize)
+
+	// key slot 0 holds the master key, split and encrypted with a key derived
+	// from the passphrase
+	slot := &hdr.KeySlots[0]
+	slot.Active = keySlotActive
+	slot.Iterations = uint32(o.Iterations)
+	_, err = io.ReadFull(rand.Reader, slot.Salt[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	split, err := afSplit(masterKey, Stripes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	material := make([]byte, slotSize*SectorSize)
+	copy(material, split)
+
+	slotKey := pbkdf2.Key(passphrase, slot.Salt[:], int(slot.Iterations), o.KeyBytes, sha256.New)
+	slotVolume, err := newVolume(hdr, slotKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	slotVolume.EncryptSectors(material, material, 0)
+
+	copy(data[int(slot.KeyMaterialOffset)*SectorSize:], material)
+
+	buf := new(bytes.Buffer)
+	err = binary.Write(buf, binary.BigEndian, hdr)
+	if err != nil {
+		return nil, nil, err
+	}
+	copy(data, buf.Bytes())
+
+	v, err := newVolume(hdr, masterKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return v, data, nil
+}
+
+// ReadHeader reads the LUKS header at the start of r.
+func ReadHeader(r io.ReaderAt) (*Header, error) {
+
+	buf := make([]byte, HeaderSize)
+	_, err := r.ReadAt(buf, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := new(Header)
+	err = binary.Read(bytes.NewReader(buf), binary.BigEndian, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.Magic != Magic {
+		return nil, ErrNotLUKS
+	}
+
+	if hdr.Version != Version {
+		return nil, fmt.Errorf("LUKS version %d is not supported", hdr.Version)
+	}
+
+	if hdr.Cipher() != CipherAESXTSPlain64 || cstring(hdr.HashSpec[:]) != hashSpec {
+		return nil, fmt.Errorf("LUKS volume uses %s with %s, but only %s with %s is supported", hdr.Cipher(), cstring(hdr.HashSpec[:]), CipherAESXTSPlain64, hashSpec)
+	}
+
+	if hdr.KeyBytes != 32 && hdr.KeyBytes != 64 {
+		return nil, fmt.Errorf("LUKS volume has an unsupported key size: %d bytes", hdr.KeyBytes)
+	}
+
+	return hdr, nil
+}
+
+// IsLUKS returns true if r starts with a LUKS header.
+func IsLUKS(r io.ReaderAt) (bool, error) {
+
+	var magic [6]byte
+	_, err := r.ReadAt(magic[:], 0)
+	if err != nil {
+		return false, err
+	}
+
+	return magic == Magic, nil
+}
+
+// Unlock reads the LUKS header at the start of r, and unlocks the volume with
+// the passphrase.
+func Unlock(r io.ReaderAt, passphrase []byte) (*Volume, error) {
+
+	hdr, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	keyBytes := int(hdr.KeyBytes)
+
+	for i := range hdr.KeySlots {
+
+		slot := &hdr.KeySlots[i]
+		if slot.Active != keySlotActive {
+			continue
+		}
+
+		material := make([]byte, slotSectors(keyBytes)*SectorSize)
+		_, err = r.ReadAt(material, int64(slot.KeyMaterialOffset)*SectorSize)
+		if err != nil {
+			return nil, err
+		}
+
+		slotKey := pbkdf2.Key(passphrase, slot.Salt[:], int(slot.Iterations), keyBytes, sha256.New)
+		slotVolume, err := newVolume(hdr, slotKey)
+		if err != nil {
+			return nil, err
+		}
+		slotVolume.DecryptSectors(material, material, 0)
+
+		masterKey := afMerge(material[:keyBytes*int(slot.Stripes)], keyBytes, int(slot.Stripes))
+
+		digest := pbkdf2.Key(masterKey, hdr.MKDigestSalt[:], int(hdr.MKDigestIter), digestSize, sha256.New)
+		if subtle.ConstantTimeCompare(digest, hdr.MKDigest[:]) == 1 {
+			return newVolume(hdr, masterKey)
+		}
+	}
+
+	return nil, ErrWrongPassphrase
+}
@@ -0,0 +1,137 @@
+package luks
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestFormatAndUnlock(t *testing.T) {
+
+	opts := &Options{Iterations: minIterations}
+
+	v, hdr, err := Format([]byte("passphrase"), opts)
+	if err != nil {
+		t.Fatalf("failed to format volume: %v", err)
+	}
+
+	if int64(len(hdr)) != v.PayloadOffset() {
+		t.Fatalf("header region is %d bytes, expected payload offset %d", len(hdr), v.PayloadOffset())
+	}
+
+	if v.PayloadOffset()%(1<<20) != 0 {
+		t.Fatalf("payload offset %d is not aligned to 1 MiB", v.PayloadOffset())
+	}
+
+	plain := bytes.Repeat([]byte("vorteil!"), SectorSize/8*4)
+	payload := make([]byte, len(plain))
+	v.EncryptSectors(payload, plain, 0)
+	if bytes.Equal(payload, plain) {
+		t.Fatalf("encrypted payload matches plaintext")
+	}
+
+	disk := bytes.NewReader(append(append([]byte{}, hdr...), payload...))
+
+	ok, err := IsLUKS(disk)
+	if err != nil || !ok {
+		t.Fatalf("expected volume to be detected as LUKS: %v", err)
+	}
+
+	_, err = Unlock(disk, []byte("wrong"))
+	if err != ErrWrongPassphrase {
+		t.Fatalf("expected wrong passphrase error, got %v", err)
+	}
+
+	u, err := Unlock(disk, []byte("passphrase"))
+	if err != nil {
+		t.Fatalf("failed to unlock volume: %v", err)
+	}
+
+	if u.Header.Cipher() != CipherAESXTSPlain64 || u.Header.KeyBytes != DefaultKeyBytes {
+		t.Fatalf("unexpected cipher '%s' with %d byte key", u.Header.Cipher(), u.Header.KeyBytes)
+	}
+
+	decrypted := make([]byte, len(payload))
+	u.DecryptSectors(decrypted, payload, 0)
+	if !bytes.Equal(decrypted, plain) {
+		t.Fatalf("decrypted payload doesn't match plaintext")
+	}
+
+	ok, err = IsLUKS(bytes.NewReader(plain))
+	if err != nil || ok {
+		t.Fatalf("expected plaintext not to be detected as LUKS: %v", err)
+	}
+}
+
+func TestFormatOptions(t *testing.T) {
+
+	for _, opts := range []*Options{
+		{Cipher: "aes-cbc-essiv:sha256"},
+		{KeyBytes: 48},
+		{Iterations: 10},
+	} {
+		if _, _, err := Format([]byte("passphrase"), opts); err == nil {
+			t.Fatalf("expected options %+v to be rejected", opts)
+		}
+	}
+
+	if _, _, err := Format(nil, &Options{Iterations: minIterations}); err == nil {
+		t.Fatalf("expected empty passphrase to be rejected")
+	}
+}
+
+func TestWriter(t *testing.T) {
+
+	v, _, err := Format([]byte("passphrase"), &Options{KeyBytes: 32, Iterations: minIterations})
+	if err != nil {
+		t.Fatalf("failed to format volume: %v", err)
+	}
+
+	// the last sector is only partly written, and padded on close
+	plain := make([]byte, SectorSize*3-100)
+	for i := range plain {
+		plain[i] = byte(i)
+	}
+
+	buf := new(bytes.Buffer)
+	w := v.NewWriter(buf)
+
+	// write in pieces that don't line up with sectors
+	for _, n := range []int{100, 700, 1, SectorSize*3 - 901} {
+		_, err = w.Write(plain[:n])
+		if err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		plain = plain[n:]
+	}
+
+	if buf.Len() != SectorSize*2 {
+		t.Fatalf("expected only whole sectors to be written before close, got %d bytes", buf.Len())
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+
+	encrypted, _ := ioutil.ReadAll(buf)
+	if len(encrypted) != SectorSize*3 {
+		t.Fatalf("expected %d bytes, got %d", SectorSize*3, len(encrypted))
+	}
+
+	v.DecryptSectors(encrypted, encrypted, 0)
+	for i := range encrypted {
+		expected := byte(i)
+		if i >= SectorSize*3-100 {
+			expected = 0
+		}
+		if encrypted[i] != expected {
+			t.Fatalf("decrypted byte %d is %d, expected %d", i, encrypted[i], expected)
+		}
+	}
+}
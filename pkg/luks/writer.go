@@ -0,0 +1,90 @@
+package luks
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"io"
+)
+
+// Writer encrypts the payload of a volume as it's written sequentially,
+// starting from the first payload sector. It buffers any partial sector
+// until it's completed, or until the Writer is closed.
+type Writer struct {
+	v       *Volume
+	w       io.Writer
+	sector  uint64
+	buf     []byte
+	pending int
+}
+
+// NewWriter returns a Writer that writes the encrypted payload to w. Nothing
+// is written for the header, which must be written separately.
+func (v *Volume) NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		v:   v,
+		w:   w,
+		buf: make([]byte, 64*SectorSize),
+	}
+}
+
+func (w *Writer) flush(n int) error {
+
+	w.v.EncryptSectors(w.buf[:n], w.buf[:n], w.sector)
+	_, err := w.w.Write(w.buf[:n])
+	if err != nil {
+		return err
+	}
+
+	w.sector += uint64(n / SectorSize)
+	copy(w.buf, w.buf[n:w.pending])
+	w.pending -= n
+
+	return nil
+}
+
+// Write implements io.Writer.
+func (w *Writer) Write(p []byte) (int, error) {
+
+	var k int
+	for len(p) > 0 {
+		n := copy(w.buf[w.pending:], p)
+		w.pending += n
+		k += n
+		p = p[n:]
+
+		if w.pending == len(w.buf) {
+			err := w.flush(w.pending)
+			if err != nil {
+				return k, err
+			}
+		}
+	}
+
+	if whole := w.pending / SectorSize * SectorSize; whole > 0 {
+		err := w.flush(whole)
+		if err != nil {
+			return k, err
+		}
+	}
+
+	return k, nil
+}
+
+// Close pads any partial sector with zeroes, and writes it.
+func (w *Writer) Close() error {
+
+	if w.pending == 0 {
+		return nil
+	}
+
+	n := (w.pending + SectorSize - 1) / SectorSize * SectorSize
+	for i := w.pending; i < n; i++ {
+		w.buf[i] = 0
+	}
+	w.pending = n
+
+	return w.flush(n)
+}
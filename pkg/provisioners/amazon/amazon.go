@@ -7,14 +7,19 @@ package amazon
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -35,6 +40,14 @@ var machineType = "t2.nano"
 var provisionerID = "Amazon-EC2"
 
 var pollrate = time.Millisecond * 1000
+
+// tagConstraints are EC2's limits on the tags of a single resource.
+var tagConstraints = &provisioners.TagConstraints{
+	MaxTags:          50,
+	MaxKeyLength:     128,
+	MaxValueLength:   256,
+	ReservedPrefixes: []string{"aws:"},
+}
 var securityGroupName = "vorteil-provisioner"
 var securityGroupPort = int64(443)
 
@@ -136,6 +149,12 @@ func (p *Provisioner) SizeAlign() vcfg.Bytes {
 	return vcfg.GiB
 }
 
+// WantsCompressed returns false, because the VHD is uploaded to S3 in a single
+// request that needs its length up front.
+func (p *Provisioner) WantsCompressed() bool {
+	return false
+}
+
 func (p *Provisioner) init() error {
 	var err error
 	p.awsSession, err = session.NewSession(&aws.Config{
@@ -155,23 +174,43 @@ func (p *Provisioner) init() error {
 // Provision given a valid ProvisionArgs object will provision the passed vorteil project
 //	to the configured amazon provisioner. This process will return as soon as the vorteil
 //	projects image has been uploaded, unless ReadyWhenUsable was set to true, then
-//	this function will block until aws reports the ami as usable.
-func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
-	var err error
+//	this function will block until aws reports the ami as usable. If it fails
+//	part way through, the bucket object and snapshot it created are removed
+//	unless args.KeepOnFailure is set.
+func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) (err error) {
+
+	if err := tagConstraints.Validate(ProvisionerType, args.Tags); err != nil {
+		return err
+	}
 	var imageID *string
 	p.args = *args
 
+	dataDisks, err := dataDiskMappings(args.DataDisks)
+	if err != nil {
+		return err
+	}
+
+	rb := provisioners.NewRollback(p.log)
+	defer func() {
+		if err != nil {
+			_ = rb.Run(args.KeepOnFailure)
+		}
+	}()
+
 	uploadProgress := p.log.NewProgress("Uploading Image to AWS Bucket", "", 0)
 	defer uploadProgress.Finish(true)
 
 	// Handle Exisitng Image and Force Flag
-	imageID, err = p.getImageID(p.args.Name)
+	imageID, err = p.getImageID(p.args.Context, p.args.Name)
 	if imageID != nil {
 		if args.Force {
 			// deregister current live version as were force pushing
 			p.log.Infof("deregistering old ami: %v\n", imageID)
-			_, err = p.ec2Client.DeregisterImageWithContext(p.args.Context, &ec2.DeregisterImageInput{
-				ImageId: imageID,
+			err = p.retry(p.args.Context, func() error {
+				_, err := p.ec2Client.DeregisterImageWithContext(p.args.Context, &ec2.DeregisterImageInput{
+					ImageId: imageID,
+				})
+				return err
 			})
 		} else {
 			err = errors.New("ami exists: try using the --force flag")
@@ -198,13 +237,24 @@ func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 		return fmt.Errorf("Failed to upload image to bucket '%s', error: %s", p.cfg.Bucket, err.Error())
 	}
 
-	defer func() {
-		p.log.Infof("Cleaning Image From Bucket %s", keyName)
-		// Delete object that was uploaded (mainly used to clean up when the function ends)
-		_, _ = p.s3Client.DeleteObject(&s3.DeleteObjectInput{
-			Bucket: aws.String(p.cfg.Bucket),
-			Key:    keyName,
+	deleteObject := func() error {
+		return p.retry(p.args.Context, func() error {
+			_, err := p.s3Client.DeleteObject(&s3.DeleteObjectInput{
+				Bucket: aws.String(p.cfg.Bucket),
+				Key:    keyName,
+			})
+			return err
 		})
+	}
+	rb.Track(fmt.Sprintf("bucket object '%s'", aws.StringValue(keyName)), deleteObject)
+
+	defer func() {
+		// the uploaded object is only needed to import the snapshot, so it's
+		// removed on success too
+		if err == nil {
+			p.log.Infof("Cleaning Image From Bucket %s", aws.StringValue(keyName))
+			_ = deleteObject()
+		}
 	}()
 
 	snapshotID, err := p.importSnapshot(aws.StringValue(keyName))
@@ -212,42 +262,125 @@ func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 		return fmt.Errorf("Failed to convert bucket Image to Snapshot, error: %s", err.Error())
 	}
 
+	rb.Track(fmt.Sprintf("snapshot '%s'", snapshotID), func() error {
+		return p.retry(p.args.Context, func() error {
+			_, err := p.ec2Client.DeleteSnapshot(&ec2.DeleteSnapshotInput{
+				SnapshotId: aws.String(snapshotID),
+			})
+			return err
+		})
+	})
+
 	registerImgProgress := p.log.NewProgress("Registering snapshot as AMI", "", 0)
 	defer registerImgProgress.Finish(true)
-	rio, err := p.ec2Client.RegisterImage(&ec2.RegisterImageInput{
-		Architecture:       aws.String("x86_64"),
-		Description:        aws.String(p.args.Description),
-		Name:               aws.String(p.args.Name),
-		EnaSupport:         aws.Bool(true),
-		VirtualizationType: aws.String("hvm"),
-		RootDeviceName:     aws.String("/dev/sda1"),
-		BlockDeviceMappings: []*ec2.BlockDeviceMapping{
-			&ec2.BlockDeviceMapping{
-				DeviceName: aws.String("/dev/sda1"),
-				Ebs: &ec2.EbsBlockDevice{
-					SnapshotId: aws.String(snapshotID),
+	var rio *ec2.RegisterImageOutput
+	err = p.retry(p.args.Context, func() error {
+		var err error
+		rio, err = p.ec2Client.RegisterImage(&ec2.RegisterImageInput{
+			Architecture:       aws.String("x86_64"),
+			Description:        aws.String(p.args.Description),
+			Name:               aws.String(p.args.Name),
+			EnaSupport:         aws.Bool(true),
+			VirtualizationType: aws.String("hvm"),
+			RootDeviceName:     aws.String("/dev/sda1"),
+			BlockDeviceMappings: append([]*ec2.BlockDeviceMapping{
+				&ec2.BlockDeviceMapping{
+					DeviceName: aws.String("/dev/sda1"),
+					Ebs: &ec2.EbsBlockDevice{
+						SnapshotId: aws.String(snapshotID),
+					},
 				},
-			},
-		},
+			}, dataDisks...),
+		})
+		return err
 	})
 	if err != nil {
 		return err
 	}
 	registerImgProgress.Finish(true)
 
+	rb.Track(fmt.Sprintf("ami '%s'", aws.StringValue(rio.ImageId)), func() error {
+		return p.retry(p.args.Context, func() error {
+			_, err := p.ec2Client.DeregisterImage(&ec2.DeregisterImageInput{
+				ImageId: rio.ImageId,
+			})
+			return err
+		})
+	})
+
+	err = p.tagResources(args.Tags, rio.ImageId, aws.String(snapshotID))
+	if err != nil {
+		return fmt.Errorf("Failed to tag AMI, error: %s", err.Error())
+	}
+
 	p.log.Printf("Provisioned AMI: %s", *rio.ImageId)
 	return nil
 }
 
+// tagResources applies tags to the EC2 resources with the given IDs.
+func (p *Provisioner) tagResources(tags map[string]string, ids ...*string) error {
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	var ec2Tags []*ec2.Tag
+	for k, v := range tags {
+		ec2Tags = append(ec2Tags, &ec2.Tag{
+			Key:   aws.String(k),
+			Value: aws.String(v),
+		})
+	}
+
+	return p.retry(p.args.Context, func() error {
+		_, err := p.ec2Client.CreateTagsWithContext(p.args.Context, &ec2.CreateTagsInput{
+			Resources: ids,
+			Tags:      ec2Tags,
+		})
+		return err
+	})
+}
+
+// dataDiskMappings returns block device mappings for empty EBS volumes of
+// the given sizes, rounded up to whole GiB, attached as /dev/sdb onwards.
+func dataDiskMappings(sizes []int64) ([]*ec2.BlockDeviceMapping, error) {
+
+	if len(sizes) > 'z'-'b'+1 {
+		return nil, fmt.Errorf("too many data disks: at most %d are supported", 'z'-'b'+1)
+	}
+
+	var mappings []*ec2.BlockDeviceMapping
+	for i, size := range sizes {
+		if size <= 0 {
+			return nil, fmt.Errorf("invalid size for data disk %d: %d", i, size)
+		}
+		gib := (size + int64(vcfg.GiB) - 1) / int64(vcfg.GiB)
+		mappings = append(mappings, &ec2.BlockDeviceMapping{
+			DeviceName: aws.String(fmt.Sprintf("/dev/sd%c", 'b'+i)),
+			Ebs: &ec2.EbsBlockDevice{
+				VolumeSize:          aws.Int64(gib),
+				DeleteOnTermination: aws.Bool(true),
+			},
+		})
+	}
+
+	return mappings, nil
+}
+
 // getImageID given a imageName, return the imageID of the first image found, or nil if not found
-func (p *Provisioner) getImageID(imageName string) (*string, error) {
+func (p *Provisioner) getImageID(ctx context.Context, imageName string) (*string, error) {
 	var err error
 	filterForce := &ec2.Filter{
 		Name:   aws.String("name"),
 		Values: []*string{aws.String(imageName)},
 	}
-	awsImages, err := p.ec2Client.DescribeImages(&ec2.DescribeImagesInput{
-		Filters: []*ec2.Filter{filterForce},
+	var awsImages *ec2.DescribeImagesOutput
+	err = p.retry(ctx, func() error {
+		var err error
+		awsImages, err = p.ec2Client.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+			Filters: []*ec2.Filter{filterForce},
+		})
+		return err
 	})
 	if err != nil {
 		return nil, fmt.Errorf("Could not get image ID for image '%s', error: %v", imageName, err)
@@ -266,15 +399,20 @@ func (p *Provisioner) importSnapshot(bucketImageKey string) (string, error) {
 	// Import Snapshot
 	var snapshotID *string
 	// o.updateStatus("Importing disk into EBS Snapshot")
-	iso, err := p.ec2Client.ImportSnapshot(&ec2.ImportSnapshotInput{
-		Description: aws.String(p.args.Description),
-		DiskContainer: &ec2.SnapshotDiskContainer{
-			UserBucket: &ec2.UserBucket{
-				S3Bucket: aws.String(p.cfg.Bucket),
-				S3Key:    aws.String(bucketImageKey),
+	var iso *ec2.ImportSnapshotOutput
+	err := p.retry(p.args.Context, func() error {
+		var err error
+		iso, err = p.ec2Client.ImportSnapshot(&ec2.ImportSnapshotInput{
+			Description: aws.String(p.args.Description),
+			DiskContainer: &ec2.SnapshotDiskContainer{
+				UserBucket: &ec2.UserBucket{
+					S3Bucket: aws.String(p.cfg.Bucket),
+					S3Key:    aws.String(bucketImageKey),
+				},
+				Format: aws.String("VHD"),
 			},
-			Format: aws.String("VHD"),
-		},
+		})
+		return err
 	})
 	if err != nil {
 		return aws.StringValue(snapshotID), err
@@ -282,8 +420,12 @@ func (p *Provisioner) importSnapshot(bucketImageKey string) (string, error) {
 
 	var disto *ec2.DescribeImportSnapshotTasksOutput
 	for {
-		disto, err = p.ec2Client.DescribeImportSnapshotTasks(&ec2.DescribeImportSnapshotTasksInput{
-			ImportTaskIds: []*string{iso.ImportTaskId},
+		err = p.retry(p.args.Context, func() error {
+			var err error
+			disto, err = p.ec2Client.DescribeImportSnapshotTasks(&ec2.DescribeImportSnapshotTasksInput{
+				ImportTaskIds: []*string{iso.ImportTaskId},
+			})
+			return err
 		})
 		if err != nil {
 			break
@@ -310,6 +452,237 @@ func (p *Provisioner) importSnapshot(bucketImageKey string) (string, error) {
 	return aws.StringValue(snapshotID), err
 }
 
+// getInstanceID returns the ID of the instance called name, which is either
+// an instance ID or the value of an instance's Name tag.
+func (p *Provisioner) getInstanceID(ctx context.Context, name string) (*string, error) {
+
+	if strings.HasPrefix(name, "i-") {
+		return aws.String(name), nil
+	}
+
+	out, err := p.ec2Client.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:Name"),
+				Values: []*string{aws.String(name)},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []*string
+	for _, r := range out.Reservations {
+		for _, i := range r.Instances {
+			ids = append(ids, i.InstanceId)
+		}
+	}
+
+	switch len(ids) {
+	case 0:
+		return nil, fmt.Errorf("no instance named '%s' found in region '%s'", name, p.cfg.Region)
+	case 1:
+		return ids[0], nil
+	default:
+		return nil, fmt.Errorf("%d instances are named '%s', use an instance ID instead", len(ids), name)
+	}
+}
+
+// Console writes the serial console output of an instance to w. The instance
+// can be given by its ID or its Name tag. EC2 only keeps the most recent
+// output, and it can take a few minutes after boot to show up.
+func (p *Provisioner) Console(ctx context.Context, name string, w io.Writer) error {
+
+	id, err := p.getInstanceID(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	out, err := p.ec2Client.GetConsoleOutputWithContext(ctx, &ec2.GetConsoleOutputInput{
+		InstanceId: id,
+		Latest:     aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	if out.Output == nil {
+		return fmt.Errorf("instance '%s' has no console output yet", aws.StringValue(id))
+	}
+
+	data, err := base64.StdEncoding.DecodeString(*out.Output)
+	if err != nil {
+		return fmt.Errorf("could not decode console output: %v", err)
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// Export exports the AMI called name to the provisioner's bucket as a raw
+// disk, downloads it to w, and removes it from the bucket again. EC2 can only
+// export AMIs that were imported, which includes those provisioned by
+// vorteil, and needs the 'vmimport' service role to be able to write to the
+// bucket.
+func (p *Provisioner) Export(ctx context.Context, name string, w io.Writer) error {
+
+	imageID, err := p.getImageID(ctx, name)
+	if err != nil {
+		return err
+	}
+	if imageID == nil {
+		return fmt.Errorf("no ami named '%s' found in region '%s'", name, p.cfg.Region)
+	}
+
+	exportProgress := p.log.NewProgress("Exporting AMI to AWS Bucket", "", 0)
+	defer exportProgress.Finish(false)
+
+	prefix := name + "-export-" + uuid.New().String() + "/"
+	var eio *ec2.ExportImageOutput
+	err = p.retry(ctx, func() error {
+		var err error
+		eio, err = p.ec2Client.ExportImageWithContext(ctx, &ec2.ExportImageInput{
+			ImageId:         imageID,
+			DiskImageFormat: aws.String(ec2.DiskImageFormatRaw),
+			S3ExportLocation: &ec2.ExportTaskS3LocationRequest{
+				S3Bucket: aws.String(p.cfg.Bucket),
+				S3Prefix: aws.String(prefix),
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to export ami '%s', error: %v", aws.StringValue(imageID), err)
+	}
+
+	// EC2 names the object after the export task
+	keyName := aws.String(prefix + aws.StringValue(eio.ExportImageTaskId) + ".raw")
+	defer func() {
+		p.log.Infof("Cleaning Image From Bucket %s", aws.StringValue(keyName))
+		_ = p.retry(ctx, func() error {
+			_, err := p.s3Client.DeleteObject(&s3.DeleteObjectInput{
+				Bucket: aws.String(p.cfg.Bucket),
+				Key:    keyName,
+			})
+			return err
+		})
+	}()
+
+	err = p.waitForExport(ctx, eio.ExportImageTaskId)
+	if err != nil {
+		return fmt.Errorf("Failed to export ami '%s', error: %v", aws.StringValue(imageID), err)
+	}
+	exportProgress.Finish(true)
+
+	var goo *s3.GetObjectOutput
+	err = p.retry(ctx, func() error {
+		var err error
+		goo, err = p.s3Client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(p.cfg.Bucket),
+			Key:    keyName,
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to download image from bucket '%s', error: %v", p.cfg.Bucket, err)
+	}
+	defer goo.Body.Close()
+
+	downloadProgress := p.log.NewProgress("Downloading Image", "KiB", aws.Int64Value(goo.ContentLength))
+	pr := downloadProgress.ProxyReader(goo.Body)
+	defer pr.Close()
+
+	_, err = io.Copy(w, pr)
+	downloadProgress.Finish(err == nil)
+	return err
+}
+
+// waitForExport polls the export image task with the given ID until it
+// completes.
+func (p *Provisioner) waitForExport(ctx context.Context, taskID *string) error {
+
+	for {
+		var deito *ec2.DescribeExportImageTasksOutput
+		err := p.retry(ctx, func() error {
+			var err error
+			deito, err = p.ec2Client.DescribeExportImageTasksWithContext(ctx, &ec2.DescribeExportImageTasksInput{
+				ExportImageTaskIds: []*string{taskID},
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(deito.ExportImageTasks) == 0 {
+			return errors.New("No export image task exists for the ami")
+		}
+
+		task := deito.ExportImageTasks[0]
+		switch aws.StringValue(task.Status) {
+		case "completed":
+			return nil
+		case "deleting", "deleted":
+			return errors.New(aws.StringValue(task.StatusMessage))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollrate):
+		}
+	}
+}
+
+// CheckCredentials checks that the bucket can be reached with the
+// provisioner's credentials, and that they're accepted by EC2 in its region.
+func (p *Provisioner) CheckCredentials(ctx context.Context) error {
+
+	_, err := p.s3Client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(p.cfg.Bucket),
+	})
+	if err != nil {
+		return fmt.Errorf("could not access bucket '%s': %v", p.cfg.Bucket, err)
+	}
+
+	_, err = p.ec2Client.DescribeRegionsWithContext(ctx, &ec2.DescribeRegionsInput{
+		RegionNames: aws.StringSlice([]string{p.cfg.Region}),
+	})
+	if err != nil {
+		return fmt.Errorf("could not access EC2 in region '%s': %v", p.cfg.Region, err)
+	}
+
+	return nil
+}
+
+// retryable marks the errors from AWS API calls that are worth retrying:
+// throttling, server errors, and dropped connections. Anything else, such as
+// an authorization failure or an exceeded limit, is returned as it is.
+func retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if request.IsErrorThrottle(err) || request.IsErrorRetryable(err) {
+		return provisioners.Retryable(err)
+	}
+
+	if rf, ok := err.(awserr.RequestFailure); ok && provisioners.RetryableStatus(rf.StatusCode()) {
+		return provisioners.Retryable(err)
+	}
+
+	return err
+}
+
+// retry calls fn, retrying it according to the provision args' retry policy
+// if it fails with a transient error, until ctx is done.
+func (p *Provisioner) retry(ctx context.Context, fn func() error) error {
+	return provisioners.WithRetry(ctx, func() error {
+		return retryable(fn())
+	}, p.args.Retry)
+}
+
 // Marshal returns json provisioner as bytes
 func (p *Provisioner) Marshal() ([]byte, error) {
 	m := make(map[string]interface{})
@@ -11,22 +11,26 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
+	"regexp"
 	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/profiles/latest/compute/mgmt/compute"
 	"github.com/Azure/azure-sdk-for-go/storage"
 	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/azure/auth"
 	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/provisioners"
 	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vio"
 )
 
 const (
@@ -35,6 +39,18 @@ const (
 	blobSize        = 4194304
 )
 
+// tagConstraints are Azure's limits on the tags of a resource. The image's
+// description is stored as a tag too, so it's reserved and counts towards
+// the limit of 50.
+var tagConstraints = &provisioners.TagConstraints{
+	MaxTags:          49,
+	MaxKeyLength:     512,
+	MaxValueLength:   256,
+	Key:              regexp.MustCompile(`^[^<>%&\\?/]*$`),
+	Reserved:         []string{"Description"},
+	ReservedPrefixes: []string{"microsoft", "azure", "windows"},
+}
+
 // Provisioner satisfies the provisioners.Provisioner interface
 type Provisioner struct {
 	cfg *Config
@@ -109,7 +125,7 @@ func (p *Provisioner) Type() string {
 
 // DiskFormat returns the provisioners required disk format
 func (p *Provisioner) DiskFormat() vdisk.Format {
-	return vdisk.VHDFormat
+	return vdisk.VHDFixedFormat
 }
 
 func fetchVal(keyMap map[string]interface{}, name string) string {
@@ -149,6 +165,12 @@ func (p *Provisioner) SizeAlign() vcfg.Bytes {
 	return vcfg.Bytes(0)
 }
 
+// WantsCompressed returns false, because Azure needs the size of the VHD up
+// front to create the page blob it's uploaded to.
+func (p *Provisioner) WantsCompressed() bool {
+	return false
+}
+
 func (p *Provisioner) getBlobRef(name string) (*storage.Blob, error) {
 
 	creds, err := azblob.NewSharedKeyCredential(p.cfg.StorageAccountName, p.cfg.StorageAccountKey)
@@ -181,12 +203,11 @@ func (p *Provisioner) getBlobRef(name string) (*storage.Blob, error) {
 
 }
 
-func (p *Provisioner) getImagesClient() (compute.ImagesClient, error) {
+func (p *Provisioner) getAuthorizer() (autorest.Authorizer, error) {
 
-	imagesClient := compute.NewImagesClient(p.subscriptionID)
 	settings, err := auth.GetSettingsFromEnvironment()
 	if err != nil {
-		return imagesClient, err
+		return nil, err
 	}
 
 	settings.Values[auth.SubscriptionID] = p.subscriptionID
@@ -196,12 +217,122 @@ func (p *Provisioner) getImagesClient() (compute.ImagesClient, error) {
 	settings.Values[auth.Resource] = p.resourceManagerEndpointURL
 	settings.Values[auth.TenantID] = p.tenantID
 
-	imagesClient.Authorizer, err = settings.GetAuthorizer()
+	return settings.GetAuthorizer()
+
+}
+
+func (p *Provisioner) getImagesClient() (compute.ImagesClient, error) {
+
+	imagesClient := compute.NewImagesClient(p.subscriptionID)
+
+	var err error
+	imagesClient.Authorizer, err = p.getAuthorizer()
 
 	return imagesClient, err
 
 }
 
+func (p *Provisioner) getVirtualMachinesClient() (compute.VirtualMachinesClient, error) {
+
+	vmClient := compute.NewVirtualMachinesClient(p.subscriptionID)
+
+	var err error
+	vmClient.Authorizer, err = p.getAuthorizer()
+
+	return vmClient, err
+
+}
+
+// Console writes the serial log kept by boot diagnostics for the VM called
+// name, in the provisioner's resource group, to w. Boot diagnostics must be
+// enabled on the VM, and must store its logs in the provisioner's storage
+// account, because that's the only one it has a key for.
+func (p *Provisioner) Console(ctx context.Context, name string, w io.Writer) error {
+
+	vmClient, err := p.getVirtualMachinesClient()
+	if err != nil {
+		return err
+	}
+
+	view, err := vmClient.InstanceView(ctx, p.cfg.ResourceGroup, name)
+	if err != nil {
+		return err
+	}
+
+	if view.BootDiagnostics == nil || view.BootDiagnostics.SerialConsoleLogBlobURI == nil {
+		return fmt.Errorf("VM '%s' has no serial log: boot diagnostics must be enabled", name)
+	}
+
+	u, err := url.Parse(*view.BootDiagnostics.SerialConsoleLogBlobURI)
+	if err != nil {
+		return err
+	}
+
+	account := strings.SplitN(u.Host, ".", 2)[0]
+	if account != p.cfg.StorageAccountName {
+		return fmt.Errorf("boot diagnostics for VM '%s' are stored in storage account '%s', not '%s'", name, account, p.cfg.StorageAccountName)
+	}
+
+	blobPath := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if len(blobPath) != 2 {
+		return fmt.Errorf("unexpected serial log location: %s", u)
+	}
+
+	storageClient, err := storage.NewBasicClient(p.cfg.StorageAccountName, p.cfg.StorageAccountKey)
+	if err != nil {
+		return err
+	}
+
+	blobService := storageClient.GetBlobService()
+	blob := blobService.GetContainerReference(blobPath[0]).GetBlobReference(blobPath[1])
+	rc, err := blob.Get(nil)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = io.Copy(w, rc)
+	return err
+
+}
+
+// Export returns provisioners.ErrExportUnsupported, because managed images
+// can't be exported from Azure without first creating a disk from them.
+func (p *Provisioner) Export(ctx context.Context, name string, w io.Writer) error {
+	return fmt.Errorf("%s: %w", ProvisionerType, provisioners.ErrExportUnsupported)
+}
+
+// CheckCredentials checks that the service principal can list the images in
+// the provisioner's resource group, and that the storage account key is
+// accepted. The container doesn't have to exist yet, because provisioning
+// creates it.
+func (p *Provisioner) CheckCredentials(ctx context.Context) error {
+
+	imagesClient, err := p.getImagesClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = imagesClient.ListByResourceGroup(ctx, p.cfg.ResourceGroup)
+	if err != nil {
+		return fmt.Errorf("could not list images in resource group '%s': %v", p.cfg.ResourceGroup, err)
+	}
+
+	storageClient, err := storage.NewBasicClient(p.cfg.StorageAccountName, p.cfg.StorageAccountKey)
+	if err != nil {
+		return err
+	}
+
+	blobService := storageClient.GetBlobService()
+	_, err = blobService.GetContainerReference(p.cfg.Container).Exists()
+	if err != nil {
+		return fmt.Errorf("could not access storage account '%s': %v", p.cfg.StorageAccountName, err)
+	}
+
+	return nil
+
+}
+
 func bytesToGB(l int64) int32 {
 
 	g := int64(1024 * 1024 * 1024)
@@ -217,13 +348,30 @@ func bytesToGB(l int64) int32 {
 
 func prepTempFile(args *provisioners.ProvisionArgs) (*os.File, int64, error) {
 
-	f, err := ioutil.TempFile(os.TempDir(), "")
+	dir := args.TempDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	avail, err := vio.FreeSpace(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	need := int64(args.Image.Size())
+	if avail >= 0 && avail < need {
+		return nil, 0, fmt.Errorf("not enough free space in %s for a copy of the disk: need %s, have %s", dir, vcfg.Bytes(need), vcfg.Bytes(avail))
+	}
+
+	f, err := ioutil.TempFile(dir, "vorteil-azure-")
 	if err != nil {
 		return nil, 0, err
 	}
 
 	n, err := io.Copy(f, args.Image)
 	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
 		return nil, 0, err
 	}
 
@@ -231,12 +379,15 @@ func prepTempFile(args *provisioners.ProvisionArgs) (*os.File, int64, error) {
 
 }
 
-func (p *Provisioner) uploadBlob(f *os.File, args *provisioners.ProvisionArgs, blob *storage.Blob) error {
+func (p *Provisioner) uploadBlob(f *os.File, args *provisioners.ProvisionArgs, blob *storage.Blob, rb *provisioners.Rollback) error {
 
 	var ps int64
 
 	if args.Force {
-		_, err := blob.DeleteIfExists(&storage.DeleteBlobOptions{})
+		err := retry(args, func() error {
+			_, err := blob.DeleteIfExists(&storage.DeleteBlobOptions{})
+			return err
+		})
 		if err != nil {
 			return err
 		}
@@ -246,11 +397,20 @@ func (p *Provisioner) uploadBlob(f *os.File, args *provisioners.ProvisionArgs, b
 	pr := progress.ProxyReader(f)
 	defer pr.Close()
 
-	err := blob.PutPageBlob(nil)
+	err := retry(args, func() error {
+		return blob.PutPageBlob(nil)
+	})
 	if err != nil {
 		return err
 	}
 
+	rb.Track(fmt.Sprintf("page blob '%s'", blob.Name), func() error {
+		return retry(args, func() error {
+			_, err := blob.DeleteIfExists(&storage.DeleteBlobOptions{})
+			return err
+		})
+	})
+
 	reader := bufio.NewReader(pr)
 	buf := make([]byte, blobSize)
 
@@ -278,7 +438,9 @@ func (p *Provisioner) uploadBlob(f *os.File, args *provisioners.ProvisionArgs, b
 			buf = buf[:n]
 		}
 
-		err = blob.WriteRange(br, bytes.NewReader(buf), nil)
+		err = retry(args, func() error {
+			return blob.WriteRange(br, bytes.NewReader(buf), nil)
+		})
 		if err != nil {
 			progress.Finish(false)
 			return err
@@ -290,15 +452,34 @@ func (p *Provisioner) uploadBlob(f *os.File, args *provisioners.ProvisionArgs, b
 
 }
 
-// Provision will provision the configured vorteil project to your configured gcp provisioner
-func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
+// Provision will provision the configured vorteil project to your configured
+// azure provisioner. If it fails part way through, the blob and image it
+// created are removed unless args.KeepOnFailure is set.
+func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) (err error) {
+
+	// Data disks in an Azure image must be made from an existing blob or
+	// snapshot, so empty ones have to be added when a VM is created.
+	if err := provisioners.CheckDataDisks(ProvisionerType, args); err != nil {
+		return err
+	}
+	if err := tagConstraints.Validate(ProvisionerType, args.Tags); err != nil {
+		return err
+	}
 
 	var (
 		length int64
 		f      *os.File
+		blob   *storage.Blob
 	)
 
-	blob, err := p.getBlobRef(args.Name)
+	rb := provisioners.NewRollback(p.log)
+	defer func() {
+		if err != nil {
+			_ = rb.Run(args.KeepOnFailure)
+		}
+	}()
+
+	blob, err = p.getBlobRef(args.Name)
 	if err != nil {
 		return err
 	}
@@ -308,16 +489,17 @@ func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 		return err
 	}
 	defer os.Remove(f.Name())
+	defer f.Close()
 
 	blob.Properties.ContentType = "text/plain"
 	blob.Properties.ContentLength = length
 
-	err = p.uploadBlob(f, args, blob)
+	err = p.uploadBlob(f, args, blob, rb)
 	if err != nil {
 		return err
 	}
 
-	err = p.createImage(length, args, blob)
+	err = p.createImage(length, args, blob, rb)
 	if err != nil {
 		return err
 	}
@@ -327,7 +509,12 @@ func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 
 func (p *Provisioner) deleteImageIfRequired(imagesClient compute.ImagesClient, args *provisioners.ProvisionArgs) error {
 
-	result, err := imagesClient.Get(args.Context, p.cfg.ResourceGroup, args.Name, "")
+	var result compute.Image
+	err := retry(args, func() error {
+		var err error
+		result, err = imagesClient.Get(args.Context, p.cfg.ResourceGroup, args.Name, "")
+		return err
+	})
 	if err == nil || result.ID != nil {
 		// image already exists
 		if !args.Force {
@@ -337,12 +524,7 @@ func (p *Provisioner) deleteImageIfRequired(imagesClient compute.ImagesClient, a
 		ciprogree := p.log.NewProgress("Deleting existing image", "", 0)
 		defer ciprogree.Finish(false)
 
-		delFuture, err := imagesClient.Delete(args.Context, p.cfg.ResourceGroup, args.Name)
-		if err != nil {
-			return err
-		}
-
-		err = delFuture.WaitForCompletionRef(args.Context, imagesClient.Client)
+		err = p.deleteImage(imagesClient, args)
 		if err != nil {
 			return err
 		}
@@ -351,7 +533,24 @@ func (p *Provisioner) deleteImageIfRequired(imagesClient compute.ImagesClient, a
 	return nil
 }
 
-func (p *Provisioner) createImage(length int64, args *provisioners.ProvisionArgs, blob *storage.Blob) error {
+func (p *Provisioner) deleteImage(imagesClient compute.ImagesClient, args *provisioners.ProvisionArgs) error {
+
+	var delFuture compute.ImagesDeleteFuture
+	err := retry(args, func() error {
+		var err error
+		delFuture, err = imagesClient.Delete(args.Context, p.cfg.ResourceGroup, args.Name)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return retry(args, func() error {
+		return delFuture.WaitForCompletionRef(args.Context, imagesClient.Client)
+	})
+}
+
+func (p *Provisioner) createImage(length int64, args *provisioners.ProvisionArgs, blob *storage.Blob, rb *provisioners.Rollback) error {
 
 	imagesClient, err := p.getImagesClient()
 	if err != nil {
@@ -377,17 +576,32 @@ func (p *Provisioner) createImage(length int64, args *provisioners.ProvisionArgs
 	// set description as a tag
 	tags := make(map[string]*string)
 	tags["Description"] = &args.Description
+	for k, v := range args.Tags {
+		v := v
+		tags[k] = &v
+	}
 	img.Tags = tags
 	u := blob.GetURL()
 	img.StorageProfile.OsDisk.BlobURI = &u
 	img.HyperVGeneration = compute.HyperVGenerationTypesV1
 
-	future, err := imagesClient.CreateOrUpdate(args.Context, p.cfg.ResourceGroup, args.Name, *img)
+	var future compute.ImagesCreateOrUpdateFuture
+	err = retry(args, func() error {
+		var err error
+		future, err = imagesClient.CreateOrUpdate(args.Context, p.cfg.ResourceGroup, args.Name, *img)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	err = future.WaitForCompletionRef(args.Context, imagesClient.Client)
+	rb.Track(fmt.Sprintf("image '%s'", args.Name), func() error {
+		return p.deleteImage(imagesClient, args)
+	})
+
+	err = retry(args, func() error {
+		return future.WaitForCompletionRef(args.Context, imagesClient.Client)
+	})
 	if err != nil {
 		return err
 	}
@@ -396,6 +610,37 @@ func (p *Provisioner) createImage(length int64, args *provisioners.ProvisionArgs
 
 }
 
+// retryable marks the errors from Azure API calls that are worth retrying:
+// throttling, a busy server, and server errors. Anything else, such as an
+// authentication failure or an exceeded quota, is returned as it is.
+func retryable(err error) error {
+
+	var serr storage.AzureStorageServiceError
+	if errors.As(err, &serr) {
+		if serr.Code == "ServerBusy" || provisioners.RetryableStatus(serr.StatusCode) {
+			return provisioners.Retryable(err)
+		}
+		return err
+	}
+
+	var derr autorest.DetailedError
+	if errors.As(err, &derr) {
+		if code, ok := derr.StatusCode.(int); ok && provisioners.RetryableStatus(code) {
+			return provisioners.Retryable(err)
+		}
+	}
+
+	return err
+}
+
+// retry calls fn, retrying it according to args' retry policy if it fails
+// with a transient error.
+func retry(args *provisioners.ProvisionArgs, fn func() error) error {
+	return provisioners.WithRetry(args.Context, func() error {
+		return retryable(fn())
+	}, args.Retry)
+}
+
 // Marshal returns json provisioner as bytes
 func (p *Provisioner) Marshal() ([]byte, error) {
 
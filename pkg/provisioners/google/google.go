@@ -6,12 +6,16 @@ package google
  */
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"path"
+	"regexp"
 	"strings"
 	"time"
 
@@ -23,7 +27,9 @@ import (
 	"github.com/vorteil/vorteil/pkg/vdisk"
 	"golang.org/x/oauth2/google"
 	"golang.org/x/oauth2/jwt"
+	"google.golang.org/api/cloudbuild/v1"
 	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
 
@@ -37,6 +43,9 @@ type Provisioner struct {
 	keyMap        map[string]interface{}
 	computeClient *compute.Service
 	jsonKey       []byte
+
+	bucketLocation     string
+	bucketLocationType string
 }
 
 // ProvisionerArgs TODO:
@@ -47,8 +56,9 @@ type ProvisionerArgs struct {
 
 // Config contains configuration fields required by the Provisioner
 type Config struct {
-	Bucket string `json:"bucket"` // Name of the bucket
-	Key    string `json:"key"`    // base64 encoded contents of a (JSON) Google Cloud Platform service account key file
+	Bucket   string `json:"bucket"`             // Name of the bucket
+	Key      string `json:"key"`                // base64 encoded contents of a (JSON) Google Cloud Platform service account key file
+	Location string `json:"location,omitempty"` // Region or multi-region to store images in, empty for the default
 }
 
 // ProvisionArgs TODO:
@@ -64,12 +74,28 @@ const (
 	ProvisionerType = "google-compute"
 	statusDone      = "DONE"
 	waitInSecs      = 120
+
+	// exportBuilder is the Cloud Build step that 'gcloud compute images
+	// export' uses to export images to a bucket. Without a format it writes
+	// the same gzipped tar of a raw disk that images are created from.
+	exportBuilder = "gcr.io/compute-image-tools/gce_vm_image_export:release"
+	exportTimeout = 2 * time.Hour
 )
 
 var scopes = []string{
 	"https://www.googleapis.com/auth/cloud-platform",
 }
 
+// tagConstraints are Compute Engine's limits on labels, which is what tags
+// are applied as.
+var tagConstraints = &provisioners.TagConstraints{
+	MaxTags:        64,
+	MaxKeyLength:   63,
+	MaxValueLength: 63,
+	Key:            regexp.MustCompile(`^[a-z][a-z0-9_-]*$`),
+	Value:          regexp.MustCompile(`^[a-z0-9_-]*$`),
+}
+
 // Validate ...
 func (p *Provisioner) Validate() error {
 	if p.cfg.Bucket == "" {
@@ -80,6 +106,82 @@ func (p *Provisioner) Validate() error {
 		return errors.New("no defined key")
 	}
 
+	if p.cfg.Location != "" && !locationPattern.MatchString(p.cfg.Location) {
+		return fmt.Errorf("invalid location '%s': should be a region like 'us-central1' or a multi-region like 'us'", p.cfg.Location)
+	}
+
+	return nil
+}
+
+var locationPattern = regexp.MustCompile(`^[a-z]+(-[a-z]+[0-9]+)?$`)
+
+// multiRegions maps each multi-region to the prefix of the regions in it.
+var multiRegions = map[string]string{
+	"us":   "us-",
+	"eu":   "europe-",
+	"asia": "asia-",
+}
+
+// dualRegions maps each predefined dual-region to the regions in it.
+var dualRegions = map[string][]string{
+	"asia1": {"asia-northeast1", "asia-northeast2"},
+	"eur4":  {"europe-north1", "europe-west4"},
+	"nam4":  {"us-central1", "us-east1"},
+}
+
+// locationContains returns true if the region, dual-region, or multi-region
+// inner is covered by outer.
+func locationContains(outer, inner string) bool {
+
+	if outer == inner {
+		return true
+	}
+
+	regions, ok := dualRegions[inner]
+	if !ok {
+		regions = []string{inner}
+	}
+
+	for _, region := range regions {
+		covered := false
+		if prefix, ok := multiRegions[outer]; ok && strings.HasPrefix(region, prefix) {
+			covered = true
+		}
+		for _, r := range dualRegions[outer] {
+			if r == region {
+				covered = true
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkBucketLocation logs the location of the bucket, and warns if it isn't
+// in the same place as the image will be stored, which makes creating the
+// image slower. With strict set it returns an error instead.
+func (p *Provisioner) checkBucketLocation(strict bool) error {
+
+	p.log.Infof("Bucket '%s' location: %s", p.cfg.Bucket, p.bucketLocation)
+
+	image := strings.ToLower(p.cfg.Location)
+	if image == "" || p.bucketLocation == "" {
+		return nil
+	}
+
+	if locationContains(p.bucketLocation, image) || locationContains(image, p.bucketLocation) {
+		return nil
+	}
+
+	msg := fmt.Sprintf("bucket '%s' is in %s but the image will be stored in %s, so it has to be copied between locations", p.cfg.Bucket, p.bucketLocation, image)
+	if strict {
+		return errors.New(msg)
+	}
+
+	p.log.Warnf("%s", msg)
 	return nil
 }
 
@@ -116,11 +218,15 @@ func (p *Provisioner) init() error {
 	}
 
 	p.bucketHandle = p.storageClient.Bucket(p.cfg.Bucket)
-	_, err = p.bucketHandle.Attrs(context.Background())
+	attrs, err := p.bucketHandle.Attrs(context.Background())
 	if err != nil {
 		return fmt.Errorf("failed to communicate with gcp bucket: %v", err)
 	}
 
+	p.bucketLocation = strings.ToLower(attrs.Location)
+	p.bucketLocationType = attrs.LocationType
+	p.log.Debugf("Bucket '%s' is in %s (%s)", p.cfg.Bucket, p.bucketLocation, p.bucketLocationType)
+
 	oauthToken, err = google.JWTConfigFromJSON(key, scopes...)
 	if err != nil {
 		return fmt.Errorf("failed to decypher JWT: %v", err)
@@ -171,11 +277,43 @@ func (p *Provisioner) SizeAlign() vcfg.Bytes {
 	return vcfg.GiB
 }
 
-// Provision provisions BUILDABLE to GCP
-func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
+// WantsCompressed returns true, because GCP archives are gzipped as they're
+// built and uploaded to the bucket as a stream.
+func (p *Provisioner) WantsCompressed() bool {
+	return true
+}
+
+// Provision provisions BUILDABLE to GCP. If it fails part way through, the
+// bucket object and image it created are removed unless args.KeepOnFailure is
+// set.
+func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) (err error) {
+
+	// Compute Engine images only hold a single disk, so data disks have to
+	// be added when an instance is created.
+	if err := provisioners.CheckDataDisks(ProvisionerType, args); err != nil {
+		return err
+	}
+	if err := tagConstraints.Validate(ProvisionerType, args.Tags); err != nil {
+		return err
+	}
+	if err := p.checkBucketLocation(args.Strict); err != nil {
+		return err
+	}
 	projectID := p.keyMap["project_id"].(string)
 
-	img, err := p.computeClient.Images.Get(projectID, args.Name).Do()
+	rb := provisioners.NewRollback(p.log)
+	defer func() {
+		if err != nil {
+			_ = rb.Run(args.KeepOnFailure)
+		}
+	}()
+
+	var img *compute.Image
+	err = retry(args, func() error {
+		var err error
+		img, err = p.computeClient.Images.Get(projectID, args.Name).Do()
+		return err
+	})
 	if err == nil && !args.Force {
 		return fmt.Errorf("image '%s' already exists", args.Name)
 	}
@@ -183,14 +321,34 @@ func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 	name := strings.Replace(fmt.Sprintf("%s.tar.gz", uuid.New().String()), "-", "", -1)
 	obj := p.bucketHandle.Object(name)
 
-	_, err = obj.Attrs(args.Context)
+	err = retry(args, func() error {
+		_, err := obj.Attrs(args.Context)
+		return err
+	})
 	if err == nil {
 		return fmt.Errorf("object '%s' already exists", name)
 	}
 
+	deleteObject := func() error {
+		err := retry(args, func() error {
+			return obj.Delete(args.Context)
+		})
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			err = nil
+		}
+		return err
+	}
+	rb.Track(fmt.Sprintf("bucket object '%s'", name), deleteObject)
+
 	w := obj.NewWriter(args.Context)
 
-	progress := p.log.NewProgress(fmt.Sprintf("Uploading %s:", args.Name), "KiB", int64(args.Image.Size()))
+	// the image is streamed while it's built if its size isn't known yet
+	var progress elog.Progress
+	if args.Image.Size() == 0 {
+		progress = p.log.NewProgress(fmt.Sprintf("Uploading %s:", args.Name), "", 0)
+	} else {
+		progress = p.log.NewProgress(fmt.Sprintf("Uploading %s:", args.Name), "KiB", int64(args.Image.Size()))
+	}
 	pr := progress.ProxyReader(args.Image)
 	defer pr.Close()
 
@@ -200,21 +358,253 @@ func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
 		w.Close()
 		return err
 	}
-	w.Close()
+	err = w.Close()
+	if err != nil {
+		progress.Finish(false)
+		return err
+	}
 	progress.Finish(true)
 
 	defer func() {
-		obj.Delete(args.Context)
+		// the uploaded object is only needed to create the image, so it's
+		// removed on success too
+		if err == nil {
+			_ = deleteObject()
+		}
 	}()
 
 	if args.Force && img != nil {
-		err := p.deleteConflictingImage(projectID, args.Name)
+		err = p.deleteConflictingImage(projectID, args.Name, args)
 		if err != nil {
 			return err
 		}
 	}
 
-	return p.uploadImage(projectID, name, args)
+	return p.uploadImage(projectID, name, args, rb)
+}
+
+// findInstanceZone returns the zone of the instance called name.
+func (p *Provisioner) findInstanceZone(ctx context.Context, projectID, name string) (string, error) {
+
+	var zones []string
+	err := p.computeClient.Instances.AggregatedList(projectID).
+		Filter(fmt.Sprintf("name = %s", name)).
+		Pages(ctx, func(list *compute.InstanceAggregatedList) error {
+			for _, scoped := range list.Items {
+				for _, inst := range scoped.Instances {
+					if inst.Name == name {
+						zones = append(zones, path.Base(inst.Zone))
+					}
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return "", err
+	}
+
+	switch len(zones) {
+	case 0:
+		return "", fmt.Errorf("no instance named '%s' found in project '%s'", name, projectID)
+	case 1:
+		return zones[0], nil
+	default:
+		return "", fmt.Errorf("instances named '%s' exist in more than one zone (%s)", name, strings.Join(zones, ", "))
+	}
+}
+
+// Console writes the output of the first serial port of the instance called
+// name to w. Compute Engine only keeps the most recent 1 MiB of output.
+func (p *Provisioner) Console(ctx context.Context, name string, w io.Writer) error {
+
+	projectID, _ := p.keyMap["project_id"].(string)
+
+	zone, err := p.findInstanceZone(ctx, projectID, name)
+	if err != nil {
+		return err
+	}
+
+	out, err := p.computeClient.Instances.GetSerialPortOutput(projectID, zone, name).Port(1).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, out.Contents)
+	return err
+}
+
+// Export exports the image called name to the provisioner's bucket, downloads
+// its disk to w, and removes it from the bucket again. Compute Engine has no
+// API to export images, so like 'gcloud compute images export' this runs a
+// Cloud Build in the provisioner's project, which needs the Cloud Build API
+// enabled and its service account to have access to Compute Engine.
+func (p *Provisioner) Export(ctx context.Context, name string, w io.Writer) error {
+
+	args := &provisioners.ProvisionArgs{Context: ctx}
+	projectID, _ := p.keyMap["project_id"].(string)
+
+	err := retry(args, func() error {
+		_, err := p.computeClient.Images.Get(projectID, name).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not find image '%s' in project '%s': %v", name, projectID, err)
+	}
+
+	buildClient, err := cloudbuild.NewService(ctx, option.WithCredentialsJSON(p.jsonKey))
+	if err != nil {
+		return fmt.Errorf("failed to create gcp cloud build client: %v", err)
+	}
+
+	key := fmt.Sprintf("%s-export-%s.tar.gz", name, uuid.New().String())
+	obj := p.bucketHandle.Object(key)
+	defer func() {
+		_ = retry(args, func() error {
+			err := obj.Delete(ctx)
+			if errors.Is(err, storage.ErrObjectNotExist) {
+				err = nil
+			}
+			return err
+		})
+	}()
+
+	progress := p.log.NewProgress("Exporting Image", "", 0)
+	defer progress.Finish(false)
+
+	var op *cloudbuild.Operation
+	err = retry(args, func() error {
+		var err error
+		op, err = buildClient.Projects.Builds.Create(projectID, &cloudbuild.Build{
+			Timeout: fmt.Sprintf("%.0fs", exportTimeout.Seconds()),
+			Tags:    []string{"vorteil-export"},
+			Steps: []*cloudbuild.BuildStep{
+				{
+					Name: exportBuilder,
+					Args: []string{
+						"-client_id=api",
+						fmt.Sprintf("-timeout=%.0fs", exportTimeout.Seconds()),
+						fmt.Sprintf("-source_image=projects/%s/global/images/%s", projectID, name),
+						fmt.Sprintf("-destination_uri=gs://%s/%s", p.cfg.Bucket, key),
+					},
+				},
+			},
+		}).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start image export: %v", err)
+	}
+
+	err = p.waitForBuild(ctx, buildClient, projectID, op)
+	if err != nil {
+		return fmt.Errorf("failed to export image '%s': %v", name, err)
+	}
+	progress.Finish(true)
+
+	var r *storage.Reader
+	err = retry(args, func() error {
+		var err error
+		r, err = obj.NewReader(ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download image from bucket '%s': %v", p.cfg.Bucket, err)
+	}
+	defer r.Close()
+
+	progress = p.log.NewProgress("Downloading Image", "KiB", r.Attrs.Size)
+	pr := progress.ProxyReader(r)
+	defer pr.Close()
+
+	err = extractRawDisk(pr, w)
+	progress.Finish(err == nil)
+	return err
+}
+
+// waitForBuild polls the build started by op until it finishes, and returns
+// an error if it didn't succeed.
+func (p *Provisioner) waitForBuild(ctx context.Context, client *cloudbuild.Service, projectID string, op *cloudbuild.Operation) error {
+
+	var md cloudbuild.BuildOperationMetadata
+	err := json.Unmarshal(op.Metadata, &md)
+	if err != nil || md.Build == nil {
+		return fmt.Errorf("could not find build in operation '%s'", op.Name)
+	}
+
+	args := &provisioners.ProvisionArgs{Context: ctx}
+	build := md.Build
+
+	for {
+		switch build.Status {
+		case "SUCCESS":
+			return nil
+		case "", "STATUS_UNKNOWN", "QUEUED", "WORKING":
+		default:
+			return fmt.Errorf("build %s: %s (see %s)", strings.ToLower(build.Status), build.StatusDetail, build.LogUrl)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+
+		id := build.Id
+		err = retry(args, func() error {
+			var err error
+			build, err = client.Projects.Builds.Get(projectID, id).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// extractRawDisk copies the disk.raw file out of a gzipped tar in the format
+// that Compute Engine imports and exports images in, from r to w.
+func extractRawDisk(r io.Reader, w io.Writer) error {
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("exported image is not gzipped: %v", err)
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return errors.New("exported image has no disk.raw")
+		}
+		if err != nil {
+			return fmt.Errorf("could not read exported image: %v", err)
+		}
+
+		if path.Clean(hdr.Name) == "disk.raw" {
+			_, err = io.Copy(w, tr)
+			return err
+		}
+	}
+}
+
+// CheckCredentials checks that the bucket can be reached with the
+// provisioner's service account, and that it can list the images in its
+// project.
+func (p *Provisioner) CheckCredentials(ctx context.Context) error {
+
+	_, err := p.bucketHandle.Attrs(ctx)
+	if err != nil {
+		return fmt.Errorf("could not access bucket '%s': %v", p.cfg.Bucket, err)
+	}
+
+	projectID, _ := p.keyMap["project_id"].(string)
+	_, err = p.computeClient.Images.List(projectID).MaxResults(1).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("could not list images in project '%s': %v", projectID, err)
+	}
+
+	return nil
 }
 
 // Marshal returns json provisioner as bytes
@@ -224,6 +614,9 @@ func (p *Provisioner) Marshal() ([]byte, error) {
 	m[provisioners.MapKey] = ProvisionerType
 	m["bucket"] = p.cfg.Bucket
 	m["key"] = p.cfg.Key
+	if p.cfg.Location != "" {
+		m["location"] = p.cfg.Location
+	}
 
 	out, err := json.Marshal(m)
 	if err != nil {
@@ -234,27 +627,47 @@ func (p *Provisioner) Marshal() ([]byte, error) {
 }
 
 // utils
-func (p *Provisioner) uploadImage(projectID, file string, args *provisioners.ProvisionArgs) error {
+func (p *Provisioner) uploadImage(projectID, file string, args *provisioners.ProvisionArgs, rb *provisioners.Rollback) error {
 
 	ciprogree := p.log.NewProgress("Creating Image", "", 0)
 	defer ciprogree.Finish(false)
 
-	op, err := p.computeClient.Images.Insert(projectID, &compute.Image{
-		Name: args.Name,
-		RawDisk: &compute.ImageRawDisk{
-			Source: fmt.Sprintf("https://storage.googleapis.com/%s/%s", p.cfg.Bucket, file),
-		},
-		Description: args.Description,
-	}).Do()
+	var locations []string
+	if p.cfg.Location != "" {
+		locations = []string{p.cfg.Location}
+	}
+
+	var op *compute.Operation
+	err := retry(args, func() error {
+		var err error
+		op, err = p.computeClient.Images.Insert(projectID, &compute.Image{
+			Name: args.Name,
+			RawDisk: &compute.ImageRawDisk{
+				Source: fmt.Sprintf("https://storage.googleapis.com/%s/%s", p.cfg.Bucket, file),
+			},
+			Description:      args.Description,
+			Labels:           args.Tags,
+			StorageLocations: locations,
+		}).Do()
+		return err
+	})
 
 	if err != nil {
 		return err
 	}
 
+	rb.Track(fmt.Sprintf("image '%s'", args.Name), func() error {
+		return p.deleteImage(projectID, args.Name, args)
+	})
+
 	var pollTimeout int
 	for op.Status != statusDone && pollTimeout <= waitInSecs {
 		<-time.After(time.Second)
-		op, err = p.computeClient.GlobalOperations.Get(projectID, op.Name).Do()
+		err = retry(args, func() error {
+			var err error
+			op, err = p.computeClient.GlobalOperations.Get(projectID, op.Name).Do()
+			return err
+		})
 		if err != nil {
 			return err
 		}
@@ -268,21 +681,29 @@ func (p *Provisioner) uploadImage(projectID, file string, args *provisioners.Pro
 	return nil
 }
 
-func (p *Provisioner) deleteImage(projectID, name string) error {
+func (p *Provisioner) deleteImage(projectID, name string, args *provisioners.ProvisionArgs) error {
 
 	var (
 		err   error
 		delOp *compute.Operation
 	)
 
-	delOp, err = p.computeClient.Images.Delete(projectID, name).Do()
+	err = retry(args, func() error {
+		var err error
+		delOp, err = p.computeClient.Images.Delete(projectID, name).Do()
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
 	var pollTimeout int
 	for delOp.Status != statusDone && pollTimeout <= waitInSecs {
-		delOp, err = p.computeClient.GlobalOperations.Get(projectID, delOp.Name).Do()
+		err = retry(args, func() error {
+			var err error
+			delOp, err = p.computeClient.GlobalOperations.Get(projectID, delOp.Name).Do()
+			return err
+		})
 		if err != nil {
 			break
 		}
@@ -301,7 +722,7 @@ func (p *Provisioner) deleteImage(projectID, name string) error {
 	return nil
 }
 
-func (p *Provisioner) deleteConflictingImage(projectID, name string) error {
+func (p *Provisioner) deleteConflictingImage(projectID, name string, args *provisioners.ProvisionArgs) error {
 
 	var (
 		err  error
@@ -310,17 +731,53 @@ func (p *Provisioner) deleteConflictingImage(projectID, name string) error {
 
 	// args.Logger.Infof("Deleting conflicting image.")
 	imagesForce := p.computeClient.Images.List(projectID)
-	list, err = imagesForce.Do()
+	err = retry(args, func() error {
+		var err error
+		list, err = imagesForce.Do()
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
 	for _, image := range list.Items {
 		if image.Name == name {
-			err = p.deleteImage(projectID, name)
+			err = p.deleteImage(projectID, name, args)
 			break
 		}
 	}
 
 	return err
 }
+
+// retryable marks the errors from Google Cloud API calls that are worth
+// retrying: throttling, rate limiting, and server errors. Anything else, such
+// as an authentication failure or an exceeded quota, is returned as it is.
+func retryable(err error) error {
+
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return err
+	}
+
+	if provisioners.RetryableStatus(gerr.Code) {
+		return provisioners.Retryable(err)
+	}
+
+	for _, item := range gerr.Errors {
+		switch item.Reason {
+		case "rateLimitExceeded", "userRateLimitExceeded":
+			return provisioners.Retryable(err)
+		}
+	}
+
+	return err
+}
+
+// retry calls fn, retrying it according to args' retry policy if it fails
+// with a transient error.
+func retry(args *provisioners.ProvisionArgs, fn func() error) error {
+	return provisioners.WithRetry(args.Context, func() error {
+		return retryable(fn())
+	}, args.Retry)
+}
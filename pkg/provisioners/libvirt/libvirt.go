@@ -0,0 +1,426 @@
+package libvirt
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/provisioners"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+)
+
+const (
+	// ProvisionerType : Constant string value used to represent the provisioner type libvirt
+	ProvisionerType = "libvirt"
+
+	// DefaultURI is the libvirt connection URI used if none is configured,
+	// which is the system instance of the local QEMU/KVM driver.
+	DefaultURI = "qemu:///system"
+
+	// DefaultPool is the storage pool disks are uploaded to if none is
+	// configured.
+	DefaultPool = "default"
+
+	// DefaultNetwork is the network domains are connected to if none is
+	// configured.
+	DefaultNetwork = "default"
+
+	// defaultRAM and defaultCPUs size domains for VCFGs that leave them to
+	// their defaults, and match the defaults of vcfg.ApplyDefaults.
+	defaultRAM  = 128 * vcfg.MiB
+	defaultCPUs = 1
+)
+
+// errNoVirsh is returned when virsh can't be found, so that it's clear the
+// problem is on this machine rather than the libvirt host.
+var errNoVirsh = errors.New("virsh is not installed: it's needed to connect to libvirt")
+
+// Provisioner satisfies the provisioners.Provisioner interface
+type Provisioner struct {
+	cfg *Config
+	log elog.View
+}
+
+// Config contains configuration fields required by the Provisioner
+type Config struct {
+	URI     string `json:"uri"`     // libvirt connection URI, or empty for DefaultURI
+	Pool    string `json:"pool"`    // storage pool to upload disks to, or empty for DefaultPool
+	Network string `json:"network"` // network for the domain's NIC, or empty for DefaultNetwork
+	Start   bool   `json:"start"`   // start domains once they're defined
+}
+
+// NewProvisioner - Create a libvirt Provisioner object
+func NewProvisioner(log elog.View, cfg *Config) (*Provisioner, error) {
+	p := new(Provisioner)
+	p.cfg = cfg
+	p.log = log
+	err := p.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s provisioner: %v", ProvisionerType, err)
+	}
+
+	return p, nil
+}
+
+// Validate ...
+func (p *Provisioner) Validate() error {
+
+	for _, s := range []string{p.cfg.Pool, p.cfg.Network} {
+		if strings.ContainsAny(s, "/'\"") {
+			return fmt.Errorf("invalid name: '%s'", s)
+		}
+	}
+
+	return nil
+}
+
+// Type returns 'libvirt'
+func (p *Provisioner) Type() string {
+	return ProvisionerType
+}
+
+// DiskFormat returns the provisioners required disk format. Disks are
+// uploaded raw, because there's no qcow2 image format, and raw volumes work
+// with every type of storage pool.
+func (p *Provisioner) DiskFormat() vdisk.Format {
+	return vdisk.RAWFormat
+}
+
+// SizeAlign returns zero, because volumes can be any size the raw format can.
+func (p *Provisioner) SizeAlign() vcfg.Bytes {
+	return vcfg.Bytes(0)
+}
+
+// WantsCompressed returns false, because the volume has to be created at the
+// size of the disk before it's uploaded.
+func (p *Provisioner) WantsCompressed() bool {
+	return false
+}
+
+// Console returns provisioners.ErrConsoleUnsupported, because libvirt only
+// offers the serial console of a domain interactively, through 'virsh
+// console'.
+func (p *Provisioner) Console(ctx context.Context, name string, w io.Writer) error {
+	return fmt.Errorf("%s: %w", ProvisionerType, provisioners.ErrConsoleUnsupported)
+}
+
+// Export downloads the boot volume of the domain called name from the storage
+// pool to w. Volumes are raw disks, so it's written out as it is.
+func (p *Provisioner) Export(ctx context.Context, name string, w io.Writer) error {
+
+	volume := volumeName(name, 0)
+	if !p.exists(ctx, "vol-info", "--pool", p.pool(), volume) {
+		return fmt.Errorf("no volume '%s' found in pool '%s'", volume, p.pool())
+	}
+
+	progress := p.log.NewProgress(fmt.Sprintf("Downloading %s", volume), "", 0)
+	err := p.virshTo(ctx, nil, w, "vol-download", "--pool", p.pool(), volume, "/dev/stdout")
+	progress.Finish(err == nil)
+	return err
+}
+
+// CheckCredentials connects to libvirt, and checks that the storage pool and
+// network can be found.
+func (p *Provisioner) CheckCredentials(ctx context.Context) error {
+
+	_, err := p.virsh(ctx, nil, "pool-info", p.pool())
+	if err != nil {
+		return err
+	}
+
+	_, err = p.virsh(ctx, nil, "net-info", p.network())
+	return err
+}
+
+// Marshal returns json provisioner as bytes
+func (p *Provisioner) Marshal() ([]byte, error) {
+
+	m := make(map[string]interface{})
+	m[provisioners.MapKey] = ProvisionerType
+	m["uri"] = p.cfg.URI
+	m["pool"] = p.cfg.Pool
+	m["network"] = p.cfg.Network
+	m["start"] = p.cfg.Start
+
+	out, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (p *Provisioner) uri() string {
+	if p.cfg.URI == "" {
+		return DefaultURI
+	}
+	return p.cfg.URI
+}
+
+func (p *Provisioner) pool() string {
+	if p.cfg.Pool == "" {
+		return DefaultPool
+	}
+	return p.cfg.Pool
+}
+
+func (p *Provisioner) network() string {
+	if p.cfg.Network == "" {
+		return DefaultNetwork
+	}
+	return p.cfg.Network
+}
+
+// virsh runs a virsh command against the configured connection, with stdin
+// as its input, and returns what it writes to stdout.
+func (p *Provisioner) virsh(ctx context.Context, stdin io.Reader, args ...string) (string, error) {
+
+	stdout := new(bytes.Buffer)
+	err := p.virshTo(ctx, stdin, stdout, args...)
+	if err != nil {
+		return "", err
+	}
+
+	return stdout.String(), nil
+}
+
+// virshTo is virsh, but it writes what the command writes to stdout to w.
+func (p *Provisioner) virshTo(ctx context.Context, stdin io.Reader, w io.Writer, args ...string) error {
+
+	args = append([]string{"--quiet", "--connect", p.uri()}, args...)
+	cmd := exec.CommandContext(ctx, "virsh", args...)
+	cmd.Stdin = stdin
+
+	stderr := new(bytes.Buffer)
+	cmd.Stdout = w
+	cmd.Stderr = stderr
+
+	p.log.Debugf("Executing virsh %s", strings.Join(args, " "))
+
+	err := cmd.Run()
+	if errors.Is(err, exec.ErrNotFound) {
+		return errNoVirsh
+	}
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return fmt.Errorf("virsh %s: %v", args[3], err)
+		}
+		return fmt.Errorf("virsh %s: %s", args[3], msg)
+	}
+
+	return nil
+}
+
+// exists returns true if the virsh command args succeeds, which for commands
+// like 'dominfo' means the object it names exists.
+func (p *Provisioner) exists(ctx context.Context, args ...string) bool {
+	_, err := p.virsh(ctx, nil, args...)
+	return err == nil
+}
+
+func volumeName(name string, i int) string {
+	if i == 0 {
+		return name + ".raw"
+	}
+	return fmt.Sprintf("%s-data%d.raw", name, i)
+}
+
+// diskTarget returns the name of the i'th SCSI disk, like the guest's kernel
+// would name it.
+func diskTarget(i int) string {
+	return fmt.Sprintf("sd%c", 'a'+i)
+}
+
+// domainXML returns the definition of a domain booting from the volume
+// called disk in pool, laid out like the QEMU virtualizer's VMs: a q35
+// machine with a virtio SCSI controller and a virtio NIC.
+func domainXML(name, description string, cpus uint, ram vcfg.Bytes, pool, network string, disks []string) string {
+
+	var devices string
+	for i, disk := range disks {
+		devices += fmt.Sprintf(`
+    <disk type='volume' device='disk'>
+      <driver name='qemu' type='raw'/>
+      <source pool='%s' volume='%s'/>
+      <target dev='%s' bus='scsi'/>
+    </disk>`, html.EscapeString(pool), html.EscapeString(disk), diskTarget(i))
+	}
+
+	return fmt.Sprintf(`<domain type='kvm'>
+  <name>%s</name>
+  <description>%s</description>
+  <memory unit='KiB'>%d</memory>
+  <vcpu>%d</vcpu>
+  <os>
+    <type arch='x86_64' machine='q35'>hvm</type>
+    <boot dev='hd'/>
+  </os>
+  <features>
+    <acpi/>
+    <apic/>
+  </features>
+  <on_reboot>destroy</on_reboot>
+  <devices>
+    <controller type='scsi' model='virtio-scsi'/>%s
+    <interface type='network'>
+      <source network='%s'/>
+      <model type='virtio'/>
+    </interface>
+    <serial type='pty'>
+      <target port='0'/>
+    </serial>
+    <console type='pty'>
+      <target type='serial' port='0'/>
+    </console>
+  </devices>
+</domain>
+`, html.EscapeString(name), html.EscapeString(description), int64(ram)/1024, cpus, devices, html.EscapeString(network))
+}
+
+// removeConflicts removes the domain called name and its volumes, if they
+// exist.
+func (p *Provisioner) removeConflicts(ctx context.Context, name string, volumes []string) error {
+
+	if p.exists(ctx, "dominfo", name) {
+		// the domain may not be running, so this is allowed to fail
+		_, _ = p.virsh(ctx, nil, "destroy", name)
+		_, err := p.virsh(ctx, nil, "undefine", name)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, vol := range volumes {
+		if !p.exists(ctx, "vol-info", "--pool", p.pool(), vol) {
+			continue
+		}
+		_, err := p.virsh(ctx, nil, "vol-delete", "--pool", p.pool(), vol)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Provision uploads the disk image to a new volume in the storage pool and
+// defines a domain that boots from it, sized by args.CPUs and args.RAM. The
+// domain is started if the provisioner is configured to.
+func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) (err error) {
+
+	// libvirt has no labels; a domain's metadata is the closest thing, but
+	// nothing reads it back.
+	if err := provisioners.CheckTags(ProvisionerType, args); err != nil {
+		return err
+	}
+
+	for i, size := range args.DataDisks {
+		if size <= 0 {
+			return fmt.Errorf("invalid size for data disk %d: %d", i, size)
+		}
+	}
+
+	if len(args.DataDisks)+1 > 26 {
+		return fmt.Errorf("too many data disks: %d", len(args.DataDisks))
+	}
+
+	ctx := args.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	volumes := make([]string, len(args.DataDisks)+1)
+	for i := range volumes {
+		volumes[i] = volumeName(args.Name, i)
+	}
+
+	conflict := p.exists(ctx, "dominfo", args.Name)
+	for _, vol := range volumes {
+		conflict = conflict || p.exists(ctx, "vol-info", "--pool", p.pool(), vol)
+	}
+
+	if conflict {
+		if !args.Force {
+			return fmt.Errorf("domain '%s' or one of its volumes already exists", args.Name)
+		}
+		err = p.removeConflicts(ctx, args.Name, volumes)
+		if err != nil {
+			return fmt.Errorf("failed to remove existing domain '%s': %v", args.Name, err)
+		}
+	}
+
+	rollback := provisioners.NewRollback(p.log)
+	defer func() {
+		if err != nil {
+			_ = rollback.Run(args.KeepOnFailure)
+		}
+	}()
+
+	sizes := append([]int64{int64(args.Image.Size())}, args.DataDisks...)
+	for i, vol := range volumes {
+		_, err = p.virsh(ctx, nil, "vol-create-as", p.pool(), vol, fmt.Sprintf("%d", sizes[i]), "--format", "raw")
+		if err != nil {
+			return err
+		}
+		vol := vol
+		rollback.Track(fmt.Sprintf("volume '%s'", vol), func() error {
+			_, err := p.virsh(context.Background(), nil, "vol-delete", "--pool", p.pool(), vol)
+			return err
+		})
+	}
+
+	progress := p.log.NewProgress(fmt.Sprintf("Uploading %s:", args.Name), "KiB", int64(args.Image.Size()))
+	pr := progress.ProxyReader(args.Image)
+	defer pr.Close()
+
+	_, err = p.virsh(ctx, pr, "vol-upload", "--pool", p.pool(), volumes[0], "/dev/stdin")
+	progress.Finish(err == nil)
+	if err != nil {
+		return err
+	}
+
+	cpus := args.CPUs
+	if cpus == 0 {
+		cpus = defaultCPUs
+	}
+
+	ram := args.RAM
+	if ram == 0 {
+		ram = defaultRAM
+	}
+
+	def := domainXML(args.Name, args.Description, cpus, ram, p.pool(), p.network(), volumes)
+	_, err = p.virsh(ctx, strings.NewReader(def), "define", "/dev/stdin")
+	if err != nil {
+		return err
+	}
+	rollback.Track(fmt.Sprintf("domain '%s'", args.Name), func() error {
+		_, err := p.virsh(context.Background(), nil, "undefine", args.Name)
+		return err
+	})
+
+	if !p.cfg.Start {
+		return nil
+	}
+
+	_, err = p.virsh(ctx, nil, "start", args.Name)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
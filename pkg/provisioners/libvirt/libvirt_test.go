@@ -0,0 +1,167 @@
+package libvirt
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/provisioners"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+)
+
+func TestDomainXML(t *testing.T) {
+
+	var domain struct {
+		Name        string `xml:"name"`
+		Description string `xml:"description"`
+		Memory      int64  `xml:"memory"`
+		VCPU        int    `xml:"vcpu"`
+		Disks       []struct {
+			Source struct {
+				Pool   string `xml:"pool,attr"`
+				Volume string `xml:"volume,attr"`
+			} `xml:"source"`
+			Target struct {
+				Dev string `xml:"dev,attr"`
+			} `xml:"target"`
+		} `xml:"devices>disk"`
+		Network struct {
+			Name string `xml:"network,attr"`
+		} `xml:"devices>interface>source"`
+	}
+
+	volumes := []string{volumeName("app", 0), volumeName("app", 1)}
+	def := domainXML("app<1>", "an 'app'", 2, 256*vcfg.MiB, "images", "lan", volumes)
+	assert.NoError(t, xml.Unmarshal([]byte(def), &domain))
+
+	assert.Equal(t, "app<1>", domain.Name)
+	assert.Equal(t, "an 'app'", domain.Description)
+	assert.Equal(t, int64(256*1024), domain.Memory)
+	assert.Equal(t, 2, domain.VCPU)
+	assert.Equal(t, "lan", domain.Network.Name)
+
+	assert.Len(t, domain.Disks, 2)
+	assert.Equal(t, "images", domain.Disks[0].Source.Pool)
+	assert.Equal(t, "app.raw", domain.Disks[0].Source.Volume)
+	assert.Equal(t, "sda", domain.Disks[0].Target.Dev)
+	assert.Equal(t, "app-data1.raw", domain.Disks[1].Source.Volume)
+	assert.Equal(t, "sdb", domain.Disks[1].Target.Dev)
+}
+
+func TestMarshal(t *testing.T) {
+
+	_, err := NewProvisioner(&elog.CLI{}, &Config{Pool: "bad/pool"})
+	assert.Error(t, err)
+
+	p, err := NewProvisioner(&elog.CLI{}, &Config{Pool: "images", Start: true})
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultURI, p.uri())
+	assert.Equal(t, DefaultNetwork, p.network())
+
+	data, err := p.Marshal()
+	assert.NoError(t, err)
+
+	ptype, err := provisioners.ProvisionerType(data)
+	assert.NoError(t, err)
+	assert.Equal(t, ProvisionerType, ptype)
+
+	var cfg Config
+	assert.NoError(t, json.Unmarshal(data, &cfg))
+	assert.Equal(t, *p.cfg, cfg)
+}
+
+func TestDiskSize(t *testing.T) {
+
+	p, err := NewProvisioner(&elog.CLI{}, &Config{})
+	assert.NoError(t, err)
+
+	// volumes are only rounded up to the 2 MiB the raw format needs
+	for in, out := range map[int64]int64{
+		1:                        int64(2 * vcfg.MiB),
+		int64(2 * vcfg.MiB):      int64(2 * vcfg.MiB),
+		int64(5*vcfg.MiB) + 1:    int64(6 * vcfg.MiB),
+		int64(10*vcfg.GiB) - 512: int64(10 * vcfg.GiB),
+	} {
+		size, err := vdisk.AlignSize(in, int64(p.SizeAlign()), p.DiskFormat())
+		assert.NoError(t, err)
+		assert.Equal(t, out, size, "%d bytes", in)
+	}
+}
+
+func TestProvisionChecksArgs(t *testing.T) {
+
+	p, err := NewProvisioner(&elog.CLI{}, &Config{})
+	assert.NoError(t, err)
+
+	// these are all rejected before virsh is run
+	err = p.Provision(&provisioners.ProvisionArgs{Name: "app", DataDisks: []int64{0}})
+	assert.Error(t, err)
+}
+
+// fakeVirsh is a virsh that logs its arguments to virsh.log beside it, and
+// only knows of the volume app.raw, which it downloads as "disk".
+const fakeVirsh = `#!/bin/sh
+echo "$@" >> "$(dirname "$0")/virsh.log"
+case "$*" in
+*"vol-info --pool default app.raw") exit 0 ;;
+*"vol-download --pool default app.raw /dev/stdout") printf disk; exit 0 ;;
+esac
+echo "error: failed to get vol" >&2
+exit 1
+`
+
+func TestExport(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("fake virsh is a shell script")
+	}
+
+	dir, err := ioutil.TempDir("", "virsh")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "virsh"), []byte(fakeVirsh), 0755)
+	assert.NoError(t, err)
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+
+	p, err := NewProvisioner(&elog.CLI{}, &Config{})
+	assert.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	err = p.Export(context.Background(), "app", buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "disk", buf.String())
+
+	buf.Reset()
+	err = p.Export(context.Background(), "missing", buf)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no volume 'missing.raw' found in pool 'default'")
+	assert.Equal(t, 0, buf.Len())
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "virsh.log"))
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, []string{
+		"--quiet --connect " + DefaultURI + " vol-info --pool default app.raw",
+		"--quiet --connect " + DefaultURI + " vol-download --pool default app.raw /dev/stdout",
+		"--quiet --connect " + DefaultURI + " vol-info --pool default missing.raw",
+	}, lines)
+}
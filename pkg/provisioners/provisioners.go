@@ -13,8 +13,13 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vdisk"
@@ -30,8 +35,33 @@ type Provisioner interface {
 	Type() string
 	DiskFormat() vdisk.Format
 	SizeAlign() vcfg.Bytes
+
+	// WantsCompressed returns true if the provisioner's DiskFormat is
+	// compressed as it's written and can be uploaded as a stream, so the
+	// disk can be built straight into the upload instead of into a
+	// temporary file first. The Image it's given is then a stream, whose
+	// Size is zero because it isn't known until the build finishes.
+	WantsCompressed() bool
+
 	Provision(args *ProvisionArgs) error
 	Marshal() ([]byte, error)
+
+	// Console writes the serial console output of the instance called name
+	// to w. Provisioners for platforms that don't keep it must return
+	// ErrConsoleUnsupported.
+	Console(ctx context.Context, name string, w io.Writer) error
+
+	// Export writes the boot disk of the image called name, which doesn't
+	// have to have been provisioned by vorteil, to w as a raw disk image.
+	// Provisioners for platforms that can't export images must return
+	// ErrExportUnsupported.
+	Export(ctx context.Context, name string, w io.Writer) error
+
+	// CheckCredentials makes a cheap authenticated call to each of the
+	// platform APIs that provisioning uses, without creating anything, so
+	// that bad credentials or permissions are found before a provisioner
+	// file is saved or a disk is built.
+	CheckCredentials(ctx context.Context) error
 }
 
 // ProvisionArgs ...
@@ -42,8 +72,66 @@ type ProvisionArgs struct {
 	ReadyWhenUsable bool
 	Context         context.Context
 	Image           vio.File
+
+	// Retry controls how transient failures of cloud API calls are retried.
+	// The zero value uses DefaultRetryPolicy.
+	Retry RetryPolicy
+
+	// KeepOnFailure stops provisioners removing the resources they created
+	// if provisioning fails part way through, which can help debugging.
+	KeepOnFailure bool
+
+	// Strict makes provisioners fail on problems with their configuration
+	// that they would otherwise only warn about, like a bucket in a
+	// different location to the image.
+	Strict bool
+
+	// DataDisks are the sizes, in bytes, of empty volumes to attach to
+	// instances of the image alongside the boot disk. Provisioners that
+	// can't add them must return ErrDataDisksUnsupported rather than
+	// dropping them.
+	DataDisks []int64
+
+	// Tags are applied to the image, and anything else the provisioner
+	// creates to back it, for cost allocation and cleanup. Provisioners
+	// must check them before uploading anything, and those that can't
+	// apply them must return ErrTagsUnsupported rather than dropping them.
+	Tags map[string]string
+
+	// CPUs and RAM are what the app's VCFG gives its VM, for provisioners
+	// that define VMs rather than just images. They are zero if the VCFG
+	// leaves them to their defaults.
+	CPUs uint
+	RAM  vcfg.Bytes
+
+	// TempDir is where provisioners keep temporary copies of the image,
+	// if they need them. If empty, the system's default temporary
+	// directory is used.
+	TempDir string
 }
 
+// ErrDataDisksUnsupported is returned by provisioners that can't attach the
+// empty volumes in ProvisionArgs.DataDisks.
+var ErrDataDisksUnsupported = errors.New("data disks are not supported by this provisioner")
+
+// CheckDataDisks returns ErrDataDisksUnsupported, wrapped with the provisioner
+// type, if args asks for any data disks. It's a convenience for provisioners
+// that can't attach them.
+func CheckDataDisks(ptype string, args *ProvisionArgs) error {
+	if len(args.DataDisks) > 0 {
+		return fmt.Errorf("%s: %w", ptype, ErrDataDisksUnsupported)
+	}
+	return nil
+}
+
+// ErrConsoleUnsupported is returned by provisioners for platforms that don't
+// keep the serial console output of instances.
+var ErrConsoleUnsupported = errors.New("serial console output is not supported by this provisioner")
+
+// ErrExportUnsupported is returned by provisioners for platforms that can't
+// export images back out.
+var ErrExportUnsupported = errors.New("exporting images is not supported by this provisioner")
+
 type InvalidProvisionerError struct {
 	Err error
 }
@@ -83,6 +171,9 @@ func Decrypt(data []byte, passphrase string) ([]byte, error) {
 		return nil, err
 	}
 	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("encrypted provisioner data is truncated")
+	}
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
 	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
@@ -91,6 +182,41 @@ func Decrypt(data []byte, passphrase string) ([]byte, error) {
 	return plaintext, nil
 }
 
+// ReadKeyFile returns the secret stored in a key file, for use in place of a
+// passphrase with Encrypt and Decrypt. A single trailing newline is ignored so
+// that key files can be created with common text editors.
+func ReadKeyFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	key := strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r")
+	if key == "" {
+		return "", fmt.Errorf("key file '%s' is empty", path)
+	}
+
+	return key, nil
+}
+
+// Rekey decrypts provisioner data with oldSecret and re-encrypts it with
+// newSecret. The decrypted data must be a valid provisioner, otherwise an
+// error is returned and nothing is re-encrypted.
+func Rekey(data []byte, oldSecret, newSecret string) ([]byte, error) {
+
+	plain, err := Decrypt(data, oldSecret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt provisioner with the old secret: %w", err)
+	}
+
+	_, err = ProvisionerType(plain)
+	if err != nil {
+		return nil, err
+	}
+
+	return Encrypt(plain, newSecret), nil
+}
+
 // ProvisionerType : Return Provisioner type as a string
 func ProvisionerType(data []byte) (string, error) {
 	m := make(map[string]interface{})
@@ -106,3 +232,101 @@ func ProvisionerType(data []byte) (string, error) {
 
 	return fmt.Sprintf("%v", ptype), nil
 }
+
+// Difference is a key whose value differs between two provisioners. A and B
+// are the values on either side, or empty if the key is missing from that
+// side. Values of secret keys are masked.
+type Difference struct {
+	Key  string
+	A, B string
+}
+
+// maskedValue replaces the values of secret keys in a Difference.
+const maskedValue = "********"
+
+// isSecretKey returns true if a provisioner key holds a credential whose value
+// shouldn't be shown.
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range []string{"key", "secret", "password", "token"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Diff compares two decrypted provisioners and returns the keys that differ,
+// sorted by key. Both must be of the same provisioner type.
+func Diff(a, b []byte) ([]Difference, error) {
+
+	ma := make(map[string]interface{})
+	err := json.Unmarshal(a, &ma)
+	if err != nil {
+		return nil, err
+	}
+
+	mb := make(map[string]interface{})
+	err = json.Unmarshal(b, &mb)
+	if err != nil {
+		return nil, err
+	}
+
+	ta, err := ProvisionerType(a)
+	if err != nil {
+		return nil, err
+	}
+
+	tb, err := ProvisionerType(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if ta != tb {
+		return nil, fmt.Errorf("cannot compare a '%s' provisioner with a '%s' provisioner", ta, tb)
+	}
+
+	keys := make(map[string]bool)
+	for k := range ma {
+		keys[k] = true
+	}
+	for k := range mb {
+		keys[k] = true
+	}
+
+	var diffs []Difference
+
+	for k := range keys {
+
+		va, inA := ma[k]
+		vb, inB := mb[k]
+		if inA && inB && reflect.DeepEqual(va, vb) {
+			continue
+		}
+
+		d := Difference{Key: k}
+		if inA {
+			d.A = fmt.Sprintf("%v", va)
+		}
+		if inB {
+			d.B = fmt.Sprintf("%v", vb)
+		}
+
+		if isSecretKey(k) {
+			if inA {
+				d.A = maskedValue
+			}
+			if inB {
+				d.B = maskedValue
+			}
+		}
+
+		diffs = append(diffs, d)
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Key < diffs[j].Key
+	})
+
+	return diffs, nil
+}
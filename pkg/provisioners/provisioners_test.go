@@ -0,0 +1,134 @@
+package provisioners
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/elog"
+)
+
+func TestRekey(t *testing.T) {
+
+	plain := []byte(`{"type":"google-compute","bucket":"b"}`)
+	data := Encrypt(plain, "old")
+
+	_, err := Rekey(data, "wrong", "new")
+	assert.Error(t, err)
+
+	out, err := Rekey(data, "old", "new")
+	assert.NoError(t, err)
+
+	_, err = Decrypt(out, "old")
+	assert.Error(t, err)
+
+	dec, err := Decrypt(out, "new")
+	assert.NoError(t, err)
+	assert.Equal(t, plain, dec)
+
+	// not a provisioner
+	_, err = Rekey(Encrypt([]byte("garbage"), "old"), "old", "new")
+	assert.Error(t, err)
+
+	// truncated data must not panic
+	_, err = Decrypt([]byte{1, 2, 3}, "old")
+	assert.Error(t, err)
+}
+
+func TestRollback(t *testing.T) {
+
+	var order []string
+	undo := func(name string, err error) func() error {
+		return func() error {
+			order = append(order, name)
+			return err
+		}
+	}
+
+	rb := NewRollback(&elog.CLI{})
+	rb.Track("blob", undo("blob", nil))
+	rb.Track("snapshot", undo("snapshot", errors.New("busy")))
+	rb.Track("image", undo("image", nil))
+
+	// nothing is removed when keeping resources
+	assert.NoError(t, rb.Run(true))
+	assert.Empty(t, order)
+
+	rb.Track("blob", undo("blob", nil))
+	rb.Track("snapshot", undo("snapshot", errors.New("busy")))
+	rb.Track("image", undo("image", nil))
+
+	err := rb.Run(false)
+	assert.EqualError(t, err, "busy")
+	assert.Equal(t, []string{"image", "snapshot", "blob"}, order)
+
+	// resources are only removed once
+	order = nil
+	assert.NoError(t, rb.Run(false))
+	assert.Empty(t, order)
+
+	rb.Track("blob", undo("blob", nil))
+	rb.Forget()
+	assert.NoError(t, rb.Run(false))
+	assert.Empty(t, order)
+}
+
+func TestDiff(t *testing.T) {
+
+	a := []byte(`{"type":"amazon-ec2","key":"AKIA1","secret":"s1","region":"ap-southeast-2","bucket":"b"}`)
+	b := []byte(`{"type":"amazon-ec2","key":"AKIA2","secret":"s1","region":"us-east-1"}`)
+
+	diffs, err := Diff(a, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []Difference{
+		{Key: "bucket", A: "b"},
+		{Key: "key", A: maskedValue, B: maskedValue},
+		{Key: "region", A: "ap-southeast-2", B: "us-east-1"},
+	}, diffs)
+
+	diffs, err = Diff(a, a)
+	assert.NoError(t, err)
+	assert.Empty(t, diffs)
+
+	_, err = Diff(a, []byte(`{"type":"google-compute","bucket":"b"}`))
+	assert.Error(t, err)
+}
+
+func TestTagConstraints(t *testing.T) {
+
+	c := &TagConstraints{
+		MaxTags:          2,
+		MaxKeyLength:     8,
+		MaxValueLength:   4,
+		Key:              regexp.MustCompile(`^[a-z][a-z0-9_-]*$`),
+		Reserved:         []string{"description"},
+		ReservedPrefixes: []string{"aws:"},
+	}
+
+	assert.NoError(t, c.Validate("test", nil))
+	assert.NoError(t, c.Validate("test", map[string]string{"team": "core", "env": ""}))
+
+	for _, tags := range []map[string]string{
+		{"a": "1", "b": "2", "c": "3"},
+		{"": "x"},
+		{"longerkey": "x"},
+		{"team": "platform"},
+		{"Team": "core"},
+		{"Description": "x"},
+	} {
+		assert.Error(t, c.Validate("test", tags), "%v", tags)
+	}
+
+	c.Key = nil
+	err := c.Validate("test", map[string]string{"AWS:name": "x"})
+	assert.EqualError(t, err, "test: tag key 'AWS:name' can't start with 'aws:'")
+
+	assert.NoError(t, CheckTags("test", &ProvisionArgs{}))
+	assert.True(t, errors.Is(CheckTags("test", &ProvisionArgs{Tags: map[string]string{"a": "b"}}), ErrTagsUnsupported))
+}
@@ -15,6 +15,8 @@ import (
 	"github.com/vorteil/vorteil/pkg/provisioners/amazon"
 	"github.com/vorteil/vorteil/pkg/provisioners/azure"
 	"github.com/vorteil/vorteil/pkg/provisioners/google"
+	"github.com/vorteil/vorteil/pkg/provisioners/libvirt"
+	"github.com/vorteil/vorteil/pkg/provisioners/vsphere"
 )
 
 func init() {
@@ -46,6 +48,24 @@ func init() {
 		return azure.NewProvisioner(log, &cfg)
 	}
 
+	vsphereFn := func(log elog.View, data []byte) (provisioners.Provisioner, error) {
+		var cfg vsphere.Config
+		err := json.Unmarshal(data, &cfg)
+		if err != nil {
+			return nil, err
+		}
+		return vsphere.NewProvisioner(log, &cfg)
+	}
+
+	libvirtFn := func(log elog.View, data []byte) (provisioners.Provisioner, error) {
+		var cfg libvirt.Config
+		err := json.Unmarshal(data, &cfg)
+		if err != nil {
+			return nil, err
+		}
+		return libvirt.NewProvisioner(log, &cfg)
+	}
+
 	err := RegisterProvisioner(google.ProvisionerType, gcpFn)
 	if err != nil {
 		panic(err)
@@ -60,6 +80,16 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+
+	err = RegisterProvisioner(vsphere.ProvisionerType, vsphereFn)
+	if err != nil {
+		panic(err)
+	}
+
+	err = RegisterProvisioner(libvirt.ProvisionerType, libvirtFn)
+	if err != nil {
+		panic(err)
+	}
 }
 
 // ProvisionerInstantiator is a function that returns a new provisioner
@@ -0,0 +1,124 @@
+package provisioners
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy controls how WithRetry retries calls that fail with a transient
+// error. Fields left at zero take their value from DefaultRetryPolicy.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a call is made before giving up,
+	// including the first. Set it to 1 to disable retrying.
+	MaxAttempts int
+
+	// InitialDelay is how long to wait before the first retry. The delay
+	// doubles after every failed attempt, up to MaxDelay.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// DefaultRetryPolicy is used for any field of a RetryPolicy left at zero.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  5,
+	InitialDelay: 2 * time.Second,
+	MaxDelay:     30 * time.Second,
+}
+
+func (policy RetryPolicy) withDefaults() RetryPolicy {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if policy.InitialDelay <= 0 {
+		policy.InitialDelay = DefaultRetryPolicy.InitialDelay
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = DefaultRetryPolicy.MaxDelay
+	}
+	return policy
+}
+
+// RetryableError marks an error as transient, so that WithRetry tries the
+// call again.
+type RetryableError struct {
+	Err error
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable wraps err in a RetryableError. It returns nil if err is nil.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &RetryableError{Err: err}
+}
+
+// RetryableStatus returns true if an API call that failed with the HTTP status
+// code is worth retrying: request timeouts, throttling, and server errors.
+func RetryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented, http.StatusHTTPVersionNotSupported:
+		return false
+	}
+	return code >= 500 && code < 600
+}
+
+// WithRetry calls fn until it succeeds, returns an error that isn't a
+// RetryableError, runs out of attempts, or ctx is done. Provisioners classify
+// the errors from their API calls inside fn, wrapping transient ones such as
+// throttling and server errors with Retryable, and leaving fatal ones such as
+// authentication or quota failures alone. The error returned is never a
+// RetryableError.
+func WithRetry(ctx context.Context, fn func() error, policy RetryPolicy) error {
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	policy = policy.withDefaults()
+	delay := policy.InitialDelay
+
+	for attempt := 1; ; attempt++ {
+
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		var rerr *RetryableError
+		if !errors.As(err, &rerr) {
+			return err
+		}
+
+		if attempt >= policy.MaxAttempts {
+			return rerr.Err
+		}
+
+		select {
+		case <-ctx.Done():
+			return rerr.Err
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+	}
+}
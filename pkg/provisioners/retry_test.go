@@ -0,0 +1,75 @@
+package provisioners
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithRetry(t *testing.T) {
+
+	policy := RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: time.Millisecond,
+	}
+	transient := errors.New("throttled")
+	fatal := errors.New("unauthorized")
+
+	// succeeds after transient failures
+	var calls int
+	err := WithRetry(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return Retryable(transient)
+		}
+		return nil
+	}, policy)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	// gives up after MaxAttempts
+	calls = 0
+	err = WithRetry(context.Background(), func() error {
+		calls++
+		return Retryable(transient)
+	}, policy)
+	assert.Equal(t, transient, err)
+	assert.Equal(t, 3, calls)
+
+	// fatal errors aren't retried
+	calls = 0
+	err = WithRetry(context.Background(), func() error {
+		calls++
+		return fatal
+	}, policy)
+	assert.Equal(t, fatal, err)
+	assert.Equal(t, 1, calls)
+
+	// a cancelled context stops retrying
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	err = WithRetry(ctx, func() error {
+		calls++
+		return Retryable(transient)
+	}, RetryPolicy{MaxAttempts: 10, InitialDelay: time.Hour})
+	assert.Equal(t, transient, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetryableStatus(t *testing.T) {
+	for _, code := range []int{408, 429, 500, 502, 503, 504} {
+		assert.True(t, RetryableStatus(code), code)
+	}
+	for _, code := range []int{200, 400, 401, 403, 404, 409, 501} {
+		assert.False(t, RetryableStatus(code), code)
+	}
+}
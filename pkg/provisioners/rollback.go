@@ -0,0 +1,73 @@
+package provisioners
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"github.com/vorteil/vorteil/pkg/elog"
+)
+
+type rollbackStep struct {
+	resource string
+	undo     func() error
+}
+
+// Rollback keeps track of the cloud resources created while provisioning, so
+// that they can be removed again if provisioning fails part way through and
+// don't go on incurring costs.
+type Rollback struct {
+	log   elog.Logger
+	steps []rollbackStep
+}
+
+// NewRollback returns an empty Rollback that reports its progress to log.
+func NewRollback(log elog.Logger) *Rollback {
+	return &Rollback{log: log}
+}
+
+// Track records that resource was created, and that undo removes it again.
+func (r *Rollback) Track(resource string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{
+		resource: resource,
+		undo:     undo,
+	})
+}
+
+// Forget stops tracking everything recorded so far, for resources that have
+// to outlive a failure once provisioning gets past a certain point.
+func (r *Rollback) Forget() {
+	r.steps = nil
+}
+
+// Run removes every tracked resource, most recently created first. A failure
+// to remove one resource doesn't stop the others being removed; the first
+// error is returned. If keep is true nothing is removed, and the resources
+// left behind are logged instead.
+func (r *Rollback) Run(keep bool) error {
+
+	var rerr error
+
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+
+		if keep {
+			r.log.Warnf("Provisioning failed; keeping %s", step.resource)
+			continue
+		}
+
+		r.log.Infof("Provisioning failed; removing %s", step.resource)
+		err := step.undo()
+		if err != nil {
+			r.log.Warnf("Failed to remove %s: %v", step.resource, err)
+			if rerr == nil {
+				rerr = err
+			}
+		}
+	}
+
+	r.steps = nil
+
+	return rerr
+}
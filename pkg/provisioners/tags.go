@@ -0,0 +1,90 @@
+package provisioners
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrTagsUnsupported is returned by provisioners that can't apply the tags in
+// ProvisionArgs.Tags to the resources they create.
+var ErrTagsUnsupported = errors.New("tags are not supported by this provisioner")
+
+// CheckTags returns ErrTagsUnsupported, wrapped with the provisioner type, if
+// args asks for any tags. It's a convenience for provisioners that can't
+// apply them.
+func CheckTags(ptype string, args *ProvisionArgs) error {
+	if len(args.Tags) > 0 {
+		return fmt.Errorf("%s: %w", ptype, ErrTagsUnsupported)
+	}
+	return nil
+}
+
+// TagConstraints describes the tags a platform accepts, so they can be
+// checked before anything is uploaded. Keys are compared case-insensitively
+// against Reserved and ReservedPrefixes, and lengths are counted in
+// characters. A zero limit or a nil pattern isn't checked.
+type TagConstraints struct {
+	MaxTags          int
+	MaxKeyLength     int
+	MaxValueLength   int
+	Key              *regexp.Regexp
+	Value            *regexp.Regexp
+	Reserved         []string // keys the provisioner sets itself
+	ReservedPrefixes []string // prefixes the platform keeps for its own tags
+}
+
+// Validate returns an error, prefixed with the provisioner type, describing
+// the first tag that doesn't meet the constraints.
+func (c *TagConstraints) Validate(ptype string, tags map[string]string) error {
+
+	if c.MaxTags > 0 && len(tags) > c.MaxTags {
+		return fmt.Errorf("%s: too many tags: at most %d are supported", ptype, c.MaxTags)
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := tags[k]
+		lk := strings.ToLower(k)
+
+		switch {
+		case k == "":
+			return fmt.Errorf("%s: tag keys can't be empty", ptype)
+		case c.MaxKeyLength > 0 && utf8.RuneCountInString(k) > c.MaxKeyLength:
+			return fmt.Errorf("%s: tag key '%s' is longer than %d characters", ptype, k, c.MaxKeyLength)
+		case c.MaxValueLength > 0 && utf8.RuneCountInString(v) > c.MaxValueLength:
+			return fmt.Errorf("%s: value of tag '%s' is longer than %d characters", ptype, k, c.MaxValueLength)
+		case c.Key != nil && !c.Key.MatchString(k):
+			return fmt.Errorf("%s: tag key '%s' is invalid (must match %s)", ptype, k, c.Key)
+		case c.Value != nil && !c.Value.MatchString(v):
+			return fmt.Errorf("%s: value '%s' of tag '%s' is invalid (must match %s)", ptype, v, k, c.Value)
+		}
+
+		for _, r := range c.Reserved {
+			if lk == strings.ToLower(r) {
+				return fmt.Errorf("%s: tag key '%s' is reserved", ptype, k)
+			}
+		}
+
+		for _, prefix := range c.ReservedPrefixes {
+			if strings.HasPrefix(lk, strings.ToLower(prefix)) {
+				return fmt.Errorf("%s: tag key '%s' can't start with '%s'", ptype, k, prefix)
+			}
+		}
+	}
+
+	return nil
+}
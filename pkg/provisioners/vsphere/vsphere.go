@@ -0,0 +1,473 @@
+package vsphere
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/nfc"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/ovf"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/provisioners"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vmdk"
+)
+
+const (
+	// ProvisionerType : Constant string value used to represent the provisioner type vsphere
+	ProvisionerType = "vmware-vsphere"
+
+	// DefaultNetwork is the network VMs are connected to if none is configured.
+	DefaultNetwork = "VM Network"
+
+	diskFile = "disk.vmdk"
+)
+
+// Provisioner satisfies the provisioners.Provisioner interface
+type Provisioner struct {
+	cfg *Config
+	log elog.View
+
+	url *url.URL
+}
+
+// Config contains configuration fields required by the Provisioner
+type Config struct {
+	URL          string `json:"url"`          // vCenter URL, e.g. https://vcenter.example.com
+	Username     string `json:"username"`     // vCenter user name
+	Password     string `json:"password"`     // vCenter password
+	Insecure     bool   `json:"insecure"`     // skip verification of the vCenter TLS certificate
+	Datacenter   string `json:"datacenter"`   // inventory path of the datacenter
+	Datastore    string `json:"datastore"`    // datastore to store the VM's disk on
+	ResourcePool string `json:"resourcePool"` // resource pool for the VM, or empty for the default
+	Network      string `json:"network"`      // network for the VM's NIC, or empty for DefaultNetwork
+}
+
+// NewProvisioner - Create a vSphere Provisioner object
+func NewProvisioner(log elog.View, cfg *Config) (*Provisioner, error) {
+	p := new(Provisioner)
+	p.cfg = cfg
+	p.log = log
+	err := p.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s provisioner: %v", ProvisionerType, err)
+	}
+
+	return p, p.init()
+}
+
+// Validate ...
+func (p *Provisioner) Validate() error {
+
+	if p.cfg.URL == "" {
+		return errors.New("no defined url")
+	}
+
+	if p.cfg.Username == "" {
+		return errors.New("no defined username")
+	}
+
+	if p.cfg.Datacenter == "" {
+		return errors.New("no defined datacenter")
+	}
+
+	if p.cfg.Datastore == "" {
+		return errors.New("no defined datastore")
+	}
+
+	return nil
+}
+
+func (p *Provisioner) init() error {
+
+	u, err := soap.ParseURL(p.cfg.URL)
+	if err != nil {
+		return fmt.Errorf("could not parse url '%s': %v", p.cfg.URL, err)
+	}
+	u.User = url.UserPassword(p.cfg.Username, p.cfg.Password)
+	p.url = u
+
+	return nil
+}
+
+// Type returns 'vmware-vsphere'
+func (p *Provisioner) Type() string {
+	return ProvisionerType
+}
+
+// DiskFormat returns the provisioners required disk format
+func (p *Provisioner) DiskFormat() vdisk.Format {
+	return vdisk.VMDKStreamOptimizedFormat
+}
+
+// SizeAlign returns zero, because disks can be any size the VMDK format can.
+func (p *Provisioner) SizeAlign() vcfg.Bytes {
+	return vcfg.Bytes(0)
+}
+
+// WantsCompressed returns false, because vSphere needs the size of the VMDK up
+// front to upload it.
+func (p *Provisioner) WantsCompressed() bool {
+	return false
+}
+
+// Console returns provisioners.ErrConsoleUnsupported, because vSphere only
+// keeps serial console output if a VM's serial port is set up to write it
+// somewhere.
+func (p *Provisioner) Console(ctx context.Context, name string, w io.Writer) error {
+	return fmt.Errorf("%s: %w", ProvisionerType, provisioners.ErrConsoleUnsupported)
+}
+
+// Export returns provisioners.ErrExportUnsupported, because provisioned VMs
+// keep their disks as VMDKs in the datastore, not as raw disks.
+func (p *Provisioner) Export(ctx context.Context, name string, w io.Writer) error {
+	return fmt.Errorf("%s: %w", ProvisionerType, provisioners.ErrExportUnsupported)
+}
+
+// CheckCredentials logs in to vCenter, and checks that the datacenter and
+// datastore can be found.
+func (p *Provisioner) CheckCredentials(ctx context.Context) error {
+
+	client, err := govmomi.NewClient(ctx, p.url, p.cfg.Insecure)
+	if err != nil {
+		return fmt.Errorf("failed to connect to vCenter: %v", err)
+	}
+	defer client.Logout(context.Background())
+
+	finder := find.NewFinder(client.Client, true)
+
+	dc, err := finder.Datacenter(ctx, p.cfg.Datacenter)
+	if err != nil {
+		return err
+	}
+	finder.SetDatacenter(dc)
+
+	_, err = finder.Datastore(ctx, p.cfg.Datastore)
+	return err
+}
+
+// Marshal returns json provisioner as bytes
+func (p *Provisioner) Marshal() ([]byte, error) {
+
+	m := make(map[string]interface{})
+	m[provisioners.MapKey] = ProvisionerType
+	m["url"] = p.cfg.URL
+	m["username"] = p.cfg.Username
+	m["password"] = p.cfg.Password
+	m["insecure"] = p.cfg.Insecure
+	m["datacenter"] = p.cfg.Datacenter
+	m["datastore"] = p.cfg.Datastore
+	m["resourcePool"] = p.cfg.ResourcePool
+	m["network"] = p.cfg.Network
+
+	out, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// descriptor returns a minimal OVF descriptor for a VM with a single
+// stream-optimized disk of the given capacity, laid out like the VMware
+// virtualizer's VMs: a paravirtual SCSI controller and a vmxnet3 NIC.
+func descriptor(name, description string, capacity, fileSize int64, dataDisks []int64) string {
+
+	// data disks have no file, so vSphere creates them empty
+	var disks, items string
+	for i, size := range dataDisks {
+		disks += fmt.Sprintf(`
+    <Disk ovf:capacity="%[2]d" ovf:capacityAllocationUnits="byte" ovf:diskId="vmdisk%[1]d"/>`, i+2, size)
+		items += fmt.Sprintf(`
+      <Item>
+        <rasd:AddressOnParent>%[1]d</rasd:AddressOnParent>
+        <rasd:ElementName>Hard Disk %[2]d</rasd:ElementName>
+        <rasd:HostResource>ovf:/disk/vmdisk%[2]d</rasd:HostResource>
+        <rasd:InstanceID>%[3]d</rasd:InstanceID>
+        <rasd:Parent>3</rasd:Parent>
+        <rasd:ResourceType>17</rasd:ResourceType>
+      </Item>`, i+1, i+2, i+6)
+	}
+
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vssd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData" xmlns:vmw="http://www.vmware.com/schema/ovf">
+  <References>
+    <File ovf:id="file1" ovf:href="%[5]s" ovf:size="%[4]d"/>
+  </References>
+  <DiskSection>
+    <Info>Virtual disk information</Info>
+    <Disk ovf:capacity="%[3]d" ovf:capacityAllocationUnits="byte" ovf:diskId="vmdisk1" ovf:fileRef="file1" ovf:format="http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"/>%[6]s
+  </DiskSection>
+  <NetworkSection>
+    <Info>The list of logical networks</Info>
+    <Network ovf:name="network">
+      <Description>The network</Description>
+    </Network>
+  </NetworkSection>
+  <VirtualSystem ovf:id="%[1]s">
+    <Info>A Vorteil virtual machine</Info>
+    <Name>%[1]s</Name>
+    <AnnotationSection>
+      <Info>Description</Info>
+      <Annotation>%[2]s</Annotation>
+    </AnnotationSection>
+    <OperatingSystemSection ovf:id="101" vmw:osType="other3xLinux64Guest">
+      <Info>The operating system installed</Info>
+    </OperatingSystemSection>
+    <VirtualHardwareSection>
+      <Info>Virtual hardware requirements</Info>
+      <System>
+        <vssd:ElementName>Virtual Hardware Family</vssd:ElementName>
+        <vssd:InstanceID>0</vssd:InstanceID>
+        <vssd:VirtualSystemIdentifier>%[1]s</vssd:VirtualSystemIdentifier>
+        <vssd:VirtualSystemType>vmx-13</vssd:VirtualSystemType>
+      </System>
+      <Item>
+        <rasd:AllocationUnits>hertz * 10^6</rasd:AllocationUnits>
+        <rasd:ElementName>1 virtual CPU(s)</rasd:ElementName>
+        <rasd:InstanceID>1</rasd:InstanceID>
+        <rasd:ResourceType>3</rasd:ResourceType>
+        <rasd:VirtualQuantity>1</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:AllocationUnits>byte * 2^20</rasd:AllocationUnits>
+        <rasd:ElementName>1024MB of memory</rasd:ElementName>
+        <rasd:InstanceID>2</rasd:InstanceID>
+        <rasd:ResourceType>4</rasd:ResourceType>
+        <rasd:VirtualQuantity>1024</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:Address>0</rasd:Address>
+        <rasd:ElementName>SCSI Controller 0</rasd:ElementName>
+        <rasd:InstanceID>3</rasd:InstanceID>
+        <rasd:ResourceSubType>VirtualSCSI</rasd:ResourceSubType>
+        <rasd:ResourceType>6</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AddressOnParent>0</rasd:AddressOnParent>
+        <rasd:ElementName>Hard Disk 1</rasd:ElementName>
+        <rasd:HostResource>ovf:/disk/vmdisk1</rasd:HostResource>
+        <rasd:InstanceID>4</rasd:InstanceID>
+        <rasd:Parent>3</rasd:Parent>
+        <rasd:ResourceType>17</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AddressOnParent>0</rasd:AddressOnParent>
+        <rasd:AutomaticAllocation>true</rasd:AutomaticAllocation>
+        <rasd:Connection>network</rasd:Connection>
+        <rasd:ElementName>Network adapter 1</rasd:ElementName>
+        <rasd:InstanceID>5</rasd:InstanceID>
+        <rasd:ResourceSubType>VmxNet3</rasd:ResourceSubType>
+        <rasd:ResourceType>10</rasd:ResourceType>
+      </Item>%[7]s
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`, html.EscapeString(name), html.EscapeString(description), capacity, fileSize, diskFile, disks, items)
+}
+
+// diskCapacity returns the virtual size of the stream-optimized VMDK at the
+// start of r without consuming it.
+func diskCapacity(r *bufio.Reader) (int64, error) {
+
+	buf, err := r.Peek(vmdk.SectorSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read vmdk header: %v", err)
+	}
+
+	hdr := new(vmdk.Header)
+	err = binary.Read(bytes.NewReader(buf), binary.LittleEndian, hdr)
+	if err != nil {
+		return 0, err
+	}
+
+	if hdr.MagicNumber != vmdk.Magic {
+		return 0, errors.New("image is not a vmdk")
+	}
+
+	return int64(hdr.Capacity) * vmdk.SectorSize, nil
+}
+
+func (p *Provisioner) removeConflictingVM(ctx context.Context, vm *object.VirtualMachine) error {
+
+	state, err := vm.PowerState(ctx)
+	if err != nil {
+		return err
+	}
+
+	if state == types.VirtualMachinePowerStatePoweredOn {
+		task, err := vm.PowerOff(ctx)
+		if err != nil {
+			return err
+		}
+		err = task.Wait(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	task, err := vm.Destroy(ctx)
+	if err != nil {
+		return err
+	}
+
+	return task.Wait(ctx)
+}
+
+// Provision uploads the disk image to vCenter and registers a new VM with it.
+// The VM is left powered off, ready to be started or converted to a template.
+func (p *Provisioner) Provision(args *provisioners.ProvisionArgs) error {
+
+	// vSphere tags live in categories managed through a separate API that
+	// the provisioner has no configuration for.
+	if err := provisioners.CheckTags(ProvisionerType, args); err != nil {
+		return err
+	}
+
+	for i, size := range args.DataDisks {
+		if size <= 0 {
+			return fmt.Errorf("invalid size for data disk %d: %d", i, size)
+		}
+	}
+
+	ctx := args.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	client, err := govmomi.NewClient(ctx, p.url, p.cfg.Insecure)
+	if err != nil {
+		return fmt.Errorf("failed to connect to vCenter: %v", err)
+	}
+	defer client.Logout(context.Background())
+
+	finder := find.NewFinder(client.Client, true)
+
+	dc, err := finder.Datacenter(ctx, p.cfg.Datacenter)
+	if err != nil {
+		return err
+	}
+	finder.SetDatacenter(dc)
+
+	ds, err := finder.Datastore(ctx, p.cfg.Datastore)
+	if err != nil {
+		return err
+	}
+
+	pool, err := finder.ResourcePoolOrDefault(ctx, p.cfg.ResourcePool)
+	if err != nil {
+		return err
+	}
+
+	folders, err := dc.Folders(ctx)
+	if err != nil {
+		return err
+	}
+
+	network := p.cfg.Network
+	if network == "" {
+		network = DefaultNetwork
+	}
+
+	net, err := finder.Network(ctx, network)
+	if err != nil {
+		return err
+	}
+
+	vm, err := finder.VirtualMachine(ctx, args.Name)
+	if err == nil {
+		if !args.Force {
+			return fmt.Errorf("virtual machine '%s' already exists", args.Name)
+		}
+		err = p.removeConflictingVM(ctx, vm)
+		if err != nil {
+			return fmt.Errorf("failed to remove existing virtual machine '%s': %v", args.Name, err)
+		}
+	} else if _, ok := err.(*find.NotFoundError); !ok {
+		return err
+	}
+
+	r := bufio.NewReaderSize(args.Image, vmdk.SectorSize)
+	capacity, err := diskCapacity(r)
+	if err != nil {
+		return err
+	}
+
+	size := int64(args.Image.Size())
+
+	spec, err := ovf.NewManager(client.Client).CreateImportSpec(ctx, descriptor(args.Name, args.Description, capacity, size, args.DataDisks), pool, ds, types.OvfCreateImportSpecParams{
+		EntityName: args.Name,
+		NetworkMapping: []types.OvfNetworkMapping{{
+			Name:    "network",
+			Network: net.Reference(),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if spec.Error != nil {
+		return errors.New(spec.Error[0].LocalizedMessage)
+	}
+	for _, w := range spec.Warning {
+		p.log.Warnf("%s", w.LocalizedMessage)
+	}
+
+	lease, err := pool.ImportVApp(ctx, spec.ImportSpec, folders.VmFolder, nil)
+	if err != nil {
+		return err
+	}
+
+	info, err := lease.Wait(ctx, spec.FileItem)
+	if err != nil {
+		return err
+	}
+
+	var item *nfc.FileItem
+	for i := range info.Items {
+		if strings.HasSuffix(info.Items[i].Path, diskFile) {
+			item = &info.Items[i]
+		}
+	}
+	if item == nil {
+		_ = lease.Abort(ctx, nil)
+		return errors.New("vCenter did not request the disk image")
+	}
+
+	updater := lease.StartUpdater(ctx, info)
+	defer updater.Done()
+
+	progress := p.log.NewProgress(fmt.Sprintf("Uploading %s:", args.Name), "KiB", size)
+	pr := progress.ProxyReader(r)
+	defer pr.Close()
+
+	err = lease.Upload(ctx, *item, pr, soap.Upload{
+		ContentLength: size,
+	})
+	if err != nil {
+		progress.Finish(false)
+		_ = lease.Abort(ctx, nil)
+		return err
+	}
+	progress.Finish(true)
+
+	return lease.Complete(ctx)
+}
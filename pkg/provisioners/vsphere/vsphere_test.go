@@ -0,0 +1,142 @@
+package vsphere
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/govmomi/ovf"
+	"github.com/vorteil/vorteil/pkg/provisioners"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vmdk"
+)
+
+func TestDiskCapacity(t *testing.T) {
+
+	buf := new(bytes.Buffer)
+	assert.NoError(t, binary.Write(buf, binary.LittleEndian, &vmdk.Header{
+		MagicNumber: vmdk.Magic,
+		Capacity:    2048,
+	}))
+	buf.WriteString("grains")
+
+	r := bufio.NewReader(bytes.NewReader(buf.Bytes()))
+	capacity, err := diskCapacity(r)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2048*vmdk.SectorSize), capacity)
+
+	// the header is still there to be uploaded
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, buf.Bytes(), data)
+
+	_, err = diskCapacity(bufio.NewReader(bytes.NewReader(make([]byte, vmdk.SectorSize))))
+	assert.Error(t, err)
+}
+
+func TestDescriptor(t *testing.T) {
+
+	e, err := ovf.Unmarshal(strings.NewReader(descriptor("app<1>", "an app", 1<<30, 12345, nil)))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "app<1>", *e.VirtualSystem.Name)
+	assert.Equal(t, diskFile, e.References[0].Href)
+	assert.Equal(t, uint(12345), e.References[0].Size)
+	assert.Equal(t, "1073741824", e.Disk.Disks[0].Capacity)
+	assert.Len(t, e.Network.Networks, 1)
+
+	// data disks are empty, so they reference no file
+	e, err = ovf.Unmarshal(strings.NewReader(descriptor("app", "", 1<<30, 12345, []int64{2 << 30, 4 << 30})))
+	assert.NoError(t, err)
+
+	assert.Len(t, e.References, 1)
+	assert.Len(t, e.Disk.Disks, 3)
+	assert.Equal(t, "vmdisk3", e.Disk.Disks[2].DiskID)
+	assert.Equal(t, "4294967296", e.Disk.Disks[2].Capacity)
+	assert.Nil(t, e.Disk.Disks[2].FileRef)
+
+	var hostResources []string
+	for _, item := range e.VirtualSystem.VirtualHardware[0].Item {
+		if len(item.HostResource) > 0 {
+			hostResources = append(hostResources, item.HostResource[0])
+		}
+	}
+	assert.Equal(t, []string{"ovf:/disk/vmdisk1", "ovf:/disk/vmdisk2", "ovf:/disk/vmdisk3"}, hostResources)
+}
+
+func TestValidate(t *testing.T) {
+
+	_, err := NewProvisioner(nil, &Config{URL: "vcenter.example.com", Username: "admin", Datacenter: "dc"})
+	assert.Error(t, err)
+
+	p, err := NewProvisioner(nil, &Config{URL: "vcenter.example.com", Username: "admin", Datacenter: "dc", Datastore: "ds"})
+	assert.NoError(t, err)
+	assert.Equal(t, "https", p.url.Scheme)
+	assert.Equal(t, "/sdk", p.url.Path)
+}
+
+func TestDiskSize(t *testing.T) {
+
+	p, err := NewProvisioner(nil, &Config{URL: "vcenter.example.com", Username: "admin", Datacenter: "dc", Datastore: "ds"})
+	assert.NoError(t, err)
+
+	// a 1 MiB alignment conflicts with the vmdk format's 2 MiB, so disks are
+	// only rounded up to what the format needs
+	for in, out := range map[int64]int64{
+		512:                 int64(2 * vcfg.MiB),
+		int64(3 * vcfg.MiB): int64(4 * vcfg.MiB),
+		int64(4 * vcfg.MiB): int64(4 * vcfg.MiB),
+		int64(vcfg.GiB) + 1: int64(vcfg.GiB + 2*vcfg.MiB),
+	} {
+		size, err := vdisk.AlignSize(in, int64(p.SizeAlign()), p.DiskFormat())
+		assert.NoError(t, err)
+		assert.Equal(t, out, size, "%d bytes", in)
+	}
+
+	_, err = vdisk.AlignSize(1, int64(vcfg.MiB), p.DiskFormat())
+	assert.Error(t, err)
+}
+
+func TestConsole(t *testing.T) {
+
+	p, err := NewProvisioner(nil, &Config{URL: "vcenter.example.com", Username: "admin", Datacenter: "dc", Datastore: "ds"})
+	assert.NoError(t, err)
+
+	err = p.Console(context.Background(), "app", ioutil.Discard)
+	assert.True(t, errors.Is(err, provisioners.ErrConsoleUnsupported))
+}
+
+func TestCheckCredentials(t *testing.T) {
+
+	p, err := NewProvisioner(nil, &Config{URL: "https://127.0.0.1:1", Username: "admin", Datacenter: "dc", Datastore: "ds"})
+	assert.NoError(t, err)
+
+	// nothing is listening, so logging in has to fail
+	err = p.CheckCredentials(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to connect to vCenter")
+}
+
+func TestProvisionTags(t *testing.T) {
+
+	p, err := NewProvisioner(nil, &Config{URL: "vcenter.example.com", Username: "admin", Datacenter: "dc", Datastore: "ds"})
+	assert.NoError(t, err)
+
+	err = p.Provision(&provisioners.ProvisionArgs{
+		Name: "app",
+		Tags: map[string]string{"team": "core"},
+	})
+	assert.True(t, errors.Is(err, provisioners.ErrTagsUnsupported))
+}
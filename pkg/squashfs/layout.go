@@ -0,0 +1,669 @@
+package squashfs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// Various squashfs build constants.
+const (
+	Magic          = 0x73717368
+	BlockSize      = 0x20000
+	blockLog       = 17
+	VersionMajor   = 4
+	VersionMinor   = 0
+	SuperblockSize = 96
+
+	metadataSize          = 8192
+	metadataHeaderSize    = 2
+	metadataUncompressed  = 0x8000
+	dataBlockUncompressed = 1 << 24
+
+	compressionGzip = 1
+
+	flagUncompressedInodes    = 0x0001
+	flagUncompressedData      = 0x0002
+	flagUncompressedFragments = 0x0008
+	flagNoFragments           = 0x0010
+	flagNoXattrs              = 0x0200
+	flagUncompressedIDs       = 0x0800
+
+	invalidTable    = 0xFFFFFFFFFFFFFFFF
+	invalidFragment = 0xFFFFFFFF
+	invalidXattr    = 0xFFFFFFFF
+
+	inodeTypeDir      = 1
+	inodeTypeFile     = 2
+	inodeTypeSymlink  = 3
+	inodeTypeExtDir   = 8
+	inodeTypeExtFile  = 9
+	inodeHeaderSize   = 16
+	dirHeaderSize     = 12
+	dirEntrySize      = 8
+	maxEntriesPerHead = 256
+
+	DefaultPermissions = 0700
+	SuperUID           = 1000
+
+	paddingAlignment = 0x1000
+)
+
+// Superblock is the structure of a squashfs superblock as written to the disk.
+type Superblock struct {
+	Magic               uint32
+	Inodes              uint32
+	ModificationTime    uint32
+	BlockSize           uint32
+	Fragments           uint32
+	Compression         uint16
+	BlockLog            uint16
+	Flags               uint16
+	IDs                 uint16
+	VersionMajor        uint16
+	VersionMinor        uint16
+	RootInode           uint64
+	BytesUsed           uint64
+	IDTableStart        uint64
+	XattrIDTableStart   uint64
+	InodeTableStart     uint64
+	DirectoryTableStart uint64
+	FragmentTableStart  uint64
+	ExportTableStart    uint64
+}
+
+type node struct {
+	tn       *vio.TreeNode
+	ino      uint32
+	kind     uint16
+	size     int64
+	mtime    uint32
+	nlink    uint32
+	parent   *node
+	children []*node
+	extended bool
+
+	dataStart  int64
+	dataSize   int64
+	blocks     []uint32
+	inodePos   int64
+	listing    []byte
+	listingPos int64
+}
+
+type layout struct {
+	nodes          []*node
+	inodeStreamLen int64
+	dirStreamLen   int64
+
+	dataEnd             int64
+	inodeTableStart     int64
+	directoryTableStart int64
+	idBlockStart        int64
+	idTableStart        int64
+	bytesUsed           int64
+}
+
+func divide(a, b int64) int64 {
+	return (a + b - 1) / b
+}
+
+func align(a, b int64) int64 {
+	return divide(a, b) * b
+}
+
+// metadataRef converts a position within an uncompressed metadata stream into
+// the offset of the metadata block containing it and the offset within that
+// block. Every block in the stream is full and uncompressed, so this can be
+// calculated directly.
+func metadataRef(pos int64) (block int64, offset int64) {
+	return (pos / metadataSize) * (metadataSize + metadataHeaderSize), pos % metadataSize
+}
+
+func metadataDiskLength(n int64) int64 {
+	return n + divide(n, metadataSize)*metadataHeaderSize
+}
+
+func (n *node) name() string {
+	return path.Base(n.tn.File.Name())
+}
+
+func (n *node) inodeLength() int64 {
+	switch n.kind {
+	case inodeTypeDir:
+		if n.extended {
+			return inodeHeaderSize + 24
+		}
+		return inodeHeaderSize + 16
+	case inodeTypeSymlink:
+		return inodeHeaderSize + 8 + n.size
+	default:
+		blocks := divide(n.size, BlockSize) * 4
+		if n.extended {
+			return inodeHeaderSize + 40 + blocks
+		}
+		return inodeHeaderSize + 16 + blocks
+	}
+}
+
+func (l *layout) scan(ctx context.Context, tree vio.FileTree) error {
+
+	m := make(map[*vio.TreeNode]*node)
+
+	err := tree.WalkNode(func(p string, tn *vio.TreeNode) error {
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n := &node{
+			tn:    tn,
+			ino:   uint32(len(l.nodes) + 1),
+			mtime: uint32(tn.File.ModTime().Unix()),
+			nlink: 1,
+		}
+
+		f := tn.File
+		switch {
+		case f.IsDir():
+			n.kind = inodeTypeDir
+			n.nlink = 2
+		case f.IsSymlink():
+			n.kind = inodeTypeSymlink
+			n.size = int64(f.Size())
+			if f.SymlinkIsCached() {
+				n.size = int64(len(f.Symlink()))
+			}
+		default:
+			n.kind = inodeTypeFile
+			n.size = int64(f.Size())
+		}
+
+		if tn.Parent != nil && tn.Parent != tn {
+			parent, ok := m[tn.Parent]
+			if !ok {
+				return fmt.Errorf("squashfs: parent of '%s' not yet scanned", p)
+			}
+			n.parent = parent
+			parent.children = append(parent.children, n)
+			if n.kind == inodeTypeDir {
+				parent.nlink++
+			}
+		}
+
+		m[tn] = n
+		l.nodes = append(l.nodes, n)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(l.nodes) == 0 {
+		return fmt.Errorf("squashfs: file tree is empty")
+	}
+
+	return nil
+}
+
+// compressData reads the contents of every file, compressing each block with
+// zlib (which squashfs calls gzip) and writing it to data. Blocks that don't
+// get any smaller are stored uncompressed. The size of each block on disk is
+// needed to plan the layout, so this happens before anything else is planned.
+func (l *layout) compressData(ctx context.Context, data io.Writer) error {
+
+	block := make([]byte, BlockSize)
+	buf := new(bytes.Buffer)
+
+	zw, err := zlib.NewWriterLevel(buf, zlib.DefaultCompression)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range l.nodes {
+
+		if n.kind != inodeTypeFile {
+			continue
+		}
+
+		f := n.tn.File
+
+		for remaining := n.size; remaining > 0; remaining -= BlockSize {
+
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			k := remaining
+			if k > BlockSize {
+				k = BlockSize
+			}
+
+			_, err = io.ReadFull(f, block[:k])
+			if err != nil {
+				return fmt.Errorf("squashfs: reading '%s' (%d of %d bytes): %w", n.tn.Path(), n.size-remaining, n.size, err)
+			}
+
+			buf.Reset()
+			zw.Reset(buf)
+			_, err = zw.Write(block[:k])
+			if err != nil {
+				return err
+			}
+
+			err = zw.Close()
+			if err != nil {
+				return err
+			}
+
+			out, size := buf.Bytes(), uint32(buf.Len())
+			if int64(buf.Len()) >= k {
+				out, size = block[:k], uint32(k)|dataBlockUncompressed
+			}
+
+			_, err = data.Write(out)
+			if err != nil {
+				return err
+			}
+
+			n.blocks = append(n.blocks, size)
+			n.dataSize += int64(len(out))
+		}
+
+		_ = f.Close()
+	}
+
+	return nil
+}
+
+func (l *layout) planData() {
+
+	pos := int64(SuperblockSize)
+
+	for _, n := range l.nodes {
+		if n.kind != inodeTypeFile {
+			continue
+		}
+		n.dataStart = pos
+		pos += n.dataSize
+		if n.size > 0xFFFFFFFF || n.dataStart > 0xFFFFFFFF {
+			n.extended = true
+		}
+	}
+
+	l.dataEnd = pos
+}
+
+func (l *layout) planInodes() {
+
+	var pos int64
+
+	for _, n := range l.nodes {
+
+		if n.kind == inodeTypeDir {
+			sort.Slice(n.children, func(i, j int) bool {
+				return n.children[i].name() < n.children[j].name()
+			})
+
+			// worst case: one header per entry
+			bound := int64(3)
+			for _, child := range n.children {
+				bound += dirHeaderSize + dirEntrySize + int64(len(child.name()))
+			}
+			n.extended = bound > 0xFFFF
+		}
+
+		n.inodePos = pos
+		pos += n.inodeLength()
+	}
+
+	l.inodeStreamLen = pos
+}
+
+func (l *layout) planListings() error {
+
+	var pos int64
+
+	for _, n := range l.nodes {
+
+		if n.kind != inodeTypeDir {
+			continue
+		}
+
+		buf := new(bytes.Buffer)
+		var headerBlock int64
+		var headerIno uint32
+		var entries []*node
+
+		flush := func() {
+			if len(entries) == 0 {
+				return
+			}
+			_ = binary.Write(buf, binary.LittleEndian, []uint32{uint32(len(entries) - 1), uint32(headerBlock), headerIno})
+			for _, child := range entries {
+				_, offset := metadataRef(child.inodePos)
+				name := child.name()
+				_ = binary.Write(buf, binary.LittleEndian, struct {
+					Offset     uint16
+					InodeDelta int16
+					Type       uint16
+					NameSize   uint16
+				}{uint16(offset), int16(int64(child.ino) - int64(headerIno)), child.kind, uint16(len(name) - 1)})
+				buf.WriteString(name)
+			}
+			entries = nil
+		}
+
+		for _, child := range n.children {
+			if len(child.name()) == 0 || len(child.name()) > 256 {
+				return fmt.Errorf("squashfs: invalid file name length: '%s'", child.name())
+			}
+			block, _ := metadataRef(child.inodePos)
+			delta := int64(child.ino) - int64(headerIno)
+			if len(entries) == maxEntriesPerHead || (len(entries) > 0 && (block != headerBlock || delta < -32768 || delta > 32767)) {
+				flush()
+			}
+			if len(entries) == 0 {
+				headerBlock = block
+				headerIno = child.ino
+			}
+			entries = append(entries, child)
+		}
+		flush()
+
+		n.listing = buf.Bytes()
+		n.listingPos = pos
+		pos += int64(len(n.listing))
+	}
+
+	l.dirStreamLen = pos
+	return nil
+}
+
+func (l *layout) plan(ctx context.Context, tree vio.FileTree, data io.Writer) error {
+
+	err := l.scan(ctx, tree)
+	if err != nil {
+		return err
+	}
+
+	err = l.compressData(ctx, data)
+	if err != nil {
+		return err
+	}
+
+	l.planData()
+	l.planInodes()
+
+	err = l.planListings()
+	if err != nil {
+		return err
+	}
+
+	l.inodeTableStart = l.dataEnd
+	l.directoryTableStart = l.inodeTableStart + metadataDiskLength(l.inodeStreamLen)
+	l.idBlockStart = l.directoryTableStart + metadataDiskLength(l.dirStreamLen)
+	l.idTableStart = l.idBlockStart + metadataHeaderSize + 4
+	l.bytesUsed = l.idTableStart + 8
+
+	return nil
+}
+
+func (l *layout) superblock() *Superblock {
+
+	block, offset := metadataRef(l.nodes[0].inodePos)
+
+	return &Superblock{
+		Magic:               Magic,
+		Inodes:              uint32(len(l.nodes)),
+		ModificationTime:    l.nodes[0].mtime,
+		BlockSize:           BlockSize,
+		Fragments:           0,
+		Compression:         compressionGzip,
+		BlockLog:            blockLog,
+		Flags:               flagUncompressedInodes | flagUncompressedFragments | flagNoFragments | flagNoXattrs | flagUncompressedIDs,
+		IDs:                 1,
+		VersionMajor:        VersionMajor,
+		VersionMinor:        VersionMinor,
+		RootInode:           uint64(block<<16 | offset),
+		BytesUsed:           uint64(l.bytesUsed),
+		IDTableStart:        uint64(l.idTableStart),
+		XattrIDTableStart:   invalidTable,
+		InodeTableStart:     uint64(l.inodeTableStart),
+		DirectoryTableStart: uint64(l.directoryTableStart),
+		FragmentTableStart:  invalidTable,
+		ExportTableStart:    invalidTable,
+	}
+}
+
+func (l *layout) writeData(ctx context.Context, w io.Writer, data io.Reader) (map[*node][]byte, error) {
+
+	// file contents were already compressed in order by compressData
+	k, err := io.CopyN(w, data, l.dataEnd-SuperblockSize)
+	if err != nil {
+		return nil, fmt.Errorf("squashfs: writing file data (%d of %d bytes): %w", k, l.dataEnd-SuperblockSize, err)
+	}
+
+	targets := make(map[*node][]byte)
+
+	for _, n := range l.nodes {
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		f := n.tn.File
+
+		switch n.kind {
+		case inodeTypeFile:
+			continue
+		case inodeTypeSymlink:
+			var target []byte
+			if f.SymlinkIsCached() {
+				target = []byte(f.Symlink())
+			} else {
+				var err error
+				target, err = ioutil.ReadAll(f)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if int64(len(target)) != n.size {
+				return nil, fmt.Errorf("squashfs: symlink '%s' changed size during build", n.tn.Path())
+			}
+			targets[n] = target
+		}
+
+		_ = f.Close()
+	}
+
+	return targets, nil
+}
+
+func (l *layout) inodeTable(targets map[*node][]byte) ([]byte, error) {
+
+	buf := new(bytes.Buffer)
+
+	for _, n := range l.nodes {
+
+		if int64(buf.Len()) != n.inodePos {
+			return nil, fmt.Errorf("squashfs: inode %d misplaced", n.ino)
+		}
+
+		// the mode only holds permissions: the type comes from itype, and
+		// the kernel rejects inodes that have type bits in their mode
+		var mode, itype uint16
+		switch n.kind {
+		case inodeTypeDir:
+			mode = DefaultPermissions
+			itype = inodeTypeDir
+			if n.extended {
+				itype = inodeTypeExtDir
+			}
+		case inodeTypeSymlink:
+			mode = 0777
+			itype = inodeTypeSymlink
+		default:
+			mode = DefaultPermissions
+			itype = inodeTypeFile
+			if n.extended {
+				itype = inodeTypeExtFile
+			}
+		}
+
+		_ = binary.Write(buf, binary.LittleEndian, struct {
+			Type  uint16
+			Mode  uint16
+			UID   uint16
+			GID   uint16
+			MTime uint32
+			Ino   uint32
+		}{itype, mode, 0, 0, n.mtime, n.ino})
+
+		switch n.kind {
+		case inodeTypeDir:
+			l.writeDirInode(buf, n)
+		case inodeTypeSymlink:
+			_ = binary.Write(buf, binary.LittleEndian, []uint32{n.nlink, uint32(n.size)})
+			buf.Write(targets[n])
+		default:
+			l.writeFileInode(buf, n)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (l *layout) writeDirInode(buf *bytes.Buffer, n *node) {
+
+	block, offset := metadataRef(n.listingPos)
+	parent := uint32(len(l.nodes) + 1)
+	if n.parent != nil {
+		parent = n.parent.ino
+	}
+	size := len(n.listing) + 3
+
+	if n.extended {
+		_ = binary.Write(buf, binary.LittleEndian, struct {
+			Links      uint32
+			Size       uint32
+			Block      uint32
+			Parent     uint32
+			IndexCount uint16
+			Offset     uint16
+			Xattr      uint32
+		}{n.nlink, uint32(size), uint32(block), parent, 0, uint16(offset), invalidXattr})
+		return
+	}
+
+	_ = binary.Write(buf, binary.LittleEndian, struct {
+		Block  uint32
+		Links  uint32
+		Size   uint16
+		Offset uint16
+		Parent uint32
+	}{uint32(block), n.nlink, uint16(size), uint16(offset), parent})
+}
+
+func (l *layout) writeFileInode(buf *bytes.Buffer, n *node) {
+
+	if n.extended {
+		_ = binary.Write(buf, binary.LittleEndian, struct {
+			Start    uint64
+			Size     uint64
+			Sparse   uint64
+			Links    uint32
+			Fragment uint32
+			Offset   uint32
+			Xattr    uint32
+		}{uint64(n.dataStart), uint64(n.size), 0, n.nlink, invalidFragment, 0, invalidXattr})
+	} else {
+		_ = binary.Write(buf, binary.LittleEndian, []uint32{uint32(n.dataStart), invalidFragment, 0, uint32(n.size)})
+	}
+
+	_ = binary.Write(buf, binary.LittleEndian, n.blocks)
+}
+
+func writeMetadata(w io.Writer, data []byte) error {
+
+	for len(data) > 0 {
+		k := len(data)
+		if k > metadataSize {
+			k = metadataSize
+		}
+
+		err := binary.Write(w, binary.LittleEndian, uint16(k)|metadataUncompressed)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(data[:k])
+		if err != nil {
+			return err
+		}
+
+		data = data[k:]
+	}
+
+	return nil
+}
+
+func (l *layout) write(ctx context.Context, w io.Writer, data io.Reader) error {
+
+	err := binary.Write(w, binary.LittleEndian, l.superblock())
+	if err != nil {
+		return err
+	}
+
+	targets, err := l.writeData(ctx, w, data)
+	if err != nil {
+		return err
+	}
+
+	inodes, err := l.inodeTable(targets)
+	if err != nil {
+		return err
+	}
+
+	err = writeMetadata(w, inodes)
+	if err != nil {
+		return err
+	}
+
+	listings := new(bytes.Buffer)
+	for _, n := range l.nodes {
+		listings.Write(n.listing)
+	}
+
+	err = writeMetadata(w, listings.Bytes())
+	if err != nil {
+		return err
+	}
+
+	// the id table has a single entry: the owner of every file
+	err = writeMetadata(w, []byte{SuperUID & 0xFF, SuperUID >> 8, 0, 0})
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(w, binary.LittleEndian, uint64(l.idBlockStart))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(w, vio.Zeroes, align(l.bytesUsed, paddingAlignment)-l.bytesUsed)
+	return err
+}
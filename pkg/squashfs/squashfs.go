@@ -0,0 +1,195 @@
+package squashfs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// CompilerArgs organizes all inputs necessary to create a new Compiler.
+type CompilerArgs struct {
+	FileTree vio.FileTree
+	Logger   elog.Logger
+
+	// TempDir is where compressed file contents are kept between Commit and
+	// Compile. If empty, the default directory for temporary files is used.
+	TempDir string
+}
+
+// Compiler keeps all variables and settings for a single squashfs compile
+// operation. It follows the same staged design as the ext compiler:
+// NewCompiler, Commit, Precompile, Compile. Because squashfs is read-only, the
+// free space and inode settings used by ext are accepted but have no effect.
+//
+// File contents are compressed with gzip, without fragments. The layout depends
+// on the compressed size of every block, so Commit reads and compresses every
+// file into a temporary file, and Compile copies it into the image in one
+// continuous stream. Metadata is left uncompressed. Call Close to remove the
+// temporary file.
+type Compiler struct {
+	log        elog.Logger
+	tree       vio.FileTree
+	tmp        string
+	data       *os.File
+	size       int64
+	transforms []vio.Transform
+
+	layout
+}
+
+// NewCompiler returns an initialized Compiler object. The next necessary step
+// is to call Commit on this Compiler, but before doing so it is possible to
+// modify its contents with functions like Mkdir and AddFile.
+func NewCompiler(args *CompilerArgs) *Compiler {
+	c := new(Compiler)
+	c.tree = args.FileTree
+	c.log = args.Logger
+	c.tmp = args.TempDir
+	return c
+}
+
+// Mkdir allows the caller to add an empty directory to the file-system at
+// 'path' if no file or directory is already mapped there. This function must
+// be called before calling Commit, otherwise the behaviour is undefined.
+func (c *Compiler) Mkdir(path string) error {
+
+	_, base := filepath.Split(path)
+	return c.tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+		Name:  base,
+		IsDir: true,
+	}))
+}
+
+// AddFile allows the caller to add a file to the file-system at 'path'. This
+// function must be called before calling Commit, otherwise the behaviour is
+// undefined.
+func (c *Compiler) AddFile(path string, r io.ReadCloser, size int64, force bool) error {
+
+	_, base := filepath.Split(path)
+	return c.tree.Map(path, vio.CustomFile(vio.CustomFileArgs{
+		Name:       base,
+		Size:       int(size),
+		ReadCloser: r,
+	}))
+}
+
+// AddTransform allows the caller to change the contents of every file whose
+// path 'matcher' returns true for, like the ext compiler's AddTransform. This
+// function must be called before calling Commit, otherwise the behaviour is
+// undefined.
+func (c *Compiler) AddTransform(matcher func(path string) bool, transform func(io.Reader) (io.Reader, error)) {
+	c.transforms = append(c.transforms, vio.Transform{
+		Match: matcher,
+		Apply: transform,
+	})
+}
+
+// IncreaseMinimumInodes has no effect on a read-only file-system.
+func (c *Compiler) IncreaseMinimumInodes(inodes int64) {}
+
+// SetMinimumInodes has no effect on a read-only file-system.
+func (c *Compiler) SetMinimumInodes(inodes int64) {}
+
+// SetMinimumInodesPer64MiB has no effect on a read-only file-system.
+func (c *Compiler) SetMinimumInodesPer64MiB(inodes int64) {}
+
+// IncreaseMinimumFreeSpace has no effect on a read-only file-system, since
+// nothing can ever use the space.
+func (c *Compiler) IncreaseMinimumFreeSpace(space int64) {
+	if space > 0 && c.log != nil {
+		c.log.Warnf("Ignoring %d bytes of requested free space: squashfs is read-only", space)
+	}
+}
+
+// Commit locks in the contents of the file-system and calculates its complete
+// layout, and therefore its minimum size. Any calls to functions that change
+// the contents of the file-system must be done before this function is called.
+func (c *Compiler) Commit(ctx context.Context) error {
+
+	err := vio.ApplyTransforms(c.tree, c.transforms)
+	if err != nil {
+		return err
+	}
+
+	c.data, err = ioutil.TempFile(c.tmp, "vorteil-squashfs-")
+	if err != nil {
+		return err
+	}
+
+	return c.layout.plan(ctx, c.tree, c.data)
+}
+
+// MinimumSize returns the minimum number of bytes needed to contain the
+// file-system image. It can be called after a successful call to Commit.
+func (c *Compiler) MinimumSize() int64 {
+	return align(c.bytesUsed, paddingAlignment)
+}
+
+// Precompile locks in the size of the partition the file-system will be
+// written to. It must be called only after a successful Commit and is
+// necessary before calling Compile.
+func (c *Compiler) Precompile(ctx context.Context, size int64) error {
+
+	if size < c.MinimumSize() {
+		return errors.New("squashfs partition is too small to contain the file-system")
+	}
+
+	c.size = size
+	return nil
+}
+
+// RegionIsHole can be called after a successful Precompile. It returns true if
+// every byte starting at begin and continuing for the full size is zeroed,
+// which is only true for the padding after the end of the file-system.
+func (c *Compiler) RegionIsHole(begin, size int64) bool {
+	return begin >= c.MinimumSize()
+}
+
+// Compile writes the file-system to the provided io.WriteSeeker, w. It never
+// seeks backwards, which means you can wrap any io.Writer with a
+// vio.WriteSeeker and it will work.
+func (c *Compiler) Compile(ctx context.Context, w io.WriteSeeker) error {
+
+	_, err := c.data.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = c.layout.write(ctx, w, c.data)
+	if err != nil {
+		return err
+	}
+
+	// seek to the end of the image
+	_, err = w.Seek(c.size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Close removes the temporary file holding the compressed file contents. It is
+// safe to call whether or not Commit succeeded.
+func (c *Compiler) Close() error {
+
+	if c.data == nil {
+		return nil
+	}
+
+	_ = c.data.Close()
+	err := os.Remove(c.data.Name())
+	c.data = nil
+	return err
+}
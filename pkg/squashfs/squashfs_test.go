@@ -0,0 +1,266 @@
+package squashfs
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// readMetadata strips the block headers from an uncompressed metadata stream.
+func readMetadata(t *testing.T, data []byte) []byte {
+	var out []byte
+	for len(data) > 0 {
+		hdr := binary.LittleEndian.Uint16(data)
+		assert.NotZero(t, hdr&metadataUncompressed)
+		k := int(hdr &^ metadataUncompressed)
+		out = append(out, data[2:2+k]...)
+		data = data[2+k:]
+	}
+	return out
+}
+
+func TestCompile(t *testing.T) {
+
+	ctx := context.Background()
+	content := "hello, world\n"
+
+	tree := vio.NewFileTree()
+	c := NewCompiler(&CompilerArgs{FileTree: tree})
+	defer c.Close()
+	assert.NoError(t, c.Mkdir("tmp"))
+	assert.NoError(t, c.AddFile("etc/hello", ioutil.NopCloser(strings.NewReader(content)), int64(len(content)), false))
+	assert.NoError(t, c.Commit(ctx))
+
+	size := c.MinimumSize()
+	assert.Zero(t, size%paddingAlignment)
+	assert.NoError(t, c.Precompile(ctx, size))
+	assert.Error(t, c.Precompile(ctx, size-1))
+	assert.NoError(t, c.Precompile(ctx, size))
+
+	buf := new(bytes.Buffer)
+	ws, err := vio.WriteSeeker(buf)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Compile(ctx, ws))
+
+	img := buf.Bytes()
+	assert.Equal(t, int64(len(img)), size)
+
+	sb := new(Superblock)
+	assert.NoError(t, binary.Read(bytes.NewReader(img), binary.LittleEndian, sb))
+	assert.Equal(t, uint32(Magic), sb.Magic)
+	assert.Equal(t, uint32(4), sb.Inodes)
+	assert.Equal(t, uint16(VersionMajor), sb.VersionMajor)
+	assert.Equal(t, uint64(c.bytesUsed), sb.BytesUsed)
+
+	// file data directly follows the superblock
+	assert.Equal(t, content, string(img[SuperblockSize:SuperblockSize+len(content)]))
+
+	// the id table points at a single uid
+	idBlock := binary.LittleEndian.Uint64(img[sb.IDTableStart:])
+	ids := readMetadata(t, img[idBlock:sb.IDTableStart])
+	assert.Equal(t, uint32(SuperUID), binary.LittleEndian.Uint32(ids))
+
+	inodes := readMetadata(t, img[sb.InodeTableStart:sb.DirectoryTableStart])
+	dirs := readMetadata(t, img[sb.DirectoryTableStart:idBlock])
+
+	// root directory inode
+	root := inodes[sb.RootInode&0xFFFF:]
+	assert.Equal(t, uint16(inodeTypeDir), binary.LittleEndian.Uint16(root))
+	assert.Equal(t, uint16(DefaultPermissions), binary.LittleEndian.Uint16(root[2:]))
+	assert.Equal(t, uint32(1), binary.LittleEndian.Uint32(root[12:]))
+	assert.Equal(t, uint32(5), binary.LittleEndian.Uint32(root[28:]))
+
+	entries := readListing(t, dirs, root)
+	assert.Len(t, entries, 2)
+	assert.Contains(t, entries, "tmp")
+
+	etc := inodes[entries["etc"]:]
+	assert.Equal(t, uint16(inodeTypeDir), binary.LittleEndian.Uint16(etc))
+	entries = readListing(t, dirs, etc)
+	assert.Len(t, entries, 1)
+
+	file := inodes[entries["hello"]:]
+	assert.Equal(t, uint16(inodeTypeFile), binary.LittleEndian.Uint16(file))
+	assert.Equal(t, uint32(SuperblockSize), binary.LittleEndian.Uint32(file[16:]))
+	assert.Equal(t, uint32(len(content)), binary.LittleEndian.Uint32(file[28:]))
+	// it's too small to shrink, so it's stored uncompressed
+	assert.Equal(t, uint32(len(content))|dataBlockUncompressed, binary.LittleEndian.Uint32(file[32:]))
+}
+
+// compile builds a squashfs image containing the files in files, keeping its
+// temporary files in tmp.
+func compile(t *testing.T, tmp string, files map[string][]byte) []byte {
+
+	ctx := context.Background()
+
+	tree := vio.NewFileTree()
+	c := NewCompiler(&CompilerArgs{FileTree: tree, TempDir: tmp})
+	defer c.Close()
+
+	for name, data := range files {
+		assert.NoError(t, c.AddFile(name, ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), false))
+	}
+	assert.NoError(t, c.Commit(ctx))
+	assert.NoError(t, c.Precompile(ctx, c.MinimumSize()))
+
+	buf := new(bytes.Buffer)
+	ws, err := vio.WriteSeeker(buf)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Compile(ctx, ws))
+
+	return buf.Bytes()
+}
+
+func testFiles() map[string][]byte {
+
+	random := make([]byte, BlockSize)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	return map[string][]byte{
+		"etc/hello": []byte("hello, world\n"),
+		"text":      bytes.Repeat([]byte("all work and no play makes jack a dull boy\n"), 2*BlockSize/43+100),
+		"random":    append(random, bytes.Repeat([]byte{0}, BlockSize/2)...),
+	}
+}
+
+func TestCompileCompressed(t *testing.T) {
+
+	tmp, err := ioutil.TempDir("", "squashfs-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	files := testFiles()
+	img := compile(t, tmp, files)
+
+	// Close removes the compressed contents
+	leftover, err := ioutil.ReadDir(tmp)
+	assert.NoError(t, err)
+	assert.Empty(t, leftover)
+
+	sb := new(Superblock)
+	assert.NoError(t, binary.Read(bytes.NewReader(img), binary.LittleEndian, sb))
+	assert.Equal(t, uint16(compressionGzip), sb.Compression)
+	assert.Zero(t, sb.Flags&flagUncompressedData)
+
+	idBlock := binary.LittleEndian.Uint64(img[sb.IDTableStart:])
+	inodes := readMetadata(t, img[sb.InodeTableStart:sb.DirectoryTableStart])
+	dirs := readMetadata(t, img[sb.DirectoryTableStart:idBlock])
+	entries := readListing(t, dirs, inodes[sb.RootInode&0xFFFF:])
+
+	read := func(name string) ([]byte, []uint32) {
+		file := inodes[entries[name]:]
+		assert.Equal(t, uint16(inodeTypeFile), binary.LittleEndian.Uint16(file))
+		start := binary.LittleEndian.Uint32(file[16:])
+		size := binary.LittleEndian.Uint32(file[28:])
+
+		var data []byte
+		var sizes []uint32
+		for i := uint32(0); i < (size+BlockSize-1)/BlockSize; i++ {
+			bs := binary.LittleEndian.Uint32(file[32+4*i:])
+			sizes = append(sizes, bs)
+			k := bs &^ dataBlockUncompressed
+			block := img[start : start+k]
+			start += k
+			if bs&dataBlockUncompressed != 0 {
+				data = append(data, block...)
+				continue
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(block))
+			assert.NoError(t, err)
+			out, err := ioutil.ReadAll(zr)
+			assert.NoError(t, err)
+			data = append(data, out...)
+		}
+		return data, sizes
+	}
+
+	text, sizes := read("text")
+	assert.Equal(t, files["text"], text)
+	assert.Len(t, sizes, 3)
+	for _, bs := range sizes {
+		assert.Zero(t, bs&dataBlockUncompressed)
+	}
+
+	// random data doesn't compress, but the zeroes after it do
+	random, sizes := read("random")
+	assert.Equal(t, files["random"], random)
+	assert.Equal(t, []uint32{BlockSize | dataBlockUncompressed}, sizes[:1])
+	assert.Zero(t, sizes[1]&dataBlockUncompressed)
+
+	assert.Less(t, len(img), len(files["text"])+len(files["random"]))
+}
+
+func TestUnsquashfs(t *testing.T) {
+
+	unsquashfs, err := exec.LookPath("unsquashfs")
+	if err != nil {
+		t.Skip("unsquashfs not installed")
+	}
+
+	tmp, err := ioutil.TempDir("", "squashfs-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	files := testFiles()
+	img := filepath.Join(tmp, "image.squashfs")
+	assert.NoError(t, ioutil.WriteFile(img, compile(t, tmp, files), 0644))
+
+	dir := filepath.Join(tmp, "out")
+	out, err := exec.Command(unsquashfs, "-no-xattrs", "-d", dir, img).CombinedOutput()
+	assert.NoError(t, err, string(out))
+
+	for name, data := range files {
+		extracted, err := ioutil.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err, name)
+		assert.Equal(t, data, extracted, name)
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, fis, len(files))
+}
+
+// readListing returns the inode offsets of the entries in the listing of a
+// basic directory inode.
+func readListing(t *testing.T, dirs, inode []byte) map[string]int {
+
+	size := int(binary.LittleEndian.Uint16(inode[24:])) - 3
+	offset := int(binary.LittleEndian.Uint16(inode[26:]))
+	listing := dirs[offset : offset+size]
+
+	entries := make(map[string]int)
+	for len(listing) > 0 {
+		count := int(binary.LittleEndian.Uint32(listing)) + 1
+		listing = listing[dirHeaderSize:]
+		for i := 0; i < count; i++ {
+			n := int(binary.LittleEndian.Uint16(listing[6:])) + 1
+			entries[string(listing[dirEntrySize:dirEntrySize+n])] = int(binary.LittleEndian.Uint16(listing))
+			listing = listing[dirEntrySize+n:]
+		}
+	}
+
+	return entries
+}
+
+func TestMetadataRef(t *testing.T) {
+	block, offset := metadataRef(metadataSize + 10)
+	assert.Equal(t, int64(metadataSize+metadataHeaderSize), block)
+	assert.Equal(t, int64(10), offset)
+	assert.Equal(t, int64(metadataSize+1+2*metadataHeaderSize), metadataDiskLength(metadataSize+1))
+}
@@ -17,47 +17,126 @@ import (
 // if they are not set
 func WithDefaults(v *VCFG, logger elog.View) error {
 
-	if v.Networks == nil {
-		v.Networks = make([]NetworkInterface, 0)
-	}
-	if len(v.Networks) == 0 {
+	if len(v.Networks) == 0 && !v.System.ServiceDisabled(DHCPService) {
 		logger.Debugf("Creating default NIC with IP = dhcp")
-		v.Networks = append(v.Networks, NetworkInterface{
-			IP: "dhcp",
-		})
 	}
 
 	if v.VM.RAM.String() == "" {
 		logger.Debugf("Using default ram. RAM (128 MiB)")
-		nBytes := 128 * 1024 * 1024
-		v.VM.RAM = Bytes(nBytes)
 	}
 
 	if v.VM.CPUs == 0 {
 		logger.Debugf("Using default no. CPUs (1)")
-		v.VM.CPUs = 1
 	}
 
-	if v.System.Hostname == "" {
-		if v.Info.Name != "" {
-			v.System.Hostname = fmt.Sprintf("%s-$SALT", sanitizeHostname(v.Info.Name))
-		} else {
-			v.System.Hostname = "vorteil-$SALT"
-		}
+	hostname := v.System.Hostname
+
+	v.ApplyDefaults()
+
+	if hostname == "" {
 		logger.Debugf("Setting empty hostname field to '%s'", v.System.Hostname)
 	}
 
-	for i := range v.Programs {
-		if v.Programs[i].Terminate == "" {
-			v.Programs[i].Terminate = DefaultTerminateSignal
+	return nil
+}
+
+// ApplyDefaults fills in every unset field that has a documented default, so
+// that the VCFG describes exactly what the VM will run with. Network MTUs are
+// the exception, because their default depends on the disk format. No default
+// NIC is added if the dhcp service is disabled. Calling it more than once has
+// no further effect.
+func (vcfg *VCFG) ApplyDefaults() {
+
+	if len(vcfg.Networks) == 0 && !vcfg.System.ServiceDisabled(DHCPService) {
+		vcfg.Networks = []NetworkInterface{{
+			IP: "dhcp",
+		}}
+	}
+
+	for i := range vcfg.Networks {
+		nic := &vcfg.Networks[i]
+		if nic.IP == "" {
+			switch nic.NetworkMode() {
+			case "", DHCPNetworkMode:
+				nic.IP = string(DHCPNetworkMode)
+			case SLAACNetworkMode:
+				nic.IP = string(SLAACNetworkMode)
+			}
 		}
 	}
 
-	if v.System.TerminateWait == 0 {
-		v.System.TerminateWait = 3000
+	if vcfg.VM.RAM.String() == "" {
+		vcfg.VM.RAM = Bytes(128 * 1024 * 1024)
 	}
 
-	return nil
+	if vcfg.VM.CPUs == 0 {
+		vcfg.VM.CPUs = 1
+	}
+
+	if vcfg.System.Hostname == "" {
+		if vcfg.Info.Name != "" {
+			vcfg.System.Hostname = fmt.Sprintf("%s-$SALT", sanitizeHostname(vcfg.Info.Name))
+		} else {
+			vcfg.System.Hostname = "vorteil-$SALT"
+		}
+	}
+
+	if vcfg.System.TerminateWait == 0 {
+		vcfg.System.TerminateWait = 3000
+	}
+
+	if len(vcfg.System.DNS) == 0 {
+		vcfg.System.DNS = []string{"8.8.8.8"}
+	}
+
+	if vcfg.System.MaxFDs == 0 {
+		vcfg.System.MaxFDs = 1024
+	}
+
+	if vcfg.System.User == "" {
+		vcfg.System.User = "root"
+	}
+
+	for i := range vcfg.Programs {
+
+		p := &vcfg.Programs[i]
+
+		if p.Cwd == "" {
+			p.Cwd = "/"
+		}
+
+		// output sent to a file or device by the logging destination is
+		// written there directly, rather than to the console
+		if sink, out, err := p.Logging.Sink(); err == nil && (sink == FileLogSink || sink == SerialLogSink) {
+			if p.Stdout == "" {
+				p.Stdout = out
+			}
+			if p.Stderr == "" {
+				p.Stderr = out
+			}
+		}
+
+		if p.Stdout == "" {
+			p.Stdout = "/dev/vtty"
+		}
+
+		if p.Stderr == "" {
+			p.Stderr = "/dev/vtty"
+		}
+
+		if p.Privilege == "" {
+			p.Privilege = RootPrivilege
+		}
+
+		if p.Terminate == "" {
+			p.Terminate = DefaultTerminateSignal
+		}
+
+		if p.Type == "" {
+			p.Type = DefaultProgramType
+		}
+
+	}
 }
 
 var hostnameRegexp = regexp.MustCompile(`(([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9\-]*[a-zA-Z0-9])\.)*([A-Za-z0-9]|[A-Za-z0-9][A-Za-z0-9\-]*[A-Za-z0-9])`)
@@ -0,0 +1,179 @@
+package vcfg
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+//EnvType : The kind of value an environment variable must hold
+type EnvType string
+
+var (
+	//StringEnvType : any value (default)
+	StringEnvType = EnvType("string")
+	//IntEnvType : a base 10 integer, e.g. '-3'
+	IntEnvType = EnvType("int")
+	//FloatEnvType : a decimal number, e.g. '0.5'
+	FloatEnvType = EnvType("float")
+	//BoolEnvType : 'true' or 'false', or anything else strconv.ParseBool accepts, e.g. '1'
+	BoolEnvType = EnvType("bool")
+	//PortEnvType : a TCP or UDP port number, from 1 to 65535
+	PortEnvType = EnvType("port")
+	//DurationEnvType : a Go duration, e.g. '1m30s'
+	DurationEnvType = EnvType("duration")
+	//URLEnvType : an absolute URL, e.g. 'https://example.com/api'
+	URLEnvType = EnvType("url")
+)
+
+// EnvTypes lists every supported EnvType.
+var EnvTypes = []EnvType{StringEnvType, IntEnvType, FloatEnvType, BoolEnvType, PortEnvType, DurationEnvType, URLEnvType}
+
+// Validate : Check if EnvType is a supported type. An empty type is a string.
+func (t *EnvType) Validate() error {
+	if *t == "" {
+		return nil
+	}
+	for _, x := range EnvTypes {
+		if *t == x {
+			return nil
+		}
+	}
+	return fmt.Errorf("environment variable type '%s' is not supported (should be one of %v)", *t, EnvTypes)
+}
+
+// Check returns an error if value isn't of type t.
+func (t EnvType) Check(value string) error {
+
+	var err error
+
+	switch t {
+	case "", StringEnvType:
+	case IntEnvType:
+		_, err = strconv.ParseInt(value, 10, 64)
+	case FloatEnvType:
+		_, err = strconv.ParseFloat(value, 64)
+	case BoolEnvType:
+		_, err = strconv.ParseBool(value)
+	case PortEnvType:
+		var port uint64
+		port, err = strconv.ParseUint(value, 10, 16)
+		if err == nil && port == 0 {
+			err = fmt.Errorf("port 0 is not usable")
+		}
+	case DurationEnvType:
+		_, err = time.ParseDuration(value)
+	case URLEnvType:
+		var u *url.URL
+		u, err = url.Parse(value)
+		if err == nil && (u.Scheme == "" || u.Host == "") {
+			err = fmt.Errorf("not an absolute url")
+		}
+	default:
+		return t.Validate()
+	}
+
+	if err != nil {
+		return fmt.Errorf("'%s' is not a valid %s", value, t)
+	}
+
+	return nil
+}
+
+// EnvVar describes an environment variable a program expects, so that a
+// VCFG missing it, or giving it a value of the wrong type, can be caught
+// before it's built into an image that fails on boot.
+type EnvVar struct {
+	Name     string  `toml:"name" json:"name"`
+	Type     EnvType `toml:"type,omitempty" json:"type,omitempty"`
+	Required bool    `toml:"required,omitempty" json:"required,omitempty"`
+}
+
+// checkEnv returns a problem for every variable in schema that's required
+// but missing from env, or set to a value of the wrong type, and for every
+// invalid entry in schema.
+func checkEnv(env []string, schema []EnvVar) []error {
+
+	var errs []error
+
+	values := make(map[string]string)
+	for _, s := range env {
+		k := envKey(s)
+		v := ""
+		if len(s) > len(k) {
+			v = s[len(k)+1:]
+		}
+		values[k] = v
+	}
+
+	seen := make(map[string]bool)
+	for _, ev := range schema {
+
+		if !ValidEnvKey(ev.Name) {
+			errs = append(errs, fmt.Errorf("env-schema: invalid environment variable name '%s'", ev.Name))
+			continue
+		}
+		if seen[ev.Name] {
+			errs = append(errs, fmt.Errorf("env-schema: environment variable '%s' is described more than once", ev.Name))
+			continue
+		}
+		seen[ev.Name] = true
+
+		if err := ev.Type.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("env-schema: %s: %v", ev.Name, err))
+			continue
+		}
+
+		v, ok := values[ev.Name]
+		if !ok {
+			if ev.Required {
+				errs = append(errs, fmt.Errorf("required environment variable '%s' is not set", ev.Name))
+			}
+			continue
+		}
+
+		if err := ev.Type.Check(v); err != nil {
+			errs = append(errs, fmt.Errorf("environment variable '%s': %v", ev.Name, err))
+		}
+	}
+
+	return errs
+}
+
+// ValidateEnv checks the program's environment against its EnvSchema, if it
+// has one: every required variable must be set, and every variable that is
+// set must be of the type it's described as.
+func (p *Program) ValidateEnv() error {
+	errs := checkEnv(p.Env, p.EnvSchema)
+	if len(errs) > 0 {
+		return ValidationError(errs)
+	}
+	return nil
+}
+
+// ValidateEnv checks the environment of every program in cfg against schema,
+// which is useful for checking a VCFG against a schema shared between
+// services without adding it to each program. Every problem is returned
+// together as a ValidationError.
+func ValidateEnv(cfg *VCFG, schema []EnvVar) error {
+
+	var errs ValidationError
+
+	for i := range cfg.Programs {
+		for _, err := range checkEnv(cfg.Programs[i].Env, schema) {
+			errs = append(errs, fmt.Errorf("program[%d]: %v", i, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
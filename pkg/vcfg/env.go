@@ -0,0 +1,151 @@
+package vcfg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var envKeyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidEnvKey returns true if key is a valid environment variable name: a
+// letter or underscore followed by any number of letters, digits, and
+// underscores.
+func ValidEnvKey(key string) bool {
+	return envKeyRegexp.MatchString(key)
+}
+
+func envKey(s string) string {
+	if i := strings.Index(s, "="); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// MergeEnv combines lists of KEY=VALUE environment variables. Where a key
+// appears more than once the last value wins, but it keeps the position of the
+// key's first appearance.
+func MergeEnv(envs ...[]string) []string {
+
+	out := make([]string, 0)
+	index := make(map[string]int)
+
+	for _, env := range envs {
+		for _, s := range env {
+			k := envKey(s)
+			if i, ok := index[k]; ok {
+				out[i] = s
+				continue
+			}
+			index[k] = len(out)
+			out = append(out, s)
+		}
+	}
+
+	return out
+}
+
+func parseEnvValue(s string) (string, error) {
+
+	if s == "" {
+		return "", nil
+	}
+
+	switch q := s[0]; q {
+	case '\'', '"':
+		end := -1
+		for i := 1; i < len(s); i++ {
+			if q == '"' && s[i] == '\\' {
+				i++
+				continue
+			}
+			if s[i] == q {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return "", fmt.Errorf("unterminated quoted value")
+		}
+		if rest := strings.TrimSpace(s[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected characters after quoted value: %s", rest)
+		}
+		v := s[1:end]
+		if q == '"' {
+			v = strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\"`, `"`, `\\`, `\`).Replace(v)
+		}
+		return v, nil
+	}
+
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+
+	return strings.TrimSpace(s), nil
+}
+
+// ParseEnvFile reads environment variables from r in dotenv format and returns
+// them as KEY=VALUE strings. Blank lines and lines starting with '#' are
+// ignored, and each remaining line must be KEY=VALUE, optionally preceded by
+// "export". Values may be wrapped in single quotes, which are taken literally,
+// or double quotes, which understand the escapes \n, \t, \" and \\. Errors
+// identify the offending line using name.
+func ParseEnvFile(name string, r io.Reader) ([]string, error) {
+
+	var env []string
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", name, n)
+		}
+
+		key := strings.TrimSpace(line[:i])
+		if !ValidEnvKey(key) {
+			return nil, fmt.Errorf("%s:%d: invalid environment variable name '%s'", name, n, key)
+		}
+
+		val, err := parseEnvValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, n, err)
+		}
+
+		env = append(env, key+"="+val)
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return env, nil
+}
+
+// LoadEnvFile reads the dotenv file at path. See ParseEnvFile.
+func LoadEnvFile(path string) ([]string, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseEnvFile(path, f)
+}
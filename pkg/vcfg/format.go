@@ -0,0 +1,215 @@
+package vcfg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sisatech/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Formats a VCFG can be loaded from. TOML is the native format; JSON and YAML
+// use the field names of the JSON encoding.
+const (
+	TOMLFormat = "toml"
+	JSONFormat = "json"
+	YAMLFormat = "yaml"
+)
+
+var decoders = map[string]func(data []byte, x *VCFG) error{
+	TOMLFormat: func(data []byte, x *VCFG) error {
+		_, err := toml.Decode(string(data), x)
+		return err
+	},
+	JSONFormat: func(data []byte, x *VCFG) error {
+		return json.Unmarshal(data, x)
+	},
+	YAMLFormat: decodeYAML,
+}
+
+// decodeYAML converts YAML to JSON and decodes that, so that YAML uses the
+// same field names and custom types as JSON.
+func decodeYAML(data []byte, x *VCFG) error {
+
+	var v interface{}
+	err := yaml.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+
+	v = yamlToJSON(v)
+	if v == nil {
+		return nil
+	}
+
+	if _, ok := v.(map[string]interface{}); !ok {
+		return errors.New("yaml: line 1: expected a mapping at the top level")
+	}
+
+	data, err = json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, x)
+}
+
+// yamlToJSON replaces the maps in a decoded YAML value, which can have keys
+// of any type, with maps that encoding/json can marshal.
+func yamlToJSON(v interface{}) interface{} {
+
+	switch x := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for k, e := range x {
+			m[fmt.Sprintf("%v", k)] = yamlToJSON(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range x {
+			x[i] = yamlToJSON(e)
+		}
+		return x
+	default:
+		return v
+	}
+}
+
+var (
+	tomlKeyRegexp   = regexp.MustCompile(`^("[^"]*"|[A-Za-z0-9_.-]+)\s*=`)
+	yamlKeyRegexp   = regexp.MustCompile(`^("[^"]*"|[A-Za-z0-9_.-]+)\s*:(\s|$)`)
+	errorLineRegexp = regexp.MustCompile(`(?i)\bline (\d+)`)
+)
+
+// DetectFormat guesses the format of a VCFG from its first significant
+// line: JSON starts with a brace, TOML with a table header or a 'key = value'
+// pair, and YAML with a document marker, a list item or a 'key: value' pair.
+// Anything else is assumed to be TOML.
+func DetectFormat(data []byte) string {
+
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	for _, line := range strings.Split(string(data), "\n") {
+
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "{"):
+			return JSONFormat
+		case strings.HasPrefix(line, "["):
+			return TOMLFormat
+		case strings.HasPrefix(line, "---"), strings.HasPrefix(line, "- "):
+			return YAMLFormat
+		case tomlKeyRegexp.MatchString(line):
+			return TOMLFormat
+		case yamlKeyRegexp.MatchString(line):
+			return YAMLFormat
+		}
+
+		return TOMLFormat
+	}
+
+	return TOMLFormat
+}
+
+// ParseError is returned when a VCFG can't be decoded in any format. It
+// describes the error from the format the content looked most like.
+type ParseError struct {
+	Formats []string // formats attempted, most likely first
+	Line    int      // line the error was found on, or zero if unknown
+	Text    string   // text of that line
+	Err     error
+}
+
+func (e *ParseError) Error() string {
+	s := fmt.Sprintf("could not parse vcfg as %s", strings.Join(e.Formats, ", "))
+	if e.Line > 0 {
+		s += fmt.Sprintf(": line %d: %q", e.Line, e.Text)
+	}
+	return fmt.Sprintf("%s: %v", s, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// errorLine works out which line of data err, from the decoder of format,
+// refers to.
+func errorLine(data []byte, format string, err error) int {
+
+	if format == JSONFormat {
+		var offset int64 = -1
+		var serr *json.SyntaxError
+		var terr *json.UnmarshalTypeError
+		if errors.As(err, &serr) {
+			offset = serr.Offset
+		} else if errors.As(err, &terr) {
+			offset = terr.Offset
+		}
+		if offset < 0 || offset > int64(len(data)) {
+			return 0
+		}
+		return bytes.Count(data[:offset], []byte("\n")) + 1
+	}
+
+	m := errorLineRegexp.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
+
+// decode decodes data into x in whichever format it's in, trying the format
+// DetectFormat picks first and then the others. JSON is valid YAML, so content
+// that looks like JSON is never decoded as YAML, or broken JSON could load
+// with a different meaning.
+func decode(data []byte, x *VCFG) error {
+
+	formats := []string{DetectFormat(data)}
+	for _, format := range []string{TOMLFormat, JSONFormat, YAMLFormat} {
+		if format == formats[0] || (format == YAMLFormat && formats[0] == JSONFormat) {
+			continue
+		}
+		formats = append(formats, format)
+	}
+
+	var firstErr error
+	for _, format := range formats {
+		y := new(VCFG)
+		err := decoders[format](data, y)
+		if err == nil {
+			*x = *y
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	perr := &ParseError{
+		Formats: formats,
+		Err:     firstErr,
+	}
+
+	lines := strings.Split(string(data), "\n")
+	if n := errorLine(data, formats[0], firstErr); n > 0 && n <= len(lines) {
+		perr.Line = n
+		perr.Text = strings.TrimSpace(lines[n-1])
+	}
+
+	return perr
+}
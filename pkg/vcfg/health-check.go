@@ -0,0 +1,151 @@
+package vcfg
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+//HealthCheckType : How the init system checks that a program is healthy
+type HealthCheckType string
+
+var (
+	//CommandHealthCheck : healthy if the command exits with status zero
+	CommandHealthCheck = HealthCheckType("command")
+	//TCPHealthCheck : healthy if a TCP connection can be made to the port
+	TCPHealthCheck = HealthCheckType("tcp")
+	//HTTPHealthCheck : healthy if a GET request for the path returns a 2xx or 3xx status
+	HTTPHealthCheck = HealthCheckType("http")
+)
+
+// Defaults for the fields of a HealthCheck that are left empty.
+const (
+	DefaultHealthCheckInterval = Duration(10 * time.Second)
+	DefaultHealthCheckTimeout  = Duration(5 * time.Second)
+	DefaultHealthCheckRetries  = 3
+	DefaultHealthCheckPath     = "/"
+)
+
+// HealthCheck configures how the init system checks that a program is ready,
+// and keeps checking that it stays healthy, so it can be supervised. A
+// program is unhealthy once Retries checks in a row have failed. Leaving Type
+// empty disables the health check.
+type HealthCheck struct {
+	Type     HealthCheckType `toml:"type,omitempty" json:"type,omitempty"`
+	Command  string          `toml:"command,omitempty" json:"command,omitempty"` // command only
+	Port     uint            `toml:"port,omitzero" json:"port,omitempty"`        // tcp and http only
+	Path     string          `toml:"path,omitempty" json:"path,omitempty"`       // http only
+	Interval Duration        `toml:"interval,omitzero" json:"interval,omitempty"`
+	Timeout  Duration        `toml:"timeout,omitzero" json:"timeout,omitempty"`
+	Retries  uint            `toml:"retries,omitzero" json:"retries,omitempty"`
+}
+
+// Enabled returns true if the health check has a type.
+func (h *HealthCheck) Enabled() bool {
+	return h.Type != ""
+}
+
+// Validate : Check that the health check type is supported, that it has the
+// fields its type needs and none of the fields for other types, and that its
+// timings are positive
+func (h *HealthCheck) Validate() error {
+
+	if !h.Enabled() {
+		if *h != (HealthCheck{}) {
+			return fmt.Errorf("health check has settings but no type (should be '%s', '%s', or '%s')", CommandHealthCheck, TCPHealthCheck, HTTPHealthCheck)
+		}
+		return nil
+	}
+
+	switch h.Type {
+	case CommandHealthCheck:
+		if strings.TrimSpace(h.Command) == "" {
+			return fmt.Errorf("'%s' health check needs a command", h.Type)
+		}
+		if h.Port != 0 || h.Path != "" {
+			return fmt.Errorf("'%s' health check does not take a port or path", h.Type)
+		}
+	case TCPHealthCheck, HTTPHealthCheck:
+		if h.Port == 0 || h.Port > 65535 {
+			return fmt.Errorf("'%s' health check needs a port from 1 to 65535", h.Type)
+		}
+		if h.Command != "" {
+			return fmt.Errorf("'%s' health check does not take a command", h.Type)
+		}
+		if h.Type == TCPHealthCheck && h.Path != "" {
+			return fmt.Errorf("'%s' health check does not take a path", h.Type)
+		}
+		if h.Path != "" && !strings.HasPrefix(h.Path, "/") {
+			return fmt.Errorf("health check path '%s' must start with '/'", h.Path)
+		}
+	default:
+		return fmt.Errorf("health check type '%s' is not supported (should be '%s', '%s', or '%s')", h.Type, CommandHealthCheck, TCPHealthCheck, HTTPHealthCheck)
+	}
+
+	if h.Interval < 0 {
+		return fmt.Errorf("health check interval %s must be positive", h.Interval)
+	}
+
+	if h.Timeout < 0 {
+		return fmt.Errorf("health check timeout %s must be positive", h.Timeout)
+	}
+
+	interval, timeout := h.Interval, h.Timeout
+	if interval == 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	if timeout == 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	if timeout > interval {
+		return fmt.Errorf("health check timeout %s is longer than its interval %s", timeout, interval)
+	}
+
+	return nil
+}
+
+// SetDefaults fills in the fields of an enabled health check that are left
+// empty.
+func (h *HealthCheck) SetDefaults() {
+
+	if !h.Enabled() {
+		return
+	}
+
+	if h.Interval == 0 {
+		h.Interval = DefaultHealthCheckInterval
+	}
+
+	if h.Timeout == 0 {
+		h.Timeout = DefaultHealthCheckTimeout
+	}
+
+	if h.Retries == 0 {
+		h.Retries = DefaultHealthCheckRetries
+	}
+
+	if h.Type == HTTPHealthCheck && h.Path == "" {
+		h.Path = DefaultHealthCheckPath
+	}
+}
+
+// ValidateHealthCheck checks the program's health check, and that it isn't
+// a oneshot program, which isn't expected to keep running.
+func (p *Program) ValidateHealthCheck() error {
+
+	err := p.Health.Validate()
+	if err != nil {
+		return err
+	}
+
+	if p.Health.Enabled() && p.Type == OneshotProgram {
+		return fmt.Errorf("'%s' programs can't have a health check", OneshotProgram)
+	}
+
+	return nil
+}
@@ -0,0 +1,40 @@
+package vcfg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+)
+
+// MaxKernelModuleNameLength is the longest module name the kernel accepts.
+const MaxKernelModuleNameLength = 55
+
+// ValidateKernelModule returns an error if name can't be the name of a kernel
+// module. Module names may only contain letters, digits, underscores and
+// hyphens.
+func ValidateKernelModule(name string) error {
+
+	if name == "" {
+		return fmt.Errorf("kernel module name is empty")
+	}
+
+	if len(name) > MaxKernelModuleNameLength {
+		return fmt.Errorf("kernel module name '%s' is longer than %d characters", name, MaxKernelModuleNameLength)
+	}
+
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z':
+		case c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9':
+		case c == '_' || c == '-':
+		default:
+			return fmt.Errorf("kernel module name '%s' contains invalid character '%c'", name, c)
+		}
+	}
+
+	return nil
+}
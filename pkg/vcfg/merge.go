@@ -66,6 +66,12 @@ func mergeSystemInfoVM(a, b *VCFG) error {
 	// System.NTP
 	ntp := mergeStringArrayExcludingDuplicateValues(a.System.NTP, b.System.NTP)
 
+	// System.KernelModules
+	modules := mergeStringArrayExcludingDuplicateValues(a.System.KernelModules, b.System.KernelModules)
+
+	// System.DisableServices
+	disabled := mergeStringArrayExcludingDuplicateValues(a.System.DisableServices, b.System.DisableServices)
+
 	// System
 	err := mergo.Merge(&a.System, &b.System, mergo.WithOverride)
 	if err != nil {
@@ -74,6 +80,8 @@ func mergeSystemInfoVM(a, b *VCFG) error {
 
 	a.System.DNS = dns
 	a.System.NTP = ntp
+	a.System.KernelModules = modules
+	a.System.DisableServices = disabled
 
 	// Info
 	err = mergo.Merge(&a.Info, &b.Info)
@@ -166,6 +166,21 @@ func TestMergePrograms(t *testing.T) {
 	assert.Equal(t, replacementProgram.Args, a.Programs[0].Args)
 	assert.Equal(t, replacementProgram.Terminate, a.Programs[0].Terminate)
 
+	a.Programs = []Program{{Health: HealthCheck{Type: HTTPHealthCheck, Port: 80, Path: "/healthz"}}}
+	b.Programs = []Program{{Health: HealthCheck{Port: 8080, Retries: 5}}}
+
+	err = a.mergePrograms(b)
+	assert.NoError(t, err)
+	assert.Equal(t, HealthCheck{Type: HTTPHealthCheck, Port: 8080, Path: "/healthz", Retries: 5}, a.Programs[0].Health)
+
+	a.Programs = []Program{{Stdin: "file:/etc/app.conf"}}
+	b.Programs = []Program{{}, {Stdin: "literal:yes"}}
+
+	err = a.mergePrograms(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "file:/etc/app.conf", a.Programs[0].Stdin)
+	assert.Equal(t, "literal:yes", a.Programs[1].Stdin)
+
 }
 
 func TestMergeRoutes(t *testing.T) {
@@ -219,3 +234,85 @@ func TestMerge(t *testing.T) {
 	assert.NoError(t, err)
 
 }
+
+func TestMergeKernelModules(t *testing.T) {
+
+	a := new(VCFG)
+	b := new(VCFG)
+
+	a.System.KernelModules = []string{"nfs", "ip_tables"}
+	b.System.KernelModules = []string{"ip_tables", "ext4"}
+
+	err := a.Merge(b)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"nfs", "ip_tables", "ext4"}, a.System.KernelModules)
+
+}
+
+func TestMergeDisableServices(t *testing.T) {
+
+	a := new(VCFG)
+	b := new(VCFG)
+
+	a.System.DisableServices = []string{"ntp", "strace"}
+	b.System.DisableServices = []string{"strace", "tcpdump"}
+
+	err := a.Merge(b)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"ntp", "strace", "tcpdump"}, a.System.DisableServices)
+	assert.True(t, a.System.ServiceDisabled(TCPDumpService))
+	assert.False(t, a.System.ServiceDisabled(DHCPService))
+
+}
+
+func TestMergeRescueShell(t *testing.T) {
+
+	a := new(VCFG)
+	b := new(VCFG)
+	b.System.RescueShell = true
+
+	err := a.Merge(b)
+	assert.NoError(t, err)
+	assert.True(t, a.System.RescueShell)
+
+	// an unset value doesn't turn the shell off again
+	err = a.Merge(new(VCFG))
+	assert.NoError(t, err)
+	assert.True(t, a.System.RescueShell)
+
+}
+
+func TestMergeBootSettings(t *testing.T) {
+
+	a := new(VCFG)
+	a.System.BootTimeout = 10
+	a.System.DefaultBootEntry = "vorteil"
+
+	b := new(VCFG)
+	b.System.DefaultBootEntry = "rescue"
+
+	err := a.Merge(b)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, a.System.BootTimeout)
+	assert.Equal(t, "rescue", a.System.DefaultBootEntry)
+
+	b = new(VCFG)
+	b.System.BootTimeout = 3
+
+	err = a.Merge(b)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, a.System.BootTimeout)
+	assert.Equal(t, "rescue", a.System.DefaultBootEntry)
+
+}
+
+func TestMergeProgramLogging(t *testing.T) {
+
+	a := &VCFG{Programs: []Program{{Binary: "/app", Logging: ProgramLogging{Destination: "syslog", Format: JSONLogFormat}}}}
+	b := &VCFG{Programs: []Program{{Logging: ProgramLogging{Destination: "file:/var/log/app.log"}}}}
+
+	err := a.Merge(b)
+	assert.NoError(t, err)
+	assert.Equal(t, ProgramLogging{Destination: "file:/var/log/app.log", Format: JSONLogFormat}, a.Programs[0].Logging)
+
+}
@@ -0,0 +1,126 @@
+package vcfg
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+//NetworkMode : How a network interface gets its address
+type NetworkMode string
+
+var (
+	//DHCPNetworkMode : IPv4 address leased from a DHCP server (the default)
+	DHCPNetworkMode = NetworkMode("dhcp")
+	//StaticNetworkMode : fixed IPv4 address, mask and gateway
+	StaticNetworkMode = NetworkMode("static")
+	//SLAACNetworkMode : IPv6 address configured from router advertisements, with no IPv4 address
+	SLAACNetworkMode = NetworkMode("slaac")
+	//IPv6StaticNetworkMode : fixed IPv6 address, prefix length and gateway, with no IPv4 address
+	IPv6StaticNetworkMode = NetworkMode("ipv6-static")
+)
+
+// NetworkModes : Supported network modes
+var NetworkModes = []NetworkMode{DHCPNetworkMode, StaticNetworkMode, SLAACNetworkMode, IPv6StaticNetworkMode}
+
+// DefaultIPv6Prefix : Prefix length used by ipv6-static networks without a mask
+const DefaultIPv6Prefix = "64"
+
+// Validate : Check if NetworkMode is a supported network mode
+func (m *NetworkMode) Validate() error {
+	for _, mode := range NetworkModes {
+		if *m == mode {
+			return nil
+		}
+	}
+
+	s := make([]string, len(NetworkModes))
+	for i, mode := range NetworkModes {
+		s[i] = string(mode)
+	}
+
+	return fmt.Errorf("network mode '%s' is not supported (should be one of: %s)", *m, strings.Join(s, ", "))
+}
+
+// NetworkMode returns the interface's Mode if it's set, and otherwise infers
+// it from its IP: 'dhcp' and 'slaac' name their modes, an IPv6 address is
+// ipv6-static, and any other address is static. An interface with neither has
+// no mode, and is either disabled or defaults to dhcp.
+func (nic *NetworkInterface) NetworkMode() NetworkMode {
+
+	if nic.Mode != "" {
+		return nic.Mode
+	}
+
+	switch nic.IP {
+	case "":
+		return ""
+	case string(DHCPNetworkMode):
+		return DHCPNetworkMode
+	case string(SLAACNetworkMode):
+		return SLAACNetworkMode
+	}
+
+	if ip := net.ParseIP(nic.IP); ip != nil && ip.To4() == nil {
+		return IPv6StaticNetworkMode
+	}
+
+	return StaticNetworkMode
+}
+
+// ValidateMode checks that the interface's mode is supported, and that its
+// addresses agree with it.
+func (nic *NetworkInterface) ValidateMode() error {
+
+	mode := nic.NetworkMode()
+	if mode == "" {
+		return nil
+	}
+
+	err := mode.Validate()
+	if err != nil {
+		return err
+	}
+
+	switch mode {
+	case DHCPNetworkMode:
+		if nic.IP != "" && nic.IP != string(DHCPNetworkMode) {
+			return fmt.Errorf("ip %s can't be used in %s mode", nic.IP, mode)
+		}
+	case SLAACNetworkMode:
+		if nic.IP != "" && nic.IP != string(SLAACNetworkMode) {
+			return fmt.Errorf("ip %s can't be used in %s mode", nic.IP, mode)
+		}
+		if nic.Mask != "" || nic.Gateway != "" {
+			return fmt.Errorf("%s mode takes its mask and gateway from router advertisements, and can't set them", mode)
+		}
+	case StaticNetworkMode:
+		if ip := net.ParseIP(nic.IP); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("%s mode needs an IPv4 address, not '%s'", mode, nic.IP)
+		}
+	case IPv6StaticNetworkMode:
+		if ip := net.ParseIP(nic.IP); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("%s mode needs an IPv6 address, not '%s'", mode, nic.IP)
+		}
+		if nic.Mask != "" && !isIPv6Prefix(nic.Mask) {
+			return fmt.Errorf("mask %s is not an IPv6 prefix length (0 to 128)", nic.Mask)
+		}
+		if ip := net.ParseIP(nic.Gateway); nic.Gateway != "" && (ip == nil || ip.To4() != nil) {
+			return fmt.Errorf("gateway %s is not an IPv6 address", nic.Gateway)
+		}
+	}
+
+	return nil
+}
+
+// isIPv6Prefix returns true if s is a prefix length, like '64' or '/64'.
+func isIPv6Prefix(s string) bool {
+	n, err := strconv.Atoi(strings.TrimPrefix(s, "/"))
+	return err == nil && n >= 0 && n <= 128
+}
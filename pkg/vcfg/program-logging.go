@@ -0,0 +1,125 @@
+package vcfg
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+//LogSink : Where a program's output is sent
+type LogSink string
+
+var (
+	//ConsoleLogSink : output goes to the console, as if no destination was configured (default)
+	ConsoleLogSink = LogSink("console")
+	//FileLogSink : output is appended to a file, e.g. 'file:/var/log/app.log'
+	FileLogSink = LogSink("file")
+	//SyslogLogSink : output is sent to the system log
+	SyslogLogSink = LogSink("syslog")
+	//SerialLogSink : output is written to a serial device, e.g. 'serial:/dev/ttyS1'
+	SerialLogSink = LogSink("serial")
+)
+
+//LogFormat : How each line of a program's output is written
+type LogFormat string
+
+var (
+	//TextLogFormat : lines are written as they are (default)
+	TextLogFormat = LogFormat("text")
+	//JSONLogFormat : each line is wrapped in a JSON object
+	JSONLogFormat = LogFormat("json")
+)
+
+// ProgramLogging configures where a program's stdout and stderr are sent.
+// Leaving it empty keeps the program's output on the console.
+type ProgramLogging struct {
+	Destination string    `toml:"destination,omitempty" json:"destination,omitempty"`
+	Format      LogFormat `toml:"format,omitempty" json:"format,omitempty"`
+}
+
+// Sink splits Destination into the sink it names and, for the file and serial
+// sinks, the path output is written to.
+func (l *ProgramLogging) Sink() (LogSink, string, error) {
+
+	if l.Destination == "" {
+		return ConsoleLogSink, "", nil
+	}
+
+	s := strings.SplitN(l.Destination, ":", 2)
+	sink := LogSink(s[0])
+	var p string
+	if len(s) == 2 {
+		p = s[1]
+	}
+
+	switch sink {
+	case ConsoleLogSink, SyslogLogSink:
+		if p != "" {
+			return "", "", fmt.Errorf("logging destination '%s' does not take a path", sink)
+		}
+	case FileLogSink:
+		if !path.IsAbs(p) {
+			return "", "", fmt.Errorf("logging destination '%s' needs an absolute path (e.g. 'file:/var/log/app.log')", l.Destination)
+		}
+		if strings.HasPrefix(path.Clean(p), "/dev/") {
+			return "", "", fmt.Errorf("logging destination '%s' is a device (use '%s:%s')", l.Destination, SerialLogSink, p)
+		}
+		p = path.Clean(p)
+	case SerialLogSink:
+		if !strings.HasPrefix(path.Clean(p), "/dev/") {
+			return "", "", fmt.Errorf("logging destination '%s' needs a device under /dev (e.g. 'serial:/dev/ttyS1')", l.Destination)
+		}
+		p = path.Clean(p)
+	default:
+		return "", "", fmt.Errorf("logging destination '%s' is not supported (should be '%s', '%s:PATH', '%s', or '%s:DEVICE')", l.Destination, ConsoleLogSink, FileLogSink, SyslogLogSink, SerialLogSink)
+	}
+
+	return sink, p, nil
+}
+
+// Validate : Check if the logging destination and format are supported
+func (l *ProgramLogging) Validate() error {
+
+	_, _, err := l.Sink()
+	if err != nil {
+		return err
+	}
+
+	switch l.Format {
+	case "", TextLogFormat, JSONLogFormat:
+		return nil
+	default:
+		return fmt.Errorf("logging format '%s' is not supported (should be '%s' or '%s')", l.Format, TextLogFormat, JSONLogFormat)
+	}
+}
+
+// ValidateLogging checks the program's logging settings, and that its stdout
+// and stderr agree with its logging destination if that sends output to a
+// file or device.
+func (p *Program) ValidateLogging() error {
+
+	err := p.Logging.Validate()
+	if err != nil {
+		return err
+	}
+
+	sink, out, _ := p.Logging.Sink()
+	if sink != FileLogSink && sink != SerialLogSink {
+		return nil
+	}
+
+	if p.Stdout != "" && p.Stdout != out {
+		return fmt.Errorf("stdout '%s' conflicts with logging destination '%s'", p.Stdout, p.Logging.Destination)
+	}
+
+	if p.Stderr != "" && p.Stderr != out {
+		return fmt.Errorf("stderr '%s' conflicts with logging destination '%s'", p.Stderr, p.Logging.Destination)
+	}
+
+	return nil
+}
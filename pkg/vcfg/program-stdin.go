@@ -0,0 +1,61 @@
+package vcfg
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+//StdinSource : Where a program's stdin is read from
+type StdinSource string
+
+var (
+	//FileStdinSource : stdin is read from a file in the image, e.g. 'file:/etc/app.conf'
+	FileStdinSource = StdinSource("file")
+	//LiteralStdinSource : stdin is the text after the colon, e.g. 'literal:yes'
+	LiteralStdinSource = StdinSource("literal")
+)
+
+// StdinSource splits the program's Stdin into the source it names and the
+// path of the file, or the literal text, it gives. A program with an empty
+// Stdin has nothing connected to its stdin, and the source is empty.
+func (p *Program) StdinSource() (StdinSource, string, error) {
+
+	if p.Stdin == "" {
+		return "", "", nil
+	}
+
+	s := strings.SplitN(p.Stdin, ":", 2)
+	if len(s) != 2 {
+		return "", "", fmt.Errorf("stdin '%s' needs a source (should be '%s:PATH' or '%s:TEXT')", p.Stdin, FileStdinSource, LiteralStdinSource)
+	}
+
+	src, v := StdinSource(s[0]), s[1]
+
+	switch src {
+	case FileStdinSource:
+		if !path.IsAbs(v) {
+			return "", "", fmt.Errorf("stdin '%s' needs an absolute path (e.g. 'file:/etc/app.conf')", p.Stdin)
+		}
+		if strings.HasPrefix(path.Clean(v), "/dev/") {
+			return "", "", fmt.Errorf("stdin '%s' is a device, which is not supported", p.Stdin)
+		}
+		v = path.Clean(v)
+	case LiteralStdinSource:
+	default:
+		return "", "", fmt.Errorf("stdin source '%s' is not supported (should be '%s' or '%s')", src, FileStdinSource, LiteralStdinSource)
+	}
+
+	return src, v, nil
+}
+
+// ValidateStdin checks that the program's stdin comes from a supported source.
+func (p *Program) ValidateStdin() error {
+	_, _, err := p.StdinSource()
+	return err
+}
@@ -0,0 +1,33 @@
+package vcfg
+
+import (
+	"fmt"
+)
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+//ProgramType : How a program should be supervised once it exits
+type ProgramType string
+
+var (
+	//ServiceProgram : long-running program, supervised as a service (default)
+	ServiceProgram = ProgramType("service")
+	//OneshotProgram : program that runs once to completion and is not restarted
+	OneshotProgram = ProgramType("oneshot")
+)
+
+// DefaultProgramType : Default ProgramType to be used on programs
+const DefaultProgramType ProgramType = "service"
+
+// Validate : Check if ProgramType is a supported program type
+func (t *ProgramType) Validate() error {
+	switch *t {
+	case ServiceProgram, OneshotProgram:
+		return nil
+	default:
+		return fmt.Errorf("program type '%s' is not supported (should be '%s' or '%s')", *t, ServiceProgram, OneshotProgram)
+	}
+}
@@ -0,0 +1,57 @@
+package vcfg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"strings"
+)
+
+//Service : A built-in service the kernel runs when the VCFG calls for it
+type Service string
+
+var (
+	//DHCPService : requests addresses for networks with ip 'dhcp' (the default)
+	DHCPService = Service("dhcp")
+	//LogsService : forwards logs to the outputs in the logging section
+	LogsService = Service("logs")
+	//NTPService : keeps the clock in sync with the servers in system.ntp
+	NTPService = Service("ntp")
+	//StraceService : traces the system calls of programs with strace set
+	StraceService = Service("strace")
+	//TCPDumpService : captures traffic on networks with tcpdump set
+	TCPDumpService = Service("tcpdump")
+)
+
+// Services lists every built-in service that can be disabled.
+var Services = []Service{DHCPService, LogsService, NTPService, StraceService, TCPDumpService}
+
+// ValidateService returns an error if name isn't one of the built-in services.
+func ValidateService(name string) error {
+
+	for _, svc := range Services {
+		if Service(name) == svc {
+			return nil
+		}
+	}
+
+	names := make([]string, len(Services))
+	for i, svc := range Services {
+		names[i] = string(svc)
+	}
+
+	return fmt.Errorf("service '%s' is not supported (should be one of: %s)", name, strings.Join(names, ", "))
+}
+
+// ServiceDisabled returns true if svc is listed in DisableServices.
+func (s *SystemSettings) ServiceDisabled(svc Service) bool {
+	for _, name := range s.DisableServices {
+		if Service(name) == svc {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package vcfg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SysctlNamespaces are the top-level directories of /proc/sys, one of which
+// every sysctl key must be in.
+var SysctlNamespaces = []string{"abi", "crypto", "debug", "dev", "fs", "kernel", "net", "sunrpc", "user", "vm"}
+
+// ValidateSysctl returns an error if key can't be the name of a sysctl, or
+// value can't be written to one. Like sysctl(8), keys are paths under
+// /proc/sys separated by dots, like 'net.core.somaxconn', or by slashes if
+// they contain any, so that 'net/ipv4/conf/eth0.100/rp_filter' can name an
+// interface with a dot in it. They must start with one of SysctlNamespaces.
+// Values must be a single line, and not empty.
+func ValidateSysctl(key, value string) error {
+
+	sep := "."
+	if strings.Contains(key, "/") {
+		sep = "/"
+	}
+
+	parts := strings.Split(key, sep)
+	if len(parts) < 2 {
+		return fmt.Errorf("sysctl '%s' is not a valid key (should be like 'net.core.somaxconn')", key)
+	}
+
+	known := false
+	for _, ns := range SysctlNamespaces {
+		if parts[0] == ns {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return fmt.Errorf("sysctl '%s' is not supported (should start with one of: %s)", key, strings.Join(SysctlNamespaces, ", "))
+	}
+
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("sysctl '%s' is not a valid key", key)
+		}
+		for _, c := range part {
+			switch {
+			case c >= 'a' && c <= 'z':
+			case c >= 'A' && c <= 'Z':
+			case c >= '0' && c <= '9':
+			case c == '_' || c == '-' || c == ':':
+			case c == '.' && sep == "/":
+			default:
+				return fmt.Errorf("sysctl '%s' contains invalid character '%c'", key, c)
+			}
+		}
+	}
+
+	if strings.TrimSpace(value) == "" {
+		return fmt.Errorf("sysctl '%s' has no value", key)
+	}
+
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("sysctl '%s' has a value with more than one line", key)
+	}
+
+	return nil
+}
+
+// SysctlKeys returns the keys of Sysctl in order.
+func (vcfg *VCFG) SysctlKeys() []string {
+
+	keys := make([]string, 0, len(vcfg.Sysctl))
+	for k := range vcfg.Sysctl {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,95 @@
+package vcfg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// zoneinfoDirs are the places tz database files are commonly found on the
+// build host, searched in order.
+var zoneinfoDirs = []string{
+	"/usr/share/zoneinfo/",
+	"/usr/share/lib/zoneinfo/",
+	"/usr/lib/locale/TZ/",
+}
+
+func readZoneinfoZip(zpath, name string) ([]byte, error) {
+
+	zr, err := zip.OpenReader(zpath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return ioutil.ReadAll(rc)
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// ZoneInfo returns the tz database file for the timezone called name, e.g.
+// "Australia/Brisbane", looking in the same places the Go runtime does:
+// $ZONEINFO, the host's zoneinfo directories, and the zoneinfo.zip shipped
+// with Go.
+func ZoneInfo(name string) ([]byte, error) {
+
+	if name == "" || name == "Local" || strings.HasPrefix(name, "/") || path.Clean(name) != name || strings.HasPrefix(name, "..") {
+		return nil, fmt.Errorf("invalid timezone '%s': expected a tz database name such as 'UTC' or 'Australia/Brisbane'", name)
+	}
+
+	var sources []string
+	if env := os.Getenv("ZONEINFO"); env != "" {
+		sources = append(sources, env)
+	}
+	sources = append(sources, zoneinfoDirs...)
+	sources = append(sources, filepath.Join(runtime.GOROOT(), "lib", "time", "zoneinfo.zip"))
+
+	for _, src := range sources {
+		var data []byte
+		var err error
+		if strings.HasSuffix(src, ".zip") {
+			data, err = readZoneinfoZip(src, name)
+		} else {
+			data, err = ioutil.ReadFile(filepath.Join(src, filepath.FromSlash(name)))
+		}
+		if err != nil {
+			continue
+		}
+
+		if _, err = time.LoadLocationFromTZData(name, data); err != nil {
+			continue
+		}
+
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("unknown timezone '%s': expected a tz database name such as 'UTC' or 'Australia/Brisbane'", name)
+}
+
+// ValidateTimezone returns an error if name is not a timezone in the tz
+// database.
+func ValidateTimezone(name string) error {
+	_, err := ZoneInfo(name)
+	return err
+}
@@ -374,8 +374,16 @@ var (
 	Ext2FS = Filesystem("ext2")
 	Ext4FS = Filesystem("ext4")
 	XFS    = Filesystem("xfs")
+
+	// SquashFS produces a gzip compressed read-only root file-system.
+	SquashFS = Filesystem("squashfs")
 )
 
+// OverlayDirs are the only directories programs may write to when the root
+// file-system is read-only. The disk just has empty directories there: it's
+// up to the init to mount something writable on them.
+var OverlayDirs = []string{"/tmp", "/var"}
+
 //
 // URL
 //
@@ -0,0 +1,121 @@
+package vcfg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// MinimumRAM is the memory ValidateStrict expects the kernel and init
+	// process to need before any programs are started.
+	MinimumRAM = 64 * MiB
+
+	// ProgramRAM is the memory ValidateStrict budgets for each program.
+	ProgramRAM = 16 * MiB
+
+	defaultRAM = 128 * MiB
+)
+
+// ErrNoPrograms is reported by ValidateStrict for a VCFG with no programs.
+var ErrNoPrograms = errors.New("no programs defined")
+
+// ValidationError lists every problem found by ValidateStrict.
+type ValidationError []error
+
+func (e ValidationError) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return fmt.Sprintf("invalid vcfg: %s", strings.Join(s, "; "))
+}
+
+// ValidateStrict checks constraints that involve more than one field, which
+// can be broken by merging VCFGs that are valid on their own:
+//
+//   - there is at least one program (ErrNoPrograms)
+//   - the RAM leaves MinimumRAM plus ProgramRAM for each program
+//   - an absolute disk size is larger than contentSize, if that is above zero
+//   - every network's mode is supported and agrees with its addresses
+//   - every network with a static IP has a gateway
+//   - every kernel module, disabled service and sysctl is valid
+//   - every program's logging, health check, stdin and env are valid
+//
+// contentSize is the total size of the files going into the disk. Every
+// violation is returned together as a ValidationError.
+func (vcfg *VCFG) ValidateStrict(contentSize int64) error {
+
+	var errs ValidationError
+
+	if len(vcfg.Programs) == 0 {
+		errs = append(errs, ErrNoPrograms)
+	}
+
+	ram := vcfg.VM.RAM
+	if ram == 0 {
+		ram = defaultRAM
+	}
+	if need := MinimumRAM + Bytes(len(vcfg.Programs))*ProgramRAM; ram > 0 && ram < need {
+		errs = append(errs, fmt.Errorf("vm.ram %s is not enough for %d programs: need at least %s", ram, len(vcfg.Programs), need))
+	}
+
+	if contentSize > 0 && !vcfg.VM.DiskSize.IsDelta() && int64(vcfg.VM.DiskSize) <= contentSize {
+		errs = append(errs, fmt.Errorf("vm.disk-size %s is not larger than the files it must contain (%s)", vcfg.VM.DiskSize, Bytes(contentSize)))
+	}
+
+	for i, nic := range vcfg.Networks {
+		if err := nic.ValidateMode(); err != nil {
+			errs = append(errs, fmt.Errorf("network[%d]: %v", i, err))
+			continue
+		}
+		mode := nic.NetworkMode()
+		if (mode == StaticNetworkMode || mode == IPv6StaticNetworkMode) && nic.Gateway == "" {
+			errs = append(errs, fmt.Errorf("network[%d] has static ip %s but no gateway", i, nic.IP))
+		}
+	}
+
+	for _, name := range vcfg.System.KernelModules {
+		if err := ValidateKernelModule(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, name := range vcfg.System.DisableServices {
+		if err := ValidateService(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, key := range vcfg.SysctlKeys() {
+		if err := ValidateSysctl(key, vcfg.Sysctl[key]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for i := range vcfg.Programs {
+		if err := vcfg.Programs[i].ValidateLogging(); err != nil {
+			errs = append(errs, fmt.Errorf("program[%d]: %v", i, err))
+		}
+		if err := vcfg.Programs[i].ValidateHealthCheck(); err != nil {
+			errs = append(errs, fmt.Errorf("program[%d]: %v", i, err))
+		}
+		if err := vcfg.Programs[i].ValidateStdin(); err != nil {
+			errs = append(errs, fmt.Errorf("program[%d]: %v", i, err))
+		}
+		for _, err := range checkEnv(vcfg.Programs[i].Env, vcfg.Programs[i].EnvSchema) {
+			errs = append(errs, fmt.Errorf("program[%d]: %v", i, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
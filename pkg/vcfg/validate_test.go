@@ -0,0 +1,390 @@
+package vcfg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateStrict(t *testing.T) {
+
+	cfg := &VCFG{
+		Programs: []Program{{Binary: "/app"}},
+		Networks: []NetworkInterface{{IP: "dhcp"}},
+		VM: VMSettings{
+			RAM:      128 * MiB,
+			DiskSize: 64 * MiB,
+		},
+	}
+
+	assert.NoError(t, cfg.ValidateStrict(32*1024*1024))
+
+	bad := &VCFG{
+		Networks: []NetworkInterface{{IP: "10.0.0.2", Mask: "255.255.255.0"}},
+		VM: VMSettings{
+			RAM:      32 * MiB,
+			DiskSize: 16 * MiB,
+		},
+	}
+
+	err := bad.ValidateStrict(32 * 1024 * 1024)
+	assert.Error(t, err)
+	assert.Len(t, err.(ValidationError), 4)
+
+	// relative disk sizes grow with the files
+	bad.Programs = cfg.Programs
+	bad.Networks[0].Gateway = "10.0.0.1"
+	bad.VM.RAM = 0
+	bad.VM.DiskSize = -16 * MiB
+	assert.NoError(t, bad.ValidateStrict(32*1024*1024))
+
+}
+
+func TestValidateKernelModule(t *testing.T) {
+
+	for _, name := range []string{"nfs", "ip_tables", "nf-conntrack", "ext4"} {
+		assert.NoError(t, ValidateKernelModule(name))
+	}
+
+	for _, name := range []string{"", "nfs.ko", "../nfs", "ip tables", strings.Repeat("a", MaxKernelModuleNameLength+1)} {
+		assert.Error(t, ValidateKernelModule(name))
+	}
+
+	cfg := &VCFG{
+		Programs: []Program{{Binary: "/app"}},
+		System: SystemSettings{
+			KernelModules: []string{"nfs", "bad/name"},
+		},
+	}
+
+	err := cfg.ValidateStrict(0)
+	assert.Error(t, err)
+	assert.Len(t, err.(ValidationError), 1)
+
+}
+
+func TestValidateLogging(t *testing.T) {
+
+	for _, dst := range []string{"", "console", "syslog", "file:/var/log/app.log", "serial:/dev/ttyS1"} {
+		p := &Program{Logging: ProgramLogging{Destination: dst, Format: JSONLogFormat}}
+		assert.NoError(t, p.ValidateLogging(), dst)
+	}
+
+	for _, dst := range []string{"kafka", "file", "file:app.log", "file:/dev/ttyS1", "serial:/tmp/out", "syslog:/dev/log"} {
+		p := &Program{Logging: ProgramLogging{Destination: dst}}
+		assert.Error(t, p.ValidateLogging(), dst)
+	}
+
+	p := &Program{Logging: ProgramLogging{Format: "xml"}}
+	assert.Error(t, p.ValidateLogging())
+
+	sink, out, err := (&ProgramLogging{Destination: "file:/var/log//app.log"}).Sink()
+	assert.NoError(t, err)
+	assert.Equal(t, FileLogSink, sink)
+	assert.Equal(t, "/var/log/app.log", out)
+
+	// stdout and stderr must agree with a file or device destination
+	p = &Program{Stdout: "/var/log/app.log", Logging: ProgramLogging{Destination: "file:/var/log/app.log"}}
+	assert.NoError(t, p.ValidateLogging())
+
+	p.Stderr = "/dev/vtty"
+	assert.Error(t, p.ValidateLogging())
+
+	cfg := &VCFG{
+		Programs: []Program{{Binary: "/app", Logging: ProgramLogging{Destination: "kafka"}}},
+	}
+
+	err = cfg.ValidateStrict(0)
+	assert.Error(t, err)
+	assert.Len(t, err.(ValidationError), 1)
+
+}
+
+func TestValidateHealthCheck(t *testing.T) {
+
+	valid := []HealthCheck{
+		{},
+		{Type: CommandHealthCheck, Command: "/bin/check"},
+		{Type: TCPHealthCheck, Port: 8080, Interval: Duration(time.Second), Timeout: Duration(time.Second)},
+		{Type: HTTPHealthCheck, Port: 80, Path: "/healthz", Retries: 5},
+	}
+	for _, h := range valid {
+		assert.NoError(t, h.Validate(), h)
+	}
+
+	invalid := []HealthCheck{
+		{Port: 80},
+		{Type: "grpc", Port: 80},
+		{Type: CommandHealthCheck},
+		{Type: CommandHealthCheck, Command: "/bin/check", Port: 80},
+		{Type: TCPHealthCheck},
+		{Type: TCPHealthCheck, Port: 70000},
+		{Type: TCPHealthCheck, Port: 80, Path: "/"},
+		{Type: HTTPHealthCheck, Port: 80, Path: "healthz"},
+		{Type: HTTPHealthCheck, Port: 80, Command: "/bin/check"},
+		{Type: TCPHealthCheck, Port: 80, Interval: Duration(-time.Second)},
+		{Type: TCPHealthCheck, Port: 80, Timeout: Duration(-time.Second)},
+		{Type: TCPHealthCheck, Port: 80, Interval: Duration(time.Second), Timeout: Duration(2 * time.Second)},
+	}
+	for _, h := range invalid {
+		assert.Error(t, h.Validate(), h)
+	}
+
+	h := HealthCheck{Type: HTTPHealthCheck, Port: 80}
+	h.SetDefaults()
+	assert.Equal(t, DefaultHealthCheckInterval, h.Interval)
+	assert.Equal(t, DefaultHealthCheckTimeout, h.Timeout)
+	assert.Equal(t, uint(DefaultHealthCheckRetries), h.Retries)
+	assert.Equal(t, DefaultHealthCheckPath, h.Path)
+
+	p := &Program{Type: OneshotProgram, Health: HealthCheck{Type: CommandHealthCheck, Command: "/bin/check"}}
+	assert.Error(t, p.ValidateHealthCheck())
+
+	cfg := &VCFG{
+		Programs: []Program{{Binary: "/app", Health: HealthCheck{Type: "grpc"}}},
+	}
+
+	err := cfg.ValidateStrict(0)
+	assert.Error(t, err)
+	assert.Len(t, err.(ValidationError), 1)
+
+}
+
+func TestValidateStdin(t *testing.T) {
+
+	valid := map[string]StdinSource{
+		"":                     "",
+		"file:/etc/app.conf":   FileStdinSource,
+		"literal:yes":          LiteralStdinSource,
+		"literal:":             LiteralStdinSource,
+		"literal:a: b\nc: d\n": LiteralStdinSource,
+	}
+	for stdin, expect := range valid {
+		p := &Program{Stdin: stdin}
+		src, _, err := p.StdinSource()
+		assert.NoError(t, err, stdin)
+		assert.Equal(t, expect, src, stdin)
+	}
+
+	p := &Program{Stdin: "literal:a: b"}
+	_, text, _ := p.StdinSource()
+	assert.Equal(t, "a: b", text)
+
+	p = &Program{Stdin: "file:/etc/../etc/app.conf"}
+	_, fpath, _ := p.StdinSource()
+	assert.Equal(t, "/etc/app.conf", fpath)
+
+	for _, stdin := range []string{"/etc/app.conf", "file:etc/app.conf", "file:/dev/ttyS1", "pipe:/tmp/fifo"} {
+		p := &Program{Stdin: stdin}
+		assert.Error(t, p.ValidateStdin(), stdin)
+	}
+
+	cfg := &VCFG{
+		Programs: []Program{{Binary: "/app", Stdin: "app.conf"}},
+	}
+
+	err := cfg.ValidateStrict(0)
+	assert.Error(t, err)
+	assert.Len(t, err.(ValidationError), 1)
+
+}
+
+func TestValidateEnv(t *testing.T) {
+
+	schema := []EnvVar{
+		{Name: "PORT", Type: PortEnvType, Required: true},
+		{Name: "DEBUG", Type: BoolEnvType},
+		{Name: "TIMEOUT", Type: DurationEnvType},
+		{Name: "API", Type: URLEnvType, Required: true},
+		{Name: "NAME"},
+	}
+
+	p := &Program{
+		Env:       []string{"PORT=8080", "DEBUG=true", "API=https://example.com/api", "NAME="},
+		EnvSchema: schema,
+	}
+	assert.NoError(t, p.ValidateEnv())
+
+	// no schema, nothing to check
+	assert.NoError(t, (&Program{Env: []string{"PORT=x"}}).ValidateEnv())
+
+	p.Env = []string{"PORT=0", "DEBUG=maybe", "TIMEOUT=5"}
+	err := p.ValidateEnv()
+	assert.Error(t, err)
+	assert.Len(t, err.(ValidationError), 4)
+	assert.Contains(t, err.Error(), "required environment variable 'API' is not set")
+
+	for value, typ := range map[string]EnvType{
+		"-3":                    IntEnvType,
+		"0.5":                   FloatEnvType,
+		"1":                     BoolEnvType,
+		"65535":                 PortEnvType,
+		"1m30s":                 DurationEnvType,
+		"postgres://db:5432/db": URLEnvType,
+		"anything":              StringEnvType,
+	} {
+		assert.NoError(t, typ.Check(value), value)
+	}
+
+	for value, typ := range map[string]EnvType{
+		"1.5":       IntEnvType,
+		"65536":     PortEnvType,
+		"/api":      URLEnvType,
+		"5":         DurationEnvType,
+		"yes":       BoolEnvType,
+		"something": EnvType("uuid"),
+	} {
+		assert.Error(t, typ.Check(value), value)
+	}
+
+	bad := []EnvVar{{Name: "1X"}, {Name: "A", Type: "uuid"}, {Name: "B"}, {Name: "B"}}
+	assert.Len(t, checkEnv(nil, bad), 3)
+
+	cfg := &VCFG{
+		Programs: []Program{
+			{Binary: "/app", Env: []string{"PORT=80"}},
+			{Binary: "/worker"},
+		},
+	}
+	err = ValidateEnv(cfg, []EnvVar{{Name: "PORT", Type: PortEnvType, Required: true}})
+	assert.Error(t, err)
+	assert.Len(t, err.(ValidationError), 1)
+	assert.Contains(t, err.Error(), "program[1]")
+
+	cfg.Programs[1].EnvSchema = []EnvVar{{Name: "QUEUE", Required: true}}
+	err = cfg.ValidateStrict(0)
+	assert.Error(t, err)
+	assert.Len(t, err.(ValidationError), 1)
+
+	cfg, err = Load([]byte("[[program]]\n  binary = \"/app\"\n  [[program.env-schema]]\n    name = \"PORT\"\n    type = \"port\"\n    required = true\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []EnvVar{{Name: "PORT", Type: PortEnvType, Required: true}}, cfg.Programs[0].EnvSchema)
+}
+
+func TestValidateNetworkMode(t *testing.T) {
+
+	inferred := map[string]NetworkMode{
+		"":            "",
+		"dhcp":        DHCPNetworkMode,
+		"slaac":       SLAACNetworkMode,
+		"10.0.0.2":    StaticNetworkMode,
+		"2001:db8::2": IPv6StaticNetworkMode,
+	}
+	for ip, expect := range inferred {
+		nic := &NetworkInterface{IP: ip}
+		assert.Equal(t, expect, nic.NetworkMode(), ip)
+	}
+
+	valid := []NetworkInterface{
+		{},
+		{Mode: DHCPNetworkMode},
+		{Mode: SLAACNetworkMode},
+		{IP: "slaac"},
+		{Mode: StaticNetworkMode, IP: "10.0.0.2", Mask: "255.255.255.0", Gateway: "10.0.0.1"},
+		{Mode: IPv6StaticNetworkMode, IP: "2001:db8::2", Mask: "/64", Gateway: "fe80::1"},
+		{IP: "2001:db8::2", Gateway: "2001:db8::1"},
+	}
+	for _, nic := range valid {
+		assert.NoError(t, nic.ValidateMode(), nic)
+	}
+
+	invalid := []NetworkInterface{
+		{Mode: "ipv4-only"},
+		{Mode: DHCPNetworkMode, IP: "10.0.0.2"},
+		{Mode: SLAACNetworkMode, IP: "2001:db8::2"},
+		{Mode: SLAACNetworkMode, Gateway: "fe80::1"},
+		{Mode: StaticNetworkMode, IP: "2001:db8::2"},
+		{Mode: StaticNetworkMode},
+		{Mode: IPv6StaticNetworkMode, IP: "10.0.0.2"},
+		{Mode: IPv6StaticNetworkMode, IP: "2001:db8::2", Mask: "255.255.255.0"},
+		{Mode: IPv6StaticNetworkMode, IP: "2001:db8::2", Gateway: "10.0.0.1"},
+	}
+	for _, nic := range invalid {
+		assert.Error(t, nic.ValidateMode(), nic)
+	}
+
+	cfg := &VCFG{
+		Programs: []Program{{Binary: "/app"}},
+		Networks: []NetworkInterface{
+			{Mode: SLAACNetworkMode},
+			{Mode: IPv6StaticNetworkMode, IP: "2001:db8::2"},
+			{Mode: "ipv4-only"},
+		},
+	}
+
+	err := cfg.ValidateStrict(0)
+	assert.Error(t, err)
+	assert.Len(t, err.(ValidationError), 2)
+
+}
+
+func TestValidateService(t *testing.T) {
+
+	for _, svc := range Services {
+		assert.NoError(t, ValidateService(string(svc)))
+	}
+
+	err := ValidateService("sshd")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "dhcp, logs, ntp, strace, tcpdump")
+
+	cfg := &VCFG{
+		Programs: []Program{{Binary: "/app"}},
+		System: SystemSettings{
+			DisableServices: []string{"ntp", "sshd"},
+		},
+	}
+
+	err = cfg.ValidateStrict(0)
+	assert.Error(t, err)
+	assert.Len(t, err.(ValidationError), 1)
+
+}
+
+func TestValidateSysctl(t *testing.T) {
+
+	for key, value := range map[string]string{
+		"net.core.somaxconn":               "1024",
+		"vm.swappiness":                    "10",
+		"fs.file-max":                      "100000",
+		"net.ipv4.tcp_rmem":                "4096 87380 6291456",
+		"net/ipv4/conf/eth0.100/rp_filter": "1",
+		"kernel.core_pattern":              "/tmp/core",
+	} {
+		assert.NoError(t, ValidateSysctl(key, value), key)
+	}
+
+	for key, value := range map[string]string{
+		"somaxconn":                 "1024",
+		"foo.bar":                   "1",
+		"net..core":                 "1",
+		"net.core.somaxconn":        "",
+		"net.core.somaxconn ":       "1",
+		"net/ipv4/../../etc/passwd": "1",
+		"net.ipv4.conf.eth0/":       "1",
+		"vm.swappiness\n":           "1",
+		"kernel.hostname":           "a\nb",
+	} {
+		assert.Error(t, ValidateSysctl(key, value), key)
+	}
+
+	cfg := &VCFG{
+		Programs: []Program{{Binary: "/app"}},
+		Sysctl: map[string]string{
+			"net.core.somaxconn": "1024",
+			"foo.bar":            "1",
+		},
+	}
+
+	err := cfg.ValidateStrict(0)
+	assert.Error(t, err)
+	assert.Len(t, err.(ValidationError), 1)
+	assert.Equal(t, []string{"foo.bar", "net.core.somaxconn"}, cfg.SysctlKeys())
+}
@@ -7,6 +7,8 @@ package vcfg
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -29,7 +31,7 @@ type VCFG struct {
 	NFS      []NFSSettings      `toml:"nfs,omitempty" json:"nfs,omitempty"`
 	Routing  []Route            `toml:"route,omitempty" json:"route,omitempty"`
 	Logging  []Logging          `toml:"logging,omitempty" json:"logging,omitempty"`
-	Sysctl   map[string]string  `toml:"sysctl,omitempty" json:"sysctl,omitempty"`
+	Sysctl   map[string]string  `toml:"sysctl,omitempty" json:"sysctl,omitempty"` // written to /proc/sys by the init system at boot, see ValidateSysctl
 	modtime  time.Time
 }
 
@@ -51,7 +53,9 @@ type Program struct {
 	Binary    string          `toml:"binary,omitempty" json:"binary"`
 	Args      string          `toml:"args,omitempty" json:"args"`
 	Env       []string        `toml:"env,omitempty" json:"env"`
+	EnvSchema []EnvVar        `toml:"env-schema,omitempty" json:"env-schema,omitempty"` // checked against Env before building
 	Cwd       string          `toml:"cwd,omitempty" json:"cwd"`
+	Stdin     string          `toml:"stdin,omitempty" json:"stdin,omitempty"` // 'file:PATH' in the image, or 'literal:TEXT', connected to stdin by the init system
 	Stdout    string          `toml:"stdout,omitempty" json:"stdout"`
 	Stderr    string          `toml:"stderr,omitempty" json:"stderr"`
 	Bootstrap []string        `toml:"bootstrap,ommitempty" json:"bootstrap"`
@@ -59,20 +63,28 @@ type Program struct {
 	Privilege Privilege       `toml:"privilege,omitempty" json:"privilege"`
 	Strace    bool            `toml:"strace,omitempty" json:"strace"`
 	Terminate TerminateSignal `toml:"terminate,omitempty" json:"terminate"`
+	Type      ProgramType     `toml:"type,omitempty" json:"type"`
+	FailBoot  bool            `toml:"fail-boot,omitempty" json:"fail-boot"` // oneshot only: fail the boot if the program exits non-zero
+	Logging   ProgramLogging  `toml:"logging,omitempty" json:"logging,omitempty"`
+	Health    HealthCheck     `toml:"health-check,omitempty" json:"health-check,omitempty"`
 }
 
 // NetworkInterface ..
 type NetworkInterface struct {
-	IP                               string   `toml:"ip,omitempty" json:"ip"`
-	Mask                             string   `toml:"mask,omitempty" json:"mask,omitempty"`
-	Gateway                          string   `toml:"gateway,omitempty" json:"gateway,omitempty"`
-	UDP                              []string `toml:"udp,omitempty" json:"udp,omitempty"`
-	TCP                              []string `toml:"tcp,omitempty" json:"tcp,omitempty"`
-	HTTP                             []string `toml:"http,omitempty" json:"http,omitempty"`
-	HTTPS                            []string `toml:"https,omitempty" json:"https,omitempty"`
-	MTU                              uint     `toml:"mtu,omitzero" json:"mtu,omitempty"`
-	DisableTCPSegmentationOffloading bool     `toml:"disable-tso,omitempty" json:"disable-tso,omitempty"`
-	TCPDUMP                          bool     `toml:"tcpdump,omitempty" json:"tcpdump"`
+	IP                               string      `toml:"ip,omitempty" json:"ip"`
+	Mode                             NetworkMode `toml:"mode,omitempty" json:"mode,omitempty"`
+	Mask                             string      `toml:"mask,omitempty" json:"mask,omitempty"`
+	Gateway                          string      `toml:"gateway,omitempty" json:"gateway,omitempty"`
+	UDP                              []string    `toml:"udp,omitempty" json:"udp,omitempty"`
+	TCP                              []string    `toml:"tcp,omitempty" json:"tcp,omitempty"`
+	HTTP                             []string    `toml:"http,omitempty" json:"http,omitempty"`
+	HTTPS                            []string    `toml:"https,omitempty" json:"https,omitempty"`
+	MTU                              uint        `toml:"mtu,omitzero" json:"mtu,omitempty"`
+	DisableTCPSegmentationOffloading bool        `toml:"disable-tso,omitempty" json:"disable-tso,omitempty"`
+	TCPDUMP                          bool        `toml:"tcpdump,omitempty" json:"tcpdump"`
+	// AcceptRA makes the interface accept IPv6 router advertisements. It's
+	// always set for slaac networks.
+	AcceptRA bool `toml:"accept-ra,omitempty" json:"accept-ra,omitempty"`
 }
 
 // NFSSettings ..
@@ -91,15 +103,21 @@ type Route struct {
 
 // SystemSettings ..
 type SystemSettings struct {
-	DNS           []string   `toml:"dns,omitempty" json:"dns,omitempty"`
-	NTP           []string   `toml:"ntp,omitempty" json:"ntp,omitempty"`
-	Hostname      string     `toml:"hostname,omitempty" json:"hostname,omitempty"`
-	MaxFDs        uint       `toml:"max-fds,omitzero" json:"max-fds,omitempty"`
-	StdoutMode    StdoutMode `toml:"output-mode,omitzero" json:"stdout-mode,omitempty"`
-	KernelArgs    string     `toml:"kernel-args,omitempty" json:"kernel-args,omitempty"`
-	Filesystem    Filesystem `toml:"filesystem,omitempty" json:"filesystem,omitempty"`
-	User          string     `toml:"user,omitempty" json:"user,omitempty"` // Note: should we validate against regex ^[a-z]*$
-	TerminateWait uint       `toml:"terminate-wait,omitzero" json:"terminate-wait,omitzero"`
+	DNS              []string   `toml:"dns,omitempty" json:"dns,omitempty"`
+	NTP              []string   `toml:"ntp,omitempty" json:"ntp,omitempty"`
+	Hostname         string     `toml:"hostname,omitempty" json:"hostname,omitempty"`
+	MaxFDs           uint       `toml:"max-fds,omitzero" json:"max-fds,omitempty"`
+	StdoutMode       StdoutMode `toml:"output-mode,omitzero" json:"stdout-mode,omitempty"`
+	KernelArgs       string     `toml:"kernel-args,omitempty" json:"kernel-args,omitempty"`
+	Filesystem       Filesystem `toml:"filesystem,omitempty" json:"filesystem,omitempty"`
+	User             string     `toml:"user,omitempty" json:"user,omitempty"` // Note: should we validate against regex ^[a-z]*$
+	TerminateWait    uint       `toml:"terminate-wait,omitzero" json:"terminate-wait,omitzero"`
+	Timezone         string     `toml:"timezone,omitempty" json:"timezone,omitempty"`
+	KernelModules    []string   `toml:"kernel-modules,omitempty" json:"kernel-modules,omitempty"`
+	RescueShell      bool       `toml:"rescue-shell,omitempty" json:"rescue-shell,omitempty"` // drop to a busybox shell instead of shutting down on failure
+	DisableServices  []string   `toml:"disable-services,omitempty" json:"disable-services,omitempty"`
+	BootTimeout      int        `toml:"boot-timeout,omitzero" json:"boot-timeout,omitempty"`              // seconds the bootloader waits before starting the default entry
+	DefaultBootEntry string     `toml:"default-boot-entry,omitempty" json:"default-boot-entry,omitempty"` // bootloader entry started once the timeout expires
 }
 
 // PackageInfo ..
@@ -155,10 +173,12 @@ func (vcfg *VCFG) File() (vio.File, error) {
 	}), nil
 }
 
-// Load ..
+// Load decodes a VCFG from data, which can be in TOML, JSON or YAML. The
+// format is detected from the content, and if it can't be decoded in any of
+// them a *ParseError is returned.
 func Load(data []byte) (*VCFG, error) {
 	vcfg := new(VCFG)
-	err := toml.Unmarshal(data, vcfg)
+	err := decode(data, vcfg)
 	if err != nil {
 		return nil, err
 	}
@@ -205,7 +225,7 @@ func (vcfg *VCFG) Load(data []byte) error {
 	old := *vcfg
 
 	x := new(VCFG)
-	_, err := toml.Decode(string(data), x)
+	err := decode(data, x)
 	if err != nil {
 		return err
 	}
@@ -260,7 +280,7 @@ func (vcfg *VCFG) LoadFile(f vio.File) error {
 	}
 
 	x := new(VCFG)
-	_, err = toml.Decode(string(data), x)
+	err = decode(data, x)
 	if err != nil {
 		return err
 	}
@@ -279,6 +299,23 @@ func (vcfg *VCFG) Marshal() ([]byte, error) {
 	return buf.Bytes(), err
 }
 
+// Hash returns a stable hex-encoded SHA-256 digest of the VCFG. The digest is
+// computed over a canonical JSON serialization, so it doesn't depend on the
+// order in which fields or map keys appeared in the source TOML. It's
+// suitable for cache keys and detecting configuration changes.
+func (vcfg *VCFG) Hash() (string, error) {
+
+	// encoding/json emits struct fields in declaration order and sorts map
+	// keys, which is all the canonicalization we need.
+	data, err := json.Marshal(vcfg)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
 func (vcfg *VCFG) negate() {
 
 	// ports
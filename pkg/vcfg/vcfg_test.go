@@ -0,0 +1,237 @@
+package vcfg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const hashTestVCFGA = `
+[[program]]
+  binary = "/app"
+  args = "--port 80"
+  env = ["A=1", "B=2"]
+
+[system]
+  hostname = "test"
+  dns = ["1.1.1.1"]
+
+[sysctl]
+  "net.core.somaxconn" = "1024"
+  "kernel.pid_max" = "4096"
+
+[vm]
+  ram = "256 MiB"
+  cpus = 2
+`
+
+const hashTestVCFGB = `
+[vm]
+  cpus = 2
+  ram = "256 MiB"
+
+[sysctl]
+  "kernel.pid_max" = "4096"
+  "net.core.somaxconn" = "1024"
+
+[system]
+  dns = ["1.1.1.1"]
+  hostname = "test"
+
+[[program]]
+  env = ["A=1", "B=2"]
+  args = "--port 80"
+  binary = "/app"
+`
+
+func TestHash(t *testing.T) {
+
+	a, err := Load([]byte(hashTestVCFGA))
+	assert.NoError(t, err)
+
+	b, err := Load([]byte(hashTestVCFGB))
+	assert.NoError(t, err)
+
+	hashA, err := a.Hash()
+	assert.NoError(t, err)
+
+	hashB, err := b.Hash()
+	assert.NoError(t, err)
+
+	assert.Equal(t, hashA, hashB)
+	assert.Len(t, hashA, 64)
+
+	b.System.Hostname = "other"
+	hashC, err := b.Hash()
+	assert.NoError(t, err)
+	assert.NotEqual(t, hashA, hashC)
+
+}
+
+func TestValidateTimezone(t *testing.T) {
+
+	assert.NoError(t, ValidateTimezone("UTC"))
+
+	for _, name := range []string{"", "Local", "Mars/Olympus_Mons", "../../etc/passwd", "/usr/share/zoneinfo/UTC"} {
+		assert.Error(t, ValidateTimezone(name), name)
+	}
+
+	a := &VCFG{System: SystemSettings{Hostname: "a", Timezone: "UTC"}}
+	b := &VCFG{System: SystemSettings{Timezone: "Australia/Brisbane"}}
+	c, err := Merge(a, b)
+	assert.NoError(t, err)
+	assert.Equal(t, "Australia/Brisbane", c.System.Timezone)
+	assert.Equal(t, "a", c.System.Hostname)
+}
+
+func TestApplyDefaults(t *testing.T) {
+
+	cfg, err := Load([]byte(hashTestVCFGA))
+	assert.NoError(t, err)
+
+	cfg.ApplyDefaults()
+
+	assert.Len(t, cfg.Networks, 1)
+	assert.Equal(t, "dhcp", cfg.Networks[0].IP)
+	assert.Equal(t, Bytes(256*1024*1024), cfg.VM.RAM)
+	assert.Equal(t, uint(2), cfg.VM.CPUs)
+	assert.Equal(t, "test", cfg.System.Hostname)
+	assert.Equal(t, uint(3000), cfg.System.TerminateWait)
+	assert.Equal(t, []string{"1.1.1.1"}, cfg.System.DNS)
+	assert.Equal(t, uint(1024), cfg.System.MaxFDs)
+	assert.Equal(t, "root", cfg.System.User)
+	assert.Equal(t, DefaultTerminateSignal, cfg.Programs[0].Terminate)
+	assert.Equal(t, DefaultProgramType, cfg.Programs[0].Type)
+	assert.Equal(t, RootPrivilege, cfg.Programs[0].Privilege)
+	assert.Equal(t, "/", cfg.Programs[0].Cwd)
+
+	// applying the defaults again changes nothing
+	before, err := cfg.Hash()
+	assert.NoError(t, err)
+	cfg.ApplyDefaults()
+	after, err := cfg.Hash()
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	empty := new(VCFG)
+	empty.ApplyDefaults()
+	assert.Equal(t, Bytes(128*1024*1024), empty.VM.RAM)
+	assert.Equal(t, uint(1), empty.VM.CPUs)
+	assert.Equal(t, "vorteil-$SALT", empty.System.Hostname)
+}
+
+func TestParseEnvFile(t *testing.T) {
+
+	env, err := ParseEnvFile("test.env", strings.NewReader(`
+# comment
+A=1
+export B = two words # trailing comment
+C="line\nbreak"
+D='$literal\n'
+E=
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"A=1", "B=two words", "C=line\nbreak", `D=$literal\n`, "E="}, env)
+
+	_, err = ParseEnvFile("test.env", strings.NewReader("A=1\n1B=2\n"))
+	assert.EqualError(t, err, "test.env:2: invalid environment variable name '1B'")
+
+	_, err = ParseEnvFile("test.env", strings.NewReader("A\n"))
+	assert.EqualError(t, err, "test.env:1: expected KEY=VALUE")
+
+	_, err = ParseEnvFile("test.env", strings.NewReader("A=\"open\n"))
+	assert.EqualError(t, err, "test.env:1: unterminated quoted value")
+}
+
+func TestMergeEnv(t *testing.T) {
+	env := MergeEnv([]string{"A=1", "B=1"}, []string{"C=2", "A=2"}, []string{"B=3"})
+	assert.Equal(t, []string{"A=2", "B=3", "C=2"}, env)
+}
+
+func TestDetectFormat(t *testing.T) {
+
+	for data, format := range map[string]string{
+		"":                                  TOMLFormat,
+		"# comment\n[[program]]\n":          TOMLFormat,
+		"hostname = \"x\"\n":                TOMLFormat,
+		"  {\n  \"program\": []\n}":         JSONFormat,
+		"---\nprogram:\n":                   YAMLFormat,
+		"# comment\nsystem:\n  hostname: x": YAMLFormat,
+		"- binary: /app\n":                  YAMLFormat,
+	} {
+		assert.Equal(t, format, DetectFormat([]byte(data)), "%q", data)
+	}
+
+}
+
+func TestLoadFormats(t *testing.T) {
+
+	expect, err := Load([]byte(hashTestVCFGA))
+	assert.NoError(t, err)
+
+	data, err := json.Marshal(expect)
+	assert.NoError(t, err)
+
+	cfg, err := Load(data)
+	assert.NoError(t, err)
+	assert.Equal(t, expect, cfg)
+
+	cfg, err = Load([]byte(`
+program:
+  - binary: /app
+    args: --port 80
+system:
+  hostname: test
+  dns: [1.1.1.1]
+vm:
+  ram: 256 MiB
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, "/app", cfg.Programs[0].Binary)
+	assert.Equal(t, "test", cfg.System.Hostname)
+	assert.Equal(t, []string{"1.1.1.1"}, cfg.System.DNS)
+	assert.Equal(t, 256*MiB, cfg.VM.RAM)
+
+}
+
+func TestLoadParseError(t *testing.T) {
+
+	for data, expect := range map[string]ParseError{
+		"[[program]]\n  binary = \"/app\"\n  args = --port\n": {
+			Formats: []string{TOMLFormat, JSONFormat, YAMLFormat},
+			Line:    3,
+			Text:    "args = --port",
+		},
+		// broken JSON is still valid YAML, so YAML isn't attempted
+		"{\n  \"program\": [\n    {\"binary\": }\n  ]\n}": {
+			Formats: []string{JSONFormat, TOMLFormat},
+			Line:    3,
+			Text:    `{"binary": }`,
+		},
+		"system:\n  hostname: test\n  dns: [x\n": {
+			Formats: []string{YAMLFormat, TOMLFormat, JSONFormat},
+			Line:    3,
+			Text:    "dns: [x",
+		},
+	} {
+		_, err := Load([]byte(data))
+		assert.Error(t, err)
+
+		var perr *ParseError
+		if assert.True(t, errors.As(err, &perr), "%q", data) {
+			assert.Equal(t, expect.Formats, perr.Formats)
+			assert.Equal(t, expect.Line, perr.Line)
+			assert.Equal(t, expect.Text, perr.Text)
+			assert.Contains(t, err.Error(), strings.Join(expect.Formats, ", "))
+		}
+	}
+
+}
@@ -0,0 +1,116 @@
+package vconvert
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+}
+
+// dockerConfigPath returns the path of the docker client configuration file,
+// which is in $DOCKER_CONFIG or ~/.docker.
+func dockerConfigPath() (string, error) {
+
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json"), nil
+	}
+
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".docker", "config.json"), nil
+}
+
+// registryHosts returns the keys docker may have stored credentials for a
+// registry under.
+func registryHosts(registry string) []string {
+
+	hosts := []string{registry, "https://" + registry, "https://" + registry + "/v1/", "https://" + registry + "/v2/"}
+	if registry == "docker.io" || registry == "registry-1.docker.io" {
+		hosts = append(hosts, "https://index.docker.io/v1/", "index.docker.io")
+	}
+
+	return hosts
+}
+
+// parseDockerCredentials finds the username and password stored for registry
+// in the contents of a docker client configuration file. Credentials kept by
+// an external credentials helper are not supported.
+func parseDockerCredentials(data []byte, registry string) (string, string, error) {
+
+	conf := new(dockerConfig)
+	err := json.Unmarshal(data, conf)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, host := range registryHosts(registry) {
+
+		a, ok := conf.Auths[host]
+		if !ok {
+			continue
+		}
+
+		if a.Auth == "" {
+			return a.Username, a.Password, nil
+		}
+
+		b, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("bad credentials for %s: %v", host, err)
+		}
+
+		s := strings.SplitN(string(b), ":", 2)
+		if len(s) != 2 {
+			return "", "", fmt.Errorf("bad credentials for %s", host)
+		}
+
+		return s[0], s[1], nil
+	}
+
+	return "", "", nil
+}
+
+// dockerCredentials returns the username and password stored for registry by
+// 'docker login', or empty strings if there are none.
+func dockerCredentials(registry string) (string, string, error) {
+
+	path, err := dockerConfigPath()
+	if err != nil {
+		return "", "", err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+
+	user, pwd, err := parseDockerCredentials(data, registry)
+	if err != nil {
+		return "", "", fmt.Errorf("%s: %v", path, err)
+	}
+
+	return user, pwd, nil
+}
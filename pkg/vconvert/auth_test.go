@@ -0,0 +1,42 @@
+package vconvert
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDockerCredentials(t *testing.T) {
+
+	data := []byte(`{
+	"auths": {
+		"https://index.docker.io/v1/": {"auth": "dXNlcjpwYXNz"},
+		"gcr.io": {"username": "other", "password": "secret"},
+		"bad.io": {"auth": "bm9jb2xvbg=="}
+	}
+}`)
+
+	user, pwd, err := parseDockerCredentials(data, "docker.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "user", user)
+	assert.Equal(t, "pass", pwd)
+
+	user, pwd, err = parseDockerCredentials(data, "gcr.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "other", user)
+	assert.Equal(t, "secret", pwd)
+
+	user, pwd, err = parseDockerCredentials(data, "mcr.microsoft.com")
+	assert.NoError(t, err)
+	assert.Empty(t, user)
+	assert.Empty(t, pwd)
+
+	_, _, err = parseDockerCredentials(data, "bad.io")
+	assert.Error(t, err)
+
+}
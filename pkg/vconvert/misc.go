@@ -35,6 +35,8 @@ func writeFile(name string, r io.Reader) error {
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+
 	for {
 		n, err := r.Read(buf)
 		if err != nil && err != io.EOF {
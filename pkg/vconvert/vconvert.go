@@ -12,6 +12,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 
@@ -21,6 +22,7 @@ import (
 
 	"github.com/containerd/containerd/archive"
 	"github.com/containerd/containerd/archive/compression"
+	"github.com/docker/distribution"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 
 	clog "github.com/containerd/containerd/log"
@@ -87,6 +89,7 @@ type ContainerConverter struct {
 	jobsCh      chan *job
 	jobsDoneCh  chan *job
 	tmpLocalTar *os.File
+	cacheDir    string
 
 	logger elog.View
 }
@@ -167,6 +170,15 @@ func (cc *ContainerConverter) ConvertToProject(dst, user, pwd string) error {
 
 		cc.logger.Printf("registry %s, url %s", cc.RegistryName(), url)
 
+		if user == "" && pwd == "" {
+			user, pwd, err = dockerCredentials(cc.RegistryName())
+			if err != nil {
+				cc.logger.Warnf("could not read docker credentials: %v", err)
+			} else if user != "" {
+				cc.logger.Debugf("using docker credentials for %s", cc.RegistryName())
+			}
+		}
+
 	} else {
 		cc.logger.Printf("registry %s", cc.RegistryType())
 	}
@@ -202,6 +214,13 @@ func (cc *ContainerConverter) ConvertToProject(dst, user, pwd string) error {
 	return nil
 }
 
+// SetCacheDir makes the converter keep layers downloaded from remote
+// registries in dir, and reuse them in later conversions instead of
+// downloading them again.
+func (cc *ContainerConverter) SetCacheDir(dir string) {
+	cc.cacheDir = dir
+}
+
 // RegistryType returns the type of registry: local, remote or none
 func (cc *ContainerConverter) RegistryType() RegistryType {
 	return cc.registryType
@@ -471,6 +490,14 @@ func (cc *ContainerConverter) blobDownloadWorker() {
 			break
 		}
 
+		if name, ok := cc.cachedLayer(job.layer); ok {
+			cc.logger.Printf("layer %s: cached", job.layer.hash)
+			job.name = name
+			cc.layers[job.number].file = name
+			cc.jobsDoneCh <- job
+			continue
+		}
+
 		reader, err = cc.fetchReader(cc.imageRef.ShortName(), job.layer, cc.registry)
 		if err != nil {
 			goto cont
@@ -480,8 +507,18 @@ func (cc *ContainerConverter) blobDownloadWorker() {
 		pr = p.ProxyReader(reader)
 
 		job.name = fmt.Sprintf(tarExpression, job.dir, job.layer.hash)
+		if path := cc.cachedLayerPath(job.layer); path != "" {
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+			if err != nil {
+				goto cont
+			}
+			job.name = path + ".download"
+		}
 
 		err = writeFile(job.name, pr)
+		if err == nil {
+			job.name, err = cc.cacheLayer(job.layer, job.name)
+		}
 
 	cont:
 		job.err = err
@@ -501,3 +538,51 @@ func (cc *ContainerConverter) blobDownloadWorker() {
 	}
 
 }
+
+// cachedLayerPath returns where a layer from a remote registry is kept in the
+// cache, or an empty string if it can't be cached.
+func (cc *ContainerConverter) cachedLayerPath(l *layer) string {
+
+	if cc.cacheDir == "" || cc.registryType != RemoteRegistry {
+		return ""
+	}
+
+	d, ok := l.layer.(distribution.Descriptor)
+	if !ok || d.Digest.Validate() != nil {
+		return ""
+	}
+
+	return filepath.Join(cc.cacheDir, d.Digest.Algorithm().String(), d.Digest.Hex())
+}
+
+func (cc *ContainerConverter) cachedLayer(l *layer) (string, bool) {
+
+	path := cc.cachedLayerPath(l)
+	if path == "" {
+		return "", false
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil || fi.Size() != l.size {
+		return "", false
+	}
+
+	return path, true
+}
+
+// cacheLayer moves a layer downloaded into the cache to its final path,
+// returning that path. Layers that aren't cached are left where they are.
+func (cc *ContainerConverter) cacheLayer(l *layer, name string) (string, error) {
+
+	path := cc.cachedLayerPath(l)
+	if path == "" {
+		return name, nil
+	}
+
+	err := os.Rename(name, path)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
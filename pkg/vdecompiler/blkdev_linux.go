@@ -0,0 +1,30 @@
+// +build linux
+
+package vdecompiler
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// BLKGETSIZE64 from linux/fs.h: _IOR(0x12, 114, size_t)
+const ioctlBlkGetSize64 = 0x80081272
+
+// blockDeviceSize returns the size in bytes of the block device open as f.
+func blockDeviceSize(f *os.File) (int64, error) {
+
+	var size uint64
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), ioctlBlkGetSize64, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0, &os.PathError{Op: "ioctl BLKGETSIZE64", Path: f.Name(), Err: errno}
+	}
+
+	return int64(size), nil
+}
@@ -0,0 +1,19 @@
+// +build !linux
+
+package vdecompiler
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// blockDeviceSize returns the size in bytes of the block device open as f.
+func blockDeviceSize(f *os.File) (int64, error) {
+	return 0, fmt.Errorf("reading disk images from block devices is not supported on %s: %s", runtime.GOOS, f.Name())
+}
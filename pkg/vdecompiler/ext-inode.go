@@ -7,6 +7,7 @@ package vdecompiler
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
 
 	"github.com/vorteil/vorteil/pkg/ext"
@@ -46,18 +47,13 @@ func (r *inodeReader) loadNextBlock() error {
 			return err
 		}
 
-		_, err = r.iio.img.Seek(int64(lba*vimg.SectorSize), io.SeekStart)
+		buf := make([]byte, blockSize)
+		_, err = r.iio.ReadAt(buf, int64(lba*vimg.SectorSize))
 		if err != nil {
 			return err
 		}
 
-		buf := new(bytes.Buffer)
-		_, err = io.CopyN(buf, r.iio.img, int64(blockSize))
-		if err != nil {
-			return err
-		}
-
-		r.block = buf.Bytes()
+		r.block = buf
 	}
 
 	return nil
@@ -123,6 +119,18 @@ func InodeSize(inode *ext.Inode) int64 {
 	return (int64(inode.SizeUpper) << 32) + int64(inode.SizeLower)
 }
 
+// InodeUID returns the user ID of the owner of the inode, combining the upper
+// bits Linux stores in the OS-specific part of the inode with the lower bits.
+func InodeUID(inode *ext.Inode) int {
+	return int(binary.LittleEndian.Uint16(inode.OSStuff[4:6]))<<16 + int(inode.UID)
+}
+
+// InodeGID returns the group ID of the inode, combining the upper bits Linux
+// stores in the OS-specific part of the inode with the lower bits.
+func InodeGID(inode *ext.Inode) int {
+	return int(binary.LittleEndian.Uint16(inode.OSStuff[6:8]))<<16 + int(inode.GID)
+}
+
 // InodePermissionsString returns a string-representation of an inode's
 // permissions modelled off the string you see with `ls -l`, e.g. `drwxr-x---`.
 func InodePermissionsString(inode *ext.Inode) string {
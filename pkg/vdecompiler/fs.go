@@ -11,6 +11,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"path/filepath"
 	"strings"
 
@@ -21,33 +22,74 @@ import (
 type fsInfo struct {
 	superblock *ext.Superblock
 	bgdt       []*ext.BlockGroupDescriptorTableEntry
+	noFollow   bool
 }
 
-func (iio *IO) readSuperblock(index int) (*ext.Superblock, error) {
+// SuperblockOffset returns the offset within the image of the ext
+// superblock in block group 'index'.
+func (iio *IO) SuperblockOffset(index int) (int64, error) {
 
 	entry, err := iio.GPTEntry(UTF16toString(vimg.RootPartitionName))
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
 	var bpg, bs int64
 	if index > 0 {
-		bpg = int64(iio.fs.superblock.BlocksPerGroup)
-		bs = int64(1024 << iio.fs.superblock.BlockSize)
+		sb, err := iio.Superblock(0)
+		if err != nil {
+			return 0, err
+		}
+		bpg = int64(sb.BlocksPerGroup)
+		bs = int64(1024 << sb.BlockSize)
+	}
+
+	return int64(entry.FirstLBA)*vimg.SectorSize + ext.SuperblockOffset + (bs * bpg * int64(index)), nil
+
+}
+
+// RawSuperblock returns all of the bytes reserved for the ext superblock in
+// block group 'index', without checking that they hold a valid superblock.
+func (iio *IO) RawSuperblock(index int) ([]byte, error) {
+
+	off, err := iio.SuperblockOffset(index)
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = iio.img.Seek(int64(int64(entry.FirstLBA)*vimg.SectorSize+ext.SuperblockOffset+(bs*bpg*int64(index))), io.SeekStart)
+	buf := make([]byte, 1024)
+	_, err = iio.ReadAt(buf, off)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+
+}
+
+func (iio *IO) readSuperblock(index int) (*ext.Superblock, error) {
+
+	off, err := iio.SuperblockOffset(index)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.Size(ext.Superblock{}))
+	_, err = iio.ReadAt(buf, off)
 	if err != nil {
 		return nil, err
 	}
 
 	sb := new(ext.Superblock)
-	err = binary.Read(iio.img, binary.LittleEndian, sb)
+	err = binary.Read(bytes.NewReader(buf), binary.LittleEndian, sb)
 	if err != nil {
 		return nil, err
 	}
 
 	if sb.Signature != ext.Signature {
+		if iio.locked() {
+			return nil, ErrEncrypted
+		}
 		return nil, errors.New("superblock doesn't contain a valid ext file-system signature (magic number)")
 	}
 
@@ -58,26 +100,163 @@ func (iio *IO) readSuperblock(index int) (*ext.Superblock, error) {
 // Superblock loads the ext superblock from block group 'index'.
 func (iio *IO) Superblock(index int) (*ext.Superblock, error) {
 
-	// only return a cached superblock if index is zero
-	if index == 0 && iio.fs.superblock != nil {
-		return iio.fs.superblock, nil
+	if index > 0 {
+		// TODO: check that index isn't out of bounds
+		return iio.readSuperblock(index)
 	}
 
-	var err error
-	if iio.fs.superblock == nil {
-		iio.fs.superblock, err = iio.readSuperblock(0)
-		if err != nil {
-			return nil, err
+	// only the superblock from block group zero is cached
+	iio.mu.Lock()
+	sb := iio.fs.superblock
+	iio.mu.Unlock()
+
+	if sb != nil {
+		return sb, nil
+	}
+
+	sb, err := iio.readSuperblock(0)
+	if err != nil {
+		return nil, err
+	}
+
+	iio.mu.Lock()
+	iio.fs.superblock = sb
+	iio.mu.Unlock()
+
+	return sb, nil
+
+}
+
+// Statfs describes the space in an image's ext file-system, like statfs(2).
+// Counts are in blocks of BlockSize bytes, or inodes.
+type Statfs struct {
+	BlockSize      int64
+	Blocks         int64
+	FreeBlocks     int64
+	ReservedBlocks int64
+
+	// AvailableBlocks are the free blocks that aren't reserved for the
+	// superuser.
+	AvailableBlocks int64
+
+	Inodes     int64
+	FreeInodes int64
+}
+
+// Statfs reports the size of the ext file-system, and how much of it is free
+// or reserved for the superuser, from its superblock.
+func (iio *IO) Statfs() (*Statfs, error) {
+
+	sb, err := iio.Superblock(0)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &Statfs{
+		BlockSize:      int64(1024 << sb.BlockSize),
+		Blocks:         sb.Blocks(),
+		FreeBlocks:     sb.UnallocatedBlocksCount(),
+		ReservedBlocks: sb.ReservedBlocksCount(),
+		Inodes:         int64(sb.TotalInodes),
+		FreeInodes:     int64(sb.UnallocatedInodes),
+	}
+
+	st.AvailableBlocks = st.FreeBlocks - st.ReservedBlocks
+	if st.AvailableBlocks < 0 {
+		st.AvailableBlocks = 0
+	}
+
+	return st, nil
+
+}
+
+// BlockUsage describes how the blocks of an image's ext file-system are laid
+// out, as found by scanning its block bitmaps. Counts are in blocks of
+// BlockSize bytes.
+type BlockUsage struct {
+	BlockSize  int64
+	Blocks     int64
+	UsedBlocks int64
+	FreeBlocks int64
+
+	// FreeExtents is the number of runs of contiguous free blocks, and
+	// LargestFreeExtent is the length of the longest one.
+	FreeExtents       int64
+	LargestFreeExtent int64
+}
+
+// Fragmentation returns how scattered the free blocks are, from 0 when they
+// are all in a single extent to nearly 1 when none of them are next to each
+// other. It is zero if there are no free blocks.
+func (u *BlockUsage) Fragmentation() float64 {
+	if u.FreeBlocks == 0 {
+		return 0
+	}
+	return 1 - float64(u.LargestFreeExtent)/float64(u.FreeBlocks)
+}
+
+// BlockUsage scans the block bitmap of every block group in the ext
+// file-system to count its free blocks and find the extents they form. Unlike
+// Statfs it doesn't trust the counts in the superblock, and it reads a block
+// for every block group.
+func (iio *IO) BlockUsage() (*BlockUsage, error) {
+
+	sb, bgdt, err := iio.superblockAndBGDT()
+	if err != nil {
+		return nil, err
+	}
+
+	u := &BlockUsage{
+		BlockSize: int64(1024 << sb.BlockSize),
+		Blocks:    sb.Blocks(),
+	}
+
+	// blocks before the first data block aren't covered by any bitmap
+	first := int64(sb.SuperblockNumber)
+	u.UsedBlocks = first
+
+	var run int64
+	endRun := func() {
+		if run == 0 {
+			return
 		}
+		u.FreeExtents++
+		if run > u.LargestFreeExtent {
+			u.LargestFreeExtent = run
+		}
+		run = 0
 	}
 
-	if index == 0 {
-		return iio.fs.superblock, nil
+	bpg := int64(sb.BlocksPerGroup)
+	for g, bgdte := range bgdt {
+
+		n := u.Blocks - first - int64(g)*bpg
+		if n <= 0 {
+			break
+		}
+		if n > bpg {
+			n = bpg
+		}
+
+		bitmap, err := iio.loadBlock(int(bgdte.BlockBitmapBlockAddr))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read block bitmap of block group %d: %w", g, err)
+		}
+
+		for i := int64(0); i < n; i++ {
+			if bitmap[i/8]&(1<<uint(i%8)) != 0 {
+				u.UsedBlocks++
+				endRun()
+				continue
+			}
+			u.FreeBlocks++
+			run++
+		}
 	}
 
-	// TODO: check that index isn't out of bounds
+	endRun()
 
-	return iio.readSuperblock(index)
+	return u, nil
 
 }
 
@@ -99,20 +278,30 @@ func (iio *IO) readBGDT(index int) ([]*ext.BlockGroupDescriptorTableEntry, error
 		return nil, err
 	}
 
-	_, err = iio.img.Seek(int64(lba*vimg.SectorSize), io.SeekStart)
+	bgs := (sb.Blocks() + int64(sb.BlocksPerGroup) - 1) / int64(sb.BlocksPerGroup)
+	buf := make([]byte, bgs*int64(sb.GroupDescriptorSize()))
+	_, err = iio.ReadAt(buf, int64(lba*vimg.SectorSize))
 	if err != nil {
 		return nil, err
 	}
 
-	bgs := (sb.TotalBlocks + sb.BlocksPerGroup - 1) / sb.BlocksPerGroup
+	r := bytes.NewReader(buf)
+	skip := int64(sb.GroupDescriptorSize() - ext.BlockGroupDescriptorSize)
 	bgdt := make([]*ext.BlockGroupDescriptorTableEntry, bgs)
 	for i := 0; i < int(bgs); i++ {
 		bgdte := new(ext.BlockGroupDescriptorTableEntry)
-		err = binary.Read(iio.img, binary.LittleEndian, bgdte)
+		err = binary.Read(r, binary.LittleEndian, bgdte)
 		if err != nil {
 			return nil, err
 		}
 		bgdt[i] = bgdte
+
+		if skip > 0 {
+			_, err = r.Seek(skip, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return bgdt, nil
@@ -122,26 +311,30 @@ func (iio *IO) readBGDT(index int) ([]*ext.BlockGroupDescriptorTableEntry, error
 // BGDT loads a block group descriptor table from block group 'index'.
 func (iio *IO) BGDT(index int) ([]*ext.BlockGroupDescriptorTableEntry, error) {
 
-	// only return a cached bgdt if index is zero
-	if index == 0 && iio.fs.bgdt != nil {
-		return iio.fs.bgdt, nil
+	if index > 0 {
+		// TODO: check that index isn't out of bounds
+		return iio.readBGDT(index)
 	}
 
-	var err error
-	if iio.fs.bgdt == nil {
-		iio.fs.bgdt, err = iio.readBGDT(0)
-		if err != nil {
-			return nil, err
-		}
+	// only the bgdt from block group zero is cached
+	iio.mu.Lock()
+	bgdt := iio.fs.bgdt
+	iio.mu.Unlock()
+
+	if bgdt != nil {
+		return bgdt, nil
 	}
 
-	if index == 0 {
-		return iio.fs.bgdt, nil
+	bgdt, err := iio.readBGDT(0)
+	if err != nil {
+		return nil, err
 	}
 
-	// TODO: check that index isn't out of bounds
+	iio.mu.Lock()
+	iio.fs.bgdt = bgdt
+	iio.mu.Unlock()
 
-	return iio.readBGDT(index)
+	return bgdt, nil
 
 }
 
@@ -161,12 +354,11 @@ func (iio *IO) superblockAndBGDT() (*ext.Superblock, []*ext.BlockGroupDescriptor
 
 }
 
-// ResolveInode looks up an inode on the file-system.
-func (iio *IO) ResolveInode(ino int) (*ext.Inode, error) {
+func (iio *IO) inodeOffset(ino int) (int64, error) {
 
 	sb, bgdt, err := iio.superblockAndBGDT()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 
 	bgno := (ino - 1) / int(sb.InodesPerGroup)
@@ -176,21 +368,54 @@ func (iio *IO) ResolveInode(ino int) (*ext.Inode, error) {
 	// TODO: check for out of bounds
 
 	lba, err := iio.BlockToLBA(firstInodeTableBlock)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(lba*vimg.SectorSize + inodeOffset*ext.InodeSize), nil
+
+}
+
+// ResolveInode looks up an inode on the file-system.
+func (iio *IO) ResolveInode(ino int) (*ext.Inode, error) {
+
+	off, err := iio.inodeOffset(ino)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = iio.img.Seek(int64(lba*vimg.SectorSize+inodeOffset*ext.InodeSize), io.SeekStart)
+	buf := make([]byte, binary.Size(ext.Inode{}))
+	_, err = iio.ReadAt(buf, off)
 	if err != nil {
 		return nil, err
 	}
 
 	inode := new(ext.Inode)
-	err = binary.Read(iio.img, binary.LittleEndian, inode)
+	err = binary.Read(bytes.NewReader(buf), binary.LittleEndian, inode)
 	return inode, err
 
 }
 
+// WriteInode overwrites an inode on the file-system. The image must have been
+// opened with OpenRW.
+func (iio *IO) WriteInode(ino int, inode *ext.Inode) error {
+
+	off, err := iio.inodeOffset(ino)
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	err = binary.Write(buf, binary.LittleEndian, inode)
+	if err != nil {
+		return err
+	}
+
+	_, err = iio.WriteAt(buf.Bytes(), off)
+	return err
+
+}
+
 // BlockToLBA converts a file-system block number into an absolute disk LBA.
 func (iio *IO) BlockToLBA(block int) (int, error) {
 
@@ -210,6 +435,46 @@ func (iio *IO) BlockToLBA(block int) (int, error) {
 
 }
 
+// BlockRangeReader returns a reader for count file-system blocks starting at
+// block start, along with the file-system's block size. The range has to fit
+// within both the file-system and the partition it's on.
+func (iio *IO) BlockRangeReader(start, count int64) (*io.SectionReader, int64, error) {
+
+	if start < 0 {
+		return nil, 0, fmt.Errorf("invalid start block: %d", start)
+	}
+
+	if count <= 0 {
+		return nil, 0, fmt.Errorf("invalid block count: %d", count)
+	}
+
+	sb, err := iio.Superblock(0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	blockSize := int64(1024 << sb.BlockSize)
+	blocks := sb.Blocks()
+	if start >= blocks || count > blocks-start {
+		return nil, 0, fmt.Errorf("blocks %d to %d are beyond the end of the file-system, which has %d blocks", start, start+count-1, blocks)
+	}
+
+	entry, err := iio.GPTEntry(UTF16toString(vimg.RootPartitionName))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size := int64(entry.LastLBA-entry.FirstLBA+1) * vimg.SectorSize
+	if (start+count)*blockSize > size {
+		return nil, 0, fmt.Errorf("blocks %d to %d are beyond the end of the file-system partition", start, start+count-1)
+	}
+
+	off := int64(entry.FirstLBA)*vimg.SectorSize + start*blockSize
+
+	return io.NewSectionReader(iio, off, count*blockSize), blockSize, nil
+
+}
+
 // Readdir returns a list of directory entries within a directory.
 func (iio *IO) Readdir(inode *ext.Inode) ([]*DirectoryEntry, error) {
 
@@ -257,9 +522,30 @@ func (iio *IO) Readdir(inode *ext.Inode) ([]*DirectoryEntry, error) {
 
 }
 
-func (iio *IO) resolveChildInodeNumber(inode *ext.Inode, path string) (int, error) {
+// MaxSymlinks is the most symlinks that are followed while resolving a single
+// path, the same limit as Linux, so that symlink loops fail.
+const MaxSymlinks = 40
+
+// ErrSymlinkLoop is returned when resolving a path would follow more than
+// MaxSymlinks symlinks.
+var ErrSymlinkLoop = errors.New("too many levels of symbolic links")
+
+// SetFollowSymlinks controls whether symlinks are followed while resolving
+// paths. They are followed by default, like on a real file-system; without
+// following them, a path through a symlink can't be resolved.
+func (iio *IO) SetFollowSymlinks(follow bool) {
+	iio.mu.Lock()
+	iio.fs.noFollow = !follow
+	iio.mu.Unlock()
+}
+
+func (iio *IO) followSymlinks() bool {
+	iio.mu.Lock()
+	defer iio.mu.Unlock()
+	return !iio.fs.noFollow
+}
 
-	_, base := filepath.Split(path)
+func (iio *IO) resolveChildInodeNumber(inode *ext.Inode, name, path string) (int, error) {
 
 	list, err := iio.Readdir(inode)
 	if err != nil {
@@ -267,37 +553,180 @@ func (iio *IO) resolveChildInodeNumber(inode *ext.Inode, path string) (int, erro
 	}
 
 	for _, entry := range list {
-		if entry.Name == base {
+		if entry.Name == name {
 			return entry.Inode, nil
 		}
 	}
 
-	return 0, fmt.Errorf("file not found: %s", path)
+	return 0, fmt.Errorf("%w: %s", ErrFileNotFound, path)
+
+}
+
+// readSymlink returns the target of a symlink.
+func (iio *IO) readSymlink(inode *ext.Inode) (string, error) {
+
+	r, err := iio.InodeReader(inode)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, InodeSize(inode)))
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(filepath.ToSlash(path), "/"), "/")
+}
+
+// resolvePath walks path one name at a time from the root, following
+// symlinks it passes through as long as SetFollowSymlinks hasn't turned them
+// off. The last name is only followed if followLast is set.
+func (iio *IO) resolvePath(path string, followLast bool) (int, error) {
+
+	follow := iio.followSymlinks()
+	ino := ext.RootDirInode
+	names := splitPath(path)
+	links := 0
+
+	for len(names) > 0 {
+
+		name := names[0]
+		names = names[1:]
+		if name == "" || name == "." {
+			continue
+		}
+
+		dir, err := iio.ResolveInode(ino)
+		if err != nil {
+			return 0, err
+		}
+
+		if !InodeIsDirectory(dir) {
+			return 0, fmt.Errorf("%w: %s (not a directory)", ErrFileNotFound, path)
+		}
+
+		child, err := iio.resolveChildInodeNumber(dir, name, path)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(names) == 0 && !followLast {
+			return child, nil
+		}
+
+		inode, err := iio.ResolveInode(child)
+		if err != nil {
+			return 0, err
+		}
+
+		if !InodeIsSymlink(inode) {
+			ino = child
+			continue
+		}
+
+		if !follow {
+			if len(names) == 0 {
+				return child, nil
+			}
+			return 0, fmt.Errorf("%w: %s (passes through a symlink, and symlinks aren't being followed)", ErrFileNotFound, path)
+		}
+
+		links++
+		if links > MaxSymlinks {
+			return 0, fmt.Errorf("%w: %s", ErrSymlinkLoop, path)
+		}
+
+		target, err := iio.readSymlink(inode)
+		if err != nil {
+			return 0, err
+		}
+
+		// relative targets are resolved from the directory holding the
+		// symlink, which is still ino
+		if strings.HasPrefix(target, "/") {
+			ino = ext.RootDirInode
+		}
+		names = append(splitPath(target), names...)
+	}
+
+	return ino, nil
 
 }
 
 // ResolvePathToInodeNo translates a filepath into an inode number if it can be
-// found on the disk.
+// found on the disk. Symlinks in the directories leading to the last name in
+// the path are followed, like on a real file-system, but if the last name is
+// a symlink its own inode is returned, like lstat(2).
 func (iio *IO) ResolvePathToInodeNo(path string) (int, error) {
+	return iio.resolvePath(path, false)
+}
+
+// ResolveTargetInodeNo is like ResolvePathToInodeNo, but if the last name in
+// the path is a symlink it's followed too, like stat(2), so that it resolves
+// to what the path would read.
+func (iio *IO) ResolveTargetInodeNo(path string) (int, error) {
+	return iio.resolvePath(path, true)
+}
+
+// Hardlinks scans the whole file-system and returns the paths of every name
+// pointing at an inode with a link count above one, grouped by inode number.
+// Directories are excluded because their link counts reflect their
+// subdirectories rather than hardlinks.
+func (iio *IO) Hardlinks() (map[int][]string, error) {
+
+	links := make(map[int][]string)
+
+	var recurse func(ino int, fpath string) error
+	recurse = func(ino int, fpath string) error {
+
+		inode, err := iio.ResolveInode(ino)
+		if err != nil {
+			return err
+		}
+
+		if !InodeIsDirectory(inode) {
+			if inode.Links > 1 {
+				links[ino] = append(links[ino], fpath)
+			}
+			return nil
+		}
+
+		entries, err := iio.Readdir(inode)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.Name == "." || entry.Name == ".." {
+				continue
+			}
+			err = recurse(entry.Inode, filepath.ToSlash(filepath.Join(fpath, entry.Name)))
+			if err != nil {
+				return err
+			}
+		}
 
-	path = filepath.Join("/", path)
-	path = filepath.ToSlash(path)
-	dir, base := filepath.Split(path)
-	if (dir == "" || dir == "/" || dir == "\"") && base == "" {
-		return ext.RootDirInode, nil
+		return nil
 	}
 
-	parent, err := iio.ResolvePathToInodeNo(dir)
+	err := recurse(ext.RootDirInode, "/")
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	inode, err := iio.ResolveInode(parent)
-	if err != nil {
-		return 0, err
+	// an inode whose other names are all outside the tree isn't hardlinked
+	for ino, paths := range links {
+		if len(paths) < 2 {
+			delete(links, ino)
+		}
 	}
 
-	return iio.resolveChildInodeNumber(inode, path)
+	return links, nil
 
 }
 
@@ -365,7 +794,7 @@ func (iio *IO) emptyInode(inode *ext.Inode) (io.Reader, error) {
 	}, nil
 }
 
-func (iio *IO) exploreExtentsTree(hdr *ext4ExtentHeader, blockSize int64, data []byte, blockAddrs *[]int, c *int) error {
+func (iio *IO) exploreExtentsTree(hdr *ext4ExtentHeader, blockSize int64, data []byte, blockAddrs []int) error {
 
 	r := bytes.NewReader(data)
 	_ = binary.Read(r, binary.LittleEndian, hdr)
@@ -373,10 +802,7 @@ func (iio *IO) exploreExtentsTree(hdr *ext4ExtentHeader, blockSize int64, data [
 	for i := 0; i < int(hdr.Entries); i++ {
 
 		index := new(ext4ExtentIdx)
-		binary.Read(r, binary.LittleEndian, index)
-		if index.Block != 0 {
-			return errors.New("extent index data unaccounted for")
-		}
+		_ = binary.Read(r, binary.LittleEndian, index)
 		baddr := int(index.LeafLo) + (int(index.LeafHi) << 32)
 
 		block, err := iio.loadBlock(baddr)
@@ -384,7 +810,7 @@ func (iio *IO) exploreExtentsTree(hdr *ext4ExtentHeader, blockSize int64, data [
 			return err
 		}
 
-		err = iio.recurseExtentsTree(blockSize, block, blockAddrs, c)
+		err = iio.recurseExtentsTree(blockSize, block, blockAddrs)
 		if err != nil {
 			return err
 		}
@@ -395,31 +821,36 @@ func (iio *IO) exploreExtentsTree(hdr *ext4ExtentHeader, blockSize int64, data [
 
 }
 
-func (iio *IO) recurseExtentsTree(blockSize int64, data []byte, blockAddrs *[]int, c *int) error {
+func (iio *IO) recurseExtentsTree(blockSize int64, data []byte, blockAddrs []int) error {
 
 	// read header
 	hdr := new(ext4ExtentHeader)
 	r := bytes.NewReader(data)
 	_ = binary.Read(r, binary.LittleEndian, hdr)
-	if hdr.Magic != 0xF30A {
+	if hdr.Magic != ext.ExtentMagic {
 		return errors.New("extent node doesn't have magic number")
 	}
 
 	if hdr.Depth != 0 {
-		return iio.exploreExtentsTree(hdr, blockSize, data, blockAddrs, c)
+		return iio.exploreExtentsTree(hdr, blockSize, data, blockAddrs)
 	}
 
 	for i := 0; i < int(hdr.Entries); i++ {
 		extent := new(ext4Extent)
-		binary.Read(r, binary.LittleEndian, extent)
-		if extent.Block != 0 && i == 0 {
-			return errors.New("extent data unaccounted for")
+		_ = binary.Read(r, binary.LittleEndian, extent)
+
+		// uninitialized extents read as zeroes, so they're left as holes
+		if extent.Len > 32768 {
+			continue
 		}
 
 		baddr := int(extent.Lo) + (int(extent.Hi) << 32)
-		l := int(extent.Len)
-		for j := 0; j < int(l) && *c < len(*blockAddrs); (*c), j = (*c + 1), j+1 {
-			(*blockAddrs)[*c] = baddr + j // TODO: catch corruption
+		for j := 0; j < int(extent.Len); j++ {
+			k := int(extent.Block) + j
+			if k >= len(blockAddrs) {
+				break
+			}
+			blockAddrs[k] = baddr + j
 		}
 	}
 
@@ -427,7 +858,7 @@ func (iio *IO) recurseExtentsTree(blockSize int64, data []byte, blockAddrs *[]in
 
 }
 
-func (iio *IO) dataFromExtentsTree(inode *ext.Inode) (io.Reader, error) {
+func (iio *IO) extentsTreeBlockAddrs(inode *ext.Inode) ([]int, error) {
 
 	sb, err := iio.Superblock(0)
 	if err != nil {
@@ -437,38 +868,33 @@ func (iio *IO) dataFromExtentsTree(inode *ext.Inode) (io.Reader, error) {
 	blockSize := int64(1024 << sb.BlockSize)
 	blockAddrs := make([]int, (InodeSize(inode)+blockSize-1)/blockSize)
 
-	i := 0
-
+	// the root of the tree occupies all of the inode's block pointer fields
 	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, inode.DirectPointer[:])
-	err = iio.recurseExtentsTree(blockSize, buf.Bytes(), &blockAddrs, &i)
+	_ = binary.Write(buf, binary.LittleEndian, inode.DirectPointer[:])
+	_ = binary.Write(buf, binary.LittleEndian, []uint32{inode.SinglyIndirect, inode.DoublyIndirect, inode.TriplyIndirect})
+	err = iio.recurseExtentsTree(blockSize, buf.Bytes(), blockAddrs)
 	if err != nil {
 		return nil, err
 	}
 
-	out := &inodeReader{
-		iio:        iio,
-		inode:      inode,
-		blockAddrs: blockAddrs,
-	}
-
-	return io.LimitReader(out, int64(inode.SizeLower)), nil
+	return blockAddrs, nil
 
 }
 
-func (iio *IO) seekToBlock(blockNo int) error {
+func (iio *IO) dataFromExtentsTree(inode *ext.Inode) (io.Reader, error) {
 
-	lba, err := iio.BlockToLBA(blockNo)
+	blockAddrs, err := iio.extentsTreeBlockAddrs(inode)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = iio.img.Seek(int64(lba*vimg.SectorSize), io.SeekStart)
-	if err != nil {
-		return err
+	out := &inodeReader{
+		iio:        iio,
+		inode:      inode,
+		blockAddrs: blockAddrs,
 	}
 
-	return nil
+	return io.LimitReader(out, InodeSize(inode)), nil
 
 }
 
@@ -479,20 +905,18 @@ func (iio *IO) loadBlock(blockNo int) ([]byte, error) {
 		return nil, err
 	}
 
-	blockSize := int64(1024 << sb.BlockSize)
-
-	err = iio.seekToBlock(blockNo)
+	lba, err := iio.BlockToLBA(blockNo)
 	if err != nil {
 		return nil, err
 	}
 
-	buf := new(bytes.Buffer)
-	_, err = io.CopyN(buf, iio.img, int64(blockSize))
+	buf := make([]byte, 1024<<sb.BlockSize)
+	_, err = iio.ReadAt(buf, int64(lba*vimg.SectorSize))
 	if err != nil {
 		return nil, err
 	}
 
-	return buf.Bytes(), nil
+	return buf, nil
 
 }
 
@@ -553,15 +977,9 @@ func loadBlockPointers(iio *IO, addr, depth int, blockAddrs *[]int, i *int) erro
 
 }
 
-func (iio *IO) dataFromBlockPointers(inode *ext.Inode) (io.Reader, error) {
-
-	sb, err := iio.Superblock(0)
-	if err != nil {
-		return nil, err
-	}
+func (iio *IO) blockPointersBlockAddrs(inode *ext.Inode, n int64) ([]int, error) {
 
-	blockSize := int64(1024 << sb.BlockSize)
-	blockAddrs := make([]int, (InodeSize(inode)+blockSize-1)/blockSize)
+	blockAddrs := make([]int, n)
 
 	// load direct pointers
 	for i := 0; i < len(inode.DirectPointer[:]) && i < len(blockAddrs); i++ {
@@ -571,12 +989,30 @@ func (iio *IO) dataFromBlockPointers(inode *ext.Inode) (io.Reader, error) {
 	i := 12
 
 	for depth, addr := range []uint32{inode.SinglyIndirect, inode.DoublyIndirect, inode.TriplyIndirect} {
-		err = loadBlockPointers(iio, int(addr), depth, &blockAddrs, &i)
+		err := loadBlockPointers(iio, int(addr), depth, &blockAddrs, &i)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	return blockAddrs, nil
+
+}
+
+func (iio *IO) dataFromBlockPointers(inode *ext.Inode) (io.Reader, error) {
+
+	sb, err := iio.Superblock(0)
+	if err != nil {
+		return nil, err
+	}
+
+	blockSize := int64(1024 << sb.BlockSize)
+
+	blockAddrs, err := iio.blockPointersBlockAddrs(inode, (InodeSize(inode)+blockSize-1)/blockSize)
+	if err != nil {
+		return nil, err
+	}
+
 	out := &inodeReader{
 		iio:        iio,
 		inode:      inode,
@@ -587,6 +1023,56 @@ func (iio *IO) dataFromBlockPointers(inode *ext.Inode) (io.Reader, error) {
 
 }
 
+// InodeBlocks returns the address of every block holding data for the inode,
+// in order. An address of zero represents a hole. Symlinks stored within the
+// inode itself have no blocks.
+func (iio *IO) InodeBlocks(inode *ext.Inode) ([]int, error) {
+
+	if inode.Sectors == 0 {
+		return []int{}, nil
+	}
+
+	if inode.Flags&ext.InodeFlagExtents > 0 {
+		return iio.extentsTreeBlockAddrs(inode)
+	}
+
+	sb, err := iio.Superblock(0)
+	if err != nil {
+		return nil, err
+	}
+
+	blockSize := int64(1024 << sb.BlockSize)
+	return iio.blockPointersBlockAddrs(inode, (InodeSize(inode)+blockSize-1)/blockSize)
+
+}
+
+// WriteBlock overwrites a single file-system block. Data shorter than a block
+// is padded with zeroes. The image must have been opened with OpenRW.
+func (iio *IO) WriteBlock(blockNo int, data []byte) error {
+
+	sb, err := iio.Superblock(0)
+	if err != nil {
+		return err
+	}
+
+	blockSize := 1024 << sb.BlockSize
+	if len(data) > blockSize {
+		return fmt.Errorf("data exceeds block size: %d > %d", len(data), blockSize)
+	}
+
+	lba, err := iio.BlockToLBA(blockNo)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, blockSize)
+	copy(buf, data)
+
+	_, err = iio.WriteAt(buf, int64(lba*vimg.SectorSize))
+	return err
+
+}
+
 // InodeReader reads all of the data stored for an inode.
 func (iio *IO) InodeReader(inode *ext.Inode) (io.Reader, error) {
 
@@ -598,7 +1084,7 @@ func (iio *IO) InodeReader(inode *ext.Inode) (io.Reader, error) {
 		return iio.emptyInode(inode)
 	}
 
-	if inode.Flags&0x80000 > 0 {
+	if inode.Flags&ext.InodeFlagExtents > 0 {
 		return iio.dataFromExtentsTree(inode)
 	}
 
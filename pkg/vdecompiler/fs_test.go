@@ -0,0 +1,314 @@
+package vdecompiler
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+)
+
+func TestStatfs(t *testing.T) {
+
+	for _, reserved := range []int{0, 5} {
+
+		path := buildReservedTestImage(t, 2, reserved)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		iio, err := Open(path)
+		if err != nil {
+			t.Fatalf("failed to open image: %v", err)
+		}
+		defer iio.Close()
+
+		st, err := iio.Statfs()
+		if err != nil {
+			t.Fatalf("failed to stat file-system: %v", err)
+		}
+
+		if st.BlockSize != 4096 || st.Blocks == 0 || st.FreeBlocks > st.Blocks || st.FreeInodes >= st.Inodes {
+			t.Fatalf("unexpected file-system statistics: %+v", st)
+		}
+
+		if expect := st.Blocks * int64(reserved) / 100; st.ReservedBlocks != expect {
+			t.Fatalf("%d%% reserved file-system reports %d reserved blocks, expected %d", reserved, st.ReservedBlocks, expect)
+		}
+
+		avail := st.FreeBlocks - st.ReservedBlocks
+		if avail < 0 {
+			avail = 0
+		}
+		if st.AvailableBlocks != avail {
+			t.Fatalf("expected %d available blocks, got %d", avail, st.AvailableBlocks)
+		}
+	}
+}
+
+func TestBlockUsage(t *testing.T) {
+
+	path := buildTestImage(t, 2)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	iio, err := Open(path)
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	defer iio.Close()
+
+	st, err := iio.Statfs()
+	if err != nil {
+		t.Fatalf("failed to stat file-system: %v", err)
+	}
+
+	u, err := iio.BlockUsage()
+	if err != nil {
+		t.Fatalf("failed to scan block bitmaps: %v", err)
+	}
+
+	if u.Blocks != st.Blocks || u.UsedBlocks+u.FreeBlocks != u.Blocks {
+		t.Fatalf("block counts don't add up: %+v", u)
+	}
+
+	if u.FreeBlocks != st.FreeBlocks {
+		t.Fatalf("block bitmaps have %d free blocks, but the superblock says %d", u.FreeBlocks, st.FreeBlocks)
+	}
+
+	if u.FreeBlocks > 0 && (u.FreeExtents == 0 || u.LargestFreeExtent == 0 || u.LargestFreeExtent > u.FreeBlocks) {
+		t.Fatalf("unexpected free extents: %+v", u)
+	}
+
+	if f := u.Fragmentation(); f < 0 || f >= 1 {
+		t.Fatalf("fragmentation out of range: %v", f)
+	}
+
+	if f := (&BlockUsage{FreeBlocks: 4, LargestFreeExtent: 1}).Fragmentation(); f != 0.75 {
+		t.Fatalf("expected fragmentation of 0.75, got %v", f)
+	}
+}
+
+func TestBlockRangeReader(t *testing.T) {
+
+	path := buildTestImage(t, 2)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	iio, err := Open(path)
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	defer iio.Close()
+
+	st, err := iio.Statfs()
+	if err != nil {
+		t.Fatalf("failed to stat file-system: %v", err)
+	}
+
+	r, blockSize, err := iio.BlockRangeReader(0, 1)
+	if err != nil {
+		t.Fatalf("failed to read block 0: %v", err)
+	}
+
+	if blockSize != st.BlockSize || r.Size() != blockSize {
+		t.Fatalf("expected one block of %d bytes, got %d bytes with block size %d", st.BlockSize, r.Size(), blockSize)
+	}
+
+	// the superblock is 1 KiB into the first block
+	raw, err := iio.RawSuperblock(0)
+	if err != nil {
+		t.Fatalf("failed to read superblock: %v", err)
+	}
+
+	buf := make([]byte, len(raw))
+	_, err = r.ReadAt(buf, ext.SuperblockOffset)
+	if err != nil {
+		t.Fatalf("failed to read block range: %v", err)
+	}
+
+	if !bytes.Equal(buf, raw) {
+		t.Fatalf("block range doesn't hold the superblock")
+	}
+
+	_, _, err = iio.BlockRangeReader(st.Blocks-1, 1)
+	if err != nil {
+		t.Fatalf("failed to read the last block: %v", err)
+	}
+
+	for _, rng := range [][2]int64{{-1, 1}, {0, 0}, {st.Blocks, 1}, {st.Blocks - 1, 2}} {
+		_, _, err = iio.BlockRangeReader(rng[0], rng[1])
+		if err == nil {
+			t.Fatalf("expected an error reading %d blocks from block %d", rng[1], rng[0])
+		}
+	}
+}
+
+func TestResolveSymlinks(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vdecompiler")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	err = os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	if err != nil {
+		t.Fatalf("failed to create source dir: %v", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(src, "sub", "f0"), testFileContents(0), 0644)
+	if err != nil {
+		t.Fatalf("failed to write source file: %v", err)
+	}
+
+	for link, target := range map[string]string{
+		"dir":      "sub",
+		"abs":      "/sub/f0",
+		"sub/up":   "../dir/f0",
+		"chain":    "sub/up",
+		"loop-a":   "loop-b",
+		"loop-b":   "loop-a",
+		"dangling": "missing",
+	} {
+		err = os.Symlink(target, filepath.Join(src, link))
+		if err != nil {
+			t.Fatalf("failed to create symlink: %v", err)
+		}
+	}
+
+	iio, err := Open(buildTestImageFromDirectory(t, dir, src, 0))
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	defer iio.Close()
+
+	expect, err := iio.ResolvePathToInodeNo("/sub/f0")
+	if err != nil {
+		t.Fatalf("failed to resolve file: %v", err)
+	}
+
+	for _, path := range []string{"/dir/f0", "dir/f0", "/abs", "/sub/up", "/chain", "/dir/../dir/f0"} {
+		ino, err := iio.ResolveTargetInodeNo(path)
+		if err != nil {
+			t.Fatalf("failed to resolve %s: %v", path, err)
+		}
+		if ino != expect {
+			t.Fatalf("%s resolved to inode %d, expected %d", path, ino, expect)
+		}
+	}
+
+	// the final component isn't followed unless asked for
+	ino, err := iio.ResolvePathToInodeNo("/abs")
+	if err != nil {
+		t.Fatalf("failed to resolve symlink: %v", err)
+	}
+	if ino == expect {
+		t.Fatalf("resolving a symlink followed it")
+	}
+
+	_, err = iio.ResolveTargetInodeNo("/loop-a")
+	if !errors.Is(err, ErrSymlinkLoop) {
+		t.Fatalf("expected a symlink loop error, got %v", err)
+	}
+
+	_, err = iio.ResolveTargetInodeNo("/dangling")
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("expected a file not found error, got %v", err)
+	}
+
+	iio.SetFollowSymlinks(false)
+
+	_, err = iio.ResolveTargetInodeNo("/dir/f0")
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("expected intermediate symlink to be rejected, got %v", err)
+	}
+
+	ino, err = iio.ResolveTargetInodeNo("/abs")
+	if err != nil {
+		t.Fatalf("failed to resolve symlink: %v", err)
+	}
+	if ino == expect {
+		t.Fatalf("symlink was followed with following disabled")
+	}
+}
+
+func TestWriteBlockAndInode(t *testing.T) {
+
+	path := buildTestImage(t, 1)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	iio, err := OpenRW(path)
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+
+	ino, err := iio.ResolvePathToInodeNo("/sub/f0")
+	if err != nil {
+		t.Fatalf("failed to resolve file: %v", err)
+	}
+
+	inode, err := iio.ResolveInode(ino)
+	if err != nil {
+		t.Fatalf("failed to resolve inode: %v", err)
+	}
+
+	blocks, err := iio.InodeBlocks(inode)
+	if err != nil {
+		t.Fatalf("failed to get inode blocks: %v", err)
+	}
+	if len(blocks) == 0 {
+		t.Fatalf("expected the file to have blocks")
+	}
+
+	err = iio.WriteBlock(blocks[0], make([]byte, 4097))
+	if err == nil {
+		t.Fatalf("expected an error writing more than a block")
+	}
+
+	contents := []byte("patched")
+	err = iio.WriteBlock(blocks[0], contents)
+	if err != nil {
+		t.Fatalf("failed to write block: %v", err)
+	}
+
+	inode.SizeLower = uint32(len(contents))
+	inode.SizeUpper = 0
+	err = iio.WriteInode(ino, inode)
+	if err != nil {
+		t.Fatalf("failed to write inode: %v", err)
+	}
+	iio.Close()
+
+	// the changes have to be on disk, not just cached
+	iio, err = Open(path)
+	if err != nil {
+		t.Fatalf("failed to reopen image: %v", err)
+	}
+	defer iio.Close()
+
+	inode, err = iio.ResolveInode(ino)
+	if err != nil {
+		t.Fatalf("failed to resolve inode: %v", err)
+	}
+	if InodeSize(inode) != int64(len(contents)) {
+		t.Fatalf("inode has size %d, expected %d", InodeSize(inode), len(contents))
+	}
+
+	r, err := iio.InodeReader(inode)
+	if err != nil {
+		t.Fatalf("failed to read inode: %v", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read inode: %v", err)
+	}
+	if !bytes.Equal(data, contents) {
+		t.Fatalf("file contains %q, expected %q", data, contents)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"sync"
 	"unicode/utf16"
 
 	"github.com/vorteil/vorteil/pkg/vdisk"
@@ -29,6 +30,9 @@ var (
 	ErrWrite = errors.New("underlying IO object does not support writing")
 )
 
+// ErrFileNotFound is returned when a path can't be resolved on the disk.
+var ErrFileNotFound = errors.New("file not found")
+
 type partialIO struct {
 	name   string
 	offset int
@@ -131,14 +135,25 @@ func (pio *partialIO) Seek(offset int64, whence int) (n int64, err error) {
 // possible to navigate and read data from it. It has a complex but
 // flexible implementation, allowing it to work from both seekable files
 // and read-only streams.
+//
+// An IO is safe for concurrent use by multiple goroutines. Every access to
+// the image is a seek followed by a read or write made while holding a lock,
+// and the readers returned by InodeReader, PartitionReader and KernelFile
+// keep track of their own positions. The exception is RawReader, which reads
+// the image directly and must not be used alongside any other method. An IO
+// opened from a read-only stream cannot rewind, so reading from it in any
+// order but a single forward pass fails regardless of locking.
 type IO struct {
+	mu         sync.Mutex // guards the image position and everything below
 	src, img   *partialIO
+	head       []byte
 	format     vdisk.Format
 	gptHeader  *vimg.GPTHeader
 	gptEntries []*vimg.GPTEntry
 	vmdk       *vmdk.Header
 	vpart      vpartInfo
 	fs         fsInfo
+	luks       luksInfo
 }
 
 // Close closes the underlying IO object and cleans up any other resources
@@ -152,7 +167,7 @@ type imageIOLoader struct {
 }
 
 func (l *imageIOLoader) Close() error {
-	_, err := l.iio.ImageFormat()
+	_, err := l.iio.imageFormat()
 	if err != nil {
 		return fmt.Errorf("could not initialize image IO: %w", err)
 	}
@@ -160,7 +175,7 @@ func (l *imageIOLoader) Close() error {
 }
 
 func (l *imageIOLoader) Read(p []byte) (n int, err error) {
-	_, err = l.iio.ImageFormat()
+	_, err = l.iio.imageFormat()
 	if err != nil {
 		return 0, fmt.Errorf("could not initialize image IO: %w", err)
 	}
@@ -168,7 +183,7 @@ func (l *imageIOLoader) Read(p []byte) (n int, err error) {
 }
 
 func (l *imageIOLoader) Seek(offset int64, whence int) (n int64, err error) {
-	_, err = l.iio.ImageFormat()
+	_, err = l.iio.imageFormat()
 	if err != nil {
 		return 0, fmt.Errorf("could not initialize image IO: %w", err)
 	}
@@ -176,7 +191,7 @@ func (l *imageIOLoader) Seek(offset int64, whence int) (n int64, err error) {
 }
 
 func (l *imageIOLoader) Write(p []byte) (n int, err error) {
-	_, err = l.iio.ImageFormat()
+	_, err = l.iio.imageFormat()
 	if err != nil {
 		return 0, fmt.Errorf("could not initialize image IO: %w", err)
 	}
@@ -205,7 +220,25 @@ func newIO(srcName string, srcSize int, img interface{}) (*IO, error) {
 
 }
 
-// Open returns an image IO object from a file at path.
+// sourceSize returns the size of the disk image open as f. Block devices
+// report no size through Stat, so on Linux it is queried from the device.
+func sourceSize(f *os.File) (int64, error) {
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	mode := fi.Mode()
+	if mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0 {
+		return blockDeviceSize(f)
+	}
+
+	return fi.Size(), nil
+}
+
+// Open returns an image IO object from a file at path, which may also be a
+// block device on Linux.
 func Open(path string) (*IO, error) {
 
 	f, err := os.Open(path)
@@ -213,12 +246,38 @@ func Open(path string) (*IO, error) {
 		return nil, err
 	}
 
-	fi, err := f.Stat()
+	size, err := sourceSize(f)
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
 
-	iio, err := newIO(path, int(fi.Size()), f)
+	iio, err := newIO(path, int(size), f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return iio, nil
+
+}
+
+// OpenRW returns an image IO object from a file at path, opened for both
+// reading and writing. Writing is only supported for raw images.
+func OpenRW(path string) (*IO, error) {
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := sourceSize(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	iio, err := newIO(path, int(size), f)
 	if err != nil {
 		f.Close()
 		return nil, err
@@ -266,6 +325,8 @@ func (iio *IO) determineImageFormat() error {
 		return err
 	}
 
+	iio.head = buf.Bytes()
+
 	var magic uint32
 
 	err = binary.Read(bytes.NewReader(buf.Bytes()), binary.LittleEndian, &magic)
@@ -287,6 +348,12 @@ func (iio *IO) determineImageFormat() error {
 
 // ImageFormat returns the image's file format.
 func (iio *IO) ImageFormat() (vdisk.Format, error) {
+	iio.mu.Lock()
+	defer iio.mu.Unlock()
+	return iio.imageFormat()
+}
+
+func (iio *IO) imageFormat() (vdisk.Format, error) {
 
 	if iio.format != "" {
 		return iio.format, nil
@@ -301,93 +368,216 @@ func (iio *IO) ImageFormat() (vdisk.Format, error) {
 
 }
 
+// ReadAt implements io.ReaderAt for the image's contents as a raw disk,
+// regardless of the image's file format. Once the image is unlocked, its
+// encrypted root partition is decrypted as it's read.
+func (iio *IO) ReadAt(p []byte, off int64) (int, error) {
+
+	iio.mu.Lock()
+	defer iio.mu.Unlock()
+
+	if iio.luks.volume != nil {
+		return iio.readEncryptedAt(p, off)
+	}
+
+	return iio.readAt(p, off)
+
+}
+
+func (iio *IO) readAt(p []byte, off int64) (int, error) {
+
+	_, err := iio.img.Seek(off, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(iio.img, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+
+}
+
+// WriteAt implements io.WriterAt for the image's contents as a raw disk. The
+// image must have been opened with OpenRW. Once the image is unlocked, its
+// encrypted root partition is encrypted as it's written.
+func (iio *IO) WriteAt(p []byte, off int64) (int, error) {
+
+	iio.mu.Lock()
+	defer iio.mu.Unlock()
+
+	if iio.luks.volume != nil {
+		return iio.writeEncryptedAt(p, off)
+	}
+
+	return iio.writeAt(p, off)
+
+}
+
+func (iio *IO) writeAt(p []byte, off int64) (int, error) {
+
+	_, err := iio.img.Seek(off, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	return iio.img.Write(p)
+
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
+
+// RawReader returns a reader for the whole disk as a raw image, along with its
+// size in bytes, or -1 if the size isn't known. Images in other formats are
+// converted to raw as they are read. For raw images the reader never seeks the
+// underlying IO object, so long as nothing past the first sector has been read
+// yet, which makes it suitable for streams. Any error identifying the image is
+// returned by the first call to Read. Closing the reader does not close iio.
+func (iio *IO) RawReader() (io.ReadCloser, int64) {
+
+	_, err := iio.ImageFormat()
+	if err != nil {
+		return ioutil.NopCloser(&errReader{err: err}), -1
+	}
+
+	size := int64(iio.img.size)
+	if iio.format == vdisk.RAWFormat && size <= 0 {
+		size = -1
+	}
+
+	var r io.Reader
+	if iio.format == vdisk.RAWFormat && iio.src.offset == len(iio.head) {
+		r = io.MultiReader(bytes.NewReader(iio.head), iio.src)
+	} else {
+		_, err = iio.img.Seek(0, io.SeekStart)
+		if err != nil {
+			return ioutil.NopCloser(&errReader{err: err}), size
+		}
+		r = iio.img
+	}
+
+	if size >= 0 {
+		r = io.LimitReader(r, size)
+	}
+
+	return ioutil.NopCloser(r), size
+
+}
+
 // GPTEntryName returns a normal string representation of the GPT entry. Without
 // calling this function the data in the GPT entry is encoded in UTF16.
 func GPTEntryName(e *vimg.GPTEntry) string {
 	return UTF16toString(e.Name[:])
 }
 
-func (iio *IO) readGPTHeader() error {
+func (iio *IO) readGPTHeader() (*vimg.GPTHeader, error) {
 
-	_, err := iio.img.Seek(vimg.PrimaryGPTHeaderLBA*vimg.SectorSize, io.SeekStart)
+	buf := make([]byte, binary.Size(vimg.GPTHeader{}))
+	_, err := iio.ReadAt(buf, vimg.PrimaryGPTHeaderLBA*vimg.SectorSize)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	hdr := new(vimg.GPTHeader)
 
-	err = binary.Read(iio.img, binary.LittleEndian, hdr)
+	err = binary.Read(bytes.NewReader(buf), binary.LittleEndian, hdr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	iio.gptHeader = hdr
+	if hdr.Signature != vimg.GPTSignature {
+		return nil, errors.New("image has no GPT: header doesn't contain a valid signature")
+	}
 
 	if hdr.SizePartEntry != vimg.GPTEntrySize {
-		return fmt.Errorf("GPT uses abnormal entry size: %d", hdr.SizePartEntry)
+		return nil, fmt.Errorf("GPT uses abnormal entry size: %d", hdr.SizePartEntry)
 	}
 
-	return nil
+	return hdr, nil
 
 }
 
 // GPTHeader returns the primary GPT header for the image.
 func (iio *IO) GPTHeader() (*vimg.GPTHeader, error) {
 
-	if iio.gptHeader != nil {
-		return iio.gptHeader, nil
+	iio.mu.Lock()
+	hdr := iio.gptHeader
+	iio.mu.Unlock()
+
+	if hdr != nil {
+		return hdr, nil
 	}
 
-	err := iio.readGPTHeader()
+	hdr, err := iio.readGPTHeader()
 	if err != nil {
 		return nil, err
 	}
 
-	return iio.gptHeader, nil
+	iio.mu.Lock()
+	iio.gptHeader = hdr
+	iio.mu.Unlock()
+
+	return hdr, nil
 
 }
 
-func (iio *IO) readGPTEntries() error {
+func (iio *IO) readGPTEntries() ([]*vimg.GPTEntry, error) {
 
 	hdr, err := iio.GPTHeader()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	_, err = iio.img.Seek(int64(hdr.StartLBAParts*vimg.SectorSize), io.SeekStart)
+	buf := make([]byte, int(hdr.NoOfParts)*vimg.GPTEntrySize)
+	_, err = iio.ReadAt(buf, int64(hdr.StartLBAParts*vimg.SectorSize))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	r := bytes.NewReader(buf)
 	list := make([]*vimg.GPTEntry, hdr.NoOfParts)
 	for i := range list {
 		entry := new(vimg.GPTEntry)
-		err = binary.Read(iio.img, binary.LittleEndian, entry)
+		err = binary.Read(r, binary.LittleEndian, entry)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		list[i] = entry
 	}
 
-	iio.gptEntries = list
-
-	return nil
+	return list, nil
 
 }
 
 // GPTEntries returns a list of all GPT partition entries on the disk.
 func (iio *IO) GPTEntries() ([]*vimg.GPTEntry, error) {
 
-	if iio.gptEntries != nil {
-		return iio.gptEntries, nil
+	iio.mu.Lock()
+	list := iio.gptEntries
+	iio.mu.Unlock()
+
+	if list != nil {
+		return list, nil
 	}
 
-	err := iio.readGPTEntries()
+	list, err := iio.readGPTEntries()
 	if err != nil {
 		return nil, err
 	}
 
-	return iio.gptEntries, nil
+	iio.mu.Lock()
+	iio.gptEntries = list
+	iio.mu.Unlock()
+
+	return list, nil
 
 }
 
@@ -422,12 +612,7 @@ func (iio *IO) PartitionReader(name string) (io.Reader, error) {
 	lbas := entry.LastLBA - entry.FirstLBA + 1
 	start := entry.FirstLBA
 
-	_, err = iio.img.Seek(int64(start)*vimg.SectorSize, io.SeekStart)
-	if err != nil {
-		return nil, err
-	}
-
-	return io.LimitReader(iio.img, int64(lbas)*vimg.SectorSize), nil
+	return io.NewSectionReader(iio, int64(start)*vimg.SectorSize, int64(lbas)*vimg.SectorSize), nil
 
 }
 
@@ -0,0 +1,315 @@
+package vdecompiler
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+const testFirstLBA = 2048
+
+func testFileContents(i int) []byte {
+	data := make([]byte, 50000+i*37000)
+	for j := range data {
+		data[j] = byte(i*31 + j*7 + j>>12)
+	}
+	return data
+}
+
+// buildTestImage writes a minimal GPT disk with a root partition holding an
+// ext file-system with the given number of files.
+func buildTestImage(t *testing.T, files int) string {
+	return buildReservedTestImage(t, files, 0)
+}
+
+// buildReservedTestImage is buildTestImage with a percentage of the
+// file-system's blocks reserved for the superuser.
+func buildReservedTestImage(t *testing.T, files, reserved int) string {
+
+	dir, err := ioutil.TempDir("", "vdecompiler")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+
+	src := filepath.Join(dir, "src")
+	err = os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	if err != nil {
+		t.Fatalf("failed to create source dir: %v", err)
+	}
+
+	for i := 0; i < files; i++ {
+		err = ioutil.WriteFile(filepath.Join(src, "sub", fmt.Sprintf("f%d", i)), testFileContents(i), 0644)
+		if err != nil {
+			t.Fatalf("failed to write source file: %v", err)
+		}
+	}
+
+	return buildTestImageFromDirectory(t, dir, src, reserved)
+}
+
+// buildTestImageFromDirectory writes a test image into dir holding an ext
+// file-system built from the contents of src.
+func buildTestImageFromDirectory(t *testing.T, dir, src string, reserved int) string {
+
+	tree, err := vio.FileTreeFromDirectory(src)
+	if err != nil {
+		t.Fatalf("failed to load file tree: %v", err)
+	}
+	defer tree.Close()
+
+	path := filepath.Join(dir, "disk.raw")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+	defer f.Close()
+
+	_, err = f.Seek(testFirstLBA*vimg.SectorSize, io.SeekStart)
+	if err != nil {
+		t.Fatalf("failed to seek image: %v", err)
+	}
+
+	size, err := vdisk.BuildFilesystem(context.Background(), f, &vdisk.FilesystemArgs{
+		FileTree:              tree,
+		Logger:                &elog.CLI{},
+		ReservedBlocksPercent: reserved,
+	})
+	if err != nil {
+		t.Fatalf("failed to build file-system: %v", err)
+	}
+
+	hdr := &vimg.GPTHeader{
+		Signature:     0x5452415020494645,
+		HeaderSize:    92,
+		CurrentLBA:    vimg.PrimaryGPTHeaderLBA,
+		StartLBAParts: 2,
+		NoOfParts:     1,
+		SizePartEntry: vimg.GPTEntrySize,
+	}
+
+	entry := &vimg.GPTEntry{
+		FirstLBA: testFirstLBA,
+		LastLBA:  uint64(testFirstLBA + size/vimg.SectorSize - 1),
+	}
+	copy(entry.Name[:], vimg.RootPartitionName)
+
+	buf := new(bytes.Buffer)
+	buf.Write(make([]byte, vimg.SectorSize))
+	_ = binary.Write(buf, binary.LittleEndian, hdr)
+	_ = binary.Write(buf, binary.LittleEndian, entry)
+
+	_, err = f.WriteAt(buf.Bytes(), 0)
+	if err != nil {
+		t.Fatalf("failed to write partition table: %v", err)
+	}
+
+	err = f.Truncate(testFirstLBA*vimg.SectorSize + size)
+	if err != nil {
+		t.Fatalf("failed to truncate image: %v", err)
+	}
+
+	return path
+}
+
+func TestConcurrentReads(t *testing.T) {
+
+	const files = 8
+
+	path := buildTestImage(t, files)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	iio, err := Open(path)
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	defer iio.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, files*4)
+
+	for n := 0; n < files*4; n++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			ino, err := iio.ResolvePathToInodeNo(fmt.Sprintf("/sub/f%d", i))
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			inode, err := iio.ResolveInode(ino)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			r, err := iio.InodeReader(inode)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			if !bytes.Equal(data, testFileContents(i)) {
+				errs <- fmt.Errorf("contents of f%d read incorrectly", i)
+			}
+		}(n % files)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+}
+
+func TestVCFG(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "vdecompiler")
+	if err != nil {
+		t.Fatalf("failed to create image: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	data := []byte(`{"program":[{"binary":"/app"}],"system":{"hostname":"test"}}`)
+	start := int64(64 * vimg.SectorSize)
+
+	hdr := &vimg.GPTHeader{
+		Signature:     vimg.GPTSignature,
+		StartLBAParts: 2,
+		NoOfParts:     1,
+		SizePartEntry: vimg.GPTEntrySize,
+	}
+
+	entry := &vimg.GPTEntry{
+		FirstLBA: 64,
+		LastLBA:  64 + vimg.KernelConfigSpaceSectors + 8,
+	}
+	copy(entry.Name[:], vimg.OSPartitionName)
+
+	conf := &vimg.BootloaderConfig{
+		ConfigOffset:   vimg.KernelConfigSpaceSectors * vimg.SectorSize,
+		ConfigLen:      uint64(len(data)),
+		ConfigCapacity: 8 * vimg.SectorSize,
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(make([]byte, vimg.SectorSize))
+	_ = binary.Write(buf, binary.LittleEndian, hdr)
+	_ = binary.Write(buf, binary.LittleEndian, entry)
+	buf.Write(make([]byte, int(start)-buf.Len()))
+	_ = binary.Write(buf, binary.LittleEndian, conf)
+	buf.Write(make([]byte, int(start)+int(conf.ConfigOffset)-buf.Len()))
+	buf.Write(data)
+	buf.Write(make([]byte, 8*vimg.SectorSize-len(data)))
+
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		t.Fatalf("failed to write image: %v", err)
+	}
+
+	iio, err := Open(f.Name())
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	defer iio.Close()
+
+	cfg, err := iio.VCFG()
+	if err != nil {
+		t.Fatalf("failed to read vcfg: %v", err)
+	}
+
+	if len(cfg.Programs) != 1 || cfg.Programs[0].Binary != "/app" || cfg.System.Hostname != "test" {
+		t.Fatalf("vcfg read incorrectly: %+v", cfg)
+	}
+
+}
+
+func TestPartitions(t *testing.T) {
+
+	path := buildTestImage(t, 1)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("failed to stat image: %v", err)
+	}
+
+	mbr := &vimg.ProtectiveMBR{
+		Status:        0x80,
+		PartitionType: 0xEE,
+		FirstLBA:      1,
+		TotalSectors:  uint32(fi.Size()/vimg.SectorSize) - 1,
+		MagicNumber:   [2]byte{0x55, 0xAA},
+	}
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, mbr)
+	_, err = f.WriteAt(buf.Bytes(), 0)
+	f.Close()
+	if err != nil {
+		t.Fatalf("failed to write mbr: %v", err)
+	}
+
+	iio, err := Open(path)
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	defer iio.Close()
+
+	partitions, err := iio.Partitions()
+	if err != nil {
+		t.Fatalf("failed to read partitions: %v", err)
+	}
+
+	if len(partitions) != 2 {
+		t.Fatalf("expected 2 partitions, got %d: %+v", len(partitions), partitions)
+	}
+
+	p := partitions[0]
+	if p.Table != PartitionTableMBR || p.Type != "GPT protective" || !p.Bootable || p.FirstLBA != 1 || p.Filesystem != "" {
+		t.Fatalf("mbr partition read incorrectly: %+v", p)
+	}
+
+	p = partitions[1]
+	if p.Table != PartitionTableGPT || p.Name != UTF16toString(vimg.RootPartitionName) || p.Type != "unspecified" ||
+		p.Bootable || p.Start() != testFirstLBA*vimg.SectorSize || p.Size() != fi.Size()-p.Start() {
+		t.Fatalf("gpt partition read incorrectly: %+v", p)
+	}
+
+	if p.Filesystem != "ext2" && p.Filesystem != "ext4" {
+		t.Fatalf("expected an ext file-system, got '%s'", p.Filesystem)
+	}
+
+}
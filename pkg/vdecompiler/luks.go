@@ -0,0 +1,180 @@
+package vdecompiler
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/vorteil/vorteil/pkg/luks"
+	"github.com/vorteil/vorteil/pkg/vimg"
+)
+
+// ErrEncrypted is returned when reading the file-system of an image whose root
+// partition is encrypted, without unlocking it first.
+var ErrEncrypted = errors.New("root partition is encrypted: the image must be unlocked with its passphrase")
+
+type luksInfo struct {
+	volume   *luks.Volume
+	firstLBA int64 // first sector of the encrypted payload
+	lastLBA  int64
+}
+
+// Encrypted returns true if the image's root partition is encrypted with
+// LUKS, whether or not it has been unlocked.
+func (iio *IO) Encrypted() (bool, error) {
+
+	iio.mu.Lock()
+	unlocked := iio.luks.volume != nil
+	iio.mu.Unlock()
+
+	if unlocked {
+		return true, nil
+	}
+
+	entry, err := iio.GPTEntry(UTF16toString(vimg.RootPartitionName))
+	if err != nil {
+		return false, err
+	}
+
+	return luks.IsLUKS(io.NewSectionReader(iio, int64(entry.FirstLBA)*vimg.SectorSize, luks.HeaderSize))
+}
+
+// locked returns true if the image's root partition is encrypted, and hasn't
+// been unlocked.
+func (iio *IO) locked() bool {
+
+	iio.mu.Lock()
+	unlocked := iio.luks.volume != nil
+	iio.mu.Unlock()
+
+	if unlocked {
+		return false
+	}
+
+	encrypted, _ := iio.Encrypted()
+	return encrypted
+}
+
+// Unlock unlocks an image whose root partition is encrypted with LUKS, after
+// which its file-system can be read and written like any other. It must be
+// called before anything is read from the file-system. Once unlocked, the root
+// partition's GPT entry starts after the LUKS header, so the entry must not be
+// written back to the image.
+func (iio *IO) Unlock(passphrase []byte) error {
+
+	entry, err := iio.GPTEntry(UTF16toString(vimg.RootPartitionName))
+	if err != nil {
+		return err
+	}
+
+	iio.mu.Lock()
+	unlocked := iio.luks.volume != nil
+	iio.mu.Unlock()
+
+	if unlocked {
+		return errors.New("image is already unlocked")
+	}
+
+	start := int64(entry.FirstLBA) * vimg.SectorSize
+	size := int64(entry.LastLBA-entry.FirstLBA+1) * vimg.SectorSize
+
+	v, err := luks.Unlock(io.NewSectionReader(iio, start, size), passphrase)
+	if err != nil {
+		return fmt.Errorf("failed to unlock root partition: %w", err)
+	}
+
+	iio.mu.Lock()
+	defer iio.mu.Unlock()
+
+	entry.FirstLBA += uint64(v.PayloadOffset() / vimg.SectorSize)
+	iio.luks = luksInfo{
+		volume:   v,
+		firstLBA: int64(entry.FirstLBA),
+		lastLBA:  int64(entry.LastLBA),
+	}
+	iio.fs = fsInfo{}
+
+	return nil
+}
+
+// crypt encrypts or decrypts the sectors of buf that are part of the
+// encrypted payload, where buf holds whole sectors starting at offset off.
+func (info *luksInfo) crypt(buf []byte, off int64, encrypt bool) {
+
+	lo := info.firstLBA * vimg.SectorSize
+	if off > lo {
+		lo = off
+	}
+
+	hi := (info.lastLBA + 1) * vimg.SectorSize
+	if end := off + int64(len(buf)); end < hi {
+		hi = end
+	}
+
+	if lo >= hi {
+		return
+	}
+
+	data := buf[lo-off : hi-off]
+	sector := uint64(lo/vimg.SectorSize - info.firstLBA)
+	if encrypt {
+		info.volume.EncryptSectors(data, data, sector)
+	} else {
+		info.volume.DecryptSectors(data, data, sector)
+	}
+}
+
+// sectorAligned returns the range of whole sectors covering n bytes from
+// offset off.
+func sectorAligned(off int64, n int) (int64, int) {
+	begin := off / vimg.SectorSize * vimg.SectorSize
+	end := (off + int64(n) + vimg.SectorSize - 1) / vimg.SectorSize * vimg.SectorSize
+	return begin, int(end - begin)
+}
+
+func (iio *IO) readEncryptedAt(p []byte, off int64) (int, error) {
+
+	begin, size := sectorAligned(off, len(p))
+	buf := make([]byte, size)
+
+	n, err := iio.readAt(buf, begin)
+	iio.luks.crypt(buf[:n/vimg.SectorSize*vimg.SectorSize], begin, false)
+
+	k := n - int(off-begin)
+	if k < 0 {
+		k = 0
+	}
+	if k > len(p) {
+		k = len(p)
+	}
+	copy(p, buf[off-begin:int(off-begin)+k])
+
+	return k, err
+}
+
+func (iio *IO) writeEncryptedAt(p []byte, off int64) (int, error) {
+
+	begin, size := sectorAligned(off, len(p))
+	buf := make([]byte, size)
+
+	_, err := iio.readAt(buf, begin)
+	if err != nil {
+		return 0, err
+	}
+
+	iio.luks.crypt(buf, begin, false)
+	copy(buf[off-begin:], p)
+	iio.luks.crypt(buf, begin, true)
+
+	_, err = iio.writeAt(buf, begin)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,158 @@
+package vdecompiler
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vorteil/vorteil/pkg/luks"
+	"github.com/vorteil/vorteil/pkg/vimg"
+)
+
+// encryptTestImage rewrites the root partition of an image made by
+// buildTestImage as a LUKS volume holding the original file-system.
+func encryptTestImage(t *testing.T, path string, passphrase []byte) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read image: %v", err)
+	}
+
+	v, hdr, err := luks.Format(passphrase, &luks.Options{Iterations: 1000})
+	if err != nil {
+		t.Fatalf("failed to format volume: %v", err)
+	}
+
+	fs := data[testFirstLBA*vimg.SectorSize:]
+	v.EncryptSectors(fs, fs, 0)
+
+	out := append(append(data[:testFirstLBA*vimg.SectorSize:testFirstLBA*vimg.SectorSize], hdr...), fs...)
+
+	entryOffset := 2 * vimg.SectorSize
+	entry := new(vimg.GPTEntry)
+	err = binary.Read(bytes.NewReader(out[entryOffset:]), binary.LittleEndian, entry)
+	if err != nil {
+		t.Fatalf("failed to read GPT entry: %v", err)
+	}
+	entry.LastLBA += uint64(len(hdr) / vimg.SectorSize)
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, binary.LittleEndian, entry)
+	copy(out[entryOffset:], buf.Bytes())
+
+	err = ioutil.WriteFile(path, out, 0644)
+	if err != nil {
+		t.Fatalf("failed to write image: %v", err)
+	}
+}
+
+func TestUnlock(t *testing.T) {
+
+	path := buildTestImage(t, 2)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	encryptTestImage(t, path, []byte("passphrase"))
+
+	read := func(iio *IO, fpath string) []byte {
+		ino, err := iio.ResolvePathToInodeNo(fpath)
+		if err != nil {
+			t.Fatalf("failed to resolve %s: %v", fpath, err)
+		}
+		inode, err := iio.ResolveInode(ino)
+		if err != nil {
+			t.Fatalf("failed to resolve inode: %v", err)
+		}
+		r, err := iio.InodeReader(inode)
+		if err != nil {
+			t.Fatalf("failed to get inode reader: %v", err)
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", fpath, err)
+		}
+		return data
+	}
+
+	iio, err := OpenRW(path)
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+
+	encrypted, err := iio.Encrypted()
+	if err != nil || !encrypted {
+		t.Fatalf("expected image to be encrypted: %v", err)
+	}
+
+	_, err = iio.ResolvePathToInodeNo("/sub/f1")
+	if !errors.Is(err, ErrEncrypted) {
+		t.Fatalf("expected reading a locked image to fail with ErrEncrypted, got %v", err)
+	}
+
+	err = iio.Unlock([]byte("wrong"))
+	if !errors.Is(err, luks.ErrWrongPassphrase) {
+		t.Fatalf("expected wrong passphrase error, got %v", err)
+	}
+
+	err = iio.Unlock([]byte("passphrase"))
+	if err != nil {
+		t.Fatalf("failed to unlock image: %v", err)
+	}
+
+	if data := read(iio, "/sub/f1"); !bytes.Equal(data, testFileContents(1)) {
+		t.Fatalf("file read from unlocked image doesn't match")
+	}
+
+	// writes to the unlocked image are encrypted, even when they don't cover
+	// whole sectors
+	ino, err := iio.ResolvePathToInodeNo("/sub/f0")
+	if err != nil {
+		t.Fatalf("failed to resolve file: %v", err)
+	}
+	inode, err := iio.ResolveInode(ino)
+	if err != nil {
+		t.Fatalf("failed to resolve inode: %v", err)
+	}
+	inode.LastAccessTime = 1600000000
+	err = iio.WriteInode(ino, inode)
+	if err != nil {
+		t.Fatalf("failed to write inode: %v", err)
+	}
+
+	iio.Close()
+
+	iio, err = Open(path)
+	if err != nil {
+		t.Fatalf("failed to open image: %v", err)
+	}
+	defer iio.Close()
+
+	err = iio.Unlock([]byte("passphrase"))
+	if err != nil {
+		t.Fatalf("failed to unlock image: %v", err)
+	}
+
+	ino, err = iio.ResolvePathToInodeNo("/sub/f0")
+	if err != nil {
+		t.Fatalf("failed to resolve file: %v", err)
+	}
+	inode, err = iio.ResolveInode(ino)
+	if err != nil {
+		t.Fatalf("failed to resolve inode: %v", err)
+	}
+	if inode.LastAccessTime != 1600000000 {
+		t.Fatalf("written inode wasn't read back: access time is %d", inode.LastAccessTime)
+	}
+
+	if data := read(iio, "/sub/f0"); !bytes.Equal(data, testFileContents(0)) {
+		t.Fatalf("file read after writing to the unlocked image doesn't match")
+	}
+}
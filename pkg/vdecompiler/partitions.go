@@ -0,0 +1,234 @@
+package vdecompiler
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vimg"
+)
+
+// Partition tables a Partition can be found in.
+const (
+	PartitionTableMBR = "mbr"
+	PartitionTableGPT = "gpt"
+)
+
+// Partition describes an entry in one of an image's partition tables.
+type Partition struct {
+	Table      string // PartitionTableMBR or PartitionTableGPT
+	Index      int    // position of the entry within its table
+	Name       string // always empty for MBR partitions
+	Type       string // a description of the partition type, or its code if it isn't recognised
+	FirstLBA   int64
+	LastLBA    int64
+	Bootable   bool
+	Filesystem string // the file-system found in the partition, empty if none was recognised
+}
+
+// Start returns the offset of the partition in bytes.
+func (p *Partition) Start() int64 {
+	return p.FirstLBA * vimg.SectorSize
+}
+
+// Size returns the size of the partition in bytes.
+func (p *Partition) Size() int64 {
+	return (p.LastLBA - p.FirstLBA + 1) * vimg.SectorSize
+}
+
+type mbrPartitionEntry struct {
+	Status       byte
+	_            [3]byte // first CHS address
+	Type         byte
+	_            [3]byte // last CHS address
+	FirstLBA     uint32
+	TotalSectors uint32
+}
+
+var mbrPartitionTypes = map[byte]string{
+	0x07: "NTFS/exFAT",
+	0x0B: "FAT32",
+	0x0C: "FAT32 (LBA)",
+	0x82: "Linux swap",
+	0x83: "Linux",
+	0xEE: "GPT protective",
+	0xEF: "EFI system",
+}
+
+var gptPartitionTypes = map[string]string{
+	"00000000-0000-0000-0000-000000000000": "unspecified",
+	"4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709": "Linux root (x86-64)",
+	"0FC63DAF-8483-4772-8E79-3D69D8477DE4": "Linux filesystem",
+	"0657FD6D-A4AB-43C4-84E5-0933C84B4F4F": "Linux swap",
+	"C12A7328-F81F-11D2-BA4B-00A0C93EC93B": "EFI system",
+	"21686148-6449-6E6F-744E-656564454649": "BIOS boot",
+}
+
+// gptLegacyBootable is the GPT entry attribute marking a partition bootable
+// by legacy BIOSes.
+const gptLegacyBootable = 1 << 2
+
+// guidString formats a GUID as it's stored on disk, where the first three
+// fields are little-endian.
+func guidString(g [16]byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
+		g[8:10], g[10:16])
+}
+
+func (iio *IO) readMBRPartitions() ([]Partition, error) {
+
+	buf := make([]byte, vimg.SectorSize)
+	_, err := iio.ReadAt(buf, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if buf[510] != 0x55 || buf[511] != 0xAA {
+		return nil, nil
+	}
+
+	var entries [4]mbrPartitionEntry
+	err = binary.Read(bytes.NewReader(buf[446:510]), binary.LittleEndian, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Partition
+	for i, e := range entries {
+		if e.Type == 0 || e.TotalSectors == 0 {
+			continue
+		}
+
+		ptype, ok := mbrPartitionTypes[e.Type]
+		if !ok {
+			ptype = fmt.Sprintf("0x%02X", e.Type)
+		}
+
+		list = append(list, Partition{
+			Table:    PartitionTableMBR,
+			Index:    i,
+			Type:     ptype,
+			FirstLBA: int64(e.FirstLBA),
+			LastLBA:  int64(e.FirstLBA) + int64(e.TotalSectors) - 1,
+			Bootable: e.Status&0x80 != 0,
+		})
+	}
+
+	return list, nil
+}
+
+func (iio *IO) readGPTPartitions() ([]Partition, error) {
+
+	entries, err := iio.GPTEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Partition
+	for i, e := range entries {
+		if e.TypeGUID == [16]byte{} && e.PartitionGUID == [16]byte{} && e.FirstLBA == 0 && e.LastLBA == 0 {
+			continue
+		}
+
+		guid := guidString(e.TypeGUID)
+		ptype, ok := gptPartitionTypes[guid]
+		if !ok {
+			ptype = guid
+		}
+
+		list = append(list, Partition{
+			Table:    PartitionTableGPT,
+			Index:    i,
+			Name:     GPTEntryName(e),
+			Type:     ptype,
+			FirstLBA: int64(e.FirstLBA),
+			LastLBA:  int64(e.LastLBA),
+			Bootable: e.Attributes&gptLegacyBootable != 0,
+		})
+	}
+
+	return list, nil
+}
+
+// detectFilesystem returns the file-system found at the start of p, if it's
+// one that can be recognised by its magic number.
+func (iio *IO) detectFilesystem(p *Partition) string {
+
+	buf := make([]byte, 2048)
+	_, err := iio.ReadAt(buf, p.Start())
+	if err != nil {
+		return ""
+	}
+
+	sb := new(ext.Superblock)
+	_ = binary.Read(bytes.NewReader(buf[1024:]), binary.LittleEndian, sb)
+
+	switch {
+	case string(buf[0:4]) == "hsqs":
+		return "squashfs"
+	case sb.Signature == ext.Signature:
+		if sb.RequiredFeatures&ext.IncompatExtents != 0 {
+			return "ext4"
+		}
+		return "ext2"
+	case string(buf[82:87]) == "FAT32":
+		return "fat32"
+	case string(buf[54:59]) == "FAT12" || string(buf[54:59]) == "FAT16":
+		return "fat"
+	case string(buf[3:7]) == "NTFS":
+		return "ntfs"
+	case string(buf[0:4]) == "XFSB":
+		return "xfs"
+	}
+
+	return ""
+}
+
+// Partitions returns the entries of the image's MBR, followed by those of its
+// GPT if it has one, and the file-systems that can be detected in them. The
+// GPT is only read if the MBR has a protective entry for it, or no entries.
+func (iio *IO) Partitions() ([]Partition, error) {
+
+	list, err := iio.readMBRPartitions()
+	if err != nil {
+		return nil, err
+	}
+
+	hasGPT := len(list) == 0
+	for _, p := range list {
+		if p.Type == mbrPartitionTypes[0xEE] {
+			hasGPT = true
+		}
+	}
+
+	if hasGPT {
+		gpt, err := iio.readGPTPartitions()
+		if err != nil && len(list) > 0 {
+			return nil, err
+		}
+		list = append(list, gpt...)
+	}
+
+	if len(list) == 0 {
+		return nil, fmt.Errorf("image has no partition table")
+	}
+
+	for i := range list {
+		p := &list[i]
+		if p.Type == mbrPartitionTypes[0xEE] {
+			continue
+		}
+		p.Filesystem = iio.detectFilesystem(p)
+	}
+
+	return list, nil
+}
@@ -7,6 +7,9 @@ package vdecompiler
 
 import (
 	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 
@@ -28,46 +31,37 @@ type KernelFile struct {
 	ImageOffset int
 }
 
-func (iio *IO) kernelTAROffset() (int64, error) {
+func (iio *IO) kernelTAROffset() (int64, int64, error) {
 
 	partitions, err := iio.GPTEntries()
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
-	return int64((partitions[0].FirstLBA + vimg.KernelConfigSpaceSectors) * vmdk.SectorSize), nil
+	offset := int64((partitions[0].FirstLBA + vimg.KernelConfigSpaceSectors) * vmdk.SectorSize)
+	end := int64((partitions[0].LastLBA + 1) * vmdk.SectorSize)
 
-}
-
-func (iio *IO) seekToKernelTAR() (int64, error) {
-
-	offset, err := iio.kernelTAROffset()
-	if err != nil {
-		return 0, err
-	}
-
-	_, err = iio.img.Seek(offset, io.SeekStart)
-	if err != nil {
-		return 0, err
-	}
-
-	return offset, nil
+	return offset, end - offset, nil
 
 }
 
 // KernelFiles returns a list of every kernel bundle file on the image.
 func (iio *IO) KernelFiles() ([]*KernelFile, error) {
 
-	if iio.vpart.files != nil {
-		return iio.vpart.files, nil
+	iio.mu.Lock()
+	files := iio.vpart.files
+	iio.mu.Unlock()
+
+	if files != nil {
+		return files, nil
 	}
 
-	offset, err := iio.seekToKernelTAR()
+	offset, size, err := iio.kernelTAROffset()
 	if err != nil {
 		return nil, err
 	}
 
-	r := iio.img
+	r := io.NewSectionReader(iio, offset, size)
 	var kfiles = make([]*KernelFile, 0)
 	tr := tar.NewReader(r)
 
@@ -75,8 +69,10 @@ func (iio *IO) KernelFiles() ([]*KernelFile, error) {
 
 		hdr, err := tr.Next()
 		if err == io.EOF {
+			iio.mu.Lock()
 			iio.vpart.files = kfiles
-			return iio.vpart.files, nil
+			iio.mu.Unlock()
+			return kfiles, nil
 		}
 		if err != nil {
 			return nil, err
@@ -117,12 +113,73 @@ func (iio *IO) KernelFile(name string) (io.Reader, error) {
 		return nil, fmt.Errorf("kernel file not found: %s", name)
 	}
 
-	_, err = iio.img.Seek(int64(kfiles[idx].ImageOffset), io.SeekStart)
+	r := io.NewSectionReader(iio, int64(kfiles[idx].ImageOffset), int64(kfiles[idx].Size))
+	return r, nil
+
+}
+
+func (iio *IO) readVCFG() (*vcfg.VCFG, error) {
+
+	entry, err := iio.GPTEntry(UTF16toString(vimg.OSPartitionName))
 	if err != nil {
 		return nil, err
 	}
 
-	r := io.LimitReader(iio.img, int64(kfiles[idx].Size))
-	return r, nil
+	start := int64(entry.FirstLBA) * vimg.SectorSize
+
+	buf := make([]byte, binary.Size(vimg.BootloaderConfig{}))
+	_, err = iio.ReadAt(buf, start)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := new(vimg.BootloaderConfig)
+	err = binary.Read(bytes.NewReader(buf), binary.LittleEndian, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.ConfigLen == 0 || conf.ConfigLen > conf.ConfigCapacity {
+		return nil, fmt.Errorf("bootloader config has an invalid vcfg length: %d", conf.ConfigLen)
+	}
+
+	data := make([]byte, conf.ConfigLen)
+	_, err = iio.ReadAt(data, start+int64(conf.ConfigOffset))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := new(vcfg.VCFG)
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse vcfg: %w", err)
+	}
+
+	return cfg, nil
+
+}
+
+// VCFG returns the VCFG the image was built with, as it is stored for the
+// kernel in the OS partition. It includes any defaults applied at build time.
+func (iio *IO) VCFG() (*vcfg.VCFG, error) {
+
+	iio.mu.Lock()
+	cfg := iio.vpart.vcfg
+	iio.mu.Unlock()
+
+	if cfg != nil {
+		return cfg, nil
+	}
+
+	cfg, err := iio.readVCFG()
+	if err != nil {
+		return nil, err
+	}
+
+	iio.mu.Lock()
+	iio.vpart.vcfg = cfg
+	iio.mu.Unlock()
+
+	return cfg, nil
 
 }
@@ -7,8 +7,12 @@ package vdisk
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"strings"
 
 	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/gcparchive"
@@ -21,10 +25,17 @@ import (
 	"github.com/vorteil/vorteil/pkg/xva"
 )
 
+// ErrNoPrograms is returned when building a package with no programs, unless
+// BuildArgs.AllowNoPrograms is set. Such an image boots, but does nothing.
+var ErrNoPrograms = errors.New("package defines no programs to run")
+
 // KernelOptions contains all kernel configuration settings.
 type KernelOptions struct {
 	Record bool
-	Shell  bool
+
+	// Shell adds a busybox shell environment to the image. It's also added
+	// if the VCFG sets System.RescueShell.
+	Shell bool
 }
 
 // BuildArgs contains all arguments a caller can use to customize the behaviour
@@ -36,6 +47,85 @@ type BuildArgs struct {
 	KernelOptions    KernelOptions
 	Logger           elog.View
 	WithVCFGDefaults bool
+
+	// Strip removes debugging information and symbol tables from every ELF
+	// executable and shared object in the package before it is written to
+	// the disk. Other files are left untouched.
+	Strip bool
+
+	// Sparse writes the image with a vio.SparseWriter, which skips every
+	// region of zeroes instead of writing it and leaves holes in the file.
+	// This is much faster for large images. The output must be an *os.File
+	// for a regular file.
+	Sparse bool
+
+	// Bootloader replaces the built-in boot code in the MBR, if it isn't
+	// nil. It must be at most vimg.BootCodeSize (446) bytes of boot code, or
+	// a whole 512-byte MBR ending in the 0x55AA signature, in which case only
+	// its boot code is used. The partition table is always written by Build.
+	//
+	// The BIOS loads the boot code to 0x7C00 and starts it in real mode with
+	// the boot drive in DL, as usual. To boot the image it must find the GPT
+	// partition named "vorteil-os", which starts with a vimg.BootloaderConfig
+	// giving the Linux arguments and where the VCFG is in the partition, and
+	// has the kernel bundle as a tar archive from vimg.KernelConfigSpaceSectors
+	// sectors in. The kernel must be started with the Linux arguments
+	// unchanged: they find the ext root file-system on the "vorteil-root"
+	// partition by its partition UUID.
+	Bootloader vio.File
+
+	// ReservedBlocksPercent is the percentage of an ext root file-system's
+	// blocks reserved for the superuser, from 0 to 50. The zero value
+	// reserves nothing, which is how images have always been built.
+	ReservedBlocksPercent int
+
+	// AllowNoPrograms builds packages that define no programs, like
+	// data-only disks, instead of returning ErrNoPrograms.
+	AllowNoPrograms bool
+
+	// Encryption encrypts the root partition with LUKS, if it isn't nil. The
+	// image can only be read by vdecompiler once it's unlocked with the same
+	// passphrase, and only boots with a kernel that can unlock it.
+	Encryption *vimg.Encryption
+
+	// Transforms change the contents of the files they match as the
+	// file-system is compiled, in the order they're given. See
+	// vio.ApplyTransforms.
+	Transforms []vio.Transform
+
+	// TempDir is where Build keeps temporary files, like the binaries
+	// spooled by Strip and the compressed contents of a squashfs root. If
+	// empty, the system's default temporary directory is used.
+	TempDir string
+}
+
+// loadBootloader reads the boot code in f, which is either just boot code, or
+// a whole MBR.
+func loadBootloader(f vio.File) ([]byte, error) {
+
+	defer f.Close()
+
+	if f.Size() > vimg.SectorSize {
+		return nil, fmt.Errorf("custom bootloader is %d bytes: it must be at most %d bytes of boot code, or a %d byte MBR", f.Size(), vimg.BootCodeSize, vimg.SectorSize)
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) == vimg.SectorSize {
+		if data[510] != 0x55 || data[511] != 0xAA {
+			return nil, errors.New("custom bootloader is a whole sector, but not an MBR: it has no 0x55AA signature")
+		}
+		data = data[:vimg.BootCodeSize]
+	}
+
+	if len(data) == 0 || len(data) > vimg.BootCodeSize {
+		return nil, fmt.Errorf("custom bootloader is %d bytes: it must be at most %d bytes of boot code, or a %d byte MBR", len(data), vimg.BootCodeSize, vimg.SectorSize)
+	}
+
+	return data, nil
 }
 
 // NegotiateSize prebuilds the minimum amount for a disk.
@@ -50,14 +140,16 @@ func NegotiateSize(ctx context.Context, vimgBuilder *vimg.Builder, cfg *vcfg.VCF
 		size = int64(cfg.VM.DiskSize.Units(vcfg.Byte))
 	}
 
-	alignment := args.SizeAlign
-	if alignment == 0 {
-		alignment = 1
+	size, err := AlignSize(size, args.SizeAlign, args.Format)
+	if err != nil {
+		return err
+	}
+
+	if args.Logger != nil {
+		args.Logger.Infof("Disk size negotiated: %s", vcfg.Bytes(size))
 	}
-	alignment = lcm(args.Format.Alignment(), alignment)
-	size = ((size + alignment - 1) / alignment) * alignment
 
-	err := vimgBuilder.Prebuild(ctx, size)
+	err = vimgBuilder.Prebuild(ctx, size)
 	if err != nil {
 		return err
 	}
@@ -66,6 +158,45 @@ func NegotiateSize(ctx context.Context, vimgBuilder *vimg.Builder, cfg *vcfg.VCF
 
 }
 
+// AlignSize rounds size up to the alignment required by the format. If
+// sizeAlign is non-zero it must be a multiple of the format's alignment, and
+// size is rounded up to a multiple of sizeAlign instead.
+func AlignSize(size, sizeAlign int64, format Format) (int64, error) {
+
+	alignment := format.Alignment()
+	if alignment <= 0 {
+		return 0, fmt.Errorf("disk format '%s' has no known size alignment", format)
+	}
+
+	if sizeAlign < 0 {
+		return 0, fmt.Errorf("invalid size alignment: %d", sizeAlign)
+	}
+
+	if sizeAlign == 0 {
+		sizeAlign = 1
+	} else if sizeAlign%alignment != 0 {
+		return 0, fmt.Errorf("size alignment %s conflicts with the '%s' format, which requires a multiple of %s", vcfg.Bytes(sizeAlign), format, vcfg.Bytes(alignment))
+	}
+	alignment = lcm(alignment, sizeAlign)
+
+	return ((size + alignment - 1) / alignment) * alignment, nil
+}
+
+// greatest common divisor (GCD) via Euclidean algorithm
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		t := b
+		b = a % b
+		a = t
+	}
+	return a
+}
+
+// find Least Common Multiple (LCM) via GCD
+func lcm(a, b int64) int64 {
+	return a * b / gcd(a, b)
+}
+
 // CreateBuilder creates a vimg.Builder with args provided.
 func CreateBuilder(ctx context.Context, args *vimg.BuilderArgs) (*vimg.Builder, error) {
 	vimgBuilder, err := vimg.NewBuilder(ctx, args)
@@ -75,11 +206,40 @@ func CreateBuilder(ctx context.Context, args *vimg.BuilderArgs) (*vimg.Builder,
 	return vimgBuilder, nil
 }
 
-func build(ctx context.Context, w io.WriteSeeker, cfg *vcfg.VCFG, args *BuildArgs) error {
+// build prepares a vimg.Builder for the package in args, negotiates its size,
+// and passes it to write.
+func build(ctx context.Context, cfg *vcfg.VCFG, bootloader []byte, args *BuildArgs, write func(b *vimg.Builder) error) error {
 
 	log := args.Logger
+	tree := args.PackageReader.FS()
+
+	// build secrets are only needed until now, and must never reach the disk
+	for _, path := range vpkg.BuildSecrets(args.PackageReader) {
+		err := tree.Unmap(path)
+		if err != nil && err != vio.ErrNodeNotFound {
+			return err
+		}
+	}
 
-	fsCompiler, err := NewFilesystemCompiler(string(cfg.System.Filesystem), log, args.PackageReader.FS(), nil)
+	if args.Strip {
+		cleanup, err := stripTree(ctx, tree, args.TempDir, log)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+	}
+
+	fsCompiler, err := NewFilesystemCompiler(string(cfg.System.Filesystem), log, tree, fsCompilerArgs(cfg, args))
+	if err != nil {
+		return err
+	}
+
+	// some compilers, like squashfs, keep temporary files until closed
+	if closer, ok := fsCompiler.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	err = addTransforms(fsCompiler, args.Transforms)
 	if err != nil {
 		return err
 	}
@@ -87,11 +247,13 @@ func build(ctx context.Context, w io.WriteSeeker, cfg *vcfg.VCFG, args *BuildArg
 	vimgBuilder, err := CreateBuilder(ctx, &vimg.BuilderArgs{
 		Kernel: vimg.KernelOptions{
 			Record: args.KernelOptions.Record,
-			Shell:  args.KernelOptions.Shell,
+			Shell:  args.KernelOptions.Shell || cfg.System.RescueShell,
 		},
 		FSCompiler: fsCompiler,
 		VCFG:       cfg,
 		Logger:     log,
+		Bootloader: bootloader,
+		Encryption: args.Encryption,
 	})
 	if err != nil {
 		return err
@@ -105,62 +267,157 @@ func build(ctx context.Context, w io.WriteSeeker, cfg *vcfg.VCFG, args *BuildArg
 		return err
 	}
 
-	err = args.Format.Build(ctx, log, w, vimgBuilder, cfg)
-	if err != nil {
-		return err
+	return write(vimgBuilder)
+
+}
+
+type writerOnly struct {
+	io.Writer
+}
+
+// checkOutput makes sure w can be written to in args.Format. Plenty of
+// writers, like an os.File for a pipe, implement io.Seeker but fail when they
+// actually seek. Formats that are written from start to finish are streamed to
+// them anyway; others would fail part way through the build, so an error is
+// returned up front instead.
+func checkOutput(w io.WriteSeeker, format Format) (io.WriteSeeker, error) {
+
+	_, err := w.Seek(0, io.SeekCurrent)
+	if err == nil {
+		return w, nil
 	}
 
-	return nil
+	if !format.Streamable() {
+		return nil, fmt.Errorf("'%s' images can't be written to an output that can't seek, such as a pipe: write to a file, or use a format that can be streamed (%s)", format, strings.Join(StreamableFormatStrings(), ", "))
+	}
 
+	return vio.WriteSeeker(writerOnly{w})
 }
 
-// Build writes a virtual disk image to w using the provided args.
-func Build(ctx context.Context, w io.WriteSeeker, args *BuildArgs) error {
+// sparseOutput wraps w with a vio.SparseWriter, if w is a regular file.
+func sparseOutput(w io.WriteSeeker) (*vio.SparseWriter, error) {
+
+	f, ok := w.(*os.File)
+	if !ok {
+		return nil, errors.New("sparse images can only be written to a file")
+	}
+
+	return vio.NewSparseWriter(f)
+}
+
+// loadBuildConfig loads the VCFG of the package in args, and the custom boot
+// code if there is any, checking that the disk is big enough for the package.
+func loadBuildConfig(args *BuildArgs) (*vcfg.VCFG, []byte, error) {
 
 	vf := args.PackageReader.VCFG()
 	defer vf.Close()
 	cfg, err := vcfg.LoadFile(vf)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	_ = vf.Close()
 
+	if len(cfg.Programs) == 0 && !args.AllowNoPrograms {
+		return nil, nil, ErrNoPrograms
+	}
+
+	err = validateReservedBlocksPercent(args.ReservedBlocksPercent)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	if args.WithVCFGDefaults {
 		args.Logger.Debugf("Using VCFG defaults for omitted fields")
 		err = vcfg.WithDefaults(cfg, args.Logger)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 	}
 
-	err = build(ctx, w, cfg, args)
+	err = validateBuildConfig(cfg, args.AllowNoPrograms)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	return nil
+	// catch a disk that's too small before spending time building it
+	_, err = EstimateSize(args.PackageReader, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var bootloader []byte
+	if args.Bootloader != nil {
+		bootloader, err = loadBootloader(args.Bootloader)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
+	return cfg, bootloader, nil
 }
 
-// greatest common divisor (GCD) via Euclidean algorithm
-func gcd(a, b int64) int64 {
-	for b != 0 {
-		t := b
-		b = a % b
-		a = t
+// validateBuildConfig runs the VCFG's strict validation, ignoring a lack of
+// programs if allowNoPrograms is set. The disk size is left to EstimateSize,
+// which also accounts for the disk's overhead.
+func validateBuildConfig(cfg *vcfg.VCFG, allowNoPrograms bool) error {
+
+	err := cfg.ValidateStrict(0)
+	verrs, ok := err.(vcfg.ValidationError)
+	if !ok || !allowNoPrograms {
+		return err
 	}
-	return a
+
+	var errs vcfg.ValidationError
+	for _, e := range verrs {
+		if e != vcfg.ErrNoPrograms {
+			errs = append(errs, e)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
 }
 
-// find Least Common Multiple (LCM) via GCD
-func lcm(a, b int64, integers ...int64) int64 {
-	result := a * b / gcd(a, b)
+// Build writes a virtual disk image to w using the provided args. If w can't
+// seek, the format must be one that can be streamed (see Format.Streamable).
+func Build(ctx context.Context, w io.WriteSeeker, args *BuildArgs) error {
+
+	var sw *vio.SparseWriter
+	if args.Sparse {
+		var err error
+		sw, err = sparseOutput(w)
+		if err != nil {
+			return err
+		}
+		w = sw
+	}
+
+	w, err := checkOutput(w, args.Format)
+	if err != nil {
+		return err
+	}
+
+	cfg, bootloader, err := loadBuildConfig(args)
+	if err != nil {
+		return err
+	}
+
+	err = build(ctx, cfg, bootloader, args, func(b *vimg.Builder) error {
+		return args.Format.Build(ctx, args.Logger, w, b, cfg)
+	})
+	if err != nil {
+		return err
+	}
 
-	for i := 0; i < len(integers); i++ {
-		result = lcm(result, integers[i])
+	if sw != nil {
+		return sw.Finish()
 	}
 
-	return result
+	return nil
+
 }
 
 func buildRAW(w io.WriteSeeker, b *vimg.Builder, cfg *vcfg.VCFG) (io.WriteSeeker, error) {
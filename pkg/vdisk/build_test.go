@@ -0,0 +1,227 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/vpkg"
+)
+
+func TestAlignSize(t *testing.T) {
+
+	// auto-round to the format's alignment
+	size, err := AlignSize(1, 0, RAWFormat)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0x200000), size)
+
+	size, err = AlignSize(int64(0x200000), 0, RAWFormat)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0x200000), size)
+
+	// explicit alignment that satisfies the format
+	size, err = AlignSize(1, int64(vcfg.GiB), VHDFixedFormat)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(vcfg.GiB), size)
+
+	size, err = AlignSize(int64(5*vcfg.MiB), int64(4*vcfg.MiB), RAWFormat)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8*vcfg.MiB), size)
+
+	// explicit alignment smaller than the format's
+	_, err = AlignSize(1, int64(vcfg.MiB), RAWFormat)
+	assert.EqualError(t, err, "size alignment 1 MiB conflicts with the 'raw' format, which requires a multiple of 2 MiB")
+
+	// explicit alignment that only shares a factor with the format's
+	_, err = AlignSize(1, int64(3*vcfg.MiB), RAWFormat)
+	assert.Error(t, err)
+
+	_, err = AlignSize(1, -1, RAWFormat)
+	assert.Error(t, err)
+
+}
+
+func TestCheckOutput(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "vdisk")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// files can seek, so anything goes
+	w, err := checkOutput(f, VMDKSparseFormat)
+	assert.NoError(t, err)
+	assert.Equal(t, io.WriteSeeker(f), w)
+
+	r, pw, err := os.Pipe()
+	assert.NoError(t, err)
+	defer r.Close()
+	defer pw.Close()
+
+	_, err = checkOutput(pw, VMDKSparseFormat)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), string(VMDKSparseFormat))
+
+	_, err = checkOutput(pw, VHDFixedFormat)
+	assert.Error(t, err)
+
+	// streamable formats can skip forwards by writing zeroes
+	w, err = checkOutput(pw, RAWFormat)
+	assert.NoError(t, err)
+
+	go func() {
+		_, _ = w.Write([]byte{1})
+		_, _ = w.Seek(4, io.SeekStart)
+		_, _ = w.Write([]byte{2})
+		pw.Close()
+	}()
+
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 0, 0, 0, 2}, data)
+
+}
+
+func TestSparseOutput(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "vdisk")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = sparseOutput(f)
+	assert.NoError(t, err)
+
+	r, pw, err := os.Pipe()
+	assert.NoError(t, err)
+	defer r.Close()
+	defer pw.Close()
+
+	_, err = sparseOutput(pw)
+	assert.Error(t, err)
+
+	ws, err := vio.WriteSeeker(f)
+	assert.NoError(t, err)
+
+	_, err = sparseOutput(ws)
+	assert.Error(t, err)
+
+}
+
+func TestLoadBootloader(t *testing.T) {
+
+	file := func(data []byte) vio.File {
+		return vio.CustomFile(vio.CustomFileArgs{
+			Size:       len(data),
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+		})
+	}
+
+	code := bytes.Repeat([]byte{0xEB}, 100)
+	data, err := loadBootloader(file(code))
+	assert.NoError(t, err)
+	assert.Equal(t, code, data)
+
+	mbr := make([]byte, vimg.SectorSize)
+	copy(mbr, code)
+	mbr[510], mbr[511] = 0x55, 0xAA
+	data, err = loadBootloader(file(mbr))
+	assert.NoError(t, err)
+	assert.Len(t, data, vimg.BootCodeSize)
+	assert.Equal(t, code, data[:len(code)])
+
+	mbr[511] = 0
+	_, err = loadBootloader(file(mbr))
+	assert.Error(t, err)
+
+	for _, size := range []int{0, vimg.BootCodeSize + 1, vimg.SectorSize + 1} {
+		_, err = loadBootloader(file(make([]byte, size)))
+		assert.Error(t, err, size)
+	}
+
+}
+
+func TestLoadBuildConfigNoPrograms(t *testing.T) {
+
+	reader := func(data string) vpkg.Reader {
+		b := vpkg.NewBuilder()
+		assert.NoError(t, b.SetVCFG(vio.CustomFile(vio.CustomFileArgs{
+			Name:       "default.vcfg",
+			Size:       len(data),
+			ModTime:    time.Unix(0, 0),
+			ReadCloser: ioutil.NopCloser(strings.NewReader(data)),
+		})))
+		rdr, err := vpkg.ReaderFromBuilder(b)
+		assert.NoError(t, err)
+		return rdr
+	}
+
+	_, _, err := loadBuildConfig(&BuildArgs{PackageReader: reader("[vm]\n  disk-size = \"+8 MiB\"\n")})
+	assert.Equal(t, ErrNoPrograms, err)
+
+	cfg, _, err := loadBuildConfig(&BuildArgs{PackageReader: reader("[vm]\n  disk-size = \"+8 MiB\"\n"), AllowNoPrograms: true})
+	assert.NoError(t, err)
+	assert.Len(t, cfg.Programs, 0)
+
+	cfg, _, err = loadBuildConfig(&BuildArgs{PackageReader: reader("[[program]]\n  binary = \"/app\"\n")})
+	assert.NoError(t, err)
+	assert.Len(t, cfg.Programs, 1)
+
+}
+
+func TestLoadBuildConfigValidates(t *testing.T) {
+
+	data := "[[program]]\n  binary = \"/app\"\n[[network]]\n  ip = \"10.0.0.2\"\n  mask = \"255.255.255.0\"\n"
+	b := vpkg.NewBuilder()
+	assert.NoError(t, b.SetVCFG(vio.CustomFile(vio.CustomFileArgs{
+		Name:       "default.vcfg",
+		Size:       len(data),
+		ModTime:    time.Unix(0, 0),
+		ReadCloser: ioutil.NopCloser(strings.NewReader(data)),
+	})))
+	rdr, err := vpkg.ReaderFromBuilder(b)
+	assert.NoError(t, err)
+
+	_, _, err = loadBuildConfig(&BuildArgs{PackageReader: rdr})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no gateway")
+
+}
+
+func TestValidateBuildConfig(t *testing.T) {
+
+	cfg := &vcfg.VCFG{VM: vcfg.VMSettings{RAM: 128 * vcfg.MiB}}
+	assert.Error(t, validateBuildConfig(cfg, false))
+	assert.NoError(t, validateBuildConfig(cfg, true))
+
+	cfg.VM.RAM = 32 * vcfg.MiB
+	err := validateBuildConfig(cfg, true)
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), vcfg.ErrNoPrograms.Error())
+
+}
+
+func TestValidateReservedBlocksPercent(t *testing.T) {
+
+	for _, p := range []int{0, 5, 50} {
+		assert.NoError(t, validateReservedBlocksPercent(p), p)
+	}
+
+	for _, p := range []int{-1, 51, 100} {
+		assert.Error(t, validateReservedBlocksPercent(p), p)
+	}
+
+}
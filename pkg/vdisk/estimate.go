@@ -0,0 +1,90 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"fmt"
+
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/vpkg"
+)
+
+// estimateOverhead is the space on every disk taken by things other than the
+// root file-system, leaving out the kernel: the primary and secondary GPT,
+// and the bootloader config and reserved sectors of the OS partition.
+const estimateOverhead = (vimg.P0FirstLBA + vimg.GPTEntriesSectors + 1 +
+	vimg.KernelConfigSpaceSectors + vimg.OSReservedSectors) * vimg.SectorSize
+
+// estimateContents returns the least space the files in tree can take on a
+// root file-system of type fs. On ext that's each file rounded up to whole
+// blocks, and an inode each. Squashfs packs file contents together without
+// compressing them, so it's just their sizes.
+func estimateContents(tree vio.FileTree, fs vcfg.Filesystem) (int64, error) {
+
+	var size int64
+
+	err := tree.Walk(func(path string, f vio.File) error {
+		if fs == vcfg.SquashFS {
+			if !f.IsDir() && !f.IsSymlink() {
+				size += int64(f.Size())
+			}
+			return nil
+		}
+
+		size += ext.InodeSize
+		switch {
+		case f.IsDir():
+			size += ext.BlockSize
+		case f.IsSymlink():
+		default:
+			size += (int64(f.Size()) + ext.BlockSize - 1) / ext.BlockSize * ext.BlockSize
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// EstimateSize returns an estimate of the size of the disk Build would write
+// for the package r configured by cfg, using only the sizes of the files in
+// the package's file-system. It's meant to be called before a build to catch
+// a disk that is too small early, and to plan for the space a disk will need.
+//
+// What the disk must hold is estimated from below: the files and an inode
+// each, plus the partition table and OS partition, but not the kernel or the
+// rest of the file-system's metadata. If cfg sets an absolute disk size
+// smaller than the estimate, an error giving the shortfall is returned.
+// Otherwise the result is the absolute disk size, or the estimate plus the
+// relative disk size.
+func EstimateSize(r vpkg.Reader, cfg *vcfg.VCFG) (int64, error) {
+
+	need := int64(estimateOverhead)
+
+	contents, err := estimateContents(r.FS(), cfg.System.Filesystem)
+	if err != nil {
+		return 0, err
+	}
+	need += contents
+
+	if cfg.VM.DiskSize.IsDelta() {
+		return need + int64(cfg.VM.DiskSize.Units(vcfg.Byte)), nil
+	}
+
+	size := int64(cfg.VM.DiskSize.Units(vcfg.Byte))
+	if size < need {
+		shortfall := vcfg.Bytes(need - size)
+		shortfall.Align(vcfg.MiB)
+		return 0, fmt.Errorf("specified disk size %s is too small for the package: it needs at least %s more", cfg.VM.DiskSize, shortfall)
+	}
+
+	return size, nil
+}
@@ -0,0 +1,73 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/vpkg"
+)
+
+func TestEstimateSize(t *testing.T) {
+
+	reader := func() vpkg.Reader {
+		b := vpkg.NewBuilder()
+		data := "[[program]]\n  binary = \"/app\"\n"
+		assert.NoError(t, b.SetVCFG(vio.CustomFile(vio.CustomFileArgs{
+			Name:       "default.vcfg",
+			Size:       len(data),
+			ModTime:    time.Unix(0, 0),
+			ReadCloser: ioutil.NopCloser(strings.NewReader(data)),
+		})))
+		assert.NoError(t, b.AddToFS("/app", vio.CustomFile(vio.CustomFileArgs{
+			Name:       "app",
+			Size:       int(8 * vcfg.MiB),
+			ModTime:    time.Unix(0, 0),
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(make([]byte, 8*vcfg.MiB))),
+		})))
+		rdr, err := vpkg.ReaderFromBuilder(b)
+		assert.NoError(t, err)
+		return rdr
+	}
+
+	// the root directory and the file
+	need := int64(estimateOverhead + 2*ext.InodeSize + ext.BlockSize + 8*vcfg.MiB)
+
+	cfg := new(vcfg.VCFG)
+	cfg.VM.DiskSize = 4 * vcfg.MiB
+	_, err := EstimateSize(reader(), cfg)
+	assert.Error(t, err)
+
+	cfg.VM.DiskSize = 16 * vcfg.MiB
+	size, err := EstimateSize(reader(), cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(16*vcfg.MiB), size)
+
+	cfg.VM.DiskSize = -4 * vcfg.MiB
+	size, err = EstimateSize(reader(), cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, need+int64(4*vcfg.MiB), size)
+
+	// squashfs stores files uncompressed, but without inode tables or
+	// rounding to blocks
+	cfg.System.Filesystem = vcfg.SquashFS
+	size, err = EstimateSize(reader(), cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(estimateOverhead+8*vcfg.MiB+4*vcfg.MiB), size)
+
+	cfg.VM.DiskSize = 4 * vcfg.MiB
+	_, err = EstimateSize(reader(), cfg)
+	assert.Error(t, err)
+
+}
@@ -92,6 +92,17 @@ var (
 		VHDDynamicFormat:          1500,
 	}
 
+	// streamable formats are written from start to finish without seeking
+	// backwards, so they can be written to outputs that can't seek, like
+	// pipes. Formats registered with RegisterNewDiskFormat are assumed to
+	// need seeking.
+	streamable = map[Format]bool{
+		RAWFormat:                 true,
+		VMDKStreamOptimizedFormat: true,
+		GCPFArchiveFormat:         true,
+		XVAFormat:                 true,
+	}
+
 	buildFuncs = map[Format]BuildWriterInstantiator{
 		RAWFormat:                 buildRAW,
 		VMDKFormat:                buildSparseVMDK,
@@ -160,6 +171,17 @@ func (x *Format) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// StreamableFormatStrings returns a list of the disk image formats that can be
+// written to an output that can't seek.
+func StreamableFormatStrings() []string {
+	var strs []string
+	for k := range streamable {
+		strs = append(strs, k.String())
+	}
+	sort.Strings(strs)
+	return strs
+}
+
 // ParseFormat resolves a string into a Format.
 func ParseFormat(s string) (Format, error) {
 
@@ -180,6 +202,54 @@ func ParseFormat(s string) (Format, error) {
 	return f, nil
 }
 
+// FormatFromExtension returns the format a file called name should hold,
+// going by its extension. It's the reverse of Suffix. Where several formats
+// share an extension, like the VMDK formats, the one named after the
+// extension is chosen. It returns an error if the extension is unknown, or
+// is shared by formats and none of them is named after it.
+func FormatFromExtension(name string) (Format, error) {
+	return formatFromExtension(formats, name)
+}
+
+// formatFromExtension does the work of FormatFromExtension, choosing from the
+// suffixes of the formats in suffixes.
+func formatFromExtension(suffixes map[Format]string, name string) (Format, error) {
+
+	lower := strings.ToLower(name)
+
+	var matches []Format
+	var suffix string
+	for f, s := range suffixes {
+		if s == "" || !strings.HasSuffix(lower, s) || len(s) < len(suffix) {
+			continue
+		}
+		// the longest match wins, so '.tar.gz' isn't mistaken for '.gz'
+		if len(s) > len(suffix) {
+			matches = nil
+			suffix = s
+		}
+		matches = append(matches, f)
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("unrecognized disk image file extension in '%s'", name)
+	case 1:
+		return matches[0], nil
+	}
+
+	names := make([]string, len(matches))
+	for i, f := range matches {
+		if f == Format(strings.TrimPrefix(suffix, ".")) {
+			return f, nil
+		}
+		names[i] = f.String()
+	}
+	sort.Strings(names)
+
+	return "", fmt.Errorf("file extension '%s' in '%s' is ambiguous: it could be %s", suffix, name, strings.Join(names, ", "))
+}
+
 // Suffix returns an appropriate file extension for files containing the format.
 func (x *Format) Suffix() string {
 	return formats[*x]
@@ -191,6 +261,12 @@ func (x *Format) Alignment() int64 {
 	return alignments[*x]
 }
 
+// Streamable returns true if the format can be written to an output that
+// can't seek, such as a pipe.
+func (x *Format) Streamable() bool {
+	return streamable[*x]
+}
+
 // DefaultMTU returns the default MTU setting for the image format.
 func (x *Format) DefaultMTU() uint {
 	return defaultMTUs[*x]
@@ -0,0 +1,57 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatFromExtension(t *testing.T) {
+
+	for name, expect := range map[string]Format{
+		"app.raw":         RAWFormat,
+		"out/app.vmdk":    VMDKFormat,
+		"APP.VHD":         VHDFormat,
+		"app.xva":         XVAFormat,
+		"app.v1.tar.gz":   GCPFArchiveFormat,
+		"/tmp/app.x.vmdk": VMDKFormat,
+	} {
+		format, err := FormatFromExtension(name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, expect, format, name)
+	}
+
+	for _, name := range []string{"app", "app.img", "app.gz", "app.vmdk.bak"} {
+		_, err := FormatFromExtension(name)
+		assert.Error(t, err, name)
+	}
+
+	// every format's own suffix leads back to it, or to the format named
+	// after the suffix
+	for _, s := range AllFormatStrings() {
+		f := Format(s)
+		format, err := FormatFromExtension("app" + f.Suffix())
+		assert.NoError(t, err, s)
+		assert.Equal(t, f.Suffix(), format.Suffix(), s)
+	}
+
+	// formats sharing an extension with none named after it are ambiguous
+	suffixes := map[Format]string{
+		RAWFormat:         ".raw",
+		Format("qcow2-a"): ".qcow2",
+		Format("qcow2-b"): ".qcow2",
+	}
+
+	_, err := formatFromExtension(suffixes, "app.qcow2")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "qcow2-a, qcow2-b")
+
+	format, err := formatFromExtension(suffixes, "app.raw")
+	assert.NoError(t, err)
+	assert.Equal(t, RAWFormat, format)
+}
@@ -7,10 +7,13 @@ package vdisk
 
 import (
 	"fmt"
+	"io"
 	"sort"
 
 	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/squashfs"
+	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vimg"
 	"github.com/vorteil/vorteil/pkg/vio"
 )
@@ -21,28 +24,115 @@ func init() {
 		return
 	}
 
-	fn := func(log elog.Logger, tree vio.FileTree, args interface{}) (vimg.FSCompiler, error) {
-		return ext.NewCompiler(&ext.CompilerArgs{
-			Logger:   log,
-			FileTree: tree,
-		}), nil
+	extCompiler := func(format ext.Format) FSCompilerInstantiator {
+		return func(log elog.Logger, tree vio.FileTree, args interface{}) (vimg.FSCompiler, error) {
+			var reserved int
+			if x, ok := args.(*ExtCompilerArgs); ok && x != nil {
+				reserved = x.ReservedBlocksPercent
+			}
+			return ext.NewCompiler(&ext.CompilerArgs{
+				Logger:                log,
+				FileTree:              tree,
+				Format:                format,
+				ReservedBlocksPercent: reserved,
+			}), nil
+		}
 	}
 
-	err := RegisterFilesystemCompiler("", fn)
+	err := RegisterFilesystemCompiler("", extCompiler(ext.FormatAuto))
 	if err != nil {
 		panic(err)
 	}
 
-	err = RegisterFilesystemCompiler("ext", fn)
+	err = RegisterFilesystemCompiler("ext", extCompiler(ext.FormatAuto))
 	if err != nil {
 		panic(err)
 	}
 
-	err = RegisterFilesystemCompiler("ext2", fn)
+	err = RegisterFilesystemCompiler(string(vcfg.Ext2FS), extCompiler(ext.FormatExt2))
 	if err != nil {
 		panic(err)
 	}
 
+	err = RegisterFilesystemCompiler(string(vcfg.Ext4FS), extCompiler(ext.FormatExt4))
+	if err != nil {
+		panic(err)
+	}
+
+	err = RegisterFilesystemCompiler(string(vcfg.SquashFS), func(log elog.Logger, tree vio.FileTree, args interface{}) (vimg.FSCompiler, error) {
+		var tmp string
+		if x, ok := args.(*SquashfsCompilerArgs); ok && x != nil {
+			tmp = x.TempDir
+		}
+		return squashfs.NewCompiler(&squashfs.CompilerArgs{
+			Logger:   log,
+			FileTree: tree,
+			TempDir:  tmp,
+		}), nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+}
+
+// ExtCompilerArgs holds the uncommon arguments understood by the ext
+// file-system compilers, passed to their FSCompilerInstantiator as 'args'.
+type ExtCompilerArgs struct {
+	ReservedBlocksPercent int
+}
+
+// SquashfsCompilerArgs holds the uncommon arguments understood by the squashfs
+// file-system compiler, passed to its FSCompilerInstantiator as 'args'.
+type SquashfsCompilerArgs struct {
+	TempDir string
+}
+
+// fsCompilerArgs returns the uncommon arguments for the file-system compiler
+// named in cfg.
+func fsCompilerArgs(cfg *vcfg.VCFG, args *BuildArgs) interface{} {
+	if cfg.System.Filesystem == vcfg.SquashFS {
+		return &SquashfsCompilerArgs{
+			TempDir: args.TempDir,
+		}
+	}
+	return &ExtCompilerArgs{
+		ReservedBlocksPercent: args.ReservedBlocksPercent,
+	}
+}
+
+// validateReservedBlocksPercent checks that p is a percentage of blocks the
+// ext compilers can reserve.
+func validateReservedBlocksPercent(p int) error {
+	if p < 0 || p > ext.MaxReservedBlocksPercent {
+		return fmt.Errorf("reserved blocks percentage %d is out of range (should be 0 to %d)", p, ext.MaxReservedBlocksPercent)
+	}
+	return nil
+}
+
+// transformer is implemented by file-system compilers that can change the
+// contents of files as they're committed, like the ext and squashfs compilers.
+type transformer interface {
+	AddTransform(matcher func(path string) bool, transform func(io.Reader) (io.Reader, error))
+}
+
+// addTransforms adds transforms to c, in order.
+func addTransforms(c vimg.FSCompiler, transforms []vio.Transform) error {
+
+	if len(transforms) == 0 {
+		return nil
+	}
+
+	tc, ok := c.(transformer)
+	if !ok {
+		return fmt.Errorf("file-system compiler %T doesn't support transforms", c)
+	}
+
+	for _, t := range transforms {
+		tc.AddTransform(t.Match, t.Apply)
+	}
+
+	return nil
 }
 
 // FSCompilerInstantiator is a function that returns a new file-system compiler
@@ -0,0 +1,217 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// FormatSize is the size of an image built in a particular format.
+type FormatSize struct {
+	Format Format
+	Size   int64
+}
+
+// MeasureFormats builds the package in args once, as a raw image written to
+// scratch, and reports how big the image would be in each of formats by
+// converting the raw image to each one in turn, without keeping the results.
+// Every format is measured at the same disk size, aligned to suit all of
+// them, so including a format with a large alignment (like gcp) can make the
+// others bigger than they would be on their own. args.Format and args.Sparse
+// are ignored.
+func MeasureFormats(ctx context.Context, scratch *os.File, args *BuildArgs, formats []Format) ([]FormatSize, error) {
+
+	if len(formats) == 0 {
+		return nil, errors.New("no formats to measure")
+	}
+
+	shared := *args
+	var err error
+	shared.Format, err = sharedFormat(formats)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, bootloader, err := loadBuildConfig(&shared)
+	if err != nil {
+		return nil, err
+	}
+
+	var sizes []FormatSize
+
+	err = build(ctx, cfg, bootloader, &shared, func(b *vimg.Builder) error {
+
+		sw, err := vio.NewSparseWriter(scratch)
+		if err != nil {
+			return err
+		}
+
+		err = b.Build(ctx, sw)
+		if err != nil {
+			return err
+		}
+
+		err = sw.Finish()
+		if err != nil {
+			return err
+		}
+
+		for _, format := range formats {
+			size, err := measureFormat(ctx, scratch, format, b, cfg)
+			if err != nil {
+				return fmt.Errorf("failed to measure %s image: %w", format, err)
+			}
+			sizes = append(sizes, FormatSize{Format: format, Size: size})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sizes, nil
+}
+
+// sharedFormat returns the format among formats with the largest alignment,
+// which is the one to build an image in for it to suit all of them.
+func sharedFormat(formats []Format) (Format, error) {
+
+	shared := formats[0]
+	for _, format := range formats {
+		if _, ok := buildFuncs[format]; !ok {
+			return shared, fmt.Errorf("unrecognized virtual disk format '%s'", format)
+		}
+		if format.Alignment() > shared.Alignment() {
+			shared = format
+		}
+	}
+
+	return shared, nil
+}
+
+// measureFormat converts the raw image in r to format, returning the number of
+// bytes the converted image takes.
+func measureFormat(ctx context.Context, r io.ReaderAt, format Format, b *vimg.Builder, cfg *vcfg.VCFG) (int64, error) {
+
+	counter := new(sizeCounter)
+
+	err := convertFormat(ctx, r, counter, format, b, cfg)
+	if err != nil {
+		return 0, err
+	}
+
+	return counter.size, nil
+}
+
+// convertFormat converts the raw image in r to format, writing it to ws. Like
+// Builder.Build, it skips the regions b reports as holes, which the format
+// writers depend on.
+func convertFormat(ctx context.Context, r io.ReaderAt, ws io.WriteSeeker, format Format, b *vimg.Builder, cfg *vcfg.VCFG) error {
+
+	w, err := buildFuncs[format](ws, b, cfg)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 0x10000)
+	size := b.Size()
+	skipped := false
+
+	for off := int64(0); off < size; off += int64(len(buf)) {
+
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		n := int64(len(buf))
+		if size-off < n {
+			n = size - off
+		}
+
+		if b.RegionIsHole(off, n) {
+			skipped = true
+			continue
+		}
+
+		// seek lazily, so a trailing hole never needs a seek to the very end
+		if skipped {
+			_, err = w.Seek(off, io.SeekStart)
+			if err != nil {
+				return err
+			}
+			skipped = false
+		}
+
+		_, err = r.ReadAt(buf[:n], off)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(buf[:n])
+		if err != nil {
+			return err
+		}
+	}
+
+	if closer, ok := w.(io.Closer); ok {
+		err = closer.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sizeCounter is an io.WriteSeeker that discards everything written to it,
+// keeping track of how big a file it would have made.
+type sizeCounter struct {
+	off  int64
+	size int64
+}
+
+func (c *sizeCounter) Write(p []byte) (int, error) {
+	c.off += int64(len(p))
+	if c.off > c.size {
+		c.size = c.off
+	}
+	return len(p), nil
+}
+
+func (c *sizeCounter) Seek(offset int64, whence int) (int64, error) {
+
+	var k int64
+
+	switch whence {
+	case io.SeekStart:
+		k = offset
+	case io.SeekCurrent:
+		k = c.off + offset
+	case io.SeekEnd:
+		k = c.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if k < 0 {
+		return 0, errors.New("cannot seek before the start of the file")
+	}
+
+	// like a file, seeking past the end doesn't grow it until it's written
+	c.off = k
+
+	return k, nil
+}
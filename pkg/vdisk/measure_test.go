@@ -0,0 +1,66 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSizeCounter(t *testing.T) {
+
+	c := new(sizeCounter)
+
+	_, err := c.Write(make([]byte, 100))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), c.size)
+
+	// seeking past the end doesn't count until something is written there
+	k, err := c.Seek(1000, io.SeekStart)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), k)
+	assert.Equal(t, int64(100), c.size)
+
+	_, err = c.Write(make([]byte, 24))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1024), c.size)
+
+	// rewriting earlier data doesn't grow it
+	_, err = c.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	_, err = c.Write(make([]byte, 512))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1024), c.size)
+
+	k, err = c.Seek(-24, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), k)
+
+	_, err = c.Seek(-1, io.SeekStart)
+	assert.Error(t, err)
+}
+
+func TestMeasureFormatsArgs(t *testing.T) {
+
+	_, err := MeasureFormats(context.Background(), nil, &BuildArgs{}, nil)
+	assert.Error(t, err)
+
+	_, err = MeasureFormats(context.Background(), nil, &BuildArgs{}, []Format{RAWFormat, Format("qcow2")})
+	assert.Error(t, err)
+}
+
+func TestCheckOutputFormats(t *testing.T) {
+
+	assert.Error(t, CheckOutputFormats(nil))
+	assert.NoError(t, CheckOutputFormats([]Format{RAWFormat, VMDKFormat, XVAFormat}))
+	assert.Error(t, CheckOutputFormats([]Format{RAWFormat, Format("qcow2")}))
+
+	// gcp images default to a smaller MTU, which is built into the image
+	assert.Error(t, CheckOutputFormats([]Format{RAWFormat, GCPFArchiveFormat}))
+}
@@ -0,0 +1,85 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/ext"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// FilesystemArgs contains all arguments a caller can use to customize the
+// behaviour of the BuildFilesystem function.
+type FilesystemArgs struct {
+	FileTree vio.FileTree
+	Logger   elog.View
+
+	// Size of the file-system image. If zero, the image is made as small as
+	// possible while still containing every file in FileTree.
+	Size vcfg.Bytes
+
+	// ReservedBlocksPercent is the percentage of blocks reserved for the
+	// superuser, from 0 to 50. The zero value reserves nothing.
+	ReservedBlocksPercent int
+}
+
+// BuildFilesystem writes a bare ext file-system image containing the files in
+// args.FileTree to w, and returns its size in bytes. Unlike Build there is no
+// partition table, bootloader, kernel or VCFG, which makes the image suitable
+// for use as a data disk. The permission bits of files are kept wherever the
+// tree knows them.
+func BuildFilesystem(ctx context.Context, w io.WriteSeeker, args *FilesystemArgs) (int64, error) {
+
+	err := validateReservedBlocksPercent(args.ReservedBlocksPercent)
+	if err != nil {
+		return 0, err
+	}
+
+	fs := ext.NewCompiler(&ext.CompilerArgs{
+		FileTree:              args.FileTree,
+		Logger:                args.Logger,
+		PreserveModes:         true,
+		Format:                ext.FormatExt2,
+		ReservedBlocksPercent: args.ReservedBlocksPercent,
+	})
+	fs.SetMinimumInodesPer64MiB(1024)
+
+	err = fs.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	size := fs.MinimumSize()
+	if args.Size != 0 {
+		if size > int64(args.Size) {
+			return 0, fmt.Errorf("specified size %s insufficient to contain file-system contents: need at least %s", args.Size, vcfg.Bytes(size))
+		}
+		size = int64(args.Size)
+	}
+	size = size / ext.BlockSize * ext.BlockSize
+
+	err = fs.Precompile(ctx, size)
+	if err != nil {
+		return 0, err
+	}
+
+	ws, err := vio.WriteSeeker(w)
+	if err != nil {
+		return 0, err
+	}
+
+	err = fs.Compile(ctx, ws)
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
@@ -0,0 +1,126 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/vorteil/vorteil/pkg/vimg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// Output is one of the images written by BuildOutputs.
+type Output struct {
+	Format Format
+	W      io.WriteSeeker
+}
+
+// CheckOutputFormats returns an error if images in formats can't all be
+// written by a single call to BuildOutputs. Every format has to be known, and
+// they all have to share a default MTU, because it's built into the image.
+func CheckOutputFormats(formats []Format) error {
+
+	if len(formats) == 0 {
+		return errors.New("no formats to build")
+	}
+
+	_, err := sharedFormat(formats)
+	if err != nil {
+		return err
+	}
+
+	for _, format := range formats[1:] {
+		if format.DefaultMTU() != formats[0].DefaultMTU() {
+			return fmt.Errorf("'%s' and '%s' images can't be built together, because their default MTUs differ", formats[0], format)
+		}
+	}
+
+	return nil
+}
+
+// BuildOutputs builds the package in args once, as a raw image written to
+// scratch, and then converts it to each of outputs in turn. This saves
+// compiling the file-system again for every format. Every image is built at
+// the same disk size, aligned to suit all of the formats. args.Format is
+// ignored, and args.Sparse applies to every output.
+func BuildOutputs(ctx context.Context, scratch *os.File, args *BuildArgs, outputs []Output) error {
+
+	formats := make([]Format, len(outputs))
+	for i, o := range outputs {
+		formats[i] = o.Format
+	}
+
+	err := CheckOutputFormats(formats)
+	if err != nil {
+		return err
+	}
+
+	writers := make([]io.WriteSeeker, len(outputs))
+	sparse := make([]*vio.SparseWriter, len(outputs))
+	for i, o := range outputs {
+		w := o.W
+		if args.Sparse {
+			sparse[i], err = sparseOutput(w)
+			if err != nil {
+				return err
+			}
+			w = sparse[i]
+		}
+		writers[i], err = checkOutput(w, o.Format)
+		if err != nil {
+			return err
+		}
+	}
+
+	shared := *args
+	shared.Format, err = sharedFormat(formats)
+	if err != nil {
+		return err
+	}
+
+	cfg, bootloader, err := loadBuildConfig(&shared)
+	if err != nil {
+		return err
+	}
+
+	return build(ctx, cfg, bootloader, &shared, func(b *vimg.Builder) error {
+
+		sw, err := vio.NewSparseWriter(scratch)
+		if err != nil {
+			return err
+		}
+
+		err = b.Build(ctx, sw)
+		if err != nil {
+			return err
+		}
+
+		err = sw.Finish()
+		if err != nil {
+			return err
+		}
+
+		for i, o := range outputs {
+
+			p := args.Logger.NewProgress(fmt.Sprintf("Writing %s image", o.Format), "", 0)
+
+			err = convertFormat(ctx, scratch, writers[i], o.Format, b, cfg)
+			if err == nil && sparse[i] != nil {
+				err = sparse[i].Finish()
+			}
+			p.Finish(err == nil)
+			if err != nil {
+				return fmt.Errorf("failed to write %s image: %w", o.Format, err)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,143 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/vorteil/vorteil/pkg/elfstrip"
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// spooledFile returns a vio.File with the name, modification time, and
+// permissions of f, but with its contents read from the file at path.
+func spooledFile(path string, f vio.File, size int64) vio.File {
+
+	var sf *os.File
+
+	mode, _ := vio.FileMode(f)
+
+	return vio.CustomFile(vio.CustomFileArgs{
+		Name:    f.Name(),
+		Size:    int(size),
+		ModTime: f.ModTime(),
+		Mode:    mode,
+		ReadCloser: vio.LazyReadCloser(func() (io.Reader, error) {
+			var err error
+			sf, err = os.Open(path)
+			return sf, err
+		}, func() error {
+			if sf == nil {
+				return nil
+			}
+			return sf.Close()
+		}),
+	})
+}
+
+// stripCandidate returns true if f could be an ELF executable or shared
+// object: it has an execute bit set, is named like a shared object, or its
+// permissions aren't known.
+func stripCandidate(f vio.File) bool {
+
+	mode, ok := vio.FileMode(f)
+	if !ok || mode&0111 != 0 {
+		return true
+	}
+
+	name := f.Name()
+	return strings.HasSuffix(name, ".so") || strings.Contains(name, ".so.")
+}
+
+// stripTree replaces every ELF executable and shared object in tree with a
+// copy that has its debugging information and symbol tables removed. Only
+// files that pass stripCandidate are read to check for the ELF magic number.
+// Package file trees can only be read once and in order, so every file that
+// has been read is spooled into a temporary directory in tmp, which the
+// returned cleanup function removes once the build has finished.
+func stripTree(ctx context.Context, tree vio.FileTree, tmp string, log elog.View) (func(), error) {
+
+	dir, err := ioutil.TempDir(tmp, "vorteil-strip-")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(dir) }
+
+	var count, spooled int
+	var saved int64
+
+	err = tree.WalkNode(func(path string, n *vio.TreeNode) error {
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		f := n.File
+		if f.IsDir() || f.IsSymlink() || f.Size() == 0 || !stripCandidate(f) {
+			return nil
+		}
+		defer f.Close()
+
+		magic := make([]byte, 4)
+		k, err := io.ReadFull(f, magic)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		magic = magic[:k]
+		r := io.MultiReader(bytes.NewReader(magic), f)
+
+		if elfstrip.IsELF(magic) {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			stripped, err := elfstrip.Strip(data)
+			if err != nil {
+				log.Warnf("Not stripping '%s': %v", n.Path(), err)
+				stripped = data
+			}
+			saved += int64(len(data) - len(stripped))
+			if len(stripped) < len(data) {
+				count++
+			}
+			r = bytes.NewReader(stripped)
+		}
+
+		spooled++
+		spool := filepath.Join(dir, strconv.Itoa(spooled))
+
+		sf, err := os.Create(spool)
+		if err != nil {
+			return err
+		}
+		size, err := io.Copy(sf, r)
+		_ = sf.Close()
+		if err != nil {
+			return err
+		}
+
+		n.File = spooledFile(spool, f, size)
+
+		return nil
+	})
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	log.Infof("Stripped %d ELF files, saving %s", count, vcfg.Bytes(saved))
+
+	return cleanup, nil
+}
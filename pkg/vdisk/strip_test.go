@@ -0,0 +1,120 @@
+package vdisk
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func TestStripTree(t *testing.T) {
+
+	if runtime.GOOS != "linux" {
+		t.Skip("native binaries are not ELF files")
+	}
+
+	src, err := ioutil.TempDir("", "vdisk-strip")
+	assert.NoError(t, err)
+	defer os.RemoveAll(src)
+
+	// test binaries are linked without debugging information, so build a
+	// program that has it
+	gobin := filepath.Join(runtime.GOROOT(), "bin", "go")
+	if _, err := os.Stat(gobin); err != nil {
+		t.Skip("go toolchain not available")
+	}
+
+	err = ioutil.WriteFile(filepath.Join(src, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644)
+	assert.NoError(t, err)
+
+	cmd := exec.Command(gobin, "build", "-o", "app", "main.go")
+	cmd.Dir = src
+	cmd.Env = append(os.Environ(), "GO111MODULE=off", "CGO_ENABLED=0")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Skipf("failed to build test binary: %v: %s", err, out)
+	}
+
+	err = os.Remove(filepath.Join(src, "main.go"))
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(src, "app"))
+	assert.NoError(t, err)
+
+	tmp, err := ioutil.TempDir("", "vdisk-strip-tmp")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	files := map[string]struct {
+		data []byte
+		mode os.FileMode
+	}{
+		"app":       {data, 0750},
+		"notes.txt": {[]byte("not an executable\n"), 0644},
+		"libfoo.so": {[]byte("not a library\n"), 0644},
+	}
+	for name, f := range files {
+		err = ioutil.WriteFile(filepath.Join(src, name), f.data, f.mode)
+		assert.NoError(t, err)
+		err = os.Chmod(filepath.Join(src, name), f.mode)
+		assert.NoError(t, err)
+	}
+
+	tree, err := vio.FileTreeFromDirectory(src)
+	assert.NoError(t, err)
+	defer tree.Close()
+
+	before := make(map[string]vio.File)
+	err = tree.Walk(func(path string, f vio.File) error {
+		before[filepath.Base(path)] = f
+		return nil
+	})
+	assert.NoError(t, err)
+
+	cleanup, err := stripTree(context.Background(), tree, tmp, &elog.CLI{DisableTTY: true})
+	assert.NoError(t, err)
+
+	// spools go in the temp dir given
+	spools, err := ioutil.ReadDir(tmp)
+	assert.NoError(t, err)
+	assert.Len(t, spools, 1)
+
+	after := make(map[string]vio.File)
+	err = tree.Walk(func(path string, f vio.File) error {
+		after[filepath.Base(path)] = f
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// files that can't be ELF binaries aren't read or spooled
+	assert.True(t, before["notes.txt"] == after["notes.txt"])
+
+	for _, name := range []string{"app", "libfoo.so"} {
+		mode, ok := vio.FileMode(after[name])
+		assert.True(t, ok, name)
+		assert.Equal(t, files[name].mode, mode, name)
+	}
+
+	assert.Less(t, after["app"].Size(), len(data))
+
+	lib, err := ioutil.ReadAll(after["libfoo.so"])
+	assert.NoError(t, err)
+	assert.Equal(t, files["libfoo.so"].data, lib)
+	after["libfoo.so"].Close()
+
+	cleanup()
+	_, err = os.Stat(filepath.Join(tmp, spools[0].Name()))
+	assert.True(t, os.IsNotExist(err))
+}
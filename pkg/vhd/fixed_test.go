@@ -0,0 +1,89 @@
+package vhd
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testHolePredictor int64
+
+func (h testHolePredictor) Size() int64 {
+	return int64(h)
+}
+
+func (h testHolePredictor) RegionIsHole(begin, size int64) bool {
+	return false
+}
+
+func TestFixedWriterFooter(t *testing.T) {
+
+	const size = 0x200000
+
+	f, err := ioutil.TempFile("", "vhd-fixed")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w, err := NewFixedWriter(f, testHolePredictor(size))
+	assert.NoError(t, err)
+
+	_, err = w.Write(bytes.Repeat([]byte{0xAB}, size))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	fi, err := f.Stat()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(size+512), fi.Size())
+
+	raw := make([]byte, 512)
+	_, err = f.ReadAt(raw, size)
+	assert.NoError(t, err)
+
+	ftr := new(footer)
+	assert.NoError(t, binary.Read(bytes.NewReader(raw), binary.BigEndian, ftr))
+
+	assert.Equal(t, "conectix", string(raw[:8]))
+	assert.Equal(t, uint32(2), ftr.DiskType)
+	assert.Equal(t, uint64(0xFFFFFFFFFFFFFFFF), ftr.DataOffset)
+	assert.Equal(t, uint64(size), ftr.CurrentSize)
+	assert.Equal(t, uint64(size), ftr.OriginalSize)
+
+	// 4096 sectors: 4 heads, 17 sectors per track, 60 cylinders
+	assert.Equal(t, uint32(60<<16|4<<8|17), ftr.DiskGeometry)
+
+	var sum uint32
+	for i, x := range raw {
+		if i >= 64 && i < 68 { // checksum field
+			continue
+		}
+		sum += uint32(x)
+	}
+	assert.Equal(t, ^sum, ftr.Checksum)
+
+	// the raw data is untouched
+	_, err = f.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(io.LimitReader(f, size))
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{0xAB}, size), data)
+}
+
+func TestDiskGeometry(t *testing.T) {
+
+	// anything large enough is clamped to the maximum geometry
+	c, h, s := diskGeometry(128 << 30)
+	assert.Equal(t, int64(65535), c)
+	assert.Equal(t, int64(16), h)
+	assert.Equal(t, int64(255), s)
+}
@@ -8,10 +8,12 @@ package vimg
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"math/rand"
 
 	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/luks"
 	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vkern"
 )
@@ -45,6 +47,14 @@ type BuilderArgs struct {
 	FSCompiler FSCompiler
 	VCFG       *vcfg.VCFG
 	Logger     elog.View
+
+	// Bootloader is written to the MBR as its boot code instead of the
+	// built-in Bootloader, if it isn't nil. It can be at most BootCodeSize
+	// bytes.
+	Bootloader []byte
+
+	// Encryption encrypts the root partition with LUKS, if it isn't nil.
+	Encryption *Encryption
 }
 
 // Builder is used for building a raw Vorteil image. Building happens in several
@@ -63,6 +73,10 @@ type Builder struct {
 	kernelTags    []string
 	linuxArgs     string
 	defaultMTU    uint
+	bootloader    []byte
+	encryption    *Encryption
+	luks          *luks.Volume
+	luksHeader    []byte
 
 	// The following variables need to be calculated in the prebuild step.
 	size                      int64
@@ -102,6 +116,8 @@ func NewBuilder(ctx context.Context, args *BuilderArgs) (*Builder, error) {
 	b.kernelOptions = args.Kernel
 	b.defaultMTU = 1500
 	b.log = args.Logger
+	b.bootloader = args.Bootloader
+	b.encryption = args.Encryption
 
 	err = b.validateArgs(ctx)
 	if err != nil {
@@ -113,6 +129,12 @@ func NewBuilder(ctx context.Context, args *BuilderArgs) (*Builder, error) {
 		return nil, err
 	}
 
+	// the root file-system type is only known once its contents are committed
+	err = b.processLinuxArgs()
+	if err != nil {
+		return nil, err
+	}
+
 	return b, nil
 }
 
@@ -125,7 +147,16 @@ func (b *Builder) SetDefaultMTU(mtu uint) {
 
 func (b *Builder) validateArgs(ctx context.Context) error {
 
-	err := b.validateOSArgs(ctx)
+	if b.bootloader != nil && (len(b.bootloader) == 0 || len(b.bootloader) > BootCodeSize) {
+		return fmt.Errorf("custom bootloader is %d bytes, but must be from 1 to %d bytes", len(b.bootloader), BootCodeSize)
+	}
+
+	err := b.validateEncryptionArgs()
+	if err != nil {
+		return err
+	}
+
+	err = b.validateOSArgs(ctx)
 	if err != nil {
 		return err
 	}
@@ -152,6 +183,8 @@ func (b *Builder) calculateMinimumSize(ctx context.Context) error {
 		return err
 	}
 
+	b.minSize += b.rootPayloadOffset()
+
 	return nil
 }
 
@@ -272,6 +305,10 @@ func (b *Builder) RegionIsHole(begin, size int64) bool {
 	last := (begin + size - 1) / SectorSize
 
 	if first >= b.rootFirstLBA && last <= b.rootLastLBA {
+		if b.luks != nil {
+			return false // encrypted file-system holes aren't zeroes
+		}
+
 		// file-system holes
 		pBegin := (first - b.rootFirstLBA) * SectorSize
 		pSize := (last - first + 1) * SectorSize
@@ -0,0 +1,118 @@
+package vimg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/vorteil/vorteil/pkg/luks"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// Sources the passphrase of an encrypted root partition can be read from when
+// the image boots.
+const (
+	KeySourceMetadata = "metadata" // the cloud provider's instance metadata
+	KeySourceConsole  = "console"  // prompted for on the console
+)
+
+// KeySources lists every supported KeySource.
+var KeySources = []string{KeySourceMetadata, KeySourceConsole}
+
+// Encryption configures a LUKS-encrypted root partition. The partition is
+// encrypted with a random master key, protected by Passphrase in the first
+// key slot. KeySource tells the image where to find the passphrase when it
+// boots, and is passed to the kernel as the 'vorteil.luks' argument, so it
+// needs a kernel and init that support unlocking the root partition.
+//
+// An encrypted image is never reproducible, even with the same Seed, because
+// the master key and salts are always random.
+type Encryption struct {
+	Cipher     string // defaults to luks.DefaultCipher
+	KeyBytes   int    // defaults to luks.DefaultKeyBytes
+	Iterations int    // defaults to luks.DefaultIterations
+	KeySource  string
+	Passphrase []byte
+}
+
+// Validate checks that the encryption settings are supported.
+func (e *Encryption) Validate() error {
+
+	var ok bool
+	for _, src := range KeySources {
+		if e.KeySource == src {
+			ok = true
+		}
+	}
+
+	if !ok {
+		return fmt.Errorf("unsupported encryption key source '%s' (should be one of %v)", e.KeySource, KeySources)
+	}
+
+	if len(e.Passphrase) == 0 {
+		return fmt.Errorf("encryption needs a passphrase")
+	}
+
+	return e.options().Validate()
+}
+
+func (e *Encryption) options() *luks.Options {
+	return &luks.Options{
+		Cipher:     e.Cipher,
+		KeyBytes:   e.KeyBytes,
+		Iterations: e.Iterations,
+	}
+}
+
+func (b *Builder) validateEncryptionArgs() error {
+
+	if b.encryption == nil {
+		return nil
+	}
+
+	err := b.encryption.Validate()
+	if err != nil {
+		return err
+	}
+
+	b.luks, b.luksHeader, err = luks.Format(b.encryption.Passphrase, b.encryption.options())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// rootPayloadOffset returns the number of bytes at the start of the root
+// partition taken by the LUKS header, which is zero if it isn't encrypted.
+func (b *Builder) rootPayloadOffset() int64 {
+	return int64(len(b.luksHeader))
+}
+
+func (b *Builder) writeEncryptedRoot(ctx context.Context, w io.Writer) error {
+
+	_, err := w.Write(b.luksHeader)
+	if err != nil {
+		return err
+	}
+
+	// the encrypting writer can't seek, so the file-system's holes are
+	// written out as encrypted zeroes
+	lw := b.luks.NewWriter(w)
+	ws, err := vio.WriteSeeker(lw)
+	if err != nil {
+		return err
+	}
+
+	err = b.fs.Compile(ctx, ws)
+	if err != nil {
+		return err
+	}
+
+	return lw.Close()
+}
@@ -14,9 +14,12 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/vorteil/vorteil/pkg/elog"
 	"github.com/vorteil/vorteil/pkg/vcfg"
 
 	shellwords "github.com/mattn/go-shellwords"
@@ -35,6 +38,9 @@ var GetKernel func(ctx context.Context, version vkern.CalVer) (*vkern.ManagedBun
 // GetLatestKernel is the function a Builder will use to determine what kernel to use if none is specified. It must be set externally.
 var GetLatestKernel func(ctx context.Context) (vkern.CalVer, error)
 
+// ListKernels is the function ResolveKernel uses to check that a requested kernel is available. If it isn't set, requested kernels aren't checked.
+var ListKernels func(ctx context.Context) (vkern.List, error)
+
 func (b *Builder) prebuildOS(ctx context.Context) error {
 
 	err := b.calculateOSPartitionSize()
@@ -125,8 +131,53 @@ func (b *Builder) calculateOSPartitionSize() error {
 	return nil
 }
 
+// disableServices clears the settings that would start any of the services
+// listed in system.disable-services, warning about each one it ignores.
+func (b *Builder) disableServices() {
+
+	sys := &b.vcfg.System
+
+	if sys.ServiceDisabled(vcfg.NTPService) && len(sys.NTP) > 0 {
+		b.log.Warnf("Ignoring system.ntp because the ntp service is disabled.")
+		sys.NTP = nil
+	}
+
+	if sys.ServiceDisabled(vcfg.LogsService) {
+		if len(b.vcfg.Logging) > 0 {
+			b.log.Warnf("Ignoring logging because the logs service is disabled.")
+			b.vcfg.Logging = nil
+		}
+		for i := range b.vcfg.Programs {
+			if len(b.vcfg.Programs[i].LogFiles) > 0 {
+				b.log.Warnf("Ignoring log files for program %d because the logs service is disabled.", i)
+				b.vcfg.Programs[i].LogFiles = nil
+			}
+		}
+	}
+
+	if sys.ServiceDisabled(vcfg.StraceService) {
+		for i := range b.vcfg.Programs {
+			if b.vcfg.Programs[i].Strace {
+				b.log.Warnf("Ignoring strace for program %d because the strace service is disabled.", i)
+				b.vcfg.Programs[i].Strace = false
+			}
+		}
+	}
+
+	if sys.ServiceDisabled(vcfg.TCPDumpService) {
+		for i := range b.vcfg.Networks {
+			if b.vcfg.Networks[i].TCPDUMP {
+				b.log.Warnf("Ignoring tcpdump for network %d because the tcpdump service is disabled.", i)
+				b.vcfg.Networks[i].TCPDUMP = false
+			}
+		}
+	}
+}
+
 func (b *Builder) setConfigDefaults() error {
 
+	b.disableServices()
+
 	for i := range b.vcfg.Programs {
 
 		p := &b.vcfg.Programs[i]
@@ -135,6 +186,17 @@ func (b *Builder) setConfigDefaults() error {
 			p.Cwd = "/"
 		}
 
+		// output sent to a file or device by the logging destination is
+		// written there directly
+		if sink, out, err := p.Logging.Sink(); err == nil && (sink == vcfg.FileLogSink || sink == vcfg.SerialLogSink) {
+			if p.Stdout == "" {
+				p.Stdout = out
+			}
+			if p.Stderr == "" {
+				p.Stderr = out
+			}
+		}
+
 		if p.Stdout == "" {
 			p.Stdout = "/dev/vtty"
 		}
@@ -147,6 +209,12 @@ func (b *Builder) setConfigDefaults() error {
 			p.Privilege = vcfg.RootPrivilege
 		}
 
+		if string(p.Type) == "" {
+			p.Type = vcfg.DefaultProgramType
+		}
+
+		p.Health.SetDefaults()
+
 	}
 
 	for i := range b.vcfg.Networks {
@@ -157,10 +225,25 @@ func (b *Builder) setConfigDefaults() error {
 			n.MTU = b.defaultMTU
 		}
 
-		if n.IP == "" {
-			n.IP = "dhcp"
+		switch n.NetworkMode() {
+		case "":
+			if !b.vcfg.System.ServiceDisabled(vcfg.DHCPService) {
+				n.IP = "dhcp"
+			}
+		case vcfg.SLAACNetworkMode:
+			// no static address: everything comes from router advertisements
+			n.IP = string(vcfg.SLAACNetworkMode)
+			n.AcceptRA = true
+		case vcfg.IPv6StaticNetworkMode:
+			if n.Mask == "" {
+				n.Mask = vcfg.DefaultIPv6Prefix
+			}
+			n.Mask = strings.TrimPrefix(n.Mask, "/")
 		}
 
+		// the init process reads the mode, so it's never left to be inferred
+		n.Mode = n.NetworkMode()
+
 	}
 
 	if len(b.vcfg.System.DNS) == 0 {
@@ -178,6 +261,38 @@ func (b *Builder) setConfigDefaults() error {
 	return nil
 }
 
+// isOverlayPath returns true if path is on one of the writable overlays of a
+// read-only root file-system.
+func isOverlayPath(p string) bool {
+	p = path.Join("/", p)
+	for _, dir := range vcfg.OverlayDirs {
+		if p == dir || strings.HasPrefix(p, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// validateReadOnlyRootProgram checks that every file a program is configured
+// to write is somewhere it will be able to write it when the root
+// file-system is read-only.
+func validateReadOnlyRootProgram(p vcfg.Program) error {
+
+	for _, f := range []string{p.Stdout, p.Stderr} {
+		if f != "" && !strings.HasPrefix(f, "/dev/") && !isOverlayPath(f) {
+			return fmt.Errorf("output file '%s' is not writable on a read-only root (use %s)", f, strings.Join(vcfg.OverlayDirs, " or "))
+		}
+	}
+
+	for _, f := range p.LogFiles {
+		if !isOverlayPath(f) {
+			return fmt.Errorf("log file '%s' is not writable on a read-only root (use %s)", f, strings.Join(vcfg.OverlayDirs, " or "))
+		}
+	}
+
+	return nil
+}
+
 func (b *Builder) validateConfig() error {
 
 	for i, p := range b.vcfg.Programs {
@@ -200,11 +315,89 @@ func (b *Builder) validateConfig() error {
 		if err := p.Terminate.Validate(); err != nil {
 			return err
 		}
+
+		if err := p.Type.Validate(); err != nil {
+			return fmt.Errorf("program %d: %v", i, err)
+		}
+
+		if err := p.ValidateLogging(); err != nil {
+			return fmt.Errorf("program %d: %v", i, err)
+		}
+
+		if err := p.ValidateHealthCheck(); err != nil {
+			return fmt.Errorf("program %d: %v", i, err)
+		}
+
+		if err := p.ValidateStdin(); err != nil {
+			return fmt.Errorf("program %d: %v", i, err)
+		}
+
+		if err := p.ValidateEnv(); err != nil {
+			return fmt.Errorf("program %d: %v", i, err)
+		}
+
+		if p.FailBoot && p.Type != vcfg.OneshotProgram {
+			return fmt.Errorf("program %d can only fail the boot if its type is '%s'", i, vcfg.OneshotProgram)
+		}
+
+		if b.vcfg.System.Filesystem == vcfg.SquashFS {
+			if err := validateReadOnlyRootProgram(p); err != nil {
+				return fmt.Errorf("program %d: %v", i, err)
+			}
+		}
+	}
+
+	for _, name := range b.vcfg.System.KernelModules {
+		if err := vcfg.ValidateKernelModule(name); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range b.vcfg.System.DisableServices {
+		if err := vcfg.ValidateService(name); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range b.vcfg.SysctlKeys() {
+		if err := vcfg.ValidateSysctl(key, b.vcfg.Sysctl[key]); err != nil {
+			return err
+		}
+	}
+
+	if b.vcfg.System.BootTimeout < 0 {
+		return fmt.Errorf("invalid boot timeout: %d (should not be negative)", b.vcfg.System.BootTimeout)
+	}
+
+	if _, err := bootEntry(b.vcfg.System.DefaultBootEntry, b.kernelOptions); err != nil {
+		return err
 	}
 
 	for i, n := range b.vcfg.Networks {
 
-		if n.IP == "dhcp" {
+		mode := n.NetworkMode()
+
+		if (mode == "" || mode == vcfg.DHCPNetworkMode) && b.vcfg.System.ServiceDisabled(vcfg.DHCPService) {
+			return fmt.Errorf("network %d needs a static ip because the dhcp service is disabled", i)
+		}
+
+		if err := n.ValidateMode(); err != nil {
+			return fmt.Errorf("network %d: %v", i, err)
+		}
+
+		if mode == vcfg.SLAACNetworkMode {
+			continue
+		}
+
+		if mode == vcfg.IPv6StaticNetworkMode {
+			if net.ParseIP(n.Gateway) == nil {
+				return fmt.Errorf("network %d has an invalid gateway: %s", i, n.Gateway)
+			}
+
+			continue
+		}
+
+		if mode == vcfg.DHCPNetworkMode {
 			if n.Mask != "" {
 				return fmt.Errorf("network %d should not have a mask set when using dhcp", i)
 			}
@@ -265,10 +458,48 @@ type BootloaderConfig struct {
 	ConfigOffset   uint64       // 40
 	ConfigLen      uint64       // 48
 	ConfigCapacity uint64       // 56
-	_              [192]byte    // 64
+	BootTimeout    uint32       // 64
+	DefaultEntry   uint32       // 68
+	_              [184]byte    // 72
 	LinuxArgs      [0x2000]byte // 256
 }
 
+// Entries the bootloader can start, named as they are in the VCFG's
+// system.default-boot-entry. The rescue entry boots into the busybox shell,
+// so it only exists on images that include it.
+const (
+	BootEntryVorteil = "vorteil"
+	BootEntryRescue  = "rescue"
+)
+
+// BootEntries returns the names of the bootloader entries of an image built
+// with opts, in the order they are numbered in its BootloaderConfig.
+func BootEntries(opts KernelOptions) []string {
+	entries := []string{BootEntryVorteil}
+	if opts.Shell {
+		entries = append(entries, BootEntryRescue)
+	}
+	return entries
+}
+
+// bootEntry returns the number of the bootloader entry called name, which
+// defaults to the first entry.
+func bootEntry(name string, opts KernelOptions) (int, error) {
+
+	entries := BootEntries(opts)
+	if name == "" {
+		return 0, nil
+	}
+
+	for i, entry := range entries {
+		if entry == name {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("default boot entry '%s' does not exist (should be one of: %s)", name, strings.Join(entries, ", "))
+}
+
 func (b *Builder) writeBootloader(ctx context.Context, w io.WriteSeeker) error {
 
 	err := ctx.Err()
@@ -281,11 +512,18 @@ func (b *Builder) writeBootloader(ctx context.Context, w io.WriteSeeker) error {
 		return err
 	}
 
+	entry, err := bootEntry(b.vcfg.System.DefaultBootEntry, b.kernelOptions)
+	if err != nil {
+		return err
+	}
+
 	bootConf := BootloaderConfig{
 		LinuxArgsLen:   uint16(len(b.linuxArgs)),
 		ConfigOffset:   uint64(b.configFirstLBA-b.osFirstLBA) * SectorSize,
 		ConfigLen:      uint64(len(b.configData)),
 		ConfigCapacity: uint64(b.osLastLBA-b.configFirstLBA+1) * SectorSize,
+		BootTimeout:    uint32(b.vcfg.System.BootTimeout),
+		DefaultEntry:   uint32(entry),
 	}
 
 	copy(bootConf.Version[:], "1.0.0")
@@ -395,75 +633,165 @@ func (b *Builder) osRegionIsHole(begin, size int64) bool {
 	return false
 }
 
-func (b *Builder) determineKernelTags() {
+// KernelFeature is an optional part of a kernel bundle, added to disks whose
+// VCFG or KernelOptions need it.
+type KernelFeature struct {
+	Tag string
+
+	// Setting describes what adds the feature to a disk.
+	Setting string
+}
+
+// KernelFeatures are the kernel features that KernelTags can ask for, in the
+// order it checks them.
+var KernelFeatures = []KernelFeature{
+	{Tag: "shell", Setting: "--shell or system.rescue-shell"},
+	{Tag: "ntp", Setting: "system.ntp"},
+	{Tag: "logs", Setting: "logging, or program logfiles"},
+	{Tag: "strace", Setting: "program strace"},
+	{Tag: "tcpdump", Setting: "network tcpdump"},
+}
+
+// KernelTags returns the tags of the kernel features a disk built from cfg
+// with opts needs, such as "shell" or "ntp". Services listed in
+// system.disable-services are left out.
+func KernelTags(cfg *vcfg.VCFG, opts KernelOptions) []string {
+
+	tags := kernelTags(cfg, opts)
+
+	enabled := tags[:0]
+	for _, tag := range tags {
+		if !cfg.System.ServiceDisabled(vcfg.Service(tag)) {
+			enabled = append(enabled, tag)
+		}
+	}
+
+	return enabled
+}
 
-	b.kernelTags = []string{}
+func kernelTags(cfg *vcfg.VCFG, opts KernelOptions) []string {
 
-	if b.kernelOptions.Shell {
-		b.kernelTags = append(b.kernelTags, "shell")
+	tags := []string{}
+
+	if opts.Shell {
+		tags = append(tags, "shell")
 	}
 
-	if len(b.vcfg.System.NTP) > 0 {
-		b.kernelTags = append(b.kernelTags, "ntp")
+	if len(cfg.System.NTP) > 0 {
+		tags = append(tags, "ntp")
 	}
 
-	if len(b.vcfg.Logging) > 0 {
-		b.kernelTags = append(b.kernelTags, "logs")
+	if len(cfg.Logging) > 0 {
+		tags = append(tags, "logs")
 	} else {
-		for _, prog := range b.vcfg.Programs {
+		for _, prog := range cfg.Programs {
 			if len(prog.LogFiles) > 0 {
-				b.kernelTags = append(b.kernelTags, "logs")
+				tags = append(tags, "logs")
 				break
 			}
 		}
 	}
 
-	for _, prog := range b.vcfg.Programs {
+	for _, prog := range cfg.Programs {
 		if prog.Strace {
-			b.kernelTags = append(b.kernelTags, "strace")
+			tags = append(tags, "strace")
 			break
 		}
 	}
 
-	for _, nic := range b.vcfg.Networks {
+	for _, nic := range cfg.Networks {
 		if nic.TCPDUMP {
-			b.kernelTags = append(b.kernelTags, "tcpdump")
+			tags = append(tags, "tcpdump")
 			break
 		}
 	}
 
-	return
+	return tags
 
 }
 
-func (b *Builder) validateOSArgs(ctx context.Context) error {
-
-	b.linuxArgs = b.vcfg.System.KernelArgs
+// ResolveKernel returns the version of the kernel a disk built from cfg will
+// use. If cfg doesn't name a kernel, or names 'latest', or names one too old
+// for this compiler, the latest kernel is used instead. A kernel that isn't
+// a valid version, or that none of the kernels from ListKernels match, is an
+// error listing the kernels that are available. GetLatestKernel must be set.
+func ResolveKernel(ctx context.Context, cfg *vcfg.VCFG, log elog.View) (vkern.CalVer, error) {
 
-	b.determineKernelTags()
+	if cfg.VM.Kernel == "" || cfg.VM.Kernel == "latest" {
+		return GetLatestKernel(ctx)
+	}
 
-	var err error
-	b.kernel, err = vkern.Parse(b.vcfg.VM.Kernel)
+	kernel, err := vkern.Parse(cfg.VM.Kernel)
 	if err != nil {
-		if err == vkern.ErrInvalidCalVer {
-			b.kernel, err = GetLatestKernel(ctx)
-		}
+		return kernel, fmt.Errorf("invalid kernel '%s'%s", cfg.VM.Kernel, availableKernels(ctx, log))
+	}
+
+	if kernel.Less(vkern.CalVer("20.9.1")) {
+		kernel, err = GetLatestKernel(ctx)
 		if err != nil {
-			return err
+			return kernel, err
 		}
-	} else if b.kernel.Less(vkern.CalVer("20.9.1")) {
-		b.kernel, err = GetLatestKernel(ctx)
+		if kernel.Less(vkern.CalVer("20.9.1")) {
+			return kernel, errors.New("the kernel source does not contain any kernels compatible with this compiler")
+		}
+		log.Warnf("Requested kernel '%s' is too old for this compiler. Using latest kernel instead.", cfg.VM.Kernel)
+		return kernel, nil
+	}
+
+	if ListKernels != nil {
+		list, err := ListKernels(ctx)
 		if err != nil {
-			return err
+			log.Debugf("Unable to list kernels to check '%s' is available: %v", kernel, err)
+		} else if _, err = list.BestMatch(kernel); err != nil && len(list) > 0 {
+			return kernel, fmt.Errorf("kernel '%s' is not available%s", kernel, availableKernels(ctx, log))
 		}
-		if b.kernel.Less(vkern.CalVer("20.9.1")) {
-			return errors.New("the kernel source does not contain any kernels compatible with this compiler")
-		} else {
-			b.log.Warnf("Requested kernel '%s' is too old for this compiler. Using latest kernel instead.", b.vcfg.VM.Kernel)
+	}
+
+	return kernel, nil
+
+}
+
+// availableKernels returns a suffix for an error message listing the kernels
+// that can be chosen from, newest first, or nothing if they can't be listed.
+func availableKernels(ctx context.Context, log elog.View) string {
+
+	if ListKernels == nil {
+		return ""
+	}
+
+	list, err := ListKernels(ctx)
+	if err != nil {
+		log.Debugf("Unable to list kernels: %v", err)
+		return ""
+	}
+	if len(list) == 0 {
+		return ""
+	}
+
+	sort.Sort(list)
+
+	var versions []string
+	seen := make(map[vkern.CalVer]bool)
+	for i := len(list) - 1; i >= 0; i-- {
+		v := list[i].Version
+		if !seen[v] {
+			seen[v] = true
+			versions = append(versions, v.String())
 		}
 	}
 
-	err = b.processLinuxArgs()
+	return fmt.Sprintf(" -- try one of these: latest, %s", strings.Join(versions, ", "))
+
+}
+
+func (b *Builder) validateOSArgs(ctx context.Context) error {
+
+	b.linuxArgs = b.vcfg.System.KernelArgs
+
+	b.kernelTags = KernelTags(b.vcfg, b.kernelOptions)
+
+	var err error
+	b.kernel, err = ResolveKernel(ctx, b.vcfg, b.log)
 	if err != nil {
 		return err
 	}
@@ -489,13 +817,23 @@ func (b *Builder) processLinuxArgs() error {
 	_, ok1 := m["ro"]
 	_, ok2 := m["rw"]
 	if !ok1 && !ok2 {
-		args = append(args, "rw")
+		if b.vcfg.System.Filesystem == vcfg.SquashFS {
+			args = append(args, "ro")
+		} else {
+			args = append(args, "rw")
+		}
+	} else if ok2 && b.vcfg.System.Filesystem == vcfg.SquashFS {
+		return errors.New("squashfs root file-system cannot be mounted 'rw'")
 	}
 
-	// if the fs is not set here we assume it is ext2
+	// if the fs is not set here the compiler decides which ext driver it
+	// needs, or we assume it is ext2
 	fs := b.vcfg.System.Filesystem
 	if fs == "" || fs == "ext" {
 		fs = "ext2"
+		if x, ok := b.fs.(interface{ FilesystemType() string }); ok {
+			fs = vcfg.Filesystem(x.FilesystemType())
+		}
 	}
 
 	args = append(args, fmt.Sprintf("rootfstype=%s", fs))
@@ -526,6 +864,10 @@ func (b *Builder) processLinuxArgs() error {
 		args = append(args, "recordmode")
 	}
 
+	if b.encryption != nil {
+		args = append(args, fmt.Sprintf("vorteil.luks=%s", b.encryption.KeySource))
+	}
+
 	var x []string
 	for _, s := range args {
 		if strings.ContainsAny(s, " \t") {
@@ -0,0 +1,78 @@
+package vimg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+)
+
+// generateTestConfig applies the defaults to cfg the way the CLI does, and
+// then the builder's own defaults and validation.
+func generateTestConfig(cfg *vcfg.VCFG) error {
+
+	log := &elog.CLI{}
+	err := vcfg.WithDefaults(cfg, log)
+	if err != nil {
+		return err
+	}
+
+	b := &Builder{vcfg: cfg, log: log, defaultMTU: 1500}
+	err = b.setConfigDefaults()
+	if err != nil {
+		return err
+	}
+
+	return b.validateConfig()
+}
+
+func TestLoggingDestinationDefaults(t *testing.T) {
+
+	for _, dest := range []string{"file:/var/log/app.log", "serial:/dev/ttyS1"} {
+		cfg := &vcfg.VCFG{Programs: []vcfg.Program{{
+			Binary:  "/app",
+			Logging: vcfg.ProgramLogging{Destination: dest},
+		}}}
+
+		assert.NoError(t, generateTestConfig(cfg), dest)
+
+		_, out, err := cfg.Programs[0].Logging.Sink()
+		assert.NoError(t, err)
+		assert.Equal(t, out, cfg.Programs[0].Stdout)
+		assert.Equal(t, out, cfg.Programs[0].Stderr)
+	}
+
+	// output is still sent to the console by default
+	cfg := &vcfg.VCFG{Programs: []vcfg.Program{{Binary: "/app"}}}
+	assert.NoError(t, generateTestConfig(cfg))
+	assert.Equal(t, "/dev/vtty", cfg.Programs[0].Stdout)
+
+	// an explicit stdout that disagrees with the destination is an error
+	cfg = &vcfg.VCFG{Programs: []vcfg.Program{{
+		Binary:  "/app",
+		Stdout:  "/dev/vtty",
+		Logging: vcfg.ProgramLogging{Destination: "file:/var/log/app.log"},
+	}}}
+	assert.Error(t, generateTestConfig(cfg))
+}
+
+func TestDisabledDHCPDefaults(t *testing.T) {
+
+	cfg := &vcfg.VCFG{
+		Programs: []vcfg.Program{{Binary: "/app"}},
+		System:   vcfg.SystemSettings{DisableServices: []string{"dhcp"}},
+	}
+
+	assert.NoError(t, generateTestConfig(cfg))
+	assert.Len(t, cfg.Networks, 0)
+
+	cfg = &vcfg.VCFG{Programs: []vcfg.Program{{Binary: "/app"}}}
+	assert.NoError(t, generateTestConfig(cfg))
+	assert.Len(t, cfg.Networks, 1)
+}
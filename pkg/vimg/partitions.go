@@ -125,9 +125,13 @@ func (b *Builder) writePartitions(ctx context.Context, w io.WriteSeeker) error {
 	return nil
 }
 
+// BootCodeSize is the number of bytes of boot code that fit in the MBR,
+// before its partition table.
+const BootCodeSize = 446
+
 // ProtectiveMBR is the structure of a protective master boot record as it appears on disk.
 type ProtectiveMBR struct {
-	Bootloader    [446]byte
+	Bootloader    [BootCodeSize]byte
 	Status        byte
 	_             byte // first head
 	_             byte // first sector
@@ -162,7 +166,11 @@ func (b *Builder) writeMBR(ctx context.Context, w io.WriteSeeker) error {
 		TotalSectors:  uint32(b.size/SectorSize) - 1,
 	}
 
-	copy(mbr.Bootloader[:], Bootloader)
+	if b.bootloader != nil {
+		copy(mbr.Bootloader[:], b.bootloader)
+	} else {
+		copy(mbr.Bootloader[:], Bootloader)
+	}
 
 	err = binary.Write(w, binary.LittleEndian, &mbr)
 	if err != nil {
@@ -198,7 +206,7 @@ type GPTEntry struct {
 	PartitionGUID [16]byte
 	FirstLBA      uint64
 	LastLBA       uint64
-	_             uint64 // attributes
+	Attributes    uint64
 	Name          [72]byte
 }
 
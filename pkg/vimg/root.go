@@ -6,8 +6,10 @@ package vimg
  */
 
 import (
+	"bytes"
 	"context"
 	"io"
+	"io/ioutil"
 
 	"github.com/vorteil/vorteil/pkg/vcfg"
 	"github.com/vorteil/vorteil/pkg/vio"
@@ -23,7 +25,7 @@ func (b *Builder) prebuildRoot(ctx context.Context) error {
 	b.rootFirstLBA = b.osLastLBA + 1
 	b.rootLastLBA = b.lastUsableLBA
 
-	size := (b.rootLastLBA - b.rootFirstLBA + 1) * SectorSize
+	size := (b.rootLastLBA-b.rootFirstLBA+1)*SectorSize - b.rootPayloadOffset()
 
 	err = b.fs.Precompile(ctx, size)
 	if err != nil {
@@ -40,6 +42,10 @@ func (b *Builder) writeRoot(ctx context.Context, w io.WriteSeeker) error {
 		return err
 	}
 
+	if b.luks != nil {
+		return b.writeEncryptedRoot(ctx, w)
+	}
+
 	ws, err := vio.WriteSeeker(w)
 	if err != nil {
 		return err
@@ -58,16 +64,61 @@ func (b *Builder) rootRegionIsHole(begin, size int64) bool {
 	return b.fs.RegionIsHole(begin, size)
 }
 
+// injectedDirs returns the directories the Builder adds to the root
+// file-system of a disk built with cfg.
+func injectedDirs(cfg *vcfg.VCFG) []string {
+
+	dirs := []string{"dev", "vorteil", "tmp", "proc", "sys"}
+	if cfg.System.Filesystem == vcfg.SquashFS {
+		// mount points for the init to make writable, see vcfg.OverlayDirs
+		dirs = append(dirs, "var")
+	}
+
+	return dirs
+}
+
+// InjectedPaths returns the paths, relative to the root, of the files and
+// directories the Builder adds to the root file-system of a disk built with
+// cfg, whether or not the package has them already. Tools comparing a disk
+// against its package can use it to ignore them.
+func InjectedPaths(cfg *vcfg.VCFG) []string {
+
+	paths := injectedDirs(cfg)
+	if cfg.System.Timezone != "" {
+		paths = append(paths, "etc", "etc/localtime", "etc/timezone")
+	}
+
+	return paths
+}
+
 func (b *Builder) validateRootArgs() error {
 
-	// inject files/directories here
-	for _, dir := range []string{"dev", "vorteil", "tmp", "proc", "sys"} {
+	// inject files/directories here, and list them in InjectedPaths
+	for _, dir := range injectedDirs(b.vcfg) {
 		err := b.fs.Mkdir(dir)
 		if err != nil {
 			return err
 		}
 	}
 
+	if tz := b.vcfg.System.Timezone; tz != "" {
+		data, err := vcfg.ZoneInfo(tz)
+		if err != nil {
+			return err
+		}
+
+		err = b.fs.AddFile("etc/localtime", ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), true)
+		if err != nil {
+			return err
+		}
+
+		data = []byte(tz + "\n")
+		err = b.fs.AddFile("etc/timezone", ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), true)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
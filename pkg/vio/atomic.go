@@ -0,0 +1,140 @@
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// AtomicFile is a file that only appears at its path once it has been
+// completely written. Everything is written to a temporary file in the same
+// directory, which Commit renames over the path, so readers never see a
+// partially written file and a crash part way through leaves any existing
+// file untouched. Closing an AtomicFile without committing it discards what
+// was written.
+//
+// The embedded *os.File is the temporary file, so its Name is not the path
+// the file will be committed to.
+type AtomicFile struct {
+	*os.File
+	path string
+	done bool
+}
+
+// AtomicCreate starts writing a new file at path, replacing any file already
+// there when it's committed. Like os.OpenFile, the file is created with perm
+// (before the umask), unless it's replacing a file, in which case it keeps
+// that file's permissions.
+func AtomicCreate(path string, perm os.FileMode) (*AtomicFile, error) {
+
+	dir, base := filepath.Split(path)
+
+	for i := 0; ; i++ {
+
+		var suffix [4]byte
+		_, err := rand.Read(suffix[:])
+		if err != nil {
+			return nil, err
+		}
+
+		tmp := filepath.Join(dir, fmt.Sprintf(".%s.%x.tmp", base, suffix))
+		f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) && i < 100 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+			err = f.Chmod(fi.Mode().Perm())
+			if err != nil {
+				f.Close()
+				os.Remove(tmp)
+				return nil, err
+			}
+		}
+
+		return &AtomicFile{
+			File: f,
+			path: path,
+		}, nil
+	}
+}
+
+// Path returns the path the file will appear at once committed.
+func (f *AtomicFile) Path() string {
+	return f.path
+}
+
+// Commit flushes everything written to disk and moves the file into place.
+// The file is closed afterwards, whether or not it succeeds.
+func (f *AtomicFile) Commit() error {
+
+	if f.done {
+		return os.ErrClosed
+	}
+	f.done = true
+
+	tmp := f.File.Name()
+
+	err := f.File.Sync()
+	if err != nil {
+		f.File.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	err = f.File.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, f.path)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// Close discards the file if it hasn't been committed. It does nothing if it
+// has, so it's safe to defer alongside a call to Commit.
+func (f *AtomicFile) Close() error {
+
+	if f.done {
+		return nil
+	}
+	f.done = true
+
+	err := f.File.Close()
+	os.Remove(f.File.Name())
+	return err
+}
+
+// AtomicWriteFile writes data to a file at path like ioutil.WriteFile, except
+// that the file only appears once all of data has been written, and replaces
+// any file already there.
+func AtomicWriteFile(path string, data []byte, perm os.FileMode) error {
+
+	f, err := AtomicCreate(path, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(data)
+	if err != nil {
+		return err
+	}
+
+	return f.Commit()
+}
@@ -0,0 +1,109 @@
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestAtomicCreate(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vorteil-atomic")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "out.raw")
+	err = ioutil.WriteFile(path, []byte("old contents"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	// an abandoned file leaves the original alone
+	f, err := AtomicCreate(path, 0644)
+	if err != nil {
+		t.Fatalf("failed to create atomic file: %v", err)
+	}
+	_, err = f.Write([]byte("partial"))
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if f.Name() == path {
+		t.Fatalf("atomic file is writing to its destination directly")
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	checkFile := func(expect string) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+		if string(data) != expect {
+			t.Fatalf("file contains '%s', expected '%s'", data, expect)
+		}
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("failed to read dir: %v", err)
+		}
+		if len(fis) != 1 {
+			t.Fatalf("expected temporary files to be cleaned up, found %d files", len(fis))
+		}
+	}
+
+	checkFile("old contents")
+
+	err = AtomicWriteFile(path, []byte("new"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	checkFile("new")
+
+	f, err = AtomicCreate(path, 0644)
+	if err != nil {
+		t.Fatalf("failed to create atomic file: %v", err)
+	}
+	err = f.Commit()
+	if err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Fatalf("expected closing a committed file to do nothing, got %v", err)
+	}
+
+	checkFile("")
+
+	// replacing a file keeps its permissions
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		t.Fatalf("failed to chmod file: %v", err)
+	}
+	err = AtomicWriteFile(path, []byte("secret"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat file: %v", err)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0600 {
+		t.Fatalf("replaced file has permissions %v, expected %v", fi.Mode().Perm(), os.FileMode(0600))
+	}
+
+	_, err = AtomicCreate(filepath.Join(dir, "missing", "out.raw"), 0644)
+	if err == nil {
+		t.Fatalf("expected an error creating a file in a missing directory")
+	}
+}
@@ -0,0 +1,217 @@
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// DefaultCacheLimit is the number of bytes a CachedFile keeps in memory if no
+// other limit is provided.
+const DefaultCacheLimit = 32 * 1024 * 1024
+
+var errCacheReleased = errors.New("cached file has been released")
+
+// CachedFile is a File that keeps a copy of everything read from it, so that
+// its contents can be read again without going back to the underlying File.
+// Up to a limit the copy is kept in memory, and anything beyond that spills
+// into a temporary file.
+//
+// Closing a CachedFile doesn't close the underlying File, but ends the
+// current pass through the contents: the next Read starts again from the
+// beginning. The underlying File is closed as soon as it has been read to
+// the end. Call Release once the contents are no longer needed.
+type CachedFile struct {
+	f     File
+	mode  os.FileMode
+	limit int64
+	dir   string
+
+	mem   []byte
+	spill *os.File
+	n     int64 // total bytes cached
+	pos   int64 // position of the current pass
+	done  bool  // the underlying file has been read to the end
+	err   error
+}
+
+// CacheFile wraps f in a CachedFile that keeps up to limit bytes of its
+// contents in memory, and the rest in a temporary file in dir. If limit is
+// zero DefaultCacheLimit is used, and if dir is empty the system's default
+// temporary directory is used.
+func CacheFile(f File, limit int64, dir string) *CachedFile {
+
+	if limit == 0 {
+		limit = DefaultCacheLimit
+	}
+
+	return &CachedFile{
+		f:     f,
+		mode:  fileMode(f),
+		limit: limit,
+		dir:   dir,
+	}
+}
+
+// Name returns the name of the underlying File.
+func (c *CachedFile) Name() string {
+	return c.f.Name()
+}
+
+// Size returns the size of the underlying File.
+func (c *CachedFile) Size() int {
+	return c.f.Size()
+}
+
+// ModTime returns the modification time of the underlying File.
+func (c *CachedFile) ModTime() time.Time {
+	return c.f.ModTime()
+}
+
+// IsDir returns true if the underlying File is a directory.
+func (c *CachedFile) IsDir() bool {
+	return c.f.IsDir()
+}
+
+// IsSymlink returns true if the underlying File is a symlink.
+func (c *CachedFile) IsSymlink() bool {
+	return c.f.IsSymlink()
+}
+
+// SymlinkIsCached returns the same as the underlying File.
+func (c *CachedFile) SymlinkIsCached() bool {
+	return c.f.SymlinkIsCached()
+}
+
+// Symlink returns the same as the underlying File.
+func (c *CachedFile) Symlink() string {
+	return c.f.Symlink()
+}
+
+// Mode returns the permission bits of the underlying File, if known.
+func (c *CachedFile) Mode() os.FileMode {
+	return c.mode
+}
+
+// Read implements io.Reader, replaying cached data before reading anything
+// new from the underlying File.
+func (c *CachedFile) Read(p []byte) (int, error) {
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if c.pos < int64(len(c.mem)) {
+		k := copy(p, c.mem[c.pos:])
+		c.pos += int64(k)
+		return k, nil
+	}
+
+	if c.pos < c.n {
+		if int64(len(p)) > c.n-c.pos {
+			p = p[:c.n-c.pos]
+		}
+		k, err := c.spill.ReadAt(p, c.pos-int64(len(c.mem)))
+		c.pos += int64(k)
+		if err == io.EOF {
+			err = nil
+		}
+		return k, err
+	}
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	if c.done {
+		return 0, io.EOF
+	}
+
+	k, err := c.f.Read(p)
+	if k > 0 {
+		werr := c.store(p[:k])
+		if werr != nil {
+			c.err = werr
+			return 0, werr
+		}
+		c.pos += int64(k)
+	}
+
+	if err == io.EOF {
+		c.done = true
+		_ = c.f.Close()
+	} else if err != nil {
+		c.err = err
+	}
+
+	return k, err
+}
+
+func (c *CachedFile) store(p []byte) error {
+
+	if room := c.limit - int64(len(c.mem)); c.spill == nil && room > 0 {
+		if int64(len(p)) > room {
+			c.mem = append(c.mem, p[:room]...)
+			c.n += room
+			p = p[room:]
+		} else {
+			c.mem = append(c.mem, p...)
+			c.n += int64(len(p))
+			return nil
+		}
+	}
+
+	if c.spill == nil {
+		var err error
+		c.spill, err = ioutil.TempFile(c.dir, "vorteil-cache-")
+		if err != nil {
+			return err
+		}
+	}
+
+	k, err := c.spill.WriteAt(p, c.n-int64(len(c.mem)))
+	c.n += int64(k)
+	return err
+}
+
+// Close ends the current pass through the file's contents. The next call to
+// Read starts again from the beginning.
+func (c *CachedFile) Close() error {
+	c.pos = 0
+	return nil
+}
+
+// Release closes the underlying File if it hasn't been read to the end, and
+// frees everything kept by the cache.
+func (c *CachedFile) Release() error {
+
+	var err error
+
+	if !c.done {
+		c.done = true
+		err = c.f.Close()
+	}
+
+	if c.spill != nil {
+		name := c.spill.Name()
+		_ = c.spill.Close()
+		_ = os.Remove(name)
+		c.spill = nil
+	}
+
+	c.mem = nil
+	c.n = 0
+	c.pos = 0
+	if c.err == nil {
+		c.err = errCacheReleased
+	}
+
+	return err
+}
@@ -0,0 +1,95 @@
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+type countingReader struct {
+	r      io.Reader
+	reads  int
+	closed bool
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads++
+	return r.r.Read(p)
+}
+
+func (r *countingReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestCachedFile(t *testing.T) {
+
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	for _, limit := range []int64{1 << 20, 1000, 1} {
+
+		src := &countingReader{r: bytes.NewReader(data)}
+		f := CacheFile(CustomFile(CustomFileArgs{
+			Name:       "data",
+			Size:       len(data),
+			ReadCloser: src,
+		}), limit, "")
+
+		if f.Name() != "data" || f.Size() != len(data) {
+			t.Fatalf("cached file doesn't match the original file")
+		}
+
+		// a partial first pass
+		part := make([]byte, 5000)
+		_, err := io.ReadFull(f, part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(part, data[:5000]) {
+			t.Fatalf("limit %d: partial read returned the wrong data", limit)
+		}
+		_ = f.Close()
+
+		for pass := 0; pass < 2; pass++ {
+			out, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Fatalf("limit %d: pass %d returned the wrong data", limit, pass)
+			}
+			_ = f.Close()
+		}
+
+		if !src.closed {
+			t.Fatalf("limit %d: underlying file wasn't closed after it was read", limit)
+		}
+
+		reads := src.reads
+		_, _ = ioutil.ReadAll(f)
+		if src.reads != reads {
+			t.Fatalf("limit %d: cached file read from the underlying file again", limit)
+		}
+
+		err = f.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = f.Read(part)
+		if err == nil {
+			t.Fatalf("limit %d: released file can still be read", limit)
+		}
+
+	}
+
+}
@@ -78,6 +78,7 @@ func Open(path string) (File, error) {
 			IsDir:      fi.IsDir(),
 			IsSymlink:  true,
 			ReadCloser: rc,
+			Mode:       fi.Mode(),
 		}), nil
 	}
 
@@ -93,6 +94,7 @@ func Open(path string) (File, error) {
 		IsDir:      fi.IsDir(),
 		IsSymlink:  false,
 		ReadCloser: f,
+		Mode:       fi.Mode(),
 	}), nil
 }
 
@@ -107,6 +109,7 @@ type CustomFileArgs struct {
 	IsSymlinkNotCached bool
 	Symlink            string
 	ReadCloser         io.ReadCloser
+	Mode               os.FileMode // permission bits, zero if unknown
 }
 
 // CustomFile makes it possible to construct a custom file
@@ -122,6 +125,7 @@ func CustomFile(args CustomFileArgs) File {
 		isSymlinkCached: !args.IsSymlinkNotCached,
 		symlink:         args.Symlink,
 		rc:              args.ReadCloser,
+		mode:            args.Mode.Perm(),
 	}
 }
 
@@ -134,6 +138,7 @@ type customFile struct {
 	isSymlinkCached bool
 	symlink         string
 	rc              io.ReadCloser
+	mode            os.FileMode
 }
 
 func (f *customFile) Name() string {
@@ -164,6 +169,10 @@ func (f *customFile) Symlink() string {
 	return f.symlink
 }
 
+func (f *customFile) Mode() os.FileMode {
+	return f.mode
+}
+
 func (f *customFile) Read(p []byte) (n int, err error) {
 	return f.rc.Read(p)
 }
@@ -175,6 +184,21 @@ func (f *customFile) Close() error {
 	return nil
 }
 
+// FileMode returns the permission bits of f if they are known, which is only
+// the case for files loaded from a real file-system with functions like Open
+// and LazyOpen, or custom files created with a Mode.
+func FileMode(f File) (os.FileMode, bool) {
+	mode := fileMode(f)
+	return mode, mode != 0
+}
+
+func fileMode(f File) os.FileMode {
+	if m, ok := f.(interface{ Mode() os.FileMode }); ok {
+		return m.Mode()
+	}
+	return 0
+}
+
 // finfo exists to implement os.FileInfo for this package's
 // FileInfo function.
 type finfo struct {
@@ -337,5 +361,6 @@ func LazyOpen(path string) (File, error) {
 		IsSymlinkNotCached: false,
 		Symlink:            lpath,
 		ReadCloser:         LazyReadCloser(openFunc, closeFunc),
+		Mode:               fi.Mode(),
 	}), nil
 }
@@ -0,0 +1,13 @@
+// +build !linux,!darwin,!freebsd
+
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+// FreeSpace returns -1 because free space can't be checked on this platform.
+func FreeSpace(dir string) (int64, error) {
+	return -1, nil
+}
@@ -0,0 +1,25 @@
+// +build linux darwin freebsd
+
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"syscall"
+)
+
+// FreeSpace returns the number of bytes available to unprivileged users on
+// the file-system containing dir.
+func FreeSpace(dir string) (int64, error) {
+
+	st := new(syscall.Statfs_t)
+	err := syscall.Statfs(dir, st)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,165 @@
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SparseChunkSize is the granularity at which a SparseWriter looks for zeroes
+// to skip. It matches the block size of most file-systems, which is the
+// smallest hole they can keep.
+const SparseChunkSize = 0x1000
+
+var zeroChunk = make([]byte, SparseChunkSize)
+
+// SparseWriter writes to a regular file while skipping regions of zeroes.
+// Seeks only move an offset kept in memory, and every write is broken into
+// chunks, with runs of chunks that aren't all zeroes written with WriteAt and
+// the rest skipped, so they end up as holes in the file. Zeroes are only
+// skipped past the furthest point data has been written to, so seeking back to
+// overwrite something is still safe. This avoids a syscall for each seek and
+// the cost of writing large empty regions, which makes up most of the time
+// spent writing a large disk image. Call Finish once everything has been
+// written to set the final length of the file.
+type SparseWriter struct {
+	f       *os.File
+	start   int64
+	off     int64
+	end     int64
+	dataEnd int64
+}
+
+// NewSparseWriter returns a SparseWriter for f, which must be a regular file.
+// Anything in f after its current offset is discarded, because skipped
+// regions must already be zeroes.
+func NewSparseWriter(f *os.File) (*SparseWriter, error) {
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("sparse output '%s' is not a regular file", f.Name())
+	}
+
+	k, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.Truncate(k)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SparseWriter{
+		f:       f,
+		start:   k,
+		off:     k,
+		end:     k,
+		dataEnd: k,
+	}, nil
+}
+
+// Write writes the chunks of p that aren't all zeroes at the current offset.
+func (w *SparseWriter) Write(p []byte) (int, error) {
+
+	var n int
+	run := -1
+
+	flush := func(i int) error {
+		if run < 0 {
+			return nil
+		}
+		_, err := w.f.WriteAt(p[run:i], w.off+int64(run))
+		if k := w.off + int64(i); k > w.dataEnd {
+			w.dataEnd = k
+		}
+		run = -1
+		return err
+	}
+
+	for n < len(p) {
+
+		l := len(p) - n
+		if l > SparseChunkSize {
+			l = SparseChunkSize
+		}
+
+		if w.off+int64(n) >= w.dataEnd && isZeroes(p[n:n+l]) {
+			if err := flush(n); err != nil {
+				return 0, err
+			}
+		} else if run < 0 {
+			run = n
+		}
+
+		n += l
+	}
+
+	if err := flush(n); err != nil {
+		return 0, err
+	}
+
+	w.off += int64(n)
+	if w.off > w.end {
+		w.end = w.off
+	}
+
+	return n, nil
+}
+
+func isZeroes(p []byte) bool {
+	return string(p) == string(zeroChunk[:len(p)])
+}
+
+// Seek implements io.Seeker. Offsets are relative to the start of the file,
+// not where the SparseWriter started.
+func (w *SparseWriter) Seek(offset int64, whence int) (int64, error) {
+
+	var k int64
+
+	switch whence {
+	case io.SeekStart:
+		k = offset
+	case io.SeekCurrent:
+		k = w.off + offset
+	case io.SeekEnd:
+		k = w.end + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if k < w.start {
+		return 0, errors.New("sparse writer cannot seek before its starting offset")
+	}
+
+	w.off = k
+	if w.off > w.end {
+		w.end = w.off
+	}
+
+	return k, nil
+}
+
+// Finish sets the length of the file to the furthest point written or sought
+// to, so that a trailing run of zeroes that was skipped is still part of the
+// file, and leaves the file's offset there.
+func (w *SparseWriter) Finish() error {
+
+	err := w.f.Truncate(w.end)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.f.Seek(w.end, io.SeekStart)
+	return err
+}
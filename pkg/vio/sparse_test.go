@@ -0,0 +1,194 @@
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// memWriteSeeker is a plain io.WriteSeeker over a byte slice, to compare a
+// SparseWriter against.
+type memWriteSeeker struct {
+	data []byte
+	off  int64
+}
+
+func (m *memWriteSeeker) Write(p []byte) (int, error) {
+	if end := m.off + int64(len(p)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	copy(m.data[m.off:], p)
+	m.off += int64(len(p))
+	return len(p), nil
+}
+
+func (m *memWriteSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.off
+	case io.SeekEnd:
+		offset += int64(len(m.data))
+	}
+	m.off = offset
+	return offset, nil
+}
+
+func TestSparseWriter(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "vorteil-sparse-*")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// stale contents must not show through skipped regions
+	_, err = f.Write(bytes.Repeat([]byte{0xff}, 3*SparseChunkSize))
+	if err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatalf("failed to seek file: %v", err)
+	}
+
+	sw, err := NewSparseWriter(f)
+	if err != nil {
+		t.Fatalf("failed to create sparse writer: %v", err)
+	}
+
+	expect := new(memWriteSeeker)
+	data := bytes.Repeat([]byte("vorteil"), 1000)
+	zeroes := make([]byte, 3*SparseChunkSize+100)
+	mixed := append(append([]byte{}, zeroes...), data...)
+
+	for _, op := range []func(w io.WriteSeeker) error{
+		func(w io.WriteSeeker) error { _, err := w.Write(zeroes); return err },
+		func(w io.WriteSeeker) error { _, err := w.Write(data); return err },
+		func(w io.WriteSeeker) error { _, err := w.Seek(5*SparseChunkSize, io.SeekCurrent); return err },
+		func(w io.WriteSeeker) error { _, err := w.Write(mixed); return err },
+		func(w io.WriteSeeker) error { _, err := w.Seek(int64(len(zeroes))+10, io.SeekStart); return err },
+		func(w io.WriteSeeker) error { _, err := w.Write(zeroes[:200]); return err },
+		func(w io.WriteSeeker) error { _, err := w.Seek(0, io.SeekEnd); return err },
+		func(w io.WriteSeeker) error { _, err := w.Write(zeroes); return err },
+	} {
+		if err := op(sw); err != nil {
+			t.Fatalf("sparse writer failed: %v", err)
+		}
+		if err := op(expect); err != nil {
+			t.Fatalf("memory writer failed: %v", err)
+		}
+	}
+
+	err = sw.Finish()
+	if err != nil {
+		t.Fatalf("failed to finish sparse writer: %v", err)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatalf("failed to seek file: %v", err)
+	}
+
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+
+	if !bytes.Equal(got, expect.data) {
+		t.Fatalf("sparse file doesn't match what was written (%d bytes, expected %d)", len(got), len(expect.data))
+	}
+
+	_, err = sw.Seek(-1, io.SeekStart)
+	if err == nil {
+		t.Fatalf("expected an error seeking before the start")
+	}
+}
+
+func TestSparseWriterNotRegular(t *testing.T) {
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	_, err = NewSparseWriter(w)
+	if err == nil {
+		t.Fatalf("expected an error using a pipe")
+	}
+}
+
+// benchmarkImage writes something shaped like a disk image to w: a little
+// metadata at the start of every 8 MiB, with the rest left empty.
+func benchmarkImage(b *testing.B, w io.WriteSeeker) {
+
+	meta := bytes.Repeat([]byte{0xa5}, 64*1024)
+	empty := make([]byte, 1024*1024)
+
+	for i := 0; i < 32; i++ {
+		if _, err := w.Write(meta); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 8; j++ {
+			if _, err := w.Write(empty); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func benchmarkFile(b *testing.B, sparse bool) {
+
+	f, err := ioutil.TempFile("", "vorteil-sparse-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	b.SetBytes(32 * (64*1024 + 8*1024*1024))
+
+	for i := 0; i < b.N; i++ {
+
+		err = f.Truncate(0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if !sparse {
+			benchmarkImage(b, f)
+			continue
+		}
+
+		sw, err := NewSparseWriter(f)
+		if err != nil {
+			b.Fatal(err)
+		}
+		benchmarkImage(b, sw)
+		err = sw.Finish()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFileWriter(b *testing.B) {
+	benchmarkFile(b, false)
+}
+
+func BenchmarkSparseWriter(b *testing.B) {
+	benchmarkFile(b, true)
+}
@@ -0,0 +1,84 @@
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Transform changes the contents of every file in a FileTree that Match
+// returns true for, by replacing them with whatever Apply reads from them.
+// Match is given the absolute path of each file, like "/etc/app.conf".
+type Transform struct {
+	Match func(path string) bool
+	Apply func(r io.Reader) (io.Reader, error)
+}
+
+// ApplyTransforms replaces the files in tree matched by transforms with their
+// transformed contents. Files are visited in the order of a Walk, and each one
+// is passed through every transform that matches it in the order they appear
+// in transforms, so the output of one is the input of the next. The first
+// error stops it, naming the file that caused it.
+//
+// Transformed contents have to be measured before the file-system they belong
+// to can be laid out, so they are kept in memory. Transforms are meant for
+// things like configuration files, not large data.
+func ApplyTransforms(tree FileTree, transforms []Transform) error {
+
+	if len(transforms) == 0 {
+		return nil
+	}
+
+	return tree.WalkNode(func(_ string, n *TreeNode) error {
+
+		f := n.File
+		if f.IsDir() || f.IsSymlink() {
+			return nil
+		}
+
+		var r io.Reader = f
+		matched := false
+
+		for _, t := range transforms {
+			if !t.Match(n.Path()) {
+				continue
+			}
+			matched = true
+			var err error
+			r, err = t.Apply(r)
+			if err != nil {
+				f.Close()
+				return fmt.Errorf("failed to transform '%s': %w", n.Path(), err)
+			}
+		}
+
+		if !matched {
+			return nil
+		}
+
+		data, err := ioutil.ReadAll(r)
+		if c, ok := r.(io.Closer); ok && r != f {
+			c.Close()
+		}
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to transform '%s': %w", n.Path(), err)
+		}
+
+		n.File = CustomFile(CustomFileArgs{
+			Name:       f.Name(),
+			Size:       len(data),
+			ModTime:    f.ModTime(),
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+			Mode:       fileMode(f),
+		})
+
+		return nil
+	})
+}
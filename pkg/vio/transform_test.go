@@ -0,0 +1,90 @@
+package vio
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestApplyTransforms(t *testing.T) {
+
+	tree := NewFileTree()
+	for path, data := range map[string]string{
+		"/etc/app.conf":  "  key = value  ",
+		"/etc/other.txt": "untouched",
+		"/app":           "binary",
+	} {
+		err := tree.Map(path, CustomFile(CustomFileArgs{
+			Name:       path[strings.LastIndex(path, "/")+1:],
+			Size:       len(data),
+			ReadCloser: ioutil.NopCloser(strings.NewReader(data)),
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf := func(path string) bool {
+		return strings.HasSuffix(path, ".conf")
+	}
+
+	apply := func(fn func(string) string) func(io.Reader) (io.Reader, error) {
+		return func(r io.Reader) (io.Reader, error) {
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			return strings.NewReader(fn(string(data))), nil
+		}
+	}
+
+	// the second transform sees the output of the first
+	err := ApplyTransforms(tree, []Transform{
+		{Match: conf, Apply: apply(strings.TrimSpace)},
+		{Match: conf, Apply: apply(func(s string) string { return "[" + s + "]" })},
+	})
+	if err != nil {
+		t.Fatalf("failed to apply transforms: %v", err)
+	}
+
+	files := make(map[string]string)
+	err = tree.Walk(func(path string, f File) error {
+		if f.IsDir() {
+			return nil
+		}
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		if len(data) != f.Size() {
+			t.Fatalf("size of '%s' is %d, but it holds %d bytes", path, f.Size(), len(data))
+		}
+		files[path] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if files["./etc/app.conf"] != "[key = value]" {
+		t.Fatalf("expected transforms to run in order, got '%s'", files["./etc/app.conf"])
+	}
+	if files["./etc/other.txt"] != "untouched" || files["./app"] != "binary" {
+		t.Fatalf("expected files that don't match to be left alone, got %v", files)
+	}
+
+	err = ApplyTransforms(tree, []Transform{{
+		Match: func(path string) bool { return path == "/app" },
+		Apply: func(r io.Reader) (io.Reader, error) { return nil, errors.New("bad input") },
+	}})
+	if err == nil || !strings.Contains(err.Error(), "/app") {
+		t.Fatalf("expected an error naming the file, got %v", err)
+	}
+}
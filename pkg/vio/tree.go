@@ -563,6 +563,7 @@ func (t *tree) Map(path string, f File) error {
 		Symlink:            f.Symlink(),
 		ModTime:            f.ModTime(),
 		ReadCloser:         f,
+		Mode:               fileMode(f),
 	})
 
 	return t.root.mapIn(path, f)
@@ -586,6 +587,7 @@ func (t *tree) MapSubTree(path string, sub FileTree) error {
 		Symlink:            f.Symlink(),
 		ModTime:            f.ModTime(),
 		ReadCloser:         f,
+		Mode:               fileMode(f),
 	})
 
 	err := t.root.mapInSubTree(path, sub)
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -368,3 +369,34 @@ func TestFileTreeMap(t *testing.T) {
 	}
 
 }
+
+func TestFileTreeMapMode(t *testing.T) {
+
+	tree := NewFileTree()
+	defer tree.Close()
+
+	err := tree.Map("a/b", CustomFile(CustomFileArgs{
+		Name:       "b",
+		ReadCloser: ioutil.NopCloser(Zeroes),
+		Mode:       0755,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modes := make(map[string]os.FileMode)
+	err = tree.Walk(func(path string, f File) error {
+		mode, ok := FileMode(f)
+		if ok {
+			modes[path] = mode
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(modes) != 1 || modes["./a/b"] != 0755 {
+		t.Errorf("FileTree.Map didn't keep file modes: %v", modes)
+	}
+}
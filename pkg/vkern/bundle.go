@@ -215,6 +215,29 @@ func (bundle *Bundle) Files() []BundleFileMetadata {
 
 }
 
+// Tags returns the tags of every optional file in the bundle, sorted and
+// without duplicates. These are the kernel features the bundle supports.
+func (bundle *Bundle) Tags() []string {
+
+	seen := make(map[string]bool)
+	tags := make([]string, 0)
+
+	for _, f := range bundle.metadata.Files {
+		for _, tag := range f.Tags {
+			tag = strings.TrimPrefix(tag, "+")
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	sort.Strings(tags)
+
+	return tags
+
+}
+
 // EarliestCompatibleCompiler ..
 func (bundle *Bundle) EarliestCompatibleCompiler() string {
 	return bundle.metadata.EarliestCompatibleCompiler
@@ -0,0 +1,136 @@
+package vorteil
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vdisk"
+	"github.com/vorteil/vorteil/pkg/vpkg"
+)
+
+// BuildOptions control how Build turns a source into a disk image.
+type BuildOptions struct {
+	SourceOptions
+
+	// Format of the disk image. The zero value is vdisk.RAWFormat.
+	Format vdisk.Format
+
+	KernelOptions vdisk.KernelOptions
+
+	// VCFGs are merged into the package's VCFG in order, so that later
+	// ones override earlier ones.
+	VCFGs []*vcfg.VCFG
+
+	// Modify, if set, is called with the package builder after the VCFGs
+	// have been merged, for any other changes to make to the package.
+	Modify func(b vpkg.Builder) error
+
+	// Strip removes debugging information and symbol tables from every ELF
+	// binary in the package's file-system.
+	Strip bool
+}
+
+func (opts *BuildOptions) format() vdisk.Format {
+	if opts.Format == "" {
+		return vdisk.RAWFormat
+	}
+	return opts.Format
+}
+
+// BuildTo builds a disk image from src and writes it to w. The source is
+// resolved with NewPackageBuilder. The kernel is loaded with vimg.GetKernel,
+// which must be set up beforehand, for example with vkern.CLI.
+func BuildTo(ctx context.Context, w io.WriteSeeker, src string, opts *BuildOptions) error {
+
+	if opts == nil {
+		opts = new(BuildOptions)
+	}
+
+	pkgb, err := NewPackageBuilder(src, &opts.SourceOptions)
+	if err != nil {
+		return err
+	}
+	defer pkgb.Close()
+
+	for _, cfg := range opts.VCFGs {
+		err = pkgb.MergeVCFG(cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Modify != nil {
+		err = opts.Modify(pkgb)
+		if err != nil {
+			return err
+		}
+	}
+
+	pkgr, err := vpkg.ReaderFromBuilder(pkgb)
+	if err != nil {
+		return err
+	}
+	defer pkgr.Close()
+
+	return vdisk.Build(ctx, w, &vdisk.BuildArgs{
+		WithVCFGDefaults: true,
+		PackageReader:    pkgr,
+		Format:           opts.format(),
+		KernelOptions:    opts.KernelOptions,
+		Logger:           opts.logger(),
+		Strip:            opts.Strip,
+		TempDir:          opts.TempDir,
+	})
+}
+
+type tempFileReader struct {
+	*os.File
+}
+
+// Close closes and deletes the temporary file.
+func (r *tempFileReader) Close() error {
+	err := r.File.Close()
+	rerr := os.Remove(r.File.Name())
+	if err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// Build builds a disk image from src and returns a reader for it. The image
+// is built in a temporary file, which is deleted when the reader is closed.
+// See BuildTo for how src is resolved.
+func Build(ctx context.Context, src string, opts *BuildOptions) (io.ReadCloser, error) {
+
+	if opts == nil {
+		opts = new(BuildOptions)
+	}
+
+	f, err := ioutil.TempFile(opts.TempDir, "vorteil-*.disk")
+	if err != nil {
+		return nil, err
+	}
+	r := &tempFileReader{File: f}
+
+	err = BuildTo(ctx, f, src, opts)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
@@ -0,0 +1,297 @@
+package vorteil
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vpkg"
+)
+
+// OCIPrefix marks a source as a package stored as an artifact in an OCI
+// registry, e.g. "oci://registry.example.com/apps/app:1.0".
+const OCIPrefix = "oci://"
+
+// Media types of the parts of a package artifact. The package file is stored
+// unchanged as the artifact's only layer, and its config is an ociConfig.
+const (
+	PackageMediaType       types.MediaType = "application/vnd.vorteil.package.v1"
+	PackageConfigMediaType types.MediaType = "application/vnd.vorteil.package.config.v1+json"
+)
+
+// ociConfig is the config of a package artifact, which describes the package
+// so that registries and tools can show what it is without downloading it.
+type ociConfig struct {
+	Info     vcfg.PackageInfo `json:"info"`
+	Kernel   string           `json:"kernel,omitempty"`
+	Programs []string         `json:"programs"`
+}
+
+// ociReference parses src, with or without OCIPrefix, as a registry
+// reference.
+func ociReference(src string) (name.Reference, error) {
+	ref, err := name.ParseReference(strings.TrimPrefix(src, OCIPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCI reference '%s': %v", src, err)
+	}
+	return ref, nil
+}
+
+// packageBlob is the package file at path, as an artifact layer.
+type packageBlob struct {
+	path   string
+	digest v1.Hash
+	size   int64
+}
+
+func (b *packageBlob) Digest() (v1.Hash, error) {
+	return b.digest, nil
+}
+
+// DiffID is the digest, because the package isn't compressed.
+func (b *packageBlob) DiffID() (v1.Hash, error) {
+	return b.digest, nil
+}
+
+func (b *packageBlob) Compressed() (io.ReadCloser, error) {
+	return os.Open(b.path)
+}
+
+func (b *packageBlob) Size() (int64, error) {
+	return b.size, nil
+}
+
+func (b *packageBlob) MediaType() (types.MediaType, error) {
+	return PackageMediaType, nil
+}
+
+// packageArtifact is an OCI image manifest with a package as its only layer,
+// which is all remote.Write needs from an image.
+type packageArtifact struct {
+	config   []byte
+	manifest []byte
+	blob     *packageBlob
+}
+
+func (a *packageArtifact) RawConfigFile() ([]byte, error) {
+	return a.config, nil
+}
+
+func (a *packageArtifact) MediaType() (types.MediaType, error) {
+	return types.OCIManifestSchema1, nil
+}
+
+func (a *packageArtifact) RawManifest() ([]byte, error) {
+	return a.manifest, nil
+}
+
+func (a *packageArtifact) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	if h != a.blob.digest {
+		return nil, fmt.Errorf("unknown blob %s", h)
+	}
+	return a.blob, nil
+}
+
+func newPackageArtifact(path string) (v1.Image, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	digest, size, err := v1.SHA256(f)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	pkgr, err := vpkg.Load(f)
+	if err != nil {
+		return nil, err
+	}
+	defer pkgr.Close()
+
+	cfg, err := vcfg.LoadFile(pkgr.VCFG())
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ociConfig{
+		Info:     cfg.Info,
+		Kernel:   cfg.VM.Kernel,
+		Programs: make([]string, 0),
+	}
+	for _, p := range cfg.Programs {
+		config.Programs = append(config.Programs, p.Binary)
+	}
+
+	configData, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	configDigest, configSize, err := v1.SHA256(bytes.NewReader(configData))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := json.Marshal(&v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIManifestSchema1,
+		Config: v1.Descriptor{
+			MediaType: PackageConfigMediaType,
+			Size:      configSize,
+			Digest:    configDigest,
+		},
+		Layers: []v1.Descriptor{{
+			MediaType: PackageMediaType,
+			Size:      size,
+			Digest:    digest,
+			Annotations: map[string]string{
+				"org.opencontainers.image.title": filepath.Base(path),
+			},
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return partial.CompressedToImage(&packageArtifact{
+		config:   configData,
+		manifest: manifest,
+		blob: &packageBlob{
+			path:   path,
+			digest: digest,
+			size:   size,
+		},
+	})
+}
+
+// PushPackage uploads the package file at path to an OCI registry as an
+// artifact, tagged as ref (with or without OCIPrefix), and returns the digest
+// of its manifest. Credentials come from the Docker config file, like they do
+// for 'docker push'.
+func PushPackage(path, ref string, opts *SourceOptions) (string, error) {
+
+	r, err := ociReference(ref)
+	if err != nil {
+		return "", err
+	}
+
+	img, err := newPackageArtifact(path)
+	if err != nil {
+		return "", err
+	}
+
+	opts.logger().Infof("Pushing package '%s' to %s", path, r)
+
+	err = remote.Write(r, img, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+
+	return digest.String(), nil
+}
+
+// fetchOCIPackage opens the package stored as an artifact at ref, returning
+// it along with its size. The digest of the package is checked as it's read.
+func fetchOCIPackage(ref string) (io.ReadCloser, int64, error) {
+
+	r, err := ociReference(ref)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	img, err := remote.Image(r, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, desc := range m.Layers {
+		if desc.MediaType != PackageMediaType {
+			continue
+		}
+
+		l, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		rc, err := l.Compressed()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return rc, desc.Size, nil
+	}
+
+	return nil, 0, fmt.Errorf("%w '%s': it holds no layer of type %s", ErrUnresolvedSource, ref, PackageMediaType)
+}
+
+// PullPackage downloads the package stored as an artifact at ref (with or
+// without OCIPrefix) to w.
+func PullPackage(ref string, w io.Writer, opts *SourceOptions) error {
+
+	rc, size, err := fetchOCIPackage(ref)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	p := opts.logger().NewProgress("Pulling package", "KiB", size)
+	_, err = io.Copy(w, p.ProxyReader(rc))
+	p.Finish(err == nil)
+
+	return err
+}
+
+// DownloadOCIPackage loads the package stored as an artifact at ref.
+func DownloadOCIPackage(ref string, opts *SourceOptions) (vpkg.Reader, error) {
+
+	rc, size, err := fetchOCIPackage(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	p := opts.logger().NewProgress("Pulling package", "KiB", size)
+
+	pkgr, err := vpkg.Load(p.ProxyReader(rc))
+	if err != nil {
+		rc.Close()
+		p.Finish(false)
+		return nil, err
+	}
+
+	return pkgr, nil
+}
@@ -0,0 +1,128 @@
+package vorteil
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/vorteil/vorteil/pkg/vcfg"
+	"github.com/vorteil/vorteil/pkg/vio"
+	"github.com/vorteil/vorteil/pkg/vpkg"
+)
+
+func TestOCIPackage(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vorteil")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := vpkg.NewBuilder()
+	data := "[info]\n  name = \"app\"\n[[program]]\n  binary = \"/app\"\n"
+	err = b.SetVCFG(vio.CustomFile(vio.CustomFileArgs{
+		Name:       "default.vcfg",
+		Size:       len(data),
+		ModTime:    time.Unix(0, 0),
+		ReadCloser: ioutil.NopCloser(strings.NewReader(data)),
+	}))
+	if err != nil {
+		t.Fatalf("failed to set vcfg: %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	err = b.Pack(buf)
+	if err != nil {
+		t.Fatalf("failed to pack package: %v", err)
+	}
+
+	path := filepath.Join(dir, "app.vorteil")
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatalf("failed to write package: %v", err)
+	}
+
+	s := httptest.NewServer(registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))))
+	defer s.Close()
+
+	ref := OCIPrefix + strings.TrimPrefix(s.URL, "http://") + "/apps/app:1.0"
+
+	st, err := GetSourceType(ref)
+	if err != nil || st != SourceOCI {
+		t.Fatalf("source '%s' resolved as %s (%v), expected %s", ref, st, err, SourceOCI)
+	}
+
+	digest, err := PushPackage(path, ref, nil)
+	if err != nil {
+		t.Fatalf("failed to push package: %v", err)
+	}
+	if !strings.HasPrefix(digest, "sha256:") {
+		t.Fatalf("unexpected digest: %s", digest)
+	}
+
+	// the config describes the package without downloading it
+	r, err := ociReference(ref)
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	img, err := remote.Image(r)
+	if err != nil {
+		t.Fatalf("failed to fetch artifact: %v", err)
+	}
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatalf("failed to fetch manifest: %v", err)
+	}
+	if m.Config.MediaType != PackageConfigMediaType {
+		t.Fatalf("unexpected config media type: %s", m.Config.MediaType)
+	}
+	raw, err := img.RawConfigFile()
+	if err != nil {
+		t.Fatalf("failed to fetch config: %v", err)
+	}
+	config := new(ociConfig)
+	err = json.Unmarshal(raw, config)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	if config.Info.Name != "app" || len(config.Programs) != 1 || config.Programs[0] != "/app" {
+		t.Fatalf("unexpected config: %s", raw)
+	}
+
+	out := new(bytes.Buffer)
+	err = PullPackage(ref, out, nil)
+	if err != nil {
+		t.Fatalf("failed to pull package: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), buf.Bytes()) {
+		t.Fatalf("pulled package doesn't match the pushed one")
+	}
+
+	pkgr, err := NewPackageReader(ref, nil)
+	if err != nil {
+		t.Fatalf("failed to open pushed package: %v", err)
+	}
+	defer pkgr.Close()
+
+	cfg, err := vcfg.LoadFile(pkgr.VCFG())
+	if err != nil {
+		t.Fatalf("failed to read vcfg: %v", err)
+	}
+	if cfg.Info.Name != "app" {
+		t.Fatalf("unexpected vcfg: %+v", cfg.Info)
+	}
+}
@@ -0,0 +1,410 @@
+package vorteil
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/vorteil/vorteil/pkg/elog"
+	"github.com/vorteil/vorteil/pkg/vpkg"
+	"github.com/vorteil/vorteil/pkg/vproj"
+)
+
+// SourceType is the kind of thing a source string refers to.
+type SourceType string
+
+// Source types.
+const (
+	SourceURL     SourceType = "URL"
+	SourceFile    SourceType = "File"
+	SourceDir     SourceType = "Dir"
+	SourceArchive SourceType = "Archive"
+	SourceOCI     SourceType = "OCI"
+	SourceInvalid SourceType = "INVALID"
+)
+
+// ErrUnresolvedSource is returned, wrapped, when a source doesn't exist or
+// can't be used as a package.
+var ErrUnresolvedSource = errors.New("failed to resolve source")
+
+// SourceOptions control how a source is resolved into a package.
+type SourceOptions struct {
+
+	// Logger reports progress downloading packages. If nil, nothing is
+	// reported.
+	Logger elog.View
+
+	// Authenticate returns the key to send to a Vorteil repository when
+	// downloading from one. If nil, requests are sent without a key.
+	Authenticate func() (string, error)
+
+	// TempDir is where temporary files are kept, like unpacked project
+	// archives and, when building, the disk image until it's read. If
+	// empty, the system's default temporary directory is used.
+	TempDir string
+}
+
+func (opts *SourceOptions) tempDir() string {
+	if opts == nil {
+		return ""
+	}
+	return opts.TempDir
+}
+
+func (opts *SourceOptions) logger() elog.View {
+	if opts == nil || opts.Logger == nil {
+		return &elog.CLI{DisableTTY: true}
+	}
+	return opts.Logger
+}
+
+// SplitSource splits a local source into its absolute path and the project
+// target named after a colon, if there is one (e.g. "./app:prod").
+func SplitSource(src string) (string, string, error) {
+
+	// Get absolute path to help with splitting
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Check if source contains a target
+	colonSplit := strings.Split(src, ":")
+	colonLength := len(colonSplit)
+
+	// Most of the time target should be here
+	target := colonSplit[len(colonSplit)-1]
+
+	// If target is src no target was provided
+	if target == src {
+		target = ""
+	}
+	if target != "" {
+		src = colonSplit[0]
+		if runtime.GOOS == "windows" {
+			src = fmt.Sprintf("%s:%s", colonSplit[0], colonSplit[1])
+			// Catches edge case when window users provide no targets because of directory
+			if colonLength == 2 {
+				target = ""
+			}
+		}
+	}
+
+	return src, target, err
+}
+
+// GetSourceType works out whether src is a URL, a package in an OCI registry,
+// a package file, or a project directory.
+func GetSourceType(src string) (SourceType, error) {
+	var err error
+	var fi os.FileInfo
+
+	// Check if Source is in an OCI registry, before it's mistaken for a URL
+	if strings.HasPrefix(src, OCIPrefix) {
+		return SourceOCI, nil
+	}
+
+	// Check if Source is a URL
+	if _, err := url.ParseRequestURI(src); err == nil {
+		if u, uErr := url.Parse(src); uErr == nil && u.Scheme != "" && u.Host != "" && u.Path != "" {
+			return SourceURL, nil
+		}
+	}
+
+	src, target, err := SplitSource(src)
+	if err != nil {
+		return SourceInvalid, err
+	}
+
+	// Check if Source is a file or dir
+	fi, err = os.Stat(src)
+	if !os.IsNotExist(err) && (fi != nil && !fi.IsDir()) {
+		if vproj.IsArchive(src) {
+			return SourceArchive, nil
+		}
+		if target != "" {
+			return SourceInvalid, errors.New("Targetable runs are unable to be used on packages")
+		}
+		return SourceFile, nil
+	} else if !os.IsNotExist(err) && (fi != nil && fi.IsDir()) {
+		return SourceDir, nil
+	}
+
+	// Source is unknown and thus is invalid
+	return SourceInvalid, err
+}
+
+// CheckRepository asks the server at src whether it is a Vorteil repository,
+// returning the value of its Vorteil-Repository header if it is.
+func CheckRepository(src string) (string, error) {
+	urlo, err := url.Parse(src)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s/info", urlo.Scheme, urlo.Host), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Info-Request", "True")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("not a new vorteil repository")
+	}
+	return resp.Header.Get("Vorteil-Repository"), nil
+}
+
+// Fetch sends a GET request for src, and returns the response if it succeeds.
+// If authenticate isn't nil, the key it returns is sent with the request.
+func Fetch(src string, authenticate func() (string, error)) (*http.Response, error) {
+	return Send("GET", src, nil, nil, authenticate)
+}
+
+// Send sends a request for src with the given method, body, and any extra
+// headers, and returns the response if it succeeds. If authenticate isn't
+// nil, the key it returns is sent with the request.
+func Send(method, src string, body io.Reader, header http.Header, authenticate func() (string, error)) (*http.Response, error) {
+
+	client := &http.Client{}
+
+	req, err := http.NewRequest(method, src, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = append(req.Header[k], v...)
+	}
+	if authenticate != nil {
+		token, err := authenticate()
+		if err != nil {
+			return nil, err
+		}
+
+		if token != "" {
+			req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, errors.New(resp.Status)
+	}
+
+	return resp, nil
+}
+
+// DownloadPackage loads the package at the URL src. The key from
+// opts.Authenticate is only sent if src is a Vorteil repository.
+func DownloadPackage(src string, opts *SourceOptions) (vpkg.Reader, error) {
+
+	newVrepo, err := CheckRepository(src)
+	if err != nil {
+		return nil, err
+	}
+
+	var authenticate func() (string, error)
+	if newVrepo == "True" && opts != nil {
+		authenticate = opts.Authenticate
+	}
+
+	resp, err := Fetch(src, authenticate)
+	if err != nil {
+		return nil, err
+	}
+
+	log := opts.logger()
+
+	var p elog.Progress
+	if resp.ContentLength == -1 {
+		p = log.NewProgress("Downloading package", "", 0)
+		defer p.Finish(true)
+	} else {
+		p = log.NewProgress("Downloading package", "KiB", resp.ContentLength)
+	}
+
+	pkgr, err := vpkg.Load(p.ProxyReader(resp.Body))
+	if err != nil {
+		resp.Body.Close()
+		p.Finish(false)
+		return nil, err
+	}
+
+	return pkgr, nil
+}
+
+// OpenPackage loads the package file at path.
+func OpenPackage(path string) (vpkg.Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w '%s'", ErrUnresolvedSource, path)
+	}
+
+	pkgr, err := vpkg.Load(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return pkgr, nil
+}
+
+func openProject(src string) (vpkg.Builder, error) {
+	path, target := vproj.Split(src)
+	proj, err := vproj.LoadProject(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w '%s'", ErrUnresolvedSource, src)
+	}
+
+	ptgt, err := proj.Target(target)
+	if err != nil {
+		return nil, err
+	}
+
+	return ptgt.NewBuilder()
+}
+
+// archivedProject is a builder for a project extracted to a temporary
+// directory, which is removed when it's closed.
+type archivedProject struct {
+	vpkg.Builder
+	dir string
+}
+
+func (p *archivedProject) Close() error {
+	err := p.Builder.Close()
+	if rerr := os.RemoveAll(p.dir); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+func openArchivedProject(src string, opts *SourceOptions) (vpkg.Builder, error) {
+	path, target := vproj.Split(src)
+
+	dir, err := ioutil.TempDir(opts.tempDir(), vproj.UnpackTempPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.logger().Debugf("Extracting project archive '%s' to '%s'", path, dir)
+
+	root, err := vproj.ExtractArchive(path, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	proj, err := vproj.LoadProject(root)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	ptgt, err := proj.Target(target)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	b, err := ptgt.NewBuilder()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return &archivedProject{Builder: b, dir: dir}, nil
+}
+
+func builderFromReader(pkgr vpkg.Reader, err error) (vpkg.Builder, error) {
+	if err != nil {
+		return nil, err
+	}
+	pkgb, err := vpkg.NewBuilderFromReader(pkgr)
+	if err != nil {
+		pkgr.Close()
+		return nil, err
+	}
+	return pkgb, nil
+}
+
+// NewPackageReader resolves src, a URL, an OCI reference (e.g.
+// "oci://registry.example.com/apps/app:1.0") or a package file, into a
+// package.
+// Project directories have to be built into a package first, so they need
+// NewPackageBuilder instead.
+func NewPackageReader(src string, opts *SourceOptions) (vpkg.Reader, error) {
+
+	sType, err := GetSourceType(src)
+	if err != nil {
+		return nil, err
+	}
+
+	switch sType {
+	case SourceURL:
+		return DownloadPackage(src, opts)
+	case SourceOCI:
+		return DownloadOCIPackage(src, opts)
+	case SourceFile:
+		return OpenPackage(src)
+	default:
+		return nil, fmt.Errorf("%w '%s'", ErrUnresolvedSource, src)
+	}
+}
+
+// NewPackageBuilder resolves src, a URL, an OCI reference, a package file, or
+// a project directory or archive (.zip or .tar.gz) with an optional target
+// (e.g. "./app:prod"), into a package builder that can be modified before it's
+// read. Archives are extracted to a temporary directory, which is removed
+// when the builder is closed.
+func NewPackageBuilder(src string, opts *SourceOptions) (vpkg.Builder, error) {
+
+	sType, err := GetSourceType(src)
+	if err != nil {
+		return nil, err
+	}
+
+	switch sType {
+	case SourceURL:
+		return builderFromReader(DownloadPackage(src, opts))
+	case SourceOCI:
+		return builderFromReader(DownloadOCIPackage(src, opts))
+	case SourceFile:
+		return builderFromReader(OpenPackage(src))
+	case SourceDir:
+		return openProject(src)
+	case SourceArchive:
+		return openArchivedProject(src, opts)
+	default:
+		return nil, fmt.Errorf("%w '%s'", ErrUnresolvedSource, src)
+	}
+}
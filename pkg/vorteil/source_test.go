@@ -0,0 +1,253 @@
+package vorteil
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetSourceType(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vorteil")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "app.vorteil")
+	err = ioutil.WriteFile(file, []byte("not a package"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	for src, expect := range map[string]SourceType{
+		"https://example.com/apps/app": SourceURL,
+		file:                           SourceFile,
+		dir:                            SourceDir,
+		dir + ":prod":                  SourceDir,
+	} {
+		st, err := GetSourceType(src)
+		if err != nil {
+			t.Fatalf("unexpected error for '%s': %v", src, err)
+		}
+		if st != expect {
+			t.Fatalf("source '%s' resolved as %s, expected %s", src, st, expect)
+		}
+	}
+
+	_, err = GetSourceType(file + ":prod")
+	if err == nil {
+		t.Fatalf("expected an error using a target with a package file")
+	}
+
+	st, err := GetSourceType(filepath.Join(dir, "missing"))
+	if err == nil || st != SourceInvalid {
+		t.Fatalf("expected a missing source to be invalid, got %s (%v)", st, err)
+	}
+
+	_, err = NewPackageReader(dir, nil)
+	if !errors.Is(err, ErrUnresolvedSource) {
+		t.Fatalf("expected a project directory not to resolve as a package reader, got %v", err)
+	}
+
+	_, err = NewPackageBuilder(dir, nil)
+	if !errors.Is(err, ErrUnresolvedSource) {
+		t.Fatalf("expected a directory without a project to be unresolved, got %v", err)
+	}
+
+	_, err = NewPackageReader(file, nil)
+	if err == nil || errors.Is(err, ErrUnresolvedSource) {
+		t.Fatalf("expected an error loading an invalid package, got %v", err)
+	}
+}
+
+func TestSplitSource(t *testing.T) {
+
+	src, target, err := SplitSource("/apps/app:prod")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if filepath.ToSlash(src) != "/apps/app" || target != "prod" {
+		t.Fatalf("split into '%s' and '%s', expected '/apps/app' and 'prod'", src, target)
+	}
+
+	_, target, err = SplitSource("/apps/app")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if target != "" {
+		t.Fatalf("expected no target, got '%s'", target)
+	}
+}
+
+func TestArchivedProject(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vorteil")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"app/.vorteilproject": "[[target]]\n\tname = \"prod\"\n\tvcfgs = [\"app.vcfg\"]\n",
+		"app/app.vcfg":        "[[program]]\n\tbinary = \"/app\"\n",
+		"app/app":             "binary",
+	}
+
+	zpath := filepath.Join(dir, "app.zip")
+	zf, err := os.Create(zpath)
+	if err != nil {
+		t.Fatalf("failed to create zip: %v", err)
+	}
+	zw := zip.NewWriter(zf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("failed to add '%s' to zip: %v", name, err)
+		}
+		_, _ = w.Write([]byte(data))
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatalf("failed to write zip: %v", err)
+	}
+	zf.Close()
+
+	tpath := filepath.Join(dir, "app.tar.gz")
+	tf, err := os.Create(tpath)
+	if err != nil {
+		t.Fatalf("failed to create tar: %v", err)
+	}
+	gz := gzip.NewWriter(tf)
+	tw := tar.NewWriter(gz)
+	for name, data := range files {
+		err = tw.WriteHeader(&tar.Header{
+			Name:     strings.TrimPrefix(name, "app/"),
+			Mode:     0644,
+			Size:     int64(len(data)),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			t.Fatalf("failed to add '%s' to tar: %v", name, err)
+		}
+		_, _ = tw.Write([]byte(data))
+	}
+	tw.Close()
+	gz.Close()
+	tf.Close()
+
+	for _, src := range []string{zpath, zpath + ":prod", tpath} {
+
+		st, err := GetSourceType(src)
+		if err != nil || st != SourceArchive {
+			t.Fatalf("source '%s' resolved as %s (%v), expected %s", src, st, err, SourceArchive)
+		}
+
+		b, err := NewPackageBuilder(src, nil)
+		if err != nil {
+			t.Fatalf("failed to open '%s': %v", src, err)
+		}
+
+		extracted := b.(*archivedProject).dir
+		if _, err = os.Stat(extracted); err != nil {
+			t.Fatalf("project wasn't extracted: %v", err)
+		}
+
+		err = b.Close()
+		if err != nil {
+			t.Fatalf("failed to close builder: %v", err)
+		}
+
+		if _, err = os.Stat(extracted); !os.IsNotExist(err) {
+			t.Fatalf("expected '%s' to be removed, got %v", extracted, err)
+		}
+	}
+
+	_, err = NewPackageBuilder(zpath+":debug", nil)
+	if err == nil {
+		t.Fatalf("expected an error for a missing target")
+	}
+
+	// entries can't escape the directory they're extracted to
+	epath := filepath.Join(dir, "evil.zip")
+	ef, err := os.Create(epath)
+	if err != nil {
+		t.Fatalf("failed to create zip: %v", err)
+	}
+	zw = zip.NewWriter(ef)
+	if _, err = zw.Create("../escaped"); err != nil {
+		t.Fatalf("failed to add to zip: %v", err)
+	}
+	zw.Close()
+	ef.Close()
+
+	_, err = NewPackageBuilder(epath, nil)
+	if err == nil {
+		t.Fatalf("expected an error extracting an entry outside of the archive")
+	}
+
+	// nor can they be written through a symlink an earlier entry created
+	outside := filepath.Join(dir, "outside")
+	if err = os.Mkdir(outside, 0777); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+
+	for i, links := range [][]string{
+		{outside},
+		{"../outside"},
+		{"sub/..", "."},
+	} {
+		spath := filepath.Join(dir, fmt.Sprintf("symlink%d.tar.gz", i))
+		sf, err := os.Create(spath)
+		if err != nil {
+			t.Fatalf("failed to create tar: %v", err)
+		}
+		gz := gzip.NewWriter(sf)
+		tw := tar.NewWriter(gz)
+		for j, target := range links {
+			err = tw.WriteHeader(&tar.Header{
+				Name:     fmt.Sprintf("link%d", j),
+				Linkname: target,
+				Typeflag: tar.TypeSymlink,
+			})
+			if err != nil {
+				t.Fatalf("failed to add symlink to tar: %v", err)
+			}
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:     fmt.Sprintf("link%d/pwned", len(links)-1),
+			Mode:     0644,
+			Size:     1,
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			t.Fatalf("failed to add file to tar: %v", err)
+		}
+		_, _ = tw.Write([]byte("x"))
+		tw.Close()
+		gz.Close()
+		sf.Close()
+
+		_, err = NewPackageBuilder(spath, nil)
+		if err == nil {
+			t.Fatalf("expected an error extracting through symlinks %v", links)
+		}
+
+		if _, err = os.Stat(filepath.Join(outside, "pwned")); !os.IsNotExist(err) {
+			t.Fatalf("expected nothing to be written outside of the archive through symlinks %v, got %v", links, err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package vpkg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+)
+
+// Icon formats recognised by IconFormat.
+const (
+	IconPNG  = "png"
+	IconJPEG = "jpeg"
+	IconGIF  = "gif"
+	IconBMP  = "bmp"
+	IconICO  = "ico"
+	IconWEBP = "webp"
+	IconSVG  = "svg"
+)
+
+var iconMagic = []struct {
+	format string
+	offset int
+	magic  []byte
+}{
+	{IconPNG, 0, []byte("\x89PNG\r\n\x1a\n")},
+	{IconJPEG, 0, []byte("\xff\xd8\xff")},
+	{IconGIF, 0, []byte("GIF87a")},
+	{IconGIF, 0, []byte("GIF89a")},
+	{IconBMP, 0, []byte("BM")},
+	{IconICO, 0, []byte("\x00\x00\x01\x00")},
+	{IconWEBP, 8, []byte("WEBP")},
+}
+
+// IconFormat works out the image format of an icon from its magic bytes,
+// returning an empty string if it isn't one of the recognised formats.
+func IconFormat(data []byte) string {
+
+	for _, m := range iconMagic {
+		if len(data) >= m.offset+len(m.magic) && bytes.Equal(data[m.offset:m.offset+len(m.magic)], m.magic) {
+			if m.format == IconWEBP && !bytes.HasPrefix(data, []byte("RIFF")) {
+				continue
+			}
+			return m.format
+		}
+	}
+
+	// SVG is text, so look for the root element near the start instead
+	head := data
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	if bytes.Contains(head, []byte("<svg")) {
+		return IconSVG
+	}
+
+	return ""
+}
@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -19,6 +20,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -41,6 +43,14 @@ identify that the file is indeed a vorteil package.
 After the package header the remainder of the file is an
 optionally compressed archive containing all of the components
 needed to produce a Vorteil disk image.
+
+Packages written to a seekable destination also store copies of
+the small metadata files (the vcfg and icon) after the archive,
+each compressed on its own as a separate gzip member. The header
+records where each of these sections can be found, so that they
+can be read without decompressing the archive's file data. Older
+readers stop at the end of the archive and never see them. The
+provenance of the package's files is only stored as a section.
 */
 const magic = 0x004c494554524f56 // "VORTEIL "
 
@@ -49,9 +59,35 @@ type header struct {
 	VersionMajor uint8
 	VersionMinor uint8
 	VersionPatch uint8
-	Pad          [501]byte
+	Flags        uint8
+	Checksum     [32]byte
+	Sections     [sectionCount]section
+	Pad          [396]byte
+}
+
+// section locates one of the separately compressed metadata sections.
+// Offset is relative to the start of the package header, Length is the
+// compressed length, and Size is the uncompressed length.
+type section struct {
+	Offset int64
+	Length int64
+	Size   int64
 }
 
+// metadata sections, in the order they are written
+const (
+	sectionVCFG = iota
+	sectionIcon
+	sectionProvenance
+	sectionCount
+)
+
+// header flags
+const (
+	flagChecksum = 0x1
+	flagSections = 0x2
+)
+
 const headerLength = 512
 
 // these path constants exist to standardize the names of
@@ -65,10 +101,13 @@ const (
 	fsPath   = "./4.fs"
 )
 
+// sectionPaths are the archive elements that are copied into sections
+var sectionPaths = [...]string{sectionVCFG: vcfgPath, sectionIcon: iconPath}
+
 // ..
 const (
 	SemverMajor    = 3
-	SemverMinor    = 0
+	SemverMinor    = 1
 	SemverRevision = 0
 )
 
@@ -138,6 +177,11 @@ type Builder interface {
 
 	MergeVCFG(cfg *vcfg.VCFG) error
 
+	// VCFG returns a copy of the package's current vcfg.
+	// Changes made to it only affect the package if it
+	// is passed back in through SetVCFG.
+	VCFG() (*vcfg.VCFG, error)
+
 	// SetIcon takes the provided vio.File and uses it
 	// as the icon for the package, overwriting any
 	// previously existing icon.
@@ -177,11 +221,31 @@ type Builder interface {
 	//	/dir/file
 	//	./dir/file
 	AddSubTreeToFS(path string, sub vio.FileTree) error
+
+	// SetBuildSecret maps f into the filesystem for the
+	// package at path like AddToFS, but marks it as only
+	// being needed while building. Build secrets are
+	// available in the filesystem of a Reader returned by
+	// ReaderFromBuilder, but they are never packed, and
+	// vdisk.Build leaves them out of the disk it writes.
+	SetBuildSecret(path string, f vio.File) error
+
+	// SetOrigin sets the Origin recorded for everything
+	// AddToFS and AddSubTreeToFS add from now on. It
+	// starts as OriginOriginal, and should be changed
+	// once the project's own files have been added, so
+	// that anything added on top of them can be told
+	// apart. See Provenance.
+	SetOrigin(origin Origin)
 }
 
 type builder struct {
 	tree             vio.FileTree
 	vcfg             vio.File
+	secrets          map[string]vio.File
+	origin           Origin
+	originals        map[string]bool
+	provenance       map[string]Origin
 	compressionLevel int
 	monitoring       MonitoringOptions
 	closeFunc        func() error
@@ -237,13 +301,29 @@ func NewBuilderFromReader(rdr Reader) (Builder, error) {
 		return nil, err
 	}
 
+	secrets := make(map[string]bool)
+	for _, path := range BuildSecrets(rdr) {
+		secrets[path] = true
+	}
+
 	err = rdr.FS().Walk(func(path string, f vio.File) error {
+		if secrets[cleanFSPath(path)] {
+			return b.SetBuildSecret(path, f)
+		}
 		return b.AddToFS(path, f)
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	if provenance := Provenance(rdr); len(provenance) > 0 {
+		bx := b.(*builder)
+		bx.provenance = make(map[string]Origin)
+		for path, origin := range provenance {
+			bx.provenance[path] = origin
+		}
+	}
+
 	return b, nil
 
 }
@@ -252,6 +332,10 @@ func (b *builder) Close() error {
 	if b.closeFunc != nil {
 		b.closeFunc()
 	}
+	for _, f := range b.secrets {
+		f.Close()
+	}
+	b.secrets = nil
 	return b.tree.Close()
 }
 
@@ -285,6 +369,27 @@ func (b *builder) MergeVCFG(cfg *vcfg.VCFG) error {
 	return nil
 }
 
+func (b *builder) VCFG() (*vcfg.VCFG, error) {
+
+	v, err := vcfg.LoadFile(b.vcfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// loading consumed the file, so it has to be replaced
+	f, err := v.File()
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.SetVCFG(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
 func (b *builder) SetIcon(f vio.File) error {
 	return b.tree.Map(iconPath, f)
 }
@@ -302,6 +407,10 @@ func (b *builder) RemoveFromFS(path string) error {
 	if path == "" {
 		return errors.New("cannot remove empty path from filesystem")
 	}
+	if b.removeBuildSecret(path) {
+		return nil
+	}
+	b.forgetOrigin(cleanFSPath(path))
 	return b.tree.Unmap(fsPath + "/" + path)
 }
 
@@ -310,9 +419,57 @@ func (b *builder) AddToFS(path string, f vio.File) error {
 	if path == "" {
 		return errors.New("cannot add empty path to filesystem")
 	}
+	b.removeBuildSecret(path)
+	b.recordOrigin(cleanFSPath(path))
 	return b.tree.Map(fsPath+"/"+path, f)
 }
 
+// cleanFSPath returns path in the form build secrets are kept in: cleaned,
+// and relative to the root of the filesystem.
+func cleanFSPath(path string) string {
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+path)), "/")
+}
+
+// removeBuildSecret closes and forgets the build secret at path, returning
+// true if there was one.
+func (b *builder) removeBuildSecret(path string) bool {
+	path = cleanFSPath(path)
+	f, ok := b.secrets[path]
+	if !ok {
+		return false
+	}
+	f.Close()
+	delete(b.secrets, path)
+	return true
+}
+
+func (b *builder) SetBuildSecret(path string, f vio.File) error {
+
+	path = cleanFSPath(path)
+	if path == "" {
+		return errors.New("cannot add empty path to filesystem")
+	}
+
+	if f.IsDir() {
+		return fmt.Errorf("build secret '%s' is a directory", path)
+	}
+
+	// a secret replaces anything already at its path
+	err := b.tree.Unmap(fsPath + "/" + path)
+	if err != nil && err != vio.ErrNodeNotFound {
+		return err
+	}
+
+	b.removeBuildSecret(path)
+
+	if b.secrets == nil {
+		b.secrets = make(map[string]vio.File)
+	}
+	b.secrets[path] = f
+
+	return nil
+}
+
 func (b *builder) AddSubTreeToFS(path string, sub vio.FileTree) error {
 	path = strings.TrimPrefix(path, "/")
 	err := sub.Walk(func(p string, f vio.File) error {
@@ -337,7 +494,27 @@ func (b *builder) Pack(w io.Writer) error {
 		return err
 	}
 
-	mw := b.monitoring.writer(w)
+	// remember where the header starts so that the checksum and
+	// section table can be written back into it
+	start := int64(-1)
+	ws, seekable := w.(io.WriteSeeker)
+	if seekable {
+		start, err = ws.Seek(0, io.SeekCurrent)
+		if err != nil {
+			start = -1
+		}
+	}
+
+	var sections [sectionCount][]byte
+	if start >= 0 {
+		sections, err = b.bufferSections()
+		if err != nil {
+			return err
+		}
+	}
+
+	out := b.monitoring.progressWriter(w)
+	mw := b.monitoring.writer(out)
 
 	hdr := new(header)
 	hdr.Magic = magic
@@ -350,7 +527,13 @@ func (b *builder) Pack(w io.Writer) error {
 		return err
 	}
 
-	gz, err := gzip.NewWriterLevel(w, b.compressionLevel)
+	var hasher hash.Hash
+	if b.monitoring.Checksum {
+		hasher = sha256.New()
+		out = io.MultiWriter(out, hasher)
+	}
+
+	gz, err := gzip.NewWriterLevel(out, b.compressionLevel)
 	if err != nil {
 		return err
 	}
@@ -368,6 +551,132 @@ func (b *builder) Pack(w io.Writer) error {
 		return err
 	}
 
+	if start >= 0 {
+		err = b.writeSections(ws, out, start, hdr, sections)
+		if err != nil {
+			return err
+		}
+	}
+
+	if hasher != nil {
+		hdr.Flags |= flagChecksum
+		copy(hdr.Checksum[:], hasher.Sum(nil))
+		b.monitoring.emitChecksum(hdr)
+	}
+
+	if start >= 0 {
+		err = rewriteHeader(ws, start, hdr)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bufferSections reads the files that get their own metadata sections into
+// memory, mapping copies back into the tree so that they can be written
+// into both the archive and their sections.
+func (b *builder) bufferSections() ([sectionCount][]byte, error) {
+
+	var sections [sectionCount][]byte
+
+	files := make(map[string]vio.File)
+	err := b.tree.Walk(func(path string, f vio.File) error {
+		if path == fsPath {
+			return vio.ErrSkip
+		}
+		files[path] = f
+		return nil
+	})
+	if err != nil {
+		return sections, err
+	}
+
+	for i, path := range sectionPaths {
+
+		f, ok := files[path]
+		if !ok || f.IsDir() {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return sections, err
+		}
+
+		cp := vio.CustomFile(vio.CustomFileArgs{
+			Name:       f.Name(),
+			Size:       len(data),
+			ModTime:    f.ModTime(),
+			ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+		})
+
+		if path == vcfgPath {
+			err = b.SetVCFG(cp)
+		} else {
+			err = b.tree.Map(path, cp)
+		}
+		if err != nil {
+			return sections, err
+		}
+
+		sections[i] = data
+	}
+
+	data, err := b.provenanceData()
+	if err != nil {
+		return sections, err
+	}
+	sections[sectionProvenance] = data
+
+	return sections, nil
+}
+
+// writeSections writes each non-empty section to out as a gzip member of its
+// own, recording where it was written in hdr.
+func (b *builder) writeSections(ws io.WriteSeeker, out io.Writer, start int64, hdr *header, sections [sectionCount][]byte) error {
+
+	for i, data := range sections {
+
+		if len(data) == 0 {
+			continue
+		}
+
+		offset, err := ws.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+
+		gz, err := gzip.NewWriterLevel(out, b.compressionLevel)
+		if err != nil {
+			return err
+		}
+
+		_, err = gz.Write(data)
+		if err != nil {
+			return err
+		}
+
+		err = gz.Close()
+		if err != nil {
+			return err
+		}
+
+		end, err := ws.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+
+		hdr.Sections[i] = section{
+			Offset: offset - start,
+			Length: end - offset,
+			Size:   int64(len(data)),
+		}
+	}
+
+	hdr.Flags |= flagSections
+
 	return nil
 }
 
@@ -416,10 +725,77 @@ type PreProcessReport struct {
 // Errors returned by the PreCompressionWriter will cause
 // the Builder.Pack operation to fail, which means this
 // writer can also be used to cancel a job.
+//
+// If not nil, ProgressCallback is called every time data is
+// written to the package's destination, with the total number
+// of (compressed) bytes written so far. If an error is
+// returned the Builder.Pack operation will fail.
+//
+// If Checksum is true a SHA-256 digest is computed over
+// everything following the package header. If the
+// io.Writer provided to Builder.Pack is also an io.Seeker
+// the digest is written back into the header, where Info
+// can read it. Either way, the hex-encoded digest is passed
+// to the ChecksumCallback if one is provided.
 type MonitoringOptions struct {
 	PreProcessCompleteCallback func(report PreProcessReport) error
 	NextFileCallback           func(path string, fi os.FileInfo) error
 	PreCompressionWriter       io.Writer
+	ProgressCallback           func(written int64) error
+	Checksum                   bool
+	ChecksumCallback           func(sum string)
+}
+
+type progressWriter struct {
+	w       io.Writer
+	written int64
+	fn      func(written int64) error
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, pw.fn(pw.written)
+}
+
+func (opts *MonitoringOptions) progressWriter(w io.Writer) io.Writer {
+	if opts.ProgressCallback == nil {
+		return w
+	}
+	return &progressWriter{w: w, fn: opts.ProgressCallback}
+}
+
+// emitChecksum reports the checksum in hdr to the ChecksumCallback.
+func (opts *MonitoringOptions) emitChecksum(hdr *header) {
+	if opts.ChecksumCallback != nil {
+		opts.ChecksumCallback(hex.EncodeToString(hdr.Checksum[:]))
+	}
+}
+
+// rewriteHeader replaces the header that was written at offset start with
+// hdr, leaving ws positioned where it was.
+func rewriteHeader(ws io.WriteSeeker, start int64, hdr *header) error {
+
+	end, err := ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	_, err = ws.Seek(start, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(ws, binary.LittleEndian, hdr)
+	if err != nil {
+		return err
+	}
+
+	_, err = ws.Seek(end, io.SeekStart)
+	return err
 }
 
 func (opts *MonitoringOptions) preprocess(b Builder) error {
@@ -530,10 +906,12 @@ type Reader interface {
 }
 
 type reader struct {
-	closeFunc func() error
-	vcfg      vio.File
-	icon      vio.File
-	fs        vio.FileTree
+	closeFunc  func() error
+	vcfg       vio.File
+	icon       vio.File
+	fs         vio.FileTree
+	secrets    []string
+	provenance map[string]Origin
 }
 
 func (r *reader) Close() error {
@@ -597,6 +975,21 @@ func ReaderFromBuilder(b Builder) (Reader, error) {
 		return nil, err
 	}
 
+	// the builder is consumed by the reader, so its build secrets can be
+	// mapped straight into the shared tree
+	for path, f := range bx.secrets {
+		err = rdr.fs.Map(path, f)
+		if err != nil {
+			return nil, err
+		}
+		rdr.secrets = append(rdr.secrets, path)
+	}
+	bx.secrets = nil
+	sort.Strings(rdr.secrets)
+
+	rdr.provenance = bx.provenance
+	bx.provenance = nil
+
 	return rdr, nil
 
 }
@@ -620,6 +1013,13 @@ func ReaderFromBuilder(b Builder) (Reader, error) {
 // logic makes use of the entire contents of the package.
 // If it is important to consume the entire stream, you may
 // want to io.Copy(ioutil.Discard, r) before closing it.
+//
+// If the io.Reader is also an io.ReaderAt and an io.Seeker,
+// such as an *os.File, the vcfg and icon are read from their
+// own sections when the package has them, and closing the
+// Reader doesn't decompress whatever remains of the archive.
+// Reading metadata from a large package this way only costs
+// as much as the metadata itself.
 func Load(r io.Reader) (Reader, error) {
 
 	var err error
@@ -638,13 +1038,36 @@ func Load(r io.Reader) (Reader, error) {
 		return nil, ErrVersionNotSupported
 	}
 
+	ra, seekable := r.(readSeekerAt)
+
+	var base int64
+	if seekable {
+		base, err = ra.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		base -= headerLength
+	}
+
 	gz, err := gzip.NewReader(r)
 	if err != nil {
 		return nil, err
 	}
 	defer gz.Close()
 
-	tree, err := vio.LoadArchive(gz)
+	// sections follow the archive as separate gzip members
+	if hdr.Flags&flagSections != 0 {
+		gz.Multistream(false)
+	}
+
+	// the tree drains its reader on close if it can, which isn't
+	// necessary if the underlying reader can seek
+	var archive io.Reader = gz
+	if seekable {
+		archive = struct{ io.Reader }{gz}
+	}
+
+	tree, err := vio.LoadArchive(archive)
 	if err != nil {
 		return nil, err
 	}
@@ -674,6 +1097,30 @@ func Load(r io.Reader) (Reader, error) {
 		return nil, err
 	}
 
+	if seekable && hdr.Flags&flagSections != 0 {
+		rdr.vcfg, err = loadSection(ra, base, hdr.Sections[sectionVCFG], rdr.vcfg)
+		if err != nil {
+			return nil, err
+		}
+
+		rdr.icon, err = loadSection(ra, base, hdr.Sections[sectionIcon], rdr.icon)
+		if err != nil {
+			return nil, err
+		}
+
+		if s := hdr.Sections[sectionProvenance]; s.Length != 0 {
+			data, err := readSection(ra, base, s, "provenance")
+			if err != nil {
+				return nil, err
+			}
+
+			rdr.provenance, err = loadProvenance(data)
+			if err != nil {
+				return nil, fmt.Errorf("%w: corrupt provenance: %v", ErrNotAPackage, err)
+			}
+		}
+	}
+
 	rdr.fs, err = tree.SubTree(fsPath)
 	if err != nil {
 		return nil, err
@@ -683,6 +1130,63 @@ func Load(r io.Reader) (Reader, error) {
 
 }
 
+type readSeekerAt interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// loadSection reads the section s of the package that starts at offset base
+// in r, returning a file with its contents that replaces f, the copy of it
+// found in the archive. If the section is empty f is returned unchanged.
+func loadSection(r io.ReaderAt, base int64, s section, f vio.File) (vio.File, error) {
+
+	if f == nil || s.Length == 0 {
+		return f, nil
+	}
+
+	data, err := readSection(r, base, s, f.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) != f.Size() {
+		return nil, fmt.Errorf("%w: section for %s has the wrong size", ErrNotAPackage, f.Name())
+	}
+
+	sf := vio.CustomFile(vio.CustomFileArgs{
+		Name:       f.Name(),
+		Size:       len(data),
+		ModTime:    f.ModTime(),
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+	})
+
+	f.Close()
+
+	return sf, nil
+}
+
+// readSection reads and decompresses the section s of the package that starts
+// at offset base in r. The name is only used in errors.
+func readSection(r io.ReaderAt, base int64, s section, name string) ([]byte, error) {
+
+	gz, err := gzip.NewReader(io.NewSectionReader(r, base+s.Offset, s.Length))
+	if err != nil {
+		return nil, fmt.Errorf("%w: corrupt section for %s: %v", ErrNotAPackage, name, err)
+	}
+	defer gz.Close()
+
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, fmt.Errorf("%w: corrupt section for %s: %v", ErrNotAPackage, name, err)
+	}
+
+	if int64(len(data)) != s.Size {
+		return nil, fmt.Errorf("%w: section for %s has the wrong size", ErrNotAPackage, name)
+	}
+
+	return data, nil
+}
+
 // VCFG ..
 func (r *reader) VCFG() vio.File {
 	return r.vcfg
@@ -705,6 +1209,94 @@ func (r *reader) FS() vio.FileTree {
 	return r.fs
 }
 
+// PackageInfo contains information read from a package header.
+type PackageInfo struct {
+	Version  string
+	Checksum string // hex-encoded SHA-256, empty if the package wasn't packed with one
+}
+
+// Info reads the header from the start of a package and returns the
+// information it contains, without reading the rest of the package.
+func Info(r io.Reader) (*PackageInfo, error) {
+
+	hdr := new(header)
+	err := binary.Read(r, binary.LittleEndian, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.Magic != magic {
+		return nil, ErrNotAPackage
+	}
+
+	return hdr.info(), nil
+}
+
+func (hdr *header) info() *PackageInfo {
+
+	info := &PackageInfo{
+		Version: fmt.Sprintf("%d.%d.%d", hdr.VersionMajor, hdr.VersionMinor, hdr.VersionPatch),
+	}
+
+	if hdr.Flags&flagChecksum != 0 {
+		info.Checksum = hex.EncodeToString(hdr.Checksum[:])
+	}
+
+	return info
+}
+
+// ErrChecksumMismatch is returned when the contents of a package don't match
+// the checksum in its header.
+var ErrChecksumMismatch = errors.New("package checksum mismatch")
+
+// Copy streams the package read from r to w without loading it, and returns
+// the information from its header. If the header has a checksum the contents
+// are verified against it as they're copied, and ErrChecksumMismatch is
+// returned if they don't match, but only once everything has been written to
+// w. Callers that need to discard a bad copy should write it somewhere they
+// can throw away, like a vio.AtomicFile.
+//
+// Packages without a checksum are copied without being verified, which the
+// caller can detect from the returned PackageInfo.
+func Copy(w io.Writer, r io.Reader) (*PackageInfo, error) {
+
+	buf := make([]byte, headerLength)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotAPackage
+		}
+		return nil, err
+	}
+
+	hdr := new(header)
+	err = binary.Read(bytes.NewReader(buf), binary.LittleEndian, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.Magic != magic {
+		return nil, ErrNotAPackage
+	}
+
+	_, err = w.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(w, hasher), r)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.Flags&flagChecksum != 0 && !bytes.Equal(hasher.Sum(nil), hdr.Checksum[:]) {
+		return nil, ErrChecksumMismatch
+	}
+
+	return hdr.info(), nil
+}
+
 // ComputeHash ..
 func ComputeHash(r io.Reader) (string, error) {
 
@@ -732,6 +1324,20 @@ func ComputeHash(r io.Reader) (string, error) {
 	return hasher.String(), nil
 }
 
+// BuildSecrets returns the paths, relative to the root of the filesystem, of
+// the build secrets in r's filesystem. Only Readers returned by
+// ReaderFromBuilder can hold build secrets.
+func BuildSecrets(r Reader) []string {
+	switch x := r.(type) {
+	case *reader:
+		return x.secrets
+	case *peekVCFGReader:
+		return BuildSecrets(x.Reader)
+	default:
+		return nil
+	}
+}
+
 type peekVCFGReader struct {
 	vcfg     vio.File
 	vcfgdata []byte
@@ -0,0 +1,445 @@
+package vpkg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+func testBuilder(t *testing.T) Builder {
+	b := NewBuilder()
+	data := "[[program]]\n  binary = \"/app\"\n"
+	err := b.SetVCFG(vio.CustomFile(vio.CustomFileArgs{
+		Name:       "default.vcfg",
+		Size:       len(data),
+		ModTime:    time.Unix(0, 0),
+		ReadCloser: ioutil.NopCloser(strings.NewReader(data)),
+	}))
+	assert.NoError(t, err)
+	return b
+}
+
+func TestPackChecksum(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "vpkg-test")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	var sum string
+	var written int64
+
+	b := testBuilder(t)
+	b.SetMonitoringOptions(MonitoringOptions{
+		Checksum:         true,
+		ChecksumCallback: func(s string) { sum = s },
+		ProgressCallback: func(n int64) error {
+			written = n
+			return nil
+		},
+	})
+
+	err = b.Pack(f)
+	assert.NoError(t, err)
+
+	end, err := f.Seek(0, io.SeekCurrent)
+	assert.NoError(t, err)
+	assert.Equal(t, end, written)
+
+	_, err = f.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+
+	info, err := Info(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "3.1.0", info.Version)
+	assert.Equal(t, sum, info.Checksum)
+
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, f)
+	assert.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(hasher.Sum(nil)), info.Checksum)
+
+	// the package must still load normally
+	_, err = f.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	_, err = Load(f)
+	assert.NoError(t, err)
+
+}
+
+func TestPackWithoutChecksum(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "vpkg-test")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = testBuilder(t).Pack(f)
+	assert.NoError(t, err)
+
+	_, err = f.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+
+	info, err := Info(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "", info.Checksum)
+
+}
+
+func TestPackSections(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "vpkg-test")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	icon := "\x89PNG\r\n\x1a\n"
+
+	b := testBuilder(t)
+	assert.NoError(t, b.SetIcon(vio.CustomFile(vio.CustomFileArgs{
+		Name:       "icon.png",
+		Size:       len(icon),
+		ReadCloser: ioutil.NopCloser(strings.NewReader(icon)),
+	})))
+	assert.NoError(t, b.AddToFS("/app", vio.CustomFile(vio.CustomFileArgs{
+		Name:       "app",
+		Size:       3,
+		ReadCloser: ioutil.NopCloser(strings.NewReader("app")),
+	})))
+	assert.NoError(t, b.Pack(f))
+	assert.NoError(t, b.Close())
+
+	_, err = f.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	hdr := new(header)
+	assert.NoError(t, binary.Read(f, binary.LittleEndian, hdr))
+	assert.NotZero(t, hdr.Flags&flagSections)
+	assert.NotZero(t, hdr.Sections[sectionVCFG].Length)
+	assert.Equal(t, int64(len(icon)), hdr.Sections[sectionIcon].Size)
+
+	// the metadata comes from the sections, so it's still readable after
+	// the archive has been read past it
+	_, err = f.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	rdr, err := Load(f)
+	assert.NoError(t, err)
+
+	err = rdr.FS().Walk(func(path string, f vio.File) error {
+		_, err := ioutil.ReadAll(f)
+		return err
+	})
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadAll(rdr.VCFG())
+	assert.NoError(t, err)
+	assert.Equal(t, "[[program]]\n  binary = \"/app\"\n", string(data))
+	assert.Equal(t, "1.vcfg", rdr.VCFG().Name())
+
+	data, err = ioutil.ReadAll(rdr.Icon())
+	assert.NoError(t, err)
+	assert.Equal(t, icon, string(data))
+	assert.NoError(t, rdr.Close())
+
+	// readers that can't seek ignore the sections
+	f, err = os.Open(f.Name())
+	assert.NoError(t, err)
+	defer f.Close()
+	rdr, err = Load(struct{ io.Reader }{f})
+	assert.NoError(t, err)
+	data, err = ioutil.ReadAll(rdr.VCFG())
+	assert.NoError(t, err)
+	assert.Equal(t, "[[program]]\n  binary = \"/app\"\n", string(data))
+
+	// packages written to a stream don't have sections
+	buf := new(bytes.Buffer)
+	assert.NoError(t, testBuilder(t).Pack(buf))
+	assert.NoError(t, binary.Read(buf, binary.LittleEndian, hdr))
+	assert.Zero(t, hdr.Flags&flagSections)
+
+}
+
+func TestCopy(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "vpkg-test")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	b := testBuilder(t)
+	b.SetMonitoringOptions(MonitoringOptions{Checksum: true})
+	assert.NoError(t, b.Pack(f))
+
+	data, err := ioutil.ReadFile(f.Name())
+	assert.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	info, err := Copy(buf, bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, info.Checksum)
+	assert.Equal(t, data, buf.Bytes())
+
+	// corrupt the last byte of the package
+	bad := append([]byte(nil), data...)
+	bad[len(bad)-1] ^= 0xff
+	_, err = Copy(ioutil.Discard, bytes.NewReader(bad))
+	assert.Equal(t, ErrChecksumMismatch, err)
+
+	_, err = Copy(ioutil.Discard, strings.NewReader("not a package"))
+	assert.Equal(t, ErrNotAPackage, err)
+
+	// packages without a checksum can't be verified
+	buf.Reset()
+	assert.NoError(t, testBuilder(t).Pack(buf))
+	info, err = Copy(ioutil.Discard, buf)
+	assert.NoError(t, err)
+	assert.Empty(t, info.Checksum)
+
+}
+
+func TestBuildSecret(t *testing.T) {
+
+	file := func(data string) vio.File {
+		return vio.CustomFile(vio.CustomFileArgs{
+			Name:       "f",
+			Size:       len(data),
+			ModTime:    time.Unix(0, 0),
+			ReadCloser: ioutil.NopCloser(strings.NewReader(data)),
+		})
+	}
+
+	paths := func(tree vio.FileTree) []string {
+		var out []string
+		err := tree.Walk(func(path string, f vio.File) error {
+			if !f.IsDir() {
+				out = append(out, path)
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		return out
+	}
+
+	// packed packages leave build secrets out
+	b := testBuilder(t)
+	assert.NoError(t, b.AddToFS("/etc/app.conf", file("conf")))
+	assert.NoError(t, b.SetBuildSecret("/etc/token", file("secret")))
+
+	buf := new(bytes.Buffer)
+	assert.NoError(t, b.Pack(buf))
+	assert.NoError(t, b.Close())
+
+	rdr, err := Load(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"./etc/app.conf"}, paths(rdr.FS()))
+	assert.Empty(t, BuildSecrets(rdr))
+
+	// readers from builders have them, and know which files they are
+	b = testBuilder(t)
+	assert.NoError(t, b.AddToFS("/etc/app.conf", file("conf")))
+	assert.NoError(t, b.AddToFS("/etc/token", file("old")))
+	assert.NoError(t, b.SetBuildSecret("/etc/token", file("secret")))
+
+	rdr, err = ReaderFromBuilder(b)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"./etc/app.conf", "./etc/token"}, paths(rdr.FS()))
+	assert.Equal(t, []string{"etc/token"}, BuildSecrets(rdr))
+
+	rdr, err = PeekVCFG(rdr)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"etc/token"}, BuildSecrets(rdr))
+
+	// adding a regular file over a secret replaces it
+	b = testBuilder(t)
+	assert.NoError(t, b.SetBuildSecret("etc/token", file("secret")))
+	assert.NoError(t, b.AddToFS("/etc/token", file("public")))
+
+	rdr, err = ReaderFromBuilder(b)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"./etc/token"}, paths(rdr.FS()))
+	assert.Empty(t, BuildSecrets(rdr))
+
+}
+
+func TestIconFormat(t *testing.T) {
+
+	for data, format := range map[string]string{
+		"\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR":             IconPNG,
+		"\xff\xd8\xff\xe0\x00\x10JFIF":                      IconJPEG,
+		"GIF89a\x01\x00\x01\x00":                            IconGIF,
+		"\x00\x00\x01\x00\x01\x00\x10\x10":                  IconICO,
+		"RIFF\x24\x00\x00\x00WEBPVP8 ":                      IconWEBP,
+		"<?xml version=\"1.0\"?>\n<svg xmlns=\"http://x\">": IconSVG,
+		"RIFF\x24\x00\x00\x00WAVEfmt ":                      "",
+		"not an image":                                      "",
+		"":                                                  "",
+	} {
+		assert.Equal(t, format, IconFormat([]byte(data)), "%q", data)
+	}
+
+}
+
+func TestProvenance(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "vpkg-test")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	file := func(data string) vio.File {
+		return vio.CustomFile(vio.CustomFileArgs{
+			Name:       "f",
+			Size:       len(data),
+			ModTime:    time.Unix(0, 0),
+			ReadCloser: ioutil.NopCloser(strings.NewReader(data)),
+		})
+	}
+
+	b := testBuilder(t)
+	assert.NoError(t, b.AddToFS("/app", file("app")))
+	assert.NoError(t, b.AddToFS("/etc/app.conf", file("conf")))
+
+	b.SetOrigin(OriginInjected)
+	assert.NoError(t, b.AddToFS("/etc/app.conf", file("override")))
+	assert.NoError(t, b.AddToFS("/data/seed", file("seed")))
+	b.SetOrigin(OriginOriginal)
+
+	assert.NoError(t, b.Pack(f))
+	assert.NoError(t, b.Close())
+
+	expect := map[string]Origin{
+		"etc/app.conf": OriginMerged,
+		"data/seed":    OriginInjected,
+		"data":         OriginInjected,
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	rdr, err := Load(f)
+	assert.NoError(t, err)
+	assert.Equal(t, expect, Provenance(rdr))
+
+	// it survives being rebuilt, and injecting again over injected files
+	// doesn't make them merged
+	b, err = NewBuilderFromReader(rdr)
+	assert.NoError(t, err)
+	b.SetOrigin(OriginInjected)
+	assert.NoError(t, b.AddToFS("/data/seed", file("new seed")))
+	assert.NoError(t, b.RemoveFromFS("/etc/app.conf"))
+
+	rdr, err = ReaderFromBuilder(b)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]Origin{
+		"data/seed": OriginInjected,
+		"data":      OriginInjected,
+	}, Provenance(rdr))
+	assert.NoError(t, rdr.Close())
+
+	// packages without anything added on top don't record any
+	buf := new(bytes.Buffer)
+	assert.NoError(t, testBuilder(t).Pack(buf))
+	rdr, err = Load(buf)
+	assert.NoError(t, err)
+	assert.Empty(t, Provenance(rdr))
+
+}
+
+func TestRebase(t *testing.T) {
+
+	file := func(data string) vio.File {
+		return vio.CustomFile(vio.CustomFileArgs{
+			Name:       "f",
+			Size:       len(data),
+			ModTime:    time.Unix(0, 0),
+			ReadCloser: ioutil.NopCloser(strings.NewReader(data)),
+		})
+	}
+
+	pack := func(files map[string]string) Reader {
+		b := testBuilder(t)
+		for path, data := range files {
+			assert.NoError(t, b.AddToFS(path, file(data)))
+		}
+		buf := new(bytes.Buffer)
+		assert.NoError(t, b.Pack(buf))
+		assert.NoError(t, b.Close())
+		rdr, err := Load(buf)
+		assert.NoError(t, err)
+		return rdr
+	}
+
+	oldBase := map[string]string{
+		"/lib/libc.so":    "libc 1",
+		"/etc/base.conf":  "base",
+		"/etc/shared":     "shared 1",
+		"/usr/share/gone": "gone",
+	}
+	app := map[string]string{
+		"/lib/libc.so":   "libc 1",
+		"/etc/base.conf": "base",
+		"/etc/shared":    "shared by app",
+		"/app":           "app",
+	}
+	newBase := map[string]string{
+		"/lib/libc.so":    "libc 2",
+		"/etc/base.conf":  "base",
+		"/etc/shared":     "shared 2",
+		"/usr/share/gone": "gone",
+		"/etc/new.conf":   "new",
+	}
+
+	oldDigests, err := FSDigests(pack(oldBase))
+	assert.NoError(t, err)
+	newDigests, err := FSDigests(pack(newBase))
+	assert.NoError(t, err)
+
+	b, err := NewBuilderFromReader(pack(newBase))
+	assert.NoError(t, err)
+
+	report, err := Rebase(b, pack(app), oldDigests, newDigests, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/app", "/etc/shared", "/usr", "/usr/share", "/usr/share/gone"}, report.Changes)
+	assert.Equal(t, []RebaseConflict{
+		{Path: "/etc/shared", App: ChangeModified, Base: ChangeModified},
+	}, report.Conflicts)
+
+	rdr, err := ReaderFromBuilder(b)
+	assert.NoError(t, err)
+	defer rdr.Close()
+
+	files := make(map[string]string)
+	err = rdr.FS().Walk(func(path string, f vio.File) error {
+		if f.IsDir() {
+			return nil
+		}
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		files[strings.TrimPrefix(path, ".")] = string(data)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"/lib/libc.so":   "libc 2",
+		"/etc/base.conf": "base",
+		"/etc/shared":    "shared by app",
+		"/etc/new.conf":  "new",
+		"/app":           "app",
+	}, files)
+
+}
@@ -0,0 +1,129 @@
+package vpkg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// Origin describes where a file in a package's filesystem came from.
+type Origin string
+
+// Origins recorded by a Builder.
+const (
+	// OriginOriginal files were part of the project or package the Builder
+	// started from.
+	OriginOriginal Origin = "original"
+
+	// OriginInjected files were added on top of it, at a path that didn't
+	// exist before, like files added with the CLI's --files flag.
+	OriginInjected Origin = "injected"
+
+	// OriginMerged files were added on top of it over something that was
+	// already there, replacing a file or adding to a directory.
+	OriginMerged Origin = "merged"
+)
+
+// Provenance returns the origin of every file in r's filesystem that isn't
+// OriginOriginal, keyed by its path relative to the root of the filesystem.
+// Packages only keep their provenance if they were packed to a destination
+// that can seek, like a file.
+func Provenance(r Reader) map[string]Origin {
+	switch x := r.(type) {
+	case *reader:
+		return x.provenance
+	case *peekVCFGReader:
+		return Provenance(x.Reader)
+	default:
+		return nil
+	}
+}
+
+func (b *builder) SetOrigin(origin Origin) {
+
+	// remember what was there before anything is added on top of it
+	if origin != OriginOriginal && b.originals == nil {
+		b.originals = make(map[string]bool)
+		_ = b.tree.Walk(func(p string, f vio.File) error {
+			if strings.HasPrefix(p, fsPath+"/") {
+				b.originals[cleanFSPath(strings.TrimPrefix(p, fsPath))] = true
+			}
+			return nil
+		})
+	}
+
+	b.origin = origin
+}
+
+// recordOrigin records the current origin of the file being added at p, which
+// must already be cleaned with cleanFSPath.
+func (b *builder) recordOrigin(p string) {
+
+	if b.origin == "" || b.origin == OriginOriginal {
+		if b.originals != nil {
+			b.originals[p] = true
+		}
+		delete(b.provenance, p)
+		return
+	}
+
+	if b.provenance == nil {
+		b.provenance = make(map[string]Origin)
+	}
+
+	switch {
+	case b.provenance[p] != "":
+		// already added on top, and still is
+	case b.originals[p]:
+		b.provenance[p] = OriginMerged
+	default:
+		b.provenance[p] = OriginInjected
+	}
+
+	// parent directories created along the way were injected too
+	for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if b.originals[dir] || b.provenance[dir] != "" {
+			break
+		}
+		b.provenance[dir] = OriginInjected
+	}
+}
+
+// forgetOrigin forgets the recorded origin of p, and of everything under it.
+func (b *builder) forgetOrigin(p string) {
+	for k := range b.provenance {
+		if k == p || strings.HasPrefix(k, p+"/") {
+			delete(b.provenance, k)
+		}
+	}
+	for k := range b.originals {
+		if k == p || strings.HasPrefix(k, p+"/") {
+			delete(b.originals, k)
+		}
+	}
+}
+
+// provenanceData encodes the builder's provenance for its section, or returns
+// nil if everything is original.
+func (b *builder) provenanceData() ([]byte, error) {
+	if len(b.provenance) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(b.provenance)
+}
+
+func loadProvenance(data []byte) (map[string]Origin, error) {
+	provenance := make(map[string]Origin)
+	err := json.Unmarshal(data, &provenance)
+	if err != nil {
+		return nil, err
+	}
+	return provenance, nil
+}
@@ -0,0 +1,237 @@
+package vpkg
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/vorteil/vorteil/pkg/vio"
+)
+
+// Changes to a path in a package's filesystem, as reported in a
+// RebaseConflict.
+const (
+	ChangeAdded    = "added"
+	ChangeModified = "modified"
+	ChangeRemoved  = "removed"
+)
+
+// RebaseConflict is a path that both the app and the new base changed from
+// the old base, in different ways. The app's version is the one kept.
+type RebaseConflict struct {
+	Path string
+	App  string
+	Base string
+}
+
+// RebaseReport describes what Rebase did.
+type RebaseReport struct {
+	// Changes are the paths the app changed from the old base, which were
+	// reapplied over the new base.
+	Changes []string
+
+	// Conflicts are the paths among Changes that the new base changed as
+	// well.
+	Conflicts []RebaseConflict
+}
+
+// digest returns a string that is the same for two files only if they have
+// the same type, permissions, and contents. It reads f to the end.
+func digest(f vio.File) (string, error) {
+
+	mode, _ := vio.FileMode(f)
+	mode &= (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+
+	if f.IsDir() {
+		return fmt.Sprintf("dir %o", mode), nil
+	}
+
+	if f.IsSymlink() && f.SymlinkIsCached() {
+		return fmt.Sprintf("symlink %s", f.Symlink()), nil
+	}
+
+	h := sha256.New()
+	_, err := io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	kind := "file"
+	if f.IsSymlink() {
+		kind = "symlink"
+	}
+
+	return fmt.Sprintf("%s %o %s", kind, mode, hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// FSDigests returns a digest of everything in r's filesystem, keyed by its
+// path relative to the root of the filesystem, for use with Rebase. It reads
+// the whole filesystem.
+func FSDigests(r Reader) (map[string]string, error) {
+
+	secrets := make(map[string]bool)
+	for _, path := range BuildSecrets(r) {
+		secrets[path] = true
+	}
+
+	digests := make(map[string]string)
+
+	err := r.FS().Walk(func(path string, f vio.File) error {
+		path = cleanFSPath(path)
+		if path == "" || secrets[path] {
+			return nil
+		}
+		d, err := digest(f)
+		if err != nil {
+			return fmt.Errorf("failed to read '/%s': %w", path, err)
+		}
+		digests[path] = d
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return digests, nil
+}
+
+// rebaseFile is a file of the app that is being reapplied over the new base.
+// The archive it came from can't be read again, so its contents are cached
+// until it's packed.
+type rebaseFile struct {
+	*vio.CachedFile
+}
+
+func (f *rebaseFile) Close() error {
+	return f.CachedFile.Release()
+}
+
+// change describes how a path changed between two digests.
+func change(from, to string) string {
+	switch {
+	case from == "":
+		return ChangeAdded
+	case to == "":
+		return ChangeRemoved
+	default:
+		return ChangeModified
+	}
+}
+
+// Rebase reapplies everything app changed from its old base over b, which
+// should be a Builder for the new base. The old and new bases are given as
+// the FSDigests of their filesystems.
+//
+// Paths app added, modified, or removed are added to or removed from b, and
+// everything else is left as the new base has it. Paths the new base changed
+// as well are reported as conflicts, and get the app's version. Only the
+// filesystem is rebased: the VCFG and icon of b are left unchanged. Large
+// files are cached in temporary files in tmp while they're compared, or in
+// the system's default temporary directory if tmp is empty.
+func Rebase(b Builder, app Reader, oldBase, newBase map[string]string, tmp string) (*RebaseReport, error) {
+
+	report := &RebaseReport{
+		Changes:   make([]string, 0),
+		Conflicts: make([]RebaseConflict, 0),
+	}
+
+	record := func(path, a string) {
+		o, n := oldBase[path], newBase[path]
+		report.Changes = append(report.Changes, "/"+path)
+		if n != o && n != a {
+			report.Conflicts = append(report.Conflicts, RebaseConflict{
+				Path: "/" + path,
+				App:  change(o, a),
+				Base: change(o, n),
+			})
+		}
+	}
+
+	secrets := make(map[string]bool)
+	for _, path := range BuildSecrets(app) {
+		secrets[path] = true
+	}
+
+	seen := make(map[string]bool)
+
+	err := app.FS().Walk(func(path string, f vio.File) error {
+
+		path = cleanFSPath(path)
+		if path == "" || secrets[path] {
+			return nil
+		}
+		seen[path] = true
+
+		if !f.IsDir() {
+			f = &rebaseFile{vio.CacheFile(f, 0, tmp)}
+		}
+
+		a, err := digest(f)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to read '/%s': %w", path, err)
+		}
+
+		if a == oldBase[path] {
+			return f.Close()
+		}
+
+		if cf, ok := f.(*rebaseFile); ok {
+			// start the next pass through the contents from the beginning
+			cf.CachedFile.Close()
+		}
+
+		record(path, a)
+
+		return b.AddToFS(path, f)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	removed := make([]string, 0)
+	for path := range oldBase {
+		if !seen[path] {
+			removed = append(removed, path)
+		}
+	}
+	sort.Strings(removed)
+
+	gone := make(map[string]bool)
+	for _, p := range removed {
+
+		record(p, "")
+
+		// everything under a removed directory went with it
+		if gone[path.Dir(p)] {
+			gone[p] = true
+			continue
+		}
+
+		if _, ok := newBase[p]; !ok {
+			continue
+		}
+
+		err = b.RemoveFromFS(p)
+		if err != nil {
+			return nil, err
+		}
+		gone[p] = true
+	}
+
+	sort.Strings(report.Changes)
+	sort.Slice(report.Conflicts, func(i, j int) bool {
+		return report.Conflicts[i].Path < report.Conflicts[j].Path
+	})
+
+	return report, nil
+}
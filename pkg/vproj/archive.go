@@ -0,0 +1,284 @@
+package vproj
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ArchiveSuffixes are the file extensions IsArchive recognises.
+var ArchiveSuffixes = []string{".zip", ".tar.gz", ".tgz"}
+
+// IsArchive returns true if path has the extension of an archive a project
+// can be extracted from.
+func IsArchive(path string) bool {
+	lpath := strings.ToLower(path)
+	for _, suffix := range ArchiveSuffixes {
+		if strings.HasSuffix(lpath, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExtractArchive unpacks the zip or gzipped tar archive at path into dir,
+// and returns the directory within it that contains the project. That's dir
+// itself, unless the project file is inside a single top-level directory,
+// as it is when a project directory is archived by name. Entries that would
+// be extracted outside of dir, or through a symlink, and symlinks that point
+// outside of dir are an error.
+func ExtractArchive(path, dir string) (string, error) {
+
+	dir = filepath.Clean(dir)
+
+	var err error
+	if strings.HasSuffix(strings.ToLower(path), ".zip") {
+		err = extractZip(path, dir)
+	} else {
+		err = extractTarGz(path, dir)
+	}
+	if err == nil {
+		err = checkSymlinks(dir)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to extract '%s': %w", path, err)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, FileName)); err == nil {
+		return dir, nil
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if len(fis) == 1 && fis[0].IsDir() {
+		root := filepath.Join(dir, fis[0].Name())
+		if _, err = os.Stat(filepath.Join(root, FileName)); err == nil {
+			return root, nil
+		}
+	}
+
+	return "", fmt.Errorf("no project in archive '%s'", path)
+}
+
+// archivePath returns where the archive entry name should be extracted to
+// within dir. Entries can't be extracted through a symlink written by an
+// earlier entry, because it could lead anywhere.
+func archivePath(dir, name string) (string, error) {
+
+	dpath := filepath.Join(dir, filepath.FromSlash(name))
+	if !inDir(dir, dpath) {
+		return "", fmt.Errorf("entry '%s' is outside of the archive", name)
+	}
+
+	rel, err := filepath.Rel(dir, dpath)
+	if err != nil {
+		return "", err
+	}
+
+	path := dir
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		if elem == "." {
+			continue
+		}
+		path = filepath.Join(path, elem)
+		fi, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("entry '%s' is inside of symlink '%s'", name, filepath.ToSlash(rel))
+		}
+	}
+
+	return dpath, nil
+}
+
+// inDir returns true if path is dir, or somewhere within it.
+func inDir(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// checkSymlinks returns an error if any symlink extracted into dir leads
+// outside of it once every symlink along the way has been followed, which
+// checking each target on its own can't catch.
+func checkSymlinks(dir string) error {
+
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+
+		target, err := filepath.EvalSymlinks(path)
+		if os.IsNotExist(err) {
+			// dangling symlinks don't lead anywhere
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !inDir(root, target) {
+			rel, _ := filepath.Rel(dir, path)
+			return fmt.Errorf("symlink '%s' leads outside of the archive", filepath.ToSlash(rel))
+		}
+
+		return nil
+	})
+}
+
+func extractFile(dpath string, mode os.FileMode, r io.Reader) error {
+
+	err := os.MkdirAll(filepath.Dir(dpath), 0777)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(dpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func extractSymlink(dir, dpath, target string) error {
+
+	if filepath.IsAbs(target) || strings.HasPrefix(target, "/") {
+		return fmt.Errorf("symlink '%s' has an absolute target '%s'", filepath.Base(dpath), target)
+	}
+
+	if !inDir(dir, filepath.Join(filepath.Dir(dpath), filepath.FromSlash(target))) {
+		return fmt.Errorf("symlink '%s' points outside of the archive to '%s'", filepath.Base(dpath), target)
+	}
+
+	err := os.MkdirAll(filepath.Dir(dpath), 0777)
+	if err != nil {
+		return err
+	}
+
+	return os.Symlink(target, dpath)
+}
+
+func extractTarGz(path, dir string) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		dpath, err := archivePath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(dpath, 0777)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(dpath, hdr.FileInfo().Mode(), tr)
+		case tar.TypeSymlink:
+			err = extractSymlink(dir, dpath, hdr.Linkname)
+		default:
+			// hard links, devices, and the like can't be part of a project
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(path, dir string) error {
+
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+
+		dpath, err := archivePath(dir, zf.Name)
+		if err != nil {
+			return err
+		}
+
+		mode := zf.Mode()
+		if mode.IsDir() {
+			err = os.MkdirAll(dpath, 0777)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+
+		if mode&os.ModeSymlink != 0 {
+			var target []byte
+			target, err = ioutil.ReadAll(rc)
+			if err == nil {
+				err = extractSymlink(dir, dpath, string(target))
+			}
+		} else {
+			err = extractFile(dpath, mode, rc)
+		}
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -141,28 +141,41 @@ func (p *Project) Target(name string) (*Target, error) {
 	targets := p.Project.Targets
 	l := len(targets)
 
-	t := new(Target)
-	t.Dir = p.Dir
-	t.Ignore = p.Project.IgnorePatterns
-
-	var found bool
-
 	for i := 0; i < l; i++ {
 		if (i == 0 && name == "") || targets[i].Name == name {
-			t.Name = targets[i].Name
-			t.Icon = targets[i].Icon
-			t.Files = targets[i].Files
-			t.VCFGs = targets[i].VCFGs
-			found = true
-			break
+			return p.target(i), nil
 		}
 	}
 
-	if !found {
-		return nil, fmt.Errorf("project target '%s' not found", name)
+	return nil, fmt.Errorf("project target '%s' not found", name)
+
+}
+
+// Targets returns every target defined in the project, in the order they are
+// defined.
+func (p *Project) Targets() []*Target {
+
+	targets := make([]*Target, len(p.Project.Targets))
+	for i := range p.Project.Targets {
+		targets[i] = p.target(i)
 	}
 
-	return t, nil
+	return targets
+
+}
+
+func (p *Project) target(i int) *Target {
+
+	data := p.Project.Targets[i]
+
+	return &Target{
+		Name:   data.Name,
+		Dir:    p.Dir,
+		Ignore: p.Project.IgnorePatterns,
+		Icon:   data.Icon,
+		VCFGs:  data.VCFGs,
+		Files:  data.Files,
+	}
 
 }
 
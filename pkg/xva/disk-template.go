@@ -0,0 +1,208 @@
+package xva
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+const diskVBDTemplate = `
+<value>
+	<struct>
+		<member>
+			<name>class</name>
+			<value>VBD</value>
+		</member>
+		<member>
+			<name>id</name>
+			<value>Ref:%d</value>
+		</member>
+		<member>
+			<name>snapshot</name>
+			<value>
+				<struct>
+					<member>
+						<name>uuid</name>
+						<value></value>
+					</member>
+					<member>
+						<name>VM</name>
+						<value>Ref:0</value>
+					</member>
+					<member>
+						<name>VDI</name>
+						<value>Ref:%d</value>
+					</member>
+					<member>
+						<name>device</name>
+						<value>%s</value>
+					</member>
+					<member>
+						<name>userdevice</name>
+						<value>%d</value>
+					</member>
+					<member>
+						<name>bootable</name>
+						<value>
+							<boolean>%d</boolean>
+						</value>
+					</member>
+					<member>
+						<name>mode</name>
+						<value>RW</value>
+					</member>
+					<member>
+						<name>type</name>
+						<value>Disk</value>
+					</member>
+					<member>
+						<name>unpluggable</name>
+						<value>
+							<boolean>0</boolean>
+						</value>
+					</member>
+					<member>
+						<name>storage_lock</name>
+						<value>
+							<boolean>0</boolean>
+						</value>
+					</member>
+					<member>
+						<name>empty</name>
+						<value>
+							<boolean>0</boolean>
+						</value>
+					</member>
+					<member>
+						<name>other_config</name>
+						<value>
+							<struct />
+						</value>
+					</member>
+					<member>
+						<name>currently_attached</name>
+						<value>
+							<boolean>0</boolean>
+						</value>
+					</member>
+					<member>
+						<name>status_code</name>
+						<value>0</value>
+					</member>
+					<member>
+						<name>status_detail</name>
+						<value />
+					</member>
+					<member>
+						<name>runtime_properties</name>
+						<value>
+							<struct />
+						</value>
+					</member>
+					<member>
+						<name>qos_algorithm_type</name>
+						<value />
+					</member>
+					<member>
+						<name>qos_algorithm_params</name>
+						<value>
+							<struct />
+						</value>
+					</member>
+					<member>
+						<name>qos_supported_algorithms</name>
+						<value>
+							<array>
+								<data />
+							</array>
+						</value>
+					</member>
+					<member>
+						<name>metrics</name>
+						<value>OpaqueRef:NULL</value>
+					</member>
+				</struct>
+			</value>
+		</member>
+	</struct>
+</value>`
+
+const diskVDITemplate = `
+<value>
+	<struct>
+		<member>
+			<name>class</name>
+			<value>VDI</value>
+		</member>
+		<member>
+			<name>id</name>
+			<value>Ref:%d</value>
+		</member>
+		<member>
+			<name>snapshot</name>
+			<value>
+				<struct>
+					<member>
+						<name>uuid</name>
+						<value></value>
+					</member>
+					<member>
+						<name>SR</name>
+						<value>Ref:5</value>
+					</member>
+					<member>
+						<name>virtual_size</name>
+						<value>%d</value>
+					</member>
+					<member>
+						<name>physical_utilisation</name>
+						<value>0</value>
+					</member>
+					<member>
+						<name>type</name>
+						<value>user</value>
+					</member>
+					<member>
+						<name>sharable</name>
+						<value>
+							<boolean>0</boolean>
+						</value>
+					</member>
+					<member>
+						<name>read_only</name>
+						<value>
+							<boolean>0</boolean>
+						</value>
+					</member>
+					<member>
+						<name>other_config</name>
+						<value>
+							<struct />
+						</value>
+					</member>
+					<member>
+						<name>storage_lock</name>
+						<value>
+							<boolean>0</boolean>
+						</value>
+					</member>
+					<member>
+						<name>managed</name>
+						<value>
+							<boolean>1</boolean>
+						</value>
+					</member>
+					<member>
+						<name>missing</name>
+						<value>
+							<boolean>0</boolean>
+						</value>
+					</member>
+					<member>
+						<name>parent</name>
+						<value>OpaqueRef:NULL</value>
+					</member>
+				</struct>
+			</value>
+		</member>
+	</struct>
+</value>`
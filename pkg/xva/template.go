@@ -0,0 +1,215 @@
+package xva
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on the MTU of a network interface in an XVA.
+const (
+	MinMTU = 68
+	MaxMTU = 65535
+)
+
+// MaxDisks is the most disks an XVA can attach to its VM, named xvda to xvdp.
+const MaxDisks = 16
+
+// XVAParams are the settings of the VM that an XVA's ova.xml describes.
+type XVAParams struct {
+	Name        string
+	Description string
+	Memory      int64 // in bytes
+	VCPUs       int
+	Disks       []int64 // in bytes, of each disk, the first being the raw disk image it boots from
+	MTUs        []uint  // one for each network interface, zero for the default
+}
+
+// Validate returns an error if the params can't be written to an ova.xml that
+// XenServer would import.
+func (p *XVAParams) Validate() error {
+
+	err := validateLabel("name", p.Name)
+	if err != nil {
+		return err
+	}
+
+	if p.Description != "" {
+		err = validateLabel("description", p.Description)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.Memory < 0 {
+		return fmt.Errorf("invalid memory: %d (should not be negative)", p.Memory)
+	}
+
+	if p.VCPUs < 0 {
+		return fmt.Errorf("invalid vcpus: %d (should not be negative)", p.VCPUs)
+	}
+
+	if len(p.Disks) == 0 {
+		return errors.New("no disks (should have at least the boot disk)")
+	}
+
+	if len(p.Disks) > MaxDisks {
+		return fmt.Errorf("too many disks: %d (should be no more than %d)", len(p.Disks), MaxDisks)
+	}
+
+	for i, size := range p.Disks {
+		if size <= 0 {
+			return fmt.Errorf("invalid size for disk %d: %d (should be larger than zero)", i, size)
+		}
+	}
+
+	for i, mtu := range p.MTUs {
+		if mtu != 0 && (mtu < MinMTU || mtu > MaxMTU) {
+			return fmt.Errorf("invalid mtu for network %d: %d (should be between %d and %d)", i, mtu, MinMTU, MaxMTU)
+		}
+	}
+
+	return nil
+}
+
+// validateLabel returns an error if s can't be used as the name or
+// description of a VM.
+func validateLabel(field, s string) error {
+
+	if strings.TrimSpace(s) == "" {
+		return fmt.Errorf("invalid %s: should not be empty", field)
+	}
+
+	if !utf8.ValidString(s) {
+		return fmt.Errorf("invalid %s '%s': not valid UTF-8", field, s)
+	}
+
+	for _, c := range s {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("invalid %s %q: contains control characters", field, s)
+		}
+	}
+
+	return nil
+}
+
+// BuildTemplate validates params, and returns the ova.xml of an XVA for a VM
+// with them. Text is escaped as it's filled in, and the result is checked to
+// parse as XML, so that mistakes are caught here rather than when the XVA is
+// imported.
+func BuildTemplate(params XVAParams) ([]byte, error) {
+
+	err := params.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	var networkVIFs string
+	var networkSettings string
+	for i, mtu := range params.MTUs {
+		vifID, netID := networkRefs(i)
+		if mtu == 0 {
+			mtu = 1500
+		}
+		networkVIFs += fmt.Sprintf(refTemplate, vifID)
+		networkSettings += fmt.Sprintf(networkSettingsTemplate, vifID, i, netID, mtu, netID, vifID, mtu)
+	}
+
+	var diskVBDs string
+	var diskSettings string
+	var diskVDIs string
+	for i, size := range params.Disks {
+		vbdID, vdiID := diskRefs(len(params.MTUs), i)
+		bootable := 0
+		if i == 0 {
+			bootable = 1
+		}
+		diskVBDs += fmt.Sprintf(refTemplate, vbdID)
+		diskSettings += fmt.Sprintf(diskVBDTemplate, vbdID, vdiID, diskDevice(i), i, bootable)
+		diskVDIs += fmt.Sprintf(diskVDITemplate, vdiID, size)
+	}
+
+	mem := params.Memory
+	s := fmt.Sprintf(ovaXMLTemplate, escapeText(params.Name), escapeText(params.Description),
+		mem, mem, mem, mem, params.VCPUs, params.VCPUs, networkVIFs, diskVBDs,
+		diskSettings, networkSettings, diskVDIs)
+
+	lines := strings.Split(s, "\n")
+	for i := 0; i < len(lines); i++ {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	s = strings.Join(lines, "")
+
+	// fmt marks substitutions that don't match their arguments with '%!'
+	if strings.Contains(s, "%!") {
+		return nil, errors.New("generated ova.xml has mismatched substitutions")
+	}
+
+	err = checkXML(s)
+	if err != nil {
+		return nil, fmt.Errorf("generated ova.xml is invalid: %v", err)
+	}
+
+	return []byte(s), nil
+}
+
+// networkRefs returns the ids of the VIF of network interface i, and of the
+// network it's attached to.
+func networkRefs(i int) (vif, network int) {
+	if i == 0 {
+		return 1, 2
+	}
+	return 2*i + 8, 2*i + 9
+}
+
+// diskRefs returns the ids of the VBD that attaches disk i to the VM, and of
+// the VDI holding its contents, in an ova.xml with n network interfaces. The
+// boot disk is always Ref:3 and Ref:4, and the ids of other disks follow the
+// last network's so that none of them overlap.
+func diskRefs(n, i int) (vbd, vdi int) {
+	if i == 0 {
+		return 3, 4
+	}
+	if n < 1 {
+		n = 1
+	}
+	vbd = 2*(n+i) + 6
+	return vbd, vbd + 1
+}
+
+// diskDevice returns the name of the device disk i is attached as.
+func diskDevice(i int) string {
+	return fmt.Sprintf("xvd%c", 'a'+i)
+}
+
+// escapeText returns s with the characters that are special in XML escaped.
+func escapeText(s string) string {
+	buf := new(bytes.Buffer)
+	_ = xml.EscapeText(buf, []byte(s))
+	return buf.String()
+}
+
+// checkXML returns an error if s isn't well-formed XML.
+func checkXML(s string) error {
+
+	dec := xml.NewDecoder(strings.NewReader(s))
+	for {
+		_, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
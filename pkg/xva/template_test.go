@@ -0,0 +1,96 @@
+package xva
+
+/**
+ * SPDX-License-Identifier: Apache-2.0
+ * Copyright 2020 vorteil.io Pty Ltd
+ */
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildTemplate(t *testing.T) {
+
+	params := XVAParams{
+		Name:        "Tom & Jerry's <app>",
+		Description: "Created by Vorteil",
+		Memory:      256 * 1024 * 1024,
+		VCPUs:       2,
+		Disks:       []int64{1024 * 1024 * 1024, 64 * 1024 * 1024},
+		MTUs:        []uint{0, 9000},
+	}
+
+	data, err := BuildTemplate(params)
+	assert.NoError(t, err)
+
+	// the name is escaped as it's filled in
+	s := string(data)
+	assert.Contains(t, s, "Tom &amp; Jerry&#39;s &lt;app&gt;")
+	assert.Contains(t, s, "<value>268435456</value>")
+	assert.Contains(t, s, "<value>1073741824</value>")
+	assert.Contains(t, s, "<value>67108864</value>")
+	assert.Contains(t, s, "<value>9000</value>")
+	assert.Equal(t, 2, strings.Count(s, "<value>VIF</value>"))
+	assert.Equal(t, 2, strings.Count(s, "<value>VBD</value>"))
+	assert.Equal(t, 2, strings.Count(s, "<value>VDI</value>"))
+
+	// the VM's arrays reference each VIF and VBD, and each VBD its VDI
+	assert.Contains(t, s, "<name>VIFs</name><value><array><data><value>Ref:1</value><value>Ref:10</value></data></array>")
+	assert.Contains(t, s, "<name>VBDs</name><value><array><data><value>Ref:3</value><value>Ref:12</value></data></array>")
+	assert.Contains(t, s, "<name>VDI</name><value>Ref:4</value></member><member><name>device</name><value>xvda</value>")
+	assert.Contains(t, s, "<name>VDI</name><value>Ref:13</value></member><member><name>device</name><value>xvdb</value>")
+	assert.Equal(t, 1, strings.Count(s, "<boolean>1</boolean></value></member><member><name>mode</name>"))
+
+	for _, mutate := range []func(p *XVAParams){
+		func(p *XVAParams) { p.Name = "" },
+		func(p *XVAParams) { p.Name = "app\x00" },
+		func(p *XVAParams) { p.Description = "a\nb" },
+		func(p *XVAParams) { p.Name = string([]byte{0xff, 0xfe}) },
+		func(p *XVAParams) { p.Memory = -1 },
+		func(p *XVAParams) { p.VCPUs = -1 },
+		func(p *XVAParams) { p.Disks = nil },
+		func(p *XVAParams) { p.Disks = []int64{1024, 0} },
+		func(p *XVAParams) { p.Disks = make([]int64, MaxDisks+1) },
+		func(p *XVAParams) { p.MTUs = []uint{1500, 20} },
+	} {
+		p := params
+		mutate(&p)
+		_, err = BuildTemplate(p)
+		assert.Error(t, err, "%+v", p)
+	}
+}
+
+func TestRefs(t *testing.T) {
+
+	// no two objects in an ova.xml may share an id, including the VM (0), the
+	// SR (5), the guest metrics (6) and the host (7, 8)
+	for networks := 0; networks < 8; networks++ {
+		used := map[int]bool{0: true, 5: true, 6: true, 7: true, 8: true}
+		use := func(id int) {
+			assert.False(t, used[id], "Ref:%d used twice with %d networks", id, networks)
+			used[id] = true
+		}
+		for i := 0; i < networks; i++ {
+			vif, network := networkRefs(i)
+			use(vif)
+			use(network)
+		}
+		for i := 0; i < MaxDisks; i++ {
+			vbd, vdi := diskRefs(networks, i)
+			use(vbd)
+			use(vdi)
+		}
+	}
+
+	assert.Equal(t, "xvda", diskDevice(0))
+	assert.Equal(t, "xvdp", diskDevice(MaxDisks-1))
+}
+
+func TestCheckXML(t *testing.T) {
+	assert.NoError(t, checkXML("<value><struct></struct></value>"))
+	assert.Error(t, checkXML("<value><struct></value>"))
+	assert.Error(t, checkXML("<value>a & b</value>"))
+}
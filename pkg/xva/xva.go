@@ -36,9 +36,10 @@ type Sizer interface {
 // XVA image is as simple as getting one of these writers and copying a raw
 // image into it.
 type Writer struct {
-	tw  *tar.Writer
-	h   Sizer
-	cfg *vcfg.VCFG
+	tw        *tar.Writer
+	h         Sizer
+	cfg       *vcfg.VCFG
+	dataDisks []int64
 
 	hdr    *tar.Header
 	hasher hash.Hash
@@ -48,12 +49,19 @@ type Writer struct {
 
 // NewWriter returns a Writer to which a RAW image can be copied in order to
 // create an XVA format disk image. The Sizer 'h' must accurately return the
-// true and final RAW size of the image.
-func NewWriter(w io.Writer, h Sizer, cfg *vcfg.VCFG) (*Writer, error) {
+// true and final RAW size of the image. Any dataDisks, in bytes, are attached
+// to the VM after the boot disk as empty disks, rounded up to a whole MiB.
+func NewWriter(w io.Writer, h Sizer, cfg *vcfg.VCFG, dataDisks ...int64) (*Writer, error) {
 
 	xw := new(Writer)
 	xw.h = h
 	xw.cfg = cfg
+	for _, size := range dataDisks {
+		if size > 0 {
+			size = (size + mib - 1) / mib * mib
+		}
+		xw.dataDisks = append(xw.dataDisks, size)
+	}
 	xw.tw = tar.NewWriter(w)
 
 	err := xw.writeOVAXML()
@@ -83,15 +91,18 @@ func (w *Writer) writeOVAXML() error {
 
 	// write ova.xml
 	hdr.Name = "ova.xml"
-	ova := w.ovaXML()
+	ova, err := w.ovaXML()
+	if err != nil {
+		return err
+	}
 	hdr.Size = int64(len(ova))
 
-	err := w.tw.WriteHeader(hdr)
+	err = w.tw.WriteHeader(hdr)
 	if err != nil {
 		return err
 	}
 
-	_, err = io.Copy(w.tw, strings.NewReader(ova))
+	_, err = w.tw.Write(ova)
 	if err != nil {
 		return err
 	}
@@ -145,7 +156,9 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 
 func (w *Writer) flushChunkHeader(chunk int64) error {
 
-	w.hdr.Name = filepath.Join("Ref:4", fmt.Sprintf("%08d", chunk))
+	// only the boot disk has data, the chunks of empty disks are all left out
+	_, vdiID := diskRefs(len(w.cfg.Networks), 0)
+	w.hdr.Name = filepath.Join(fmt.Sprintf("Ref:%d", vdiID), fmt.Sprintf("%08d", chunk))
 	w.hdr.Size = int64(mib)
 	err := w.tw.WriteHeader(w.hdr)
 	if err != nil {
@@ -247,7 +260,9 @@ func (w *Writer) Close() error {
 
 }
 
-func (w *Writer) ovaXML() string {
+// ovaXML returns the ova.xml describing a VM with the settings in the
+// writer's VCFG.
+func (w *Writer) ovaXML() ([]byte, error) {
 
 	cfg := w.cfg
 
@@ -259,36 +274,21 @@ func (w *Writer) ovaXML() string {
 	if description == "" {
 		description = "Created by Vorteil"
 	}
-	mem := int(cfg.VM.RAM)
-	cpus := int(cfg.VM.CPUs)
 
-	var networkVIFs string
-	var networkSettings string
+	mtus := make([]uint, len(cfg.Networks))
 	for i := range cfg.Networks {
-		vifID := 2*i + 8
-		netID := 2*i + 9
-		if i == 0 {
-			vifID = 1
-			netID = 2
-		}
-		mtu := cfg.Networks[i].MTU
-		if mtu == 0 {
-			mtu = 1500
-		}
-		networkVIFs += fmt.Sprintf(networkVIFTemplate, vifID)
-		networkSettings += fmt.Sprintf(networkSettingsTemplate, vifID, i, netID, mtu, netID, vifID, mtu)
-	}
-
-	s := fmt.Sprintf(ovaXMLTemplate, name, description, mem, mem, mem, mem, cpus, cpus, networkVIFs, networkSettings, w.h.Size())
-
-	lines := strings.Split(s, "\n")
-	for i := 0; i < len(lines); i++ {
-		lines[i] = strings.TrimSpace(lines[i])
+		mtus[i] = cfg.Networks[i].MTU
 	}
-	s = strings.Join(lines, "")
 
-	return s
+	return BuildTemplate(XVAParams{
+		Name:        name,
+		Description: description,
+		Memory:      int64(cfg.VM.RAM),
+		VCPUs:       int(cfg.VM.CPUs),
+		Disks:       append([]int64{w.h.Size()}, w.dataDisks...),
+		MTUs:        mtus,
+	})
 
 }
 
-const networkVIFTemplate = `<value>Ref:%d</value>`
+const refTemplate = `<value>Ref:%d</value>`